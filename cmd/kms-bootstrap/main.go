@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+
+	"my-kms/internal/auth"
+	"my-kms/internal/config"
+	"my-kms/internal/seal"
+	"my-kms/internal/storage"
+)
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: kms-bootstrap -admin <firebase uid> [-seal none|shamir|kek] [-keyring file] [-shares N] [-threshold K] [-kek source] [-out file] [-config file]")
+	os.Exit(2)
+}
+
+func main() {
+	flag.StringVar(&config.File, "config", config.File, "YAML or JSON configuration file, as for kms-server")
+	admin := flag.String("admin", "", "Firebase UID of the first platform admin")
+	sealType := flag.String("seal", "none", "how to keep the first master key: none (MASTER_KEYS), shamir or kek")
+	keyring := flag.String("keyring", "", "keyring file to create for -seal shamir or kek")
+	shares := flag.Int("shares", 5, "number of unseal shares for -seal shamir")
+	threshold := flag.Int("threshold", 3, "shares needed to unseal for -seal shamir")
+	kekSource := flag.String("kek", "", "KEK to encrypt the keyring under for -seal kek, as in SEAL_KEK_SOURCE")
+	out := flag.String("out", "kms-bootstrap.env", "file to write the generated settings to; it must not exist")
+	flag.Usage = usage
+	flag.Parse()
+	if *admin == "" || flag.NArg() > 0 {
+		usage()
+	}
+	switch *sealType {
+	case "none":
+	case "shamir", "kek":
+		if *keyring == "" {
+			log.Fatalf("-keyring is required with -seal %s", *sealType)
+		}
+		if *sealType == "kek" && *kekSource == "" {
+			log.Fatalf("-kek is required with -seal kek")
+		}
+	default:
+		log.Fatalf("Invalid -seal %q; expected none, shamir or kek", *sealType)
+	}
+	if _, err := os.Stat(*out); err == nil {
+		log.Fatalf("%s already exists; bootstrap writes a new file so no secret is overwritten", *out)
+	}
+
+	// 1. Load configuration
+	cfg, err := config.LoadConfig()
+	if err != nil {
+		log.Fatalf("Failed to load config: %v", err)
+	}
+	ctx := context.Background()
+
+	// 2. Create the schema and connect to the user store
+	users, err := connectUsers(ctx, cfg)
+	if err != nil {
+		log.Fatalf("Failed to prepare the %s user store: %v", cfg.StorageBackend, err)
+	}
+	defer users.Close(ctx)
+
+	// 3. Refuse to run twice: once there is an admin, users are managed through the API
+	admins, err := users.CountUsersWithRole(ctx, string(auth.RoleAdmin))
+	if err != nil {
+		log.Fatalf("Failed to count admins: %v", err)
+	}
+	if admins > 0 {
+		log.Fatalf("The deployment already has %d admin(s); add users with /create-user instead", admins)
+	}
+
+	// 4. Generate the first master key and the other secrets that are still unset
+	env := []string{"STORAGE_BACKEND=" + cfg.StorageBackend}
+	if cfg.MasterKeys != "" || cfg.SealType != "none" {
+		log.Printf("Master keys are already configured (SEAL_TYPE=%s); keeping them", cfg.SealType)
+	} else {
+		settings, err := createMasterKey(ctx, *sealType, *keyring, *kekSource, *shares, *threshold)
+		if err != nil {
+			log.Fatalf("Failed to create the master key: %v", err)
+		}
+		env = append(env, settings...)
+	}
+	if cfg.SnapshotKey == "" {
+		env = append(env, "SNAPSHOT_KEY="+randomKey())
+	}
+	if cfg.AttestationKey == "" {
+		env = append(env, "ATTESTATION_KEY="+randomKey())
+	}
+	header := fmt.Sprintf("# Written by kms-bootstrap at %s. It holds secrets: move them\n# into the server's secret store and delete this file.\n", time.Now().UTC().Format(time.RFC3339))
+	if err := os.WriteFile(*out, []byte(header+strings.Join(env, "\n")+"\n"), 0o600); err != nil {
+		log.Fatalf("Failed to write %s: %v", *out, err)
+	}
+	log.Printf("Wrote the generated settings to %s", *out)
+
+	// 5. Create the first admin
+	if err := users.UpsertUser(ctx, storage.User{FirebaseUID: *admin, Role: string(auth.RoleAdmin)}); err != nil {
+		log.Fatalf("Failed to create admin %s: %v", *admin, err)
+	}
+	log.Printf("Created platform admin %s", *admin)
+}
+
+// connectUsers opens the user store for STORAGE_BACKEND, bringing the schema up to
+// date first as kms-migrate would.
+func connectUsers(ctx context.Context, cfg *config.Config) (storage.UserStore, error) {
+	switch cfg.StorageBackend {
+	case "mongo":
+		if cfg.MongoURI == "" || cfg.MongoDBName == "" {
+			return nil, errors.New("MONGO_URI and MONGO_DB_NAME are required")
+		}
+		client, err := storage.ConnectMongo(cfg.MongoURI)
+		if err != nil {
+			return nil, err
+		}
+		applied, err := storage.MigrateMongo(ctx, client, cfg.MongoDBName, storage.MongoSchema{
+			Users: cfg.MongoUsersCollection,
+			DEKs:  cfg.MongoDEKCollection,
+		})
+		for _, name := range applied {
+			log.Printf("Applied %s", name)
+		}
+		if err != nil {
+			client.Disconnect(ctx)
+			return nil, err
+		}
+		return storage.NewMongoUserStoreFromClient(client, cfg.MongoDBName, cfg.MongoUsersCollection, cfg.MongoRolesCollection), nil
+	case "postgres":
+		return storage.NewPostgresUserStore(cfg.PostgresURL)
+	default:
+		return nil, fmt.Errorf("invalid STORAGE_BACKEND %q; expected mongo or postgres", cfg.StorageBackend)
+	}
+}
+
+// createMasterKey generates the first master key and returns the settings that give
+// it to the server. For shamir the unseal shares are printed once, to standard output.
+func createMasterKey(ctx context.Context, sealType, keyring, kekSource string, n, threshold int) ([]string, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	defer clear(key)
+	id := uuid.New().String()
+	if sealType == "none" {
+		log.Printf("Generated master key %s", id)
+		return []string{"MASTER_KEYS=" + id + ":" + base64.StdEncoding.EncodeToString(key)}, nil
+	}
+
+	keys := []storage.MasterKey{{ID: id, Key: key, CreatedAt: time.Now().UTC()}}
+	if sealType == "kek" {
+		kek, err := seal.FetchKEK(ctx, kekSource)
+		if err != nil {
+			return nil, err
+		}
+		defer clear(kek)
+		if err := seal.InitKEK(keyring, keys, kek); err != nil {
+			return nil, err
+		}
+		log.Printf("Keyring %s holds master key %s", keyring, id)
+		return []string{"SEAL_TYPE=kek", "SEAL_KEYRING_FILE=" + keyring, "SEAL_KEK_SOURCE=" + kekSource}, nil
+	}
+
+	split, err := seal.Init(keyring, keys, n, threshold)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Keyring %s holds master key %s", keyring, id)
+	fmt.Printf("Unseal shares (any %d of %d unseal the server). They are shown only once;\n", threshold, n)
+	fmt.Println("give each to a different holder and do not store them together.")
+	fmt.Println()
+	for i, s := range split {
+		fmt.Printf("Share %d: %s\n", i+1, base64.StdEncoding.EncodeToString(s))
+	}
+	fmt.Println()
+	return []string{"SEAL_TYPE=shamir", "SEAL_KEYRING_FILE=" + keyring}, nil
+}
+
+func randomKey() string {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		log.Fatalf("Failed to generate a key: %v", err)
+	}
+	return base64.StdEncoding.EncodeToString(key)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"my-kms/internal/config"
+	"my-kms/internal/storage"
+)
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: kms-migrate [-config file] [-status]")
+	os.Exit(2)
+}
+
+func main() {
+	flag.StringVar(&config.File, "config", config.File, "YAML or JSON configuration file, as for kms-server")
+	status := flag.Bool("status", false, "list pending migrations without applying them")
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() > 0 {
+		usage()
+	}
+
+	// 1. Load configuration
+	cfg, err := config.LoadConfig()
+	if err != nil {
+		log.Fatalf("Failed to load config: %v", err)
+	}
+	ctx := context.Background()
+
+	// 2. PostgreSQL migrates whenever it is connected to
+	if cfg.StorageBackend == "postgres" {
+		if *status {
+			log.Fatalf("-status is only supported for MongoDB; PostgreSQL migrations are listed in schema_migrations")
+		}
+		users, err := storage.NewPostgresUserStore(cfg.PostgresURL)
+		if err != nil {
+			log.Fatalf("Failed to migrate PostgreSQL: %v", err)
+		}
+		users.Close(ctx)
+		log.Printf("PostgreSQL schema is up to date")
+		if cfg.MongoURI == "" {
+			return
+		}
+	}
+
+	// 3. Connect to MongoDB
+	if cfg.MongoURI == "" || cfg.MongoDBName == "" {
+		log.Fatalf("MONGO_URI and MONGO_DB_NAME are required")
+	}
+	client, err := storage.ConnectMongo(cfg.MongoURI)
+	if err != nil {
+		log.Fatalf("Failed to connect to MongoDB: %v", err)
+	}
+	defer client.Disconnect(ctx)
+
+	// 4. List or apply the migrations
+	if *status {
+		pending, err := storage.PendingMongoMigrations(ctx, client, cfg.MongoDBName)
+		if err != nil {
+			log.Fatalf("Failed to check MongoDB migrations: %v", err)
+		}
+		if len(pending) == 0 {
+			fmt.Println("MongoDB schema is up to date")
+			return
+		}
+		fmt.Printf("Pending MongoDB migrations:\n  %s\n", strings.Join(pending, "\n  "))
+		return
+	}
+	applied, err := storage.MigrateMongo(ctx, client, cfg.MongoDBName, storage.MongoSchema{
+		Users: cfg.MongoUsersCollection,
+		DEKs:  cfg.MongoDEKCollection,
+	})
+	for _, name := range applied {
+		log.Printf("Applied %s", name)
+	}
+	if err != nil {
+		log.Fatalf("Failed to migrate MongoDB: %v", err)
+	}
+	log.Printf("MongoDB schema is up to date")
+}
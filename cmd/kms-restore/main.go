@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"my-kms/internal/backup"
+	"my-kms/internal/config"
+	"my-kms/internal/seal"
+	"my-kms/internal/storage"
+)
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: kms-restore -in <file> -recovery-key <private key PEM> -trusted-key <base64 Ed25519 key> [-dry-run] [-config file]")
+	os.Exit(2)
+}
+
+func main() {
+	flag.StringVar(&config.File, "config", config.File, "YAML or JSON configuration file, as for kms-server")
+	in := flag.String("in", "", "path of the backup taken from /backup")
+	recoveryKey := flag.String("recovery-key", "", "path of the PEM recovery private key")
+	trustedKey := flag.String("trusted-key", "", "base64 attestation public key of the deployment the backup came from")
+	dryRun := flag.Bool("dry-run", false, "verify and decrypt the backup without writing anything")
+	flag.Parse()
+	if *in == "" || *recoveryKey == "" || *trustedKey == "" {
+		usage()
+	}
+
+	// 1. Verify and decrypt the backup
+	contents, err := open(*in, *recoveryKey, *trustedKey)
+	if err != nil {
+		log.Fatalf("Failed to open backup: %v", err)
+	}
+	defer contents.Clear()
+	log.Printf("Backup taken by %s at %s: %d master keys (active %s), %d DEKs",
+		contents.CreatedBy, contents.CreatedAt.Format(time.RFC3339), len(contents.MasterKeys), contents.ActiveMasterKeyID, len(contents.DEKs))
+	if *dryRun {
+		return
+	}
+
+	// 2. Load configuration
+	cfg, err := config.LoadConfig()
+	if err != nil {
+		log.Fatalf("Failed to load config: %v", err)
+	}
+
+	// 3. Load the master keys of the deployment being restored into
+	masterKeyStore, err := loadMasterKeys(cfg)
+	if err != nil {
+		log.Fatalf("Failed to load master keys: %v", err)
+	}
+	defer masterKeyStore.Close(context.Background())
+
+	// 4. Connect to the DEK store
+	var dekStore storage.DEKStore
+	switch cfg.StorageBackend {
+	case "mongo":
+		dekStore, err = storage.NewMongoDEKStore(cfg.MongoURI, cfg.MongoDBName, cfg.MongoDEKCollection)
+	case "postgres":
+		dekStore, err = storage.NewPostgresDEKStore(cfg.PostgresURL)
+	default:
+		log.Fatalf("Invalid STORAGE_BACKEND %q; expected mongo or postgres", cfg.StorageBackend)
+	}
+	if err != nil {
+		log.Fatalf("Failed to create the %s DEK store: %v", cfg.StorageBackend, err)
+	}
+	defer dekStore.Close(context.Background())
+	dekStore = storage.NewSealedDEKStore(dekStore, masterKeyStore, cfg.EncryptDEKMetadata)
+
+	if err := restore(context.Background(), contents, dekStore, masterKeyStore); err != nil {
+		log.Fatalf("Restore failed: %v", err)
+	}
+}
+
+func open(path, recoveryKeyPath, trustedKey string) (*backup.Contents, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pemBytes, err := os.ReadFile(recoveryKeyPath)
+	if err != nil {
+		return nil, err
+	}
+	recovery, err := backup.ParseRecoveryPrivateKey(pemBytes)
+	if err != nil {
+		return nil, err
+	}
+	trusted, err := base64.StdEncoding.DecodeString(trustedKey)
+	if err != nil || len(trusted) != ed25519.PublicKeySize {
+		return nil, errors.New("-trusted-key must be a base64 Ed25519 public key")
+	}
+	return backup.Open(data, recovery, trusted)
+}
+
+// loadMasterKeys opens the master keys the same way the server does for SEAL_TYPE,
+// reading unseal shares from standard input for shamir.
+func loadMasterKeys(cfg *config.Config) (*storage.MasterKeyStore, error) {
+	if cfg.SealType == "none" {
+		configMasterKeys, err := cfg.ParseMasterKeys()
+		if err != nil {
+			return nil, err
+		}
+		keys := make([]storage.MasterKey, len(configMasterKeys))
+		for i, mk := range configMasterKeys {
+			keys[i] = storage.MasterKey{ID: mk.ID, Key: mk.Key}
+		}
+		return storage.NewMasterKeyStore(keys)
+	}
+	if cfg.SealType != "shamir" && cfg.SealType != "kek" {
+		return nil, fmt.Errorf("unknown SEAL_TYPE %q; expected none, shamir or kek", cfg.SealType)
+	}
+
+	keys := storage.NewSealedMasterKeyStore()
+	unsealer, err := seal.NewUnsealer(cfg.SealKeyringFile, keys)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.SealType == "kek" {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		kek, err := seal.FetchKEK(ctx, cfg.SealKEKSource)
+		if err != nil {
+			return nil, err
+		}
+		defer clear(kek)
+		return keys, unsealer.UnsealWithKEK(kek)
+	}
+
+	stdin := bufio.NewReader(os.Stdin)
+	for keys.Sealed() {
+		st := unsealer.Status()
+		fmt.Fprintf(os.Stderr, "Unseal share (%d of %d): ", st.Progress+1, st.Threshold)
+		line, err := stdin.ReadString('\n')
+		if err != nil && line == "" {
+			return nil, fmt.Errorf("failed to read share: %w", err)
+		}
+		share, err := base64.StdEncoding.DecodeString(strings.TrimSpace(line))
+		if err != nil {
+			return nil, errors.New("the share is not valid base64")
+		}
+		if _, err := unsealer.Submit(share); err != nil {
+			return nil, err
+		}
+	}
+	return keys, nil
+}
+
+// restore inserts every DEK under its original ID, wrapping master-key DEKs under the
+// active master key of this deployment. Deleted DEKs keep their tombstone, so they stay
+// restorable for the rest of their retention.
+func restore(ctx context.Context, contents *backup.Contents, deks storage.DEKStore, keys *storage.MasterKeyStore) error {
+	var rewrapped, cmkWrapped int
+	for _, entry := range contents.DEKs {
+		doc := entry.Document
+		if entry.Key != nil {
+			wrapped, masterKeyID, err := keys.EncryptDataKey(ctx, entry.Key)
+			if err != nil {
+				return fmt.Errorf("DEK %s: %w", doc.ID.Hex(), err)
+			}
+			doc.DEK, doc.MasterKeyID = wrapped, masterKeyID
+			rewrapped++
+		} else {
+			cmkWrapped++
+		}
+		if _, err := deks.InsertDEK(ctx, doc); err != nil {
+			return fmt.Errorf("DEK %s: %w", doc.ID.Hex(), err)
+		}
+	}
+	_, active := keys.KeyIDs()
+	log.Printf("Restored %d DEKs under master key %s and %d wrapped by tenant CMKs", rewrapped, active, cmkWrapped)
+	if cmkWrapped > 0 {
+		log.Printf("Note: tenants must register their CMKs with this deployment before CMK-wrapped DEKs can be used")
+	}
+	return nil
+}
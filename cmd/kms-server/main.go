@@ -2,109 +2,1086 @@ package main
 
 import (
 	"context"
-	"log"
+	"flag"
+	"fmt"
+	"log/slog"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
 	firebase "firebase.google.com/go"
+	"go.mongodb.org/mongo-driver/mongo"
 	"google.golang.org/api/option"
 
+	"my-kms/internal/attest"
+	"my-kms/internal/auth"
+	"my-kms/internal/backup"
+	"my-kms/internal/cmk"
+	"my-kms/internal/compliance"
 	"my-kms/internal/config"
+	"my-kms/internal/crypto"
+	"my-kms/internal/dekcache"
+	"my-kms/internal/events"
+	"my-kms/internal/logging"
+	"my-kms/internal/metrics"
+	"my-kms/internal/ratelimit"
+	"my-kms/internal/seal"
+	"my-kms/internal/secmem"
 	"my-kms/internal/server"
+	"my-kms/internal/siem"
 	"my-kms/internal/storage"
+	"my-kms/internal/tracing"
+	"my-kms/internal/transform"
 )
 
 func main() {
-	log.Println("KMS server is starting...")
+	flag.StringVar(&config.File, "config", config.File, "YAML or JSON configuration file; environment variables override it")
+	flag.Parse()
+	logging.Infof("main", "KMS server is starting...")
 
 	// 1. Load configuration
 	cfg, err := config.LoadConfig()
 	if err != nil {
-		log.Fatalf("Failed to load config: %v", err)
+		logging.Fatalf("Failed to load config: %v", err)
+	}
+	if err := logging.Setup(os.Stderr, cfg.LogLevel, cfg.LogFormat); err != nil {
+		logging.Fatalf("Failed to set up logging: %v", err)
 	}
 
-	// 2. Parse master keys
-	configMasterKeys, err := cfg.ParseMasterKeys()
+	// 1b. Tracing goes up first so store connections are traced from the start
+	shutdownTracing, err := tracing.Setup(context.Background(), cfg.TracesExporter)
 	if err != nil {
-		log.Fatalf("Failed to parse master keys: %v", err)
+		logging.Fatalf("Failed to set up tracing: %v", err)
 	}
 
-	// Convert config.MasterKey to storage.MasterKey
-	storageMasterKeys := make([]storage.MasterKey, len(configMasterKeys))
-	for i, mk := range configMasterKeys {
-		storageMasterKeys[i] = storage.MasterKey{
-			ID:  mk.ID,
-			Key: mk.Key,
+	if cfg.LockKeyMemory {
+		if err := secmem.Enable(); err != nil {
+			logging.Fatalf("LOCK_KEY_MEMORY: %v (raise the memlock limit, e.g. ulimit -l or LimitMEMLOCK)", err)
 		}
+		logging.Infof("main", "Master keys are kept in locked memory")
 	}
 
-	// 3. Initialize MasterKeyStore
-	masterKeyStore, err := storage.NewMasterKeyStore(storageMasterKeys)
-	if err != nil {
-		log.Fatalf("Failed to initialize MasterKeyStore: %v", err)
+	// 2. Parse master keys, unless SEAL_TYPE keeps them in an encrypted keyring
+	var (
+		masterKeyStore *storage.MasterKeyStore
+		unsealer       *seal.Unsealer
+	)
+	switch cfg.SealType {
+	case "none":
+		if cfg.MasterKeys == "" {
+			logging.Fatalf("MASTER_KEYS is required unless SEAL_TYPE is shamir or kek")
+		}
+		configMasterKeys, err := cfg.ParseMasterKeys()
+		if err != nil {
+			logging.Fatalf("Failed to parse master keys: %v", err)
+		}
+
+		// Convert config.MasterKey to storage.MasterKey
+		storageMasterKeys := make([]storage.MasterKey, len(configMasterKeys))
+		for i, mk := range configMasterKeys {
+			storageMasterKeys[i] = storage.MasterKey{
+				ID:  mk.ID,
+				Key: mk.Key,
+			}
+		}
+
+		// 3. Initialize MasterKeyStore, which keeps its own copies
+		masterKeyStore, err = storage.NewMasterKeyStore(storageMasterKeys)
+		for _, mk := range configMasterKeys {
+			secmem.Zero(mk.Key)
+		}
+		if err != nil {
+			logging.Fatalf("Failed to initialize MasterKeyStore: %v", err)
+		}
+	case "shamir":
+		if cfg.MasterKeys != "" {
+			logging.Fatalf("MASTER_KEYS must not be set with SEAL_TYPE=shamir; the keys live in SEAL_KEYRING_FILE")
+		}
+		if cfg.SealKeyringFile == "" {
+			logging.Fatalf("SEAL_TYPE=shamir requires SEAL_KEYRING_FILE (create it with kmsctl init-seal)")
+		}
+		// 3. The MasterKeyStore stays empty until enough shares arrive at /unseal
+		masterKeyStore = storage.NewSealedMasterKeyStore()
+		unsealer, err = seal.NewUnsealer(cfg.SealKeyringFile, masterKeyStore)
+		if err != nil {
+			logging.Fatalf("Failed to open keyring: %v", err)
+		}
+		st := unsealer.Status()
+		logging.Warnf("main", "Starting sealed: %d of %d unseal shares are needed at /v1/unseal", st.Threshold, st.Shares)
+	case "kek":
+		if cfg.MasterKeys != "" {
+			logging.Fatalf("MASTER_KEYS must not be set with SEAL_TYPE=kek; the keys live in SEAL_KEYRING_FILE")
+		}
+		if cfg.SealKeyringFile == "" || cfg.SealKEKSource == "" {
+			logging.Fatalf("SEAL_TYPE=kek requires SEAL_KEYRING_FILE and SEAL_KEK_SOURCE (create the keyring with kmsctl init-seal -kek)")
+		}
+		// 3. Decrypt the keyring with the KEK; the unsealer stays to write rotations back
+		masterKeyStore = storage.NewSealedMasterKeyStore()
+		unsealer, err = seal.NewUnsealer(cfg.SealKeyringFile, masterKeyStore)
+		if err != nil {
+			logging.Fatalf("Failed to open keyring: %v", err)
+		}
+		fetchCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		kek, err := seal.FetchKEK(fetchCtx, cfg.SealKEKSource)
+		cancel()
+		if err != nil {
+			logging.Fatalf("Failed to fetch KEK: %v", err)
+		}
+		err = unsealer.UnsealWithKEK(kek)
+		secmem.Zero(kek)
+		if err != nil {
+			logging.Fatalf("Failed to decrypt keyring: %v", err)
+		}
+		logging.Infof("main", "Master keys decrypted from %s", cfg.SealKeyringFile)
+	default:
+		logging.Fatalf("Unknown SEAL_TYPE %q; expected none, shamir or kek", cfg.SealType)
 	}
 	defer masterKeyStore.Close(context.Background())
+	wrapMode, err := storage.ParseWrapMode(cfg.MasterKeyWrapMode)
+	if err != nil {
+		logging.Fatalf("Invalid MASTER_KEY_WRAP_MODE: %v", err)
+	}
+	if wrapMode == storage.WrapModeHybrid {
+		if cfg.SealType == "none" {
+			logging.Fatalf("MASTER_KEY_WRAP_MODE=%s needs SEAL_TYPE shamir or kek, since only rotated keys are created hybrid", wrapMode)
+		}
+		logging.Warnf("main", "New master keys wrap DEKs with %s, which is experimental", wrapMode)
+	}
+	masterKeyStore.SetNewKeyWrapMode(wrapMode)
+	metrics.NewGaugeFunc("kms_active_master_key_age_seconds",
+		"Seconds since the active master key became active (since startup for keys from MASTER_KEYS).",
+		func() float64 { return masterKeyStore.ActiveKeyAge().Seconds() })
 
-	// 4. Initialize MongoDB user store
-	userStore, err := storage.NewMongoUserStore(cfg.MongoURI, cfg.MongoDBName, cfg.MongoUsersCollection)
+	// 4. Initialize the user and DEK stores on the configured backend
+	err = storage.ConfigureMongoClients(storage.MongoClientConfig{
+		MaxPoolSize:            cfg.MongoMaxPoolSize,
+		MinPoolSize:            cfg.MongoMinPoolSize,
+		ServerSelectionTimeout: cfg.MongoServerSelectionTimeout,
+		SocketTimeout:          cfg.MongoSocketTimeout,
+		ReadPreference:         cfg.MongoReadPreference,
+	})
 	if err != nil {
-		log.Fatalf("Failed to create MongoUserStore: %v", err)
+		logging.Fatalf("Invalid MongoDB client settings: %v", err)
+	}
+	// Every MongoDB store shares one client, and so one connection pool. It is
+	// disconnected once, after the stores deferred below have closed.
+	var mongoClient *mongo.Client
+	if cfg.MongoURI != "" {
+		if cfg.MongoDBName == "" {
+			logging.Fatalf("MONGO_URI requires MONGO_DB_NAME")
+		}
+		mongoClient, err = storage.ConnectMongo(cfg.MongoURI)
+		if err != nil {
+			logging.Fatalf("Failed to connect to MongoDB: %v", err)
+		}
+		defer mongoClient.Disconnect(context.Background())
+	}
+	var userStore storage.UserStore
+	var dekStore storage.DEKStore
+	var mongoDEKs *storage.MongoDEKStore
+	switch cfg.StorageBackend {
+	case "mongo":
+		if cfg.MongoURI == "" || cfg.MongoDBName == "" {
+			logging.Fatalf("STORAGE_BACKEND=mongo requires MONGO_URI and MONGO_DB_NAME")
+		}
+		if cfg.MongoRetryAttempts < 1 || cfg.MongoRetryBackoff <= 0 || cfg.MongoAttemptTimeout < 0 || cfg.MongoBreakerThreshold < 0 || cfg.MongoBreakerCooldown <= 0 {
+			logging.Fatalf("MONGO_RETRY_ATTEMPTS must be at least 1, MONGO_RETRY_BACKOFF and MONGO_BREAKER_COOLDOWN positive, and MONGO_ATTEMPT_TIMEOUT and MONGO_BREAKER_THRESHOLD not negative")
+		}
+		migrateMongo(mongoClient, cfg)
+		mongoUsers := storage.NewMongoUserStoreFromClient(mongoClient, cfg.MongoDBName, cfg.MongoUsersCollection, cfg.MongoRolesCollection)
+		mongoDEKs = storage.NewMongoDEKStoreFromClient(mongoClient, cfg.MongoDBName, cfg.MongoDEKCollection)
+		breaker := storage.NewCircuitBreaker("MongoDB", storage.ResiliencePolicy{
+			MaxAttempts:      cfg.MongoRetryAttempts,
+			BaseDelay:        cfg.MongoRetryBackoff,
+			AttemptTimeout:   cfg.MongoAttemptTimeout,
+			BreakerThreshold: cfg.MongoBreakerThreshold,
+			BreakerCooldown:  cfg.MongoBreakerCooldown,
+		})
+		metrics.NewGaugeFunc("kms_mongo_circuit_open",
+			"1 while the circuit breaker in front of the MongoDB user and DEK stores is open.",
+			func() float64 {
+				if breaker.Open() {
+					return 1
+				}
+				return 0
+			})
+		userStore, dekStore = storage.NewResilientUserStore(mongoUsers, breaker), storage.NewResilientDEKStore(mongoDEKs, breaker)
+	case "postgres":
+		if cfg.PostgresURL == "" {
+			logging.Fatalf("STORAGE_BACKEND=postgres requires POSTGRES_URL")
+		}
+		pgUsers, err := storage.NewPostgresUserStore(cfg.PostgresURL)
+		if err != nil {
+			logging.Fatalf("Failed to create PostgresUserStore: %v", err)
+		}
+		pgDEKs, err := storage.NewPostgresDEKStore(cfg.PostgresURL)
+		if err != nil {
+			logging.Fatalf("Failed to create PostgresDEKStore: %v", err)
+		}
+		userStore, dekStore = pgUsers, pgDEKs
+	case "memory":
+		devUsers, err := cfg.ParseDevUsers()
+		if err != nil {
+			logging.Fatalf("Invalid DEV_USERS: %v", err)
+		}
+		users := make([]storage.User, len(devUsers))
+		for i, u := range devUsers {
+			users[i] = storage.User{FirebaseUID: u.UID, Role: u.Role, TenantID: u.Tenant}
+		}
+		logging.Warnf("main", "STORAGE_BACKEND=memory: users and DEKs are lost when the server stops")
+		userStore, dekStore = storage.NewMemoryUserStore(users...), storage.NewMemoryDEKStore()
+	default:
+		logging.Fatalf("Invalid STORAGE_BACKEND %q; expected mongo, postgres or memory", cfg.StorageBackend)
+	}
+	if cfg.DevUsers != "" && cfg.StorageBackend != "memory" {
+		logging.Fatalf("DEV_USERS requires STORAGE_BACKEND=memory")
 	}
 	defer userStore.Close(context.Background())
+	defer dekStore.Close(context.Background())
+
+	// 4a. Optionally read DEKs from, and replicate them to, another region's cluster
+	var dekReplicator *storage.DEKReplicator
+	if cfg.MongoReplicaURI != "" {
+		if mongoDEKs == nil {
+			logging.Fatalf("MONGO_REPLICA_URI requires STORAGE_BACKEND=mongo")
+		}
+		replicaDBName := cfg.MongoReplicaDBName
+		if replicaDBName == "" {
+			replicaDBName = cfg.MongoDBName
+		}
+		replicaDEKs, err := storage.NewMongoDEKStore(cfg.MongoReplicaURI, replicaDBName, cfg.MongoDEKCollection)
+		if err != nil {
+			logging.Fatalf("Failed to connect to the replica DEK store: %v", err)
+		}
+		defer replicaDEKs.Close(context.Background())
+		dekStore = storage.NewFailoverDEKStore(dekStore, replicaDEKs)
+		if cfg.DEKReplication {
+			dekReplicator = storage.NewDEKReplicator(mongoDEKs, replicaDEKs, cfg.MongoReplicationStateCollection)
+		}
+		logging.Infof("main", "DEK reads fall back to the replica cluster (replication %t)", cfg.DEKReplication)
+	} else if cfg.DEKReplication {
+		logging.Fatalf("DEK_REPLICATION requires MONGO_REPLICA_URI")
+	}
+
+	// 4b. Optionally cache wrapped DEKs in Redis, shared by every replica
+	var dekCache *dekcache.Cache
+	if cfg.DEKCache {
+		if cfg.RedisURL == "" {
+			logging.Fatalf("DEK_CACHE requires REDIS_URL")
+		}
+		dekCache, err = dekcache.New(dekStore, cfg.RedisURL, cfg.DEKCacheTTL, cfg.DEKCacheLocalTTL)
+		if err != nil {
+			logging.Fatalf("Failed to create DEK cache: %v", err)
+		}
+		defer dekCache.Close(context.Background())
+		logging.Infof("main", "Caching DEKs in Redis for %s (%s in process)", cfg.DEKCacheTTL, cfg.DEKCacheLocalTTL)
+	}
+
+	// 5. The remaining stores live in MongoDB. Without MONGO_URI (possible only with
+	// STORAGE_BACKEND=postgres or memory) they stay nil and the features they back are disabled.
+	var (
+		clientStore       *storage.MongoClientStore
+		importTokenStore  *storage.MongoImportTokenStore
+		aliasStore        *storage.MongoAliasStore
+		grantStore        *storage.MongoGrantStore
+		legalHoldStore    *storage.MongoLegalHoldStore
+		tenantKeyStore    *storage.MongoTenantKeyStore
+		apiKeyStore       *storage.MongoAPIKeyStore
+		locationStore     *storage.MongoCiphertextLocationStore
+		handoffTokenStore *storage.MongoHandoffTokenStore
+		auditStore        *storage.MongoAuditStore
+		usageStore        *storage.MongoUsageStore
+		indexKeyStore     *storage.MongoIndexKeyStore
+		keyRotationStore  *storage.MongoKeyRotationStore
+		nonceCounterStore *storage.MongoNonceCounterStore
+		caStore           *storage.MongoCAStore
+		signingKeyStore   *storage.MongoSigningKeyStore
+		idempotencyStore  *storage.MongoIdempotencyStore
+		revocationStore   *storage.MongoRevocationStore
+		lockStore         *storage.MongoLockStore
+		outboxStore       *storage.MongoOutboxStore
+	)
+	if cfg.MongoURI == "" {
+		logging.Warnf("main", "MONGO_URI is not set: aliases, grants, API keys, audit events and the other MongoDB-backed features are disabled")
+		if cfg.Quotas != "" {
+			logging.Fatalf("QUOTAS requires MONGO_URI")
+		}
+	} else {
+		// 5b. Initialize MongoDB client fingerprint store
+		clientStore = storage.NewMongoClientStoreFromClient(mongoClient, cfg.MongoDBName, cfg.MongoClientsCollection)
+
+		// 5c. Initialize MongoDB import token store
+		importTokenStore = storage.NewMongoImportTokenStoreFromClient(mongoClient, cfg.MongoDBName, cfg.MongoImportTokensCollection)
+
+		// 5d. Initialize MongoDB alias store
+		aliasStore = storage.NewMongoAliasStoreFromClient(mongoClient, cfg.MongoDBName, cfg.MongoAliasesCollection)
 
-	// 5. Initialize MongoDB DEK store
-	dekStore, err := storage.NewMongoDEKStore(cfg.MongoURI, cfg.MongoDBName, cfg.MongoDEKCollection)
+		// 5e. Initialize MongoDB grant store
+		grantStore = storage.NewMongoGrantStoreFromClient(mongoClient, cfg.MongoDBName, cfg.MongoGrantsCollection)
+
+		// 5f. Initialize MongoDB legal hold store
+		legalHoldStore = storage.NewMongoLegalHoldStoreFromClient(mongoClient, cfg.MongoDBName, cfg.MongoLegalHoldsCollection)
+
+		// 5g. Initialize MongoDB tenant CMK store
+		tenantKeyStore = storage.NewMongoTenantKeyStoreFromClient(mongoClient, cfg.MongoDBName, cfg.MongoTenantKeysCollection)
+
+		// 5h. Initialize MongoDB API key store
+		apiKeyStore = storage.NewMongoAPIKeyStoreFromClient(mongoClient, cfg.MongoDBName, cfg.MongoAPIKeysCollection)
+
+		// 5i. Initialize MongoDB ciphertext location registry
+		locationStore = storage.NewMongoCiphertextLocationStoreFromClient(mongoClient, cfg.MongoDBName, cfg.MongoCiphertextLocationsCollection)
+
+		// 5j. Initialize MongoDB handoff token store
+		handoffTokenStore = storage.NewMongoHandoffTokenStoreFromClient(mongoClient, cfg.MongoDBName, cfg.MongoHandoffTokensCollection)
+
+		// 5k. Initialize MongoDB audit event store
+		auditStore, err = storage.NewMongoAuditStoreFromClient(mongoClient, cfg.MongoDBName, cfg.MongoAuditCollection, cfg.MongoAuditCheckpointsCollection)
+		if err != nil {
+			logging.Fatalf("Failed to create MongoAuditStore: %v", err)
+		}
+		defer auditStore.Close(context.Background())
+
+		// 5l. Initialize MongoDB usage counter store
+		if cfg.UsageMetering {
+			usageStore, err = storage.NewMongoUsageStoreFromClient(mongoClient, cfg.MongoDBName, cfg.MongoUsageCollection)
+			if err != nil {
+				logging.Fatalf("Failed to create MongoUsageStore: %v", err)
+			}
+		} else if cfg.Quotas != "" {
+			logging.Fatalf("QUOTAS requires USAGE_METERING")
+		}
+
+		// 5m. Initialize MongoDB blind index key store
+		indexKeyStore, err = storage.NewMongoIndexKeyStoreFromClient(mongoClient, cfg.MongoDBName, cfg.MongoIndexKeysCollection)
+		if err != nil {
+			logging.Fatalf("Failed to create MongoIndexKeyStore: %v", err)
+		}
+
+		// 5n. Initialize MongoDB key rotation history store
+		keyRotationStore, err = storage.NewMongoKeyRotationStoreFromClient(mongoClient, cfg.MongoDBName, cfg.MongoKeyRotationsCollection)
+		if err != nil {
+			logging.Fatalf("Failed to create MongoKeyRotationStore: %v", err)
+		}
+
+		// 5o. Initialize MongoDB encryption counter store for AES-GCM keys
+		nonceCounterStore = storage.NewMongoNonceCounterStoreFromClient(mongoClient, cfg.MongoDBName, cfg.MongoNonceCountersCollection)
+
+		// 5p. Initialize MongoDB certificate authority store
+		caStore, err = storage.NewMongoCAStoreFromClient(mongoClient, cfg.MongoDBName, cfg.MongoCAsCollection)
+		if err != nil {
+			logging.Fatalf("Failed to create MongoCAStore: %v", err)
+		}
+
+		// 5q. Initialize MongoDB JWT signing key store
+		signingKeyStore, err = storage.NewMongoSigningKeyStoreFromClient(mongoClient, cfg.MongoDBName, cfg.MongoSigningKeysCollection)
+		if err != nil {
+			logging.Fatalf("Failed to create MongoSigningKeyStore: %v", err)
+		}
+
+		// 5r. Initialize MongoDB idempotency key store
+		idempotencyStore, err = storage.NewMongoIdempotencyStoreFromClient(mongoClient, cfg.MongoDBName, cfg.MongoIdempotencyKeysCollection)
+		if err != nil {
+			logging.Fatalf("Failed to create MongoIdempotencyStore: %v", err)
+		}
+
+		// 5s. Initialize MongoDB principal revocation store
+		revocationStore = storage.NewMongoRevocationStoreFromClient(mongoClient, cfg.MongoDBName, cfg.MongoRevocationsCollection)
+
+		// 5t. Initialize MongoDB cluster lock store
+		lockStore = storage.NewMongoLockStoreFromClient(mongoClient, cfg.MongoDBName, cfg.MongoLocksCollection)
+
+		// 5u. Initialize MongoDB event outbox store
+		if cfg.EventBroker != "" {
+			outboxStore, err = storage.NewMongoOutboxStoreFromClient(mongoClient, cfg.MongoDBName, cfg.MongoEventOutboxCollection)
+			if err != nil {
+				logging.Fatalf("Failed to create MongoOutboxStore: %v", err)
+			}
+		}
+	}
+
+	// 6. Initialize Firebase; the memory backend may run with development tokens instead
+	var tokenVerifier server.TokenVerifier
+	if cfg.FirebaseServiceAccountPath == "" {
+		if cfg.StorageBackend != "memory" {
+			logging.Fatalf("FIREBASE_SERVICE_ACCOUNT_PATH is required unless STORAGE_BACKEND=memory")
+		}
+		logging.Warnf("main", "FIREBASE_SERVICE_ACCOUNT_PATH is not set: bearer tokens are taken as user IDs, for development only")
+		if cfg.CheckTokenRevocation {
+			logging.Warnf("main", "CHECK_TOKEN_REVOCATION has no effect on development tokens")
+		}
+		tokenVerifier = server.DevTokenVerifier{}
+	} else {
+		opt := option.WithCredentialsFile(cfg.FirebaseServiceAccountPath)
+		app, err := firebase.NewApp(context.Background(), nil, opt)
+		if err != nil {
+			logging.Fatalf("Failed to initialize Firebase App: %v", err)
+		}
+		firebaseAuth, err := app.Auth(context.Background())
+		if err != nil {
+			logging.Fatalf("Failed to get Firebase Auth client: %v", err)
+		}
+		tokenVerifier = firebaseAuth
+		if cfg.CheckTokenRevocation {
+			tokenVerifier = server.RevocationCheckingVerifier{Client: firebaseAuth}
+		}
+	}
+
+	// 7. Create the KMS server
+	kmsServer := server.NewServer(masterKeyStore, userStore, dekStore, tokenVerifier)
+	if cfg.SealType == "shamir" {
+		kmsServer.Unsealer = unsealer
+	}
+	if dekCache != nil {
+		kmsServer.DEKStore = dekCache
+	}
+	// Sealing sits above the cache, so Redis only ever holds sealed metadata.
+	kmsServer.DEKStore = storage.NewSealedDEKStore(kmsServer.DEKStore, masterKeyStore, cfg.EncryptDEKMetadata)
+	if cfg.EncryptDEKMetadata {
+		logging.Infof("main", "Encrypting DEK descriptions, tags and policies at rest")
+	}
+	kmsServer.TokenPolicy = auth.TokenTimePolicy{
+		ClockSkew: cfg.TokenClockSkew,
+		MaxAge:    cfg.TokenMaxAge,
+	}
+	if err := kmsServer.TokenPolicy.Validate(); err != nil {
+		logging.Fatalf("Invalid token policy: %v", err)
+	}
+	kmsServer.TenantClaim = cfg.TenantClaim
+	kmsServer.RoleClaim = cfg.RoleClaim
+	kmsServer.UserFallback, err = server.ParseUserFallbackMode(cfg.UserStoreFallback)
 	if err != nil {
-		log.Fatalf("Failed to create MongoDEKStore: %v", err)
+		logging.Fatalf("Invalid user store fallback: %v", err)
 	}
-	defer dekStore.Close(context.Background())
+	kmsServer.UserCacheMaxStaleness = cfg.UserCacheMaxStaleness
+	kmsServer.UserCacheTTL = cfg.UserCacheTTL
+	kmsServer.Failures, err = server.ParseFailurePolicy(cfg.FailureModes)
+	if err != nil {
+		logging.Fatalf("Invalid failure modes: %v", err)
+	}
+	kmsServer.Failures.Log()
+	kmsServer.LegacyRoutes, err = server.ParseLegacyRoutes(cfg.LegacyRoutes, cfg.LegacyRoutesSunset)
+	if err != nil {
+		logging.Fatalf("Invalid legacy routes settings: %v", err)
+	}
+	logging.Infof("main", "Failure mode: user-store fallback is %s", kmsServer.UserFallback)
+	policySource := cfg.PolicySource
+	if policySource == "" && cfg.PolicyFile != "" {
+		policySource = "file"
+	}
+	var loadPolicy auth.PolicyLoader
+	switch policySource {
+	case "", "builtin":
+	case "file":
+		loadPolicy = func(context.Context) (*auth.RulePolicy, error) {
+			return auth.LoadRulePolicy(cfg.PolicyFile)
+		}
+	case "mongo":
+		if cfg.MongoURI == "" {
+			logging.Fatalf("POLICY_SOURCE=mongo requires MONGO_URI")
+		}
+		policyStore := storage.NewMongoPolicyStoreFromClient(mongoClient, cfg.MongoDBName, cfg.MongoPoliciesCollection)
+		loadPolicy = policyStore.GetPolicy
+	default:
+		logging.Fatalf("Unknown POLICY_SOURCE %q", policySource)
+	}
+	if loadPolicy != nil {
+		if err := kmsServer.LoadPolicy(context.Background(), loadPolicy); err != nil {
+			logging.Fatalf("%v", err)
+		}
+	}
+	if err := kmsServer.LoadCustomRoles(context.Background()); err != nil {
+		logging.Fatalf("Failed to load custom roles: %v", err)
+	}
+	kmsServer.ClientCertMode, err = server.ParseClientCertMode(cfg.ClientCertMode)
+	if err != nil {
+		logging.Fatalf("Invalid client certificate mode: %v", err)
+	}
+	if cfg.ClientCertMappingPath != "" {
+		kmsServer.CertMapping, err = server.LoadCertMapping(cfg.ClientCertMappingPath)
+		if err != nil {
+			logging.Fatalf("Failed to load client certificate mapping: %v", err)
+		}
+	}
+	tlsMinVersion, err := cfg.ParseTLSMinVersion()
+	if err != nil {
+		logging.Fatalf("Invalid TLS settings: %v", err)
+	}
+	tlsConfig, err := server.ClientCertTLSConfig(kmsServer.ClientCertMode, cfg.TLSClientCAPath, tlsMinVersion)
+	if err != nil {
+		logging.Fatalf("Invalid client certificate settings: %v", err)
+	}
+	switch cfg.ListenMode {
+	case "https":
+		if cfg.TLSCertPath == "" || cfg.TLSKeyPath == "" {
+			logging.Fatalf("LISTEN_MODE=https requires TLS_CERT_PATH and TLS_KEY_PATH")
+		}
+	case "http":
+		if kmsServer.ClientCertMode != server.ClientCertOff {
+			logging.Fatalf("CLIENT_CERT_MODE=%s needs LISTEN_MODE=https; client certificates end at the proxy", kmsServer.ClientCertMode)
+		}
+		logging.Warnf("main", "LISTEN_MODE=http: serving plain HTTP, so TLS must be terminated by the proxy in front")
+	default:
+		logging.Fatalf("Invalid LISTEN_MODE %q; expected http or https", cfg.ListenMode)
+	}
+	kmsServer.TrustedProxies, err = server.ParseTrustedProxies(cfg.TrustedProxies)
+	if err != nil {
+		logging.Fatalf("Invalid TRUSTED_PROXIES: %v", err)
+	}
+	if cfg.ListenMode == "http" && len(kmsServer.TrustedProxies) == 0 {
+		logging.Warnf("main", "TRUSTED_PROXIES is not set: audit logs and per-IP rate limits will see the proxy's address")
+	}
+	kmsServer.AlgPolicy, err = crypto.ParseAlgorithmPolicy(cfg.AllowedAlgorithms, cfg.MinKeyBits)
+	if err != nil {
+		logging.Fatalf("Invalid algorithm policy: %v", err)
+	}
+
+	kmsServer.MaxPayloadBytes = cfg.MaxPayloadBytes
+	if cfg.MaxRequestBodyBytes <= 0 {
+		logging.Fatalf("MAX_REQUEST_BODY_BYTES must be positive")
+	}
+	kmsServer.MaxRequestBodyBytes = cfg.MaxRequestBodyBytes
+	if cfg.RequestTimeout < 0 {
+		logging.Fatalf("REQUEST_TIMEOUT must not be negative")
+	}
+	kmsServer.RequestTimeout = cfg.RequestTimeout
+	if kmsServer.EndpointTimeouts, err = server.ParseEndpointTimeouts(cfg.EndpointTimeouts); err != nil {
+		logging.Fatalf("Invalid ENDPOINT_TIMEOUTS: %v", err)
+	}
+	if cfg.ReadHeaderTimeout < 0 || cfg.ReadTimeout < 0 || cfg.WriteTimeout < 0 || cfg.IdleTimeout < 0 {
+		logging.Fatalf("READ_HEADER_TIMEOUT, READ_TIMEOUT, WRITE_TIMEOUT and IDLE_TIMEOUT must not be negative")
+	}
+	kmsServer.WriteTimeout = cfg.WriteTimeout
+
+	kmsServer.ClientStore = clientStore
+	kmsServer.Clients = server.NewClientTracker(clientStore, cfg.BlockedClientVersions)
+	kmsServer.ImportTokens = importTokenStore
+	kmsServer.ImportTokenTTL = cfg.ImportTokenTTL
+	kmsServer.HandoffTokens = handoffTokenStore
+	if usageStore != nil {
+		quotas, err := server.ParseQuotas(cfg.Quotas)
+		if err != nil {
+			logging.Fatalf("Invalid QUOTAS: %v", err)
+		}
+		kmsServer.Quotas = &server.Quotas{Store: usageStore, Limits: quotas}
+		for _, q := range quotas {
+			logging.Infof("main", "Quota: %s", q)
+		}
+	}
+	if cfg.GCMEncryptionLimit <= 0 || cfg.GCMEncryptionLimit > server.DefaultGCMEncryptionLimit {
+		logging.Fatalf("GCM_ENCRYPTION_LIMIT must be between 1 and %d", int64(server.DefaultGCMEncryptionLimit))
+	}
+	kmsServer.Nonces = server.NewNonceLedger(nonceCounterStore, cfg.GCMEncryptionLimit, cfg.GCMEncryptionLease)
+	if nonceCounterStore == nil {
+		logging.Warnf("main", "MONGO_URI is not set: AES-GCM encryption counts are kept per process and restart from zero")
+	}
+	masterKeyStore.SetWrapGuard(kmsServer.CountMasterKeyWrap)
+	kmsServer.HandoffTokenMaxTTL = cfg.HandoffTokenMaxTTL
+	kmsServer.Aliases = aliasStore
+	kmsServer.Grants = grantStore
+	kmsServer.IndexKeys = indexKeyStore
+	kmsServer.CAs = caStore
+	kmsServer.SigningKeys = signingKeyStore
+	kmsServer.SigningKeyRotationPeriod = cfg.SigningKeyRotationPeriod
+	if cfg.JWTMaxTTL <= 0 {
+		logging.Fatalf("JWT_MAX_TTL must be positive")
+	}
+	kmsServer.JWTMaxTTL = cfg.JWTMaxTTL
+	kmsServer.Idempotency = idempotencyStore
+	if cfg.IdempotencyKeyTTL <= 0 {
+		logging.Fatalf("IDEMPOTENCY_KEY_TTL must be positive")
+	}
+	kmsServer.IdempotencyKeyTTL = cfg.IdempotencyKeyTTL
+	kmsServer.CertificateProfiles = server.DefaultCertificateProfiles()
+	if cfg.CAProfilesFile != "" {
+		kmsServer.CertificateProfiles, err = server.LoadCertificateProfiles(cfg.CAProfilesFile)
+		if err != nil {
+			logging.Fatalf("Invalid CA_PROFILES_FILE: %v", err)
+		}
+	}
+	kmsServer.KeyRotations = keyRotationStore
+	if lockStore != nil {
+		hostname, _ := os.Hostname()
+		kmsServer.Locks = server.NewClusterLocks(lockStore, fmt.Sprintf("%s:%d", hostname, os.Getpid()), cfg.LockLease)
+	}
+	kmsServer.LegalHolds = legalHoldStore
+	kmsServer.Revocations = server.NewRevocationList(revocationStore)
+	if err := kmsServer.Revocations.Load(context.Background()); err != nil {
+		logging.Fatalf("Failed to load revoked principals: %v", err)
+	}
+	kmsServer.TenantCMKs = tenantKeyStore
+	kmsServer.APIKeys = apiKeyStore
+	kmsServer.CiphertextLocations = locationStore
 
-	// 6. Initialize Firebase
-	opt := option.WithCredentialsFile(cfg.FirebaseServiceAccountPath)
-	app, err := firebase.NewApp(context.Background(), nil, opt)
+	dlpMode, err := transform.ParseDLPMode(cfg.DLPMode)
 	if err != nil {
-		log.Fatalf("Failed to initialize Firebase App: %v", err)
+		logging.Fatalf("Invalid DLP mode: %v", err)
+	}
+	dlpRules := transform.DefaultDLPRules()
+	if cfg.DLPRulesFile != "" {
+		extra, err := transform.LoadDLPRules(cfg.DLPRulesFile)
+		if err != nil {
+			logging.Fatalf("Failed to load DLP rules: %v", err)
+		}
+		dlpRules = append(dlpRules, extra...)
 	}
-	firebaseAuth, err := app.Auth(context.Background())
+	kmsServer.DLP, err = transform.NewDLPScanner(dlpMode, dlpRules)
 	if err != nil {
-		log.Fatalf("Failed to get Firebase Auth client: %v", err)
+		logging.Fatalf("Invalid DLP rules: %v", err)
 	}
 
-	// 7. Create the KMS server
-	kmsServer := server.NewServer(masterKeyStore, userStore, dekStore, firebaseAuth)
+	if cfg.AttestationKey != "" {
+		attestationKey, err := cfg.ParseAttestationKey()
+		if err != nil {
+			logging.Fatalf("Invalid attestation key: %v", err)
+		}
+		configHash, err := attest.ConfigHash(cfg.Redacted())
+		if err != nil {
+			logging.Fatalf("Failed to hash configuration: %v", err)
+		}
+		keyProviders := []string{"master-keys"}
+		for _, p := range cmk.Implemented() {
+			keyProviders = append(keyProviders, "cmk:"+p)
+		}
+		kmsServer.Attestor, err = attest.NewSigner(attestationKey, configHash, keyProviders)
+		if err != nil {
+			logging.Fatalf("Failed to create attestation signer: %v", err)
+		}
+		logging.Infof("main", "Attestation enabled, config hash %s", configHash)
+	}
+	if cfg.BackupRecoveryKeyFile != "" {
+		if kmsServer.Attestor == nil {
+			logging.Fatalf("BACKUP_RECOVERY_KEY_FILE requires ATTESTATION_KEY to sign backups")
+		}
+		pemBytes, err := os.ReadFile(cfg.BackupRecoveryKeyFile)
+		if err != nil {
+			logging.Fatalf("Failed to read backup recovery key: %v", err)
+		}
+		kmsServer.BackupRecoveryKey, err = backup.ParseRecoveryPublicKey(pemBytes)
+		if err != nil {
+			logging.Fatalf("Invalid backup recovery key: %v", err)
+		}
+		logging.Infof("main", "Backups enabled under recovery key %s", backup.RecoveryKeyID(kmsServer.BackupRecoveryKey))
+	}
+	if auditStore != nil {
+		kmsServer.Audit = auditStore
+	}
+	kmsServer.MetricsToken = cfg.MetricsToken
+
+	var redisLimiter *ratelimit.Redis
+	if cfg.RateLimitBackend != "off" {
+		limits := &server.RateLimits{Fallback: ratelimit.NewMemory()}
+		if limits.IP, err = ratelimit.ParseLimit(cfg.RateLimitIP); err != nil {
+			logging.Fatalf("Invalid RATE_LIMIT_IP: %v", err)
+		}
+		if limits.Identity, err = ratelimit.ParseLimit(cfg.RateLimitIdentity); err != nil {
+			logging.Fatalf("Invalid RATE_LIMIT_IDENTITY: %v", err)
+		}
+		if limits.Endpoints, err = ratelimit.ParseEndpointLimits(cfg.RateLimitEndpoints); err != nil {
+			logging.Fatalf("Invalid RATE_LIMIT_ENDPOINTS: %v", err)
+		}
+		switch cfg.RateLimitBackend {
+		case "memory":
+			limits.Limiter = limits.Fallback
+		case "redis":
+			if cfg.RedisURL == "" {
+				logging.Fatalf("RATE_LIMIT_BACKEND=redis requires REDIS_URL")
+			}
+			redisLimiter, err = ratelimit.NewRedis(cfg.RedisURL)
+			if err != nil {
+				logging.Fatalf("Failed to create Redis rate limiter: %v", err)
+			}
+			defer redisLimiter.Close()
+			limits.Limiter = redisLimiter
+		default:
+			logging.Fatalf("Invalid RATE_LIMIT_BACKEND %q; expected memory, redis or off", cfg.RateLimitBackend)
+		}
+		kmsServer.RateLimits = limits
+		logging.Infof("main", "Rate limiting (%s): %s per IP, %s per identity and endpoint, %d endpoint overrides",
+			cfg.RateLimitBackend, limits.IP, limits.Identity, len(limits.Endpoints))
+	}
+	if cfg.ConcurrencyLimits != "off" {
+		limits, err := server.ParseConcurrencyLimits(cfg.ConcurrencyLimits)
+		if err != nil {
+			logging.Fatalf("Invalid CONCURRENCY_LIMITS: %v", err)
+		}
+		if cfg.ConcurrencyQueueTimeout <= 0 {
+			logging.Fatalf("CONCURRENCY_QUEUE_TIMEOUT must be positive")
+		}
+		kmsServer.Concurrency = server.NewConcurrencyLimiter(limits, cfg.ConcurrencyQueueTimeout)
+		logging.Infof("main", "Concurrency limits on %d endpoints, queueing for up to %s", len(limits), cfg.ConcurrencyQueueTimeout)
+	}
+	if cfg.AuditArchiveDir != "" && cfg.AuditRetention > 0 && cfg.AuditRetention <= cfg.AuditArchiveAfter {
+		logging.Fatalf("AUDIT_RETENTION must be longer than AUDIT_ARCHIVE_AFTER, or events expire before they are archived")
+	}
+	if cfg.AuditCheckpointInterval <= 0 {
+		logging.Fatalf("AUDIT_CHECKPOINT_INTERVAL must be positive")
+	}
+	if cfg.HealthCheckInterval <= 0 {
+		logging.Fatalf("HEALTH_CHECK_INTERVAL must be positive")
+	}
+	if cfg.AuditRetention > 0 && cfg.AuditRetention <= cfg.AuditCheckpointInterval {
+		logging.Fatalf("AUDIT_RETENTION must be longer than AUDIT_CHECKPOINT_INTERVAL, or the audit chain head can expire unsigned")
+	}
+	if auditStore != nil {
+		if err := auditStore.EnsureRetention(context.Background(), cfg.AuditRetention); err != nil {
+			logging.Fatalf("Failed to apply audit retention: %v", err)
+		}
+	}
+	sinks, err := siem.New(siem.Config{
+		SyslogAddr:    cfg.AuditSyslogAddr,
+		WebhookURL:    cfg.AuditWebhookURL,
+		WebhookSecret: cfg.AuditWebhookSecret,
+		KafkaRESTURL:  cfg.AuditKafkaRESTURL,
+		KafkaTopic:    cfg.AuditKafkaTopic,
+	})
+	if err != nil {
+		logging.Fatalf("Invalid audit sink settings: %v", err)
+	}
+	if len(sinks) > 0 {
+		if cfg.AuditSinkBufferSize <= 0 || cfg.AuditSinkBatchSize <= 0 || cfg.AuditSinkFlushInterval <= 0 {
+			logging.Fatalf("AUDIT_SINK_BUFFER_SIZE, AUDIT_SINK_BATCH_SIZE and AUDIT_SINK_FLUSH_INTERVAL must be positive")
+		}
+		kmsServer.SIEM = siem.NewForwarder(sinks, cfg.AuditSinkBufferSize)
+		logging.Infof("main", "Streaming audit events to %s", strings.Join(kmsServer.SIEM.Names(), ", "))
+	}
+	eventSinks, err := events.NewWebhooks(cfg.EventWebhookURLs, cfg.EventWebhookSecret)
+	if err != nil {
+		logging.Fatalf("Invalid event webhook settings: %v", err)
+	}
+	if cfg.EventsEnabled || len(eventSinks) > 0 {
+		if cfg.EventBufferSize <= 0 || cfg.EventBatchSize <= 0 || cfg.EventFlushInterval <= 0 {
+			logging.Fatalf("EVENT_BUFFER_SIZE, EVENT_BATCH_SIZE and EVENT_FLUSH_INTERVAL must be positive")
+		}
+		kmsServer.Events = events.NewBus(eventSinks, cfg.EventBufferSize)
+		if len(eventSinks) > 0 {
+			logging.Infof("main", "Sending key lifecycle events to %s", strings.Join(kmsServer.Events.Names(), ", "))
+		}
+	}
+	if cfg.EventBroker != "" {
+		if outboxStore == nil {
+			logging.Fatalf("EVENT_BROKER needs MONGO_URI for its outbox")
+		}
+		if cfg.EventOutboxBatchSize <= 0 || cfg.EventOutboxInterval <= 0 || cfg.EventOutboxRetention <= 0 {
+			logging.Fatalf("EVENT_OUTBOX_BATCH_SIZE, EVENT_OUTBOX_INTERVAL and EVENT_OUTBOX_RETENTION must be positive")
+		}
+		broker, err := events.NewBroker(cfg.EventBroker, cfg.EventBrokerURL, cfg.EventBrokerJetStream)
+		if err != nil {
+			logging.Fatalf("Invalid event broker settings: %v", err)
+		}
+		kmsServer.Outbox, err = events.NewOutbox(outboxStore, broker, cfg.EventBrokerTopic, cfg.EventBrokerAuditTopic)
+		if err != nil {
+			logging.Fatalf("Invalid event broker settings: %v", err)
+		}
+		logging.Infof("main", "Publishing key lifecycle events to %s topic %s through the MongoDB outbox", broker.Name(), cfg.EventBrokerTopic)
+		if kmsServer.Outbox.PublishesAudit() {
+			logging.Infof("main", "Publishing audit events to %s topic %s", broker.Name(), cfg.EventBrokerAuditTopic)
+		}
+	}
+
+	if cfg.UsageExportPath != "" {
+		kmsServer.Usage, err = server.NewUsageStats(cfg.UsageExportEpsilon, cfg.UsageExportPath)
+		if err != nil {
+			logging.Fatalf("Invalid usage export settings: %v", err)
+		}
+	}
+
+	if cfg.AWSKMSFacade {
+		kmsServer.AWSFacade = &server.AWSFacade{Region: cfg.AWSKMSRegion, AccountID: cfg.AWSKMSAccountID}
+	}
+	kmsServer.VaultTransit = cfg.VaultTransit
+
+	if cfg.DualControl {
+		kmsServer.DualControl = server.NewDualControl(cfg.DualControlTTL)
+	}
+
+	// Rotating or rewrapping onto a key nobody saves would leave DEKs under a key lost at
+	// restart, so both need the keyring
+	if cfg.SealType != "none" {
+		kmsServer.Rotation = server.NewRotationSchedule(cfg.MasterKeyRotationInterval, cfg.DEKRewrapBatchSize)
+		if cfg.MasterKeyRotationInterval > 0 {
+			logging.Infof("main", "Master key rotates every %s", cfg.MasterKeyRotationInterval)
+		}
+	} else if cfg.MasterKeyRotationInterval > 0 {
+		logging.Fatalf("MASTER_KEY_ROTATION_INTERVAL needs SEAL_TYPE shamir or kek, so rotated keys are persisted")
+	}
+
+	// 7b. Refuse to boot if the configuration violates the chosen compliance profile
+	if cfg.ComplianceProfile != "" {
+		profile, err := compliance.Lookup(cfg.ComplianceProfile)
+		if err != nil {
+			logging.Fatalf("Invalid compliance profile: %v", err)
+		}
+		if cfg.StorageBackend == "memory" {
+			logging.Fatalf("Compliance profile %s cannot be used with STORAGE_BACKEND=memory", profile.Name)
+		}
+		settings := compliance.Settings{
+			AlgorithmPolicy: kmsServer.AlgPolicy,
+			TLSMinVersion:   tlsMinVersion,
+			FIPSMode:        attest.FIPSMode(),
+			DualControl:     kmsServer.DualControl != nil,
+			FailOpen:        kmsServer.Failures.OpenSubsystems(),
+
+			MasterKeyRotationInterval: cfg.MasterKeyRotationInterval,
+		}
+		if kmsServer.Audit != nil {
+			settings.AuditSinks = append(settings.AuditSinks, "mongo")
+		}
+		if kmsServer.SIEM != nil {
+			settings.AuditSinks = append(settings.AuditSinks, "siem")
+		}
+		if kmsServer.Outbox != nil && kmsServer.Outbox.PublishesAudit() {
+			settings.AuditSinks = append(settings.AuditSinks, "event-broker")
+		}
+		if kmsServer.UserFallback != server.UserFallbackNone {
+			settings.FailOpen = append(settings.FailOpen, "user-store")
+		}
+		if err := profile.Check(settings); err != nil {
+			logging.Fatalf("%v", err)
+		}
+		logging.Infof("main", "Compliance profile %s (%s) satisfied", profile.Name, profile.Description)
+	}
+
+	// Deployment-specific payload transformers are registered here, e.g.
+	// kmsServer.Transformers.MustRegister(myDLPScanner{})
+
+	// Background jobs stop when the server shuts down, finishing the work in progress
+	jobs := server.NewJobs()
+	jobs.OnShutdown("tracing", shutdownTracing)
+	jobs.Go("dek-purge", func(ctx context.Context) { kmsServer.RunPurgeJob(ctx, cfg.DEKPurgeInterval, cfg.DEKRetention) })
+	jobs.Go("client-flush", func(ctx context.Context) { kmsServer.Clients.Run(ctx, cfg.ClientFlushInterval) })
+	jobs.Go("revocations", func(ctx context.Context) { kmsServer.Revocations.Run(ctx, cfg.RevocationRefreshInterval) })
+	if dekCache != nil {
+		jobs.Go("dek-cache", func(ctx context.Context) { dekCache.Run(ctx) })
+	}
+	if kmsServer.Usage != nil {
+		jobs.Go("usage-export", func(ctx context.Context) { kmsServer.Usage.Run(ctx, cfg.UsageExportInterval) })
+	}
+	if kmsServer.Audit != nil {
+		if cfg.AuditArchiveDir != "" {
+			jobs.Go("audit-archive", func(ctx context.Context) {
+				kmsServer.RunAuditArchive(ctx, cfg.AuditArchiveInterval, cfg.AuditArchiveAfter, cfg.AuditArchiveDir)
+			})
+		}
+		jobs.Go("audit-checkpoints", func(ctx context.Context) { kmsServer.RunAuditCheckpoints(ctx, cfg.AuditCheckpointInterval) })
+	}
+	if kmsServer.Outbox != nil {
+		jobs.Go("event-relay", func(ctx context.Context) {
+			kmsServer.RunEventRelay(ctx, cfg.EventOutboxInterval, cfg.EventOutboxBatchSize, cfg.EventOutboxRetention)
+		})
+	}
+	if kmsServer.Events != nil {
+		jobs.Go("events", func(ctx context.Context) { kmsServer.Events.Run(ctx, cfg.EventBatchSize, cfg.EventFlushInterval) })
+	}
+	if kmsServer.SIEM != nil {
+		jobs.Go("siem", func(ctx context.Context) { kmsServer.SIEM.Run(ctx, cfg.AuditSinkBatchSize, cfg.AuditSinkFlushInterval) })
+	}
+	if dekReplicator != nil {
+		jobs.Go("dek-replication", func(ctx context.Context) {
+			kmsServer.RunDEKReplication(ctx, dekReplicator, cfg.DEKReplicationRetryInterval)
+		})
+	}
+	if kmsServer.Rotation != nil {
+		jobs.Go("rotation-schedule", func(ctx context.Context) { kmsServer.RunRotationSchedule(ctx, cfg.MasterKeyRotationCheckInterval) })
+	}
+	// The dependency checks run once as part of warm-up and then every
+	// HEALTH_CHECK_INTERVAL, so /readyz drops to 503 when a store, the master keys or
+	// Firebase become unavailable.
+	healthChecks := []server.WarmupStep{
+		{Name: "master-keys", Run: func(context.Context) error { return masterKeyStore.SelfTest() }},
+		server.PingStep(cfg.StorageBackend+":users", userStore.Ping),
+		server.PingStep(cfg.StorageBackend+":deks", dekStore.Ping),
+	}
+	// The MongoDB stores share one client, so one ping covers all of them.
+	if mongoClient != nil {
+		healthChecks = append(healthChecks, server.PingStep("mongo", func(ctx context.Context) error {
+			return mongoClient.Ping(ctx, nil)
+		}))
+	}
+	if cfg.FirebaseServiceAccountPath != "" {
+		healthChecks = append(healthChecks, server.FirebaseKeysStep())
+	}
+	// A rate limiter that fails open is no reason to stop taking traffic.
+	if redisLimiter != nil && !kmsServer.Failures.FailsOpen(server.SubsystemRateLimiter) {
+		healthChecks = append(healthChecks, server.WarmupStep{Name: "redis:rate-limits", Run: func(ctx context.Context) error {
+			ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+			defer cancel()
+			return redisLimiter.Ping(ctx)
+		}})
+	}
+	warmup := append([]server.WarmupStep{
+		{Name: "crypto-self-test", Run: func(context.Context) error { return crypto.SelfTest() }},
+	}, healthChecks...)
+	warmup = append(warmup, server.WarmupStep{Name: "custom-roles", Run: kmsServer.LoadCustomRoles})
+	jobs.Go("warmup", func(ctx context.Context) { kmsServer.RunWarmup(ctx, warmup, cfg.WarmupRetryInterval) })
+	jobs.Go("health-checks", func(ctx context.Context) { kmsServer.RunHealthChecks(ctx, healthChecks, cfg.HealthCheckInterval) })
+	if cfg.PolicyReloadInterval > 0 {
+		if loadPolicy != nil {
+			jobs.Go("policy-reload", func(ctx context.Context) { auth.WatchPolicy(ctx, cfg.PolicyReloadInterval, loadPolicy) })
+		}
+		jobs.Go("role-reload", func(ctx context.Context) { kmsServer.RunRoleReload(ctx, cfg.PolicyReloadInterval) })
+	}
+
+	// SIGHUP and /admin/reload re-apply what can change without a restart
+	kmsServer.Reload = func(ctx context.Context) error {
+		return reloadConfig(ctx, kmsServer, dekCache, loadPolicy)
+	}
 
 	// 8. Setup routes
 	router := kmsServer.Routes()
 
-	// 9. Start HTTPS server with graceful shutdown
-	addr := ":8443"
+	// 9. Start the HTTPS (or, behind a TLS-terminating proxy, HTTP) server with graceful shutdown
+	addr := cfg.ListenAddr
 	httpServer := &http.Server{
-		Addr:    addr,
-		Handler: router,
+		Addr:      addr,
+		Handler:   router,
+		TLSConfig: tlsConfig,
+
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		ReadTimeout:       cfg.ReadTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
 	}
+	kmsServer.RegisterShutdown(httpServer)
 
 	go func() {
-		log.Printf("KMS server listening on %s", addr)
-		if err := httpServer.ListenAndServeTLS(cfg.TLSCertPath, cfg.TLSKeyPath); err != nil && err != http.ErrServerClosed {
-			log.Fatalf("Server error: %v", err)
+		logging.Infof("main", "KMS server listening on %s over %s (client certificates: %s)", addr, cfg.ListenMode, kmsServer.ClientCertMode)
+		var err error
+		if cfg.ListenMode == "http" {
+			err = httpServer.ListenAndServe()
+		} else {
+			err = httpServer.ListenAndServeTLS(cfg.TLSCertPath, cfg.TLSKeyPath)
+		}
+		if err != nil && err != http.ErrServerClosed {
+			logging.Fatalf("Server error: %v", err)
 		}
 	}()
 
-	// Handle graceful shutdown
-	stop := make(chan os.Signal, 1)
-	signal.Notify(stop, os.Interrupt)
-	<-stop
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := kmsServer.ReloadConfig(context.Background(), "SIGHUP"); err != nil {
+				logging.Errorf("main", "Configuration reload failed: %v", err)
+			}
+		}
+	}()
 
-	log.Println("Shutting down server...")
+	// Handle graceful shutdown on Ctrl-C and on SIGTERM, which Kubernetes sends
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	sig := <-stop
 
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	logging.Infof("main", "Received %s, shutting down server (drain timeout %s)...", sig, cfg.ShutdownTimeout)
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
 	defer cancel()
 
+	// In-flight requests finish first, then the background jobs and the shutdown hooks
 	if err := httpServer.Shutdown(ctx); err != nil {
-		log.Fatalf("Server forced to shutdown: %v", err)
+		logging.Errorf("main", "Server forced to shutdown: %v", err)
+	}
+	if err := jobs.Shutdown(ctx); err != nil {
+		logging.Errorf("main", "Shutdown incomplete: %v", err)
 	}
 
-	log.Println("Server gracefully stopped.")
+	logging.Infof("main", "Server gracefully stopped.")
+}
+
+// migrateMongo brings the MongoDB schema up to date, or with MONGO_MIGRATE=false warns
+// about migrations still to be run by kms-migrate.
+func migrateMongo(client *mongo.Client, cfg *config.Config) {
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Minute)
+	defer cancel()
+	if !cfg.MongoMigrate {
+		pending, err := storage.PendingMongoMigrations(ctx, client, cfg.MongoDBName)
+		if err != nil {
+			logging.Fatalf("Failed to check MongoDB migrations: %v", err)
+		}
+		if len(pending) > 0 {
+			logging.Warnf("main", "MONGO_MIGRATE=false and %d MongoDB migrations are pending (%s); run kms-migrate", len(pending), strings.Join(pending, ", "))
+		}
+		return
+	}
+	applied, err := storage.MigrateMongo(ctx, client, cfg.MongoDBName, storage.MongoSchema{
+		Users: cfg.MongoUsersCollection,
+		DEKs:  cfg.MongoDEKCollection,
+	})
+	if err != nil {
+		logging.Fatalf("Failed to migrate MongoDB: %v", err)
+	}
+	if len(applied) > 0 {
+		logging.Infof("main", "Applied MongoDB migrations: %s", strings.Join(applied, ", "))
+	}
+}
+
+// reloadConfig re-reads .env and applies the settings that can change without a
+// restart: rate limits, quotas, the authorization policy and custom roles, the log
+// level and cache TTLs. Everything is parsed first, so a bad value changes nothing.
+// Other settings, such as backends and addresses, still need a restart.
+func reloadConfig(ctx context.Context, s *server.Server, dekCache *dekcache.Cache, loadPolicy auth.PolicyLoader) error {
+	cfg, err := config.ReloadConfig()
+	if err != nil {
+		return err
+	}
+
+	var ipLimit, identityLimit ratelimit.Limit
+	var endpointLimits map[string]ratelimit.Limit
+	if s.RateLimits != nil {
+		if ipLimit, err = ratelimit.ParseLimit(cfg.RateLimitIP); err != nil {
+			return fmt.Errorf("invalid RATE_LIMIT_IP: %w", err)
+		}
+		if identityLimit, err = ratelimit.ParseLimit(cfg.RateLimitIdentity); err != nil {
+			return fmt.Errorf("invalid RATE_LIMIT_IDENTITY: %w", err)
+		}
+		if endpointLimits, err = ratelimit.ParseEndpointLimits(cfg.RateLimitEndpoints); err != nil {
+			return fmt.Errorf("invalid RATE_LIMIT_ENDPOINTS: %w", err)
+		}
+	}
+	var quotas []server.Quota
+	if s.Quotas != nil {
+		if quotas, err = server.ParseQuotas(cfg.Quotas); err != nil {
+			return fmt.Errorf("invalid QUOTAS: %w", err)
+		}
+	}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(cfg.LogLevel)); err != nil {
+		return fmt.Errorf("invalid LOG_LEVEL %q", cfg.LogLevel)
+	}
+	if dekCache != nil && (cfg.DEKCacheTTL <= 0 || cfg.DEKCacheLocalTTL <= 0) {
+		return fmt.Errorf("DEK_CACHE_TTL and DEK_CACHE_LOCAL_TTL must be positive")
+	}
+	var policy *auth.RulePolicy
+	if loadPolicy != nil {
+		if policy, err = loadPolicy(ctx); err != nil {
+			return fmt.Errorf("failed to load authorization policy: %w", err)
+		}
+	}
+
+	if s.RateLimits != nil {
+		s.RateLimits.SetLimits(ipLimit, identityLimit, endpointLimits)
+		logging.Infof("main", "Rate limiting: %s per IP, %s per identity and endpoint, %d endpoint overrides",
+			ipLimit, identityLimit, len(endpointLimits))
+	}
+	if s.Quotas != nil {
+		s.Quotas.SetLimits(quotas)
+		for _, q := range quotas {
+			logging.Infof("main", "Quota: %s", q)
+		}
+	}
+	logging.SetLevel(cfg.LogLevel)
+	s.SetUserCacheTTLs(cfg.UserCacheTTL, cfg.UserCacheMaxStaleness)
+	if dekCache != nil {
+		dekCache.SetTTLs(cfg.DEKCacheTTL, cfg.DEKCacheLocalTTL)
+	}
+	if policy != nil {
+		auth.SetPolicyEngine(policy)
+	}
+	// Custom roles are read from the user store, which can fail after everything else
+	// has been applied; the roles already loaded stay in force then.
+	if err := s.LoadCustomRoles(ctx); err != nil {
+		return fmt.Errorf("settings applied, but custom roles could not be reloaded: %w", err)
+	}
+	return nil
 }
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"my-kms/internal/config"
+	"my-kms/internal/snapshot"
+	"my-kms/internal/storage"
+)
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: kms-snapshot capture -out <file> | restore -in <file>")
+	os.Exit(2)
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+
+	// 1. Load configuration
+	cfg, err := config.LoadConfig()
+	if err != nil {
+		log.Fatalf("Failed to load config: %v", err)
+	}
+	key, err := cfg.ParseSnapshotKey()
+	if err != nil {
+		log.Fatalf("Invalid snapshot key: %v", err)
+	}
+
+	// 2. Connect to the user store
+	var userStore storage.UserStore
+	switch cfg.StorageBackend {
+	case "mongo":
+		userStore, err = storage.NewMongoUserStore(cfg.MongoURI, cfg.MongoDBName, cfg.MongoUsersCollection, cfg.MongoRolesCollection)
+	case "postgres":
+		userStore, err = storage.NewPostgresUserStore(cfg.PostgresURL)
+	default:
+		log.Fatalf("Invalid STORAGE_BACKEND %q; expected mongo or postgres", cfg.StorageBackend)
+	}
+	if err != nil {
+		log.Fatalf("Failed to create the %s user store: %v", cfg.StorageBackend, err)
+	}
+	defer userStore.Close(context.Background())
+
+	ctx := context.Background()
+	switch os.Args[1] {
+	case "capture":
+		fs := flag.NewFlagSet("capture", flag.ExitOnError)
+		out := fs.String("out", "", "path to write the sealed snapshot to")
+		fs.Parse(os.Args[2:])
+		if *out == "" {
+			usage()
+		}
+		if err := capture(ctx, cfg, userStore, key, *out); err != nil {
+			log.Fatalf("Snapshot capture failed: %v", err)
+		}
+		log.Printf("Snapshot written to %s", *out)
+	case "restore":
+		fs := flag.NewFlagSet("restore", flag.ExitOnError)
+		in := fs.String("in", "", "path of the sealed snapshot to restore")
+		fs.Parse(os.Args[2:])
+		if *in == "" {
+			usage()
+		}
+		if err := restore(ctx, cfg, userStore, key, *in); err != nil {
+			log.Fatalf("Snapshot restore failed: %v", err)
+		}
+		log.Printf("Snapshot %s restored", *in)
+	default:
+		usage()
+	}
+}
+
+func capture(ctx context.Context, cfg *config.Config, users storage.UserStore, key []byte, path string) error {
+	userList, err := users.ListUsers(ctx)
+	if err != nil {
+		return err
+	}
+	roles, err := users.ListRoles(ctx)
+	if err != nil {
+		return err
+	}
+
+	snap := &snapshot.Snapshot{
+		Version:   snapshot.FormatVersion,
+		CreatedAt: time.Now().UTC(),
+		Settings: snapshot.Settings{
+			StorageBackend:       cfg.StorageBackend,
+			MongoDBName:          cfg.MongoDBName,
+			MongoUsersCollection: cfg.MongoUsersCollection,
+			MongoDEKCollection:   cfg.MongoDEKCollection,
+		},
+		Users: userList,
+		Roles: roles,
+	}
+
+	data, err := snapshot.Seal(snap, key)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0o600)
+}
+
+func restore(ctx context.Context, cfg *config.Config, users storage.UserStore, key []byte, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	snap, err := snapshot.Open(data, key)
+	if err != nil {
+		return err
+	}
+
+	if snap.Settings.MongoDBName != cfg.MongoDBName {
+		log.Printf("Note: snapshot was taken from database %q, restoring into %q", snap.Settings.MongoDBName, cfg.MongoDBName)
+	}
+
+	// Roles first, so restored users never reference an undefined role.
+	for _, role := range snap.Roles {
+		if err := users.UpsertRole(ctx, role); err != nil {
+			return fmt.Errorf("role %s: %w", role.Name, err)
+		}
+	}
+	for _, u := range snap.Users {
+		if err := users.UpsertUser(ctx, u); err != nil {
+			return fmt.Errorf("user %s: %w", u.FirebaseUID, err)
+		}
+	}
+	log.Printf("Restored %d roles and %d users from snapshot taken at %s", len(snap.Roles), len(snap.Users), snap.CreatedAt.Format(time.RFC3339))
+	return nil
+}
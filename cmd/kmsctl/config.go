@@ -0,0 +1,97 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// ctlConfig is where kmsctl finds the server and its credentials. The file
+// (KMSCTL_CONFIG, default ~/.config/kmsctl/config.json) is read first and the
+// KMS_* environment variables override it field by field.
+type ctlConfig struct {
+	URL        string `json:"url"`        // KMS_URL
+	Token      string `json:"token"`      // KMS_TOKEN, a Firebase ID token
+	APIKey     string `json:"apiKey"`     // KMS_API_KEY
+	CACert     string `json:"caCert"`     // KMS_CA_CERT, PEM file to trust instead of the system roots
+	ClientCert string `json:"clientCert"` // KMS_CLIENT_CERT, PEM file for mutual TLS
+	ClientKey  string `json:"clientKey"`  // KMS_CLIENT_KEY
+}
+
+// loadConfig reads the configuration. Credentials may be left out only when
+// requireCredentials is false, for the calls a sealed server takes without them.
+func loadConfig(requireCredentials bool) (*ctlConfig, error) {
+	cfg := &ctlConfig{}
+	path, explicit := os.LookupEnv("KMSCTL_CONFIG")
+	if !explicit {
+		if dir, err := os.UserConfigDir(); err == nil {
+			path = filepath.Join(dir, "kmsctl", "config.json")
+		}
+	}
+	if path != "" {
+		data, err := os.ReadFile(path)
+		switch {
+		case err == nil:
+			if info, statErr := os.Stat(path); statErr == nil && info.Mode().Perm()&0o077 != 0 {
+				fmt.Fprintf(os.Stderr, "kmsctl: warning: %s holds credentials and is readable by other users\n", path)
+			}
+			if err := json.Unmarshal(data, cfg); err != nil {
+				return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+			}
+		case explicit || !errors.Is(err, os.ErrNotExist):
+			return nil, fmt.Errorf("failed to read %s: %w", path, err)
+		}
+	}
+
+	for env, dst := range map[string]*string{
+		"KMS_URL":         &cfg.URL,
+		"KMS_TOKEN":       &cfg.Token,
+		"KMS_API_KEY":     &cfg.APIKey,
+		"KMS_CA_CERT":     &cfg.CACert,
+		"KMS_CLIENT_CERT": &cfg.ClientCert,
+		"KMS_CLIENT_KEY":  &cfg.ClientKey,
+	} {
+		if v := os.Getenv(env); v != "" {
+			*dst = v
+		}
+	}
+	if cfg.URL == "" {
+		return nil, errors.New("no server configured: set KMS_URL or url in the config file")
+	}
+	if requireCredentials && cfg.Token == "" && cfg.APIKey == "" && cfg.ClientCert == "" {
+		return nil, errors.New("no credentials configured: set KMS_TOKEN, KMS_API_KEY or a client certificate")
+	}
+	return cfg, nil
+}
+
+// httpClient applies the TLS settings.
+func (cfg *ctlConfig) httpClient() (*http.Client, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if cfg.CACert != "" {
+		pem, err := os.ReadFile(cfg.CACert)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA certificate: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", cfg.CACert)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if cfg.ClientCert != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.ClientCert, cfg.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	return &http.Client{Transport: transport, Timeout: 30 * time.Second}, nil
+}
@@ -0,0 +1,569 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"my-kms/pkg/kmsclient"
+)
+
+const usageText = `usage: kmsctl <command> [flags]
+
+commands:
+  generate-key  [-algorithm A] [-description D] [-tag k=v]...
+  encrypt       -key ID | -alias A [-context k=v]... [-deterministic] [-in file]
+  decrypt       -key ID | -alias A [-context k=v]... [-in file] [-out file]
+  hpke-open     -key ID | -alias A [-info S] [-aad S] [-in file] [-out file]
+  derive-key    -key ID | -alias A -info S [-salt S] [-size N]
+  issue-certificate -csr FILE [-ca NAME] [-profile P] [-ttl D] [-out FILE]
+  sign-jwt      [-key NAME] [-ttl D] [-claims JSON | -in file]
+  rotate
+  master-keys   [-json]
+  retire-master-key -id ID
+  backup        -out FILE
+  list-keys     [-state S] [-master-key ID] [-owner UID] [-tag k=v]... [-json]
+  audit tail    [-n N] [-f] [-interval D] [-action A] [-identity I] [-key ID] [-result R] [-json]
+  init-seal     -keyring FILE [-shares N] [-threshold K] | -kek SOURCE [-wrap-mode M]
+  unseal        [-reset]
+  seal-status
+  seal
+
+The server and credentials come from KMS_URL and KMS_TOKEN or KMS_API_KEY, or from
+the file named by KMSCTL_CONFIG (default ~/.config/kmsctl/config.json). init-seal
+runs locally and needs neither; unseal and seal-status need no credentials.`
+
+func usage() {
+	fmt.Fprintln(os.Stderr, usageText)
+	os.Exit(2)
+}
+
+// maxAuditPage is the most events /audit-logs returns per call.
+const maxAuditPage = 500
+
+// kvFlag collects repeated k=v flags.
+type kvFlag map[string]string
+
+func (f kvFlag) String() string { return "" }
+
+func (f kvFlag) Set(v string) error {
+	k, val, ok := strings.Cut(v, "=")
+	if !ok || k == "" {
+		return fmt.Errorf("%q is not key=value", v)
+	}
+	f[k] = val
+	return nil
+}
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("kmsctl: ")
+	if len(os.Args) < 2 {
+		usage()
+	}
+
+	if os.Args[1] == "init-seal" {
+		if err := initSeal(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	cfg, err := loadConfig(os.Args[1] != "unseal" && os.Args[1] != "seal-status")
+	if err != nil {
+		log.Fatal(err)
+	}
+	hc, err := cfg.httpClient()
+	if err != nil {
+		log.Fatal(err)
+	}
+	opts := []kmsclient.Option{kmsclient.WithHTTPClient(hc)}
+	if cfg.Token != "" {
+		token := cfg.Token
+		opts = append(opts, kmsclient.WithTokenSource(func(context.Context) (string, error) { return token, nil }))
+	}
+	if cfg.APIKey != "" {
+		opts = append(opts, kmsclient.WithAPIKey(cfg.APIKey))
+	}
+	client, err := kmsclient.New(cfg.URL, opts...)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer client.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	args := os.Args[2:]
+	switch os.Args[1] {
+	case "generate-key":
+		err = generateKey(ctx, client, args)
+	case "encrypt":
+		err = encrypt(ctx, client, args)
+	case "decrypt":
+		err = decrypt(ctx, client, args)
+	case "hpke-open":
+		err = hpkeOpen(ctx, client, args)
+	case "derive-key":
+		err = deriveKey(ctx, client, args)
+	case "issue-certificate":
+		err = issueCertificate(ctx, client, args)
+	case "sign-jwt":
+		err = signJWT(ctx, client, args)
+	case "rotate":
+		err = rotate(ctx, client, args)
+	case "master-keys":
+		err = masterKeys(ctx, client, args)
+	case "retire-master-key":
+		err = retireMasterKey(ctx, client, args)
+	case "backup":
+		err = takeBackup(ctx, client, args)
+	case "list-keys":
+		err = listKeys(ctx, client, args)
+	case "audit":
+		if len(args) == 0 || args[0] != "tail" {
+			usage()
+		}
+		err = auditTail(ctx, client, args[1:])
+	case "unseal":
+		err = unseal(ctx, client, args)
+	case "seal-status":
+		err = sealStatus(ctx, client, args)
+	case "seal":
+		err = sealServer(ctx, client, args)
+	default:
+		usage()
+	}
+	if err != nil && ctx.Err() == nil {
+		log.Fatal(err)
+	}
+}
+
+func generateKey(ctx context.Context, c *kmsclient.Client, args []string) error {
+	fs := flag.NewFlagSet("generate-key", flag.ExitOnError)
+	algorithm := fs.String("algorithm", "", "key algorithm (default AES_256_GCM)")
+	description := fs.String("description", "", "free-form description")
+	tags := kvFlag{}
+	fs.Var(tags, "tag", "tag as key=value; repeatable")
+	fs.Parse(args)
+
+	key, err := c.GenerateDataKey(ctx, kmsclient.GenerateDataKeyInput{Algorithm: *algorithm, Description: *description, Tags: tags})
+	if err != nil {
+		return err
+	}
+	return printJSON(key)
+}
+
+// keyFlags are the flags encrypt and decrypt share.
+type keyFlags struct {
+	keyID, alias, in string
+	context          kvFlag
+}
+
+func (k *keyFlags) register(fs *flag.FlagSet) {
+	k.context = kvFlag{}
+	fs.StringVar(&k.keyID, "key", "", "DEK ID")
+	fs.StringVar(&k.alias, "alias", "", "key alias, instead of -key")
+	fs.StringVar(&k.in, "in", "-", "input file; - for stdin")
+	fs.Var(k.context, "context", "encryption context as key=value; repeatable")
+}
+
+func (k *keyFlags) encryptionContext() map[string]string {
+	if len(k.context) == 0 {
+		return nil
+	}
+	return k.context
+}
+
+// encrypt reads the plaintext as raw bytes and prints the ciphertext as base64.
+func encrypt(ctx context.Context, c *kmsclient.Client, args []string) error {
+	fs := flag.NewFlagSet("encrypt", flag.ExitOnError)
+	var k keyFlags
+	k.register(fs)
+	deterministic := fs.Bool("deterministic", false, "required for AES_256_SIV keys")
+	fs.Parse(args)
+
+	plaintext, err := readInput(k.in)
+	if err != nil {
+		return err
+	}
+	defer clear(plaintext)
+	ct, err := c.Encrypt(ctx, kmsclient.EncryptInput{
+		KeyID:             k.keyID,
+		Alias:             k.alias,
+		Plaintext:         plaintext,
+		EncryptionContext: k.encryptionContext(),
+		Deterministic:     *deterministic,
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Println(base64.StdEncoding.EncodeToString(ct))
+	return nil
+}
+
+// decrypt reads a base64 ciphertext and writes the raw plaintext.
+func decrypt(ctx context.Context, c *kmsclient.Client, args []string) error {
+	fs := flag.NewFlagSet("decrypt", flag.ExitOnError)
+	var k keyFlags
+	k.register(fs)
+	out := fs.String("out", "-", "output file; - for stdout")
+	fs.Parse(args)
+
+	encoded, err := readInput(k.in)
+	if err != nil {
+		return err
+	}
+	ct, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(encoded)))
+	if err != nil {
+		return fmt.Errorf("ciphertext is not base64: %w", err)
+	}
+	plaintext, err := c.Decrypt(ctx, kmsclient.DecryptInput{KeyID: k.keyID, Alias: k.alias, Ciphertext: ct, EncryptionContext: k.encryptionContext()})
+	if err != nil {
+		return err
+	}
+	defer clear(plaintext)
+	if *out == "-" {
+		_, err = os.Stdout.Write(plaintext)
+		return err
+	}
+	return os.WriteFile(*out, plaintext, 0o600)
+}
+
+// hpkeOpen reads a base64 HPKE message, the encapsulated key followed by the
+// ciphertext, and writes the raw plaintext.
+func hpkeOpen(ctx context.Context, c *kmsclient.Client, args []string) error {
+	fs := flag.NewFlagSet("hpke-open", flag.ExitOnError)
+	keyID := fs.String("key", "", "DEK ID of the HPKE key pair")
+	alias := fs.String("alias", "", "key alias, instead of -key")
+	in := fs.String("in", "-", "input file; - for stdin")
+	info := fs.String("info", "", "HPKE info the sender used")
+	aad := fs.String("aad", "", "additional data the sender used")
+	out := fs.String("out", "-", "output file; - for stdout")
+	fs.Parse(args)
+
+	encoded, err := readInput(*in)
+	if err != nil {
+		return err
+	}
+	msg, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(encoded)))
+	if err != nil {
+		return fmt.Errorf("message is not base64: %w", err)
+	}
+	plaintext, err := c.HPKEOpen(ctx, kmsclient.HPKEOpenInput{KeyID: *keyID, Alias: *alias, Ciphertext: msg, Info: []byte(*info), AAD: []byte(*aad)})
+	if err != nil {
+		return err
+	}
+	defer clear(plaintext)
+	if *out == "-" {
+		_, err = os.Stdout.Write(plaintext)
+		return err
+	}
+	return os.WriteFile(*out, plaintext, 0o600)
+}
+
+// deriveKey prints the derived key as base64.
+func deriveKey(ctx context.Context, c *kmsclient.Client, args []string) error {
+	fs := flag.NewFlagSet("derive-key", flag.ExitOnError)
+	keyID := fs.String("key", "", "DEK ID of the HKDF_SHA256 root secret")
+	alias := fs.String("alias", "", "key alias, instead of -key")
+	info := fs.String("info", "", "what the derived key is for; required")
+	salt := fs.String("salt", "", "optional salt")
+	size := fs.Int("size", 0, "key size in bytes (default 32)")
+	fs.Parse(args)
+
+	key, err := c.DeriveKey(ctx, kmsclient.DeriveKeyInput{KeyID: *keyID, Alias: *alias, Info: []byte(*info), Salt: []byte(*salt), Size: *size})
+	if err != nil {
+		return err
+	}
+	defer clear(key)
+	fmt.Println(base64.StdEncoding.EncodeToString(key))
+	return nil
+}
+
+// issueCertificate writes the certificate followed by its chain, ready for a TLS server.
+func issueCertificate(ctx context.Context, c *kmsclient.Client, args []string) error {
+	fs := flag.NewFlagSet("issue-certificate", flag.ExitOnError)
+	csrFile := fs.String("csr", "", "PEM certificate signing request; required")
+	ca := fs.String("ca", "", "CA name (default \"default\")")
+	profile := fs.String("profile", "", "certificate profile (default \"server\")")
+	ttl := fs.Duration("ttl", 0, "certificate lifetime (default: the profile's)")
+	out := fs.String("out", "", "output file, instead of stdout")
+	fs.Parse(args)
+
+	if *csrFile == "" {
+		return fmt.Errorf("-csr is required")
+	}
+	csr, err := os.ReadFile(*csrFile)
+	if err != nil {
+		return err
+	}
+	cert, err := c.IssueCertificate(ctx, kmsclient.IssueCertificateInput{CA: *ca, CSR: csr, Profile: *profile, TTL: *ttl})
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Issued certificate %s, valid until %s\n", cert.SerialNumber, cert.NotAfter.Local().Format(time.RFC3339))
+	pemChain := cert.Certificate + cert.Chain
+	if *out == "" {
+		fmt.Print(pemChain)
+		return nil
+	}
+	return os.WriteFile(*out, []byte(pemChain), 0o644)
+}
+
+// signJWT prints the compact token. Claims are a JSON object, from -claims or -in.
+func signJWT(ctx context.Context, c *kmsclient.Client, args []string) error {
+	fs := flag.NewFlagSet("sign-jwt", flag.ExitOnError)
+	name := fs.String("key", "", "signing key name (default \"default\")")
+	claimsJSON := fs.String("claims", "", "claims as a JSON object")
+	in := fs.String("in", "", "file holding the claims, instead of -claims (\"-\" for stdin)")
+	ttl := fs.Duration("ttl", 0, "token lifetime (default 1h)")
+	fs.Parse(args)
+
+	data := []byte(*claimsJSON)
+	if *in != "" {
+		var err error
+		if data, err = readInput(*in); err != nil {
+			return err
+		}
+	}
+	var claims map[string]interface{}
+	if err := json.Unmarshal(data, &claims); err != nil || claims == nil {
+		return fmt.Errorf("claims must be a JSON object")
+	}
+	tok, err := c.SignJWT(ctx, kmsclient.SignJWTInput{Name: *name, Claims: claims, TTL: *ttl})
+	if err != nil {
+		return err
+	}
+	fmt.Println(tok.Token)
+	return nil
+}
+
+func rotate(ctx context.Context, c *kmsclient.Client, args []string) error {
+	fs := flag.NewFlagSet("rotate", flag.ExitOnError)
+	fs.Parse(args)
+
+	rot, err := c.RotateMasterKey(ctx)
+	if err != nil {
+		return err
+	}
+	if rot.PendingApproval {
+		fmt.Printf("Rotation requested by %s; a second approver must run kmsctl rotate before %s\n", rot.RequestedBy, rot.ExpiresAt.Local().Format(time.RFC3339))
+		return nil
+	}
+	fmt.Printf("Master key rotated to %s\n", rot.NewMasterKeyID)
+	return nil
+}
+
+func masterKeys(ctx context.Context, c *kmsclient.Client, args []string) error {
+	fs := flag.NewFlagSet("master-keys", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "print JSON instead of a table")
+	fs.Parse(args)
+
+	keys, err := c.ListMasterKeys(ctx)
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		return printJSON(keys)
+	}
+
+	formatTime := func(t *time.Time) string {
+		if t == nil {
+			return "-"
+		}
+		return t.Local().Format(time.DateTime)
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "MASTER KEY ID\tSTATE\tWRAP MODE\tCREATED\tEXPIRES\tRETIRED")
+	for _, k := range keys {
+		mode := k.WrapMode
+		if mode == "" {
+			mode = "-"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", k.ID, k.State, mode, formatTime(k.CreatedAt), formatTime(k.ExpiresAt), formatTime(k.RetiredAt))
+	}
+	return tw.Flush()
+}
+
+func retireMasterKey(ctx context.Context, c *kmsclient.Client, args []string) error {
+	fs := flag.NewFlagSet("retire-master-key", flag.ExitOnError)
+	id := fs.String("id", "", "master key to retire")
+	fs.Parse(args)
+	if *id == "" {
+		return fmt.Errorf("-id is required")
+	}
+
+	ret, err := c.RetireMasterKey(ctx, *id)
+	if err != nil {
+		return err
+	}
+	if ret.PendingApproval {
+		fmt.Printf("Retirement requested by %s; a second approver must run kmsctl retire-master-key before %s\n", ret.RequestedBy, ret.ExpiresAt.Local().Format(time.RFC3339))
+		return nil
+	}
+	fmt.Printf("Master key %s retired\n", ret.ID)
+	return nil
+}
+
+func takeBackup(ctx context.Context, c *kmsclient.Client, args []string) error {
+	fs := flag.NewFlagSet("backup", flag.ExitOnError)
+	out := fs.String("out", "", "file to write the backup to")
+	fs.Parse(args)
+	if *out == "" {
+		return fmt.Errorf("-out is required")
+	}
+
+	b, err := c.Backup(ctx)
+	if err != nil {
+		return err
+	}
+	if b.PendingApproval {
+		fmt.Printf("Backup requested by %s; a second approver must run kmsctl backup before %s\n", b.RequestedBy, b.ExpiresAt.Local().Format(time.RFC3339))
+		return nil
+	}
+	if err := os.WriteFile(*out, b.Data, 0o600); err != nil {
+		return err
+	}
+	fmt.Printf("Backup written to %s\n", *out)
+	return nil
+}
+
+// listKeys pages through every matching key.
+func listKeys(ctx context.Context, c *kmsclient.Client, args []string) error {
+	fs := flag.NewFlagSet("list-keys", flag.ExitOnError)
+	state := fs.String("state", "", "ENABLED, DISABLED or PENDING_DELETION")
+	masterKey := fs.String("master-key", "", "only keys wrapped by this master key")
+	owner := fs.String("owner", "", "only keys owned by this UID")
+	asJSON := fs.Bool("json", false, "print JSON instead of a table")
+	tags := kvFlag{}
+	fs.Var(tags, "tag", "tag as key=value; repeatable, all must match")
+	fs.Parse(args)
+
+	in := kmsclient.ListDataKeysInput{MasterKeyID: *masterKey, OwnerUID: *owner, State: *state, Tags: tags}
+	var keys []kmsclient.KeyMetadata
+	for {
+		page, err := c.ListDataKeys(ctx, in)
+		if err != nil {
+			return err
+		}
+		keys = append(keys, page.Keys...)
+		if page.NextCursor == "" {
+			break
+		}
+		in.Cursor = page.NextCursor
+	}
+	if *asJSON {
+		return printJSON(keys)
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "DEK ID\tSTATE\tALGORITHM\tCREATED\tDESCRIPTION")
+	for _, k := range keys {
+		created := "-"
+		if k.CreatedAt != nil {
+			created = k.CreatedAt.Local().Format(time.DateTime)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", k.DEKID, k.State, k.Algorithm, created, k.Description)
+	}
+	return tw.Flush()
+}
+
+// auditTail prints the latest events oldest first and, with -f, polls for new ones.
+// The server filters by whole seconds, so each poll repeats the last second and
+// drops events already printed.
+func auditTail(ctx context.Context, c *kmsclient.Client, args []string) error {
+	fs := flag.NewFlagSet("audit tail", flag.ExitOnError)
+	n := fs.Int("n", 20, "number of events to show first")
+	follow := fs.Bool("f", false, "keep polling for new events")
+	interval := fs.Duration("interval", 2*time.Second, "poll interval with -f")
+	asJSON := fs.Bool("json", false, "print one JSON event per line")
+	q := kmsclient.AuditQuery{}
+	fs.StringVar(&q.Action, "action", "", "only this action (endpoint)")
+	fs.StringVar(&q.Identity, "identity", "", "only this identity")
+	fs.StringVar(&q.KeyID, "key", "", "only this key")
+	fs.StringVar(&q.Result, "result", "", "only this result")
+	fs.Parse(args)
+
+	q.Limit = *n
+	seen := map[string]time.Time{}
+	for {
+		events, err := c.AuditEvents(ctx, q)
+		if err != nil {
+			return err
+		}
+		sort.SliceStable(events, func(i, j int) bool { return events[i].Time.Before(events[j].Time) })
+		for _, ev := range events {
+			if _, ok := seen[ev.ID]; ok {
+				continue
+			}
+			seen[ev.ID] = ev.Time
+			if ev.Time.After(q.Since) {
+				q.Since = ev.Time.Truncate(time.Second)
+			}
+			if err := printEvent(ev, *asJSON); err != nil {
+				return err
+			}
+		}
+		if !*follow {
+			return nil
+		}
+		// Later polls ask for everything since the newest event, as many as the server
+		// returns at once, rather than just the last n.
+		q.Limit = maxAuditPage
+		if q.Since.IsZero() {
+			q.Since = time.Now().Add(-*interval).Truncate(time.Second)
+		}
+		for id, t := range seen {
+			if t.Before(q.Since) {
+				delete(seen, id)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(*interval):
+		}
+	}
+}
+
+func printEvent(ev kmsclient.AuditEvent, asJSON bool) error {
+	if asJSON {
+		return json.NewEncoder(os.Stdout).Encode(ev)
+	}
+	line := fmt.Sprintf("%s %-7s %-24s %s", ev.Time.Local().Format(time.RFC3339), ev.Result, ev.Action, ev.Identity)
+	if ev.KeyID != "" {
+		line += " key=" + ev.KeyID
+	}
+	if ev.Status != 0 {
+		line += fmt.Sprintf(" status=%d", ev.Status)
+	}
+	if len(ev.Details) > 0 {
+		line += " " + strings.Join(ev.Details, "; ")
+	}
+	fmt.Println(line)
+	return nil
+}
+
+func readInput(path string) ([]byte, error) {
+	if path == "-" {
+		return io.ReadAll(os.Stdin)
+	}
+	return os.ReadFile(path)
+}
+
+func printJSON(v interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
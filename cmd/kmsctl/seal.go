@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+
+	"my-kms/internal/config"
+	"my-kms/internal/seal"
+	"my-kms/internal/storage"
+	"my-kms/pkg/kmsclient"
+)
+
+// initSeal creates a keyring for SEAL_TYPE=shamir, or for SEAL_TYPE=kek with -kek. It
+// takes the keys in MASTER_KEYS, so an existing deployment keeps decrypting its DEKs,
+// or else generates one.
+func initSeal(args []string) error {
+	fs := flag.NewFlagSet("init-seal", flag.ExitOnError)
+	path := fs.String("keyring", "", "keyring file to create")
+	shares := fs.Int("shares", 5, "number of unseal shares")
+	threshold := fs.Int("threshold", 3, "shares needed to unseal")
+	kekSource := fs.String("kek", "", "encrypt under this KEK (the server's SEAL_KEK_SOURCE) instead of splitting")
+	wrapModeName := fs.String("wrap-mode", "", "wrap mode of the generated key: AES_256_GCM (default) or MLKEM768_AES_256_GCM")
+	fs.Parse(args)
+	if *path == "" {
+		return errors.New("-keyring is required")
+	}
+	wrapMode, err := storage.ParseWrapMode(*wrapModeName)
+	if err != nil {
+		return err
+	}
+
+	var keys []storage.MasterKey
+	if env := os.Getenv("MASTER_KEYS"); env != "" {
+		if wrapMode != storage.WrapModeAES {
+			return errors.New("-wrap-mode applies to a generated key; keys from MASTER_KEYS stay AES_256_GCM, so rotate once the server runs")
+		}
+		parsed, err := (&config.Config{MasterKeys: env}).ParseMasterKeys()
+		if err != nil {
+			return err
+		}
+		for _, k := range parsed {
+			keys = append(keys, storage.MasterKey{ID: k.ID, Key: k.Key})
+		}
+	} else {
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return err
+		}
+		keys = []storage.MasterKey{{ID: uuid.New().String(), Key: key, CreatedAt: time.Now().UTC()}}
+		if wrapMode == storage.WrapModeHybrid {
+			if keys[0].KEMSeed, err = storage.NewKEMSeed(); err != nil {
+				return err
+			}
+		}
+	}
+
+	if *kekSource != "" {
+		kek, err := seal.FetchKEK(context.Background(), *kekSource)
+		if err != nil {
+			return err
+		}
+		defer clear(kek)
+		if err := seal.InitKEK(*path, keys, kek); err != nil {
+			return err
+		}
+		fmt.Printf("Keyring %s holds %d master key(s); active key %s.\n", *path, len(keys), keys[0].ID)
+		fmt.Printf("Start the server with SEAL_TYPE=kek and SEAL_KEK_SOURCE=%s.\n", *kekSource)
+		if os.Getenv("MASTER_KEYS") != "" {
+			fmt.Println("Remove MASTER_KEYS from the server's environment first.")
+		}
+		return nil
+	}
+
+	split, err := seal.Init(*path, keys, *shares, *threshold)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Keyring %s holds %d master key(s); active key %s.\n", *path, len(keys), keys[0].ID)
+	fmt.Printf("Unseal shares (any %d of %d unseal the server). They are shown only once;\n", *threshold, *shares)
+	fmt.Println("give each to a different holder and do not store them together.")
+	fmt.Println()
+	for i, s := range split {
+		fmt.Printf("Share %d: %s\n", i+1, base64.StdEncoding.EncodeToString(s))
+	}
+	if os.Getenv("MASTER_KEYS") != "" {
+		fmt.Println()
+		fmt.Println("Remove MASTER_KEYS from the server's environment before starting it with SEAL_TYPE=shamir.")
+	}
+	return nil
+}
+
+// unseal reads one share from standard input, so it stays out of shell history.
+func unseal(ctx context.Context, c *kmsclient.Client, args []string) error {
+	fs := flag.NewFlagSet("unseal", flag.ExitOnError)
+	reset := fs.Bool("reset", false, "discard the shares submitted so far")
+	fs.Parse(args)
+
+	var st *kmsclient.SealStatus
+	var err error
+	if *reset {
+		st, err = c.ResetUnseal(ctx)
+	} else {
+		fmt.Fprint(os.Stderr, "Unseal share: ")
+		line, rerr := bufio.NewReader(os.Stdin).ReadString('\n')
+		if rerr != nil && line == "" {
+			return fmt.Errorf("failed to read share: %w", rerr)
+		}
+		share, derr := base64.StdEncoding.DecodeString(strings.TrimSpace(line))
+		if derr != nil {
+			return errors.New("the share is not valid base64")
+		}
+		st, err = c.Unseal(ctx, share)
+	}
+	if err != nil {
+		return err
+	}
+	printSealStatus(st)
+	return nil
+}
+
+func sealStatus(ctx context.Context, c *kmsclient.Client, args []string) error {
+	fs := flag.NewFlagSet("seal-status", flag.ExitOnError)
+	fs.Parse(args)
+
+	st, err := c.SealStatus(ctx)
+	if err != nil {
+		return err
+	}
+	printSealStatus(st)
+	return nil
+}
+
+func sealServer(ctx context.Context, c *kmsclient.Client, args []string) error {
+	fs := flag.NewFlagSet("seal", flag.ExitOnError)
+	fs.Parse(args)
+
+	st, err := c.Seal(ctx)
+	if err != nil {
+		return err
+	}
+	printSealStatus(st)
+	return nil
+}
+
+func printSealStatus(st *kmsclient.SealStatus) {
+	if !st.Sealed {
+		fmt.Println("Unsealed")
+		return
+	}
+	fmt.Printf("Sealed: %d of %d shares submitted (%d shares issued)\n", st.Progress, st.Threshold, st.Shares)
+}
@@ -0,0 +1,162 @@
+// Package attest produces signed statements describing the running server build and
+// configuration, so clients can check they are talking to an approved deployment.
+package attest
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"runtime"
+	"runtime/debug"
+	"time"
+
+	"my-kms/internal/canonical"
+)
+
+// Version and Commit are set at build time:
+//
+//	go build -ldflags "-X my-kms/internal/attest.Version=1.4.0 -X my-kms/internal/attest.Commit=$(git rev-parse HEAD)"
+//
+// Commit falls back to the VCS revision embedded by the Go toolchain.
+var (
+	Version = "dev"
+	Commit  = ""
+)
+
+// Algorithm is the signature scheme used for attestations.
+const Algorithm = "Ed25519"
+
+// MaxNonceLength bounds the caller-supplied nonce echoed in a statement.
+const MaxNonceLength = 128
+
+// Statement is what the server attests to.
+type Statement struct {
+	Version      string    `json:"version"`
+	Commit       string    `json:"commit"`
+	GoVersion    string    `json:"goVersion"`
+	ConfigHash   string    `json:"configHash"` // hex SHA-256 of the non-secret configuration
+	FIPSMode     bool      `json:"fipsMode"`
+	KeyProviders []string  `json:"keyProviders"`
+	IssuedAt     time.Time `json:"issuedAt"`
+	Nonce        string    `json:"nonce,omitempty"`
+}
+
+// Attestation is a signed Statement. Payload holds the exact bytes that were signed, the
+// statement in RFC 8785 canonical JSON; Statement is the same content decoded for convenience.
+type Attestation struct {
+	Statement Statement `json:"statement"`
+	Payload   []byte    `json:"payload"`
+	Signature []byte    `json:"signature"`
+	Algorithm string    `json:"algorithm"`
+	PublicKey []byte    `json:"publicKey"`
+}
+
+// Signer issues attestations for one build and configuration.
+type Signer struct {
+	key  ed25519.PrivateKey
+	base Statement
+}
+
+// FIPSMode reports whether the binary runs on a FIPS 140 validated crypto module.
+func FIPSMode() bool {
+	return fipsMode()
+}
+
+// NewSigner returns a Signer for the given configuration hash and key providers.
+func NewSigner(key ed25519.PrivateKey, configHash string, keyProviders []string) (*Signer, error) {
+	if len(key) != ed25519.PrivateKeySize {
+		return nil, errors.New("attestation key must be an Ed25519 private key")
+	}
+	return &Signer{
+		key: key,
+		base: Statement{
+			Version:      Version,
+			Commit:       commit(),
+			GoVersion:    runtime.Version(),
+			ConfigHash:   configHash,
+			FIPSMode:     fipsMode(),
+			KeyProviders: keyProviders,
+		},
+	}, nil
+}
+
+// PublicKey returns the key attestations verify against.
+func (s *Signer) PublicKey() ed25519.PublicKey {
+	return s.key.Public().(ed25519.PublicKey)
+}
+
+// Sign signs message with the attestation key, for other things the deployment vouches
+// for. message must start with a context string of its own, so it can never pass for a
+// Statement payload, which is a JSON object.
+func (s *Signer) Sign(message []byte) []byte {
+	return ed25519.Sign(s.key, message)
+}
+
+// Attest signs a fresh statement carrying nonce.
+func (s *Signer) Attest(nonce string) (*Attestation, error) {
+	if len(nonce) > MaxNonceLength {
+		return nil, fmt.Errorf("nonce must be at most %d characters", MaxNonceLength)
+	}
+	st := s.base
+	st.IssuedAt = time.Now().UTC()
+	st.Nonce = nonce
+
+	payload, err := canonical.Marshal(st)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal statement: %w", err)
+	}
+	return &Attestation{
+		Statement: st,
+		Payload:   payload,
+		Signature: ed25519.Sign(s.key, payload),
+		Algorithm: Algorithm,
+		PublicKey: s.PublicKey(),
+	}, nil
+}
+
+// Verify checks an attestation's signature against a trusted public key and returns
+// the statement that was signed.
+func Verify(a *Attestation, trusted ed25519.PublicKey) (*Statement, error) {
+	if a.Algorithm != Algorithm {
+		return nil, fmt.Errorf("unsupported attestation algorithm %q", a.Algorithm)
+	}
+	if !ed25519.Verify(trusted, a.Payload, a.Signature) {
+		return nil, errors.New("attestation signature verification failed")
+	}
+	if !canonical.IsCanonical(a.Payload) {
+		return nil, errors.New("attestation payload is not canonical JSON")
+	}
+	var st Statement
+	if err := json.Unmarshal(a.Payload, &st); err != nil {
+		return nil, fmt.Errorf("failed to decode statement: %w", err)
+	}
+	return &st, nil
+}
+
+// ConfigHash returns the hex SHA-256 of v's canonical JSON encoding. Callers must strip
+// secrets first.
+func ConfigHash(v any) (string, error) {
+	data, err := canonical.Marshal(v)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal configuration: %w", err)
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func commit() string {
+	if Commit != "" {
+		return Commit
+	}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range info.Settings {
+			if setting.Key == "vcs.revision" {
+				return setting.Value
+			}
+		}
+	}
+	return "unknown"
+}
@@ -0,0 +1,9 @@
+//go:build boringcrypto
+
+package attest
+
+import "crypto/boring"
+
+func fipsMode() bool {
+	return boring.Enabled()
+}
@@ -0,0 +1,8 @@
+//go:build !boringcrypto
+
+package attest
+
+// fipsMode is false unless the server is built with the BoringCrypto toolchain.
+func fipsMode() bool {
+	return false
+}
@@ -0,0 +1,99 @@
+package auth
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+	"time"
+)
+
+// AccessCondition bounds when and from where an identity may act, so a contractor's
+// access lapses on its own and a service's only works from inside the VPC.
+type AccessCondition struct {
+	ValidFrom   *time.Time  `bson:"validFrom,omitempty" json:"validFrom,omitempty"`
+	ValidUntil  *time.Time  `bson:"validUntil,omitempty" json:"validUntil,omitempty"`
+	SourceCIDRs SourceCIDRs `bson:"sourceCidrs,omitempty" json:"sourceCIDRs,omitempty"`
+}
+
+// Empty reports whether the condition allows everything.
+func (c *AccessCondition) Empty() bool {
+	return c == nil || (c.ValidFrom == nil && c.ValidUntil == nil && len(c.SourceCIDRs) == 0)
+}
+
+// Validate checks the window and the networks.
+func (c *AccessCondition) Validate() error {
+	if c == nil {
+		return nil
+	}
+	if c.ValidFrom != nil && c.ValidUntil != nil && !c.ValidUntil.After(*c.ValidFrom) {
+		return fmt.Errorf("validUntil must be after validFrom")
+	}
+	return c.SourceCIDRs.Validate()
+}
+
+// Check returns why a request from ip at now falls outside the condition, or nil if it
+// does not.
+func (c *AccessCondition) Check(now time.Time, ip string) error {
+	if c == nil {
+		return nil
+	}
+	if c.ValidFrom != nil && now.Before(*c.ValidFrom) {
+		return fmt.Errorf("access is not valid until %s", c.ValidFrom.UTC().Format(time.RFC3339))
+	}
+	if c.ValidUntil != nil && !now.Before(*c.ValidUntil) {
+		return fmt.Errorf("access expired at %s", c.ValidUntil.UTC().Format(time.RFC3339))
+	}
+	if !c.SourceCIDRs.Allows(ip) {
+		return fmt.Errorf("access is not allowed from %s", ip)
+	}
+	return nil
+}
+
+// SourceCIDRs lists the networks requests may come from, as CIDRs or single addresses
+// such as "10.20.0.0/16" or "192.0.2.7". Empty allows any address.
+type SourceCIDRs []string
+
+// Validate checks that every entry parses.
+func (s SourceCIDRs) Validate() error {
+	for _, entry := range s {
+		if _, err := parseSourcePrefix(entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Allows reports whether ip is inside one of the networks. An address that does not
+// parse is inside none of them.
+func (s SourceCIDRs) Allows(ip string) bool {
+	if len(s) == 0 {
+		return true
+	}
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, entry := range s {
+		if prefix, err := parseSourcePrefix(entry); err == nil && prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func parseSourcePrefix(entry string) (netip.Prefix, error) {
+	entry = strings.TrimSpace(entry)
+	if !strings.Contains(entry, "/") {
+		addr, err := netip.ParseAddr(entry)
+		if err != nil {
+			return netip.Prefix{}, fmt.Errorf("invalid source CIDR %q: %w", entry, err)
+		}
+		return netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()), nil
+	}
+	prefix, err := netip.ParsePrefix(entry)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid source CIDR %q: %w", entry, err)
+	}
+	return prefix.Masked(), nil
+}
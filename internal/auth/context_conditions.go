@@ -0,0 +1,52 @@
+package auth
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+)
+
+// AnyContextValue in a ContextCondition accepts any value, as long as the key is present.
+const AnyContextValue = "*"
+
+// ContextCondition constrains a request by its encryption context: every key it lists must
+// be present with one of its values. {"orderRegion": ["EU"]} admits only EU orders.
+type ContextCondition map[string][]string
+
+// Validate checks that every key has at least one value.
+func (c ContextCondition) Validate() error {
+	for k, values := range c {
+		if k == "" {
+			return fmt.Errorf("encryption context condition has an empty key")
+		}
+		if len(values) == 0 {
+			return fmt.Errorf("encryption context condition on %q lists no values", k)
+		}
+	}
+	return nil
+}
+
+// Allows reports whether encCtx satisfies the condition.
+func (c ContextCondition) Allows(encCtx map[string]string) bool {
+	return c.Check(encCtx) == nil
+}
+
+// Check returns why encCtx does not satisfy the condition, or nil if it does. Keys are
+// checked in order, so the error names the same key every time.
+func (c ContextCondition) Check(encCtx map[string]string) error {
+	keys := make([]string, 0, len(c))
+	for k := range c {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		got, ok := encCtx[k]
+		if !ok {
+			return fmt.Errorf("encryption context must include %q", k)
+		}
+		if !slices.Contains(c[k], AnyContextValue) && !slices.Contains(c[k], got) {
+			return fmt.Errorf("encryption context %q has a value the policy does not allow", k)
+		}
+	}
+	return nil
+}
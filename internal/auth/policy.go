@@ -0,0 +1,280 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"sync"
+	"time"
+
+	"my-kms/internal/logging"
+)
+
+// AccessRequest is everything a policy engine may look at.
+type AccessRequest struct {
+	Identity Identity
+	Action   Action
+	Time     time.Time
+
+	// HasKey is set once the target key is known; KeyTags are then its tags, and
+	// EncryptionContext the request's encryption context, if it has one.
+	HasKey            bool
+	KeyTags           map[string]string
+	EncryptionContext map[string]string
+}
+
+// PolicyEngine decides whether a request is allowed. A nil error means allow.
+type PolicyEngine interface {
+	Authorize(req AccessRequest) error
+}
+
+var (
+	engineMu sync.RWMutex
+	engine   PolicyEngine = DefaultPolicy()
+)
+
+// SetPolicyEngine replaces the engine used by IsAuthorized and IsAuthorizedForKey.
+func SetPolicyEngine(e PolicyEngine) {
+	engineMu.Lock()
+	defer engineMu.Unlock()
+	engine = e
+}
+
+func currentEngine() PolicyEngine {
+	engineMu.RLock()
+	defer engineMu.RUnlock()
+	return engine
+}
+
+// IsAuthorizedForKey is IsAuthorized with the target key's tags, so rules conditioned on
+// key tags can be applied.
+func IsAuthorizedForKey(id Identity, action Action, keyTags map[string]string) error {
+	return authorize(AccessRequest{
+		Identity: id,
+		Action:   action,
+		Time:     time.Now().UTC(),
+		HasKey:   true,
+		KeyTags:  keyTags,
+	})
+}
+
+// IsAuthorizedForKeyUse is IsAuthorizedForKey for an encrypt or decrypt carrying encCtx,
+// so rules conditioned on the encryption context can be applied.
+func IsAuthorizedForKeyUse(id Identity, action Action, keyTags, encCtx map[string]string) error {
+	return authorize(AccessRequest{
+		Identity:          id,
+		Action:            action,
+		Time:              time.Now().UTC(),
+		HasKey:            true,
+		KeyTags:           keyTags,
+		EncryptionContext: encCtx,
+	})
+}
+
+// ---------------------------------------------------------------------
+// Rule-based policy
+// ---------------------------------------------------------------------
+
+// Effect of a matching rule.
+type Effect string
+
+const (
+	EffectAllow Effect = "allow"
+	EffectDeny  Effect = "deny"
+)
+
+// HourRange matches UTC hours in [From, To). From > To wraps past midnight.
+type HourRange struct {
+	From int `json:"from" bson:"from"`
+	To   int `json:"to" bson:"to"`
+}
+
+func (h HourRange) contains(hour int) bool {
+	if h.From <= h.To {
+		return hour >= h.From && hour < h.To
+	}
+	return hour >= h.From || hour < h.To
+}
+
+// Rule matches requests on every non-empty field. "*" in roles or actions matches anything.
+type Rule struct {
+	Effect  Effect            `json:"effect" bson:"effect"`
+	Roles   []Role            `json:"roles,omitempty" bson:"roles,omitempty"`
+	Actions []Action          `json:"actions,omitempty" bson:"actions,omitempty"`
+	Tenants []string          `json:"tenants,omitempty" bson:"tenants,omitempty"`
+	KeyTags map[string]string `json:"keyTags,omitempty" bson:"keyTags,omitempty"`
+	Hours   *HourRange        `json:"hours,omitempty" bson:"hours,omitempty"`
+
+	EncryptionContext ContextCondition `json:"encryptionContext,omitempty" bson:"encryptionContext,omitempty"`
+}
+
+// RulePolicy evaluates rules with deny-overrides: any matching deny rule denies, otherwise
+// a matching allow rule, the role matrix or a custom role (SetCustomRoles) allows,
+// otherwise the request is denied.
+//
+// When the key is not known yet (HasKey false) rules with keyTags or encryptionContext
+// cannot be decided: allow rules count as matching and deny rules are skipped, and the
+// handler repeats the check with IsAuthorizedForKey once the key is loaded. Requests
+// without an encryption context, such as key management, never match encryptionContext.
+type RulePolicy struct {
+	// Roles is the plain role -> actions matrix; "*" grants every action.
+	Roles map[Role][]Action `json:"roles,omitempty" bson:"roles,omitempty"`
+	Rules []Rule            `json:"rules,omitempty" bson:"rules,omitempty"`
+}
+
+// DefaultPolicy reproduces the built-in role matrix.
+func DefaultPolicy() *RulePolicy {
+	return &RulePolicy{Roles: map[Role][]Action{
+		RoleAdmin: {"*"},
+		RoleService: {
+			ActionGenerateDataKey, ActionEncrypt, ActionDecrypt, ActionDescribeKey, ActionListKeys, ActionImportKey,
+			ActionTokenize, ActionDeriveKey, ActionIssueCertificate, ActionSignJWT, ActionSubscribeEvents,
+		},
+		RoleAuditor: {ActionListKeys, ActionDescribeKey, ActionViewClientReport, ActionListRoles, ActionListUsers, ActionViewAuditLog, ActionViewUsage},
+	}}
+}
+
+// LoadRulePolicy reads and validates a RulePolicy from a JSON file.
+func LoadRulePolicy(path string) (*RulePolicy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read policy: %w", err)
+	}
+	var p RulePolicy
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("failed to parse policy: %w", err)
+	}
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// PolicyLoader fetches the current policy from wherever it is kept.
+type PolicyLoader func(ctx context.Context) (*RulePolicy, error)
+
+// WatchPolicy reloads the policy every interval and installs it when it has changed.
+// A failed load keeps the policy already in force.
+func WatchPolicy(ctx context.Context, interval time.Duration, load PolicyLoader) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		p, err := load(ctx)
+		if err != nil {
+			logging.Errorf("auth", "Policy reload failed, keeping current policy: %v", err)
+			continue
+		}
+		if current, ok := currentEngine().(*RulePolicy); ok && reflect.DeepEqual(current, p) {
+			continue
+		}
+		SetPolicyEngine(p)
+		logging.Infof("auth", "[AUDIT] authorization policy reloaded (%d roles, %d rules)", len(p.Roles), len(p.Rules))
+	}
+}
+
+// Validate checks rule effects and hour ranges.
+func (p *RulePolicy) Validate() error {
+	if len(p.Roles) == 0 && len(p.Rules) == 0 {
+		return fmt.Errorf("policy defines no roles or rules")
+	}
+	for i, r := range p.Rules {
+		if r.Effect != EffectAllow && r.Effect != EffectDeny {
+			return fmt.Errorf("rule %d: effect must be allow or deny", i)
+		}
+		if r.Hours != nil && (r.Hours.From < 0 || r.Hours.From > 23 || r.Hours.To < 0 || r.Hours.To > 24) {
+			return fmt.Errorf("rule %d: hours must be between 0 and 24", i)
+		}
+		if err := r.EncryptionContext.Validate(); err != nil {
+			return fmt.Errorf("rule %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+func (p *RulePolicy) Authorize(req AccessRequest) error {
+	allowed := containsAction(p.Roles[req.Identity.Role], req.Action) ||
+		containsAction(customRoleActions(req.Identity.Role), req.Action)
+	for _, r := range p.Rules {
+		if !r.matches(req) {
+			continue
+		}
+		if r.Effect == EffectDeny {
+			return fmt.Errorf("action %s denied by policy for %s role", req.Action, req.Identity.Role)
+		}
+		allowed = true
+	}
+	if !allowed {
+		return fmt.Errorf("action %s not authorized for %s role", req.Action, req.Identity.Role)
+	}
+	return nil
+}
+
+func (r Rule) matches(req AccessRequest) bool {
+	if len(r.Roles) > 0 && !containsRole(r.Roles, req.Identity.Role) {
+		return false
+	}
+	if len(r.Actions) > 0 && !containsAction(r.Actions, req.Action) {
+		return false
+	}
+	if len(r.Tenants) > 0 && !containsString(r.Tenants, req.Identity.Tenant) {
+		return false
+	}
+	if r.Hours != nil && !r.Hours.contains(req.Time.UTC().Hour()) {
+		return false
+	}
+	if len(r.KeyTags) > 0 {
+		if !req.HasKey {
+			return r.Effect == EffectAllow
+		}
+		for k, v := range r.KeyTags {
+			if req.KeyTags[k] != v {
+				return false
+			}
+		}
+	}
+	if len(r.EncryptionContext) > 0 {
+		if !req.HasKey {
+			return r.Effect == EffectAllow
+		}
+		if !r.EncryptionContext.Allows(req.EncryptionContext) {
+			return false
+		}
+	}
+	return true
+}
+
+func containsRole(list []Role, v Role) bool {
+	for _, item := range list {
+		if item == "*" || item == v {
+			return true
+		}
+	}
+	return false
+}
+
+func containsAction(list []Action, v Action) bool {
+	for _, item := range list {
+		if item == "*" || item == v {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(list []string, v string) bool {
+	for _, item := range list {
+		if item == v {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,50 @@
+package auth
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Principal prefixes used in key policies.
+const (
+	PrincipalUserPrefix = "user:"
+	PrincipalRolePrefix = "role:"
+	PrincipalAnyone     = "*"
+)
+
+// ValidatePrincipal checks that p is "user:<uid>", "role:<ROLE>" or "*".
+func ValidatePrincipal(p string) error {
+	switch {
+	case p == PrincipalAnyone:
+		return nil
+	case strings.HasPrefix(p, PrincipalUserPrefix) && len(p) > len(PrincipalUserPrefix):
+		return nil
+	case strings.HasPrefix(p, PrincipalRolePrefix):
+		if KnownRole(Role(strings.TrimPrefix(p, PrincipalRolePrefix))) {
+			return nil
+		}
+		return fmt.Errorf("unknown role in principal %q", p)
+	default:
+		return fmt.Errorf("principal %q must be user:<uid>, role:<ROLE> or *", p)
+	}
+}
+
+// PrincipalMatches reports whether id is named by any of principals.
+func PrincipalMatches(id Identity, principals []string) bool {
+	for _, p := range principals {
+		switch {
+		case p == PrincipalAnyone:
+			return true
+		case p == PrincipalUserPrefix+id.Name:
+			return true
+		case p == PrincipalRolePrefix+string(id.Role):
+			return true
+		}
+	}
+	return false
+}
+
+// PrincipalsFor lists the specific principals naming id, for lookups by principal.
+func PrincipalsFor(id Identity) []string {
+	return []string{PrincipalUserPrefix + id.Name, PrincipalRolePrefix + string(id.Role)}
+}
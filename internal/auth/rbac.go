@@ -1,6 +1,11 @@
 package auth
 
-import "errors"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
 
 // Role defines user roles
 type Role string
@@ -19,32 +24,101 @@ const (
 	ActionEncrypt         Action = "ENCRYPT"
 	ActionDecrypt         Action = "DECRYPT"
 	ActionRotateMasterKey Action = "ROTATE_MASTER_KEY"
+	ActionOffboardUser    Action = "OFFBOARD_USER"
+	ActionManageKey       Action = "MANAGE_KEY"
+	ActionDescribeKey     Action = "DESCRIBE_KEY"
+	ActionListKeys        Action = "LIST_KEYS"
+	ActionRestoreDataKey  Action = "RESTORE_DATA_KEY"
+	ActionImportKey       Action = "IMPORT_KEY"
+	ActionExportKey       Action = "EXPORT_KEY"
+
+	ActionViewClientReport Action = "VIEW_CLIENT_REPORT"
+	ActionLegalHold        Action = "LEGAL_HOLD"
+	ActionManageCMK        Action = "MANAGE_CMK"
+	ActionManageRoles      Action = "MANAGE_ROLES"
+	ActionListRoles        Action = "LIST_ROLES"
+	ActionManageUsers      Action = "MANAGE_USERS"
+	ActionListUsers        Action = "LIST_USERS"
+	ActionRevokePrincipal  Action = "REVOKE_PRINCIPAL"
+	ActionReloadConfig     Action = "RELOAD_CONFIG"
+	ActionViewAuditLog     Action = "VIEW_AUDIT_LOG"
+	ActionManageAPIKeys    Action = "MANAGE_API_KEYS"
+	ActionViewUsage        Action = "VIEW_USAGE"
+	ActionTokenize         Action = "TOKENIZE"
+	ActionDeriveKey        Action = "DERIVE_KEY"
+	ActionManageCA         Action = "MANAGE_CA"
+	ActionIssueCertificate Action = "ISSUE_CERTIFICATE"
+	ActionSignJWT          Action = "SIGN_JWT"
+	ActionSubscribeEvents  Action = "SUBSCRIBE_EVENTS"
+
+	// ActionEncryptDeterministic is needed, on top of GENERATE_DATA_KEY or ENCRYPT, to
+	// create or encrypt with a deterministic key, and for format-preserving encryption.
+	// No role but ADMIN has it by default.
+	ActionEncryptDeterministic Action = "ENCRYPT_DETERMINISTIC"
 )
 
+// ContextKey is the type of the context keys this package defines.
+type ContextKey string
+
+// IdentityKey holds the authenticated Identity in a request context.
+const IdentityKey ContextKey = "identity"
+
+// WithIdentity returns a copy of ctx carrying id.
+func WithIdentity(ctx context.Context, id Identity) context.Context {
+	return context.WithValue(ctx, IdentityKey, id)
+}
+
+// FromContext returns the Identity put in ctx by WithIdentity, if there is one.
+func FromContext(ctx context.Context) (Identity, bool) {
+	id, ok := ctx.Value(IdentityKey).(Identity)
+	return id, ok
+}
+
 // Identity is placed in request context
 type Identity struct {
-	Name string
-	Role Role
+	Name   string
+	Role   Role
+	Tenant string // empty for single-tenant deployments
+
+	// DecryptOnly is set when the identity was resolved in emergency mode; every
+	// action other than DECRYPT is denied regardless of role.
+	DecryptOnly bool
+
+	// KeyScope lists the only DEK IDs an API key may use or manage; empty means any.
+	KeyScope []string
+
+	// Conditions bound when and from where the identity may act; nil means always and
+	// from anywhere.
+	Conditions *AccessCondition
 }
 
-// IsAuthorized checks if the user's role can perform the specified action.
+// CanUseKey reports whether dekID is within the identity's key scope.
+func (id Identity) CanUseKey(dekID string) bool {
+	return len(id.KeyScope) == 0 || containsString(id.KeyScope, dekID)
+}
+
+// CheckTenant ensures an identity only acts on resources in its own tenant.
+func CheckTenant(id Identity, resourceTenant string) error {
+	if id.Tenant != resourceTenant {
+		return errors.New("resource belongs to a different tenant")
+	}
+	return nil
+}
+
+// IsAuthorized checks if the user's role can perform the specified action under the
+// current policy engine (DefaultPolicy unless replaced with SetPolicyEngine).
 func IsAuthorized(id Identity, action Action) error {
-	switch id.Role {
-	case RoleAdmin:
-		// Admin can do all
-		return nil
-	case RoleService:
-		// Service can generate data keys, encrypt, decrypt
-		switch action {
-		case ActionGenerateDataKey, ActionEncrypt, ActionDecrypt:
-			return nil
-		default:
-			return errors.New("action not authorized for SERVICE role")
-		}
-	case RoleAuditor:
-		// Auditors can do (??) - typically read-only. Adjust as needed.
-		return errors.New("action not authorized for AUDITOR role")
-	default:
-		return errors.New("unknown role")
+	return authorize(AccessRequest{
+		Identity: id,
+		Action:   action,
+		Time:     time.Now().UTC(),
+	})
+}
+
+// authorize applies the emergency restriction before consulting the policy engine.
+func authorize(req AccessRequest) error {
+	if req.Identity.DecryptOnly && req.Action != ActionDecrypt {
+		return fmt.Errorf("action %s unavailable: user store is degraded, only %s is allowed", req.Action, ActionDecrypt)
 	}
+	return currentEngine().Authorize(req)
 }
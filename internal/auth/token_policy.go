@@ -0,0 +1,57 @@
+package auth
+
+import (
+	"fmt"
+	"time"
+)
+
+// FirebaseMaxClockSkew is the leeway the Firebase SDK already applies to iat/exp.
+// A larger tolerance cannot be honored because the SDK rejects such tokens first.
+const FirebaseMaxClockSkew = 5 * time.Minute
+
+// TokenTimePolicy holds the time-based checks applied to verified tokens.
+type TokenTimePolicy struct {
+	// ClockSkew is the tolerance applied to issued-at and expiry timestamps.
+	ClockSkew time.Duration
+	// MaxAge rejects tokens issued (or authenticated) longer ago than this. Zero disables the check.
+	MaxAge time.Duration
+}
+
+// DefaultTokenTimePolicy matches the Firebase SDK's built-in behavior.
+func DefaultTokenTimePolicy() TokenTimePolicy {
+	return TokenTimePolicy{ClockSkew: FirebaseMaxClockSkew}
+}
+
+// Validate reports policies that cannot be enforced.
+func (p TokenTimePolicy) Validate() error {
+	if p.ClockSkew < 0 || p.MaxAge < 0 {
+		return fmt.Errorf("token clock skew and max age must not be negative")
+	}
+	if p.ClockSkew > FirebaseMaxClockSkew {
+		return fmt.Errorf("token clock skew %s exceeds the %s supported by the Firebase verifier", p.ClockSkew, FirebaseMaxClockSkew)
+	}
+	return nil
+}
+
+// Check applies the policy to a token's timestamps (unix seconds). authTime may be zero.
+func (p TokenTimePolicy) Check(issuedAt, expires, authTime int64, now time.Time) error {
+	iat := time.Unix(issuedAt, 0)
+	exp := time.Unix(expires, 0)
+
+	if iat.After(now.Add(p.ClockSkew)) {
+		return fmt.Errorf("token issued in the future (iat=%d, server time=%d)", issuedAt, now.Unix())
+	}
+	if exp.Add(p.ClockSkew).Before(now) {
+		return fmt.Errorf("token expired (exp=%d, server time=%d)", expires, now.Unix())
+	}
+	if p.MaxAge > 0 {
+		issued := iat
+		if authTime > 0 && time.Unix(authTime, 0).Before(issued) {
+			issued = time.Unix(authTime, 0)
+		}
+		if now.Sub(issued) > p.MaxAge+p.ClockSkew {
+			return fmt.Errorf("token older than the maximum age of %s", p.MaxAge)
+		}
+	}
+	return nil
+}
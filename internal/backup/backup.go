@@ -0,0 +1,233 @@
+// Package backup reads and writes disaster-recovery exports of the key hierarchy: the
+// master key metadata and every DEK. An export is encrypted under an offline recovery
+// RSA key, so only whoever holds its private half can read it, and signed with the
+// server's Ed25519 attestation key, so a restore can tell it came from the deployment.
+package backup
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"time"
+
+	"my-kms/internal/canonical"
+	"my-kms/internal/crypto"
+	"my-kms/internal/secmem"
+	"my-kms/internal/storage"
+)
+
+// FormatVersion is bumped whenever the backup layout changes incompatibly.
+const FormatVersion = 1
+
+// Algorithms used by FormatVersion 1.
+const (
+	WrappingAlgorithm = "RSAES_OAEP_SHA_256"
+	SigningAlgorithm  = "Ed25519"
+)
+
+// MinRecoveryKeyBits is the smallest recovery key accepted. The key protects every DEK for
+// as long as backups are kept, so it is held to more than keys for a single export.
+const MinRecoveryKeyBits = 3072
+
+// signingContext prefixes what is signed, so a backup signature can never pass for an
+// attestation made with the same key.
+const signingContext = "kms-backup-v1\x00"
+
+// MasterKey describes a master key as it was when the backup was taken, never its material.
+type MasterKey struct {
+	ID        string                 `json:"id"`
+	State     storage.MasterKeyState `json:"state"`
+	CreatedAt time.Time              `json:"createdAt,omitempty"`
+	RetiredAt time.Time              `json:"retiredAt,omitempty"`
+}
+
+// DEK is one DEK document with its metadata in the clear. For a DEK wrapped under a
+// master key, Key holds the key itself and Document.DEK is empty, so it can be wrapped
+// again under whichever master key the restored deployment has. A DEK wrapped by a
+// tenant CMK keeps its wrapped key, which only the CMK can open.
+type DEK struct {
+	Document storage.DEKDocument `json:"document"`
+	Key      []byte              `json:"key,omitempty"`
+}
+
+// Contents is what a backup holds.
+type Contents struct {
+	Version           int         `json:"version"`
+	CreatedAt         time.Time   `json:"createdAt"`
+	CreatedBy         string      `json:"createdBy"`
+	ActiveMasterKeyID string      `json:"activeMasterKeyID"`
+	MasterKeys        []MasterKey `json:"masterKeys"`
+	DEKs              []DEK       `json:"deks"`
+}
+
+// Clear zeroes the DEKs held in c.
+func (c *Contents) Clear() {
+	for i := range c.DEKs {
+		secmem.Zero(c.DEKs[i].Key)
+	}
+}
+
+// envelope is the on-disk format: the contents encrypted under a random key, that key
+// wrapped under the recovery key, and a signature over everything else.
+type envelope struct {
+	Version           int       `json:"version"`
+	CreatedAt         time.Time `json:"createdAt"`
+	RecoveryKeyID     string    `json:"recoveryKeyID"`
+	WrappingAlgorithm string    `json:"wrappingAlgorithm"`
+	WrappedKey        []byte    `json:"wrappedKey"`
+	Ciphertext        []byte    `json:"ciphertext"`
+	SigningAlgorithm  string    `json:"signingAlgorithm"`
+	SigningKey        []byte    `json:"signingKey"`
+	Signature         []byte    `json:"signature,omitempty"`
+}
+
+// Seal encrypts c under recovery and signs it with sign, which signs with signingKey.
+func Seal(c *Contents, recovery *rsa.PublicKey, signingKey ed25519.PublicKey, sign func([]byte) []byte) ([]byte, error) {
+	plaintext, err := json.Marshal(c)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal backup: %w", err)
+	}
+	defer clear(plaintext)
+
+	key := make([]byte, crypto.KeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	defer clear(key)
+	ciphertext, err := crypto.EncryptAES256GCM(key, plaintext)
+	if err != nil {
+		return nil, err
+	}
+	wrapped, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, recovery, key, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to wrap backup key: %w", err)
+	}
+
+	env := envelope{
+		Version:           c.Version,
+		CreatedAt:         c.CreatedAt,
+		RecoveryKeyID:     RecoveryKeyID(recovery),
+		WrappingAlgorithm: WrappingAlgorithm,
+		WrappedKey:        wrapped,
+		Ciphertext:        ciphertext,
+		SigningAlgorithm:  SigningAlgorithm,
+		SigningKey:        signingKey,
+	}
+	signed, err := signedBytes(&env)
+	if err != nil {
+		return nil, err
+	}
+	env.Signature = sign(signed)
+	return json.MarshalIndent(env, "", "  ")
+}
+
+// Open verifies a backup against trusted, the attestation public key of the deployment
+// it came from, and decrypts it with recovery.
+func Open(data []byte, recovery *rsa.PrivateKey, trusted ed25519.PublicKey) (*Contents, error) {
+	var env envelope
+	if err := json.Unmarshal(data, &env); err != nil {
+		return nil, fmt.Errorf("failed to parse backup: %w", err)
+	}
+	if env.Version != FormatVersion {
+		return nil, fmt.Errorf("unsupported backup version %d", env.Version)
+	}
+	if env.WrappingAlgorithm != WrappingAlgorithm || env.SigningAlgorithm != SigningAlgorithm {
+		return nil, fmt.Errorf("unsupported backup algorithms %s and %s", env.WrappingAlgorithm, env.SigningAlgorithm)
+	}
+	signed, err := signedBytes(&env)
+	if err != nil {
+		return nil, err
+	}
+	if !ed25519.Verify(trusted, signed, env.Signature) {
+		return nil, errors.New("backup signature verification failed")
+	}
+	if id := RecoveryKeyID(&recovery.PublicKey); env.RecoveryKeyID != id {
+		return nil, fmt.Errorf("backup is encrypted under recovery key %s, not %s", env.RecoveryKeyID, id)
+	}
+
+	key, err := rsa.DecryptOAEP(sha256.New(), nil, recovery, env.WrappedKey, nil)
+	if err != nil {
+		return nil, errors.New("failed to unwrap backup key")
+	}
+	defer clear(key)
+	plaintext, err := crypto.DecryptAES256GCM(key, env.Ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	defer clear(plaintext)
+
+	var c Contents
+	if err := json.Unmarshal(plaintext, &c); err != nil {
+		return nil, fmt.Errorf("failed to decode backup: %w", err)
+	}
+	return &c, nil
+}
+
+// signedBytes is what the signature covers: the envelope without it, as canonical JSON.
+func signedBytes(env *envelope) ([]byte, error) {
+	unsigned := *env
+	unsigned.Signature = nil
+	data, err := canonical.Marshal(unsigned)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal backup envelope: %w", err)
+	}
+	return append([]byte(signingContext), data...), nil
+}
+
+// RecoveryKeyID names a recovery key: the hex SHA-256 of its DER SubjectPublicKeyInfo.
+func RecoveryKeyID(pub *rsa.PublicKey) string {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:])
+}
+
+// ParseRecoveryPublicKey reads a PEM "PUBLIC KEY" block holding an RSA key of at least
+// MinRecoveryKeyBits.
+func ParseRecoveryPublicKey(data []byte) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("recovery public key is not PEM")
+	}
+	parsed, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid recovery public key: %w", err)
+	}
+	pub, ok := parsed.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("recovery public key must be an RSA key")
+	}
+	if pub.N.BitLen() < MinRecoveryKeyBits {
+		return nil, fmt.Errorf("recovery public key must be at least %d bits", MinRecoveryKeyBits)
+	}
+	return pub, nil
+}
+
+// ParseRecoveryPrivateKey reads a PEM PKCS #8 or PKCS #1 RSA private key.
+func ParseRecoveryPrivateKey(data []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("recovery private key is not PEM")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid recovery private key: %w", err)
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("recovery private key must be an RSA key")
+	}
+	return key, nil
+}
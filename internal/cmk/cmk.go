@@ -0,0 +1,57 @@
+// Package cmk talks to customer-managed key services, so a tenant's DEKs can be
+// wrapped by a root key that lives in the customer's own account.
+package cmk
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Supported provider names.
+const (
+	ProviderVault  = "vault"
+	ProviderAWSKMS = "aws-kms"
+	ProviderGCPKMS = "gcp-kms"
+)
+
+// Provider wraps and unwraps data keys with a key the server never sees.
+type Provider interface {
+	Wrap(ctx context.Context, dek []byte) ([]byte, error)
+	Unwrap(ctx context.Context, wrapped []byte) ([]byte, error)
+}
+
+// Config identifies a customer key and how to reach it.
+type Config struct {
+	Provider    string
+	Endpoint    string
+	KeyName     string
+	Credentials string
+}
+
+// Implemented lists the providers New can build.
+func Implemented() []string {
+	return []string{ProviderVault}
+}
+
+// DefaultTimeout bounds each call to an external key service.
+const DefaultTimeout = 10 * time.Second
+
+// New builds the provider described by cfg.
+func New(cfg Config) (Provider, error) {
+	if cfg.KeyName == "" {
+		return nil, fmt.Errorf("keyName is required")
+	}
+	client := &http.Client{Timeout: DefaultTimeout}
+
+	switch strings.ToLower(cfg.Provider) {
+	case ProviderVault:
+		return newVaultTransit(cfg, client)
+	case ProviderAWSKMS, ProviderGCPKMS:
+		return nil, fmt.Errorf("provider %s is not supported yet", cfg.Provider)
+	default:
+		return nil, fmt.Errorf("unknown provider %q", cfg.Provider)
+	}
+}
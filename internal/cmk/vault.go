@@ -0,0 +1,99 @@
+package cmk
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// vaultTransit wraps keys with a HashiCorp Vault transit key.
+type vaultTransit struct {
+	endpoint string
+	keyName  string
+	token    string
+	client   *http.Client
+}
+
+func newVaultTransit(cfg Config, client *http.Client) (*vaultTransit, error) {
+	u, err := url.Parse(cfg.Endpoint)
+	if err != nil || u.Scheme != "https" || u.Host == "" {
+		return nil, fmt.Errorf("vault endpoint must be an https URL")
+	}
+	if cfg.Credentials == "" {
+		return nil, fmt.Errorf("vault token is required")
+	}
+	return &vaultTransit{
+		endpoint: strings.TrimRight(cfg.Endpoint, "/"),
+		keyName:  cfg.KeyName,
+		token:    cfg.Credentials,
+		client:   client,
+	}, nil
+}
+
+func (v *vaultTransit) Wrap(ctx context.Context, dek []byte) ([]byte, error) {
+	var out struct {
+		Data struct {
+			Ciphertext string `json:"ciphertext"`
+		} `json:"data"`
+	}
+	in := map[string]string{"plaintext": base64.StdEncoding.EncodeToString(dek)}
+	if err := v.call(ctx, "encrypt", in, &out); err != nil {
+		return nil, err
+	}
+	if out.Data.Ciphertext == "" {
+		return nil, fmt.Errorf("vault returned no ciphertext")
+	}
+	return []byte(out.Data.Ciphertext), nil
+}
+
+func (v *vaultTransit) Unwrap(ctx context.Context, wrapped []byte) ([]byte, error) {
+	var out struct {
+		Data struct {
+			Plaintext string `json:"plaintext"`
+		} `json:"data"`
+	}
+	in := map[string]string{"ciphertext": string(wrapped)}
+	if err := v.call(ctx, "decrypt", in, &out); err != nil {
+		return nil, err
+	}
+	dek, err := base64.StdEncoding.DecodeString(out.Data.Plaintext)
+	if err != nil {
+		return nil, fmt.Errorf("vault returned invalid plaintext: %w", err)
+	}
+	return dek, nil
+}
+
+func (v *vaultTransit) call(ctx context.Context, op string, in, out interface{}) error {
+	body, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	endpoint := fmt.Sprintf("%s/v1/transit/%s/%s", v.endpoint, op, url.PathEscape(v.keyName))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Vault-Token", v.token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("vault %s failed: %w", op, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("vault %s returned %s: %s", op, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("failed to decode vault response: %w", err)
+	}
+	return nil
+}
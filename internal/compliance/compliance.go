@@ -0,0 +1,162 @@
+// Package compliance defines named bundles of settings a deployment must satisfy.
+package compliance
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"my-kms/internal/crypto"
+)
+
+// Settings is the part of the deployed configuration a profile looks at.
+type Settings struct {
+	AlgorithmPolicy crypto.AlgorithmPolicy
+	AuditSinks      []string // enabled audit destinations, e.g. "buffer"
+	TLSMinVersion   uint16
+	FIPSMode        bool
+	DualControl     bool
+	FailOpen        []string // subsystems configured to fail open
+
+	MasterKeyRotationInterval time.Duration // 0 when the master key is only rotated by hand
+}
+
+// Profile is a named compliance preset.
+type Profile struct {
+	Name        string
+	Description string
+
+	// ApprovedAlgorithms must include every algorithm the algorithm policy permits.
+	ApprovedAlgorithms []crypto.Algorithm
+	MinKeyBits         int
+	// RequiredAuditSinks must all be enabled; at least one sink is always required.
+	RequiredAuditSinks []string
+	TLSMinVersion      uint16
+	RequireFIPS        bool
+	RequireDualControl bool
+	RequireFailClosed  bool
+	// MaxRotationInterval, when set, is the longest cryptoperiod allowed for the master
+	// key; rotation must be scheduled at least that often.
+	MaxRotationInterval time.Duration
+}
+
+var profiles = map[string]Profile{
+	"pci": {
+		Name:               "pci",
+		Description:        "PCI DSS key management",
+		ApprovedAlgorithms: []crypto.Algorithm{crypto.AlgorithmAES256GCM, crypto.AlgorithmAES128GCM},
+		MinKeyBits:         128,
+		TLSMinVersion:      tls.VersionTLS12,
+		RequireDualControl: true,
+		RequireFailClosed:  true,
+		// PCI DSS 3.6.4: keys are changed at the end of a defined cryptoperiod.
+		MaxRotationInterval: 365 * 24 * time.Hour,
+	},
+	"hipaa": {
+		Name:               "hipaa",
+		Description:        "HIPAA security rule safeguards",
+		ApprovedAlgorithms: []crypto.Algorithm{crypto.AlgorithmAES256GCM},
+		MinKeyBits:         256,
+		TLSMinVersion:      tls.VersionTLS12,
+		RequireFailClosed:  true,
+	},
+	"fedramp-moderate": {
+		Name:               "fedramp-moderate",
+		Description:        "FedRAMP Moderate baseline (FIPS 140 validated crypto)",
+		ApprovedAlgorithms: []crypto.Algorithm{crypto.AlgorithmAES256GCM, crypto.AlgorithmAES128GCM},
+		MinKeyBits:         128,
+		TLSMinVersion:      tls.VersionTLS12,
+		RequireFIPS:        true,
+		RequireDualControl: true,
+		RequireFailClosed:  true,
+		// NIST SP 800-57: at most a year for a symmetric key-wrapping key.
+		MaxRotationInterval: 365 * 24 * time.Hour,
+	},
+}
+
+// Lookup returns the named profile.
+func Lookup(name string) (Profile, error) {
+	p, ok := profiles[name]
+	if !ok {
+		return Profile{}, fmt.Errorf("unknown compliance profile %q (known: %s)", name, strings.Join(Names(), ", "))
+	}
+	return p, nil
+}
+
+// Names lists the known profiles.
+func Names() []string {
+	names := make([]string, 0, len(profiles))
+	for name := range profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Check returns every way s violates the profile, joined, or nil when it complies.
+func (p Profile) Check(s Settings) error {
+	var errs []error
+
+	for _, alg := range crypto.SupportedAlgorithms {
+		if s.AlgorithmPolicy.Check(alg) != nil {
+			continue
+		}
+		if !approved(p.ApprovedAlgorithms, alg) {
+			errs = append(errs, fmt.Errorf("algorithm %s is permitted but not approved; restrict ALLOWED_ALGORITHMS", alg))
+		}
+	}
+	if s.AlgorithmPolicy.MinKeyBits < p.MinKeyBits {
+		errs = append(errs, fmt.Errorf("MIN_KEY_BITS must be at least %d", p.MinKeyBits))
+	}
+
+	if len(s.AuditSinks) == 0 {
+		errs = append(errs, errors.New("an audit sink must be enabled"))
+	}
+	for _, sink := range p.RequiredAuditSinks {
+		if !containsString(s.AuditSinks, sink) {
+			errs = append(errs, fmt.Errorf("audit sink %s must be enabled", sink))
+		}
+	}
+
+	if s.TLSMinVersion < p.TLSMinVersion {
+		errs = append(errs, fmt.Errorf("TLS_MIN_VERSION must be at least %s", tls.VersionName(p.TLSMinVersion)))
+	}
+	if p.RequireFIPS && !s.FIPSMode {
+		errs = append(errs, errors.New("FIPS mode is required; build with GOEXPERIMENT=boringcrypto"))
+	}
+	if p.RequireDualControl && !s.DualControl {
+		errs = append(errs, errors.New("DUAL_CONTROL must be enabled"))
+	}
+	if p.MaxRotationInterval > 0 && (s.MasterKeyRotationInterval <= 0 || s.MasterKeyRotationInterval > p.MaxRotationInterval) {
+		errs = append(errs, fmt.Errorf("MASTER_KEY_ROTATION_INTERVAL must be set to at most %s", p.MaxRotationInterval))
+	}
+	if p.RequireFailClosed && len(s.FailOpen) > 0 {
+		errs = append(errs, fmt.Errorf("subsystems must fail closed: %s", strings.Join(s.FailOpen, ", ")))
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+	return fmt.Errorf("configuration violates compliance profile %s: %w", p.Name, errors.Join(errs...))
+}
+
+func approved(list []crypto.Algorithm, alg crypto.Algorithm) bool {
+	for _, a := range list {
+		if a == alg {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(list []string, v string) bool {
+	for _, item := range list {
+		if item == v {
+			return true
+		}
+	}
+	return false
+}
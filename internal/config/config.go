@@ -1,10 +1,15 @@
 package config
 
 import (
+	"crypto/ed25519"
+	"crypto/tls"
 	"encoding/base64"
 	"errors"
 	"fmt"
+	"io/fs"
+	"os"
 	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
 	"github.com/kelseyhightower/envconfig"
@@ -15,31 +20,421 @@ type MasterKey struct {
 	Key []byte
 }
 
+// DevUser is a user seeded into the in-memory user store.
+type DevUser struct {
+	UID    string
+	Role   string
+	Tenant string
+}
+
 type Config struct {
-	MongoURI                   string `envconfig:"MONGO_URI" required:"true"`
-	MongoDBName                string `envconfig:"MONGO_DB_NAME" required:"true"`
-	MongoUsersCollection       string `envconfig:"MONGO_USERS_COLLECTION" required:"true"`
-	FirebaseServiceAccountPath string `envconfig:"FIREBASE_SERVICE_ACCOUNT_PATH" required:"true"`
-	MasterKeys                 string `envconfig:"MASTER_KEYS" required:"true"`
-	TLSCertPath                string `envconfig:"TLS_CERT_PATH" required:"true"`
-	TLSKeyPath                 string `envconfig:"TLS_KEY_PATH" required:"true"`
-	MongoDEKCollection         string `envconfig:"MONGO_DEK_COLLECTION" required:"true"`
+	StorageBackend             string `envconfig:"STORAGE_BACKEND" default:"mongo"` // mongo, postgres or memory, for users, roles and DEKs
+	PostgresURL                string `envconfig:"POSTGRES_URL"`                    // e.g. postgres://kms@db:5432/kms?sslmode=verify-full
+	MongoURI                   string `envconfig:"MONGO_URI"`                       // optional with STORAGE_BACKEND=postgres or memory
+	MongoDBName                string `envconfig:"MONGO_DB_NAME"`
+	MongoUsersCollection       string `envconfig:"MONGO_USERS_COLLECTION" default:"users"`
+	MongoRolesCollection       string `envconfig:"MONGO_ROLES_COLLECTION" default:"roles"`
+	MongoMigrate               bool   `envconfig:"MONGO_MIGRATE" default:"true"`  // apply MongoDB migrations at startup; false leaves them to kms-migrate
+	FirebaseServiceAccountPath string `envconfig:"FIREBASE_SERVICE_ACCOUNT_PATH"` // optional only with STORAGE_BACKEND=memory
+	MasterKeys                 string `envconfig:"MASTER_KEYS"`                   // id:base64key,...; required unless SEAL_TYPE=shamir
+	TLSCertPath                string `envconfig:"TLS_CERT_PATH"`                 // required with LISTEN_MODE=https
+	TLSKeyPath                 string `envconfig:"TLS_KEY_PATH"`
+	MongoDEKCollection         string `envconfig:"MONGO_DEK_COLLECTION" default:"deks"`
+	DevUsers                   string `envconfig:"DEV_USERS"`       // uid=ROLE[@tenant],... seeded into the memory backend
+	SnapshotKey                string `envconfig:"SNAPSHOT_KEY"`    // base64 32-byte key for configuration snapshots
+	AttestationKey             string `envconfig:"ATTESTATION_KEY"` // base64 32-byte Ed25519 seed; empty disables /attestation
+
+	// BackupRecoveryKeyFile is a PEM RSA public key, of at least 3072 bits, that /backup
+	// encrypts under. Its private half stays offline until a restore. Backups are signed
+	// with the attestation key, so this needs ATTESTATION_KEY too.
+	BackupRecoveryKeyFile string `envconfig:"BACKUP_RECOVERY_KEY_FILE"`
+
+	// LockKeyMemory keeps master keys and the keyring root key in memory locked into RAM
+	// and left out of core dumps. Linux only; RLIMIT_MEMLOCK must allow a few pages.
+	LockKeyMemory bool `envconfig:"LOCK_KEY_MEMORY" default:"false"`
+
+	// SealType shamir starts the server sealed, with the master keys in SEAL_KEYRING_FILE
+	// under a root key split into shares, instead of reading them from MASTER_KEYS. kek
+	// decrypts the same file at startup with the key named by SEAL_KEK_SOURCE.
+	SealType        string `envconfig:"SEAL_TYPE" default:"none"` // none, shamir or kek
+	SealKeyringFile string `envconfig:"SEAL_KEYRING_FILE"`
+	SealKEKSource   string `envconfig:"SEAL_KEK_SOURCE"` // file:PATH, aws-secretsmanager:ID or gcp-secretmanager:NAME
+
+	// MasterKeyRotationInterval rotates the active master key once it is that old, e.g.
+	// 2160h for 90 days, and rewraps DEKs onto the new key. The new key is persisted to
+	// SEAL_KEYRING_FILE, so it needs SEAL_TYPE shamir or kek.
+	MasterKeyRotationInterval      time.Duration `envconfig:"MASTER_KEY_ROTATION_INTERVAL" default:"0"` // 0 disables
+	MasterKeyRotationCheckInterval time.Duration `envconfig:"MASTER_KEY_ROTATION_CHECK_INTERVAL" default:"1h"`
+	DEKRewrapBatchSize             int           `envconfig:"DEK_REWRAP_BATCH_SIZE" default:"100"`
+
+	// MasterKeyWrapMode is how master keys created from now on wrap DEKs: AES_256_GCM, or
+	// the experimental MLKEM768_AES_256_GCM hybrid. Existing keys keep their mode.
+	MasterKeyWrapMode string `envconfig:"MASTER_KEY_WRAP_MODE" default:"AES_256_GCM"`
+
+	ListenAddr            string `envconfig:"LISTEN_ADDR" default:":8443"`
+	ListenMode            string `envconfig:"LISTEN_MODE" default:"https"`    // http behind a TLS-terminating proxy
+	TrustedProxies        string `envconfig:"TRUSTED_PROXIES"`                // CIDRs whose X-Forwarded-For is believed
+	TLSMinVersion         string `envconfig:"TLS_MIN_VERSION" default:"1.2"`  // 1.2 or 1.3
+	ClientCertMode        string `envconfig:"CLIENT_CERT_MODE" default:"off"` // off, optional or require
+	TLSClientCAPath       string `envconfig:"TLS_CLIENT_CA_PATH"`             // PEM bundle trusted for client certificates
+	ClientCertMappingPath string `envconfig:"CLIENT_CERT_MAPPING_FILE"`       // JSON SPIFFE ID/OU -> role rules
+
+	TokenClockSkew time.Duration `envconfig:"TOKEN_CLOCK_SKEW" default:"5m"`
+	TokenMaxAge    time.Duration `envconfig:"TOKEN_MAX_AGE" default:"0"` // 0 disables the max-age check
+	TenantClaim    string        `envconfig:"TENANT_CLAIM" default:"tenant"`
+	RoleClaim      string        `envconfig:"ROLE_CLAIM"` // e.g. "kmsRole"; empty reads roles from the user store, which still disables users either way
+
+	CheckTokenRevocation      bool          `envconfig:"CHECK_TOKEN_REVOCATION" default:"false"` // ask Firebase on every request
+	RevocationRefreshInterval time.Duration `envconfig:"REVOCATION_REFRESH_INTERVAL" default:"5s"`
+
+	UserStoreFallback     string        `envconfig:"USER_STORE_FALLBACK" default:"none"` // none, cache or emergency
+	UserCacheMaxStaleness time.Duration `envconfig:"USER_CACHE_MAX_STALENESS" default:"15m"`
+	UserCacheTTL          time.Duration `envconfig:"USER_CACHE_TTL" default:"30s"` // 0 looks users up on every request
+
+	AllowedAlgorithms   string        `envconfig:"ALLOWED_ALGORITHMS"` // comma-separated; empty allows all
+	MinKeyBits          int           `envconfig:"MIN_KEY_BITS" default:"0"`
+	MaxPayloadBytes     int64         `envconfig:"MAX_PAYLOAD_BYTES" default:"4194304"`
+	MaxRequestBodyBytes int64         `envconfig:"MAX_REQUEST_BODY_BYTES" default:"1048576"` // JSON bodies of endpoints that take no payload
+	RequestTimeout      time.Duration `envconfig:"REQUEST_TIMEOUT" default:"30s"`            // 0 disables
+	EndpointTimeouts    string        `envconfig:"ENDPOINT_TIMEOUTS" default:"/backup=5m,/verify-audit-chain=5m,/offboard-user=5m"`
+
+	// Connection timeouts of the http.Server; 0 disables. WRITE_TIMEOUT is extended for
+	// requests to endpoints whose REQUEST_TIMEOUT or ENDPOINT_TIMEOUTS entry is longer.
+	ReadHeaderTimeout time.Duration `envconfig:"READ_HEADER_TIMEOUT" default:"10s"`
+	ReadTimeout       time.Duration `envconfig:"READ_TIMEOUT" default:"1m"`
+	WriteTimeout      time.Duration `envconfig:"WRITE_TIMEOUT" default:"1m"`
+	IdleTimeout       time.Duration `envconfig:"IDLE_TIMEOUT" default:"2m"`
+
+	// ShutdownTimeout bounds the drain on SIGTERM or Ctrl-C: requests in flight, then
+	// background jobs and shutdown hooks. Keep it below the pod's grace period.
+	ShutdownTimeout time.Duration `envconfig:"SHUTDOWN_TIMEOUT" default:"25s"`
+
+	DEKRetention     time.Duration `envconfig:"DEK_RETENTION" default:"720h"` // how long soft-deleted DEKs can be restored
+	DEKPurgeInterval time.Duration `envconfig:"DEK_PURGE_INTERVAL" default:"1h"`
+
+	MongoClientsCollection string        `envconfig:"MONGO_CLIENTS_COLLECTION" default:"clients"`
+	ClientFlushInterval    time.Duration `envconfig:"CLIENT_FLUSH_INTERVAL" default:"1m"`
+	BlockedClientVersions  string        `envconfig:"BLOCKED_CLIENT_VERSIONS"` // e.g. "kms-go/1.0.0,kms-py/0.*"
+
+	MongoImportTokensCollection string        `envconfig:"MONGO_IMPORT_TOKENS_COLLECTION" default:"import_tokens"`
+	ImportTokenTTL              time.Duration `envconfig:"IMPORT_TOKEN_TTL" default:"24h"`
+
+	MongoUsageCollection string `envconfig:"MONGO_USAGE_COLLECTION" default:"usage_counters"`
+	UsageMetering        bool   `envconfig:"USAGE_METERING" default:"true"` // per-key and per-identity operation counts for /usage and quotas
+	Quotas               string `envconfig:"QUOTAS"`                        // e.g. "key:decrypt=10000/day,identity:*=1000000/month"
+
+	// GCMEncryptionLimit caps encryptions under each AES-GCM DEK and wraps under each
+	// master key; instances reserve GCMEncryptionLease of them at a time.
+	GCMEncryptionLimit           int64  `envconfig:"GCM_ENCRYPTION_LIMIT" default:"4294967296"`
+	GCMEncryptionLease           int64  `envconfig:"GCM_ENCRYPTION_LEASE" default:"1000"`
+	MongoNonceCountersCollection string `envconfig:"MONGO_NONCE_COUNTERS_COLLECTION" default:"nonce_counters"`
+
+	MongoHandoffTokensCollection string        `envconfig:"MONGO_HANDOFF_TOKENS_COLLECTION" default:"handoff_tokens"`
+	HandoffTokenMaxTTL           time.Duration `envconfig:"HANDOFF_TOKEN_MAX_TTL" default:"15m"`
+
+	MongoAliasesCollection string `envconfig:"MONGO_ALIASES_COLLECTION" default:"aliases"`
+	MongoGrantsCollection  string `envconfig:"MONGO_GRANTS_COLLECTION" default:"grants"`
+
+	MongoIndexKeysCollection string `envconfig:"MONGO_INDEX_KEYS_COLLECTION" default:"index_keys"` // blind index keys for /tokenize
+
+	MongoCAsCollection string `envconfig:"MONGO_CERTIFICATE_AUTHORITIES_COLLECTION" default:"certificate_authorities"`
+	CAProfilesFile     string `envconfig:"CA_PROFILES_FILE"` // JSON certificate profiles added to "server" and "client"
+
+	MongoSigningKeysCollection string        `envconfig:"MONGO_SIGNING_KEYS_COLLECTION" default:"signing_keys"`
+	SigningKeyRotationPeriod   time.Duration `envconfig:"SIGNING_KEY_ROTATION_PERIOD" default:"720h"` // 0 disables scheduled rotation
+	JWTMaxTTL                  time.Duration `envconfig:"JWT_MAX_TTL" default:"24h"`
+
+	MongoIdempotencyKeysCollection string        `envconfig:"MONGO_IDEMPOTENCY_KEYS_COLLECTION" default:"idempotency_keys"`
+	IdempotencyKeyTTL              time.Duration `envconfig:"IDEMPOTENCY_KEY_TTL" default:"24h"` // how long retries are answered from the first response
+
+	MongoLegalHoldsCollection          string `envconfig:"MONGO_LEGAL_HOLDS_COLLECTION" default:"legal_holds"`
+	MongoRevocationsCollection         string `envconfig:"MONGO_REVOCATIONS_COLLECTION" default:"revoked_principals"`
+	MongoAPIKeysCollection             string `envconfig:"MONGO_API_KEYS_COLLECTION" default:"api_keys"`
+	MongoTenantKeysCollection          string `envconfig:"MONGO_TENANT_KEYS_COLLECTION" default:"tenant_keys"`
+	MongoCiphertextLocationsCollection string `envconfig:"MONGO_CIPHERTEXT_LOCATIONS_COLLECTION" default:"ciphertext_locations"`
+	MongoKeyRotationsCollection        string `envconfig:"MONGO_KEY_ROTATIONS_COLLECTION" default:"key_rotations"` // history for /key-rotation-history
+
+	// MongoLocksCollection holds the leases that keep rotation, the DEK purge and audit
+	// upkeep to one replica at a time; a replica that stops renewing one loses it after
+	// LOCK_LEASE.
+	MongoLocksCollection string        `envconfig:"MONGO_LOCKS_COLLECTION" default:"locks"`
+	LockLease            time.Duration `envconfig:"LOCK_LEASE" default:"1m"`
+
+	// MongoReplicaURI is the MongoDB cluster of another region. DEK reads fall back to it
+	// when the local cluster lacks the DEK or is down, and with DEKReplication on, DEK
+	// changes made here are copied to it from the local change stream.
+	MongoReplicaURI                 string        `envconfig:"MONGO_REPLICA_URI"`
+	MongoReplicaDBName              string        `envconfig:"MONGO_REPLICA_DB_NAME"` // defaults to MONGO_DB_NAME
+	DEKReplication                  bool          `envconfig:"DEK_REPLICATION" default:"false"`
+	MongoReplicationStateCollection string        `envconfig:"MONGO_REPLICATION_STATE_COLLECTION" default:"replication_state"`
+	DEKReplicationRetryInterval     time.Duration `envconfig:"DEK_REPLICATION_RETRY_INTERVAL" default:"10s"`
+
+	// Every MongoDB client (the user and DEK stores share one) gets these pool settings and timeouts,
+	// overriding MONGO_URI; 0 keeps the URI's or the driver's value.
+	MongoMaxPoolSize            uint64        `envconfig:"MONGO_MAX_POOL_SIZE" default:"100"`
+	MongoMinPoolSize            uint64        `envconfig:"MONGO_MIN_POOL_SIZE" default:"0"`
+	MongoServerSelectionTimeout time.Duration `envconfig:"MONGO_SERVER_SELECTION_TIMEOUT" default:"5s"`
+	MongoSocketTimeout          time.Duration `envconfig:"MONGO_SOCKET_TIMEOUT" default:"30s"`
+	MongoReadPreference         string        `envconfig:"MONGO_READ_PREFERENCE"` // user and DEK stores only; empty keeps the URI's, or primary
+
+	// Calls to the MongoDB user and DEK stores are retried after transient failures, and
+	// fail fast behind a circuit breaker while the cluster is down.
+	MongoRetryAttempts    int           `envconfig:"MONGO_RETRY_ATTEMPTS" default:"3"` // including the first
+	MongoRetryBackoff     time.Duration `envconfig:"MONGO_RETRY_BACKOFF" default:"50ms"`
+	MongoAttemptTimeout   time.Duration `envconfig:"MONGO_ATTEMPT_TIMEOUT" default:"10s"` // 0 leaves it to REQUEST_TIMEOUT
+	MongoBreakerThreshold int           `envconfig:"MONGO_BREAKER_THRESHOLD" default:"5"` // 0 disables the breaker
+	MongoBreakerCooldown  time.Duration `envconfig:"MONGO_BREAKER_COOLDOWN" default:"10s"`
+
+	PolicySource            string        `envconfig:"POLICY_SOURCE"` // builtin, file or mongo; defaults to file when POLICY_FILE is set
+	PolicyFile              string        `envconfig:"POLICY_FILE"`   // JSON role matrix and rules
+	MongoPoliciesCollection string        `envconfig:"MONGO_POLICIES_COLLECTION" default:"policies"`
+	PolicyReloadInterval    time.Duration `envconfig:"POLICY_RELOAD_INTERVAL" default:"30s"` // 0 disables hot reload
+
+	ComplianceProfile string        `envconfig:"COMPLIANCE_PROFILE"` // pci, hipaa or fedramp-moderate; empty enforces none
+	DualControl       bool          `envconfig:"DUAL_CONTROL" default:"false"`
+	DualControlTTL    time.Duration `envconfig:"DUAL_CONTROL_TTL" default:"1h"`
+
+	FailureModes string `envconfig:"FAILURE_MODES"` // e.g. "legal-holds=closed,tenant-cmk=open"
+
+	WarmupRetryInterval time.Duration `envconfig:"WARMUP_RETRY_INTERVAL" default:"2s"`
+	HealthCheckInterval time.Duration `envconfig:"HEALTH_CHECK_INTERVAL" default:"10s"`
+
+	UsageExportPath     string        `envconfig:"USAGE_EXPORT_PATH"` // JSON lines file; empty disables the export
+	UsageExportInterval time.Duration `envconfig:"USAGE_EXPORT_INTERVAL" default:"24h"`
+	UsageExportEpsilon  float64       `envconfig:"USAGE_EXPORT_EPSILON" default:"1.0"`
+
+	MongoAuditCollection string        `envconfig:"MONGO_AUDIT_COLLECTION" default:"audit_events"`
+	AuditRetention       time.Duration `envconfig:"AUDIT_RETENTION" default:"0"`         // TTL on audit events; 0 keeps them forever
+	AuditArchiveDir      string        `envconfig:"AUDIT_ARCHIVE_DIR"`                   // gzipped JSON lines; empty disables archival
+	AuditArchiveAfter    time.Duration `envconfig:"AUDIT_ARCHIVE_AFTER" default:"2160h"` // age at which events move to the archive
+	AuditArchiveInterval time.Duration `envconfig:"AUDIT_ARCHIVE_INTERVAL" default:"1h"`
+
+	AuditSyslogAddr        string        `envconfig:"AUDIT_SYSLOG_ADDR"`    // tcp://, udp:// or tls://host:port; CEF over syslog
+	AuditWebhookURL        string        `envconfig:"AUDIT_WEBHOOK_URL"`    // https URL receiving signed JSON batches
+	AuditWebhookSecret     string        `envconfig:"AUDIT_WEBHOOK_SECRET"` // HMAC-SHA256 key for X-KMS-Signature
+	AuditKafkaRESTURL      string        `envconfig:"AUDIT_KAFKA_REST_URL"` // Kafka REST Proxy base URL
+	AuditKafkaTopic        string        `envconfig:"AUDIT_KAFKA_TOPIC" default:"kms-audit"`
+	AuditSinkBufferSize    int           `envconfig:"AUDIT_SINK_BUFFER_SIZE" default:"10000"`
+	AuditSinkBatchSize     int           `envconfig:"AUDIT_SINK_BATCH_SIZE" default:"100"`
+	AuditSinkFlushInterval time.Duration `envconfig:"AUDIT_SINK_FLUSH_INTERVAL" default:"5s"`
+
+	// Key lifecycle events: EVENTS_ENABLED serves them at /events, and every URL in
+	// EVENT_WEBHOOK_URLS receives them as signed JSON batches.
+	EventsEnabled      bool          `envconfig:"EVENTS_ENABLED" default:"false"`
+	EventWebhookURLs   string        `envconfig:"EVENT_WEBHOOK_URLS"`   // comma-separated https URLs
+	EventWebhookSecret string        `envconfig:"EVENT_WEBHOOK_SECRET"` // HMAC-SHA256 key for X-KMS-Signature
+	EventBufferSize    int           `envconfig:"EVENT_BUFFER_SIZE" default:"1000"`
+	EventBatchSize     int           `envconfig:"EVENT_BATCH_SIZE" default:"100"`
+	EventFlushInterval time.Duration `envconfig:"EVENT_FLUSH_INTERVAL" default:"1s"`
+
+	// EVENT_BROKER (kafka or nats) publishes lifecycle events, and audit events unless
+	// EVENT_BROKER_AUDIT_TOPIC is set empty, through an outbox in MongoDB. EVENT_BROKER_URL
+	// is the Kafka REST Proxy, or a nats:// or tls:// URL with any credentials in it.
+	EventBroker                string        `envconfig:"EVENT_BROKER"`
+	EventBrokerURL             string        `envconfig:"EVENT_BROKER_URL"`
+	EventBrokerTopic           string        `envconfig:"EVENT_BROKER_TOPIC" default:"kms.key-events"`
+	EventBrokerAuditTopic      string        `envconfig:"EVENT_BROKER_AUDIT_TOPIC" default:"kms.audit"`
+	EventBrokerJetStream       bool          `envconfig:"EVENT_BROKER_JETSTREAM" default:"true"` // wait for JetStream acks, not just the NATS server's
+	EventOutboxBatchSize       int           `envconfig:"EVENT_OUTBOX_BATCH_SIZE" default:"100"`
+	EventOutboxInterval        time.Duration `envconfig:"EVENT_OUTBOX_INTERVAL" default:"1s"`
+	EventOutboxRetention       time.Duration `envconfig:"EVENT_OUTBOX_RETENTION" default:"24h"` // how long published messages are kept
+	MongoEventOutboxCollection string        `envconfig:"MONGO_EVENT_OUTBOX_COLLECTION" default:"event_outbox"`
+
+	MongoAuditCheckpointsCollection string        `envconfig:"MONGO_AUDIT_CHECKPOINTS_COLLECTION" default:"audit_checkpoints"`
+	AuditCheckpointInterval         time.Duration `envconfig:"AUDIT_CHECKPOINT_INTERVAL" default:"1h"`
+
+	AWSKMSFacade    bool   `envconfig:"AWS_KMS_FACADE" default:"false"` // serve the AWS KMS JSON protocol at /aws-kms
+	AWSKMSRegion    string `envconfig:"AWS_KMS_REGION" default:"us-east-1"`
+	AWSKMSAccountID string `envconfig:"AWS_KMS_ACCOUNT_ID" default:"000000000000"` // used in key ARNs
+
+	VaultTransit bool `envconfig:"VAULT_TRANSIT" default:"false"` // serve Vault's transit encrypt/decrypt at /v1/transit
+
+	LegacyRoutes       string `envconfig:"LEGACY_ROUTES" default:"on"` // on or off: serve the unversioned paths that predate /v1
+	LegacyRoutesSunset string `envconfig:"LEGACY_ROUTES_SUNSET"`       // RFC 3339; announced in the Sunset header
+
+	LogLevel  string `envconfig:"LOG_LEVEL" default:"info"`  // debug, info, warn or error
+	LogFormat string `envconfig:"LOG_FORMAT" default:"json"` // json or text
+
+	MetricsToken string `envconfig:"METRICS_TOKEN"` // bearer token for /metrics; empty leaves it open
+
+	// Only the exporter switch lives here; OTEL_EXPORTER_OTLP_*, OTEL_TRACES_SAMPLER and
+	// OTEL_SERVICE_NAME are read by the OpenTelemetry SDK.
+	TracesExporter string `envconfig:"OTEL_TRACES_EXPORTER" default:"none"` // otlp or none
+
+	RateLimitBackend        string        `envconfig:"RATE_LIMIT_BACKEND" default:"memory"` // memory, redis or off
+	RateLimitIP             string        `envconfig:"RATE_LIMIT_IP" default:"100/s:200"`   // per client IP, before authentication
+	RateLimitIdentity       string        `envconfig:"RATE_LIMIT_IDENTITY" default:"20/s:40"`
+	RateLimitEndpoints      string        `envconfig:"RATE_LIMIT_ENDPOINTS" default:"/encrypt=50/s:100,/decrypt=10/s:20,/re-encrypt=10/s:20,/encrypt-fields=50/s:100,/decrypt-fields=10/s:20,/encrypt-fpe=50/s:100,/decrypt-fpe=10/s:20,/tokenize=50/s:100"`
+	ConcurrencyLimits       string        `envconfig:"CONCURRENCY_LIMITS" default:"/decrypt=64:256,/re-encrypt=32:128,/decrypt-fields=32:128,/decrypt-fpe=32:128,/encrypt=128:512"` // "off" disables
+	ConcurrencyQueueTimeout time.Duration `envconfig:"CONCURRENCY_QUEUE_TIMEOUT" default:"1s"`
+	RedisURL                string        `envconfig:"REDIS_URL"` // redis:// or rediss://, for RATE_LIMIT_BACKEND=redis and DEK_CACHE
+
+	DEKCache         bool          `envconfig:"DEK_CACHE" default:"false"` // cache wrapped DEKs in Redis at REDIS_URL
+	DEKCacheTTL      time.Duration `envconfig:"DEK_CACHE_TTL" default:"5m"`
+	DEKCacheLocalTTL time.Duration `envconfig:"DEK_CACHE_LOCAL_TTL" default:"10s"` // in-process tier, in front of Redis
+
+	// EncryptDEKMetadata seals DEK descriptions, tags and policies under a key derived from
+	// the master keys. Already sealed DEKs stay readable when it is turned off.
+	EncryptDEKMetadata bool `envconfig:"ENCRYPT_DEK_METADATA" default:"false"`
+
+	DLPMode      string `envconfig:"DLP_MODE" default:"off"` // off, flag or block
+	DLPRulesFile string `envconfig:"DLP_RULES_FILE"`         // JSON rules added to the built-in set
 }
 
-func LoadConfig() (*Config, error) {
+// envFile is the file LoadConfig and ReloadConfig read settings from, beneath the
+// process environment and above File.
+const envFile = ".env"
 
-	if err := godotenv.Load(); err != nil {
+// fromEnvFile records the variables LoadConfig took from envFile or File rather than
+// the process environment; only those can change on ReloadConfig.
+var fromEnvFile = map[string]bool{}
+
+func LoadConfig() (*Config, error) {
+	vals, err := readFile()
+	if err != nil {
+		return nil, err
+	}
+	envVals, err := godotenv.Read(envFile)
+	if err != nil {
 		fmt.Println("No .env file found, relying on environment variables...")
 	}
+	vals = mergeSettings(vals, envVals)
+	for k, v := range vals {
+		if _, set := os.LookupEnv(k); !set {
+			os.Setenv(k, v)
+			fromEnvFile[k] = true
+		}
+	}
 
 	var cfg Config
-	err := envconfig.Process("", &cfg)
+	err = envconfig.Process("", &cfg)
 	if err != nil {
 		return nil, fmt.Errorf("failed to process environment variables: %w", err)
 	}
 	return &cfg, nil
 }
 
+// ReloadConfig reads .env and File again and returns the configuration they now give.
+// Variables set in the process environment at start-up still win, as they did for
+// LoadConfig.
+func ReloadConfig() (*Config, error) {
+	fileVals, err := readFile()
+	if err != nil {
+		return nil, err
+	}
+	envVals, err := godotenv.Read(envFile)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("failed to read %s: %w", envFile, err)
+	}
+	vals := mergeSettings(fileVals, envVals)
+	for k, v := range vals {
+		if _, set := os.LookupEnv(k); !set || fromEnvFile[k] {
+			os.Setenv(k, v)
+			fromEnvFile[k] = true
+		}
+	}
+	for k := range fromEnvFile {
+		if _, ok := vals[k]; !ok {
+			os.Unsetenv(k) // removed from the file: back to its default
+			delete(fromEnvFile, k)
+		}
+	}
+
+	var cfg Config
+	if err := envconfig.Process("", &cfg); err != nil {
+		return nil, fmt.Errorf("failed to process environment variables: %w", err)
+	}
+	return &cfg, nil
+}
+
+// mergeSettings returns the settings in base with those in over replacing them.
+func mergeSettings(base, over map[string]string) map[string]string {
+	if base == nil {
+		return over
+	}
+	for k, v := range over {
+		base[k] = v
+	}
+	return base
+}
+
+// ParseSnapshotKey decodes SNAPSHOT_KEY.
+func (cfg *Config) ParseSnapshotKey() ([]byte, error) {
+	if cfg.SnapshotKey == "" {
+		return nil, errors.New("SNAPSHOT_KEY is not set")
+	}
+	key, err := base64.StdEncoding.DecodeString(cfg.SnapshotKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode SNAPSHOT_KEY: %w", err)
+	}
+	if len(key) != 32 {
+		return nil, errors.New("SNAPSHOT_KEY must be 32 bytes")
+	}
+	return key, nil
+}
+
+// ParseAttestationKey decodes ATTESTATION_KEY into an Ed25519 signing key.
+func (cfg *Config) ParseAttestationKey() (ed25519.PrivateKey, error) {
+	if cfg.AttestationKey == "" {
+		return nil, errors.New("ATTESTATION_KEY is not set")
+	}
+	seed, err := base64.StdEncoding.DecodeString(cfg.AttestationKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode ATTESTATION_KEY: %w", err)
+	}
+	if len(seed) != ed25519.SeedSize {
+		return nil, errors.New("ATTESTATION_KEY must be 32 bytes")
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// ParseTLSMinVersion decodes TLS_MIN_VERSION.
+func (cfg *Config) ParseTLSMinVersion() (uint16, error) {
+	switch cfg.TLSMinVersion {
+	case "1.2", "":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	default:
+		return 0, fmt.Errorf("unsupported TLS_MIN_VERSION %q; expected 1.2 or 1.3", cfg.TLSMinVersion)
+	}
+}
+
+// Redacted returns a copy of the configuration with secrets removed, for hashing and display.
+func (cfg *Config) Redacted() Config {
+	c := *cfg
+	c.MongoURI = ""
+	c.MongoReplicaURI = ""
+	c.PostgresURL = ""
+	c.MasterKeys = ""
+	c.SnapshotKey = ""
+	c.AttestationKey = ""
+	c.AuditWebhookSecret = ""
+	c.EventWebhookSecret = ""
+	c.EventBrokerURL = "" // may carry NATS credentials
+	c.MetricsToken = ""
+	c.RedisURL = ""
+	return c
+}
+
+// ParseDevUsers decodes DEV_USERS, e.g. "alice=ADMIN,bob=USER@acme".
+func (cfg *Config) ParseDevUsers() ([]DevUser, error) {
+	var users []DevUser
+	for _, p := range strings.Split(cfg.DevUsers, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		uid, role, ok := strings.Cut(p, "=")
+		if !ok || uid == "" || role == "" {
+			return nil, fmt.Errorf("invalid DEV_USERS entry %q; expected uid=ROLE[@tenant]", p)
+		}
+		role, tenant, _ := strings.Cut(role, "@")
+		users = append(users, DevUser{UID: uid, Role: role, Tenant: tenant})
+	}
+	return users, nil
+}
+
 func (cfg *Config) ParseMasterKeys() ([]MasterKey, error) {
 	parts := strings.Split(cfg.MasterKeys, ",")
 	var masterKeys []MasterKey
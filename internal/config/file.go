@@ -0,0 +1,162 @@
+package config
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// File is the YAML or JSON configuration file LoadConfig reads, set by -config or
+// KMS_CONFIG_FILE. Empty means none.
+var File = os.Getenv("KMS_CONFIG_FILE")
+
+// readFile returns the settings in File as environment variables, which the process
+// environment and .env override.
+//
+// Keys are the variable names, in any case, and nested maps join their keys with
+// underscores, so rate_limit: {ip: 100/s:200} sets RATE_LIMIT_IP. A list is joined with
+// commas and a map under a setting's own name becomes its key=value pairs, e.g.
+// endpoint_timeouts: {/backup: 5m}. master_keys takes a list of {id, key} or
+// {id, keyFile} entries. Unknown keys are an error, so a typo isn't silently ignored.
+func readFile() (map[string]string, error) {
+	if File == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(File)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", File, err)
+	}
+	var doc map[string]interface{}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", File, err)
+	}
+	vals := make(map[string]string)
+	if err := flattenSettings("", doc, vals); err != nil {
+		return nil, fmt.Errorf("%s: %w", File, err)
+	}
+	return vals, nil
+}
+
+// settingNames are the variables Config reads.
+var settingNames = func() map[string]bool {
+	names := make(map[string]bool)
+	t := reflect.TypeOf(Config{})
+	for i := 0; i < t.NumField(); i++ {
+		if name := t.Field(i).Tag.Get("envconfig"); name != "" {
+			names[name] = true
+		}
+	}
+	return names
+}()
+
+func flattenSettings(prefix string, m map[string]interface{}, vals map[string]string) error {
+	for k, v := range m {
+		name := strings.ToUpper(strings.NewReplacer("-", "_", ".", "_").Replace(k))
+		if prefix != "" {
+			name = prefix + "_" + name
+		}
+		if name == "MASTER_KEYS" {
+			if list, ok := v.([]interface{}); ok {
+				keys, err := fileMasterKeys(list)
+				if err != nil {
+					return err
+				}
+				vals[name] = keys
+				continue
+			}
+		}
+		nested, isMap := v.(map[string]interface{})
+		if !settingNames[name] {
+			if !isMap {
+				return fmt.Errorf("unknown setting %s", name)
+			}
+			if err := flattenSettings(name, nested, vals); err != nil {
+				return err
+			}
+			continue
+		}
+		s, err := settingValue(name, v)
+		if err != nil {
+			return err
+		}
+		vals[name] = s
+	}
+	return nil
+}
+
+// settingValue writes v the way the variable would hold it.
+func settingValue(name string, v interface{}) (string, error) {
+	switch v := v.(type) {
+	case nil:
+		return "", nil
+	case []interface{}:
+		parts := make([]string, 0, len(v))
+		for _, e := range v {
+			s, err := settingValue(name, e)
+			if err != nil {
+				return "", err
+			}
+			parts = append(parts, s)
+		}
+		return strings.Join(parts, ","), nil
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		parts := make([]string, 0, len(v))
+		for _, k := range keys {
+			s, err := settingValue(name, v[k])
+			if err != nil {
+				return "", err
+			}
+			parts = append(parts, k+"="+s)
+		}
+		return strings.Join(parts, ","), nil
+	case string, bool, int, int64, uint64, float64:
+		return fmt.Sprint(v), nil
+	default:
+		return "", fmt.Errorf("%s has unsupported value %v", name, v)
+	}
+}
+
+// fileMasterKeys turns the master_keys list into MASTER_KEYS. keyFile names a file
+// holding the base64 key, such as a mounted secret, in place of key.
+func fileMasterKeys(list []interface{}) (string, error) {
+	parts := make([]string, 0, len(list))
+	for i, e := range list {
+		entry, ok := e.(map[string]interface{})
+		if !ok {
+			return "", fmt.Errorf("master_keys[%d] must be a map with id and key or keyFile", i)
+		}
+		id, _ := entry["id"].(string)
+		key, _ := entry["key"].(string)
+		keyFile, _ := entry["keyFile"].(string)
+		for k := range entry {
+			if k != "id" && k != "key" && k != "keyFile" {
+				return "", fmt.Errorf("master_keys[%d] has unknown field %s", i, k)
+			}
+		}
+		if id == "" || (key == "") == (keyFile == "") {
+			return "", fmt.Errorf("master_keys[%d] needs an id and exactly one of key or keyFile", i)
+		}
+		if keyFile != "" {
+			data, err := os.ReadFile(keyFile)
+			if err != nil {
+				return "", fmt.Errorf("failed to read key file for master key %s: %w", id, err)
+			}
+			key = strings.TrimSpace(string(data))
+		}
+		if _, err := base64.StdEncoding.DecodeString(key); err != nil {
+			return "", fmt.Errorf("failed to decode base64 key for ID %s: %w", id, err)
+		}
+		parts = append(parts, id+":"+key)
+	}
+	return strings.Join(parts, ","), nil
+}
@@ -0,0 +1,209 @@
+package crypto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"strings"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Algorithm identifies what a data key is used with: a symmetric AEAD, HPKE for a
+// recipient key pair, or HKDF for a root secret.
+type Algorithm string
+
+const (
+	AlgorithmAES256GCM         Algorithm = "AES_256_GCM"
+	AlgorithmAES128GCM         Algorithm = "AES_128_GCM"
+	AlgorithmXChaCha20Poly1305 Algorithm = "XCHACHA20_POLY1305"
+	AlgorithmAES256GCMSIV      Algorithm = "AES_256_GCM_SIV" // nonce-misuse resistant
+
+	// AlgorithmAES256SIV is deterministic: equal plaintexts under the same key and AAD
+	// encrypt to equal ciphertexts.
+	AlgorithmAES256SIV Algorithm = "AES_256_SIV"
+
+	// AlgorithmHPKEX25519 makes the key an X25519 private key that only opens HPKE
+	// messages senders sealed to its public key; see HPKEOpen.
+	AlgorithmHPKEX25519 Algorithm = "HPKE_X25519_AES_256_GCM"
+
+	// AlgorithmHKDFSHA256 makes the key a root secret that only derives other keys; see
+	// DeriveKey.
+	AlgorithmHKDFSHA256 Algorithm = "HKDF_SHA256"
+)
+
+// DefaultAlgorithm is used when a key does not name one.
+const DefaultAlgorithm = AlgorithmAES256GCM
+
+// SupportedAlgorithms lists every algorithm the server can operate.
+var SupportedAlgorithms = []Algorithm{AlgorithmAES256GCM, AlgorithmAES128GCM, AlgorithmXChaCha20Poly1305, AlgorithmAES256GCMSIV, AlgorithmAES256SIV, AlgorithmHPKEX25519, AlgorithmHKDFSHA256}
+
+// ParseAlgorithm validates an algorithm name. An empty name yields the default.
+func ParseAlgorithm(name string) (Algorithm, error) {
+	if name == "" {
+		return DefaultAlgorithm, nil
+	}
+	alg := Algorithm(strings.ToUpper(name))
+	for _, a := range SupportedAlgorithms {
+		if a == alg {
+			return alg, nil
+		}
+	}
+	return "", fmt.Errorf("unsupported algorithm %q", name)
+}
+
+// KeySize returns the key length in bytes.
+func (a Algorithm) KeySize() int {
+	switch a {
+	case AlgorithmAES128GCM:
+		return 16
+	case AlgorithmAES256GCM, AlgorithmXChaCha20Poly1305, AlgorithmAES256GCMSIV, AlgorithmHPKEX25519, AlgorithmHKDFSHA256:
+		return 32
+	case AlgorithmAES256SIV:
+		return 64 // a MAC key and an encryption key
+	default:
+		return 0
+	}
+}
+
+// Deterministic reports whether alg encrypts equal inputs to equal ciphertexts.
+func (a Algorithm) Deterministic() bool {
+	return a == AlgorithmAES256SIV
+}
+
+// HPKE reports whether alg is a recipient key pair rather than a symmetric key.
+func (a Algorithm) HPKE() bool {
+	return a == AlgorithmHPKEX25519
+}
+
+// Derivation reports whether alg is a root secret for DeriveKey.
+func (a Algorithm) Derivation() bool {
+	return a == AlgorithmHKDFSHA256
+}
+
+// NonceLimited reports whether alg's random nonces are short enough that a key must stop
+// encrypting after a bounded number of messages: AES-GCM's 96 bits, which NIST SP
+// 800-38D limits to 2^32 messages per key.
+func (a Algorithm) NonceLimited() bool {
+	return a == AlgorithmAES256GCM || a == AlgorithmAES128GCM
+}
+
+// KeyBits returns the key length in bits. For AES-SIV that is the strength of each of
+// its two AES keys.
+func (a Algorithm) KeyBits() int {
+	if a == AlgorithmAES256SIV {
+		return a.KeySize() * 4
+	}
+	return a.KeySize() * 8
+}
+
+// Overhead returns the ciphertext expansion (nonce plus authentication tag) in bytes.
+func (a Algorithm) Overhead() int {
+	switch a {
+	case AlgorithmAES256GCM, AlgorithmAES128GCM, AlgorithmAES256GCMSIV:
+		return 12 + 16
+	case AlgorithmXChaCha20Poly1305:
+		return chacha20poly1305.NonceSizeX + chacha20poly1305.Overhead
+	case AlgorithmAES256SIV:
+		return sivSize
+	case AlgorithmHPKEX25519:
+		return HPKEEncSize + 16
+	default:
+		return 0
+	}
+}
+
+// MaxOverhead returns the largest Overhead of any supported algorithm.
+func MaxOverhead() int {
+	n := 0
+	for _, a := range SupportedAlgorithms {
+		n = max(n, a.Overhead())
+	}
+	return n
+}
+
+// AEAD builds the cipher for key.
+func (a Algorithm) AEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) != a.KeySize() {
+		return nil, fmt.Errorf("%s requires a %d-byte key", a, a.KeySize())
+	}
+	switch a {
+	case AlgorithmAES256GCM, AlgorithmAES128GCM:
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create AES cipher: %w", err)
+		}
+		gcm, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create GCM cipher: %w", err)
+		}
+		return gcm, nil
+	case AlgorithmXChaCha20Poly1305:
+		aead, err := chacha20poly1305.NewX(key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create XChaCha20-Poly1305 cipher: %w", err)
+		}
+		return aead, nil
+	case AlgorithmAES256GCMSIV:
+		return newGCMSIV(key)
+	case AlgorithmAES256SIV:
+		return newSIV(key)
+	case AlgorithmHPKEX25519:
+		return nil, fmt.Errorf("%s is a key pair for HPKE, not a symmetric cipher", a)
+	case AlgorithmHKDFSHA256:
+		return nil, fmt.Errorf("%s is a root secret for key derivation, not a symmetric cipher", a)
+	default:
+		return nil, fmt.Errorf("unsupported algorithm %q", a)
+	}
+}
+
+// GenerateKeyFor creates a random key of the right size for alg.
+func GenerateKeyFor(alg Algorithm) ([]byte, error) {
+	if alg.KeySize() == 0 {
+		return nil, fmt.Errorf("unsupported algorithm %q", alg)
+	}
+	if alg.HPKE() {
+		return GenerateHPKEKey()
+	}
+	key := make([]byte, alg.KeySize())
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("failed to generate key: %w", err)
+	}
+	return key, nil
+}
+
+// Encrypt seals plaintext with alg, returning nonce + ciphertext. aad is authenticated but not encrypted.
+func Encrypt(alg Algorithm, key, plaintext, aad []byte) ([]byte, error) {
+	aead, err := alg.AEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	return aead.Seal(nonce, nonce, plaintext, aad), nil
+}
+
+// Decrypt opens nonce + ciphertext produced by Encrypt with the same aad.
+func Decrypt(alg Algorithm, key, ciphertext, aad []byte) ([]byte, error) {
+	aead, err := alg.AEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonceSize := aead.NonceSize()
+	if len(ciphertext) < nonceSize {
+		return nil, fmt.Errorf("ciphertext too short")
+	}
+	nonce, actualCipher := ciphertext[:nonceSize], ciphertext[nonceSize:]
+
+	plaintext, err := aead.Open(nil, nonce, actualCipher, aad)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt ciphertext: %w", err)
+	}
+	return plaintext, nil
+}
@@ -0,0 +1,42 @@
+package crypto
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+const (
+	maxContextEntries = 64
+	maxContextLength  = 256
+)
+
+// EncryptionContextAAD encodes an encryption context as additional authenticated data.
+// Keys are sorted, so equal contexts always produce the same bytes. An empty context yields nil,
+// which keeps ciphertext written before encryption contexts existed decryptable.
+func EncryptionContextAAD(ctx map[string]string) ([]byte, error) {
+	if len(ctx) == 0 {
+		return nil, nil
+	}
+	aad, err := json.Marshal(ctx) // encoding/json sorts map keys
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode encryption context: %w", err)
+	}
+	return aad, nil
+}
+
+// ValidateEncryptionContext checks the size of an encryption context.
+func ValidateEncryptionContext(ctx map[string]string) error {
+	if len(ctx) > maxContextEntries {
+		return fmt.Errorf("encryption context cannot have more than %d entries", maxContextEntries)
+	}
+	for k, v := range ctx {
+		if k == "" {
+			return errors.New("encryption context keys cannot be empty")
+		}
+		if len(k) > maxContextLength || len(v) > maxContextLength {
+			return fmt.Errorf("encryption context keys and values are limited to %d bytes", maxContextLength)
+		}
+	}
+	return nil
+}
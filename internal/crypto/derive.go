@@ -0,0 +1,38 @@
+package crypto
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	// MinDerivedKeySize and MaxDerivedKeySize bound the keys DeriveKey returns.
+	MinDerivedKeySize = 16
+	MaxDerivedKeySize = 64
+
+	// MaxDerivationInfoSize bounds the info and salt callers pass to DeriveKey.
+	MaxDerivationInfoSize = 1024
+)
+
+// DeriveKey runs HKDF-SHA256 (RFC 5869) over an HKDF_SHA256 root secret. The same
+// root, salt and info always give the same key; info names the purpose, so it may not
+// be empty.
+func DeriveKey(root, salt, info []byte, size int) ([]byte, error) {
+	if size < MinDerivedKeySize || size > MaxDerivedKeySize {
+		return nil, fmt.Errorf("derived key size must be %d to %d bytes", MinDerivedKeySize, MaxDerivedKeySize)
+	}
+	if len(info) == 0 {
+		return nil, fmt.Errorf("info is required; it names what the derived key is for")
+	}
+	if len(info) > MaxDerivationInfoSize || len(salt) > MaxDerivationInfoSize {
+		return nil, fmt.Errorf("info and salt may be at most %d bytes each", MaxDerivationInfoSize)
+	}
+	key := make([]byte, size)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, root, salt, info), key); err != nil {
+		return nil, fmt.Errorf("failed to derive key: %w", err)
+	}
+	return key, nil
+}
@@ -0,0 +1,326 @@
+package crypto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"math/big"
+	"slices"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// Format-preserving encryption (NIST SP 800-38G rev. 1): FF1 and FF3-1 encrypt a
+// string of numerals in some radix to another string of the same length and radix, so
+// a 16-digit card number stays a 16-digit number. Both are deterministic for a given
+// key and tweak.
+
+// FPEMode names an FPE algorithm.
+type FPEMode string
+
+const (
+	FPEModeFF1  FPEMode = "FF1"
+	FPEModeFF31 FPEMode = "FF3-1"
+)
+
+// FPE limits from SP 800-38G: the domain must hold at least a million values, and
+// FF1 tweaks are bounded here to keep requests small.
+const (
+	fpeMinDomain    = 1000000
+	fpeMaxRadix     = 1 << 16
+	FF1MaxTweakSize = 256
+	FF31TweakSize   = 7
+)
+
+// FPE encrypts and decrypts numeral strings; each numeral is in [0, radix).
+type FPE interface {
+	Encrypt(tweak []byte, x []uint16) ([]uint16, error)
+	Decrypt(tweak []byte, x []uint16) ([]uint16, error)
+	// Lengths returns the shortest and longest strings the cipher accepts.
+	Lengths() (minLen, maxLen int)
+}
+
+// NewFPE builds mode with an AES key of 16, 24 or 32 bytes.
+func NewFPE(mode FPEMode, key []byte, radix int) (FPE, error) {
+	if radix < 2 || radix > fpeMaxRadix {
+		return nil, fmt.Errorf("radix must be between 2 and %d", fpeMaxRadix)
+	}
+	minLen := 2
+	for d := big.NewInt(int64(radix * radix)); d.Cmp(big.NewInt(fpeMinDomain)) < 0; d.Mul(d, big.NewInt(int64(radix))) {
+		minLen++
+	}
+	switch mode {
+	case FPEModeFF1:
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create AES cipher: %w", err)
+		}
+		return &ff1{block: block, radix: radix, minLen: minLen}, nil
+	case FPEModeFF31:
+		block, err := aes.NewCipher(reverseBytes(key))
+		if err != nil {
+			return nil, fmt.Errorf("failed to create AES cipher: %w", err)
+		}
+		// maxlen = 2 * floor(log_radix(2^96))
+		half := 0
+		limit := new(big.Int).Lsh(big.NewInt(1), 96)
+		for d := big.NewInt(int64(radix)); d.Cmp(limit) <= 0; d.Mul(d, big.NewInt(int64(radix))) {
+			half++
+		}
+		return &ff31{block: block, radix: radix, minLen: minLen, maxLen: 2 * half}, nil
+	default:
+		return nil, fmt.Errorf("unsupported FPE mode %q; use %s or %s", mode, FPEModeFF1, FPEModeFF31)
+	}
+}
+
+// DeriveFPEKey derives the AES-256 key mode uses from a data key and an encryption
+// context AAD, so FPE never shares key material with the data key's own algorithm and
+// values encrypted under one context do not decrypt under another.
+func DeriveFPEKey(dek []byte, mode FPEMode, aad []byte) ([]byte, error) {
+	info := append([]byte("my-kms fpe "+string(mode)+"\x00"), aad...)
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, dek, nil, info), key); err != nil {
+		return nil, fmt.Errorf("failed to derive FPE key: %w", err)
+	}
+	return key, nil
+}
+
+// ---------------------------------------------------------------------
+// FF1
+// ---------------------------------------------------------------------
+
+type ff1 struct {
+	block  cipher.Block
+	radix  int
+	minLen int
+}
+
+func (f *ff1) Lengths() (int, int) { return f.minLen, 1 << 16 }
+
+func (f *ff1) Encrypt(tweak []byte, x []uint16) ([]uint16, error) {
+	return f.crypt(tweak, x, true)
+}
+
+func (f *ff1) Decrypt(tweak []byte, x []uint16) ([]uint16, error) {
+	return f.crypt(tweak, x, false)
+}
+
+func (f *ff1) crypt(tweak []byte, x []uint16, encrypt bool) ([]uint16, error) {
+	if err := checkNumerals(f, f.radix, x); err != nil {
+		return nil, err
+	}
+	if len(tweak) > FF1MaxTweakSize {
+		return nil, fmt.Errorf("FF1 tweak must be at most %d bytes", FF1MaxTweakSize)
+	}
+	n, t := len(x), len(tweak)
+	u := n / 2
+	v := n - u
+	radix := big.NewInt(int64(f.radix))
+	a, b := slices.Clone(x[:u]), slices.Clone(x[u:])
+
+	maxV := new(big.Int).Exp(radix, big.NewInt(int64(v)), nil)
+	bLen := (maxV.Sub(maxV, big.NewInt(1)).BitLen() + 7) / 8
+	d := 4*((bLen+3)/4) + 4
+
+	p := []byte{1, 2, 1, byte(f.radix >> 16), byte(f.radix >> 8), byte(f.radix), 10, byte(u),
+		byte(n >> 24), byte(n >> 16), byte(n >> 8), byte(n), byte(t >> 24), byte(t >> 16), byte(t >> 8), byte(t)}
+	pad := ((-t-bLen-1)%16 + 16) % 16
+	q := make([]byte, t+pad+1+bLen)
+	copy(q, tweak)
+
+	modU := new(big.Int).Exp(radix, big.NewInt(int64(u)), nil)
+	modV := new(big.Int).Exp(radix, big.NewInt(int64(v)), nil)
+	r := make([]byte, aes.BlockSize)
+	s := make([]byte, ((d+15)/16)*16)
+	for step := 0; step < 10; step++ {
+		i := step
+		if !encrypt {
+			i = 9 - step
+		}
+		// The half that feeds the round function: B when encrypting, A when decrypting.
+		in := b
+		if !encrypt {
+			in = a
+		}
+		q[t+pad] = byte(i)
+		num(in, f.radix).FillBytes(q[t+pad+1:])
+
+		clear(r)
+		cbcMAC(f.block, r, p)
+		cbcMAC(f.block, r, q)
+		copy(s, r)
+		for j := 1; j*16 < d; j++ {
+			blk := s[j*16 : (j+1)*16]
+			copy(blk, r)
+			blk[15] ^= byte(j)
+			blk[14] ^= byte(j >> 8)
+			f.block.Encrypt(blk, blk)
+		}
+		y := new(big.Int).SetBytes(s[:d])
+
+		m, mod := u, modU
+		if i%2 == 1 {
+			m, mod = v, modV
+		}
+		var c *big.Int
+		if encrypt {
+			c = new(big.Int).Add(num(a, f.radix), y)
+		} else {
+			c = new(big.Int).Sub(num(b, f.radix), y)
+		}
+		c.Mod(c, mod)
+		out := str(c, f.radix, m)
+		if encrypt {
+			a, b = b, out
+		} else {
+			a, b = out, a
+		}
+	}
+	return append(a, b...), nil
+}
+
+// cbcMAC folds msg, a whole number of blocks, into the chaining value r.
+func cbcMAC(block cipher.Block, r, msg []byte) {
+	for i := 0; i < len(msg); i += aes.BlockSize {
+		for j := 0; j < aes.BlockSize; j++ {
+			r[j] ^= msg[i+j]
+		}
+		block.Encrypt(r, r)
+	}
+}
+
+// ---------------------------------------------------------------------
+// FF3-1
+// ---------------------------------------------------------------------
+
+type ff31 struct {
+	block          cipher.Block // under the byte-reversed key
+	radix          int
+	minLen, maxLen int
+}
+
+func (f *ff31) Lengths() (int, int) { return f.minLen, f.maxLen }
+
+func (f *ff31) Encrypt(tweak []byte, x []uint16) ([]uint16, error) {
+	return f.crypt(tweak, x, true)
+}
+
+func (f *ff31) Decrypt(tweak []byte, x []uint16) ([]uint16, error) {
+	return f.crypt(tweak, x, false)
+}
+
+func (f *ff31) crypt(tweak []byte, x []uint16, encrypt bool) ([]uint16, error) {
+	if err := checkNumerals(f, f.radix, x); err != nil {
+		return nil, err
+	}
+	if len(tweak) != FF31TweakSize {
+		return nil, fmt.Errorf("FF3-1 tweak must be %d bytes", FF31TweakSize)
+	}
+	tl := []byte{tweak[0], tweak[1], tweak[2], tweak[3] & 0xf0}
+	tr := []byte{tweak[4], tweak[5], tweak[6], tweak[3] << 4}
+	return f.rounds(tl, tr, x, encrypt), nil
+}
+
+// rounds is the FF3 Feistel network with the 32-bit tweak halves tl and tr.
+func (f *ff31) rounds(tl, tr []byte, x []uint16, encrypt bool) []uint16 {
+	n := len(x)
+	v := n / 2
+	u := n - v
+	radix := big.NewInt(int64(f.radix))
+	a, b := slices.Clone(x[:u]), slices.Clone(x[u:])
+	modU := new(big.Int).Exp(radix, big.NewInt(int64(u)), nil)
+	modV := new(big.Int).Exp(radix, big.NewInt(int64(v)), nil)
+
+	p := make([]byte, aes.BlockSize)
+	for step := 0; step < 8; step++ {
+		i := step
+		if !encrypt {
+			i = 7 - step
+		}
+		m, mod, w := u, modU, tr
+		if i%2 == 1 {
+			m, mod, w = v, modV, tl
+		}
+		in := b
+		if !encrypt {
+			in = a
+		}
+		copy(p, w)
+		p[3] ^= byte(i)
+		num(reverseNumerals(in), f.radix).FillBytes(p[4:])
+
+		s := reverseBytes(p)
+		f.block.Encrypt(s, s)
+		y := new(big.Int).SetBytes(reverseBytes(s))
+
+		var c *big.Int
+		if encrypt {
+			c = new(big.Int).Add(num(reverseNumerals(a), f.radix), y)
+		} else {
+			c = new(big.Int).Sub(num(reverseNumerals(b), f.radix), y)
+		}
+		c.Mod(c, mod)
+		out := reverseNumerals(str(c, f.radix, m))
+		if encrypt {
+			a, b = b, out
+		} else {
+			a, b = out, a
+		}
+	}
+	return append(a, b...)
+}
+
+// ---------------------------------------------------------------------
+// Helper Functions
+// ---------------------------------------------------------------------
+
+func checkNumerals(f FPE, radix int, x []uint16) error {
+	minLen, maxLen := f.Lengths()
+	if len(x) < minLen || len(x) > maxLen {
+		return fmt.Errorf("input must have %d to %d numerals in radix %d", minLen, maxLen, radix)
+	}
+	for _, d := range x {
+		if int(d) >= radix {
+			return fmt.Errorf("numeral %d is out of range for radix %d", d, radix)
+		}
+	}
+	return nil
+}
+
+// num is NUM_radix: x read as a big-endian number.
+func num(x []uint16, radix int) *big.Int {
+	n := new(big.Int)
+	r := big.NewInt(int64(radix))
+	for _, d := range x {
+		n.Mul(n, r)
+		n.Add(n, big.NewInt(int64(d)))
+	}
+	return n
+}
+
+// str is STR^m_radix: the m-numeral big-endian representation of n.
+func str(n *big.Int, radix, m int) []uint16 {
+	out := make([]uint16, m)
+	r := big.NewInt(int64(radix))
+	n = new(big.Int).Set(n)
+	rem := new(big.Int)
+	for i := m - 1; i >= 0; i-- {
+		n.DivMod(n, r, rem)
+		out[i] = uint16(rem.Int64())
+	}
+	return out
+}
+
+func reverseNumerals(x []uint16) []uint16 {
+	out := slices.Clone(x)
+	slices.Reverse(out)
+	return out
+}
+
+func reverseBytes(b []byte) []byte {
+	out := slices.Clone(b)
+	slices.Reverse(out)
+	return out
+}
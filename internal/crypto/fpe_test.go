@@ -0,0 +1,246 @@
+package crypto
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+const (
+	base36 = "0123456789abcdefghijklmnopqrstuvwxyz"
+	latin  = "abcdefghijklmnopqrstuvwxyz"
+)
+
+// numerals maps s to its positions in alphabet.
+func numerals(t *testing.T, alphabet, s string) []uint16 {
+	t.Helper()
+	out := make([]uint16, len(s))
+	for i, c := range s {
+		j := strings.IndexRune(alphabet, c)
+		if j < 0 {
+			t.Fatalf("%q is not in the alphabet", c)
+		}
+		out[i] = uint16(j)
+	}
+	return out
+}
+
+// NIST SP 800-38G FF1 samples 1 to 9.
+func TestFF1Samples(t *testing.T) {
+	const (
+		key128 = "2b7e151628aed2a6abf7158809cf4f3c"
+		key192 = key128 + "ef4359d8d580aa4f"
+		key256 = key192 + "7f036d6f04fc6a94"
+		tweak  = "39383736353433323130"
+		tweak2 = "3737373770717273373737"
+	)
+	samples := []struct {
+		key, tweak           string
+		radix                int
+		plaintext, wantCrypt string
+	}{
+		{key128, "", 10, "0123456789", "2433477484"},
+		{key128, tweak, 10, "0123456789", "6124200773"},
+		{key128, tweak2, 36, "0123456789abcdefghi", "a9tv40mll9kdu509eum"},
+		{key192, "", 10, "0123456789", "2830668132"},
+		{key192, tweak, 10, "0123456789", "2496655549"},
+		{key192, tweak2, 36, "0123456789abcdefghi", "xbj3kv35jrawxv32ysr"},
+		{key256, "", 10, "0123456789", "6657667009"},
+		{key256, tweak, 10, "0123456789", "1001623463"},
+		{key256, tweak2, 36, "0123456789abcdefghi", "xs8a0azh2avyalyzuwd"},
+	}
+	for i, s := range samples {
+		f, err := NewFPE(FPEModeFF1, unhex(t, s.key), s.radix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pt, want := numerals(t, base36, s.plaintext), numerals(t, base36, s.wantCrypt)
+		got, err := f.Encrypt(unhex(t, s.tweak), pt)
+		if err != nil || !slices.Equal(got, want) {
+			t.Errorf("sample %d: Encrypt = %v, %v, want %v", i+1, got, err, want)
+			continue
+		}
+		back, err := f.Decrypt(unhex(t, s.tweak), got)
+		if err != nil || !slices.Equal(back, pt) {
+			t.Errorf("sample %d: Decrypt = %v, %v, want %v", i+1, back, err, pt)
+		}
+	}
+}
+
+// NIST SP 800-38G FF3 samples. FF3 takes a 64-bit tweak, which FF3-1 no longer
+// accepts, so these drive the Feistel rounds FF3-1 shares with it directly.
+func TestFF3Samples(t *testing.T) {
+	const (
+		key128 = "ef4359d8d580aa4f7f036d6f04fc6a94"
+		key192 = key128 + "2b7e151628aed2a6"
+		key256 = key192 + "abf7158809cf4f3c"
+		short  = "890121234567890000"
+		long   = "89012123456789000000789000000"
+	)
+	samples := []struct {
+		key, tweak           string
+		radix                int
+		plaintext, wantCrypt string
+	}{
+		{key128, "d8e7920afa330a73", 10, short, "750918814058654607"},
+		{key128, "9a768a92f60e12d8", 10, short, "018989839189395384"},
+		{key128, "d8e7920afa330a73", 10, long, "48598367162252569629397416226"},
+		{key128, "0000000000000000", 10, long, "34695224821734535122613701434"},
+		{key128, "9a768a92f60e12d8", 26, "0123456789abcdefghi", "g2pk40i992fn20cjakb"},
+		{key192, "d8e7920afa330a73", 10, short, "646965393875028755"},
+		{key192, "9a768a92f60e12d8", 10, short, "961610514491424446"},
+		{key192, "d8e7920afa330a73", 10, long, "53048884065350204541786380807"},
+		{key192, "0000000000000000", 10, long, "98083802678820389295041483512"},
+		{key192, "9a768a92f60e12d8", 26, "0123456789abcdefghi", "i0ihe2jfj7a9opf9p88"},
+		{key256, "d8e7920afa330a73", 10, short, "922011205562777495"},
+		{key256, "9a768a92f60e12d8", 10, short, "504149865578056140"},
+		{key256, "d8e7920afa330a73", 10, long, "04344343235792599165734622699"},
+		{key256, "0000000000000000", 10, long, "30859239999374053872365555822"},
+		{key256, "9a768a92f60e12d8", 26, "0123456789abcdefghi", "p0b2godfja9bhb7bk38"},
+	}
+	for i, s := range samples {
+		f, err := NewFPE(FPEModeFF31, unhex(t, s.key), s.radix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tweak := unhex(t, s.tweak)
+		tl, tr := tweak[:4], tweak[4:]
+		pt, want := numerals(t, base36, s.plaintext), numerals(t, base36, s.wantCrypt)
+		got := f.(*ff31).rounds(tl, tr, pt, true)
+		if !slices.Equal(got, want) {
+			t.Errorf("sample %d: encrypt = %v, want %v", i+1, got, want)
+			continue
+		}
+		if back := f.(*ff31).rounds(tl, tr, got, false); !slices.Equal(back, pt) {
+			t.Errorf("sample %d: decrypt = %v, want %v", i+1, back, pt)
+		}
+	}
+}
+
+// FF3-1 vectors with 56-bit tweaks, from the NIST ACVP AES-FF3-1 test set.
+func TestFF31Vectors(t *testing.T) {
+	vectors := []struct {
+		key, tweak           string
+		radix                int
+		alphabet             string
+		plaintext, wantCrypt string
+	}{
+		{"2de79d232df5585d68ce47882ae256d6", "cbd09280979564", 10, base36, "3992520240", "8901801106"},
+		{"01c63017111438f7fc8e24eb16c71ab5", "c4e822dcd09f27", 10, base36,
+			"60761757463116869318437658042297305934914824457484538562",
+			"35637144092473838892796702739628394376915177448290847293"},
+		{"718385e6542534604419e83ce387a437", "b6f35084fa90e1", 26, latin, "wfmwlrorcd", "ywowehycyd"},
+		{"db602dff22ed7e84c8d8c865a941a238", "ebefd63bcc2083", 26, latin,
+			"kkuomenbzqvggfbteqdyanwpmhzdmoicekiihkrm",
+			"belcfahcwwytwrckieymthabgjjfkxtxauipmjja"},
+	}
+	for i, v := range vectors {
+		f, err := NewFPE(FPEModeFF31, unhex(t, v.key), v.radix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pt, want := numerals(t, v.alphabet, v.plaintext), numerals(t, v.alphabet, v.wantCrypt)
+		got, err := f.Encrypt(unhex(t, v.tweak), pt)
+		if err != nil || !slices.Equal(got, want) {
+			t.Errorf("vector %d: Encrypt = %v, %v, want %v", i+1, got, err, want)
+			continue
+		}
+		back, err := f.Decrypt(unhex(t, v.tweak), got)
+		if err != nil || !slices.Equal(back, pt) {
+			t.Errorf("vector %d: Decrypt = %v, %v, want %v", i+1, back, err, pt)
+		}
+	}
+}
+
+func TestNewFPERejects(t *testing.T) {
+	key := make([]byte, 32)
+	for _, tc := range []struct {
+		name  string
+		mode  FPEMode
+		key   []byte
+		radix int
+	}{
+		{"radix 1", FPEModeFF1, key, 1},
+		{"radix 0", FPEModeFF31, key, 0},
+		{"radix 2^16+1", FPEModeFF1, key, fpeMaxRadix + 1},
+		{"FF1 with a 20-byte key", FPEModeFF1, key[:20], 10},
+		{"FF3-1 with a 20-byte key", FPEModeFF31, key[:20], 10},
+		{"unknown mode", FPEMode("FF2"), key, 10},
+	} {
+		if _, err := NewFPE(tc.mode, tc.key, tc.radix); err == nil {
+			t.Errorf("%s: NewFPE succeeded", tc.name)
+		}
+	}
+}
+
+func TestFPELengths(t *testing.T) {
+	for _, tc := range []struct {
+		mode           FPEMode
+		radix          int
+		minLen, maxLen int
+	}{
+		{FPEModeFF1, 10, 6, 1 << 16},
+		{FPEModeFF1, 2, 20, 1 << 16},
+		{FPEModeFF1, 36, 4, 1 << 16},
+		{FPEModeFF1, fpeMaxRadix, 2, 1 << 16},
+		// FF3-1's maxlen is 2*floor(log_radix(2^96)).
+		{FPEModeFF31, 10, 6, 56},
+		{FPEModeFF31, 2, 20, 192},
+		{FPEModeFF31, 26, 5, 40},
+		{FPEModeFF31, fpeMaxRadix, 2, 12},
+	} {
+		f, err := NewFPE(tc.mode, make([]byte, 16), tc.radix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if minLen, maxLen := f.Lengths(); minLen != tc.minLen || maxLen != tc.maxLen {
+			t.Errorf("%s radix %d: lengths %d to %d, want %d to %d", tc.mode, tc.radix, minLen, maxLen, tc.minLen, tc.maxLen)
+		}
+	}
+}
+
+func TestFPERejectsOutOfRangeInput(t *testing.T) {
+	key := make([]byte, 16)
+	f1, err := NewFPE(FPEModeFF1, key, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f31, err := NewFPE(FPEModeFF31, key, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	digits := func(n int) []uint16 { return make([]uint16, n) }
+	tweak7 := make([]byte, FF31TweakSize)
+	for _, tc := range []struct {
+		name  string
+		f     FPE
+		tweak []byte
+		x     []uint16
+	}{
+		{"FF1 below minlen", f1, nil, digits(5)},
+		{"FF1 above maxlen", f1, nil, digits(1<<16 + 1)},
+		{"FF1 numeral out of radix", f1, nil, []uint16{0, 1, 2, 3, 4, 10}},
+		{"FF1 tweak too long", f1, make([]byte, FF1MaxTweakSize+1), digits(10)},
+		{"FF3-1 below minlen", f31, tweak7, digits(5)},
+		{"FF3-1 above maxlen", f31, tweak7, digits(57)},
+		{"FF3-1 numeral out of radix", f31, tweak7, []uint16{0, 1, 2, 3, 4, 10}},
+		{"FF3-1 without a tweak", f31, nil, digits(10)},
+		{"FF3-1 with a 6-byte tweak", f31, tweak7[:6], digits(10)},
+		{"FF3-1 with an FF3 64-bit tweak", f31, make([]byte, 8), digits(10)},
+	} {
+		if _, err := tc.f.Encrypt(tc.tweak, tc.x); err == nil {
+			t.Errorf("%s: Encrypt succeeded", tc.name)
+		}
+		if _, err := tc.f.Decrypt(tc.tweak, tc.x); err == nil {
+			t.Errorf("%s: Decrypt succeeded", tc.name)
+		}
+	}
+
+	// The bounds themselves are accepted.
+	if _, err := f1.Encrypt(make([]byte, FF1MaxTweakSize), digits(6)); err != nil {
+		t.Errorf("FF1 at minlen with the longest tweak: %v", err)
+	}
+	if _, err := f31.Encrypt(tweak7, digits(56)); err != nil {
+		t.Errorf("FF3-1 at maxlen: %v", err)
+	}
+}
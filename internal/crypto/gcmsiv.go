@@ -0,0 +1,180 @@
+package crypto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// AES-GCM-SIV (RFC 8452) is nonce-misuse resistant: a repeated nonce only reveals
+// whether two messages were equal, instead of the keystream and the authentication key
+// as with GCM. Each message also gets its own encryption key, derived from the nonce,
+// so a key is good for far more messages than GCM's 2^32.
+
+const gcmSIVNonceSize = 12
+
+var errGCMSIVOpen = errors.New("cipher: message authentication failed")
+
+type gcmSIV struct {
+	block cipher.Block // the key-generating key
+}
+
+// newGCMSIV builds AES-256-GCM-SIV from a 32-byte key.
+func newGCMSIV(key []byte) (cipher.AEAD, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("AES-256-GCM-SIV requires a 32-byte key")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create AES cipher: %w", err)
+	}
+	return &gcmSIV{block: block}, nil
+}
+
+func (g *gcmSIV) NonceSize() int { return gcmSIVNonceSize }
+
+func (g *gcmSIV) Overhead() int { return aes.BlockSize }
+
+// deriveKeys derives the per-nonce POLYVAL key and AES-256 encryption key.
+func (g *gcmSIV) deriveKeys(nonce []byte) (authKey [16]byte, enc cipher.Block) {
+	var in, out [aes.BlockSize]byte
+	copy(in[4:], nonce)
+	var encKey [32]byte
+	for i := uint32(0); i < 6; i++ {
+		binary.LittleEndian.PutUint32(in[:4], i)
+		g.block.Encrypt(out[:], in[:])
+		if i < 2 {
+			copy(authKey[i*8:], out[:8])
+		} else {
+			copy(encKey[(i-2)*8:], out[:8])
+		}
+	}
+	enc, _ = aes.NewCipher(encKey[:])
+	clear(encKey[:])
+	return authKey, enc
+}
+
+// tag computes the tag over additionalData and plaintext.
+func (g *gcmSIV) tag(authKey [16]byte, enc cipher.Block, nonce, plaintext, additionalData []byte) []byte {
+	p := newPolyval(authKey)
+	p.update(additionalData)
+	p.update(plaintext)
+	var lengths [16]byte
+	binary.LittleEndian.PutUint64(lengths[:8], uint64(len(additionalData))*8)
+	binary.LittleEndian.PutUint64(lengths[8:], uint64(len(plaintext))*8)
+	p.update(lengths[:])
+
+	s := p.sum()
+	for i := range nonce {
+		s[i] ^= nonce[i]
+	}
+	s[15] &= 0x7f
+	t := make([]byte, aes.BlockSize)
+	enc.Encrypt(t, s[:])
+	return t
+}
+
+// ctr runs AES-CTR from the tag with its top bit set, incrementing the first 32 bits
+// little-endian.
+func (g *gcmSIV) ctr(enc cipher.Block, dst, src, tag []byte) {
+	var counter, ks [aes.BlockSize]byte
+	copy(counter[:], tag)
+	counter[15] |= 0x80
+	for len(src) > 0 {
+		enc.Encrypt(ks[:], counter[:])
+		n := subtle.XORBytes(dst, src, ks[:])
+		dst, src = dst[n:], src[n:]
+		binary.LittleEndian.PutUint32(counter[:4], binary.LittleEndian.Uint32(counter[:4])+1)
+	}
+}
+
+func (g *gcmSIV) Seal(dst, nonce, plaintext, additionalData []byte) []byte {
+	if len(nonce) != gcmSIVNonceSize {
+		panic("crypto: incorrect nonce length given to AES-GCM-SIV")
+	}
+	authKey, enc := g.deriveKeys(nonce)
+	t := g.tag(authKey, enc, nonce, plaintext, additionalData)
+	ret, out := sliceForAppend(dst, len(plaintext)+aes.BlockSize)
+	g.ctr(enc, out, plaintext, t)
+	copy(out[len(plaintext):], t)
+	return ret
+}
+
+func (g *gcmSIV) Open(dst, nonce, ciphertext, additionalData []byte) ([]byte, error) {
+	if len(nonce) != gcmSIVNonceSize {
+		panic("crypto: incorrect nonce length given to AES-GCM-SIV")
+	}
+	if len(ciphertext) < aes.BlockSize {
+		return nil, errGCMSIVOpen
+	}
+	body, t := ciphertext[:len(ciphertext)-aes.BlockSize], ciphertext[len(ciphertext)-aes.BlockSize:]
+	authKey, enc := g.deriveKeys(nonce)
+	plaintext := make([]byte, len(body))
+	g.ctr(enc, plaintext, body, t)
+	if subtle.ConstantTimeCompare(g.tag(authKey, enc, nonce, plaintext, additionalData), t) != 1 {
+		clear(plaintext)
+		return nil, errGCMSIVOpen
+	}
+	return append(dst, plaintext...), nil
+}
+
+// polyval is POLYVAL from RFC 8452, computed through its relation to GHASH: POLYVAL is
+// GHASH with every block byte-reversed and the key multiplied by x.
+type polyval struct {
+	h   [2]uint64 // the GHASH key, big-endian halves
+	acc [2]uint64
+}
+
+func newPolyval(key [16]byte) *polyval {
+	var rev [16]byte
+	for i := range rev {
+		rev[i] = key[15-i]
+	}
+	h := [2]uint64{binary.BigEndian.Uint64(rev[:8]), binary.BigEndian.Uint64(rev[8:])}
+	return &polyval{h: ghashMulX(h)}
+}
+
+// update absorbs data, zero-padded to a whole number of blocks.
+func (p *polyval) update(data []byte) {
+	for len(data) > 0 {
+		var block [16]byte
+		n := copy(block[:], data)
+		data = data[n:]
+		// Byte-reverse the block into GHASH order.
+		p.acc[0] ^= binary.LittleEndian.Uint64(block[8:])
+		p.acc[1] ^= binary.LittleEndian.Uint64(block[:8])
+		p.acc = ghashMul(p.acc, p.h)
+	}
+}
+
+func (p *polyval) sum() [16]byte {
+	var out [16]byte
+	binary.LittleEndian.PutUint64(out[:8], p.acc[1])
+	binary.LittleEndian.PutUint64(out[8:], p.acc[0])
+	return out
+}
+
+// ghashMulX multiplies by x in GHASH's bit-reflected field.
+func ghashMulX(v [2]uint64) [2]uint64 {
+	mask := -(v[1] & 1)
+	v[1] = v[1]>>1 | v[0]<<63
+	v[0] = v[0]>>1 ^ mask&0xe100000000000000
+	return v
+}
+
+// ghashMul multiplies in GHASH's field, in constant time (NIST SP 800-38D, algorithm 1).
+func ghashMul(x, y [2]uint64) [2]uint64 {
+	var z [2]uint64
+	v := y
+	for i := 0; i < 128; i++ {
+		bit := x[i/64] >> (63 - i%64) & 1
+		mask := -bit
+		z[0] ^= v[0] & mask
+		z[1] ^= v[1] & mask
+		v = ghashMulX(v)
+	}
+	return z
+}
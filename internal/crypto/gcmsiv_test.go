@@ -0,0 +1,170 @@
+package crypto
+
+import (
+	"bytes"
+	"testing"
+)
+
+// gcmSIVVectors are AEAD_AES_256_GCM_SIV examples from RFC 8452, appendix C.2. The
+// last two are its counter-wrap tests, whose tags make the 32-bit counter overflow.
+var gcmSIVVectors = []struct {
+	key, nonce, aad, plaintext, sealed string
+}{
+	{
+		key:    "01000000000000000000000000000000 00000000000000000000000000000000",
+		nonce:  "030000000000000000000000",
+		sealed: "07f5f4169bbf55a8400cd47ea6fd400f",
+	},
+	{
+		key:       "01000000000000000000000000000000 00000000000000000000000000000000",
+		nonce:     "030000000000000000000000",
+		plaintext: "0100000000000000",
+		sealed:    "c2ef328e5c71c83b 843122130f7364b761e0b97427e3df28",
+	},
+	{
+		key:       "01000000000000000000000000000000 00000000000000000000000000000000",
+		nonce:     "030000000000000000000000",
+		plaintext: "010000000000000000000000",
+		sealed:    "9aab2aeb3faa0a34aea8e2b1 8ca50da9ae6559e48fd10f6e5c9ca17e",
+	},
+	{
+		key:       "01000000000000000000000000000000 00000000000000000000000000000000",
+		nonce:     "030000000000000000000000",
+		plaintext: "01000000000000000000000000000000",
+		sealed:    "85a01b63025ba19b7fd3ddfc033b3e76 c9eac6fa700942702e90862383c6c366",
+	},
+	{
+		key:       "01000000000000000000000000000000 00000000000000000000000000000000",
+		nonce:     "030000000000000000000000",
+		plaintext: "01000000000000000000000000000000 02000000000000000000000000000000",
+		sealed:    "4a6a9db4c8c6549201b9edb53006cba8 21ec9cf850948a7c86c68ac7539d027f e819e63abcd020b006a976397632eb5d",
+	},
+	{
+		key:       "01000000000000000000000000000000 00000000000000000000000000000000",
+		nonce:     "030000000000000000000000",
+		plaintext: "01000000000000000000000000000000 02000000000000000000000000000000 03000000000000000000000000000000",
+		sealed:    "c00d121893a9fa603f48ccc1ca3c57ce 7499245ea0046db16c53c7c66fe717e3 9cf6c748837b61f6ee3adcee17534ed5 790bc96880a99ba804bd12c0e6a22cc4",
+	},
+	{
+		key:       "01000000000000000000000000000000 00000000000000000000000000000000",
+		nonce:     "030000000000000000000000",
+		plaintext: "01000000000000000000000000000000 02000000000000000000000000000000 03000000000000000000000000000000 04000000000000000000000000000000",
+		sealed:    "c2d5160a1f8683834910acdafc41fbb1 632d4a353e8b905ec9a5499ac34f96c7 e1049eb080883891a4db8caaa1f99dd0 04d80487540735234e3744512c6f90ce 112864c269fc0d9d88c61fa47e39aa08",
+	},
+	{
+		key:       "01000000000000000000000000000000 00000000000000000000000000000000",
+		nonce:     "030000000000000000000000",
+		aad:       "01",
+		plaintext: "0200000000000000",
+		sealed:    "1de22967237a8132 91213f267e3b452f02d01ae33e4ec854",
+	},
+	{
+		key:       "01000000000000000000000000000000 00000000000000000000000000000000",
+		nonce:     "030000000000000000000000",
+		aad:       "01",
+		plaintext: "020000000000000000000000",
+		sealed:    "163d6f9cc1b346cd453a2e4c c1a4a19ae800941ccdc57cc8413c277f",
+	},
+	{
+		key:       "01000000000000000000000000000000 00000000000000000000000000000000",
+		nonce:     "030000000000000000000000",
+		aad:       "01",
+		plaintext: "02000000000000000000000000000000",
+		sealed:    "c91545823cc24f17dbb0e9e807d5ec17 b292d28ff61189e8e49f3875ef91aff7",
+	},
+	{
+		key:       "01000000000000000000000000000000 00000000000000000000000000000000",
+		nonce:     "030000000000000000000000",
+		aad:       "01",
+		plaintext: "02000000000000000000000000000000 03000000000000000000000000000000",
+		sealed:    "07dad364bfc2b9da89116d7bef6daaaf 6f255510aa654f920ac81b94e8bad365 aea1bad12702e1965604374aab96dbbc",
+	},
+	{
+		key:       "01000000000000000000000000000000 00000000000000000000000000000000",
+		nonce:     "030000000000000000000000",
+		aad:       "01",
+		plaintext: "02000000000000000000000000000000 03000000000000000000000000000000 04000000000000000000000000000000",
+		sealed:    "c67a1f0f567a5198aa1fcc8e3f213143 36f7f51ca8b1af61feac35a86416fa47 fbca3b5f749cdf564527f2314f42fe25 03332742b228c647173616cfd44c54eb",
+	},
+	{
+		key:       "01000000000000000000000000000000 00000000000000000000000000000000",
+		nonce:     "030000000000000000000000",
+		aad:       "01",
+		plaintext: "02000000000000000000000000000000 03000000000000000000000000000000 04000000000000000000000000000000 05000000000000000000000000000000",
+		sealed:    "67fd45e126bfb9a79930c43aad2d3696 7d3f0e4d217c1e551f59727870beefc9 8cb933a8fce9de887b1e40799988db1f c3f91880ed405b2dd298318858467c89 5bde0285037c5de81e5b570a049b62a0",
+	},
+	{
+		key:       "00000000000000000000000000000000 00000000000000000000000000000000",
+		nonce:     "000000000000000000000000",
+		plaintext: "00000000000000000000000000000000 4db923dc793ee6497c76dcc03a98e108",
+		sealed:    "f3f80f2cf0cb2dd9c5984fcda908456c c537703b5ba70324a6793a7bf218d3ea ffffffff000000000000000000000000",
+	},
+	{
+		key:       "00000000000000000000000000000000 00000000000000000000000000000000",
+		nonce:     "000000000000000000000000",
+		plaintext: "eb3640277c7ffd1303c7a542d02d3e4c 0000000000000000",
+		sealed:    "18ce4f0b8cb4d0cac65fea8f79257b20 888e53e72299e56d ffffffff000000000000000000000000",
+	},
+}
+
+func TestGCMSIVRFC8452(t *testing.T) {
+	for i, v := range gcmSIVVectors {
+		aead, err := newGCMSIV(unhex(t, v.key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		nonce, aad, plaintext, want := unhex(t, v.nonce), unhex(t, v.aad), unhex(t, v.plaintext), unhex(t, v.sealed)
+		got := aead.Seal(nil, nonce, plaintext, aad)
+		if !bytes.Equal(got, want) {
+			t.Errorf("vector %d: Seal = %x, want %x", i, got, want)
+			continue
+		}
+		opened, err := aead.Open(nil, nonce, got, aad)
+		if err != nil || !bytes.Equal(opened, plaintext) {
+			t.Errorf("vector %d: Open = %x, %v, want %x", i, opened, err, plaintext)
+		}
+	}
+}
+
+func TestGCMSIVOpenRejectsTampering(t *testing.T) {
+	aead, err := newGCMSIV(unhex(t, "01000000000000000000000000000000 00000000000000000000000000000000"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce := unhex(t, "030000000000000000000000")
+	aad := []byte("tenant=acme")
+	sealed := aead.Seal(nil, nonce, []byte("a secret worth 32 bytes of text"), aad)
+
+	// Every flipped bit, whether in the ciphertext or the tag, fails.
+	for i := range sealed {
+		for bit := 0; bit < 8; bit++ {
+			tampered := append([]byte(nil), sealed...)
+			tampered[i] ^= 1 << bit
+			if _, err := aead.Open(nil, nonce, tampered, aad); err != errGCMSIVOpen {
+				t.Fatalf("byte %d bit %d flipped: Open error = %v", i, bit, err)
+			}
+		}
+	}
+	otherNonce := append([]byte(nil), nonce...)
+	otherNonce[11] = 1
+	for name, tc := range map[string]struct{ nonce, ciphertext, aad []byte }{
+		"other nonce":           {otherNonce, sealed, aad},
+		"other associated data": {nonce, sealed, []byte("tenant=other")},
+		"no associated data":    {nonce, sealed, nil},
+		"truncated":             {nonce, sealed[:len(sealed)-1], aad},
+		"shorter than the tag":  {nonce, sealed[:15], aad},
+		"empty":                 {nonce, nil, aad},
+	} {
+		if _, err := aead.Open(nil, tc.nonce, tc.ciphertext, tc.aad); err != errGCMSIVOpen {
+			t.Errorf("%s: Open error = %v, want %v", name, err, errGCMSIVOpen)
+		}
+	}
+}
+
+func TestGCMSIVKeySizes(t *testing.T) {
+	for _, n := range []int{0, 16, 24, 31, 33, 64} {
+		if _, err := newGCMSIV(make([]byte, n)); err == nil {
+			t.Errorf("newGCMSIV accepted a %d-byte key", n)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package crypto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// HPKE (RFC 9180) in base mode with one suite: DHKEM(X25519, HKDF-SHA256), HKDF-SHA256
+// and AES-256-GCM. Senders use any RFC 9180 library with the recipient's public key and
+// need no KMS credentials; only the KMS can open what they sealed.
+const (
+	HPKEKEMID  = 0x0020 // DHKEM(X25519, HKDF-SHA256)
+	HPKEKDFID  = 0x0001 // HKDF-SHA256
+	HPKEAEADID = 0x0002 // AES-256-GCM
+
+	// HPKEEncSize is the length of the encapsulated key, an X25519 public key.
+	HPKEEncSize = 32
+)
+
+var (
+	hpkeKEMSuiteID = []byte{'K', 'E', 'M', byte(HPKEKEMID >> 8), byte(HPKEKEMID & 0xff)}
+	hpkeSuiteID    = []byte{'H', 'P', 'K', 'E', byte(HPKEKEMID >> 8), byte(HPKEKEMID & 0xff), byte(HPKEKDFID >> 8), byte(HPKEKDFID & 0xff), byte(HPKEAEADID >> 8), byte(HPKEAEADID & 0xff)}
+)
+
+func hpkeLabeledExtract(suiteID, salt []byte, label string, ikm []byte) []byte {
+	labeled := append(append(append([]byte("HPKE-v1"), suiteID...), label...), ikm...)
+	return hkdf.Extract(sha256.New, labeled, salt)
+}
+
+func hpkeLabeledExpand(suiteID, prk []byte, label string, info []byte, length int) ([]byte, error) {
+	labeled := binary.BigEndian.AppendUint16(nil, uint16(length))
+	labeled = append(append(append(append(labeled, "HPKE-v1"...), suiteID...), label...), info...)
+	out := make([]byte, length)
+	if _, err := hkdf.Expand(sha256.New, prk, labeled).Read(out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// hpkeSharedSecret is DHKEM's ExtractAndExpand over the Diffie-Hellman output.
+func hpkeSharedSecret(dh, enc, recipient []byte) ([]byte, error) {
+	prk := hpkeLabeledExtract(hpkeKEMSuiteID, nil, "eae_prk", dh)
+	return hpkeLabeledExpand(hpkeKEMSuiteID, prk, "shared_secret", append(append([]byte{}, enc...), recipient...), 32)
+}
+
+// hpkeContext runs the base mode key schedule and returns the AEAD and its nonce for
+// the first, and only, message.
+func hpkeContext(sharedSecret, info []byte) (cipher.AEAD, []byte, error) {
+	pskIDHash := hpkeLabeledExtract(hpkeSuiteID, nil, "psk_id_hash", nil)
+	infoHash := hpkeLabeledExtract(hpkeSuiteID, nil, "info_hash", info)
+	keyScheduleContext := append(append([]byte{0x00}, pskIDHash...), infoHash...) // mode_base
+	secret := hpkeLabeledExtract(hpkeSuiteID, sharedSecret, "secret", nil)
+	defer clear(secret)
+
+	key, err := hpkeLabeledExpand(hpkeSuiteID, secret, "key", keyScheduleContext, 32)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer clear(key)
+	nonce, err := hpkeLabeledExpand(hpkeSuiteID, secret, "base_nonce", keyScheduleContext, 12)
+	if err != nil {
+		return nil, nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, nil, err
+	}
+	return aead, nonce, nil
+}
+
+// GenerateHPKEKey returns a new X25519 private key for an HPKE recipient.
+func GenerateHPKEKey() ([]byte, error) {
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate key: %w", err)
+	}
+	return priv.Bytes(), nil
+}
+
+// HPKEPublicKey returns the public key senders encrypt to for the private key priv.
+func HPKEPublicKey(priv []byte) ([]byte, error) {
+	sk, err := ecdh.X25519().NewPrivateKey(priv)
+	if err != nil {
+		return nil, fmt.Errorf("invalid HPKE private key: %w", err)
+	}
+	return sk.PublicKey().Bytes(), nil
+}
+
+// HPKESeal encrypts plaintext to the recipient public key pub, returning the
+// encapsulated key and the ciphertext. The server only needs it for its self-test.
+func HPKESeal(pub, info, aad, plaintext []byte) (enc, ciphertext []byte, err error) {
+	pkR, err := ecdh.X25519().NewPublicKey(pub)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid HPKE public key: %w", err)
+	}
+	skE, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	dh, err := skE.ECDH(pkR)
+	if err != nil {
+		return nil, nil, err
+	}
+	enc = skE.PublicKey().Bytes()
+	sharedSecret, err := hpkeSharedSecret(dh, enc, pub)
+	if err != nil {
+		return nil, nil, err
+	}
+	aead, nonce, err := hpkeContext(sharedSecret, info)
+	if err != nil {
+		return nil, nil, err
+	}
+	return enc, aead.Seal(nil, nonce, plaintext, aad), nil
+}
+
+// HPKEOpen decrypts a single-shot HPKE message sealed to the public key of priv.
+func HPKEOpen(priv, enc, info, aad, ciphertext []byte) ([]byte, error) {
+	skR, err := ecdh.X25519().NewPrivateKey(priv)
+	if err != nil {
+		return nil, fmt.Errorf("invalid HPKE private key: %w", err)
+	}
+	pkE, err := ecdh.X25519().NewPublicKey(enc)
+	if err != nil {
+		return nil, errors.New("invalid encapsulated key")
+	}
+	dh, err := skR.ECDH(pkE)
+	if err != nil {
+		return nil, errors.New("invalid encapsulated key")
+	}
+	defer clear(dh)
+	sharedSecret, err := hpkeSharedSecret(dh, enc, skR.PublicKey().Bytes())
+	if err != nil {
+		return nil, err
+	}
+	defer clear(sharedSecret)
+	aead, nonce, err := hpkeContext(sharedSecret, info)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := aead.Open(nil, nonce, ciphertext, aad)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open HPKE message: %w", err)
+	}
+	return plaintext, nil
+}
@@ -0,0 +1,159 @@
+package crypto
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// JWE compact serialization (RFC 7516) with direct encryption ("dir"): the data key is
+// the content encryption key, and the protected header, which names the key, is the
+// only additional authenticated data.
+
+const (
+	jweDirect  = "dir"
+	jweIVSize  = 12
+	jweTagSize = 16
+)
+
+var errNotJWE = errors.New("ciphertext is not a JWE compact serialization")
+
+// JWEHeader is the protected header. ContextHash is a private parameter binding the
+// encryption context, which compact serialization has no other room for.
+type JWEHeader struct {
+	Alg         string `json:"alg"`
+	Enc         string `json:"enc"`
+	Kid         string `json:"kid"`
+	ContextHash string `json:"kms_ctx,omitempty"`
+}
+
+// JWE is a parsed compact serialization.
+type JWE struct {
+	Header     JWEHeader
+	IV         []byte
+	Ciphertext []byte
+	Tag        []byte
+
+	protected string // the encoded header, as it was authenticated
+}
+
+// JWEEncryption returns the JWA "enc" name for alg. Only the AES-GCM algorithms have
+// one.
+func JWEEncryption(alg Algorithm) (string, error) {
+	switch alg {
+	case AlgorithmAES256GCM:
+		return "A256GCM", nil
+	case AlgorithmAES128GCM:
+		return "A128GCM", nil
+	default:
+		return "", fmt.Errorf("JWE output needs an AES_256_GCM or AES_128_GCM key, not %s", alg)
+	}
+}
+
+// NewJWEHeader returns the header for a JWE under key kid with alg.
+func NewJWEHeader(alg Algorithm, kid, contextHash string) (JWEHeader, error) {
+	enc, err := JWEEncryption(alg)
+	if err != nil {
+		return JWEHeader{}, err
+	}
+	return JWEHeader{Alg: jweDirect, Enc: enc, Kid: kid, ContextHash: contextHash}, nil
+}
+
+func encodeJWEHeader(h JWEHeader) (string, error) {
+	b, err := json.Marshal(h)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode JWE header: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// JWELength returns the length of the serialization of n plaintext bytes under h.
+func JWELength(h JWEHeader, n int) int {
+	protected, err := encodeJWEHeader(h)
+	if err != nil {
+		return 0
+	}
+	b64 := base64.RawURLEncoding
+	return len(protected) + 4 + b64.EncodedLen(jweIVSize) + b64.EncodedLen(n) + b64.EncodedLen(jweTagSize)
+}
+
+// SealJWE encrypts plaintext with key under h and returns the compact serialization.
+func SealJWE(alg Algorithm, key []byte, h JWEHeader, plaintext []byte) (string, error) {
+	enc, err := JWEEncryption(alg)
+	if err != nil {
+		return "", err
+	}
+	if h.Alg != jweDirect || h.Enc != enc {
+		return "", fmt.Errorf("JWE header does not match %s", alg)
+	}
+	protected, err := encodeJWEHeader(h)
+	if err != nil {
+		return "", err
+	}
+	sealed, err := Encrypt(alg, key, plaintext, []byte(protected))
+	if err != nil {
+		return "", err
+	}
+	iv, ct, tag := sealed[:jweIVSize], sealed[jweIVSize:len(sealed)-jweTagSize], sealed[len(sealed)-jweTagSize:]
+
+	b64 := base64.RawURLEncoding
+	return strings.Join([]string{protected, "", b64.EncodeToString(iv), b64.EncodeToString(ct), b64.EncodeToString(tag)}, "."), nil
+}
+
+// LooksLikeJWE reports whether s has the five parts of a compact serialization. A
+// standard base64 ciphertext never does.
+func LooksLikeJWE(s string) bool {
+	return strings.Count(s, ".") == 4
+}
+
+// ParseJWE splits a compact serialization and decodes its header. Headers this
+// server would not have written, including any with crit or zip, are refused.
+func ParseJWE(compact string) (*JWE, error) {
+	parts := strings.Split(compact, ".")
+	if len(parts) != 5 {
+		return nil, errNotJWE
+	}
+	b64 := base64.RawURLEncoding
+	raw, err := b64.DecodeString(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("%w: bad header encoding", errNotJWE)
+	}
+	dec := json.NewDecoder(strings.NewReader(string(raw)))
+	dec.DisallowUnknownFields()
+	j := &JWE{protected: parts[0]}
+	if err := dec.Decode(&j.Header); err != nil {
+		return nil, fmt.Errorf("unsupported JWE header: %w", err)
+	}
+	if j.Header.Alg != jweDirect {
+		return nil, fmt.Errorf("unsupported JWE alg %q (want %q)", j.Header.Alg, jweDirect)
+	}
+	if parts[1] != "" {
+		return nil, errors.New("a direct-encryption JWE has no encrypted key")
+	}
+	if j.IV, err = b64.DecodeString(parts[2]); err != nil || len(j.IV) != jweIVSize {
+		return nil, fmt.Errorf("%w: bad initialization vector", errNotJWE)
+	}
+	if j.Ciphertext, err = b64.DecodeString(parts[3]); err != nil {
+		return nil, fmt.Errorf("%w: bad ciphertext encoding", errNotJWE)
+	}
+	if j.Tag, err = b64.DecodeString(parts[4]); err != nil || len(j.Tag) != jweTagSize {
+		return nil, fmt.Errorf("%w: bad authentication tag", errNotJWE)
+	}
+	return j, nil
+}
+
+// OpenJWE decrypts j with key, whose algorithm must match the header's enc.
+func OpenJWE(alg Algorithm, key []byte, j *JWE) ([]byte, error) {
+	enc, err := JWEEncryption(alg)
+	if err != nil {
+		return nil, err
+	}
+	if j.Header.Enc != enc {
+		return nil, fmt.Errorf("JWE enc %q does not match the key's %s", j.Header.Enc, enc)
+	}
+	sealed := make([]byte, 0, len(j.IV)+len(j.Ciphertext)+len(j.Tag))
+	sealed = append(append(append(sealed, j.IV...), j.Ciphertext...), j.Tag...)
+	return Decrypt(alg, key, sealed, []byte(j.protected))
+}
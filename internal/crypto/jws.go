@@ -0,0 +1,139 @@
+package crypto
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+// JWS signature algorithms (RFC 7518) for JWT signing keys.
+const (
+	JWSES256 = "ES256" // ECDSA P-256 with SHA-256
+	JWSRS256 = "RS256" // RSASSA-PKCS1-v1_5 with SHA-256
+
+	jwsRSABits = 2048
+)
+
+// ValidJWSAlgorithm reports whether alg is a JWS algorithm signing keys can use.
+func ValidJWSAlgorithm(alg string) bool {
+	return alg == JWSES256 || alg == JWSRS256
+}
+
+// GenerateSigningKey returns a new private key for alg as PKCS #8 and its public key as
+// PKIX, both DER.
+func GenerateSigningKey(alg string) (private, public []byte, err error) {
+	var key crypto.Signer
+	switch alg {
+	case JWSES256:
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case JWSRS256:
+		key, err = rsa.GenerateKey(rand.Reader, jwsRSABits)
+	default:
+		return nil, nil, fmt.Errorf("unsupported signing algorithm %q", alg)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to generate signing key: %w", err)
+	}
+	private, err = x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to marshal signing key: %w", err)
+	}
+	public, err = x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to marshal public key: %w", err)
+	}
+	return private, public, nil
+}
+
+// SignJWS signs a JWS signing input (base64url header, '.', base64url payload) with a
+// PKCS #8 key from GenerateSigningKey. ES256 signatures are the fixed-size R || S of
+// RFC 7518, not ASN.1.
+func SignJWS(alg string, private, signingInput []byte) ([]byte, error) {
+	parsed, err := x509.ParsePKCS8PrivateKey(private)
+	if err != nil {
+		return nil, fmt.Errorf("invalid signing key: %w", err)
+	}
+	digest := sha256.Sum256(signingInput)
+	switch key := parsed.(type) {
+	case *ecdsa.PrivateKey:
+		if alg != JWSES256 || key.Curve != elliptic.P256() {
+			return nil, fmt.Errorf("key does not match %s", alg)
+		}
+		r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+		if err != nil {
+			return nil, err
+		}
+		sig := make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+		return sig, nil
+	case *rsa.PrivateKey:
+		if alg != JWSRS256 {
+			return nil, fmt.Errorf("key does not match %s", alg)
+		}
+		return rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	default:
+		return nil, fmt.Errorf("unsupported signing key type %T", parsed)
+	}
+}
+
+// VerifyJWS checks a signature from SignJWS against a PKIX public key.
+func VerifyJWS(alg string, public, signingInput, sig []byte) error {
+	parsed, err := x509.ParsePKIXPublicKey(public)
+	if err != nil {
+		return fmt.Errorf("invalid public key: %w", err)
+	}
+	digest := sha256.Sum256(signingInput)
+	switch key := parsed.(type) {
+	case *ecdsa.PublicKey:
+		if alg != JWSES256 || len(sig) != 64 {
+			return errors.New("invalid signature")
+		}
+		r, s := new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])
+		if !ecdsa.Verify(key, digest[:], r, s) {
+			return errors.New("invalid signature")
+		}
+		return nil
+	case *rsa.PublicKey:
+		if alg != JWSRS256 {
+			return errors.New("invalid signature")
+		}
+		if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig); err != nil {
+			return errors.New("invalid signature")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported public key type %T", parsed)
+	}
+}
+
+// jwsRoundTrip signs and verifies with a fresh key for each algorithm.
+func jwsRoundTrip() error {
+	input := []byte("eyJhbGciOiJub25lIn0.eyJzdWIiOiJzZWxmLXRlc3QifQ")
+	for _, alg := range []string{JWSES256, JWSRS256} {
+		private, public, err := GenerateSigningKey(alg)
+		if err != nil {
+			return fmt.Errorf("%s: %w", alg, err)
+		}
+		sig, err := SignJWS(alg, private, input)
+		clear(private)
+		if err != nil {
+			return fmt.Errorf("%s sign: %w", alg, err)
+		}
+		if err := VerifyJWS(alg, public, input, sig); err != nil {
+			return fmt.Errorf("%s round trip failed", alg)
+		}
+		sig[len(sig)-1] ^= 1
+		if err := VerifyJWS(alg, public, input, sig); err == nil {
+			return fmt.Errorf("%s accepted a tampered signature", alg)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+package crypto
+
+import (
+	"fmt"
+	"strings"
+)
+
+// AlgorithmPolicy restricts which algorithms and key sizes may be used.
+// The zero value allows everything.
+type AlgorithmPolicy struct {
+	// Allowed is the set of permitted algorithms. Empty means all supported algorithms.
+	Allowed []Algorithm
+	// MinKeyBits rejects algorithms with shorter keys. Zero disables the check.
+	MinKeyBits int
+}
+
+// ParseAlgorithmPolicy builds a policy from a comma-separated algorithm list and a minimum key size.
+func ParseAlgorithmPolicy(allowed string, minKeyBits int) (AlgorithmPolicy, error) {
+	policy := AlgorithmPolicy{MinKeyBits: minKeyBits}
+	for _, name := range strings.Split(allowed, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		alg, err := ParseAlgorithm(name)
+		if err != nil {
+			return AlgorithmPolicy{}, err
+		}
+		policy.Allowed = append(policy.Allowed, alg)
+	}
+	if minKeyBits < 0 {
+		return AlgorithmPolicy{}, fmt.Errorf("minimum key size must not be negative")
+	}
+	return policy, nil
+}
+
+// Check reports whether alg may be used under this policy.
+func (p AlgorithmPolicy) Check(alg Algorithm) error {
+	if len(p.Allowed) > 0 {
+		permitted := false
+		for _, a := range p.Allowed {
+			if a == alg {
+				permitted = true
+				break
+			}
+		}
+		if !permitted {
+			return fmt.Errorf("algorithm %s is not permitted by policy (allowed: %s)", alg, p.allowedList())
+		}
+	}
+	if p.MinKeyBits > 0 && alg.KeyBits() < p.MinKeyBits {
+		return fmt.Errorf("algorithm %s uses %d-bit keys; policy requires at least %d bits", alg, alg.KeyBits(), p.MinKeyBits)
+	}
+	return nil
+}
+
+func (p AlgorithmPolicy) allowedList() string {
+	names := make([]string, len(p.Allowed))
+	for i, a := range p.Allowed {
+		names[i] = string(a)
+	}
+	return strings.Join(names, ", ")
+}
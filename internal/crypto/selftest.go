@@ -0,0 +1,233 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/hex"
+	"fmt"
+	"slices"
+)
+
+// aes256GCMKAT is test case 14 of the original GCM specification (McGrew & Viega):
+// all-zero 256-bit key, 96-bit IV and 128-bit plaintext.
+var aes256GCMKAT = struct {
+	key, nonce, plaintext, sealed string
+}{
+	key:       "0000000000000000000000000000000000000000000000000000000000000000",
+	nonce:     "000000000000000000000000",
+	plaintext: "00000000000000000000000000000000",
+	sealed:    "cea7403d4d606b6e074ec5d3baf39d18" + "d0d1c8a799996bf0265b98b5d48ab919",
+}
+
+// aesSIVKAT is the deterministic example of RFC 5297, appendix A.1 (AES-SIV with two
+// 128-bit keys; AES_256_SIV runs the same construction with 256-bit keys).
+var aesSIVKAT = struct {
+	key, ad, plaintext, sealed string
+}{
+	key:       "fffefdfcfbfaf9f8f7f6f5f4f3f2f1f0" + "f0f1f2f3f4f5f6f7f8f9fafbfcfdfeff",
+	ad:        "101112131415161718191a1b1c1d1e1f2021222324252627",
+	plaintext: "112233445566778899aabbccddee",
+	sealed:    "85632d07c6e8f37f950acd320a2ecc93" + "40c02b9690c4dc04daef7f6afe5c",
+}
+
+// aesGCMSIVKAT is the first AEAD_AES_256_GCM_SIV example of RFC 8452, appendix C.2,
+// with an 8-byte plaintext and no AAD.
+var aesGCMSIVKAT = struct {
+	key, nonce, plaintext, sealed string
+}{
+	key:       "0100000000000000000000000000000000000000000000000000000000000000",
+	nonce:     "030000000000000000000000",
+	plaintext: "0100000000000000",
+	sealed:    "c2ef328e5c71c83b" + "843122130f7364b761e0b97427e3df28",
+}
+
+// hkdfKAT is test case 1 of RFC 5869, appendix A.1 (HKDF-SHA256).
+var hkdfKAT = struct {
+	ikm, salt, info, okm string
+}{
+	ikm:  "0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b",
+	salt: "000102030405060708090a0b0c",
+	info: "f0f1f2f3f4f5f6f7f8f9",
+	okm:  "3cb25f25faacd57a90434f64d0362f2a2d2d0a90cf1a5a4c5db02d56ecc4c5bf34007208d5b887185865",
+}
+
+// ff1KAT is sample 2 of the NIST FF1 examples: AES-128, radix 10, a 10-byte tweak.
+var ff1KAT = struct {
+	key, tweak string
+	plaintext  []uint16
+	ciphertext []uint16
+}{
+	key:        "2b7e151628aed2a6abf7158809cf4f3c",
+	tweak:      "39383736353433323130",
+	plaintext:  []uint16{0, 1, 2, 3, 4, 5, 6, 7, 8, 9},
+	ciphertext: []uint16{6, 1, 2, 4, 2, 0, 0, 7, 7, 3},
+}
+
+// SelfTest checks AES-256-GCM, AES-256-GCM-SIV, AES-SIV, FF1 and HKDF against known
+// answers and round-trips every supported cipher, HPKE included, with and without AAD,
+// including tamper detection. JWT signing keys are checked the same way.
+func SelfTest() error {
+	key, _ := hex.DecodeString(aes256GCMKAT.key)
+	nonce, _ := hex.DecodeString(aes256GCMKAT.nonce)
+	plaintext, _ := hex.DecodeString(aes256GCMKAT.plaintext)
+	want, _ := hex.DecodeString(aes256GCMKAT.sealed)
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return fmt.Errorf("AES-256-GCM known answer: %w", err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return fmt.Errorf("AES-256-GCM known answer: %w", err)
+	}
+	if got := gcm.Seal(nil, nonce, plaintext, nil); !bytes.Equal(got, want) {
+		return fmt.Errorf("AES-256-GCM known answer mismatch")
+	}
+	if err := gcmSIVKnownAnswer(); err != nil {
+		return err
+	}
+	if err := sivKnownAnswer(); err != nil {
+		return err
+	}
+	if err := ff1KnownAnswer(); err != nil {
+		return err
+	}
+	if err := hkdfKnownAnswer(); err != nil {
+		return err
+	}
+
+	if err := hpkeRoundTrip(); err != nil {
+		return err
+	}
+	if err := jwsRoundTrip(); err != nil {
+		return err
+	}
+
+	msg := []byte("kms self-test")
+	aad := []byte(`{"purpose":"self-test"}`)
+	for _, alg := range SupportedAlgorithms {
+		if alg.HPKE() || alg.Derivation() {
+			continue
+		}
+		k, err := GenerateKeyFor(alg)
+		if err != nil {
+			return fmt.Errorf("%s: %w", alg, err)
+		}
+		ct, err := Encrypt(alg, k, msg, aad)
+		if err != nil {
+			return fmt.Errorf("%s encrypt: %w", alg, err)
+		}
+		pt, err := Decrypt(alg, k, ct, aad)
+		if err != nil || !bytes.Equal(pt, msg) {
+			return fmt.Errorf("%s round trip failed", alg)
+		}
+		if _, err := Decrypt(alg, k, ct, nil); err == nil {
+			return fmt.Errorf("%s accepted ciphertext with the wrong AAD", alg)
+		}
+		ct[len(ct)-1] ^= 1
+		if _, err := Decrypt(alg, k, ct, aad); err == nil {
+			return fmt.Errorf("%s accepted tampered ciphertext", alg)
+		}
+	}
+	return nil
+}
+
+func hpkeRoundTrip() error {
+	priv, err := GenerateHPKEKey()
+	if err != nil {
+		return fmt.Errorf("HPKE: %w", err)
+	}
+	pub, err := HPKEPublicKey(priv)
+	if err != nil {
+		return fmt.Errorf("HPKE: %w", err)
+	}
+	msg, info, aad := []byte("kms self-test"), []byte("self-test"), []byte(`{"purpose":"self-test"}`)
+	enc, ct, err := HPKESeal(pub, info, aad, msg)
+	if err != nil {
+		return fmt.Errorf("HPKE seal: %w", err)
+	}
+	if pt, err := HPKEOpen(priv, enc, info, aad, ct); err != nil || !bytes.Equal(pt, msg) {
+		return fmt.Errorf("HPKE round trip failed")
+	}
+	if _, err := HPKEOpen(priv, enc, nil, aad, ct); err == nil {
+		return fmt.Errorf("HPKE accepted a message with the wrong info")
+	}
+	ct[len(ct)-1] ^= 1
+	if _, err := HPKEOpen(priv, enc, info, aad, ct); err == nil {
+		return fmt.Errorf("HPKE accepted a tampered message")
+	}
+	return nil
+}
+
+func gcmSIVKnownAnswer() error {
+	key, _ := hex.DecodeString(aesGCMSIVKAT.key)
+	nonce, _ := hex.DecodeString(aesGCMSIVKAT.nonce)
+	plaintext, _ := hex.DecodeString(aesGCMSIVKAT.plaintext)
+	want, _ := hex.DecodeString(aesGCMSIVKAT.sealed)
+
+	aead, err := newGCMSIV(key)
+	if err != nil {
+		return fmt.Errorf("AES-256-GCM-SIV known answer: %w", err)
+	}
+	if got := aead.Seal(nil, nonce, plaintext, nil); !bytes.Equal(got, want) {
+		return fmt.Errorf("AES-256-GCM-SIV known answer mismatch")
+	}
+	if pt, err := aead.Open(nil, nonce, want, nil); err != nil || !bytes.Equal(pt, plaintext) {
+		return fmt.Errorf("AES-256-GCM-SIV known answer failed to open")
+	}
+	return nil
+}
+
+func sivKnownAnswer() error {
+	key, _ := hex.DecodeString(aesSIVKAT.key)
+	ad, _ := hex.DecodeString(aesSIVKAT.ad)
+	plaintext, _ := hex.DecodeString(aesSIVKAT.plaintext)
+	want, _ := hex.DecodeString(aesSIVKAT.sealed)
+
+	aead, err := newSIV(key)
+	if err != nil {
+		return fmt.Errorf("AES-SIV known answer: %w", err)
+	}
+	if got := aead.Seal(nil, nil, plaintext, ad); !bytes.Equal(got, want) {
+		return fmt.Errorf("AES-SIV known answer mismatch")
+	}
+	if pt, err := aead.Open(nil, nil, want, ad); err != nil || !bytes.Equal(pt, plaintext) {
+		return fmt.Errorf("AES-SIV known answer failed to open")
+	}
+	return nil
+}
+
+func hkdfKnownAnswer() error {
+	ikm, _ := hex.DecodeString(hkdfKAT.ikm)
+	salt, _ := hex.DecodeString(hkdfKAT.salt)
+	info, _ := hex.DecodeString(hkdfKAT.info)
+	want, _ := hex.DecodeString(hkdfKAT.okm)
+
+	got, err := DeriveKey(ikm, salt, info, len(want))
+	if err != nil {
+		return fmt.Errorf("HKDF known answer: %w", err)
+	}
+	if !bytes.Equal(got, want) {
+		return fmt.Errorf("HKDF known answer mismatch")
+	}
+	return nil
+}
+
+func ff1KnownAnswer() error {
+	key, _ := hex.DecodeString(ff1KAT.key)
+	tweak, _ := hex.DecodeString(ff1KAT.tweak)
+
+	f, err := NewFPE(FPEModeFF1, key, 10)
+	if err != nil {
+		return fmt.Errorf("FF1 known answer: %w", err)
+	}
+	got, err := f.Encrypt(tweak, ff1KAT.plaintext)
+	if err != nil || !slices.Equal(got, ff1KAT.ciphertext) {
+		return fmt.Errorf("FF1 known answer mismatch")
+	}
+	if pt, err := f.Decrypt(tweak, got); err != nil || !slices.Equal(pt, ff1KAT.plaintext) {
+		return fmt.Errorf("FF1 known answer failed to decrypt")
+	}
+	return nil
+}
@@ -0,0 +1,166 @@
+package crypto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+)
+
+// AES-SIV (RFC 5297) is a deterministic AEAD: the same key, plaintext and associated
+// data always give the same ciphertext, which is what lets applications look values up
+// by equality. It reveals exactly that, and nothing more; it is never used unless a key
+// is created for it.
+
+const sivSize = aes.BlockSize
+
+var errSIVOpen = errors.New("cipher: message authentication failed")
+
+type siv struct {
+	mac cipher.Block // K1, for S2V
+	ctr cipher.Block // K2, for CTR mode
+}
+
+// newSIV builds AES-SIV from a key twice the size of the AES key: 32, 48 or 64 bytes.
+func newSIV(key []byte) (cipher.AEAD, error) {
+	if n := len(key); n != 32 && n != 48 && n != 64 {
+		return nil, fmt.Errorf("AES-SIV requires a 32, 48 or 64-byte key")
+	}
+	half := len(key) / 2
+	mac, err := aes.NewCipher(key[:half])
+	if err != nil {
+		return nil, fmt.Errorf("failed to create AES cipher: %w", err)
+	}
+	ctr, err := aes.NewCipher(key[half:])
+	if err != nil {
+		return nil, fmt.Errorf("failed to create AES cipher: %w", err)
+	}
+	return &siv{mac: mac, ctr: ctr}, nil
+}
+
+// NonceSize is zero: the synthetic IV is derived from the input.
+func (s *siv) NonceSize() int { return 0 }
+
+func (s *siv) Overhead() int { return sivSize }
+
+// Seal returns dst with the synthetic IV and ciphertext appended. Empty additional data
+// is the same as none.
+func (s *siv) Seal(dst, nonce, plaintext, additionalData []byte) []byte {
+	if len(nonce) != 0 {
+		panic("crypto: AES-SIV takes no nonce")
+	}
+	v := s.s2v(plaintext, adComponents(additionalData)...)
+	ret, out := sliceForAppend(dst, sivSize+len(plaintext))
+	copy(out, v)
+	s.xorKeyStream(out[sivSize:], plaintext, v)
+	return ret
+}
+
+func (s *siv) Open(dst, nonce, ciphertext, additionalData []byte) ([]byte, error) {
+	if len(nonce) != 0 {
+		panic("crypto: AES-SIV takes no nonce")
+	}
+	if len(ciphertext) < sivSize {
+		return nil, errSIVOpen
+	}
+	v := ciphertext[:sivSize]
+	plaintext := make([]byte, len(ciphertext)-sivSize)
+	s.xorKeyStream(plaintext, ciphertext[sivSize:], v)
+	if subtle.ConstantTimeCompare(s.s2v(plaintext, adComponents(additionalData)...), v) != 1 {
+		clear(plaintext)
+		return nil, errSIVOpen
+	}
+	return append(dst, plaintext...), nil
+}
+
+// xorKeyStream runs AES-CTR from the synthetic IV with bits 31 and 63 cleared.
+func (s *siv) xorKeyStream(dst, src, v []byte) {
+	q := make([]byte, sivSize)
+	copy(q, v)
+	q[8] &= 0x7f
+	q[12] &= 0x7f
+	cipher.NewCTR(s.ctr, q).XORKeyStream(dst, src)
+}
+
+// adComponents is the AEAD's additional data as S2V components: one, or none when it
+// is empty.
+func adComponents(additionalData []byte) [][]byte {
+	if len(additionalData) == 0 {
+		return nil
+	}
+	return [][]byte{additionalData}
+}
+
+// s2v is S2V over the associated data components and the plaintext.
+func (s *siv) s2v(plaintext []byte, ad ...[]byte) []byte {
+	d := s.cmac(make([]byte, sivSize))
+	for _, a := range ad {
+		d = dbl(d)
+		subtle.XORBytes(d, d, s.cmac(a))
+	}
+	var t []byte
+	if len(plaintext) >= sivSize {
+		t = append([]byte(nil), plaintext...)
+		end := t[len(t)-sivSize:]
+		subtle.XORBytes(end, end, d)
+	} else {
+		t = dbl(d)
+		pad := make([]byte, sivSize)
+		copy(pad, plaintext)
+		pad[len(plaintext)] = 0x80
+		subtle.XORBytes(t, t, pad)
+	}
+	return s.cmac(t)
+}
+
+// cmac is AES-CMAC (RFC 4493) under K1.
+func (s *siv) cmac(msg []byte) []byte {
+	k1 := make([]byte, sivSize)
+	s.mac.Encrypt(k1, k1)
+	k1 = dbl(k1)
+
+	n := (len(msg) + sivSize - 1) / sivSize
+	last := make([]byte, sivSize)
+	if n > 0 && len(msg)%sivSize == 0 {
+		subtle.XORBytes(last, msg[(n-1)*sivSize:], k1)
+	} else {
+		if n == 0 {
+			n = 1
+		}
+		copy(last, msg[(n-1)*sivSize:])
+		last[len(msg)-(n-1)*sivSize] = 0x80
+		subtle.XORBytes(last, last, dbl(k1))
+	}
+
+	x := make([]byte, sivSize)
+	for i := 0; i < n-1; i++ {
+		subtle.XORBytes(x, x, msg[i*sivSize:(i+1)*sivSize])
+		s.mac.Encrypt(x, x)
+	}
+	subtle.XORBytes(x, x, last)
+	s.mac.Encrypt(x, x)
+	return x
+}
+
+// dbl multiplies a block by x in GF(2^128).
+func dbl(b []byte) []byte {
+	out := make([]byte, sivSize)
+	var carry byte
+	for i := sivSize - 1; i >= 0; i-- {
+		out[i] = b[i]<<1 | carry
+		carry = b[i] >> 7
+	}
+	out[sivSize-1] ^= 0x87 & -carry
+	return out
+}
+
+func sliceForAppend(in []byte, n int) (head, tail []byte) {
+	if total := len(in) + n; cap(in) >= total {
+		head = in[:total]
+	} else {
+		head = make([]byte, total)
+		copy(head, in)
+	}
+	return head, head[len(in):]
+}
@@ -0,0 +1,293 @@
+// Package dekcache caches wrapped DEK documents in front of a storage.DEKStore, in
+// Redis shared by every replica and briefly in each process. Only the wrapped form is
+// cached; unwrapping still needs the master keys.
+package dekcache
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"my-kms/internal/logging"
+	"my-kms/internal/metrics"
+	"my-kms/internal/storage"
+)
+
+const (
+	keyPrefix           = "kms:dek:"
+	generationPrefix    = "kms:dek-gen:"
+	invalidationChannel = "kms:dek-invalidate"
+
+	// localMaxEntries bounds the in-process tier; it is emptied when full.
+	localMaxEntries = 10000
+
+	redisTimeout = 500 * time.Millisecond
+)
+
+// setScript stores a document only if its DEK has not been invalidated since the
+// caller read the generation, so a read racing an update cannot cache the old state.
+var setScript = redis.NewScript(`
+local gen = redis.call('GET', KEYS[2]) or '0'
+if gen ~= ARGV[1] then
+  return 0
+end
+redis.call('SET', KEYS[1], ARGV[2], 'PX', ARGV[3])
+return 1
+`)
+
+// localEntry holds the encoded document, so callers never share its slices and maps.
+type localEntry struct {
+	encoded []byte
+	expires time.Time
+}
+
+// Cache is a storage.DEKStore that serves GetDEK from the cache. Every change to a DEK
+// other than TouchDEK removes it from Redis and, through pub/sub, from every replica's
+// in-process tier. Redis errors fall through to the store.
+type Cache struct {
+	storage.DEKStore
+
+	client *redis.Client
+	// ttl and localTTL are durations, held atomically so SetTTLs can change them.
+	ttl      atomic.Int64
+	localTTL atomic.Int64
+
+	mu    sync.Mutex
+	local map[string]localEntry
+	// epoch moves on every invalidation this process hears of; a read that started in
+	// an earlier epoch does not fill the local tier.
+	epoch atomic.Uint64
+}
+
+// New connects to the Redis server at url and wraps store. Entries live for ttl in Redis
+// and for localTTL in the process, which bounds staleness should an invalidation be lost.
+func New(store storage.DEKStore, url string, ttl, localTTL time.Duration) (*Cache, error) {
+	if ttl <= 0 || localTTL <= 0 {
+		return nil, errors.New("DEK cache TTLs must be positive")
+	}
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Redis URL: %w", err)
+	}
+	client := redis.NewClient(opts)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("failed to connect to Redis: %w", err)
+	}
+	c := &Cache{
+		DEKStore: store,
+		client:   client,
+		local:    make(map[string]localEntry),
+	}
+	c.ttl.Store(int64(ttl))
+	c.localTTL.Store(int64(localTTL))
+	return c, nil
+}
+
+// SetTTLs changes how long entries cached from now on live. Entries already cached
+// keep the TTL they were cached with.
+func (c *Cache) SetTTLs(ttl, localTTL time.Duration) error {
+	if ttl <= 0 || localTTL <= 0 {
+		return errors.New("DEK cache TTLs must be positive")
+	}
+	c.ttl.Store(int64(ttl))
+	c.localTTL.Store(int64(localTTL))
+	return nil
+}
+
+func (c *Cache) redisTTL() time.Duration   { return time.Duration(c.ttl.Load()) }
+func (c *Cache) processTTL() time.Duration { return time.Duration(c.localTTL.Load()) }
+
+// GetDEK returns the DEK from the local tier, then Redis, then the store.
+func (c *Cache) GetDEK(ctx context.Context, tenantID, id string) (*storage.DEKDocument, error) {
+	epoch := c.epoch.Load()
+	if doc := c.getLocal(id); doc != nil && doc.TenantID == tenantID {
+		metrics.DEKCacheLookups.Inc("hit")
+		return doc, nil
+	}
+
+	rctx, cancel := context.WithTimeout(ctx, redisTimeout)
+	vals, err := c.client.MGet(rctx, keyPrefix+id, generationPrefix+id).Result()
+	cancel()
+	gen := "0"
+	if err == nil {
+		if s, ok := vals[1].(string); ok {
+			gen = s
+		}
+		if s, ok := vals[0].(string); ok {
+			var doc storage.DEKDocument
+			if err := json.Unmarshal([]byte(s), &doc); err == nil && doc.TenantID == tenantID {
+				metrics.DEKCacheLookups.Inc("hit")
+				c.putLocal(id, []byte(s), epoch)
+				return &doc, nil
+			}
+		}
+	} else {
+		logging.Warnf("dekcache", "Redis lookup failed, reading DEK %s from the store: %v", id, err)
+	}
+
+	metrics.DEKCacheLookups.Inc("miss")
+	doc, derr := c.DEKStore.GetDEK(ctx, tenantID, id)
+	if derr != nil {
+		return nil, derr
+	}
+	encoded, merr := json.Marshal(doc)
+	if merr != nil {
+		return doc, nil
+	}
+	if err == nil {
+		c.fill(ctx, id, gen, encoded)
+	}
+	c.putLocal(id, encoded, epoch)
+	return doc, nil
+}
+
+func (c *Cache) fill(ctx context.Context, id, gen string, encoded []byte) {
+	rctx, cancel := context.WithTimeout(ctx, redisTimeout)
+	defer cancel()
+	if err := setScript.Run(rctx, c.client, []string{keyPrefix + id, generationPrefix + id}, gen, encoded, c.redisTTL().Milliseconds()).Err(); err != nil {
+		logging.Warnf("dekcache", "Failed to cache DEK %s: %v", id, err)
+	}
+}
+
+func (c *Cache) getLocal(id string) *storage.DEKDocument {
+	c.mu.Lock()
+	e, ok := c.local[id]
+	c.mu.Unlock()
+	if !ok || time.Now().After(e.expires) {
+		return nil
+	}
+	var doc storage.DEKDocument
+	if err := json.Unmarshal(e.encoded, &doc); err != nil {
+		return nil
+	}
+	return &doc
+}
+
+func (c *Cache) putLocal(id string, encoded []byte, epoch uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.epoch.Load() != epoch {
+		return
+	}
+	if len(c.local) >= localMaxEntries {
+		clear(c.local)
+	}
+	c.local[id] = localEntry{encoded: encoded, expires: time.Now().Add(c.processTTL())}
+}
+
+// dropLocal forgets id, or everything when id is empty.
+func (c *Cache) dropLocal(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.epoch.Add(1)
+	if id == "" {
+		clear(c.local)
+		return
+	}
+	delete(c.local, id)
+}
+
+// invalidate runs after the store has changed id. Bumping the generation stops
+// in-flight reads from caching what they read before the change.
+func (c *Cache) invalidate(ctx context.Context, id string, err error) error {
+	if err != nil {
+		return err
+	}
+	c.dropLocal(id)
+	rctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 2*time.Second)
+	defer cancel()
+	pipe := c.client.TxPipeline()
+	pipe.Incr(rctx, generationPrefix+id)
+	pipe.Expire(rctx, generationPrefix+id, c.redisTTL()+time.Minute)
+	pipe.Del(rctx, keyPrefix+id)
+	pipe.Publish(rctx, invalidationChannel, id)
+	if _, err := pipe.Exec(rctx); err != nil {
+		logging.Errorf("dekcache", "Failed to invalidate cached DEK %s; other replicas may serve it for up to %s: %v", id, c.redisTTL(), err)
+	}
+	return nil
+}
+
+// Run applies invalidations published by other replicas until ctx is cancelled. The
+// local tier is emptied whenever the subscription is (re)established, as messages sent
+// while it was down are lost.
+func (c *Cache) Run(ctx context.Context) {
+	ps := c.client.Subscribe(ctx, invalidationChannel)
+	defer ps.Close()
+	for {
+		msg, err := ps.Receive(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			c.dropLocal("")
+			logging.Warnf("dekcache", "DEK invalidation subscription failed: %v", err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(time.Second):
+			}
+			continue
+		}
+		switch m := msg.(type) {
+		case *redis.Subscription:
+			c.dropLocal("")
+		case *redis.Message:
+			c.dropLocal(m.Payload)
+		}
+	}
+}
+
+func (c *Cache) DeleteDEK(ctx context.Context, tenantID, id, deletedBy string) error {
+	return c.invalidate(ctx, id, c.DEKStore.DeleteDEK(ctx, tenantID, id, deletedBy))
+}
+
+func (c *Cache) SetDEKOwner(ctx context.Context, tenantID, id, ownerUID string) error {
+	return c.invalidate(ctx, id, c.DEKStore.SetDEKOwner(ctx, tenantID, id, ownerUID))
+}
+
+func (c *Cache) SetDEKState(ctx context.Context, tenantID, id string, state storage.KeyState, from ...storage.KeyState) error {
+	return c.invalidate(ctx, id, c.DEKStore.SetDEKState(ctx, tenantID, id, state, from...))
+}
+
+func (c *Cache) SetDEKDeprecation(ctx context.Context, tenantID, id string, deprecatedAt, sunsetAt time.Time, replacementDEKID string) error {
+	return c.invalidate(ctx, id, c.DEKStore.SetDEKDeprecation(ctx, tenantID, id, deprecatedAt, sunsetAt, replacementDEKID))
+}
+
+func (c *Cache) SetDEKTags(ctx context.Context, tenantID, id string, tags map[string]string) error {
+	return c.invalidate(ctx, id, c.DEKStore.SetDEKTags(ctx, tenantID, id, tags))
+}
+
+func (c *Cache) RemoveDEKTags(ctx context.Context, tenantID, id string, keys []string) error {
+	return c.invalidate(ctx, id, c.DEKStore.RemoveDEKTags(ctx, tenantID, id, keys))
+}
+
+func (c *Cache) SetDEKPolicy(ctx context.Context, tenantID, id string, policy *storage.KeyPolicy) error {
+	return c.invalidate(ctx, id, c.DEKStore.SetDEKPolicy(ctx, tenantID, id, policy))
+}
+
+func (c *Cache) SetDEKSealedMetadata(ctx context.Context, tenantID, id string, prev []byte, sealed *storage.SealedMetadata) error {
+	return c.invalidate(ctx, id, c.DEKStore.SetDEKSealedMetadata(ctx, tenantID, id, prev, sealed))
+}
+
+func (c *Cache) RewrapDEK(ctx context.Context, tenantID, id, prevMasterKeyID string, dek []byte, masterKeyID string) error {
+	return c.invalidate(ctx, id, c.DEKStore.RewrapDEK(ctx, tenantID, id, prevMasterKeyID, dek, masterKeyID))
+}
+
+// PingRedis checks the connection to Redis. Ping, from the store, checks the store.
+func (c *Cache) PingRedis(ctx context.Context) error {
+	return c.client.Ping(ctx).Err()
+}
+
+// Close closes the Redis connection. The store is left to whoever opened it.
+func (c *Cache) Close(ctx context.Context) error {
+	return c.client.Close()
+}
@@ -0,0 +1,265 @@
+// Package events notifies downstream services of key lifecycle changes, so they can
+// react (re-encrypt, drop a cached key) without polling: signed HTTPS webhooks, and
+// subscribers such as the /events Server-Sent Events stream.
+package events
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+
+	"my-kms/internal/logging"
+)
+
+// Type names a lifecycle change.
+type Type string
+
+const (
+	KeyCreated           Type = "key.created" // generated or imported DEK
+	KeyRotated           Type = "key.rotated" // DEK deprecated in favour of a replacement
+	KeyDisabled          Type = "key.disabled"
+	KeyEnabled           Type = "key.enabled"
+	KeyDeletionScheduled Type = "key.deletion_scheduled" // soft-deleted, purged after DEK_RETENTION
+	KeyRestored          Type = "key.restored"
+	GrantCreated         Type = "grant.created"
+	GrantRetired         Type = "grant.retired"
+	MasterKeyRotated     Type = "master_key.rotated"
+	MasterKeyRetired     Type = "master_key.retired"
+)
+
+// AllTypes lists every event type, for validating filters.
+var AllTypes = []Type{
+	KeyCreated, KeyRotated, KeyDisabled, KeyEnabled, KeyDeletionScheduled, KeyRestored,
+	GrantCreated, GrantRetired, MasterKeyRotated, MasterKeyRetired,
+}
+
+// Event is one lifecycle change. Master key events have no tenant: they concern every
+// tenant whose DEKs the master key wraps.
+type Event struct {
+	ID       string            `json:"id"`
+	Type     Type              `json:"type"`
+	Time     time.Time         `json:"time"`
+	TenantID string            `json:"tenantId,omitempty"`
+	KeyID    string            `json:"keyId,omitempty"` // the DEK or master key; for grants, the DEK granted
+	Actor    string            `json:"actor"`           // identity that made the change, or "kms"
+	Data     map[string]string `json:"data,omitempty"`  // type-specific, e.g. replacementKeyId or grantId
+}
+
+// Sink delivers a batch of events; an error means the whole batch is retried.
+type Sink interface {
+	Name() string
+	Send(ctx context.Context, events []Event) error
+}
+
+// DefaultTimeout bounds each delivery attempt.
+const DefaultTimeout = 10 * time.Second
+
+// Retry backoff between failed deliveries.
+const (
+	minRetryBackoff = time.Second
+	maxRetryBackoff = time.Minute
+)
+
+// Bus fans events out to the sinks and subscribers. Each sink has its own buffer, so
+// a slow or unreachable receiver never blocks a request; when it is full, new events
+// for that sink are dropped and counted.
+type Bus struct {
+	queues []*queue
+
+	mu   sync.Mutex
+	subs map[*Subscription]struct{}
+}
+
+type queue struct {
+	sink    Sink
+	events  chan Event
+	dropped atomic.Int64
+}
+
+// NewBus buffers up to bufferSize events for each sink.
+func NewBus(sinks []Sink, bufferSize int) *Bus {
+	b := &Bus{subs: map[*Subscription]struct{}{}}
+	for _, s := range sinks {
+		b.queues = append(b.queues, &queue{sink: s, events: make(chan Event, bufferSize)})
+	}
+	return b
+}
+
+// Names lists the configured sinks.
+func (b *Bus) Names() []string {
+	names := make([]string, 0, len(b.queues))
+	for _, q := range b.queues {
+		names = append(names, q.sink.Name())
+	}
+	return names
+}
+
+// Publish stamps ev with an ID and time unless it has them, and hands it to every sink
+// and matching subscriber without blocking.
+func (b *Bus) Publish(ev Event) {
+	if ev.ID == "" {
+		ev.ID = uuid.NewString()
+	}
+	if ev.Time.IsZero() {
+		ev.Time = time.Now().UTC()
+	}
+	for _, q := range b.queues {
+		select {
+		case q.events <- ev:
+		default:
+			if q.dropped.Add(1) == 1 {
+				logging.Warnf("events", "Event sink %s buffer is full; dropping key lifecycle events", q.sink.Name())
+			}
+		}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for sub := range b.subs {
+		if !sub.match(ev) {
+			continue
+		}
+		select {
+		case sub.c <- ev:
+		default:
+			// A subscriber that can't keep up is cut off rather than silently missing
+			// events; it reconnects knowing it has to catch up.
+			delete(b.subs, sub)
+			sub.overflowed.Store(true)
+			close(sub.c)
+		}
+	}
+}
+
+// Subscription receives the events its filter matches on C, which is closed when the
+// subscription ends: by Close, by CloseSubscriptions, or when it falls behind.
+type Subscription struct {
+	C <-chan Event
+
+	c          chan Event
+	match      func(Event) bool
+	bus        *Bus
+	overflowed atomic.Bool
+}
+
+// Subscribe returns a subscription buffering up to bufferSize events that match filter.
+func (b *Bus) Subscribe(bufferSize int, filter func(Event) bool) *Subscription {
+	c := make(chan Event, bufferSize)
+	sub := &Subscription{C: c, c: c, match: filter, bus: b}
+	b.mu.Lock()
+	b.subs[sub] = struct{}{}
+	b.mu.Unlock()
+	return sub
+}
+
+// Overflowed reports whether the subscription ended because it fell behind.
+func (s *Subscription) Overflowed() bool { return s.overflowed.Load() }
+
+// Close ends the subscription.
+func (s *Subscription) Close() {
+	s.bus.mu.Lock()
+	defer s.bus.mu.Unlock()
+	if _, ok := s.bus.subs[s]; ok {
+		delete(s.bus.subs, s)
+		close(s.c)
+	}
+}
+
+// CloseSubscriptions ends every subscription, so streams return at shutdown.
+func (b *Bus) CloseSubscriptions() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for sub := range b.subs {
+		delete(b.subs, sub)
+		close(sub.c)
+	}
+}
+
+// Run delivers queued events in batches of up to batchSize, at least every flushInterval,
+// retrying failed batches with backoff until ctx is cancelled.
+func (b *Bus) Run(ctx context.Context, batchSize int, flushInterval time.Duration) {
+	var wg sync.WaitGroup
+	for _, q := range b.queues {
+		wg.Add(1)
+		go func(q *queue) {
+			defer wg.Done()
+			q.run(ctx, batchSize, flushInterval)
+		}(q)
+	}
+	wg.Wait()
+}
+
+func (q *queue) run(ctx context.Context, batchSize int, flushInterval time.Duration) {
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	batch := make([]Event, 0, batchSize)
+	for {
+		select {
+		case <-ctx.Done():
+			q.flushOnShutdown(batch)
+			return
+		case ev := <-q.events:
+			batch = append(batch, ev)
+			if len(batch) < batchSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+		if !q.deliver(ctx, batch) {
+			q.flushOnShutdown(batch)
+			return
+		}
+		batch = batch[:0]
+	}
+}
+
+// deliver sends batch until it succeeds, or returns false once ctx is cancelled.
+func (q *queue) deliver(ctx context.Context, batch []Event) bool {
+	backoff := minRetryBackoff
+	for {
+		sendCtx, cancel := context.WithTimeout(ctx, DefaultTimeout)
+		err := q.sink.Send(sendCtx, batch)
+		cancel()
+		if err == nil {
+			if n := q.dropped.Swap(0); n > 0 {
+				logging.Warnf("events", "Event sink %s dropped %d events while its buffer was full", q.sink.Name(), n)
+			}
+			return true
+		}
+		logging.Warnf("events", "Event sink %s failed to deliver %d events, retrying in %s: %v", q.sink.Name(), len(batch), backoff, err)
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(backoff):
+		}
+		backoff = min(2*backoff, maxRetryBackoff)
+	}
+}
+
+// flushOnShutdown makes one last attempt at whatever is still buffered.
+func (q *queue) flushOnShutdown(batch []Event) {
+drain:
+	for {
+		select {
+		case ev := <-q.events:
+			batch = append(batch, ev)
+		default:
+			break drain
+		}
+	}
+	if len(batch) == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultTimeout)
+	defer cancel()
+	if err := q.sink.Send(ctx, batch); err != nil {
+		logging.Errorf("events", "Event sink %s lost %d events at shutdown: %v", q.sink.Name(), len(batch), err)
+	}
+}
@@ -0,0 +1,45 @@
+package events
+
+import (
+	"context"
+	"net/http"
+
+	"my-kms/internal/kafkarest"
+	"my-kms/internal/storage"
+)
+
+// kafkaBroker produces to topics through the Kafka REST Proxy, as the SIEM Kafka sink
+// does. Records are keyed by tenant so each tenant's events stay ordered within a
+// partition.
+type kafkaBroker struct {
+	producer *kafkarest.Producer
+}
+
+func newKafkaBroker(restURL string) (*kafkaBroker, error) {
+	producer, err := kafkarest.NewProducer(restURL, &http.Client{Timeout: DefaultTimeout})
+	if err != nil {
+		return nil, err
+	}
+	return &kafkaBroker{producer: producer}, nil
+}
+
+func (b *kafkaBroker) Name() string { return "kafka" }
+
+// Publish produces msgs one topic at a time, in order.
+func (b *kafkaBroker) Publish(ctx context.Context, msgs []storage.OutboxMessage) error {
+	for start := 0; start < len(msgs); {
+		end := start + 1
+		for end < len(msgs) && msgs[end].Topic == msgs[start].Topic {
+			end++
+		}
+		records := make([]kafkarest.Record, 0, end-start)
+		for _, msg := range msgs[start:end] {
+			records = append(records, kafkarest.Record{Key: msg.Key, Value: msg.Payload})
+		}
+		if err := b.producer.Produce(ctx, msgs[start].Topic, records); err != nil {
+			return err
+		}
+		start = end
+	}
+	return nil
+}
@@ -0,0 +1,386 @@
+package events
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+
+	"my-kms/internal/storage"
+)
+
+// natsBroker publishes to NATS subjects over the NATS client protocol. It speaks the
+// part of the protocol the outbox needs (CONNECT, PUB/HPUB, PING/PONG and one SUB for
+// JetStream acks) rather than pulling in nats.go for it, as the Kafka broker goes
+// through the REST Proxy: publishing is a batch at a time under the outbox's own retry
+// loop, so the library's reconnect buffering, subscriptions and JetStream API would go
+// unused. nats_test.go runs it against a scripted server. Each message carries a
+// Nats-Msg-Id header, so JetStream drops the copies a retry publishes within its
+// duplicate window.
+type natsBroker struct {
+	addr       string
+	serverName string
+	useTLS     bool
+	user, pass string
+	token      string
+	jetStream  bool
+
+	mu         sync.Mutex
+	conn       net.Conn
+	r          *bufio.Reader
+	maxPayload int
+	headers    bool
+	inbox      string // JetStream acknowledgements arrive on inbox.<n>
+}
+
+func newNATSBroker(rawURL string, jetStream bool) (*natsBroker, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "nats" && u.Scheme != "tls") || u.Hostname() == "" {
+		return nil, fmt.Errorf("NATS URL must be a nats:// or tls:// URL")
+	}
+	b := &natsBroker{
+		addr:       u.Host,
+		serverName: u.Hostname(),
+		useTLS:     u.Scheme == "tls",
+		jetStream:  jetStream,
+	}
+	if u.Port() == "" {
+		b.addr = net.JoinHostPort(u.Hostname(), "4222")
+	}
+	if u.User != nil {
+		if pass, ok := u.User.Password(); ok {
+			b.user, b.pass = u.User.Username(), pass
+		} else {
+			b.token = u.User.Username()
+		}
+	}
+	return b, nil
+}
+
+func (b *natsBroker) Name() string { return "nats" }
+
+// Publish sends msgs in order and waits until the server, or with JetStream every
+// message's stream, has them. The connection is dropped after any error and made
+// again on the next call.
+func (b *natsBroker) Publish(ctx context.Context, msgs []storage.OutboxMessage) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.conn == nil {
+		if err := b.connect(ctx); err != nil {
+			return err
+		}
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		b.conn.SetDeadline(deadline)
+	} else {
+		b.conn.SetDeadline(time.Now().Add(DefaultTimeout))
+	}
+
+	var err error
+	if b.jetStream {
+		err = b.publishJetStream(msgs)
+	} else {
+		err = b.publishCore(msgs)
+	}
+	if err != nil {
+		b.conn.Close()
+		b.conn = nil
+	}
+	return err
+}
+
+// natsInfo is the part of the server's INFO we use.
+type natsInfo struct {
+	Headers     bool `json:"headers"`
+	MaxPayload  int  `json:"max_payload"`
+	TLSRequired bool `json:"tls_required"`
+}
+
+func (b *natsBroker) connect(ctx context.Context) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", b.addr)
+	if err != nil {
+		return fmt.Errorf("failed to connect to NATS: %w", err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	fail := func(err error) error {
+		conn.Close()
+		return err
+	}
+
+	// The server sends INFO in the clear, then expects the TLS handshake if it's wanted.
+	r := bufio.NewReader(conn)
+	line, err := readNATSLine(r)
+	if err != nil {
+		return fail(fmt.Errorf("failed to read NATS INFO: %w", err))
+	}
+	op, rest, _ := strings.Cut(line, " ")
+	if !strings.EqualFold(op, "INFO") {
+		return fail(fmt.Errorf("NATS server sent %q instead of INFO", op))
+	}
+	var info natsInfo
+	if err := json.Unmarshal([]byte(rest), &info); err != nil {
+		return fail(fmt.Errorf("failed to parse NATS INFO: %w", err))
+	}
+	if info.TLSRequired && !b.useTLS {
+		return fail(fmt.Errorf("NATS server requires TLS; use a tls:// URL"))
+	}
+	if b.jetStream && !info.Headers {
+		return fail(fmt.Errorf("NATS server doesn't support headers, which JetStream publishing needs"))
+	}
+	if b.useTLS {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: b.serverName, MinVersion: tls.VersionTLS12})
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			return fail(fmt.Errorf("NATS TLS handshake failed: %w", err))
+		}
+		conn = tlsConn
+		r = bufio.NewReader(conn)
+	}
+
+	connect, err := json.Marshal(map[string]interface{}{
+		"verbose":       false,
+		"pedantic":      false,
+		"tls_required":  b.useTLS,
+		"name":          "kms",
+		"lang":          "go",
+		"version":       "1",
+		"protocol":      1,
+		"headers":       info.Headers,
+		"no_responders": info.Headers,
+		"user":          b.user,
+		"pass":          b.pass,
+		"auth_token":    b.token,
+	})
+	if err != nil {
+		return fail(err)
+	}
+	b.conn, b.r, b.maxPayload, b.headers = conn, r, info.MaxPayload, info.Headers
+	b.inbox = "_INBOX." + strings.ReplaceAll(uuid.NewString(), "-", "")
+	cmds := "CONNECT " + string(connect) + "\r\n"
+	if b.jetStream {
+		cmds += "SUB " + b.inbox + ".* 1\r\n"
+	}
+	if _, err := io.WriteString(conn, cmds+"PING\r\n"); err != nil {
+		b.conn = nil
+		return fail(fmt.Errorf("failed to send NATS CONNECT: %w", err))
+	}
+	if err := b.awaitPong(); err != nil {
+		b.conn = nil
+		return fail(err)
+	}
+	return nil
+}
+
+// publishCore publishes msgs and then pings: NATS handles a connection's commands in
+// order, so the PONG means it has taken every message.
+func (b *natsBroker) publishCore(msgs []storage.OutboxMessage) error {
+	w := bufio.NewWriter(b.conn)
+	for _, msg := range msgs {
+		if err := b.writeMsg(w, msg, ""); err != nil {
+			return err
+		}
+	}
+	w.WriteString("PING\r\n")
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("failed to publish to NATS: %w", err)
+	}
+	return b.awaitPong()
+}
+
+// publishJetStream publishes each message with its own reply subject and waits for the
+// stream to acknowledge every one.
+func (b *natsBroker) publishJetStream(msgs []storage.OutboxMessage) error {
+	w := bufio.NewWriter(b.conn)
+	for i, msg := range msgs {
+		if err := b.writeMsg(w, msg, b.inbox+"."+strconv.Itoa(i)); err != nil {
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("failed to publish to NATS: %w", err)
+	}
+
+	acked := make([]bool, len(msgs))
+	for remaining := len(msgs); remaining > 0; {
+		msg, err := b.readMsg()
+		if err != nil {
+			return err
+		}
+		i, err := strconv.Atoi(strings.TrimPrefix(msg.subject, b.inbox+"."))
+		if err != nil || i < 0 || i >= len(msgs) || acked[i] {
+			continue // a late answer to a batch that failed
+		}
+		if err := jetStreamAckError(msg, msgs[i].Topic); err != nil {
+			return err
+		}
+		acked[i] = true
+		remaining--
+	}
+	return nil
+}
+
+// writeMsg writes msg as HPUB when the server takes headers, or PUB when it doesn't.
+func (b *natsBroker) writeMsg(w *bufio.Writer, msg storage.OutboxMessage, reply string) error {
+	if b.maxPayload > 0 && len(msg.Payload) > b.maxPayload {
+		return fmt.Errorf("outbox message %s is %d bytes, over the NATS server's max_payload of %d", msg.ID, len(msg.Payload), b.maxPayload)
+	}
+	subject := msg.Topic
+	if reply != "" {
+		subject += " " + reply
+	}
+	if !b.headers {
+		fmt.Fprintf(w, "PUB %s %d\r\n", subject, len(msg.Payload))
+		w.Write(msg.Payload)
+		w.WriteString("\r\n")
+		return nil
+	}
+	header := "NATS/1.0\r\nNats-Msg-Id: " + msg.ID + "\r\n"
+	if msg.Key != "" {
+		header += "Kms-Tenant: " + msg.Key + "\r\n"
+	}
+	header += "\r\n"
+	fmt.Fprintf(w, "HPUB %s %d %d\r\n%s", subject, len(header), len(header)+len(msg.Payload), header)
+	w.Write(msg.Payload)
+	w.WriteString("\r\n")
+	return nil
+}
+
+// natsMsg is a MSG or HMSG delivered to our subscription.
+type natsMsg struct {
+	subject string
+	header  string // empty for MSG
+	data    []byte
+}
+
+// readMsg reads until the next delivered message, answering PINGs on the way.
+func (b *natsBroker) readMsg() (*natsMsg, error) {
+	for {
+		line, err := readNATSLine(b.r)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read from NATS: %w", err)
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		switch strings.ToUpper(fields[0]) {
+		case "PING":
+			if _, err := io.WriteString(b.conn, "PONG\r\n"); err != nil {
+				return nil, fmt.Errorf("failed to answer NATS PING: %w", err)
+			}
+		case "-ERR":
+			return nil, fmt.Errorf("NATS server error: %s", strings.TrimSpace(strings.TrimPrefix(line, fields[0])))
+		case "MSG", "HMSG":
+			return readNATSPayload(b.r, fields)
+		}
+	}
+}
+
+// awaitPong reads until the server's PONG.
+func (b *natsBroker) awaitPong() error {
+	for {
+		line, err := readNATSLine(b.r)
+		if err != nil {
+			return fmt.Errorf("failed to read from NATS: %w", err)
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		switch strings.ToUpper(fields[0]) {
+		case "PONG":
+			return nil
+		case "PING":
+			if _, err := io.WriteString(b.conn, "PONG\r\n"); err != nil {
+				return fmt.Errorf("failed to answer NATS PING: %w", err)
+			}
+		case "-ERR":
+			return fmt.Errorf("NATS server error: %s", strings.TrimSpace(strings.TrimPrefix(line, fields[0])))
+		case "MSG", "HMSG":
+			if _, err := readNATSPayload(b.r, fields); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// readNATSPayload reads the payload announced by "MSG <subject> <sid> [reply] <size>" or
+// "HMSG <subject> <sid> [reply] <header size> <total size>".
+func readNATSPayload(r *bufio.Reader, fields []string) (*natsMsg, error) {
+	isHMSG := strings.EqualFold(fields[0], "HMSG")
+	minFields := 4
+	if isHMSG {
+		minFields = 5
+	}
+	if len(fields) < minFields {
+		return nil, fmt.Errorf("malformed NATS %s", fields[0])
+	}
+	total, err := strconv.Atoi(fields[len(fields)-1])
+	if err != nil || total < 0 {
+		return nil, fmt.Errorf("malformed NATS %s size", fields[0])
+	}
+	headerSize := 0
+	if isHMSG {
+		if headerSize, err = strconv.Atoi(fields[len(fields)-2]); err != nil || headerSize < 0 || headerSize > total {
+			return nil, fmt.Errorf("malformed NATS HMSG header size")
+		}
+	}
+	buf := make([]byte, total+2)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, fmt.Errorf("failed to read NATS message: %w", err)
+	}
+	return &natsMsg{subject: fields[1], header: string(buf[:headerSize]), data: buf[headerSize:total]}, nil
+}
+
+// jetStreamAckError returns why the stream didn't take the message on subject, or nil
+// if it did.
+func jetStreamAckError(msg *natsMsg, subject string) error {
+	// A status header without data, e.g. "NATS/1.0 503", means no stream listens.
+	if status, _, _ := strings.Cut(msg.header, "\r\n"); strings.HasPrefix(status, "NATS/1.0 ") {
+		if code := strings.TrimSpace(strings.TrimPrefix(status, "NATS/1.0")); code != "" {
+			if strings.HasPrefix(code, "503") {
+				return fmt.Errorf("no JetStream stream captures subject %s", subject)
+			}
+			return fmt.Errorf("JetStream answered %s for subject %s", code, subject)
+		}
+	}
+	var ack struct {
+		Stream string `json:"stream"`
+		Error  *struct {
+			Code        int    `json:"code"`
+			Description string `json:"description"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(msg.data, &ack); err != nil {
+		return fmt.Errorf("failed to parse JetStream acknowledgement: %w", err)
+	}
+	if ack.Error != nil {
+		return fmt.Errorf("JetStream rejected a message for subject %s: %s (%d)", subject, ack.Error.Description, ack.Error.Code)
+	}
+	if ack.Stream == "" {
+		return fmt.Errorf("JetStream acknowledgement for subject %s names no stream", subject)
+	}
+	return nil
+}
+
+// readNATSLine reads one protocol line without its CRLF.
+func readNATSLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
@@ -0,0 +1,477 @@
+package events
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"my-kms/internal/storage"
+)
+
+// natsServer is a scripted NATS server: each accepted connection is handed to the
+// test's script in turn.
+type natsServer struct {
+	t    *testing.T
+	ln   net.Listener
+	done chan error
+}
+
+func startNATSServer(t *testing.T, scripts ...func(*natsConn) error) *natsServer {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &natsServer{t: t, ln: ln, done: make(chan error, 1)}
+	go func() {
+		for _, script := range scripts {
+			conn, err := ln.Accept()
+			if err != nil {
+				s.done <- err
+				return
+			}
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			err = script(&natsConn{conn: conn, r: bufio.NewReader(conn)})
+			conn.Close()
+			if err != nil {
+				s.done <- err
+				return
+			}
+		}
+		s.done <- nil
+	}()
+	t.Cleanup(func() { ln.Close() })
+	return s
+}
+
+func (s *natsServer) url() string { return "nats://" + s.ln.Addr().String() }
+
+// wait fails the test if a script failed.
+func (s *natsServer) wait() {
+	s.t.Helper()
+	if err := <-s.done; err != nil {
+		s.t.Fatalf("server: %v", err)
+	}
+}
+
+type natsConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func (c *natsConn) send(lines ...string) error {
+	_, err := io.WriteString(c.conn, strings.Join(lines, "\r\n")+"\r\n")
+	return err
+}
+
+func (c *natsConn) line() (string, error) {
+	return readNATSLine(c.r)
+}
+
+// expect reads a line and checks its operation.
+func (c *natsConn) expect(op string) (string, error) {
+	line, err := c.line()
+	if err != nil {
+		return "", fmt.Errorf("waiting for %s: %w", op, err)
+	}
+	if got, _, _ := strings.Cut(line, " "); got != op {
+		return "", fmt.Errorf("got %q, want %s", line, op)
+	}
+	return line, nil
+}
+
+// handshake sends INFO and answers the client's CONNECT, optional SUB and PING. It
+// returns the CONNECT options and the subscribed subject, if any.
+func (c *natsConn) handshake(info string) (connect map[string]interface{}, sub string, err error) {
+	if err := c.send("INFO " + info); err != nil {
+		return nil, "", err
+	}
+	line, err := c.expect("CONNECT")
+	if err != nil {
+		return nil, "", err
+	}
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "CONNECT ")), &connect); err != nil {
+		return nil, "", err
+	}
+	for {
+		line, err := c.line()
+		if err != nil {
+			return nil, "", err
+		}
+		switch fields := strings.Fields(line); fields[0] {
+		case "SUB":
+			sub = fields[1]
+		case "PING":
+			return connect, sub, c.send("PONG")
+		default:
+			return nil, "", fmt.Errorf("unexpected %q during handshake", line)
+		}
+	}
+}
+
+// natsPub is a PUB or HPUB the client sent.
+type natsPub struct {
+	op, subject, reply string
+	header, payload    string
+}
+
+// readPub reads one PUB or HPUB.
+func (c *natsConn) readPub() (*natsPub, error) {
+	line, err := c.line()
+	if err != nil {
+		return nil, err
+	}
+	fields := strings.Fields(line)
+	p := &natsPub{op: fields[0], subject: fields[1]}
+	var sizes []string
+	switch {
+	case p.op == "PUB" && len(fields) == 4, p.op == "HPUB" && len(fields) == 5:
+		p.reply, sizes = fields[2], fields[3:]
+	case p.op == "PUB" && len(fields) == 3, p.op == "HPUB" && len(fields) == 4:
+		sizes = fields[2:]
+	default:
+		return nil, fmt.Errorf("got %q, want PUB or HPUB", line)
+	}
+	total, _ := strconv.Atoi(sizes[len(sizes)-1])
+	headerSize := 0
+	if p.op == "HPUB" {
+		headerSize, _ = strconv.Atoi(sizes[0])
+	}
+	buf := make([]byte, total+2)
+	if _, err := io.ReadFull(c.r, buf); err != nil {
+		return nil, err
+	}
+	if string(buf[total:]) != "\r\n" {
+		return nil, fmt.Errorf("payload of %q is not followed by CRLF", line)
+	}
+	p.header, p.payload = string(buf[:headerSize]), string(buf[headerSize:total])
+	return p, nil
+}
+
+const natsHeaderInfo = `{"server_id":"test","headers":true,"max_payload":1024}`
+
+var natsTestMsgs = []storage.OutboxMessage{
+	{ID: "m1", Topic: "kms.key.created", Key: "acme", Payload: []byte(`{"n":1}`)},
+	{ID: "m2", Topic: "kms.key.rotated", Payload: []byte(`{"n":2}`)},
+}
+
+func publishCtx(t *testing.T) context.Context {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	t.Cleanup(cancel)
+	return ctx
+}
+
+func TestNATSPublishHeaders(t *testing.T) {
+	srv := startNATSServer(t, func(c *natsConn) error {
+		connect, sub, err := c.handshake(natsHeaderInfo)
+		if err != nil {
+			return err
+		}
+		if sub != "" {
+			return fmt.Errorf("core publishing subscribed to %s", sub)
+		}
+		if connect["user"] != "svc" || connect["pass"] != "secret" || connect["headers"] != true {
+			return fmt.Errorf("CONNECT %v", connect)
+		}
+		for _, want := range natsTestMsgs {
+			p, err := c.readPub()
+			if err != nil {
+				return err
+			}
+			if p.op != "HPUB" || p.subject != want.Topic || p.reply != "" || p.payload != string(want.Payload) {
+				return fmt.Errorf("got %+v for %s", p, want.ID)
+			}
+			if !strings.HasPrefix(p.header, "NATS/1.0\r\n") || !strings.Contains(p.header, "Nats-Msg-Id: "+want.ID+"\r\n") {
+				return fmt.Errorf("header %q lacks Nats-Msg-Id %s", p.header, want.ID)
+			}
+			if want.Key != "" && !strings.Contains(p.header, "Kms-Tenant: "+want.Key+"\r\n") {
+				return fmt.Errorf("header %q lacks Kms-Tenant", p.header)
+			}
+		}
+		if _, err := c.expect("PING"); err != nil {
+			return err
+		}
+		return c.send("PONG")
+	})
+	b, err := newNATSBroker(strings.Replace(srv.url(), "nats://", "nats://svc:secret@", 1), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Publish(publishCtx(t), natsTestMsgs); err != nil {
+		t.Fatalf("Publish: %v", err)
+	}
+	srv.wait()
+}
+
+func TestNATSPublishWithoutHeaders(t *testing.T) {
+	srv := startNATSServer(t, func(c *natsConn) error {
+		connect, _, err := c.handshake(`{"headers":false}`)
+		if err != nil {
+			return err
+		}
+		if connect["auth_token"] != "tok" || connect["headers"] != false {
+			return fmt.Errorf("CONNECT %v", connect)
+		}
+		p, err := c.readPub()
+		if err != nil {
+			return err
+		}
+		if p.op != "PUB" || p.subject != "kms.key.created" || p.payload != `{"n":1}` {
+			return fmt.Errorf("got %+v", p)
+		}
+		// A server PING in the middle is answered and doesn't end the publish.
+		if err := c.send("PING"); err != nil {
+			return err
+		}
+		if _, err := c.expect("PING"); err != nil {
+			return err
+		}
+		if _, err := c.expect("PONG"); err != nil {
+			return err
+		}
+		return c.send("PONG")
+	})
+	b, err := newNATSBroker(strings.Replace(srv.url(), "nats://", "nats://tok@", 1), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Publish(publishCtx(t), natsTestMsgs[:1]); err != nil {
+		t.Fatalf("Publish: %v", err)
+	}
+	srv.wait()
+}
+
+func TestNATSPublishJetStream(t *testing.T) {
+	srv := startNATSServer(t, func(c *natsConn) error {
+		_, sub, err := c.handshake(natsHeaderInfo)
+		if err != nil {
+			return err
+		}
+		if !strings.HasPrefix(sub, "_INBOX.") || !strings.HasSuffix(sub, ".*") {
+			return fmt.Errorf("subscribed to %q, want an inbox wildcard", sub)
+		}
+		var pubs []*natsPub
+		for range natsTestMsgs {
+			p, err := c.readPub()
+			if err != nil {
+				return err
+			}
+			if !strings.HasPrefix(p.reply, strings.TrimSuffix(sub, "*")) {
+				return fmt.Errorf("reply subject %q is outside %s", p.reply, sub)
+			}
+			pubs = append(pubs, p)
+		}
+		// Acknowledge out of order, once as MSG and once as HMSG, with a stale reply first.
+		stale := strings.TrimSuffix(sub, "*") + "7"
+		ack := `{"stream":"KMS","seq":1}`
+		return c.send(
+			fmt.Sprintf("MSG %s 1 %d", stale, len(ack)), ack,
+			fmt.Sprintf("MSG %s 1 %d", pubs[1].reply, len(ack)), ack,
+			fmt.Sprintf("HMSG %s 1 12 %d", pubs[0].reply, 12+len(ack)), "NATS/1.0\r\n\r\n"+ack,
+		)
+	})
+	b, err := newNATSBroker(srv.url(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Publish(publishCtx(t), natsTestMsgs); err != nil {
+		t.Fatalf("Publish: %v", err)
+	}
+	srv.wait()
+}
+
+func TestNATSPublishJetStreamFailures(t *testing.T) {
+	tests := []struct {
+		name    string
+		reply   func(reply string) []string
+		wantErr string
+	}{
+		{
+			name: "no responders",
+			reply: func(reply string) []string {
+				return []string{fmt.Sprintf("HMSG %s 1 16 16", reply), "NATS/1.0 503\r\n\r\n"}
+			},
+			wantErr: "no JetStream stream captures subject kms.key.created",
+		},
+		{
+			name: "stream error",
+			reply: func(reply string) []string {
+				ack := `{"error":{"code":500,"description":"insufficient resources"}}`
+				return []string{fmt.Sprintf("MSG %s 1 %d", reply, len(ack)), ack}
+			},
+			wantErr: "insufficient resources (500)",
+		},
+		{
+			name: "server error",
+			reply: func(string) []string {
+				return []string{"-ERR 'Permissions Violation for Publish to kms.key.created'"}
+			},
+			wantErr: "NATS server error: 'Permissions Violation",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := startNATSServer(t, func(c *natsConn) error {
+				if _, _, err := c.handshake(natsHeaderInfo); err != nil {
+					return err
+				}
+				p, err := c.readPub()
+				if err != nil {
+					return err
+				}
+				return c.send(tt.reply(p.reply)...)
+			})
+			b, err := newNATSBroker(srv.url(), true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = b.Publish(publishCtx(t), natsTestMsgs[:1])
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("Publish error = %v, want %q", err, tt.wantErr)
+			}
+			srv.wait()
+		})
+	}
+}
+
+func TestNATSReconnectsAfterError(t *testing.T) {
+	srv := startNATSServer(t,
+		func(c *natsConn) error {
+			if _, _, err := c.handshake(natsHeaderInfo); err != nil {
+				return err
+			}
+			return nil // hang up before the publish is confirmed
+		},
+		func(c *natsConn) error {
+			if _, _, err := c.handshake(natsHeaderInfo); err != nil {
+				return err
+			}
+			if _, err := c.readPub(); err != nil {
+				return err
+			}
+			if _, err := c.expect("PING"); err != nil {
+				return err
+			}
+			return c.send("PONG")
+		},
+	)
+	b, err := newNATSBroker(srv.url(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Publish(publishCtx(t), natsTestMsgs[:1]); err == nil {
+		t.Fatal("Publish over a closed connection succeeded")
+	}
+	if err := b.Publish(publishCtx(t), natsTestMsgs[:1]); err != nil {
+		t.Fatalf("Publish after reconnecting: %v", err)
+	}
+	srv.wait()
+}
+
+func TestNATSConnectRefusals(t *testing.T) {
+	tests := []struct {
+		name      string
+		info      string
+		jetStream bool
+		wantErr   string
+	}{
+		{name: "TLS required", info: `{"tls_required":true}`, wantErr: "requires TLS"},
+		{name: "JetStream without headers", info: `{"headers":false}`, jetStream: true, wantErr: "doesn't support headers"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := startNATSServer(t, func(c *natsConn) error {
+				return c.send("INFO " + tt.info)
+			})
+			b, err := newNATSBroker(srv.url(), tt.jetStream)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = b.Publish(publishCtx(t), natsTestMsgs[:1])
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("Publish error = %v, want %q", err, tt.wantErr)
+			}
+			srv.wait()
+		})
+	}
+}
+
+func TestNATSConnectAuthError(t *testing.T) {
+	srv := startNATSServer(t, func(c *natsConn) error {
+		if err := c.send("INFO " + natsHeaderInfo); err != nil {
+			return err
+		}
+		if _, err := c.expect("CONNECT"); err != nil {
+			return err
+		}
+		if _, err := c.expect("PING"); err != nil {
+			return err
+		}
+		return c.send("-ERR 'Authorization Violation'")
+	})
+	b, err := newNATSBroker(srv.url(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = b.Publish(publishCtx(t), natsTestMsgs[:1])
+	if err == nil || !strings.Contains(err.Error(), "Authorization Violation") {
+		t.Fatalf("Publish error = %v, want the authorization violation", err)
+	}
+	srv.wait()
+}
+
+func TestNATSMaxPayload(t *testing.T) {
+	srv := startNATSServer(t, func(c *natsConn) error {
+		_, _, err := c.handshake(`{"headers":true,"max_payload":4}`)
+		return err
+	})
+	b, err := newNATSBroker(srv.url(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = b.Publish(publishCtx(t), natsTestMsgs[:1])
+	if err == nil || !strings.Contains(err.Error(), "over the NATS server's max_payload of 4") {
+		t.Fatalf("Publish error = %v, want max_payload refusal", err)
+	}
+	srv.wait()
+}
+
+func TestNewNATSBroker(t *testing.T) {
+	tests := []struct {
+		url      string
+		addr     string
+		tls      bool
+		user     string
+		token    string
+		wantFail bool
+	}{
+		{url: "nats://nats.internal", addr: "nats.internal:4222"},
+		{url: "tls://u:p@nats.internal:7422", addr: "nats.internal:7422", tls: true, user: "u"},
+		{url: "nats://tok@nats.internal:4222", addr: "nats.internal:4222", token: "tok"},
+		{url: "http://nats.internal", wantFail: true},
+		{url: "nats://", wantFail: true},
+	}
+	for _, tt := range tests {
+		b, err := newNATSBroker(tt.url, false)
+		if tt.wantFail {
+			if err == nil {
+				t.Errorf("newNATSBroker(%q) succeeded", tt.url)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("newNATSBroker(%q): %v", tt.url, err)
+			continue
+		}
+		if b.addr != tt.addr || b.useTLS != tt.tls || b.user != tt.user || b.token != tt.token {
+			t.Errorf("newNATSBroker(%q) = addr %s tls %t user %q token %q", tt.url, b.addr, b.useTLS, b.user, b.token)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+
+	"my-kms/internal/storage"
+)
+
+// Broker publishes outbox messages to a message broker; an error means the whole batch
+// is published again.
+type Broker interface {
+	Name() string
+	Publish(ctx context.Context, msgs []storage.OutboxMessage) error
+}
+
+// NewBroker returns the broker kind names: "kafka", through the Kafka REST Proxy at
+// rawURL, or "nats", at a nats:// or tls:// URL. With jetStream, NATS publishes wait
+// for the stream's acknowledgement; without it, only for the server's.
+func NewBroker(kind, rawURL string, jetStream bool) (Broker, error) {
+	switch kind {
+	case "kafka":
+		return newKafkaBroker(rawURL)
+	case "nats":
+		return newNATSBroker(rawURL, jetStream)
+	default:
+		return nil, fmt.Errorf("unknown event broker %q, want kafka or nats", kind)
+	}
+}
+
+// OutboxStore keeps messages until they are published. It is implemented by
+// storage.MongoOutboxStore.
+type OutboxStore interface {
+	Add(ctx context.Context, msg storage.OutboxMessage) error
+	Pending(ctx context.Context, limit int) ([]storage.OutboxMessage, error)
+	MarkSent(ctx context.Context, ids []string, keep time.Duration) error
+	MarkFailed(ctx context.Context, ids []string, cause error) error
+}
+
+// Outbox publishes key lifecycle and audit events to a broker at least once. Events are
+// stored first and relayed in the order they were stored; one that was published but
+// not yet marked sent is published again, so consumers should dedupe on its id.
+type Outbox struct {
+	store      OutboxStore
+	broker     Broker
+	eventTopic string
+	auditTopic string // empty leaves audit events out
+}
+
+// NewOutbox relays lifecycle events to eventTopic and audit events to auditTopic.
+func NewOutbox(store OutboxStore, broker Broker, eventTopic, auditTopic string) (*Outbox, error) {
+	if eventTopic == "" {
+		return nil, fmt.Errorf("event broker topic is required")
+	}
+	for _, topic := range []string{eventTopic, auditTopic} {
+		if strings.ContainsAny(topic, " \t\r\n") {
+			return nil, fmt.Errorf("event broker topic %q must not contain whitespace", topic)
+		}
+	}
+	return &Outbox{store: store, broker: broker, eventTopic: eventTopic, auditTopic: auditTopic}, nil
+}
+
+// Name names the broker.
+func (o *Outbox) Name() string { return o.broker.Name() }
+
+// PublishesAudit reports whether audit events are relayed as well.
+func (o *Outbox) PublishesAudit() bool { return o.auditTopic != "" }
+
+// AddEvent stores ev for publishing. ev must have its ID and time.
+func (o *Outbox) AddEvent(ctx context.Context, ev Event) error {
+	payload, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	return o.store.Add(ctx, storage.OutboxMessage{
+		ID:        ev.ID,
+		Topic:     o.eventTopic,
+		Key:       ev.TenantID,
+		Payload:   payload,
+		CreatedAt: ev.Time,
+	})
+}
+
+// AddAudit stores an audit event for publishing, unless audit events are left out.
+func (o *Outbox) AddAudit(ctx context.Context, ev storage.AuditEvent) error {
+	if o.auditTopic == "" {
+		return nil
+	}
+	payload, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	// Stored events are named by their audit log ID, so a retried write isn't relayed twice.
+	id := "audit-" + uuid.NewString()
+	if !ev.ID.IsZero() {
+		id = "audit-" + ev.ID.Hex()
+	}
+	return o.store.Add(ctx, storage.OutboxMessage{
+		ID:        id,
+		Topic:     o.auditTopic,
+		Key:       ev.TenantID,
+		Payload:   payload,
+		CreatedAt: time.Now().UTC(),
+	})
+}
+
+// Relay publishes the oldest batchSize pending messages and keeps them for keep once
+// published. It returns how many it published.
+func (o *Outbox) Relay(ctx context.Context, batchSize int, keep time.Duration) (int, error) {
+	msgs, err := o.store.Pending(ctx, batchSize)
+	if err != nil || len(msgs) == 0 {
+		return 0, err
+	}
+	ids := make([]string, 0, len(msgs))
+	for _, msg := range msgs {
+		ids = append(ids, msg.ID)
+	}
+
+	sendCtx, cancel := context.WithTimeout(ctx, DefaultTimeout)
+	err = o.broker.Publish(sendCtx, msgs)
+	cancel()
+	if err != nil {
+		if markErr := o.store.MarkFailed(context.WithoutCancel(ctx), ids, err); markErr != nil {
+			err = fmt.Errorf("%w (%v)", err, markErr)
+		}
+		return 0, err
+	}
+	if err := o.store.MarkSent(context.WithoutCancel(ctx), ids, keep); err != nil {
+		return 0, err
+	}
+	return len(msgs), nil
+}
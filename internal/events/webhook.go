@@ -0,0 +1,90 @@
+package events
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"my-kms/internal/siem"
+)
+
+// Webhooks are signed like the SIEM audit webhook: X-KMS-Signature is sha256=<hex
+// HMAC-SHA256 of "<timestamp>.<body>"> with X-KMS-Timestamp, so receivers verify both
+// with siem.SignWebhook.
+type webhookSink struct {
+	url    string
+	secret []byte
+	client *http.Client
+}
+
+// NewWebhooks returns a sink for each https URL in urls, a comma-separated list, all
+// signing with secret.
+func NewWebhooks(urls, secret string) ([]Sink, error) {
+	client := &http.Client{Timeout: DefaultTimeout}
+	var sinks []Sink
+	for _, raw := range strings.Split(urls, ",") {
+		if raw = strings.TrimSpace(raw); raw == "" {
+			continue
+		}
+		u, err := url.Parse(raw)
+		if err != nil || u.Scheme != "https" || u.Host == "" {
+			return nil, fmt.Errorf("event webhook URL %q must be an https URL", raw)
+		}
+		if len(secret) < 16 {
+			return nil, fmt.Errorf("event webhook secret must be at least 16 characters")
+		}
+		sinks = append(sinks, &webhookSink{url: raw, secret: []byte(secret), client: client})
+	}
+	return sinks, nil
+}
+
+func (s *webhookSink) Name() string {
+	u, _ := url.Parse(s.url)
+	return "webhook:" + u.Host
+}
+
+func (s *webhookSink) Send(ctx context.Context, events []Event) error {
+	body, err := json.Marshal(struct {
+		Events []Event `json:"events"`
+	}{events})
+	if err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(siem.WebhookTimestampHeader, timestamp)
+	req.Header.Set(siem.WebhookSignatureHeader, "sha256="+siem.SignWebhook(s.secret, timestamp, body))
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("event webhook request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("event webhook %s returned %s", redactURL(s.url), resp.Status)
+	}
+	return nil
+}
+
+// redactURL strips the query, which may carry a receiver's token, from a URL for the log.
+func redactURL(raw string) string {
+	parsed, err := url.Parse(raw)
+	if err != nil {
+		return "(invalid URL)"
+	}
+	parsed.RawQuery = ""
+	return parsed.String()
+}
@@ -0,0 +1,268 @@
+// Package fieldpath selects values inside a decoded JSON document by path, for
+// encrypting individual fields in place.
+//
+// A path is a dot path such as "user.email", optionally written JSONPath-style with a
+// leading "$". Array elements are selected with [n] and every element or member with
+// [*] or *; names that are not identifiers go in brackets and quotes, as in
+// ["first name"].
+package fieldpath
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type segment struct {
+	name     string
+	index    int
+	isIndex  bool
+	wildcard bool
+}
+
+// Selector is a parsed path.
+type Selector struct {
+	raw      string
+	segments []segment
+}
+
+// String returns the path the selector was parsed from.
+func (s Selector) String() string {
+	return s.raw
+}
+
+// Parse parses a path.
+func Parse(path string) (Selector, error) {
+	sel := Selector{raw: path}
+	p := strings.TrimSpace(path)
+	if p == "$" {
+		return sel, fmt.Errorf("path %q selects the whole document", path)
+	}
+	p = strings.TrimPrefix(p, "$")
+	if p == "" {
+		return sel, fmt.Errorf("path is empty")
+	}
+	for i := 0; i < len(p); {
+		switch {
+		case p[i] == '.':
+			if i == 0 && !strings.HasPrefix(strings.TrimSpace(path), "$") {
+				return sel, fmt.Errorf("path %q cannot start with '.'", path)
+			}
+			i++
+			if i == len(p) || p[i] == '.' || p[i] == '[' {
+				return sel, fmt.Errorf("path %q has an empty segment", path)
+			}
+		case p[i] == '[':
+			end := findClose(p, i)
+			if end < 0 {
+				return sel, fmt.Errorf("path %q has an unclosed '['", path)
+			}
+			seg, err := parseBracket(p[i+1 : end])
+			if err != nil {
+				return sel, fmt.Errorf("path %q: %w", path, err)
+			}
+			sel.segments = append(sel.segments, seg)
+			i = end + 1
+			if i < len(p) && p[i] != '.' && p[i] != '[' {
+				return sel, fmt.Errorf("path %q: expected '.' or '[' after ']'", path)
+			}
+		default:
+			j := i
+			for j < len(p) && p[j] != '.' && p[j] != '[' {
+				j++
+			}
+			name := p[i:j]
+			if name == "*" {
+				sel.segments = append(sel.segments, segment{wildcard: true})
+			} else {
+				sel.segments = append(sel.segments, segment{name: name})
+			}
+			i = j
+		}
+	}
+	if len(sel.segments) == 0 {
+		return sel, fmt.Errorf("path %q selects nothing", path)
+	}
+	return sel, nil
+}
+
+// findClose returns the index of the ']' closing the '[' at open, skipping quoted text.
+func findClose(p string, open int) int {
+	var quote byte
+	for i := open + 1; i < len(p); i++ {
+		switch c := p[i]; {
+		case quote != 0:
+			if c == '\\' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == ']':
+			return i
+		}
+	}
+	return -1
+}
+
+func parseBracket(inner string) (segment, error) {
+	inner = strings.TrimSpace(inner)
+	switch {
+	case inner == "*":
+		return segment{wildcard: true}, nil
+	case len(inner) >= 2 && (inner[0] == '"' || inner[0] == '\'') && inner[len(inner)-1] == inner[0]:
+		if inner[0] == '\'' {
+			// Single-quoted names are taken literally.
+			return segment{name: inner[1 : len(inner)-1]}, nil
+		}
+		name, err := strconv.Unquote(inner)
+		if err != nil {
+			return segment{}, fmt.Errorf("invalid quoted name [%s]", inner)
+		}
+		return segment{name: name}, nil
+	default:
+		n, err := strconv.Atoi(inner)
+		if err != nil || n < 0 {
+			return segment{}, fmt.Errorf("invalid index [%s]; expected a non-negative integer, * or a quoted name", inner)
+		}
+		return segment{index: n, isIndex: true}, nil
+	}
+}
+
+// Match is one value a selector reached.
+type Match struct {
+	Path  string // concrete path, e.g. $.cards[2].number
+	Field string // the innermost member name on the path, "" if there is none
+	Value interface{}
+}
+
+// Replace calls fn for every value sel matches in doc, a document decoded by
+// encoding/json, and stores what fn returns in its place. Parts of the path that are
+// missing in doc match nothing. It returns the concrete paths replaced.
+func Replace(doc interface{}, sel Selector, fn func(Match) (interface{}, bool, error)) ([]string, error) {
+	var replaced []string
+	err := walk(doc, sel.segments, "$", "", func(m Match, set func(interface{})) error {
+		v, ok, err := fn(m)
+		if err != nil {
+			return fmt.Errorf("%s: %w", m.Path, err)
+		}
+		if ok {
+			set(v)
+			replaced = append(replaced, m.Path)
+		}
+		return nil
+	})
+	return replaced, err
+}
+
+func walk(node interface{}, segs []segment, path, field string, visit func(Match, func(interface{})) error) error {
+	seg, rest := segs[0], segs[1:]
+	step := func(child interface{}, childPath, childField string, set func(interface{})) error {
+		if len(rest) == 0 {
+			return visit(Match{Path: childPath, Field: childField, Value: child}, set)
+		}
+		return walk(child, rest, childPath, childField, visit)
+	}
+
+	switch n := node.(type) {
+	case map[string]interface{}:
+		if seg.isIndex {
+			return nil
+		}
+		if seg.wildcard {
+			for _, k := range sortedMemberNames(n) {
+				if err := step(n[k], joinName(path, k), k, func(v interface{}) { n[k] = v }); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		child, ok := n[seg.name]
+		if !ok {
+			return nil
+		}
+		return step(child, joinName(path, seg.name), seg.name, func(v interface{}) { n[seg.name] = v })
+	case []interface{}:
+		if seg.wildcard {
+			for i := range n {
+				if err := step(n[i], path+"["+strconv.Itoa(i)+"]", field, func(v interface{}) { n[i] = v }); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		if !seg.isIndex || seg.index >= len(n) {
+			return nil
+		}
+		i := seg.index
+		return step(n[i], path+"["+strconv.Itoa(i)+"]", field, func(v interface{}) { n[i] = v })
+	}
+	return nil
+}
+
+// Walk calls fn for every string in doc, for finding encrypted fields without a path.
+func Walk(doc interface{}, fn func(Match) (interface{}, bool, error)) ([]string, error) {
+	var replaced []string
+	var visit func(node interface{}, path, field string, set func(interface{})) error
+	visit = func(node interface{}, path, field string, set func(interface{})) error {
+		switch n := node.(type) {
+		case map[string]interface{}:
+			for _, k := range sortedMemberNames(n) {
+				if err := visit(n[k], joinName(path, k), k, func(v interface{}) { n[k] = v }); err != nil {
+					return err
+				}
+			}
+		case []interface{}:
+			for i := range n {
+				if err := visit(n[i], path+"["+strconv.Itoa(i)+"]", field, func(v interface{}) { n[i] = v }); err != nil {
+					return err
+				}
+			}
+		case string:
+			v, ok, err := fn(Match{Path: path, Field: field, Value: n})
+			if err != nil {
+				return fmt.Errorf("%s: %w", path, err)
+			}
+			if ok {
+				set(v)
+				replaced = append(replaced, path)
+			}
+		}
+		return nil
+	}
+	err := visit(doc, "$", "", func(interface{}) {})
+	return replaced, err
+}
+
+// sortedMemberNames keeps the order of matches, and so of error messages and field
+// lists, stable.
+func sortedMemberNames(m map[string]interface{}) []string {
+	names := make([]string, 0, len(m))
+	for k := range m {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// joinName appends a member name to path, bracketing names that are not identifiers.
+func joinName(path, name string) string {
+	if isIdentifier(name) {
+		return path + "." + name
+	}
+	return path + "[" + strconv.Quote(name) + "]"
+}
+
+func isIdentifier(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i, c := range s {
+		if !(c == '_' || c == '-' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || i > 0 && c >= '0' && c <= '9') {
+			return false
+		}
+	}
+	return s != "*"
+}
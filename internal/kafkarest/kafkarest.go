@@ -0,0 +1,83 @@
+// Package kafkarest produces records through the Kafka REST Proxy v2 API, which keeps a
+// Kafka client library out of the server. The SIEM Kafka sink and the event outbox's
+// Kafka broker both produce through it.
+package kafkarest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Record is one Kafka record. Value is encoded as JSON; a json.RawMessage goes out as is.
+type Record struct {
+	Key   string `json:"key,omitempty"`
+	Value any    `json:"value"`
+}
+
+// Producer posts records to the topics of one REST Proxy.
+type Producer struct {
+	endpoint string
+	client   *http.Client
+}
+
+// NewProducer returns a Producer for the REST Proxy at restURL that sends with client.
+func NewProducer(restURL string, client *http.Client) (*Producer, error) {
+	u, err := url.Parse(restURL)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return nil, fmt.Errorf("Kafka REST Proxy URL must be an http(s) URL")
+	}
+	return &Producer{
+		endpoint: strings.TrimRight(restURL, "/") + "/topics/",
+		client:   client,
+	}, nil
+}
+
+// Produce posts records to topic in one request. It fails when any record was
+// rejected, so the caller sends the whole batch again.
+func (p *Producer) Produce(ctx context.Context, topic string, records []Record) error {
+	body, err := json.Marshal(struct {
+		Records []Record `json:"records"`
+	}{records})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.endpoint+url.PathEscape(topic), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/vnd.kafka.json.v2+json")
+	req.Header.Set("Accept", "application/vnd.kafka.v2+json")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("Kafka REST Proxy request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+		return fmt.Errorf("Kafka REST Proxy returned %s for topic %s", resp.Status, topic)
+	}
+
+	// The proxy answers 200 even when individual records fail.
+	var out struct {
+		Offsets []struct {
+			Error string `json:"error"`
+		} `json:"offsets"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&out); err != nil {
+		return fmt.Errorf("failed to decode Kafka REST Proxy response: %w", err)
+	}
+	for _, o := range out.Offsets {
+		if o.Error != "" {
+			return fmt.Errorf("Kafka REST Proxy rejected a record for topic %s: %s", topic, o.Error)
+		}
+	}
+	return nil
+}
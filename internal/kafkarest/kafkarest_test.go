@@ -0,0 +1,67 @@
+package kafkarest
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestProduce(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  int
+		body    string
+		wantErr string
+	}{
+		{name: "accepted", status: http.StatusOK, body: `{"offsets":[{"partition":0,"offset":1},{"partition":0,"offset":2}]}`},
+		{name: "record rejected", status: http.StatusOK, body: `{"offsets":[{"offset":1},{"error":"record too large"}]}`, wantErr: "rejected a record for topic kms events: record too large"},
+		{name: "proxy error", status: http.StatusInternalServerError, body: `{"error_code":50001}`, wantErr: "returned 500 Internal Server Error for topic kms events"},
+		{name: "undecodable answer", status: http.StatusOK, body: `<html>`, wantErr: "failed to decode"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.EscapedPath() != "/v3/topics/kms%20events" || r.Header.Get("Content-Type") != "application/vnd.kafka.json.v2+json" {
+					t.Errorf("request to %s with Content-Type %q", r.URL.EscapedPath(), r.Header.Get("Content-Type"))
+				}
+				body, _ := io.ReadAll(r.Body)
+				if got, want := string(body), `{"records":[{"key":"acme","value":{"n":1}},{"value":"raw"}]}`; got != want {
+					t.Errorf("body %s, want %s", got, want)
+				}
+				w.WriteHeader(tt.status)
+				io.WriteString(w, tt.body)
+			}))
+			defer srv.Close()
+
+			p, err := NewProducer(srv.URL+"/v3/", srv.Client())
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = p.Produce(context.Background(), "kms events", []Record{
+				{Key: "acme", Value: map[string]int{"n": 1}},
+				{Value: json.RawMessage(`"raw"`)},
+			})
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("Produce: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("Produce error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestNewProducerURL(t *testing.T) {
+	for _, u := range []string{"", "kafka:9092", "ftp://proxy", "https://"} {
+		if _, err := NewProducer(u, http.DefaultClient); err == nil {
+			t.Errorf("NewProducer(%q) succeeded", u)
+		}
+	}
+}
@@ -0,0 +1,207 @@
+// Package logging configures the process-wide structured logger. Every record passes
+// through a redaction layer, so key material, tokens and plaintext that end up in a
+// message by accident (a formatted []byte, an error quoting its input) are masked
+// before they are written.
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// level is the minimum level logged, changed by SetLevel without replacing the handler.
+var level slog.LevelVar
+
+// Setup makes a JSON (or, for local use, text) logger at level the default for both
+// log/slog and the standard log package.
+func Setup(w io.Writer, lvl, format string) error {
+	if err := SetLevel(lvl); err != nil {
+		return err
+	}
+	opts := &slog.HandlerOptions{Level: &level}
+
+	var h slog.Handler
+	switch strings.ToLower(format) {
+	case "json", "":
+		h = slog.NewJSONHandler(w, opts)
+	case "text":
+		h = slog.NewTextHandler(w, opts)
+	default:
+		return fmt.Errorf("invalid LOG_FORMAT %q; expected json or text", format)
+	}
+	// Lines still written with the log package come out at info through the same handler.
+	slog.SetDefault(slog.New(&redactingHandler{h}))
+	return nil
+}
+
+// SetLevel changes the minimum level logged, for every logger already handed out too.
+func SetLevel(lvl string) error {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(lvl)); err != nil {
+		return fmt.Errorf("invalid LOG_LEVEL %q; expected debug, info, warn or error", lvl)
+	}
+	level.Set(l)
+	return nil
+}
+
+// Logger returns the default logger tagged with component.
+func Logger(component string) *slog.Logger {
+	return slog.Default().With("component", component)
+}
+
+// Logf formats a message and logs it for component at level, redacting the arguments.
+func Logf(ctx context.Context, level slog.Level, component string, attrs []slog.Attr, format string, args ...interface{}) {
+	l := slog.Default()
+	if !l.Enabled(ctx, level) {
+		return
+	}
+	attrs = append([]slog.Attr{slog.String("component", component)}, attrs...)
+	l.LogAttrs(ctx, level, fmt.Sprintf(format, RedactArgs(args)...), attrs...)
+}
+
+// Infof, Warnf and Errorf log for component outside any request.
+func Infof(component, format string, args ...interface{}) {
+	Logf(context.Background(), slog.LevelInfo, component, nil, format, args...)
+}
+
+func Warnf(component, format string, args ...interface{}) {
+	Logf(context.Background(), slog.LevelWarn, component, nil, format, args...)
+}
+
+func Errorf(component, format string, args ...interface{}) {
+	Logf(context.Background(), slog.LevelError, component, nil, format, args...)
+}
+
+// Fatalf logs at error level for the main component and exits.
+func Fatalf(format string, args ...interface{}) {
+	Logf(context.Background(), slog.LevelError, "main", nil, format, args...)
+	os.Exit(1)
+}
+
+// ---------------------------------------------------------------------
+// Redaction
+// ---------------------------------------------------------------------
+
+// Redacted replaces anything the redaction layer masks.
+const Redacted = "[REDACTED]"
+
+// sensitiveKeys are attribute names whose values are never logged.
+var sensitiveKeys = []string{"key", "dek", "plaintext", "secret", "token", "password", "credential", "material", "authorization", "seed"}
+
+// safeKeys are attribute names that look sensitive but hold identifiers.
+var safeKeys = map[string]bool{"component": true, "request_id": true, "trace_id": true, "span_id": true, "key_id": true, "dek_id": true}
+
+// secretPatterns catch secrets inside free text. The length floors keep identifiers
+// (ObjectIDs, UUIDs, Firebase UIDs) readable: a 32-byte key is 44 base64 or 64 hex
+// characters, well above them.
+var secretPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`-----BEGIN [A-Z ]*PRIVATE KEY-----[\s\S]*?(-----END [A-Z ]*PRIVATE KEY-----|$)`),
+	regexp.MustCompile(`(?i)\bbearer\s+[A-Za-z0-9._~+/=-]+`),
+	regexp.MustCompile(`\beyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+(\.[A-Za-z0-9_-]*)?`), // JWTs
+	regexp.MustCompile(`\bkms_[A-Za-z0-9]+_[A-Za-z0-9_-]+`),                      // API keys (kms_<prefix>_<secret>)
+	regexp.MustCompile(`[A-Za-z0-9+/_-]{40,}={0,2}`),                             // base64
+	regexp.MustCompile(`\b[0-9a-fA-F]{64,}\b`),                                   // hex
+}
+
+// Redact masks secrets in free text.
+func Redact(s string) string {
+	for _, re := range secretPatterns {
+		s = re.ReplaceAllString(s, Redacted)
+	}
+	return s
+}
+
+// RedactArgs masks byte slices, which in this server are key material, DEKs or
+// payloads, before they reach a format string.
+func RedactArgs(args []interface{}) []interface{} {
+	var out []interface{}
+	for i, a := range args {
+		if _, ok := a.([]byte); ok {
+			if out == nil {
+				out = append([]interface{}(nil), args...)
+			}
+			out[i] = Redacted
+		}
+	}
+	if out == nil {
+		return args
+	}
+	return out
+}
+
+func sensitiveKey(key string) bool {
+	k := strings.ToLower(key)
+	if safeKeys[k] {
+		return false
+	}
+	for _, s := range sensitiveKeys {
+		if strings.Contains(k, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func redactAttr(a slog.Attr) slog.Attr {
+	if sensitiveKey(a.Key) {
+		return slog.String(a.Key, Redacted)
+	}
+	v := a.Value.Resolve()
+	switch v.Kind() {
+	case slog.KindString:
+		return slog.String(a.Key, Redact(v.String()))
+	case slog.KindGroup:
+		group := v.Group()
+		out := make([]slog.Attr, len(group))
+		for i, g := range group {
+			out[i] = redactAttr(g)
+		}
+		return slog.Attr{Key: a.Key, Value: slog.GroupValue(out...)}
+	case slog.KindAny:
+		switch x := v.Any().(type) {
+		case []byte:
+			return slog.String(a.Key, Redacted)
+		case error:
+			return slog.String(a.Key, Redact(x.Error()))
+		case fmt.Stringer:
+			return slog.String(a.Key, Redact(x.String()))
+		}
+		return slog.String(a.Key, Redact(fmt.Sprint(v.Any())))
+	}
+	return slog.Attr{Key: a.Key, Value: v}
+}
+
+// redactingHandler masks the message and every attribute before handing the record on.
+type redactingHandler struct {
+	next slog.Handler
+}
+
+func (h *redactingHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.next.Enabled(ctx, level)
+}
+
+func (h *redactingHandler) Handle(ctx context.Context, r slog.Record) error {
+	out := slog.NewRecord(r.Time, r.Level, Redact(r.Message), r.PC)
+	r.Attrs(func(a slog.Attr) bool {
+		out.AddAttrs(redactAttr(a))
+		return true
+	})
+	return h.next.Handle(ctx, out)
+}
+
+func (h *redactingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	out := make([]slog.Attr, len(attrs))
+	for i, a := range attrs {
+		out[i] = redactAttr(a)
+	}
+	return &redactingHandler{h.next.WithAttrs(out)}
+}
+
+func (h *redactingHandler) WithGroup(name string) slog.Handler {
+	return &redactingHandler{h.next.WithGroup(name)}
+}
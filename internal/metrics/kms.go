@@ -0,0 +1,40 @@
+package metrics
+
+// The server's metrics. Label values come from bounded sets (route patterns, operation
+// names, status codes), never from request data, to keep cardinality fixed.
+var (
+	HTTPRequests = NewCounterVec("kms_http_requests_total",
+		"HTTP requests by route pattern and status code.", "endpoint", "code")
+	HTTPDuration = NewHistogramVec("kms_http_request_duration_seconds",
+		"HTTP request latency by route pattern.", DefaultLatencyBuckets, "endpoint")
+	AuthFailures = NewCounterVec("kms_auth_failures_total",
+		"Requests rejected as unauthenticated (401) or forbidden (403), by route pattern.", "endpoint", "reason")
+	CryptoDuration = NewHistogramVec("kms_crypto_operation_duration_seconds",
+		"Latency of encrypt and decrypt operations on payloads, excluding DEK lookup.", DefaultLatencyBuckets, "operation", "algorithm")
+	DEKCacheLookups = NewCounterVec("kms_dek_cache_lookups_total",
+		"DEK cache lookups by result (hit or miss).", "result")
+	UserCacheLookups = NewCounterVec("kms_user_cache_lookups_total",
+		"User role lookups by result (hit or miss) while USER_CACHE_TTL is set.", "result")
+	RateLimited = NewCounterVec("kms_rate_limited_total",
+		"Requests rejected with 429, by route pattern and limit scope (ip or identity).", "endpoint", "scope")
+	LoadShed = NewCounterVec("kms_load_shed_total",
+		"Requests rejected with 503 by an endpoint's concurrency limit, by route pattern and reason (queue_full or queue_timeout).", "endpoint", "reason")
+	QuotaExceeded = NewCounterVec("kms_quota_exceeded_total",
+		"Operations refused for exceeding a quota, by operation, scope (key or identity) and period.", "operation", "scope", "period")
+	LegacyRouteRequests = NewCounterVec("kms_legacy_route_requests_total",
+		"Requests to deprecated unversioned paths, by route pattern.", "endpoint")
+	DEKsRewrapped = NewCounterVec("kms_deks_rewrapped_total",
+		"DEKs moved onto the active master key by the rotation schedule, by result (rewrapped or failed).", "result")
+	MongoErrors = NewCounterVec("kms_mongo_errors_total",
+		"Failed MongoDB commands by command name.", "command")
+	MongoRetries = NewCounterVec("kms_mongo_retries_total",
+		"User and DEK store calls retried after a transient MongoDB failure, by store method.", "operation")
+	DEKReplicationChanges = NewCounterVec("kms_dek_replication_changes_total",
+		"DEK changes replicated to the other region, by result (applied, skipped or conflict).", "result")
+	DEKReplicationLag = NewHistogramVec("kms_dek_replication_lag_seconds",
+		"Seconds between a DEK change and its replication to the other region.", []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 300})
+	DEKReplicaReads = NewCounterVec("kms_dek_replica_reads_total",
+		"DEKs read from the other region's cluster, by why the local read failed (not_found or error).", "reason")
+	EncryptionLimitReached = NewCounterVec("kms_encryption_limit_reached_total",
+		"Encryptions and wraps refused because a GCM key used up its nonce budget, by key type (dek or master).", "key_type")
+)
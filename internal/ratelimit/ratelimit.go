@@ -0,0 +1,160 @@
+// Package ratelimit implements token-bucket rate limiting, in process memory for a
+// single instance or in Redis when several instances must share the budget.
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Limit is a token bucket: Rate tokens per second are added, up to Burst. The zero
+// Limit is unlimited.
+type Limit struct {
+	Rate  float64
+	Burst int
+}
+
+// Unlimited reports whether l places no limit.
+func (l Limit) Unlimited() bool {
+	return l.Rate <= 0
+}
+
+// String renders l in the form ParseLimit reads.
+func (l Limit) String() string {
+	if l.Unlimited() {
+		return "off"
+	}
+	return strconv.FormatFloat(l.Rate, 'g', -1, 64) + "/s:" + strconv.Itoa(l.Burst)
+}
+
+// ParseLimit reads "N/unit[:burst]", where unit is s, m or h, or "off". The burst
+// defaults to N, so "600/m" allows 600 requests at once and then 10 a second.
+func ParseLimit(s string) (Limit, error) {
+	s = strings.TrimSpace(s)
+	if s == "" || s == "off" {
+		return Limit{}, nil
+	}
+	spec, burstStr, hasBurst := strings.Cut(s, ":")
+	countStr, unit, ok := strings.Cut(spec, "/")
+	if !ok {
+		return Limit{}, fmt.Errorf("invalid rate limit %q; expected N/s, N/m or N/h with an optional :burst", s)
+	}
+	count, err := strconv.ParseFloat(countStr, 64)
+	if err != nil || count <= 0 || math.IsInf(count, 0) {
+		return Limit{}, fmt.Errorf("invalid rate limit %q: count must be a positive number", s)
+	}
+	var per time.Duration
+	switch unit {
+	case "s":
+		per = time.Second
+	case "m":
+		per = time.Minute
+	case "h":
+		per = time.Hour
+	default:
+		return Limit{}, fmt.Errorf("invalid rate limit %q: unit must be s, m or h", s)
+	}
+	l := Limit{Rate: count / per.Seconds(), Burst: int(math.Ceil(count))}
+	if hasBurst {
+		if l.Burst, err = strconv.Atoi(burstStr); err != nil || l.Burst < 1 {
+			return Limit{}, fmt.Errorf("invalid rate limit %q: burst must be a positive integer", s)
+		}
+	}
+	return l, nil
+}
+
+// ParseEndpointLimits reads "path=limit" pairs separated by commas, such as
+// "/decrypt=10/s:20,/encrypt=50/s".
+func ParseEndpointLimits(s string) (map[string]Limit, error) {
+	limits := map[string]Limit{}
+	for _, pair := range strings.Split(s, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		path, spec, ok := strings.Cut(pair, "=")
+		path = strings.TrimSpace(path)
+		if !ok || !strings.HasPrefix(path, "/") {
+			return nil, fmt.Errorf("invalid endpoint rate limit %q; expected /path=limit", pair)
+		}
+		l, err := ParseLimit(spec)
+		if err != nil {
+			return nil, fmt.Errorf("endpoint %s: %w", path, err)
+		}
+		limits[path] = l
+	}
+	return limits, nil
+}
+
+// Limiter takes a token from the bucket at key. When none is left it returns false and
+// how long until one will be.
+type Limiter interface {
+	Allow(ctx context.Context, key string, l Limit) (bool, time.Duration, error)
+}
+
+// ---------------------------------------------------------------------
+// In-memory Limiter
+// ---------------------------------------------------------------------
+
+// sweepInterval is how often idle buckets are dropped from a Memory limiter.
+const sweepInterval = time.Minute
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+	limit  Limit
+}
+
+// Memory keeps buckets in process memory. Buckets that have refilled completely are
+// indistinguishable from new ones and are swept away, so memory follows the number of
+// recently active keys.
+type Memory struct {
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+// NewMemory returns an empty in-memory limiter.
+func NewMemory() *Memory {
+	return &Memory{buckets: map[string]*bucket{}, lastSweep: time.Now()}
+}
+
+func (m *Memory) Allow(_ context.Context, key string, l Limit) (bool, time.Duration, error) {
+	if l.Unlimited() {
+		return true, 0, nil
+	}
+	now := time.Now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if now.Sub(m.lastSweep) >= sweepInterval {
+		for k, b := range m.buckets {
+			if b.refill(now) >= float64(b.limit.Burst) {
+				delete(m.buckets, k)
+			}
+		}
+		m.lastSweep = now
+	}
+
+	b := m.buckets[key]
+	if b == nil || b.limit != l {
+		b = &bucket{tokens: float64(l.Burst), last: now, limit: l}
+		m.buckets[key] = b
+	}
+	b.tokens = b.refill(now)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0, nil
+	}
+	return false, time.Duration((1 - b.tokens) / l.Rate * float64(time.Second)), nil
+}
+
+// refill returns the tokens in b at now.
+func (b *bucket) refill(now time.Time) float64 {
+	return math.Min(float64(b.limit.Burst), b.tokens+now.Sub(b.last).Seconds()*b.limit.Rate)
+}
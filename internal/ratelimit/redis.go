@@ -0,0 +1,81 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// keyPrefix namespaces the limiter's keys in a shared Redis.
+const keyPrefix = "kms:ratelimit:"
+
+// takeScript refills and takes from a bucket atomically, on Redis's clock so instances
+// with skewed clocks still agree. It returns {allowed, milliseconds until a token}.
+var takeScript = redis.NewScript(`
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local t = redis.call('TIME')
+local now = tonumber(t[1]) + tonumber(t[2]) / 1000000
+local b = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+local tokens = tonumber(b[1]) or burst
+local ts = tonumber(b[2]) or now
+tokens = math.min(burst, tokens + math.max(0, now - ts) * rate)
+local allowed, wait = 0, 0
+if tokens >= 1 then
+  tokens = tokens - 1
+  allowed = 1
+else
+  wait = math.ceil((1 - tokens) / rate * 1000)
+end
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'ts', tostring(now))
+redis.call('PEXPIRE', KEYS[1], math.ceil(burst / rate * 1000) + 1000)
+return {allowed, wait}
+`)
+
+// Redis keeps buckets in Redis so every instance draws from the same budget. Keys
+// expire once their bucket would have refilled.
+type Redis struct {
+	client *redis.Client
+}
+
+// NewRedis connects to the Redis server at url (redis:// or rediss://).
+func NewRedis(url string) (*Redis, error) {
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Redis URL: %w", err)
+	}
+	client := redis.NewClient(opts)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("failed to connect to Redis: %w", err)
+	}
+	return &Redis{client: client}, nil
+}
+
+func (r *Redis) Allow(ctx context.Context, key string, l Limit) (bool, time.Duration, error) {
+	if l.Unlimited() {
+		return true, 0, nil
+	}
+	res, err := takeScript.Run(ctx, r.client, []string{keyPrefix + key}, l.Rate, l.Burst).Int64Slice()
+	if err != nil {
+		return false, 0, fmt.Errorf("failed to take rate limit token: %w", err)
+	}
+	if len(res) != 2 {
+		return false, 0, fmt.Errorf("failed to take rate limit token: unexpected reply %v", res)
+	}
+	return res[0] == 1, time.Duration(res[1]) * time.Millisecond, nil
+}
+
+// Ping checks the connection to Redis.
+func (r *Redis) Ping(ctx context.Context) error {
+	return r.client.Ping(ctx).Err()
+}
+
+// Close closes the connection pool.
+func (r *Redis) Close() error {
+	return r.client.Close()
+}
@@ -0,0 +1,187 @@
+package seal
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	secretmanager "google.golang.org/api/secretmanager/v1"
+)
+
+// FetchKEK reads the 32-byte key-encryption key named by source:
+//
+//	file:/run/secrets/kms-kek
+//	aws-secretsmanager:<secret name or ARN>
+//	gcp-secretmanager:projects/<p>/secrets/<s>/versions/<v>
+//
+// The secret holds the key raw or in base64. AWS credentials and region come from the
+// standard AWS_* environment variables; GCP uses Application Default Credentials.
+func FetchKEK(ctx context.Context, source string) ([]byte, error) {
+	scheme, ref, ok := strings.Cut(source, ":")
+	if !ok || ref == "" {
+		return nil, fmt.Errorf("invalid KEK source %q; expected file:, aws-secretsmanager: or gcp-secretmanager:", source)
+	}
+	var secret []byte
+	var err error
+	switch scheme {
+	case "file":
+		secret, err = os.ReadFile(ref)
+	case "aws-secretsmanager":
+		secret, err = fetchAWSSecret(ctx, ref)
+	case "gcp-secretmanager":
+		secret, err = fetchGCPSecret(ctx, ref)
+	default:
+		return nil, fmt.Errorf("unknown KEK source %q", scheme)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch KEK from %s: %w", scheme, err)
+	}
+	defer clear(secret)
+	return decodeKEK(secret)
+}
+
+func decodeKEK(secret []byte) ([]byte, error) {
+	if len(secret) == 32 {
+		return bytes.Clone(secret), nil
+	}
+	kek, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(secret)))
+	if err != nil || len(kek) != 32 {
+		return nil, errors.New("KEK must be 32 bytes, raw or base64")
+	}
+	return kek, nil
+}
+
+func fetchGCPSecret(ctx context.Context, name string) ([]byte, error) {
+	svc, err := secretmanager.NewService(ctx)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := svc.Projects.Secrets.Versions.Access(name).Context(ctx).Do()
+	if err != nil {
+		return nil, err
+	}
+	if resp.Payload == nil {
+		return nil, errors.New("secret version has no payload")
+	}
+	return base64.StdEncoding.DecodeString(resp.Payload.Data)
+}
+
+// fetchAWSSecret calls GetSecretValue, signed with Signature Version 4.
+func fetchAWSSecret(ctx context.Context, secretID string) ([]byte, error) {
+	accessKey, secretKey := os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY")
+	if accessKey == "" || secretKey == "" {
+		return nil, errors.New("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set")
+	}
+	region := os.Getenv("AWS_REGION")
+	if region == "" {
+		region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	if region == "" {
+		return nil, errors.New("AWS_REGION must be set")
+	}
+	// A secret ARN names its region; the call must go there.
+	if arn := strings.Split(secretID, ":"); len(arn) > 3 && arn[0] == "arn" {
+		region = arn[3]
+	}
+
+	body, err := json.Marshal(map[string]string{"SecretId": secretID})
+	if err != nil {
+		return nil, err
+	}
+	host := "secretsmanager." + region + ".amazonaws.com"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "https://"+host+"/", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "secretsmanager.GetSecretValue")
+	if token := os.Getenv("AWS_SESSION_TOKEN"); token != "" {
+		req.Header.Set("X-Amz-Security-Token", token)
+	}
+	signAWSRequest(req, host, region, "secretsmanager", accessKey, secretKey, body, time.Now().UTC())
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GetSecretValue returned %s: %s", resp.Status, bytes.TrimSpace(data))
+	}
+	var out struct {
+		SecretString string `json:"SecretString"`
+		SecretBinary []byte `json:"SecretBinary"`
+	}
+	if err := json.Unmarshal(data, &out); err != nil {
+		return nil, fmt.Errorf("failed to decode GetSecretValue response: %w", err)
+	}
+	clear(data)
+	if out.SecretBinary != nil {
+		return out.SecretBinary, nil
+	}
+	return []byte(out.SecretString), nil
+}
+
+// signAWSRequest adds the X-Amz-Date and Authorization headers. Only host, the
+// content type, the target and the date are signed, which is all GetSecretValue needs.
+func signAWSRequest(req *http.Request, host, region, service, accessKey, secretKey string, body []byte, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+
+	headers := map[string]string{
+		"content-type": req.Header.Get("Content-Type"),
+		"host":         host,
+		"x-amz-date":   amzDate,
+		"x-amz-target": req.Header.Get("X-Amz-Target"),
+	}
+	if token := req.Header.Get("X-Amz-Security-Token"); token != "" {
+		headers["x-amz-security-token"] = token
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	payloadHash := sha256.Sum256(body)
+	canonical := strings.Join([]string{"POST", "/", "", canonicalHeaders.String(), signedHeaders, hex.EncodeToString(payloadHash[:])}, "\n")
+	canonicalHash := sha256.Sum256([]byte(canonical))
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), []byte(date))
+	for _, part := range []string{region, service, "aws4_request"} {
+		key = hmacSHA256(key, []byte(part))
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, []byte(stringToSign)))
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+accessKey+"/"+scope+", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func hmacSHA256(key, data []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
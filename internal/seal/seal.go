@@ -0,0 +1,426 @@
+// Package seal keeps the master keys in a keyring file encrypted under a root key. The
+// root key either exists only as Shamir shares, in which case the server starts sealed
+// and takes the shares one at a time until a threshold of them rebuilds it, or is a
+// key-encryption key (KEK) fetched at startup from a file or a cloud secret manager.
+package seal
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"my-kms/internal/secmem"
+	"my-kms/internal/storage"
+)
+
+const keyringVersion = 1
+
+// Root key kinds, as recorded in the keyring.
+const (
+	TypeShamir = "shamir"
+	TypeKEK    = "kek"
+)
+
+// ErrUnsealed is returned for shares submitted once the server is already unsealed.
+var ErrUnsealed = errors.New("the KMS is already unsealed")
+
+// keyringFile is the on-disk keyring. Ciphertext is the nonce followed by the
+// AES-256-GCM sealed JSON of the master keys, active key first.
+type keyringFile struct {
+	Version    int    `json:"version"`
+	Type       string `json:"type,omitempty"` // TypeShamir when empty
+	Shares     int    `json:"shares,omitempty"`
+	Threshold  int    `json:"threshold,omitempty"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+type keyringEntry struct {
+	ID         string            `json:"id"`
+	Key        []byte            `json:"key,omitempty"`     // absent once retired
+	KEMSeed    []byte            `json:"kemSeed,omitempty"` // ML-KEM-768 seed of a hybrid key
+	CreatedAt  *time.Time        `json:"createdAt,omitempty"`
+	RetiredAt  *time.Time        `json:"retiredAt,omitempty"`
+	VerifyKeys map[string][]byte `json:"verifyKeys,omitempty"`
+}
+
+func timePtr(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+func timeOrZero(t *time.Time) time.Time {
+	if t == nil {
+		return time.Time{}
+	}
+	return *t
+}
+
+func (f *keyringFile) aad() []byte {
+	if f.Type == TypeKEK {
+		return []byte("kms-keyring|" + strconv.Itoa(f.Version) + "|" + TypeKEK)
+	}
+	return []byte("kms-keyring|" + strconv.Itoa(f.Version) + "|" + strconv.Itoa(f.Shares) + "|" + strconv.Itoa(f.Threshold))
+}
+
+func newGCM(root []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(root)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts keys under root into f.Ciphertext.
+func (f *keyringFile) seal(root []byte, keys []storage.MasterKey) error {
+	entries := make([]keyringEntry, len(keys))
+	for i, k := range keys {
+		entries[i] = keyringEntry{ID: k.ID, Key: k.Key, KEMSeed: k.KEMSeed, CreatedAt: timePtr(k.CreatedAt), RetiredAt: timePtr(k.RetiredAt)}
+		for purpose, pub := range k.VerifyKeys {
+			if entries[i].VerifyKeys == nil {
+				entries[i].VerifyKeys = make(map[string][]byte)
+			}
+			entries[i].VerifyKeys[purpose] = pub
+		}
+	}
+	plaintext, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	defer clear(plaintext)
+	gcm, err := newGCM(root)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	f.Ciphertext = gcm.Seal(nonce, nonce, plaintext, f.aad())
+	return nil
+}
+
+// open decrypts the master keys with root.
+func (f *keyringFile) open(root []byte) ([]storage.MasterKey, error) {
+	gcm, err := newGCM(root)
+	if err != nil {
+		return nil, err
+	}
+	if len(f.Ciphertext) < gcm.NonceSize() {
+		return nil, errors.New("keyring is truncated")
+	}
+	plaintext, err := gcm.Open(nil, f.Ciphertext[:gcm.NonceSize()], f.Ciphertext[gcm.NonceSize():], f.aad())
+	if err != nil {
+		return nil, err
+	}
+	defer clear(plaintext)
+	var entries []keyringEntry
+	if err := json.Unmarshal(plaintext, &entries); err != nil {
+		return nil, fmt.Errorf("failed to decode keyring: %w", err)
+	}
+	keys := make([]storage.MasterKey, len(entries))
+	for i, e := range entries {
+		keys[i] = storage.MasterKey{ID: e.ID, Key: e.Key, KEMSeed: e.KEMSeed, CreatedAt: timeOrZero(e.CreatedAt), RetiredAt: timeOrZero(e.RetiredAt)}
+		for purpose, pub := range e.VerifyKeys {
+			if len(pub) != ed25519.PublicKeySize {
+				return nil, fmt.Errorf("keyring holds an invalid verify key for master key %s", e.ID)
+			}
+			if keys[i].VerifyKeys == nil {
+				keys[i].VerifyKeys = make(map[string]ed25519.PublicKey)
+			}
+			keys[i].VerifyKeys[purpose] = pub
+		}
+	}
+	return keys, nil
+}
+
+// write replaces the keyring file at path atomically.
+func (f *keyringFile) write(path string) error {
+	data, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func readKeyring(path string) (*keyringFile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read keyring: %w", err)
+	}
+	var f keyringFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("failed to parse keyring %s: %w", path, err)
+	}
+	if f.Version != keyringVersion {
+		return nil, fmt.Errorf("unsupported keyring version %d", f.Version)
+	}
+	switch f.Type {
+	case "", TypeShamir:
+		f.Type = TypeShamir
+		if f.Threshold < 2 || f.Shares < f.Threshold {
+			return nil, fmt.Errorf("keyring %s has an invalid threshold of %d of %d", path, f.Threshold, f.Shares)
+		}
+	case TypeKEK:
+	default:
+		return nil, fmt.Errorf("keyring %s has unknown type %q", path, f.Type)
+	}
+	return &f, nil
+}
+
+// Init writes a new keyring at path holding keys, the first of them active, and returns
+// the n shares of its root key. The shares are not stored anywhere; they must be handed
+// to their holders now. An existing keyring is never overwritten.
+func Init(path string, keys []storage.MasterKey, n, threshold int) ([][]byte, error) {
+	if err := checkInit(path, keys); err != nil {
+		return nil, err
+	}
+	root := make([]byte, 32)
+	if _, err := rand.Read(root); err != nil {
+		return nil, err
+	}
+	defer clear(root)
+	shares, err := Split(root, n, threshold)
+	if err != nil {
+		return nil, err
+	}
+	f := &keyringFile{Version: keyringVersion, Type: TypeShamir, Shares: n, Threshold: threshold}
+	if err := f.seal(root, keys); err != nil {
+		return nil, err
+	}
+	if err := f.write(path); err != nil {
+		return nil, fmt.Errorf("failed to write keyring: %w", err)
+	}
+	return shares, nil
+}
+
+// InitKEK writes a new keyring at path holding keys, the first of them active,
+// encrypted under kek. An existing keyring is never overwritten.
+func InitKEK(path string, keys []storage.MasterKey, kek []byte) error {
+	if err := checkInit(path, keys); err != nil {
+		return err
+	}
+	f := &keyringFile{Version: keyringVersion, Type: TypeKEK}
+	if err := f.seal(kek, keys); err != nil {
+		return err
+	}
+	if err := f.write(path); err != nil {
+		return fmt.Errorf("failed to write keyring: %w", err)
+	}
+	return nil
+}
+
+func checkInit(path string, keys []storage.MasterKey) error {
+	if len(keys) == 0 {
+		return errors.New("no master keys provided")
+	}
+	if _, err := os.Stat(path); err == nil {
+		return fmt.Errorf("keyring %s already exists", path)
+	}
+	return nil
+}
+
+// Status is the progress of unsealing.
+type Status struct {
+	Sealed    bool `json:"sealed"`
+	Threshold int  `json:"threshold"`
+	Shares    int  `json:"shares"`
+	Progress  int  `json:"progress"` // shares submitted towards the threshold
+}
+
+// Unsealer collects shares and unseals a MasterKeyStore with the keyring they open.
+// While unsealed it holds the root key, so rotations can be written back to the keyring.
+type Unsealer struct {
+	path string
+	keys *storage.MasterKeyStore
+
+	mu      sync.Mutex
+	keyring *keyringFile
+	pending [][]byte
+	root    []byte // nil while sealed
+}
+
+// NewUnsealer reads the keyring at path. keys must be a sealed store.
+// A Shamir keyring is unsealed with Submit, a KEK one with UnsealWithKEK.
+func NewUnsealer(path string, keys *storage.MasterKeyStore) (*Unsealer, error) {
+	f, err := readKeyring(path)
+	if err != nil {
+		return nil, err
+	}
+	return &Unsealer{path: path, keys: keys, keyring: f}, nil
+}
+
+// Status reports whether the store is sealed and how many shares have been submitted.
+func (u *Unsealer) Status() Status {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.status()
+}
+
+func (u *Unsealer) status() Status {
+	return Status{
+		Sealed:    u.root == nil,
+		Threshold: u.keyring.Threshold,
+		Shares:    u.keyring.Shares,
+		Progress:  len(u.pending),
+	}
+}
+
+// Submit adds a share. When it completes the threshold, the root key is rebuilt and the
+// master keys loaded; if the shares do not open the keyring, they are all discarded and
+// unsealing starts over.
+func (u *Unsealer) Submit(share []byte) (Status, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.root != nil {
+		return u.status(), ErrUnsealed
+	}
+	if u.keyring.Type != TypeShamir {
+		return u.status(), errors.New("the keyring is not split into shares")
+	}
+	if len(share) != 33 {
+		return u.status(), errors.New("share has the wrong length")
+	}
+	for _, p := range u.pending {
+		if p[len(p)-1] == share[len(share)-1] {
+			return u.status(), errors.New("this share was already submitted")
+		}
+	}
+	u.pending = append(u.pending, append([]byte(nil), share...))
+	if len(u.pending) < u.keyring.Threshold {
+		return u.status(), nil
+	}
+
+	root, err := Combine(u.pending)
+	u.reset()
+	if err != nil {
+		return u.status(), err
+	}
+	if err := u.unseal(root); err != nil {
+		if errors.Is(err, errWrongRoot) {
+			err = errors.New("the shares do not open the keyring; unsealing has been reset")
+		}
+		return u.status(), err
+	}
+	return u.status(), nil
+}
+
+// UnsealWithKEK opens a KEK keyring and loads its master keys.
+func (u *Unsealer) UnsealWithKEK(kek []byte) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.root != nil {
+		return ErrUnsealed
+	}
+	if u.keyring.Type != TypeKEK {
+		return errors.New("the keyring is not encrypted under a KEK")
+	}
+	if err := u.unseal(bytes.Clone(kek)); err != nil {
+		if errors.Is(err, errWrongRoot) {
+			err = errors.New("the KEK does not open the keyring")
+		}
+		return err
+	}
+	return nil
+}
+
+var errWrongRoot = errors.New("wrong root key")
+
+// unseal opens the keyring with root, which it takes ownership of, and loads the
+// master keys. The caller holds mu.
+func (u *Unsealer) unseal(root []byte) error {
+	keys, err := u.keyring.open(root)
+	if err != nil {
+		secmem.Zero(root)
+		return errWrongRoot
+	}
+	defer func() {
+		for _, k := range keys {
+			secmem.Zero(k.Key)
+			secmem.Zero(k.KEMSeed)
+		}
+	}()
+	kept, err := secmem.Clone(root)
+	secmem.Zero(root)
+	if err != nil {
+		return err
+	}
+	if err := u.keys.Unseal(keys, u.persist); err != nil {
+		secmem.Zero(kept)
+		return err
+	}
+	u.root = kept
+	return nil
+}
+
+// Reset discards the shares submitted so far.
+func (u *Unsealer) Reset() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.reset()
+}
+
+func (u *Unsealer) reset() {
+	for _, p := range u.pending {
+		secmem.Zero(p)
+	}
+	u.pending = nil
+}
+
+// Seal drops the master keys and the root key. Unsealing again takes a fresh threshold
+// of shares.
+func (u *Unsealer) Seal() {
+	// The store's lock is taken first, as a rotation does before calling persist.
+	u.keys.Seal()
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	secmem.Zero(u.root)
+	u.root = nil
+	u.reset()
+}
+
+// persist rewrites the keyring with keys. The store calls it during a rotation, with
+// its lock held, so nothing holding u.mu may wait for the store.
+func (u *Unsealer) persist(keys []storage.MasterKey) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.root == nil {
+		return errors.New("the KMS is sealed")
+	}
+	f := &keyringFile{Version: keyringVersion, Type: u.keyring.Type, Shares: u.keyring.Shares, Threshold: u.keyring.Threshold}
+	if err := f.seal(u.root, keys); err != nil {
+		return err
+	}
+	if err := f.write(u.path); err != nil {
+		return err
+	}
+	u.keyring = f
+	return nil
+}
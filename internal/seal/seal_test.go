@@ -0,0 +1,92 @@
+package seal
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"my-kms/internal/storage"
+)
+
+// newShamirKeyring writes a 3-of-5 keyring and returns its unsealer and shares.
+func newShamirKeyring(t *testing.T) (*Unsealer, [][]byte) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "keyring.json")
+	shares, err := Init(path, []storage.MasterKey{{ID: "mk1", Key: bytes.Repeat([]byte{7}, 32)}}, 5, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := NewUnsealer(path, storage.NewSealedMasterKeyStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u, shares
+}
+
+func TestUnsealWithAnyThreshold(t *testing.T) {
+	u, shares := newShamirKeyring(t)
+	for mask, subset := range subsets(shares) {
+		if len(subset) != 3 {
+			continue
+		}
+		for i, share := range subset {
+			status, err := u.Submit(share)
+			if err != nil {
+				t.Fatalf("shares %b: share %d: %v", mask, i+1, err)
+			}
+			if want := i < 2; status.Sealed != want || (want && status.Progress != i+1) {
+				t.Fatalf("shares %b: after share %d status %+v", mask, i+1, status)
+			}
+		}
+		if _, err := u.Submit(shares[0]); err != ErrUnsealed {
+			t.Errorf("shares %b: share after unsealing: error = %v, want %v", mask, err, ErrUnsealed)
+		}
+		u.Seal()
+	}
+}
+
+func TestUnsealRejectsDuplicateShare(t *testing.T) {
+	u, shares := newShamirKeyring(t)
+	if _, err := u.Submit(shares[0]); err != nil {
+		t.Fatal(err)
+	}
+	status, err := u.Submit(shares[0])
+	if err == nil || !strings.Contains(err.Error(), "already submitted") {
+		t.Fatalf("duplicate share: error = %v", err)
+	}
+	if status.Progress != 1 {
+		t.Errorf("duplicate share counted: progress %d", status.Progress)
+	}
+}
+
+func TestUnsealRejectsCorruptedShare(t *testing.T) {
+	u, shares := newShamirKeyring(t)
+	corrupted := bytes.Clone(shares[2])
+	corrupted[0] ^= 0x80
+	for _, share := range [][]byte{shares[0], shares[1]} {
+		if _, err := u.Submit(share); err != nil {
+			t.Fatal(err)
+		}
+	}
+	status, err := u.Submit(corrupted)
+	if err == nil || !strings.Contains(err.Error(), "do not open the keyring") {
+		t.Fatalf("corrupted share: error = %v", err)
+	}
+	if !status.Sealed || status.Progress != 0 {
+		t.Errorf("after a corrupted share status %+v, want sealed and reset", status)
+	}
+
+	// Below the threshold, and with a share of the wrong length, nothing unseals.
+	if _, err := u.Submit(shares[0][1:]); err == nil {
+		t.Error("short share accepted")
+	}
+	for _, share := range shares[:2] {
+		if status, err = u.Submit(share); err != nil || !status.Sealed {
+			t.Fatalf("status %+v, %v", status, err)
+		}
+	}
+	if status, err = u.Submit(shares[4]); err != nil || status.Sealed {
+		t.Errorf("good shares after the reset: status %+v, %v", status, err)
+	}
+}
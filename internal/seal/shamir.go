@@ -0,0 +1,110 @@
+package seal
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+)
+
+// gfMul multiplies in GF(2^8) with the AES polynomial, without data-dependent branches.
+func gfMul(a, b byte) byte {
+	var p byte
+	for i := 0; i < 8; i++ {
+		p ^= -(b & 1) & a
+		hi := a >> 7
+		a = a<<1 ^ -hi&0x1b
+		b >>= 1
+	}
+	return p
+}
+
+// gfInv returns the multiplicative inverse of a, which must not be zero: a^254.
+func gfInv(a byte) byte {
+	r := a
+	for i := 0; i < 6; i++ {
+		r = gfMul(gfMul(r, r), a)
+	}
+	return gfMul(r, r)
+}
+
+// Split divides secret into n Shamir shares over GF(2^8), any threshold of which
+// reconstruct it. Each share holds one point per secret byte, followed by its x
+// coordinate.
+func Split(secret []byte, n, threshold int) ([][]byte, error) {
+	switch {
+	case len(secret) == 0:
+		return nil, errors.New("cannot split an empty secret")
+	case threshold < 2:
+		return nil, errors.New("threshold must be at least 2")
+	case n < threshold:
+		return nil, errors.New("share count must be at least the threshold")
+	case n > 255:
+		return nil, errors.New("share count must be at most 255")
+	}
+
+	shares := make([][]byte, n)
+	for i := range shares {
+		shares[i] = make([]byte, len(secret)+1)
+		shares[i][len(secret)] = byte(i + 1)
+	}
+	coeffs := make([]byte, threshold-1)
+	for j, b := range secret {
+		if _, err := rand.Read(coeffs); err != nil {
+			return nil, err
+		}
+		for _, share := range shares {
+			x := share[len(secret)]
+			// Horner's rule, highest coefficient first.
+			var y byte
+			for c := len(coeffs) - 1; c >= 0; c-- {
+				y = gfMul(y, x) ^ coeffs[c]
+			}
+			share[j] = gfMul(y, x) ^ b
+		}
+	}
+	clear(coeffs)
+	return shares, nil
+}
+
+// Combine reconstructs the secret from shares by Lagrange interpolation at zero. With
+// fewer shares than the threshold it returns garbage rather than an error; the caller
+// must check the result.
+func Combine(shares [][]byte) ([]byte, error) {
+	if len(shares) < 2 {
+		return nil, errors.New("at least two shares are required")
+	}
+	size := len(shares[0])
+	if size < 2 {
+		return nil, errors.New("share is too short")
+	}
+	xs := make([]byte, len(shares))
+	for i, share := range shares {
+		if len(share) != size {
+			return nil, errors.New("shares differ in length")
+		}
+		xs[i] = share[size-1]
+		if xs[i] == 0 {
+			return nil, errors.New("invalid share")
+		}
+		for _, x := range xs[:i] {
+			if x == xs[i] {
+				return nil, fmt.Errorf("share %d was given twice", x)
+			}
+		}
+	}
+
+	secret := make([]byte, size-1)
+	for i, share := range shares {
+		// basis is the Lagrange basis polynomial for share i, evaluated at zero.
+		basis := byte(1)
+		for m, x := range xs {
+			if m != i {
+				basis = gfMul(basis, gfMul(x, gfInv(x^xs[i])))
+			}
+		}
+		for j := range secret {
+			secret[j] ^= gfMul(share[j], basis)
+		}
+	}
+	return secret, nil
+}
@@ -0,0 +1,135 @@
+package seal
+
+import (
+	"bytes"
+	"crypto/rand"
+	"math/bits"
+	"testing"
+)
+
+func TestGFInverse(t *testing.T) {
+	for a := 1; a < 256; a++ {
+		if p := gfMul(byte(a), gfInv(byte(a))); p != 1 {
+			t.Fatalf("%#x * inverse = %#x", a, p)
+		}
+	}
+}
+
+// subsets returns every subset of shares, by bitmask.
+func subsets(shares [][]byte) map[uint][][]byte {
+	out := make(map[uint][][]byte)
+	for mask := uint(1); mask < 1<<len(shares); mask++ {
+		for i, s := range shares {
+			if mask&(1<<i) != 0 {
+				out[mask] = append(out[mask], s)
+			}
+		}
+	}
+	return out
+}
+
+func TestSplitCombine(t *testing.T) {
+	for _, tc := range []struct{ n, threshold int }{{2, 2}, {3, 2}, {5, 3}, {6, 6}} {
+		secret := make([]byte, 32)
+		rand.Read(secret)
+		shares, err := Split(secret, tc.n, tc.threshold)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for mask, subset := range subsets(shares) {
+			if len(subset) < 2 {
+				continue
+			}
+			got, err := Combine(subset)
+			if err != nil {
+				t.Fatalf("%d of %d, shares %b: %v", tc.threshold, tc.n, mask, err)
+			}
+			switch {
+			case len(subset) >= tc.threshold && !bytes.Equal(got, secret):
+				t.Errorf("%d of %d: shares %b do not rebuild the secret", tc.threshold, tc.n, mask)
+			case len(subset) < tc.threshold && bytes.Equal(got, secret):
+				t.Errorf("%d of %d: %d shares rebuild the secret", tc.threshold, tc.n, bits.OnesCount(mask))
+			}
+		}
+	}
+}
+
+// Below the threshold a share is uniform whatever the secret: with a threshold of 2, one
+// share of a fixed secret takes every value.
+func TestBelowThresholdRevealsNothing(t *testing.T) {
+	seen := make(map[byte]bool)
+	for i := 0; i < 10000 && len(seen) < 256; i++ {
+		shares, err := Split([]byte{0x42}, 3, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		seen[shares[0][0]] = true
+	}
+	if len(seen) < 256 {
+		t.Errorf("a single share of a fixed secret took only %d of 256 values", len(seen))
+	}
+}
+
+func TestSplitRejects(t *testing.T) {
+	secret := make([]byte, 32)
+	for _, tc := range []struct {
+		name         string
+		secret       []byte
+		n, threshold int
+	}{
+		{"empty secret", nil, 3, 2},
+		{"threshold of 1", secret, 3, 1},
+		{"fewer shares than the threshold", secret, 2, 3},
+		{"more than 255 shares", secret, 256, 2},
+	} {
+		if _, err := Split(tc.secret, tc.n, tc.threshold); err == nil {
+			t.Errorf("%s: Split succeeded", tc.name)
+		}
+	}
+}
+
+func TestCombineRejects(t *testing.T) {
+	secret := make([]byte, 32)
+	rand.Read(secret)
+	shares, err := Split(secret, 5, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zeroX := bytes.Clone(shares[1])
+	zeroX[len(zeroX)-1] = 0
+	for _, tc := range []struct {
+		name   string
+		shares [][]byte
+	}{
+		{"one share", shares[:1]},
+		{"duplicate share", [][]byte{shares[0], shares[1], shares[0]}},
+		{"same x with other points", [][]byte{shares[0], shares[1], append(bytes.Clone(shares[2][:32]), shares[1][32])}},
+		{"x of zero", [][]byte{shares[0], zeroX, shares[2]}},
+		{"shares of different lengths", [][]byte{shares[0], shares[1][1:], shares[2]}},
+		{"share too short", [][]byte{{1}, {2}}},
+	} {
+		if _, err := Combine(tc.shares); err == nil {
+			t.Errorf("%s: Combine succeeded", tc.name)
+		}
+	}
+}
+
+// A corrupted point is not detectable by interpolation alone: it rebuilds a different
+// secret, which the keyring's authentication then refuses (see TestUnsealRejectsCorruptedShare).
+func TestCombineCorruptedShare(t *testing.T) {
+	secret := make([]byte, 32)
+	rand.Read(secret)
+	shares, err := Split(secret, 3, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	corrupted := bytes.Clone(shares[1])
+	corrupted[7] ^= 0x01
+	got, err := Combine([][]byte{shares[0], corrupted})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(got, secret) {
+		t.Error("a corrupted share rebuilt the secret")
+	}
+}
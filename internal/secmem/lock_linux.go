@@ -0,0 +1,26 @@
+//go:build linux
+
+package secmem
+
+import "golang.org/x/sys/unix"
+
+// lockedPages maps at least n bytes of anonymous memory, locks it into RAM and excludes
+// it from core dumps.
+func lockedPages(n int) ([]byte, error) {
+	pageSize := unix.Getpagesize()
+	size := (n + pageSize - 1) / pageSize * pageSize
+	b, err := unix.Mmap(-1, 0, size, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_ANON|unix.MAP_PRIVATE)
+	if err != nil {
+		return nil, err
+	}
+	if err := unix.Mlock(b); err != nil {
+		unix.Munmap(b)
+		return nil, err
+	}
+	if err := unix.Madvise(b, unix.MADV_DONTDUMP); err != nil {
+		unix.Munlock(b)
+		unix.Munmap(b)
+		return nil, err
+	}
+	return b, nil
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package secmem
+
+import "errors"
+
+func lockedPages(int) ([]byte, error) {
+	return nil, errors.New("memory locking is only supported on Linux")
+}
@@ -0,0 +1,78 @@
+// Package secmem keeps key material from outliving its use. Zero wipes a buffer once a
+// key is done with. With Enable, New hands out buffers for long-lived keys from pages
+// locked into RAM, so they never reach swap, and left out of core dumps.
+package secmem
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+)
+
+var (
+	mu      sync.Mutex
+	enabled bool
+	arena   []byte // what is left of the current locked pages
+)
+
+// Enable makes New allocate from locked memory. It fails where that isn't supported or
+// RLIMIT_MEMLOCK doesn't allow even one page.
+func Enable() error {
+	mu.Lock()
+	defer mu.Unlock()
+	if enabled {
+		return nil
+	}
+	page, err := lockedPages(1)
+	if err != nil {
+		return fmt.Errorf("failed to lock memory: %w", err)
+	}
+	arena, enabled = page, true
+	return nil
+}
+
+// Enabled reports whether New allocates from locked memory.
+func Enabled() bool {
+	mu.Lock()
+	defer mu.Unlock()
+	return enabled
+}
+
+// New returns a zeroed n-byte buffer for a key kept in memory for a long time, such as a
+// master key. Once enabled, buffers are carved from locked pages that are never unmapped
+// or reused, so a reader racing a Zero sees zeros rather than a fault or another key.
+// Per-request keys should use the heap and Zero instead.
+func New(n int) ([]byte, error) {
+	mu.Lock()
+	defer mu.Unlock()
+	if !enabled {
+		return make([]byte, n), nil
+	}
+	if n > len(arena) {
+		page, err := lockedPages(n)
+		if err != nil {
+			return nil, fmt.Errorf("failed to lock memory: %w", err)
+		}
+		arena = page
+	}
+	b := arena[:n:n]
+	arena = arena[n:]
+	return b, nil
+}
+
+// Clone copies b into a buffer from New.
+func Clone(b []byte) ([]byte, error) {
+	c, err := New(len(b))
+	if err != nil {
+		return nil, err
+	}
+	copy(c, b)
+	return c, nil
+}
+
+// Zero overwrites b with zeros.
+func Zero(b []byte) {
+	clear(b)
+	// Keep the writes from being optimized away as dead stores.
+	runtime.KeepAlive(b)
+}
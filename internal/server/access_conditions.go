@@ -0,0 +1,50 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"my-kms/internal/auth"
+)
+
+// validateAccessCondition checks a condition being set on a user or API key. A window
+// that has already closed is refused, as an expiresAt in the past is.
+func validateAccessCondition(c *auth.AccessCondition) error {
+	if err := c.Validate(); err != nil {
+		return err
+	}
+	if c != nil && c.ValidUntil != nil && !c.ValidUntil.After(time.Now()) {
+		return errors.New("validUntil must be in the future")
+	}
+	return nil
+}
+
+// normalizeAccessCondition stores times in UTC and drops a condition that allows
+// everything, so {} clears one.
+func normalizeAccessCondition(c *auth.AccessCondition) *auth.AccessCondition {
+	if c.Empty() {
+		return nil
+	}
+	out := *c
+	if out.ValidFrom != nil {
+		t := out.ValidFrom.UTC()
+		out.ValidFrom = &t
+	}
+	if out.ValidUntil != nil {
+		t := out.ValidUntil.UTC()
+		out.ValidUntil = &t
+	}
+	return &out
+}
+
+// rejectOutsideConditions refuses a request made outside the identity's validity window
+// or from an address its conditions leave out.
+func (s *Server) rejectOutsideConditions(w http.ResponseWriter, r *http.Request, identity auth.Identity) bool {
+	if err := identity.Conditions.Check(time.Now(), clientIP(r)); err != nil {
+		warnf(r.Context(), "Refused request from %s: %v", identity.Name, err)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return true
+	}
+	return false
+}
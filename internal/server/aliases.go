@@ -0,0 +1,230 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+
+	"my-kms/internal/auth"
+	"my-kms/internal/storage"
+	"my-kms/internal/transform"
+)
+
+var aliasNamePattern = regexp.MustCompile(`^[A-Za-z0-9/_-]{1,256}$`)
+
+// ---------------------------------------------------------------------
+// Create / Update Alias
+// ---------------------------------------------------------------------
+
+// AliasRequest creates an alias or repoints an existing one.
+type AliasRequest struct {
+	Alias        string   `json:"alias"`
+	DEKID        string   `json:"dekID"`
+	Transformers []string `json:"transformers,omitempty"` // applied before encrypt, reversed after decrypt
+
+	ApprovedDataClasses []string `json:"approvedDataClasses,omitempty"` // DLP classes allowed under this alias
+}
+
+func (s *Server) CreateAliasHandler(w http.ResponseWriter, r *http.Request) {
+	identity, err := getIdentity(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	if err := auth.IsAuthorized(identity, auth.ActionManageKey); err != nil {
+		warnf(r.Context(), "Unauthorized attempt by role=%s to create alias", identity.Role)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	if s.Aliases == nil {
+		http.Error(w, "aliases are not enabled", http.StatusNotFound)
+		return
+	}
+
+	var req AliasRequest
+	if !decodeJSON(w, r.Body, &req) {
+		return
+	}
+	if !aliasNamePattern.MatchString(req.Alias) {
+		http.Error(w, "alias must be 1-256 characters of letters, digits, '/', '_' or '-'", http.StatusBadRequest)
+		return
+	}
+	if err := s.Transformers.Validate(req.Transformers); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if !s.authorizeKeyManagement(w, r, identity, req.DEKID) {
+		return
+	}
+
+	alias := storage.Alias{
+		Name:         req.Alias,
+		TenantID:     identity.Tenant,
+		DEKID:        req.DEKID,
+		Transformers: req.Transformers,
+		UpdatedBy:    identity.Name,
+
+		ApprovedDataClasses: req.ApprovedDataClasses,
+	}
+	if err := s.Aliases.UpsertAlias(r.Context(), alias); err != nil {
+		errorf(r.Context(), "Failed to store alias: %v", err)
+		http.Error(w, "failed to store alias", http.StatusInternalServerError)
+		return
+	}
+	auditf(r.Context(), "alias %s now points at DEK %s (set by %s)", req.Alias, req.DEKID, identity.Name)
+
+	writeJSON(w, alias)
+}
+
+// ---------------------------------------------------------------------
+// Delete Alias
+// ---------------------------------------------------------------------
+
+type DeleteAliasRequest struct {
+	Alias string `json:"alias"`
+}
+
+func (s *Server) DeleteAliasHandler(w http.ResponseWriter, r *http.Request) {
+	identity, err := getIdentity(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	if err := auth.IsAuthorized(identity, auth.ActionManageKey); err != nil {
+		warnf(r.Context(), "Unauthorized attempt by role=%s to delete alias", identity.Role)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	if s.Aliases == nil {
+		http.Error(w, "aliases are not enabled", http.StatusNotFound)
+		return
+	}
+
+	var req DeleteAliasRequest
+	if !decodeJSON(w, r.Body, &req) {
+		return
+	}
+
+	if err := s.Aliases.DeleteAlias(r.Context(), identity.Tenant, req.Alias); err != nil {
+		errorf(r.Context(), "Failed to delete alias: %v", err)
+		http.Error(w, "alias not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ---------------------------------------------------------------------
+// List Aliases
+// ---------------------------------------------------------------------
+
+type ListAliasesResponse struct {
+	Aliases      []storage.Alias `json:"aliases"`
+	Transformers []string        `json:"transformers"` // names available to aliases
+}
+
+func (s *Server) ListAliasesHandler(w http.ResponseWriter, r *http.Request) {
+	identity, err := getIdentity(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	if err := auth.IsAuthorized(identity, auth.ActionListKeys); err != nil {
+		warnf(r.Context(), "Unauthorized attempt by role=%s to list aliases", identity.Role)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	if s.Aliases == nil {
+		http.Error(w, "aliases are not enabled", http.StatusNotFound)
+		return
+	}
+
+	aliases, err := s.Aliases.ListAliases(r.Context(), identity.Tenant)
+	if err != nil {
+		errorf(r.Context(), "Failed to list aliases: %v", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	if aliases == nil {
+		aliases = []storage.Alias{}
+	}
+
+	writeJSON(w, ListAliasesResponse{Aliases: aliases, Transformers: s.Transformers.Names()})
+}
+
+// ---------------------------------------------------------------------
+// Helper Functions
+// ---------------------------------------------------------------------
+
+// resolveKey turns a request's dekID or alias into a DEK ID. The alias is returned
+// (nil when the caller used a DEK ID) so its transformers can be applied.
+func (s *Server) resolveKey(r *http.Request, tenant, dekID, aliasName string) (string, *storage.Alias, error) {
+	switch {
+	case dekID != "" && aliasName != "":
+		return "", nil, errors.New("specify dekID or alias, not both")
+	case aliasName == "":
+		return dekID, nil, nil
+	case s.Aliases == nil:
+		return "", nil, errors.New("aliases are not enabled")
+	}
+
+	alias, err := s.Aliases.GetAlias(r.Context(), tenant, aliasName)
+	if err != nil {
+		errorf(r.Context(), "Failed to get alias: %v", err)
+		return "", nil, fmt.Errorf("alias %s not found", aliasName)
+	}
+	return alias.DEKID, alias, nil
+}
+
+func transformInfo(identity auth.Identity, dekID string, alias *storage.Alias) transform.Info {
+	info := transform.Info{Tenant: identity.Tenant, Identity: identity.Name, DEKID: dekID}
+	if alias != nil {
+		info.Alias = alias.Name
+	}
+	return info
+}
+
+// beforeEncrypt runs the alias's transformers on plaintext, then the DLP scan if one is
+// configured. Requests by DEK ID skip the transformers and have no approved data classes.
+func (s *Server) beforeEncrypt(r *http.Request, identity auth.Identity, dekID string, alias *storage.Alias, plaintext []byte) ([]byte, error) {
+	var approved []string
+	if alias != nil {
+		approved = alias.ApprovedDataClasses
+		if len(alias.Transformers) > 0 {
+			var err error
+			plaintext, err = s.Transformers.BeforeEncrypt(r.Context(), alias.Transformers, transformInfo(identity, dekID, alias), plaintext)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if s.DLP == nil {
+		return plaintext, nil
+	}
+	findings := s.DLP.Scan(plaintext, approved)
+	for _, f := range findings {
+		auditf(r.Context(), "DLP finding rule=%s class=%s count=%d approved=%t dek=%s by %s",
+			f.Rule, f.Class, f.Count, f.Approved, dekID, identity.Name)
+	}
+	if s.DLP.Blocks(findings) {
+		return nil, errors.New("payload contains data classes not approved for this key")
+	}
+	return plaintext, nil
+}
+
+// afterDecrypt is the decrypt-side counterpart of beforeEncrypt.
+func (s *Server) afterDecrypt(r *http.Request, identity auth.Identity, dekID string, alias *storage.Alias, plaintext []byte) ([]byte, error) {
+	if alias == nil || len(alias.Transformers) == 0 {
+		return plaintext, nil
+	}
+	return s.Transformers.AfterDecrypt(r.Context(), alias.Transformers, transformInfo(identity, dekID, alias), plaintext)
+}
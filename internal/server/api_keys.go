@@ -0,0 +1,331 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"my-kms/internal/auth"
+	"my-kms/internal/storage"
+)
+
+// APIKeyHeader carries a service account API key instead of a Firebase token.
+const APIKeyHeader = "X-API-Key"
+
+// API keys look like kms_<prefix>_<secret>: the prefix identifies the stored record
+// and the secret is checked against its hash.
+const (
+	apiKeyScheme      = "kms_"
+	apiKeyPrefixBytes = 8
+	apiKeySecretBytes = 32
+
+	// apiKeyIdentityPrefix marks identities authenticated by API key; key policies
+	// and grants name them as user:apikey:<prefix>.
+	apiKeyIdentityPrefix = "apikey:"
+)
+
+// APIKeyResponse is the public view of an API key; Key is only set on creation.
+type APIKeyResponse struct {
+	Key       string     `json:"key,omitempty"`
+	Prefix    string     `json:"prefix"`
+	Principal string     `json:"principal"`
+	Name      string     `json:"name"`
+	Role      string     `json:"role"`
+	DEKIDs    []string   `json:"dekIDs,omitempty"`
+	CreatedBy string     `json:"createdBy"`
+	CreatedAt time.Time  `json:"createdAt"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+	RevokedAt *time.Time `json:"revokedAt,omitempty"`
+
+	Conditions *auth.AccessCondition `json:"conditions,omitempty"`
+
+	// AWS credentials for the /aws-kms facade, when the key was created with them.
+	AWSAccessKeyID     string `json:"awsAccessKeyID,omitempty"`
+	AWSSecretAccessKey string `json:"awsSecretAccessKey,omitempty"` // only set on creation
+}
+
+func apiKeyResponseFromDoc(k *storage.APIKey) APIKeyResponse {
+	resp := APIKeyResponse{
+		Prefix:    k.Prefix,
+		Principal: auth.PrincipalUserPrefix + apiKeyIdentityPrefix + k.Prefix,
+		Name:      k.Name,
+		Role:      k.Role,
+		DEKIDs:    k.DEKIDs,
+		CreatedBy: k.CreatedBy,
+		CreatedAt: k.CreatedAt,
+		ExpiresAt: optionalTime(k.ExpiresAt),
+		RevokedAt: optionalTime(k.RevokedAt),
+
+		Conditions: k.Conditions,
+	}
+	if k.SigningSecret != nil {
+		resp.AWSAccessKeyID = k.Prefix
+	}
+	return resp
+}
+
+// ---------------------------------------------------------------------
+// Create API Key
+// ---------------------------------------------------------------------
+
+type CreateAPIKeyRequest struct {
+	Name      string     `json:"name" validate:"required"`
+	Role      string     `json:"role"`
+	DEKIDs    []string   `json:"dekIDs,omitempty"` // restrict the key to these DEKs
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+
+	// Conditions bound when and from where the key works, e.g. {"sourceCIDRs": ["10.20.0.0/16"]}.
+	Conditions *auth.AccessCondition `json:"conditions,omitempty"`
+
+	// AWSCredentials also issues the key as an AWS access key pair for the /aws-kms
+	// facade. The secret is then stored wrapped, not just hashed.
+	AWSCredentials bool `json:"awsCredentials,omitempty"`
+}
+
+func (s *Server) CreateAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	identity, err := getIdentity(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	if err := auth.IsAuthorized(identity, auth.ActionManageAPIKeys); err != nil {
+		warnf(r.Context(), "Unauthorized attempt by role=%s to create API key", identity.Role)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	if s.APIKeys == nil {
+		http.Error(w, "API keys are not enabled", http.StatusNotFound)
+		return
+	}
+
+	var req CreateAPIKeyRequest
+	if !decodeJSON(w, r.Body, &req) {
+		return
+	}
+	if !auth.KnownRole(auth.Role(req.Role)) {
+		http.Error(w, "unknown role", http.StatusBadRequest)
+		return
+	}
+	// A key can't do anything its creator couldn't.
+	keyIdentity := auth.Identity{Role: auth.Role(req.Role), Tenant: identity.Tenant}
+	for _, a := range auth.AllActions {
+		if auth.IsAuthorized(keyIdentity, a) == nil && auth.IsAuthorized(identity, a) != nil {
+			http.Error(w, fmt.Sprintf("role %s grants %s, which the caller does not hold", req.Role, a), http.StatusForbidden)
+			return
+		}
+	}
+	var expiresAt time.Time
+	if req.ExpiresAt != nil {
+		expiresAt = req.ExpiresAt.UTC()
+		if !expiresAt.After(time.Now()) {
+			http.Error(w, "expiresAt must be in the future", http.StatusBadRequest)
+			return
+		}
+	}
+	if err := validateAccessCondition(req.Conditions); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	conditions := normalizeAccessCondition(req.Conditions)
+	// Nor outlive or escape its creator's conditions.
+	if !identity.Conditions.Empty() {
+		if conditions != nil {
+			http.Error(w, "a caller with access conditions cannot set them on an API key, which inherits the caller's", http.StatusForbidden)
+			return
+		}
+		conditions = identity.Conditions
+	}
+	for _, dekID := range req.DEKIDs {
+		if !s.authorizeKeyManagement(w, r, identity, dekID) {
+			return
+		}
+	}
+
+	key, prefix, hash, err := newAPIKey()
+	if err != nil {
+		errorf(r.Context(), "Failed to generate API key: %v", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	doc := storage.APIKey{
+		Prefix:     prefix,
+		TenantID:   identity.Tenant,
+		Name:       req.Name,
+		SecretHash: hash,
+		Role:       req.Role,
+		DEKIDs:     req.DEKIDs,
+		CreatedBy:  identity.Name,
+		CreatedAt:  time.Now().UTC(),
+		ExpiresAt:  expiresAt,
+		Conditions: conditions,
+	}
+	secret := strings.TrimPrefix(key, apiKeyScheme+prefix+"_")
+	if req.AWSCredentials {
+		doc.SigningSecret, doc.SigningMasterKeyID, err = s.wrapDEK(r, identity.Tenant, []byte(secret))
+		if err != nil {
+			errorf(r.Context(), "Failed to wrap API key signing secret: %v", err)
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := s.APIKeys.InsertAPIKey(r.Context(), doc); err != nil {
+		errorf(r.Context(), "Failed to store API key: %v", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	auditf(r.Context(), "API key %s (%q, role=%s) created by %s", prefix, req.Name, req.Role, identity.Name)
+
+	resp := apiKeyResponseFromDoc(&doc)
+	resp.Key = key
+	if req.AWSCredentials {
+		resp.AWSSecretAccessKey = secret
+	}
+	writeJSON(w, resp)
+}
+
+// ---------------------------------------------------------------------
+// List API Keys
+// ---------------------------------------------------------------------
+
+type ListAPIKeysResponse struct {
+	Keys []APIKeyResponse `json:"keys"`
+}
+
+func (s *Server) ListAPIKeysHandler(w http.ResponseWriter, r *http.Request) {
+	identity, err := getIdentity(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	if err := auth.IsAuthorized(identity, auth.ActionManageAPIKeys); err != nil {
+		warnf(r.Context(), "Unauthorized attempt by role=%s to list API keys", identity.Role)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	if s.APIKeys == nil {
+		http.Error(w, "API keys are not enabled", http.StatusNotFound)
+		return
+	}
+
+	keys, err := s.APIKeys.ListAPIKeys(r.Context(), identity.Tenant)
+	if err != nil {
+		errorf(r.Context(), "Failed to list API keys: %v", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	resp := ListAPIKeysResponse{Keys: make([]APIKeyResponse, 0, len(keys))}
+	for i := range keys {
+		resp.Keys = append(resp.Keys, apiKeyResponseFromDoc(&keys[i]))
+	}
+	writeJSON(w, resp)
+}
+
+// ---------------------------------------------------------------------
+// Revoke API Key
+// ---------------------------------------------------------------------
+
+type RevokeAPIKeyRequest struct {
+	Prefix string `json:"prefix" validate:"required"`
+}
+
+func (s *Server) RevokeAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	identity, err := getIdentity(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	if err := auth.IsAuthorized(identity, auth.ActionManageAPIKeys); err != nil {
+		warnf(r.Context(), "Unauthorized attempt by role=%s to revoke API key", identity.Role)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	if s.APIKeys == nil {
+		http.Error(w, "API keys are not enabled", http.StatusNotFound)
+		return
+	}
+
+	var req RevokeAPIKeyRequest
+	if !decodeJSON(w, r.Body, &req) {
+		return
+	}
+
+	if err := s.APIKeys.RevokeAPIKey(r.Context(), identity.Tenant, req.Prefix, identity.Name); err != nil {
+		errorf(r.Context(), "Failed to revoke API key: %v", err)
+		http.Error(w, "active API key not found", http.StatusNotFound)
+		return
+	}
+	auditf(r.Context(), "API key %s revoked by %s", req.Prefix, identity.Name)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ---------------------------------------------------------------------
+// Helper Functions
+// ---------------------------------------------------------------------
+
+// errInvalidAPIKey covers malformed, unknown, revoked and expired keys alike.
+var errInvalidAPIKey = errors.New("invalid API key")
+
+// newAPIKey returns a fresh key, its prefix and the hash of its secret.
+func newAPIKey() (key, prefix string, hash []byte, err error) {
+	buf := make([]byte, apiKeyPrefixBytes+apiKeySecretBytes)
+	if _, err := rand.Read(buf); err != nil {
+		return "", "", nil, err
+	}
+	prefix = hex.EncodeToString(buf[:apiKeyPrefixBytes])
+	secret := base64.RawURLEncoding.EncodeToString(buf[apiKeyPrefixBytes:])
+	sum := sha256.Sum256([]byte(secret))
+	return apiKeyScheme + prefix + "_" + secret, prefix, sum[:], nil
+}
+
+// authenticateAPIKey resolves an X-API-Key value to an identity. Secrets are 256-bit
+// random values, so an unsalted SHA-256 is enough to make the stored hash useless.
+func (s *Server) authenticateAPIKey(ctx context.Context, key string) (auth.Identity, error) {
+	if s.APIKeys == nil {
+		return auth.Identity{}, errInvalidAPIKey
+	}
+	prefix, secret, ok := strings.Cut(strings.TrimPrefix(key, apiKeyScheme), "_")
+	if !ok || !strings.HasPrefix(key, apiKeyScheme) || len(prefix) != 2*apiKeyPrefixBytes {
+		return auth.Identity{}, errInvalidAPIKey
+	}
+
+	doc, err := s.APIKeys.GetAPIKey(ctx, prefix)
+	if err != nil {
+		if errors.Is(err, storage.ErrAPIKeyNotFound) {
+			return auth.Identity{}, errInvalidAPIKey
+		}
+		return auth.Identity{}, fmt.Errorf("%w: %v", errUserStoreUnavailable, err)
+	}
+	sum := sha256.Sum256([]byte(secret))
+	if subtle.ConstantTimeCompare(sum[:], doc.SecretHash) != 1 || !doc.Active(time.Now()) {
+		return auth.Identity{}, errInvalidAPIKey
+	}
+	return apiKeyIdentity(doc), nil
+}
+
+// apiKeyIdentity is the identity an authenticated API key acts as.
+func apiKeyIdentity(doc *storage.APIKey) auth.Identity {
+	return auth.Identity{
+		Name:     apiKeyIdentityPrefix + doc.Prefix,
+		Role:     auth.Role(doc.Role),
+		Tenant:   doc.TenantID,
+		KeyScope: doc.DEKIDs,
+
+		Conditions: doc.Conditions,
+	}
+}
@@ -0,0 +1,23 @@
+package server
+
+import (
+	"net/http"
+)
+
+// AttestationHandler is unauthenticated so clients can check the build and configuration
+// before sending credentials. An optional ?nonce= is echoed in the signed statement to
+// prove freshness.
+func (s *Server) AttestationHandler(w http.ResponseWriter, r *http.Request) {
+	if s.Attestor == nil {
+		http.Error(w, "attestation is not enabled", http.StatusNotFound)
+		return
+	}
+
+	a, err := s.Attestor.Attest(r.URL.Query().Get("nonce"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	writeJSON(w, a)
+}
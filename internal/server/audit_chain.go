@@ -0,0 +1,226 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"my-kms/internal/auth"
+	"my-kms/internal/storage"
+)
+
+// auditCheckpointPurpose separates the checkpoint signing key from other keys derived
+// from the same master key.
+const auditCheckpointPurpose = "audit-checkpoint"
+
+// errStopWalk ends a chain walk once a break has been recorded.
+var errStopWalk = errors.New("stop walk")
+
+// RunAuditCheckpoints signs the audit chain head every interval, whenever events have been
+// appended since the last checkpoint, until ctx is cancelled.
+func (s *Server) RunAuditCheckpoints(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.withClusterLock(ctx, LockAuditCheckpoints, func(ctx context.Context) {
+				if err := s.checkpointAuditChain(ctx); err != nil {
+					errorf(ctx, "Audit checkpoint failed: %v", err)
+				}
+			})
+		}
+	}
+}
+
+func (s *Server) checkpointAuditChain(ctx context.Context) error {
+	head, err := s.Audit.LastEvent(ctx)
+	if err != nil || head == nil {
+		return err
+	}
+	last, err := s.Audit.LatestCheckpoint(ctx)
+	if err != nil {
+		return err
+	}
+	if last != nil && last.Seq >= head.Seq {
+		return nil
+	}
+
+	key, keyID, err := s.KeyStore.DeriveSigningKey("", auditCheckpointPurpose)
+	if err != nil {
+		return err
+	}
+	cp := storage.AuditCheckpoint{
+		Seq:       head.Seq,
+		Hash:      head.Hash,
+		Time:      time.Now().UTC().Truncate(time.Millisecond),
+		KeyID:     keyID,
+		PublicKey: key.Public().(ed25519.PublicKey),
+	}
+	payload, err := cp.SignedPayload()
+	if err != nil {
+		return err
+	}
+	cp.Signature = ed25519.Sign(key, payload)
+	if err := s.Audit.InsertCheckpoint(ctx, cp); err != nil {
+		return err
+	}
+	logf(ctx, "Signed audit checkpoint at seq %d with key derived from master key %s", cp.Seq, keyID)
+	return nil
+}
+
+// ---------------------------------------------------------------------
+// Verify Audit Chain
+// ---------------------------------------------------------------------
+
+type ChainBreak struct {
+	Seq    int64  `json:"seq"`
+	Reason string `json:"reason"`
+}
+
+type VerifyAuditChainResponse struct {
+	Verified            bool        `json:"verified"`
+	FromSeq             int64       `json:"fromSeq"`
+	ToSeq               int64       `json:"toSeq"`
+	Events              int         `json:"events"`
+	CheckpointsVerified int         `json:"checkpointsVerified"`
+	Break               *ChainBreak `json:"break,omitempty"` // first problem found
+}
+
+// VerifyAuditChainHandler recomputes the hash chain over ?from= to ?to= (sequence numbers;
+// by default everything still stored) and checks every signed checkpoint in that range.
+// Events removed by retention or archival before from are not needed: the first event's
+// link is taken on trust unless a checkpoint covers it.
+func (s *Server) VerifyAuditChainHandler(w http.ResponseWriter, r *http.Request) {
+	identity, err := getIdentity(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	// The chain spans every tenant, so only platform auditors may walk it.
+	if err := auth.IsAuthorized(identity, auth.ActionViewAuditLog); err != nil || identity.Tenant != "" {
+		warnf(r.Context(), "Unauthorized attempt by role=%s to verify the audit chain", identity.Role)
+		http.Error(w, "not authorized to verify the audit chain", http.StatusForbidden)
+		return
+	}
+
+	if s.Audit == nil {
+		http.Error(w, "audit log store is not enabled", http.StatusNotFound)
+		return
+	}
+
+	var from, to int64
+	for param, dst := range map[string]*int64{"from": &from, "to": &to} {
+		if v := r.URL.Query().Get(param); v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || n <= 0 {
+				http.Error(w, param+" must be a positive sequence number", http.StatusBadRequest)
+				return
+			}
+			*dst = n
+		}
+	}
+	if to > 0 && from > to {
+		http.Error(w, "from must not be after to", http.StatusBadRequest)
+		return
+	}
+
+	resp, err := s.verifyAuditChain(r.Context(), from, to)
+	if err != nil {
+		errorf(r.Context(), "Failed to verify audit chain: %v", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	if resp.Break != nil {
+		auditf(r.Context(), "audit chain verification by %s failed at seq %d: %s", identity.Name, resp.Break.Seq, resp.Break.Reason)
+	} else {
+		auditf(r.Context(), "audit chain verified by %s over seq %d-%d (%d checkpoints)", identity.Name, resp.FromSeq, resp.ToSeq, resp.CheckpointsVerified)
+	}
+
+	writeJSON(w, resp)
+}
+
+func (s *Server) verifyAuditChain(ctx context.Context, from, to int64) (*VerifyAuditChainResponse, error) {
+	checkpoints, err := s.Audit.ListCheckpoints(ctx, from, to)
+	if err != nil {
+		return nil, err
+	}
+	bySeq := make(map[int64]*storage.AuditCheckpoint, len(checkpoints))
+	for i := range checkpoints {
+		bySeq[checkpoints[i].Seq] = &checkpoints[i]
+	}
+
+	resp := &VerifyAuditChainResponse{FromSeq: from}
+	var prev *storage.AuditEvent
+	fail := func(seq int64, format string, args ...interface{}) {
+		resp.Break = &ChainBreak{Seq: seq, Reason: fmt.Sprintf(format, args...)}
+	}
+	err = s.Audit.WalkChain(ctx, from, to, func(ev *storage.AuditEvent) error {
+		if prev == nil {
+			resp.FromSeq = ev.Seq
+		} else if ev.Seq != prev.Seq+1 {
+			fail(prev.Seq+1, "event missing")
+			return errStopWalk
+		} else if !bytes.Equal(ev.PrevHash, prev.Hash) {
+			fail(ev.Seq, "previous hash does not match event %d", prev.Seq)
+			return errStopWalk
+		}
+		sum, err := ev.ChainHash()
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(sum, ev.Hash) {
+			fail(ev.Seq, "event content does not match its hash")
+			return errStopWalk
+		}
+		if cp := bySeq[ev.Seq]; cp != nil {
+			if reason := s.verifyCheckpoint(cp, ev); reason != "" {
+				fail(ev.Seq, "%s", reason)
+				return errStopWalk
+			}
+			resp.CheckpointsVerified++
+			delete(bySeq, ev.Seq)
+		}
+		resp.Events++
+		resp.ToSeq = ev.Seq
+		prev = ev
+		return nil
+	})
+	if err != nil && err != errStopWalk {
+		return nil, err
+	}
+	// A checkpoint past the last stored event means the tail of the chain was removed.
+	for seq := range bySeq {
+		if resp.Break == nil && seq > resp.ToSeq {
+			fail(seq, "chain truncated: checkpointed event missing")
+		}
+	}
+	resp.Verified = resp.Break == nil
+	return resp, nil
+}
+
+// verifyCheckpoint re-derives the signing key rather than trusting the stored public key,
+// so a forged checkpoint cannot carry its own key. It returns why cp is invalid, or "".
+func (s *Server) verifyCheckpoint(cp *storage.AuditCheckpoint, ev *storage.AuditEvent) string {
+	if !bytes.Equal(cp.Hash, ev.Hash) {
+		return "checkpoint hash does not match event"
+	}
+	pub, err := s.KeyStore.SigningPublicKey(cp.KeyID, auditCheckpointPurpose)
+	if err != nil {
+		return fmt.Sprintf("checkpoint signing key %s is unavailable", cp.KeyID)
+	}
+	payload, err := cp.SignedPayload()
+	if err != nil || !ed25519.Verify(pub, payload, cp.Signature) {
+		return "checkpoint signature is invalid"
+	}
+	return ""
+}
@@ -0,0 +1,425 @@
+package server
+
+import (
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"my-kms/internal/auth"
+	"my-kms/internal/storage"
+)
+
+// auditWriteTimeout bounds how long writing one audit event may take.
+const auditWriteTimeout = 5 * time.Second
+
+// AuditStore keeps the hash-chained audit events and their checkpoints. It is implemented
+// by storage.MongoAuditStore.
+type AuditStore interface {
+	AppendEvent(ctx context.Context, ev storage.AuditEvent) (*storage.AuditEvent, error)
+	QueryEvents(ctx context.Context, q storage.AuditQuery) ([]storage.AuditEvent, error)
+	ArchiveBefore(ctx context.Context, before time.Time, limit int64, w io.Writer) (int, error)
+	LastEvent(ctx context.Context) (*storage.AuditEvent, error)
+	WalkChain(ctx context.Context, fromSeq, toSeq int64, fn func(*storage.AuditEvent) error) error
+	InsertCheckpoint(ctx context.Context, cp storage.AuditCheckpoint) error
+	LatestCheckpoint(ctx context.Context) (*storage.AuditCheckpoint, error)
+	ListCheckpoints(ctx context.Context, fromSeq, toSeq int64) ([]storage.AuditCheckpoint, error)
+}
+
+// auditRecord collects what a request did while its handlers run; AuditMiddleware writes
+// it as one event when the request is done.
+type auditRecord struct {
+	mu    sync.Mutex
+	event storage.AuditEvent
+}
+
+type auditRecordKey struct{}
+
+func auditRecordFrom(ctx context.Context) *auditRecord {
+	rec, _ := ctx.Value(auditRecordKey{}).(*auditRecord)
+	return rec
+}
+
+// AuditMiddleware writes one structured audit event per request to the audit store.
+// Probes (/healthz, /readyz, /time) and /metrics scrapes are not recorded.
+func (s *Server) AuditMiddleware(mux *http.ServeMux, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, pattern := mux.Handler(r)
+		if pattern == "/healthz" || pattern == "/readyz" || pattern == "/time" || pattern == "/metrics" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if pattern == "" {
+			pattern = r.URL.Path
+		}
+
+		rec := &auditRecord{event: storage.AuditEvent{
+			Time:       time.Now().UTC(),
+			RequestID:  RequestIDFromContext(r.Context()),
+			Action:     pattern,
+			RemoteAddr: r.RemoteAddr,
+		}}
+		r = r.WithContext(context.WithValue(r.Context(), auditRecordKey{}, rec))
+		aw := &auditResponseWriter{ResponseWriter: w, s: s, r: r, rec: rec}
+		next.ServeHTTP(aw, r)
+		if !aw.committed {
+			aw.commit(http.StatusOK)
+		}
+	})
+}
+
+// errAuditRefused is returned to handlers writing a response that was replaced because
+// its audit event could not be stored.
+var errAuditRefused = errors.New("response withheld: audit event could not be stored")
+
+// auditResponseWriter stores the request's audit event when the handler starts its
+// response, before anything reaches the client. If the event can't be stored and audit
+// fails closed, the client gets a 503 instead of the response.
+type auditResponseWriter struct {
+	http.ResponseWriter
+	s   *Server
+	r   *http.Request
+	rec *auditRecord
+
+	committed bool
+	refused   bool
+}
+
+func (w *auditResponseWriter) WriteHeader(code int) {
+	if !w.committed {
+		w.commit(code)
+	}
+	if !w.refused {
+		w.ResponseWriter.WriteHeader(code)
+	}
+}
+
+func (w *auditResponseWriter) Write(b []byte) (int, error) {
+	if !w.committed {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.refused {
+		return 0, errAuditRefused
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush commits the event first, so a streamed response is audited too.
+func (w *auditResponseWriter) Flush() {
+	if !w.committed {
+		w.WriteHeader(http.StatusOK)
+	}
+	if !w.refused {
+		http.NewResponseController(w.ResponseWriter).Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the connection, e.g. to move its write
+// deadline.
+func (w *auditResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// commit writes the request's event with status, and refuses the response if that fails
+// and the audit subsystem fails closed.
+func (w *auditResponseWriter) commit(status int) {
+	w.committed = true
+	w.rec.mu.Lock()
+	ev := w.rec.event
+	w.rec.mu.Unlock()
+	ev.Status = status
+	switch {
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		ev.Result = storage.AuditResultDenied
+	case status >= 400:
+		ev.Result = storage.AuditResultError
+	default:
+		ev.Result = storage.AuditResultSuccess
+	}
+	if err := w.s.writeAuditEvent(ev); err != nil && !w.s.failOpen(w.r.Context(), SubsystemAudit, err) {
+		w.refused = true
+		h := w.ResponseWriter.Header()
+		for k := range h {
+			if k != http.CanonicalHeaderKey(RequestIDHeader) {
+				delete(h, k)
+			}
+		}
+		http.Error(w.ResponseWriter, "audit log unavailable", http.StatusServiceUnavailable)
+	}
+}
+
+// setAuditIdentity records who is making the request.
+func setAuditIdentity(r *http.Request, identity auth.Identity) {
+	if rec := auditRecordFrom(r.Context()); rec != nil {
+		rec.mu.Lock()
+		rec.event.Identity = identity.Name
+		rec.event.Role = string(identity.Role)
+		rec.event.TenantID = identity.Tenant
+		rec.mu.Unlock()
+	}
+}
+
+// auditKey records the key, and encryption context if any, the request operates on.
+func auditKey(r *http.Request, dekID string, encCtx map[string]string) {
+	if rec := auditRecordFrom(r.Context()); rec != nil {
+		rec.mu.Lock()
+		rec.event.KeyID = dekID
+		if len(encCtx) > 0 {
+			rec.event.EncryptionContext = encCtx
+		}
+		rec.mu.Unlock()
+	}
+}
+
+// auditf logs an audit line and adds it to the audit event of the request ctx belongs to.
+func auditf(ctx context.Context, format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	logf(ctx, "[AUDIT] %s", msg)
+	if rec := auditRecordFrom(ctx); rec != nil {
+		rec.mu.Lock()
+		rec.event.Details = append(rec.event.Details, msg)
+		rec.mu.Unlock()
+	}
+}
+
+// auditSystem logs and stores an audit event for something the server did on its own,
+// e.g. a background job.
+func (s *Server) auditSystem(action, tenantID, keyID, format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	logf(context.Background(), "[AUDIT] %s", msg)
+	// Nobody is waiting on a background job's event, so a failure is only logged.
+	_ = s.writeAuditEvent(storage.AuditEvent{
+		Time:     time.Now().UTC(),
+		Identity: "kms",
+		TenantID: tenantID,
+		Action:   action,
+		KeyID:    keyID,
+		Result:   storage.AuditResultSuccess,
+		Details:  []string{msg},
+	})
+}
+
+// writeAuditEvent stores ev and then streams it to the SIEM sinks, so what they receive
+// carries its place in the hash chain. An event the store refused goes nowhere else:
+// sinks only ever see chained events.
+func (s *Server) writeAuditEvent(ev storage.AuditEvent) error {
+	if s.Audit != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), auditWriteTimeout)
+		stored, err := s.Audit.AppendEvent(ctx, ev)
+		cancel()
+		if err != nil {
+			errorf(ctx, "Failed to write audit event for %s %s: %v", ev.Action, ev.RequestID, err)
+			return err
+		}
+		ev = *stored
+	}
+	if s.SIEM != nil {
+		s.SIEM.Publish(ev)
+	}
+	if s.Outbox != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), auditWriteTimeout)
+		err := s.Outbox.AddAudit(ctx, ev)
+		cancel()
+		if err != nil {
+			errorf(ctx, "Failed to add audit event for %s %s to the event outbox: %v", ev.Action, ev.RequestID, err)
+		}
+	}
+	return nil
+}
+
+// RunAuditArchive moves audit events older than after into gzipped JSON lines files in
+// dir, checking every interval until ctx is cancelled.
+func (s *Server) RunAuditArchive(ctx context.Context, interval, after time.Duration, dir string) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.withClusterLock(ctx, LockAuditArchive, func(ctx context.Context) {
+				if err := s.archiveAuditEvents(ctx, time.Now().UTC().Add(-after), dir); err != nil {
+					errorf(ctx, "Audit archival failed: %v", err)
+				}
+			})
+		}
+	}
+}
+
+// auditArchiveBatch caps how many events go into one archive file.
+const auditArchiveBatch = 50000
+
+func (s *Server) archiveAuditEvents(ctx context.Context, before time.Time, dir string) error {
+	for {
+		name := filepath.Join(dir, fmt.Sprintf("audit-%s.jsonl.gz", time.Now().UTC().Format("20060102T150405.000000000Z")))
+		f, err := os.OpenFile(name, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+		if err != nil {
+			return fmt.Errorf("failed to create audit archive: %w", err)
+		}
+		zw := gzip.NewWriter(f)
+		n, err := s.Audit.ArchiveBefore(ctx, before, auditArchiveBatch, zw)
+		if cerr := zw.Close(); err == nil {
+			err = cerr
+		}
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return os.Remove(name)
+		}
+		logf(ctx, "Archived %d audit events to %s", n, name)
+		if n < auditArchiveBatch {
+			return nil
+		}
+	}
+}
+
+// ---------------------------------------------------------------------
+// Audit Logs
+// ---------------------------------------------------------------------
+
+type AuditLogsResponse struct {
+	Events []storage.AuditEvent `json:"events"`
+}
+
+// AuditLogsHandler returns audit events, newest first, filtered by the identity, action,
+// keyID, result, requestID, since and until (RFC 3339) query parameters; limit caps the
+// count. Tenant callers only see their tenant; platform auditors see everything, or one
+// tenant with ?tenant=.
+func (s *Server) AuditLogsHandler(w http.ResponseWriter, r *http.Request) {
+	identity, err := getIdentity(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	if err := auth.IsAuthorized(identity, auth.ActionViewAuditLog); err != nil {
+		warnf(r.Context(), "Unauthorized attempt by role=%s to read audit logs", identity.Role)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	if s.Audit == nil {
+		http.Error(w, "audit log store is not enabled", http.StatusNotFound)
+		return
+	}
+
+	query := r.URL.Query()
+	q := storage.AuditQuery{
+		TenantID:  identity.Tenant,
+		Identity:  query.Get("identity"),
+		Action:    query.Get("action"),
+		KeyID:     query.Get("keyID"),
+		Result:    query.Get("result"),
+		RequestID: query.Get("requestID"),
+		Limit:     defaultListLimit,
+	}
+	if identity.Tenant == "" {
+		if t := query.Get("tenant"); t != "" {
+			q.TenantID = t
+		} else {
+			q.AllTenants = true
+		}
+	}
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			http.Error(w, "limit must be a positive integer", http.StatusBadRequest)
+			return
+		}
+		q.Limit = int64(min(n, maxListLimit))
+	}
+	for param, dst := range map[string]*time.Time{"since": &q.Since, "until": &q.Until} {
+		if v := query.Get(param); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				http.Error(w, param+" must be an RFC 3339 timestamp", http.StatusBadRequest)
+				return
+			}
+			*dst = t
+		}
+	}
+
+	events, err := s.Audit.QueryEvents(r.Context(), q)
+	if err != nil {
+		errorf(r.Context(), "Failed to query audit events: %v", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	if events == nil {
+		events = []storage.AuditEvent{}
+	}
+	writeJSON(w, AuditLogsResponse{Events: events})
+}
+
+// ---------------------------------------------------------------------
+// List Master Keys
+// ---------------------------------------------------------------------
+
+type MasterKeyInfo struct {
+	ID        string                 `json:"id"`
+	Active    bool                   `json:"active"`
+	State     storage.MasterKeyState `json:"state"`
+	WrapMode  storage.WrapMode       `json:"wrapMode,omitempty"`
+	CreatedAt *time.Time             `json:"createdAt,omitempty"` // unknown for keys from MASTER_KEYS
+	RetiredAt *time.Time             `json:"retiredAt,omitempty"`
+	ExpiresAt *time.Time             `json:"expiresAt,omitempty"` // when the rotation schedule replaces the active key
+}
+
+// masterKeyInfo describes k for the API.
+func (s *Server) masterKeyInfo(k storage.MasterKeyInfo) MasterKeyInfo {
+	info := MasterKeyInfo{
+		ID:        k.ID,
+		Active:    k.State == storage.MasterKeyStateActive,
+		State:     k.State,
+		WrapMode:  k.WrapMode,
+		CreatedAt: optionalTime(k.CreatedAt),
+		RetiredAt: optionalTime(k.RetiredAt),
+	}
+	if info.Active && s.Rotation != nil && s.Rotation.Interval > 0 {
+		info.ExpiresAt = optionalTime(time.Now().UTC().Add(s.Rotation.Interval - s.KeyStore.ActiveKeyAge()).Truncate(time.Second))
+	}
+	return info
+}
+
+type ListMasterKeysResponse struct {
+	Keys      []MasterKeyInfo             `json:"keys"`
+	Rotations []storage.MasterKeyRotation `json:"rotations"` // since the last restart
+}
+
+// ListMasterKeysHandler lists master keys with their lifecycle state, and the rotation
+// history, never key material.
+func (s *Server) ListMasterKeysHandler(w http.ResponseWriter, r *http.Request) {
+	identity, err := getIdentity(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	if err := auth.IsAuthorized(identity, auth.ActionListKeys); err != nil {
+		warnf(r.Context(), "Unauthorized attempt by role=%s to list master keys", identity.Role)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	keys := s.KeyStore.Keys()
+	resp := ListMasterKeysResponse{
+		Keys:      make([]MasterKeyInfo, 0, len(keys)),
+		Rotations: s.KeyStore.Rotations(),
+	}
+	for _, k := range keys {
+		resp.Keys = append(resp.Keys, s.masterKeyInfo(k))
+	}
+	writeJSON(w, resp)
+}
@@ -0,0 +1,462 @@
+package server
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"my-kms/internal/auth"
+	"my-kms/internal/secmem"
+	"my-kms/internal/storage"
+)
+
+// AWSKMSPath serves the AWS KMS JSON protocol, so code using an AWS SDK can point its
+// KMS endpoint here without other changes.
+const AWSKMSPath = "/aws-kms"
+
+const (
+	awsTargetPrefix     = "TrentService."
+	awsContentType      = "application/x-amz-json-1.1"
+	awsSymmetricDefault = "SYMMETRIC_DEFAULT"
+	awsMaxDataKeyBytes  = 1024
+)
+
+// AWSFacade configures the AWS KMS compatibility layer. Key ARNs are built from
+// Region and AccountID; signatures scoped to another region are refused.
+type AWSFacade struct {
+	Region    string
+	AccountID string
+}
+
+// awsError is an error in the AWS JSON protocol: the SDKs read Type from the body.
+type awsError struct {
+	Status  int    `json:"-"`
+	Type    string `json:"__type"`
+	Message string `json:"message"`
+}
+
+func (e *awsError) Error() string { return e.Type + ": " + e.Message }
+
+func newAWSError(status int, typ, format string, args ...interface{}) *awsError {
+	return &awsError{Status: status, Type: typ, Message: fmt.Sprintf(format, args...)}
+}
+
+func writeAWSError(w http.ResponseWriter, r *http.Request, e *awsError) {
+	w.Header().Set("Content-Type", awsContentType)
+	w.Header().Set("X-Amzn-ErrorType", e.Type)
+	w.Header().Set("X-Amzn-RequestId", RequestIDFromContext(r.Context()))
+	w.WriteHeader(e.Status)
+	json.NewEncoder(w).Encode(e)
+}
+
+func writeAWSJSON(w http.ResponseWriter, r *http.Request, v interface{}) {
+	w.Header().Set("Content-Type", awsContentType)
+	w.Header().Set("X-Amzn-RequestId", RequestIDFromContext(r.Context()))
+	json.NewEncoder(w).Encode(v)
+}
+
+// ---------------------------------------------------------------------
+// Authentication
+// ---------------------------------------------------------------------
+
+// authenticateSigV4 authenticates a request signed with the AWS credentials of an API
+// key (see CreateAPIKeyRequest.AWSCredentials) and sets the key's identity in context.
+func (s *Server) authenticateSigV4(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.AWSFacade == nil || s.APIKeys == nil {
+			http.Error(w, "the AWS KMS facade is not enabled", http.StatusNotFound)
+			return
+		}
+		if s.rejectBlockedClient(w, r) {
+			return
+		}
+
+		body, err := io.ReadAll(io.LimitReader(r.Body, 2*s.MaxPayloadBytes+1<<16))
+		if err != nil {
+			writeAWSError(w, r, newAWSError(http.StatusBadRequest, "ValidationException", "failed to read request body"))
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		identity, awsErr := s.sigV4Identity(r, body)
+		if awsErr != nil {
+			warnf(r.Context(), "AWS signature authentication failed: %v", awsErr)
+			writeAWSError(w, r, awsErr)
+			return
+		}
+		if s.Clients != nil {
+			s.Clients.Observe(identity.Name, r)
+		}
+		setAuditIdentity(r, identity)
+		next.ServeHTTP(w, r.WithContext(auth.WithIdentity(r.Context(), identity)))
+	}
+}
+
+func (s *Server) sigV4Identity(r *http.Request, body []byte) (auth.Identity, *awsError) {
+	cred, err := parseSigV4Authorization(r.Header.Get("Authorization"))
+	if err != nil {
+		if errors.Is(err, errSigV4Missing) {
+			return auth.Identity{}, newAWSError(http.StatusUnauthorized, "MissingAuthenticationTokenException", "%v", err)
+		}
+		return auth.Identity{}, newAWSError(http.StatusUnauthorized, "IncompleteSignatureException", "%v", err)
+	}
+	if cred.Region != s.AWSFacade.Region {
+		return auth.Identity{}, newAWSError(http.StatusUnauthorized, "InvalidSignatureException", "credential should be scoped to a valid region, not %q", cred.Region)
+	}
+	if err := checkSigV4Time(r, cred, time.Now()); err != nil {
+		return auth.Identity{}, newAWSError(http.StatusUnauthorized, "InvalidSignatureException", "%v", err)
+	}
+
+	doc, err := s.APIKeys.GetAPIKey(r.Context(), cred.AccessKeyID)
+	if err != nil && !errors.Is(err, storage.ErrAPIKeyNotFound) {
+		errorf(r.Context(), "Failed to look up API key: %v", err)
+		return auth.Identity{}, newAWSError(http.StatusServiceUnavailable, "DependencyTimeoutException", "user store unavailable")
+	}
+	if err != nil || doc.SigningSecret == nil || !doc.Active(time.Now()) {
+		return auth.Identity{}, newAWSError(http.StatusUnauthorized, "UnrecognizedClientException", "the security token included in the request is invalid")
+	}
+	secret, err := s.unwrapDEK(r, &storage.DEKDocument{DEK: doc.SigningSecret, MasterKeyID: doc.SigningMasterKeyID, TenantID: doc.TenantID})
+	if err != nil {
+		errorf(r.Context(), "Failed to unwrap API key signing secret: %v", err)
+		return auth.Identity{}, newAWSError(http.StatusInternalServerError, "KMSInternalException", "internal server error")
+	}
+	defer secmem.Zero(secret)
+	if err := verifySigV4(r, cred, secret, body); err != nil {
+		return auth.Identity{}, newAWSError(http.StatusUnauthorized, "InvalidSignatureException", "%v", err)
+	}
+	identity := apiKeyIdentity(doc)
+	if s.isRevoked(r, identity) {
+		return auth.Identity{}, newAWSError(http.StatusUnauthorized, "UnrecognizedClientException", "principal revoked")
+	}
+	if err := identity.Conditions.Check(time.Now(), clientIP(r)); err != nil {
+		return auth.Identity{}, newAWSError(http.StatusForbidden, "AccessDeniedException", "%v", err)
+	}
+	return identity, nil
+}
+
+// ---------------------------------------------------------------------
+// Operations
+// ---------------------------------------------------------------------
+
+type awsEncryptRequest struct {
+	KeyId               string
+	Plaintext           []byte
+	EncryptionContext   map[string]string
+	EncryptionAlgorithm string
+}
+
+type awsEncryptResponse struct {
+	KeyId               string
+	CiphertextBlob      []byte
+	EncryptionAlgorithm string
+}
+
+type awsDecryptRequest struct {
+	KeyId               string
+	CiphertextBlob      []byte
+	EncryptionContext   map[string]string
+	EncryptionAlgorithm string
+}
+
+type awsDecryptResponse struct {
+	KeyId               string
+	Plaintext           []byte
+	EncryptionAlgorithm string
+}
+
+type awsReEncryptRequest struct {
+	CiphertextBlob                 []byte
+	SourceKeyId                    string
+	SourceEncryptionContext        map[string]string
+	SourceEncryptionAlgorithm      string
+	DestinationKeyId               string
+	DestinationEncryptionContext   map[string]string
+	DestinationEncryptionAlgorithm string
+}
+
+type awsReEncryptResponse struct {
+	CiphertextBlob                 []byte
+	SourceKeyId                    string
+	KeyId                          string
+	SourceEncryptionAlgorithm      string
+	DestinationEncryptionAlgorithm string
+}
+
+type awsGenerateDataKeyRequest struct {
+	KeyId             string
+	KeySpec           string
+	NumberOfBytes     int
+	EncryptionContext map[string]string
+}
+
+type awsGenerateDataKeyResponse struct {
+	KeyId          string
+	CiphertextBlob []byte
+	Plaintext      []byte
+}
+
+// AWSKMSHandler dispatches on X-Amz-Target. Each operation runs the matching native
+// handler in-process (see callNative), so authorization, key policies, grants, quotas, DLP and audit
+// behave exactly as they do for /encrypt and /decrypt.
+func (s *Server) AWSKMSHandler(w http.ResponseWriter, r *http.Request) {
+	identity, err := getIdentity(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		writeAWSError(w, r, newAWSError(http.StatusMethodNotAllowed, "ValidationException", "the AWS KMS protocol uses POST"))
+		return
+	}
+	op, ok := strings.CutPrefix(r.Header.Get("X-Amz-Target"), awsTargetPrefix)
+	if !ok {
+		writeAWSError(w, r, newAWSError(http.StatusBadRequest, "UnknownOperationException", "missing or unknown X-Amz-Target"))
+		return
+	}
+
+	var resp interface{}
+	var awsErr *awsError
+	switch op {
+	case "Encrypt":
+		var req awsEncryptRequest
+		if awsErr = decodeAWSRequest(r, &req); awsErr == nil {
+			resp, awsErr = s.awsEncrypt(w, r, req)
+		}
+	case "Decrypt":
+		var req awsDecryptRequest
+		if awsErr = decodeAWSRequest(r, &req); awsErr == nil {
+			resp, awsErr = s.awsDecrypt(w, r, req)
+		}
+	case "ReEncrypt":
+		var req awsReEncryptRequest
+		if awsErr = decodeAWSRequest(r, &req); awsErr == nil {
+			resp, awsErr = s.awsReEncrypt(w, r, req)
+		}
+	case "GenerateDataKey":
+		var req awsGenerateDataKeyRequest
+		if awsErr = decodeAWSRequest(r, &req); awsErr == nil {
+			resp, awsErr = s.awsGenerateDataKey(w, r, req)
+		}
+	default:
+		awsErr = newAWSError(http.StatusBadRequest, "UnsupportedOperationException", "%s is not supported by this server", op)
+	}
+	if awsErr != nil {
+		if awsErr.Status >= 500 {
+			errorf(r.Context(), "AWS %s failed: %v", op, awsErr)
+		}
+		writeAWSError(w, r, awsErr)
+		return
+	}
+	auditf(r.Context(), "AWS %s by %s", op, identity.Name)
+	writeAWSJSON(w, r, resp)
+}
+
+func decodeAWSRequest(r *http.Request, v interface{}) *awsError {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		return newAWSError(http.StatusBadRequest, "SerializationException", "invalid request body")
+	}
+	return nil
+}
+
+func checkAWSAlgorithm(alg string) *awsError {
+	if alg != "" && alg != awsSymmetricDefault {
+		return newAWSError(http.StatusBadRequest, "ValidationException", "EncryptionAlgorithm must be %s", awsSymmetricDefault)
+	}
+	return nil
+}
+
+func (s *Server) awsEncrypt(w http.ResponseWriter, r *http.Request, req awsEncryptRequest) (*awsEncryptResponse, *awsError) {
+	if err := checkAWSAlgorithm(req.EncryptionAlgorithm); err != nil {
+		return nil, err
+	}
+	dekID, ciphertext, awsErr := s.awsEncryptWith(w, r, req.KeyId, req.Plaintext, req.EncryptionContext)
+	if awsErr != nil {
+		return nil, awsErr
+	}
+	return &awsEncryptResponse{KeyId: s.awsKeyARN(dekID), CiphertextBlob: ciphertext, EncryptionAlgorithm: awsSymmetricDefault}, nil
+}
+
+func (s *Server) awsDecrypt(w http.ResponseWriter, r *http.Request, req awsDecryptRequest) (*awsDecryptResponse, *awsError) {
+	if err := checkAWSAlgorithm(req.EncryptionAlgorithm); err != nil {
+		return nil, err
+	}
+	dekID, ciphertext, err := parseKeyedCiphertext(req.CiphertextBlob)
+	if err != nil {
+		return nil, newAWSError(http.StatusBadRequest, "InvalidCiphertextException", "%v", err)
+	}
+	if req.KeyId != "" {
+		// An alias may have moved since; only a key ID or ARN must match.
+		keyID, alias := s.parseAWSKeyID(req.KeyId)
+		if alias == "" && keyID != dekID {
+			return nil, newAWSError(http.StatusBadRequest, "IncorrectKeyException", "the ciphertext was encrypted under a different key")
+		}
+	}
+
+	var out DecryptResponse
+	in := DecryptRequest{
+		DEKID:             dekID,
+		Ciphertext:        base64.StdEncoding.EncodeToString(ciphertext),
+		PlaintextEncoding: plaintextEncodingBase64,
+		EncryptionContext: req.EncryptionContext,
+	}
+	if nerr := s.callNative(w, r, "/decrypt", s.identityRateLimit(s.DecryptHandler), in, &out); nerr != nil {
+		return nil, awsErrorFromNative(nerr)
+	}
+	if out.Plaintext == nil {
+		out.Plaintext = []byte{}
+	}
+	return &awsDecryptResponse{KeyId: s.awsKeyARN(dekID), Plaintext: out.Plaintext, EncryptionAlgorithm: awsSymmetricDefault}, nil
+}
+
+func (s *Server) awsReEncrypt(w http.ResponseWriter, r *http.Request, req awsReEncryptRequest) (*awsReEncryptResponse, *awsError) {
+	if err := checkAWSAlgorithm(req.SourceEncryptionAlgorithm); err != nil {
+		return nil, err
+	}
+	if err := checkAWSAlgorithm(req.DestinationEncryptionAlgorithm); err != nil {
+		return nil, err
+	}
+	if req.DestinationKeyId == "" {
+		return nil, newAWSError(http.StatusBadRequest, "ValidationException", "DestinationKeyId is required")
+	}
+	srcID, ciphertext, err := parseKeyedCiphertext(req.CiphertextBlob)
+	if err != nil {
+		return nil, newAWSError(http.StatusBadRequest, "InvalidCiphertextException", "%v", err)
+	}
+	if req.SourceKeyId != "" {
+		keyID, alias := s.parseAWSKeyID(req.SourceKeyId)
+		if alias == "" && keyID != srcID {
+			return nil, newAWSError(http.StatusBadRequest, "IncorrectKeyException", "the ciphertext was encrypted under a different key")
+		}
+	}
+
+	dstID, dstAlias := s.parseAWSKeyID(req.DestinationKeyId)
+	var out ReEncryptResponse
+	in := ReEncryptRequest{
+		SourceDEKID:                  srcID,
+		Ciphertext:                   base64.StdEncoding.EncodeToString(ciphertext),
+		SourceEncryptionContext:      req.SourceEncryptionContext,
+		DestinationDEKID:             dstID,
+		DestinationAlias:             dstAlias,
+		DestinationEncryptionContext: req.DestinationEncryptionContext,
+	}
+	if nerr := s.callNative(w, r, "/re-encrypt", s.identityRateLimit(s.ReEncryptHandler), in, &out); nerr != nil {
+		return nil, awsErrorFromNative(nerr)
+	}
+	sealed, err := base64.StdEncoding.DecodeString(out.Ciphertext)
+	if err != nil {
+		return nil, newAWSError(http.StatusInternalServerError, "KMSInternalException", "internal server error")
+	}
+	return &awsReEncryptResponse{
+		CiphertextBlob:                 keyedCiphertext(out.DEKID, sealed),
+		SourceKeyId:                    s.awsKeyARN(srcID),
+		KeyId:                          s.awsKeyARN(out.DEKID),
+		SourceEncryptionAlgorithm:      awsSymmetricDefault,
+		DestinationEncryptionAlgorithm: awsSymmetricDefault,
+	}, nil
+}
+
+// awsGenerateDataKey returns a random key and its encryption, as AWS does. The key is
+// for the caller's own envelope encryption and is not stored here.
+func (s *Server) awsGenerateDataKey(w http.ResponseWriter, r *http.Request, req awsGenerateDataKeyRequest) (*awsGenerateDataKeyResponse, *awsError) {
+	size := req.NumberOfBytes
+	switch {
+	case req.KeySpec != "" && size != 0:
+		return nil, newAWSError(http.StatusBadRequest, "ValidationException", "give KeySpec or NumberOfBytes, not both")
+	case req.KeySpec == "AES_256":
+		size = 32
+	case req.KeySpec == "AES_128":
+		size = 16
+	case req.KeySpec != "":
+		return nil, newAWSError(http.StatusBadRequest, "ValidationException", "KeySpec must be AES_256 or AES_128")
+	case size < 1 || size > awsMaxDataKeyBytes:
+		return nil, newAWSError(http.StatusBadRequest, "ValidationException", "NumberOfBytes must be between 1 and %d", awsMaxDataKeyBytes)
+	}
+	key := make([]byte, size)
+	if _, err := rand.Read(key); err != nil {
+		return nil, newAWSError(http.StatusInternalServerError, "KMSInternalException", "failed to generate data key")
+	}
+	dekID, ciphertext, awsErr := s.awsEncryptWith(w, r.WithContext(withWrapping(r.Context())), req.KeyId, key, req.EncryptionContext)
+	if awsErr != nil {
+		secmem.Zero(key)
+		return nil, awsErr
+	}
+	return &awsGenerateDataKeyResponse{KeyId: s.awsKeyARN(dekID), CiphertextBlob: ciphertext, Plaintext: key}, nil
+}
+
+func (s *Server) awsEncryptWith(w http.ResponseWriter, r *http.Request, keyID string, plaintext []byte, encCtx map[string]string) (string, []byte, *awsError) {
+	if keyID == "" {
+		return "", nil, newAWSError(http.StatusBadRequest, "ValidationException", "KeyId is required")
+	}
+	if plaintext == nil {
+		plaintext = []byte{}
+	}
+	dekID, alias := s.parseAWSKeyID(keyID)
+	var out EncryptResponse
+	in := EncryptRequest{DEKID: dekID, Alias: alias, Plaintext: plaintext, EncryptionContext: encCtx}
+	if nerr := s.callNative(w, r, "/encrypt", s.identityRateLimit(s.EncryptHandler), in, &out); nerr != nil {
+		return "", nil, awsErrorFromNative(nerr)
+	}
+	ciphertext, err := base64.StdEncoding.DecodeString(out.Ciphertext)
+	if err != nil {
+		return "", nil, newAWSError(http.StatusInternalServerError, "KMSInternalException", "internal server error")
+	}
+	return out.DEKID, keyedCiphertext(out.DEKID, ciphertext), nil
+}
+
+// ---------------------------------------------------------------------
+// Helper Functions
+// ---------------------------------------------------------------------
+
+// awsErrorFromNative maps a native error response to the nearest AWS KMS exception.
+func awsErrorFromNative(e *nativeError) *awsError {
+	status, msg := e.Status, e.Message
+	switch {
+	case status == http.StatusTooManyRequests:
+		return newAWSError(http.StatusBadRequest, "ThrottlingException", "%s (retry after %ss)", msg, e.Header.Get("Retry-After"))
+	case status == http.StatusForbidden:
+		return newAWSError(http.StatusForbidden, "AccessDeniedException", "%s", msg)
+	case msg == "DEK not found" || strings.HasPrefix(msg, "alias ") && strings.HasSuffix(msg, " not found"):
+		return newAWSError(http.StatusBadRequest, "NotFoundException", "%s", msg)
+	case strings.HasSuffix(msg, "cannot be used"):
+		if strings.Contains(msg, string(storage.KeyStateDisabled)) {
+			return newAWSError(http.StatusBadRequest, "DisabledException", "%s", msg)
+		}
+		return newAWSError(http.StatusBadRequest, "KMSInvalidStateException", "%s", msg)
+	case msg == "decryption failed" || msg == "ciphertext too short":
+		return newAWSError(http.StatusBadRequest, "InvalidCiphertextException", "%s", msg)
+	case status == http.StatusServiceUnavailable:
+		return newAWSError(http.StatusServiceUnavailable, "DependencyTimeoutException", "%s", msg)
+	case status >= 500:
+		return newAWSError(http.StatusInternalServerError, "KMSInternalException", "%s", msg)
+	}
+	return newAWSError(http.StatusBadRequest, "ValidationException", "%s", msg)
+}
+
+// parseAWSKeyID accepts a key ID, key ARN, alias/name or alias ARN.
+func (s *Server) parseAWSKeyID(keyID string) (dekID, alias string) {
+	if strings.HasPrefix(keyID, "arn:") {
+		// arn:aws:kms:region:account:key/id or ...:alias/name
+		if parts := strings.SplitN(keyID, ":", 6); len(parts) == 6 {
+			keyID = parts[5]
+		}
+		if id, ok := strings.CutPrefix(keyID, "key/"); ok {
+			return id, ""
+		}
+	}
+	if name, ok := strings.CutPrefix(keyID, "alias/"); ok {
+		return "", name
+	}
+	return keyID, ""
+}
+
+func (s *Server) awsKeyARN(dekID string) string {
+	return fmt.Sprintf("arn:aws:kms:%s:%s:key/%s", s.AWSFacade.Region, s.AWSFacade.AccountID, dekID)
+}
@@ -0,0 +1,129 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"my-kms/internal/auth"
+	"my-kms/internal/backup"
+	"my-kms/internal/storage"
+)
+
+// metadataOpener is implemented by storage.SealedDEKStore.
+type metadataOpener interface {
+	OpenDEKMetadata(doc *storage.DEKDocument) error
+}
+
+// ---------------------------------------------------------------------
+// Backup
+// ---------------------------------------------------------------------
+
+// BackupHandler returns a disaster-recovery backup of the key hierarchy, encrypted under
+// BackupRecoveryKey and signed with the attestation key, for cmd/kms-restore. It holds
+// every DEK in every tenant, so only platform admins may take one.
+func (s *Server) BackupHandler(w http.ResponseWriter, r *http.Request) {
+	identity, err := getIdentity(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	if err := auth.IsAuthorized(identity, auth.ActionExportKey); err != nil {
+		warnf(r.Context(), "Unauthorized attempt by role=%s to take a backup", identity.Role)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if identity.Tenant != "" {
+		http.Error(w, "a backup spans every tenant; only platform admins may take one", http.StatusForbidden)
+		return
+	}
+
+	if s.BackupRecoveryKey == nil || s.Attestor == nil {
+		http.Error(w, "backups are not enabled", http.StatusNotFound)
+		return
+	}
+
+	if !s.requireSecondApprover(w, r, identity, "backup", "") {
+		return
+	}
+
+	contents, err := s.backupContents(r.Context(), identity.Name)
+	if err != nil {
+		errorf(r.Context(), "Failed to collect backup: %v", err)
+		http.Error(w, "backup failed", http.StatusInternalServerError)
+		return
+	}
+	defer contents.Clear()
+	data, err := backup.Seal(contents, s.BackupRecoveryKey, s.Attestor.PublicKey(), s.Attestor.Sign)
+	if err != nil {
+		errorf(r.Context(), "Failed to seal backup: %v", err)
+		http.Error(w, "backup failed", http.StatusInternalServerError)
+		return
+	}
+	auditf(r.Context(), "backup of %d master keys and %d DEKs taken by %s under recovery key %s",
+		len(contents.MasterKeys), len(contents.DEKs), identity.Name, backup.RecoveryKeyID(s.BackupRecoveryKey))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="kms-backup-%s.json"`, contents.CreatedAt.Format("20060102T150405Z")))
+	w.Write(data)
+}
+
+// backupContents collects the master key metadata and every DEK, deleted ones included
+// so they can still be restored, with metadata opened and master-key-wrapped DEKs
+// unwrapped. A DEK that can't be read fails the backup rather than going missing from it.
+func (s *Server) backupContents(ctx context.Context, createdBy string) (_ *backup.Contents, err error) {
+	_, active := s.KeyStore.KeyIDs()
+	c := &backup.Contents{
+		Version:           backup.FormatVersion,
+		CreatedAt:         time.Now().UTC(),
+		CreatedBy:         createdBy,
+		ActiveMasterKeyID: active,
+	}
+	for _, k := range s.KeyStore.Keys() {
+		c.MasterKeys = append(c.MasterKeys, backup.MasterKey{ID: k.ID, State: k.State, CreatedAt: k.CreatedAt, RetiredAt: k.RetiredAt})
+	}
+
+	defer func() {
+		if err != nil {
+			c.Clear()
+		}
+	}()
+
+	opener, _ := s.DEKStore.(metadataOpener)
+	cursor := ""
+	for {
+		docs, next, err := s.DEKStore.ListDEKsByMasterKey(ctx, "", cursor, DefaultRewrapBatchSize)
+		if err != nil {
+			return nil, err
+		}
+		for _, doc := range docs {
+			if doc.Sealed != nil {
+				if opener == nil {
+					return nil, fmt.Errorf("metadata of DEK %s is sealed but the DEK store cannot open it", doc.ID.Hex())
+				}
+				if err := opener.OpenDEKMetadata(&doc); err != nil {
+					return nil, err
+				}
+			}
+			entry := backup.DEK{Document: doc}
+			if !strings.HasPrefix(doc.MasterKeyID, cmkKeyIDPrefix) {
+				key, err := s.KeyStore.DecryptDataKey(doc.DEK, doc.MasterKeyID)
+				if err != nil {
+					return nil, fmt.Errorf("failed to unwrap DEK %s: %w", doc.ID.Hex(), err)
+				}
+				entry.Key, entry.Document.DEK = key, nil
+			}
+			c.DEKs = append(c.DEKs, entry)
+		}
+		if next == "" {
+			return c, nil
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		cursor = next
+	}
+}
@@ -0,0 +1,182 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"my-kms/internal/crypto"
+)
+
+// Encrypt and decrypt take their payload either in a JSON body (jsonData or base64
+// plaintext; base64 ciphertext) or, with Content-Type: application/octet-stream, as the
+// raw body, the other parameters then coming from the query string and the encryption
+// context from EncryptionContextHeader. Accept: application/octet-stream returns the
+// raw result instead of JSON.
+
+const contentTypeBinary = "application/octet-stream"
+
+// EncryptionContextHeader carries the encryption context, as a JSON object, on
+// binary requests.
+const EncryptionContextHeader = "X-Encryption-Context"
+
+// Plaintext encodings a decrypt caller may ask for.
+const (
+	plaintextEncodingAuto   = ""       // jsonData when the plaintext is JSON, plaintext otherwise
+	plaintextEncodingBase64 = "base64" // always plaintext
+)
+
+// errPayloadTooLarge is returned while reading a raw body past the payload limit.
+var errPayloadTooLarge = errors.New("payload too large")
+
+// isBinaryRequest reports whether the body is a raw payload.
+func isBinaryRequest(r *http.Request) bool {
+	mt, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mt == contentTypeBinary
+}
+
+// wantsBinary reports whether the caller accepts a raw response.
+func wantsBinary(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		if mt, _, err := mime.ParseMediaType(strings.TrimSpace(part)); err == nil && mt == contentTypeBinary {
+			return true
+		}
+	}
+	return false
+}
+
+// readEncryptRequest decodes an encrypt request in either form.
+func (s *Server) readEncryptRequest(r *http.Request) (EncryptRequest, error) {
+	var req EncryptRequest
+	if !isBinaryRequest(r) {
+		if err := decodeRequest(r.Body, &req, false); err != nil {
+			return req, err
+		}
+		if req.JSONData != nil && req.Plaintext != nil {
+			return req, errors.New("give jsonData or plaintext, not both")
+		}
+		return req, nil
+	}
+
+	if err := readBinaryParams(r, &req.DEKID, &req.Alias, &req.ValidateOnly, &req.EncryptionContext); err != nil {
+		return req, err
+	}
+	if v := r.URL.Query().Get("deterministic"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return req, errors.New("deterministic must be true or false")
+		}
+		req.Deterministic = b
+	}
+	req.Format = r.URL.Query().Get("format")
+	body, err := readLimitedBody(r, s.MaxPayloadBytes)
+	if err != nil {
+		return req, err
+	}
+	req.Plaintext = body
+	return req, nil
+}
+
+// payload returns the bytes to encrypt.
+func (req EncryptRequest) payload() []byte {
+	if req.Plaintext != nil {
+		return req.Plaintext
+	}
+	return req.JSONData
+}
+
+// readDecryptRequest decodes a decrypt request in either form. For a binary request
+// the raw ciphertext is returned alongside; otherwise it is left base64 in the request.
+func (s *Server) readDecryptRequest(r *http.Request) (DecryptRequest, []byte, error) {
+	var req DecryptRequest
+	if !isBinaryRequest(r) {
+		if err := decodeRequest(r.Body, &req, false); err != nil {
+			return req, nil, err
+		}
+		return req, nil, nil
+	}
+
+	if err := readBinaryParams(r, &req.DEKID, &req.Alias, &req.ValidateOnly, &req.EncryptionContext); err != nil {
+		return req, nil, err
+	}
+	req.PlaintextEncoding = r.URL.Query().Get("plaintextEncoding")
+	req.Format = r.URL.Query().Get("format")
+	limit := s.MaxPayloadBytes + int64(crypto.MaxOverhead())
+	if req.Format == ciphertextFormatJWE {
+		limit = jweLimit(s.MaxPayloadBytes)
+	}
+	body, err := readLimitedBody(r, limit)
+	if err != nil {
+		return req, nil, err
+	}
+	return req, body, nil
+}
+
+// readBinaryParams reads the parameters of a binary request from its query string
+// and headers.
+func readBinaryParams(r *http.Request, dekID, alias *string, validateOnly *bool, encCtx *map[string]string) error {
+	q := r.URL.Query()
+	*dekID = q.Get("dekID")
+	*alias = q.Get("alias")
+	if v := q.Get("validateOnly"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return errors.New("validateOnly must be true or false")
+		}
+		*validateOnly = b
+	}
+	if v := r.Header.Get(EncryptionContextHeader); v != "" {
+		if err := json.Unmarshal([]byte(v), encCtx); err != nil {
+			return fmt.Errorf("%s must be a JSON object of strings", EncryptionContextHeader)
+		}
+	}
+	return nil
+}
+
+// readLimitedBody reads at most limit bytes of the body, failing with
+// errPayloadTooLarge beyond that.
+func readLimitedBody(r *http.Request, limit int64) ([]byte, error) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, limit+1))
+	if err != nil {
+		return nil, errors.New("failed to read request body")
+	}
+	if int64(len(body)) > limit {
+		return nil, errPayloadTooLarge
+	}
+	return body, nil
+}
+
+// writePlaintext answers a decrypt: raw bytes when the caller accepts them, otherwise
+// JSON with jsonData when the plaintext is JSON (and base64 was not asked for) or
+// base64 plaintext.
+func writePlaintext(w http.ResponseWriter, r *http.Request, plaintext []byte, encoding string) {
+	if wantsBinary(r) {
+		writeBinary(w, plaintext)
+		return
+	}
+	if encoding == plaintextEncodingAuto && json.Valid(plaintext) {
+		writeJSON(w, DecryptResponse{JSONData: plaintext})
+		return
+	}
+	writeJSON(w, DecryptResponse{Plaintext: plaintext})
+}
+
+func writeBinary(w http.ResponseWriter, data []byte) {
+	w.Header().Set("Content-Type", contentTypeBinary)
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.Write(data)
+}
+
+// validPlaintextEncoding checks a decrypt request's plaintextEncoding.
+func validPlaintextEncoding(encoding string) error {
+	switch encoding {
+	case plaintextEncodingAuto, plaintextEncodingBase64:
+		return nil
+	}
+	return fmt.Errorf("plaintextEncoding must be %q or omitted", plaintextEncodingBase64)
+}
@@ -0,0 +1,733 @@
+package server
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"my-kms/internal/auth"
+	"my-kms/internal/secmem"
+	"my-kms/internal/storage"
+)
+
+// A small issuing CA: /create-ca keeps an ECDSA P-256 key wrapped like a DEK and either
+// self-signs it or returns a CSR for a parent CA to sign, /issue-certificate signs CSRs
+// under a profile, and /ca-chain hands out the chain to trust.
+
+const (
+	defaultCAName = "default"
+
+	// DefaultCATTL is the lifetime of a self-signed CA certificate unless asked otherwise.
+	DefaultCATTL = 5 * 365 * 24 * time.Hour
+	maxCATTL     = 10 * 365 * 24 * time.Hour
+
+	// certificateBackdate covers clocks slightly behind ours.
+	certificateBackdate = time.Minute
+
+	minCertificateRSABits = 2048
+)
+
+// CertificateProfile is what a certificate issued under it may name and contain.
+type CertificateProfile struct {
+	KeyUsage    []string `json:"keyUsage"`    // digitalSignature, keyEncipherment, keyAgreement
+	ExtKeyUsage []string `json:"extKeyUsage"` // serverAuth, clientAuth
+
+	DefaultTTLSeconds int `json:"defaultTTLSeconds"`
+	MaxTTLSeconds     int `json:"maxTTLSeconds"`
+
+	// AllowedDomains limits DNS names to these domains and their subdomains; empty allows any.
+	AllowedDomains   []string `json:"allowedDomains,omitempty"`
+	AllowWildcards   bool     `json:"allowWildcards,omitempty"`
+	AllowIPAddresses bool     `json:"allowIPAddresses,omitempty"`
+	AllowURIs        bool     `json:"allowURIs,omitempty"` // e.g. SPIFFE IDs
+
+	keyUsage    x509.KeyUsage
+	extKeyUsage []x509.ExtKeyUsage
+}
+
+var certificateKeyUsages = map[string]x509.KeyUsage{
+	"digitalSignature": x509.KeyUsageDigitalSignature,
+	"keyEncipherment":  x509.KeyUsageKeyEncipherment,
+	"keyAgreement":     x509.KeyUsageKeyAgreement,
+}
+
+var certificateExtKeyUsages = map[string]x509.ExtKeyUsage{
+	"serverAuth": x509.ExtKeyUsageServerAuth,
+	"clientAuth": x509.ExtKeyUsageClientAuth,
+}
+
+// DefaultCertificateProfiles returns the built-in "server" and "client" profiles:
+// one-day certificates by default, a month at most.
+func DefaultCertificateProfiles() map[string]*CertificateProfile {
+	profiles := map[string]*CertificateProfile{
+		"server": {
+			KeyUsage:          []string{"digitalSignature", "keyEncipherment"},
+			ExtKeyUsage:       []string{"serverAuth"},
+			DefaultTTLSeconds: 24 * 60 * 60,
+			MaxTTLSeconds:     30 * 24 * 60 * 60,
+			AllowIPAddresses:  true,
+		},
+		"client": {
+			KeyUsage:          []string{"digitalSignature"},
+			ExtKeyUsage:       []string{"clientAuth"},
+			DefaultTTLSeconds: 24 * 60 * 60,
+			MaxTTLSeconds:     30 * 24 * 60 * 60,
+			AllowURIs:         true,
+		},
+	}
+	for name, p := range profiles {
+		if err := p.compile(); err != nil {
+			panic(fmt.Sprintf("built-in certificate profile %s: %v", name, err))
+		}
+	}
+	return profiles
+}
+
+// LoadCertificateProfiles reads profiles from a JSON object keyed by name and adds them
+// to the built-in ones, replacing any with the same name.
+func LoadCertificateProfiles(path string) (map[string]*CertificateProfile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read certificate profiles: %w", err)
+	}
+	var loaded map[string]*CertificateProfile
+	if err := json.Unmarshal(data, &loaded); err != nil {
+		return nil, fmt.Errorf("failed to parse certificate profiles: %w", err)
+	}
+	profiles := DefaultCertificateProfiles()
+	for name, p := range loaded {
+		if p == nil {
+			return nil, fmt.Errorf("certificate profile %s is empty", name)
+		}
+		if err := p.compile(); err != nil {
+			return nil, fmt.Errorf("certificate profile %s: %w", name, err)
+		}
+		profiles[name] = p
+	}
+	return profiles, nil
+}
+
+func (p *CertificateProfile) compile() error {
+	p.keyUsage, p.extKeyUsage = 0, nil
+	for _, u := range p.KeyUsage {
+		ku, ok := certificateKeyUsages[u]
+		if !ok {
+			return fmt.Errorf("unknown key usage %q", u)
+		}
+		p.keyUsage |= ku
+	}
+	for _, u := range p.ExtKeyUsage {
+		eku, ok := certificateExtKeyUsages[u]
+		if !ok {
+			return fmt.Errorf("unknown extended key usage %q", u)
+		}
+		p.extKeyUsage = append(p.extKeyUsage, eku)
+	}
+	if len(p.extKeyUsage) == 0 {
+		return errors.New("at least one extended key usage is required")
+	}
+	if p.MaxTTLSeconds <= 0 || p.DefaultTTLSeconds <= 0 || p.DefaultTTLSeconds > p.MaxTTLSeconds {
+		return errors.New("defaultTTLSeconds and maxTTLSeconds must be positive, the default no more than the max")
+	}
+	for i, d := range p.AllowedDomains {
+		p.AllowedDomains[i] = strings.ToLower(strings.TrimPrefix(d, "."))
+	}
+	return nil
+}
+
+// checkNames refuses subject alternative names the profile does not allow.
+func (p *CertificateProfile) checkNames(csr *x509.CertificateRequest) error {
+	if len(csr.DNSNames)+len(csr.IPAddresses)+len(csr.URIs) == 0 {
+		return errors.New("the CSR names no DNS names, IP addresses or URIs")
+	}
+	if len(csr.EmailAddresses) > 0 {
+		return errors.New("email addresses are not issued")
+	}
+	if len(csr.IPAddresses) > 0 && !p.AllowIPAddresses {
+		return errors.New("this profile does not issue IP addresses")
+	}
+	if len(csr.URIs) > 0 && !p.AllowURIs {
+		return errors.New("this profile does not issue URIs")
+	}
+	for _, name := range csr.DNSNames {
+		name = strings.ToLower(name)
+		if strings.HasPrefix(name, "*.") {
+			if !p.AllowWildcards {
+				return fmt.Errorf("this profile does not issue wildcard names like %s", name)
+			}
+			name = name[2:]
+		}
+		if !p.domainAllowed(name) {
+			return fmt.Errorf("DNS name %s is outside the profile's allowed domains", name)
+		}
+	}
+	return nil
+}
+
+func (p *CertificateProfile) domainAllowed(name string) bool {
+	if len(p.AllowedDomains) == 0 {
+		return true
+	}
+	for _, d := range p.AllowedDomains {
+		if name == d || strings.HasSuffix(name, "."+d) {
+			return true
+		}
+	}
+	return false
+}
+
+// ---------------------------------------------------------------------
+// Create CA
+// ---------------------------------------------------------------------
+
+type CreateCARequest struct {
+	Name         string `json:"name,omitempty"` // defaults to "default"
+	CommonName   string `json:"commonName" validate:"required"`
+	Organization string `json:"organization,omitempty"`
+
+	// SelfSigned makes a root CA at once. Otherwise the response carries a CSR for a
+	// parent CA to sign, and /import-ca-certificate completes the CA.
+	SelfSigned bool `json:"selfSigned,omitempty"`
+	TTLSeconds int  `json:"ttlSeconds,omitempty"` // self-signed only; defaults to five years
+}
+
+type CreateCAResponse struct {
+	Name  string `json:"name"`
+	CSR   string `json:"csr,omitempty"`   // PEM, for a sub-CA
+	Chain string `json:"chain,omitempty"` // PEM, for a self-signed CA
+}
+
+func (s *Server) CreateCAHandler(w http.ResponseWriter, r *http.Request) {
+	identity, err := getIdentity(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	if err := auth.IsAuthorized(identity, auth.ActionManageCA); err != nil {
+		warnf(r.Context(), "Unauthorized attempt by role=%s to create CA", identity.Role)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	if s.CAs == nil {
+		http.Error(w, "certificate issuance is not enabled", http.StatusNotFound)
+		return
+	}
+
+	var req CreateCARequest
+	if !decodeJSON(w, r.Body, &req) {
+		return
+	}
+	name, err := caName(req.Name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ttl := DefaultCATTL
+	if req.TTLSeconds != 0 {
+		ttl = time.Duration(req.TTLSeconds) * time.Second
+	}
+	if ttl <= 0 || ttl > maxCATTL {
+		http.Error(w, fmt.Sprintf("ttlSeconds must be between 1 and %d", int(maxCATTL/time.Second)), http.StatusBadRequest)
+		return
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		errorf(r.Context(), "Failed to generate CA key: %v", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	subject := pkix.Name{CommonName: req.CommonName}
+	if req.Organization != "" {
+		subject.Organization = []string{req.Organization}
+	}
+
+	var resp CreateCAResponse
+	var chain [][]byte
+	if req.SelfSigned {
+		cert, err := selfSignCA(key, subject, ttl)
+		if err != nil {
+			errorf(r.Context(), "Failed to self-sign CA: %v", err)
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
+		chain = [][]byte{cert}
+		resp.Chain = encodeCertificates(chain)
+	} else {
+		csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{Subject: subject}, key)
+		if err != nil {
+			errorf(r.Context(), "Failed to create CA CSR: %v", err)
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
+		resp.CSR = string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csr}))
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		errorf(r.Context(), "Failed to marshal CA key: %v", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	wrapped, masterKeyID, err := s.wrapDEK(r, identity.Tenant, der)
+	secmem.Zero(der)
+	if err != nil {
+		errorf(r.Context(), "Failed to wrap CA key: %v", err)
+		http.Error(w, "encryption failed", http.StatusInternalServerError)
+		return
+	}
+	err = s.CAs.CreateCA(r.Context(), storage.CertificateAuthority{
+		TenantID:     identity.Tenant,
+		Name:         name,
+		Key:          wrapped,
+		MasterKeyID:  masterKeyID,
+		Certificates: chain,
+		CreatedBy:    identity.Name,
+	})
+	if errors.Is(err, storage.ErrCAExists) {
+		http.Error(w, fmt.Sprintf("CA %s already exists", name), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		errorf(r.Context(), "Failed to store CA: %v", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	auditf(r.Context(), "CA %s created by %s (self-signed: %t)", name, identity.Name, req.SelfSigned)
+
+	resp.Name = name
+	writeJSON(w, resp)
+}
+
+// ---------------------------------------------------------------------
+// Import CA Certificate
+// ---------------------------------------------------------------------
+
+type ImportCACertificateRequest struct {
+	Name  string `json:"name,omitempty"`
+	Chain string `json:"chain"` // PEM: the CA's certificate, then its issuers
+}
+
+// ImportCACertificateHandler installs the certificate a parent CA issued for a sub-CA's
+// CSR, or a renewal of it.
+func (s *Server) ImportCACertificateHandler(w http.ResponseWriter, r *http.Request) {
+	identity, err := getIdentity(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	if err := auth.IsAuthorized(identity, auth.ActionManageCA); err != nil {
+		warnf(r.Context(), "Unauthorized attempt by role=%s to import CA certificate", identity.Role)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	if s.CAs == nil {
+		http.Error(w, "certificate issuance is not enabled", http.StatusNotFound)
+		return
+	}
+
+	var req ImportCACertificateRequest
+	if !decodeJSON(w, r.Body, &req) {
+		return
+	}
+	name, err := caName(req.Name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	certs, err := parseCertificateChain(req.Chain)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ca, signer, err := s.loadCA(r, identity, name)
+	if err != nil {
+		s.caError(w, r, name, err)
+		return
+	}
+	if err := checkCAChain(certs, signer.Public(), time.Now()); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	chain := make([][]byte, len(certs))
+	for i, c := range certs {
+		chain[i] = c.Raw
+	}
+	if err := s.CAs.SetCACertificates(r.Context(), ca.TenantID, name, chain); err != nil {
+		errorf(r.Context(), "Failed to store CA certificate: %v", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	auditf(r.Context(), "CA %s certificate imported by %s, valid until %s", name, identity.Name, certs[0].NotAfter.Format(time.RFC3339))
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ---------------------------------------------------------------------
+// Issue Certificate
+// ---------------------------------------------------------------------
+
+type IssueCertificateRequest struct {
+	CA         string `json:"ca,omitempty"`      // CA name; defaults to "default"
+	CSR        string `json:"csr"`               // PEM
+	Profile    string `json:"profile,omitempty"` // defaults to "server"
+	TTLSeconds int    `json:"ttlSeconds,omitempty"`
+}
+
+type IssueCertificateResponse struct {
+	Certificate  string    `json:"certificate"` // PEM
+	Chain        string    `json:"chain"`       // PEM, the CA's chain without the certificate
+	SerialNumber string    `json:"serialNumber"`
+	NotAfter     time.Time `json:"notAfter"`
+}
+
+func (s *Server) IssueCertificateHandler(w http.ResponseWriter, r *http.Request) {
+	identity, err := getIdentity(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	if err := auth.IsAuthorized(identity, auth.ActionIssueCertificate); err != nil {
+		warnf(r.Context(), "Unauthorized attempt by role=%s to issue certificate", identity.Role)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	if s.CAs == nil {
+		http.Error(w, "certificate issuance is not enabled", http.StatusNotFound)
+		return
+	}
+
+	var req IssueCertificateRequest
+	if !decodeJSON(w, http.MaxBytesReader(w, r.Body, 64<<10), &req) {
+		return
+	}
+	name, err := caName(req.CA)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Profile == "" {
+		req.Profile = "server"
+	}
+	profile, ok := s.CertificateProfiles[req.Profile]
+	if !ok {
+		http.Error(w, fmt.Sprintf("unknown certificate profile %q", req.Profile), http.StatusBadRequest)
+		return
+	}
+	ttl := time.Duration(profile.DefaultTTLSeconds) * time.Second
+	if req.TTLSeconds != 0 {
+		ttl = time.Duration(req.TTLSeconds) * time.Second
+	}
+	if ttl <= 0 || ttl > time.Duration(profile.MaxTTLSeconds)*time.Second {
+		http.Error(w, fmt.Sprintf("ttlSeconds must be between 1 and %d for profile %s", profile.MaxTTLSeconds, req.Profile), http.StatusBadRequest)
+		return
+	}
+	csr, err := parseCSR(req.CSR)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := profile.checkNames(csr); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ca, signer, err := s.loadCA(r, identity, name)
+	if err != nil {
+		s.caError(w, r, name, err)
+		return
+	}
+	if len(ca.Certificates) == 0 {
+		http.Error(w, fmt.Sprintf("CA %s has no certificate yet; import the one its parent issued", name), http.StatusConflict)
+		return
+	}
+	caCert, err := x509.ParseCertificate(ca.Certificates[0])
+	if err != nil {
+		errorf(r.Context(), "Failed to parse certificate of CA %s: %v", name, err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	now := time.Now()
+	if !now.Before(caCert.NotAfter) {
+		http.Error(w, fmt.Sprintf("CA %s expired at %s", name, caCert.NotAfter.Format(time.RFC3339)), http.StatusConflict)
+		return
+	}
+	notAfter := now.Add(ttl)
+	if notAfter.After(caCert.NotAfter) {
+		notAfter = caCert.NotAfter // a certificate can't outlive its issuer
+	}
+	serial, err := randomSerial()
+	if err != nil {
+		errorf(r.Context(), "Failed to generate serial number: %v", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	// Only the names are taken from the CSR; everything else comes from the profile.
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: csr.Subject.CommonName},
+		NotBefore:             now.Add(-certificateBackdate),
+		NotAfter:              notAfter,
+		KeyUsage:              profile.keyUsage,
+		ExtKeyUsage:           profile.extKeyUsage,
+		BasicConstraintsValid: true,
+		DNSNames:              csr.DNSNames,
+		IPAddresses:           csr.IPAddresses,
+		URIs:                  csr.URIs,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, caCert, csr.PublicKey, signer)
+	if err != nil {
+		errorf(r.Context(), "Failed to issue certificate: %v", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	serialHex := hex.EncodeToString(serial.Bytes())
+	auditf(r.Context(), "Certificate %s issued by CA %s to %s (profile %s, names %s, until %s)",
+		serialHex, name, identity.Name, req.Profile, strings.Join(certificateNames(template), ","), notAfter.UTC().Format(time.RFC3339))
+
+	writeJSON(w, IssueCertificateResponse{
+		Certificate:  encodeCertificates([][]byte{der}),
+		Chain:        encodeCertificates(ca.Certificates),
+		SerialNumber: serialHex,
+		NotAfter:     notAfter.UTC(),
+	})
+}
+
+// ---------------------------------------------------------------------
+// CA Chain
+// ---------------------------------------------------------------------
+
+// CAChainHandler serves a CA's chain as PEM (application/pem-certificate-chain), for
+// clients and servers to trust.
+func (s *Server) CAChainHandler(w http.ResponseWriter, r *http.Request) {
+	identity, err := getIdentity(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	if err := auth.IsAuthorized(identity, auth.ActionDescribeKey); err != nil {
+		warnf(r.Context(), "Unauthorized attempt by role=%s to get CA chain", identity.Role)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	if s.CAs == nil {
+		http.Error(w, "certificate issuance is not enabled", http.StatusNotFound)
+		return
+	}
+
+	name, err := caName(r.URL.Query().Get("name"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ca, err := s.CAs.GetCA(r.Context(), identity.Tenant, name)
+	if err != nil {
+		errorf(r.Context(), "Failed to load CA %s: %v", name, err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	if ca == nil || len(ca.Certificates) == 0 {
+		http.Error(w, fmt.Sprintf("CA %s has no certificate", name), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/pem-certificate-chain")
+	w.Write([]byte(encodeCertificates(ca.Certificates)))
+}
+
+// ---------------------------------------------------------------------
+// Helper Functions
+// ---------------------------------------------------------------------
+
+var errCANotFound = errors.New("certificate authority not found")
+
+func caName(name string) (string, error) {
+	if name == "" {
+		return defaultCAName, nil
+	}
+	if !indexNamePattern.MatchString(name) {
+		return "", errors.New("CA name must be 1-128 characters of letters, digits, '.', '_' or '-'")
+	}
+	return name, nil
+}
+
+// loadCA returns the tenant's CA and its unwrapped signing key.
+func (s *Server) loadCA(r *http.Request, identity auth.Identity, name string) (*storage.CertificateAuthority, crypto.Signer, error) {
+	ca, err := s.CAs.GetCA(r.Context(), identity.Tenant, name)
+	if err != nil {
+		return nil, nil, err
+	}
+	if ca == nil {
+		return nil, nil, errCANotFound
+	}
+	der, err := s.unwrapDEK(r, &storage.DEKDocument{DEK: ca.Key, MasterKeyID: ca.MasterKeyID, TenantID: ca.TenantID})
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to unwrap CA key: %w", err)
+	}
+	defer secmem.Zero(der)
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse CA key: %w", err)
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, nil, fmt.Errorf("CA key is a %T, not a signing key", key)
+	}
+	return ca, signer, nil
+}
+
+func (s *Server) caError(w http.ResponseWriter, r *http.Request, name string, err error) {
+	if errors.Is(err, errCANotFound) {
+		http.Error(w, fmt.Sprintf("CA %s not found", name), http.StatusNotFound)
+		return
+	}
+	errorf(r.Context(), "Failed to load CA %s: %v", name, err)
+	http.Error(w, "internal server error", http.StatusInternalServerError)
+}
+
+func selfSignCA(key *ecdsa.PrivateKey, subject pkix.Name, ttl time.Duration) ([]byte, error) {
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               subject,
+		NotBefore:             now.Add(-certificateBackdate),
+		NotAfter:              now.Add(ttl),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true, // it only issues leaf certificates
+	}
+	return x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+}
+
+// checkCAChain verifies that certs[0] is a CA certificate for pub and that each certificate
+// is signed by the next.
+func checkCAChain(certs []*x509.Certificate, pub crypto.PublicKey, now time.Time) error {
+	leaf := certs[0]
+	if k, ok := leaf.PublicKey.(interface{ Equal(crypto.PublicKey) bool }); !ok || !k.Equal(pub) {
+		return errors.New("the first certificate is not for this CA's key")
+	}
+	if !leaf.BasicConstraintsValid || !leaf.IsCA || leaf.KeyUsage&x509.KeyUsageCertSign == 0 {
+		return errors.New("the first certificate does not allow signing certificates; the parent must issue it as a CA")
+	}
+	for i, c := range certs {
+		if now.Before(c.NotBefore) || !now.Before(c.NotAfter) {
+			return fmt.Errorf("certificate %d (%s) is not valid now", i, c.Subject.CommonName)
+		}
+		if i+1 < len(certs) {
+			if err := c.CheckSignatureFrom(certs[i+1]); err != nil {
+				return fmt.Errorf("certificate %d is not signed by certificate %d: %w", i, i+1, err)
+			}
+		}
+	}
+	return nil
+}
+
+func parseCertificateChain(encoded string) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	rest := []byte(encoded)
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			return nil, fmt.Errorf("unexpected PEM block %q in chain", block.Type)
+		}
+		c, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("invalid certificate in chain: %w", err)
+		}
+		certs = append(certs, c)
+	}
+	if len(certs) == 0 {
+		return nil, errors.New("chain must hold at least one PEM certificate")
+	}
+	if len(bytes.TrimSpace(rest)) > 0 {
+		return nil, errors.New("chain has trailing data that is not PEM")
+	}
+	return certs, nil
+}
+
+func parseCSR(encoded string) (*x509.CertificateRequest, error) {
+	block, _ := pem.Decode([]byte(encoded))
+	if block == nil || block.Type != "CERTIFICATE REQUEST" {
+		return nil, errors.New("csr must be a PEM CERTIFICATE REQUEST")
+	}
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid CSR: %w", err)
+	}
+	if err := csr.CheckSignature(); err != nil {
+		return nil, fmt.Errorf("CSR signature is invalid: %w", err)
+	}
+	switch k := csr.PublicKey.(type) {
+	case *rsa.PublicKey:
+		if k.N.BitLen() < minCertificateRSABits {
+			return nil, fmt.Errorf("RSA keys must be at least %d bits", minCertificateRSABits)
+		}
+	case *ecdsa.PublicKey:
+		if k.Curve != elliptic.P256() && k.Curve != elliptic.P384() {
+			return nil, errors.New("ECDSA keys must be on P-256 or P-384")
+		}
+	case ed25519.PublicKey:
+	default:
+		return nil, fmt.Errorf("unsupported public key type %T", csr.PublicKey)
+	}
+	return csr, nil
+}
+
+func randomSerial() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+func encodeCertificates(ders [][]byte) string {
+	var b strings.Builder
+	for _, der := range ders {
+		b.Write(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+	}
+	return b.String()
+}
+
+func certificateNames(c *x509.Certificate) []string {
+	names := append([]string{}, c.DNSNames...)
+	for _, ip := range c.IPAddresses {
+		names = append(names, ip.String())
+	}
+	for _, u := range c.URIs {
+		names = append(names, u.String())
+	}
+	return names
+}
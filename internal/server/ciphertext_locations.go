@@ -0,0 +1,388 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"my-kms/internal/auth"
+	"my-kms/internal/storage"
+)
+
+// locationNotifyTimeout bounds a single callback notification.
+const locationNotifyTimeout = 10 * time.Second
+
+var locationNotifyClient = &http.Client{Timeout: locationNotifyTimeout}
+
+// CiphertextLocationResponse is the public view of a registered ciphertext location.
+type CiphertextLocationResponse struct {
+	LocationID       string     `json:"locationID"`
+	DEKID            string     `json:"dekID"`
+	Kind             string     `json:"kind"`
+	URI              string     `json:"uri"`
+	Description      string     `json:"description,omitempty"`
+	RegisteredBy     string     `json:"registeredBy"`
+	RegisteredAt     time.Time  `json:"registeredAt"`
+	Status           string     `json:"status"`
+	Reason           string     `json:"reason,omitempty"`
+	ReplacementDEKID string     `json:"replacementDEKID,omitempty"`
+	StatusDetail     string     `json:"statusDetail,omitempty"`
+	StatusUpdatedBy  string     `json:"statusUpdatedBy,omitempty"`
+	StatusUpdatedAt  *time.Time `json:"statusUpdatedAt,omitempty"`
+	LastNotifiedAt   *time.Time `json:"lastNotifiedAt,omitempty"`
+	NotifyError      string     `json:"notifyError,omitempty"`
+}
+
+func ciphertextLocationResponseFromDoc(l *storage.CiphertextLocation) CiphertextLocationResponse {
+	return CiphertextLocationResponse{
+		LocationID:       l.ID.Hex(),
+		DEKID:            l.DEKID,
+		Kind:             l.Kind,
+		URI:              l.URI,
+		Description:      l.Description,
+		RegisteredBy:     l.RegisteredBy,
+		RegisteredAt:     l.RegisteredAt,
+		Status:           l.Status,
+		Reason:           l.Reason,
+		ReplacementDEKID: l.ReplacementDEKID,
+		StatusDetail:     l.StatusDetail,
+		StatusUpdatedBy:  l.StatusUpdatedBy,
+		StatusUpdatedAt:  optionalTime(l.StatusUpdatedAt),
+		LastNotifiedAt:   optionalTime(l.LastNotifiedAt),
+		NotifyError:      l.NotifyError,
+	}
+}
+
+// ---------------------------------------------------------------------
+// Register Ciphertext Location
+// ---------------------------------------------------------------------
+
+type RegisterCiphertextLocationRequest struct {
+	DEKID       string `json:"dekID"`
+	Kind        string `json:"kind"` // s3, mongo or callback
+	URI         string `json:"uri"`
+	Description string `json:"description,omitempty"`
+}
+
+func (s *Server) RegisterCiphertextLocationHandler(w http.ResponseWriter, r *http.Request) {
+	identity, err := getIdentity(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	if err := auth.IsAuthorized(identity, auth.ActionManageKey); err != nil {
+		warnf(r.Context(), "Unauthorized attempt by role=%s to register ciphertext location", identity.Role)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	if s.CiphertextLocations == nil {
+		http.Error(w, "ciphertext locations are not enabled", http.StatusNotFound)
+		return
+	}
+
+	var req RegisterCiphertextLocationRequest
+	if !decodeJSON(w, r.Body, &req) {
+		return
+	}
+	if err := validateCiphertextLocation(req.Kind, req.URI); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if !s.authorizeKeyManagement(w, r, identity, req.DEKID) {
+		return
+	}
+
+	loc, err := s.CiphertextLocations.InsertLocation(r.Context(), storage.CiphertextLocation{
+		TenantID:     identity.Tenant,
+		DEKID:        req.DEKID,
+		Kind:         req.Kind,
+		URI:          req.URI,
+		Description:  req.Description,
+		RegisteredBy: identity.Name,
+	})
+	if err != nil {
+		errorf(r.Context(), "Failed to store ciphertext location: %v", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	auditf(r.Context(), "ciphertext location %s (%s %s) for DEK %s registered by %s", loc.ID.Hex(), req.Kind, req.URI, req.DEKID, identity.Name)
+
+	writeJSON(w, ciphertextLocationResponseFromDoc(loc))
+}
+
+// ---------------------------------------------------------------------
+// List Ciphertext Locations
+// ---------------------------------------------------------------------
+
+type ListCiphertextLocationsRequest struct {
+	DEKID  string `json:"dekID,omitempty"`
+	Status string `json:"status,omitempty"`
+}
+
+type ListCiphertextLocationsResponse struct {
+	Locations []CiphertextLocationResponse `json:"locations"`
+	Summary   map[string]int               `json:"summary"` // count per status
+}
+
+func (s *Server) ListCiphertextLocationsHandler(w http.ResponseWriter, r *http.Request) {
+	identity, err := getIdentity(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	if err := auth.IsAuthorized(identity, auth.ActionListKeys); err != nil {
+		warnf(r.Context(), "Unauthorized attempt by role=%s to list ciphertext locations", identity.Role)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	if s.CiphertextLocations == nil {
+		http.Error(w, "ciphertext locations are not enabled", http.StatusNotFound)
+		return
+	}
+
+	var req ListCiphertextLocationsRequest
+	if !decodeJSON(w, r.Body, &req) {
+		return
+	}
+
+	locs, err := s.CiphertextLocations.ListLocations(r.Context(), identity.Tenant, req.DEKID, req.Status)
+	if err != nil {
+		errorf(r.Context(), "Failed to list ciphertext locations: %v", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	resp := ListCiphertextLocationsResponse{
+		Locations: make([]CiphertextLocationResponse, 0, len(locs)),
+		Summary:   make(map[string]int),
+	}
+	for i := range locs {
+		resp.Locations = append(resp.Locations, ciphertextLocationResponseFromDoc(&locs[i]))
+		resp.Summary[locs[i].Status]++
+	}
+	writeJSON(w, resp)
+}
+
+// ---------------------------------------------------------------------
+// Update Ciphertext Location
+// ---------------------------------------------------------------------
+
+type UpdateCiphertextLocationRequest struct {
+	LocationID string `json:"locationID"`
+	Status     string `json:"status"` // in_progress, done or failed
+	Detail     string `json:"detail,omitempty"`
+}
+
+// UpdateCiphertextLocationHandler lets the location's registrar, or a manager of its key,
+// report downstream re-encryption progress.
+func (s *Server) UpdateCiphertextLocationHandler(w http.ResponseWriter, r *http.Request) {
+	identity, err := getIdentity(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	if s.CiphertextLocations == nil {
+		http.Error(w, "ciphertext locations are not enabled", http.StatusNotFound)
+		return
+	}
+
+	var req UpdateCiphertextLocationRequest
+	if !decodeJSON(w, r.Body, &req) {
+		return
+	}
+	switch req.Status {
+	case storage.ReencryptionInProgress, storage.ReencryptionDone, storage.ReencryptionFailed:
+	default:
+		http.Error(w, "status must be in_progress, done or failed", http.StatusBadRequest)
+		return
+	}
+
+	loc, ok := s.authorizeLocationChange(w, r, identity, req.LocationID, "update")
+	if !ok {
+		return
+	}
+
+	if err := s.CiphertextLocations.UpdateStatus(r.Context(), identity.Tenant, req.LocationID, req.Status, req.Detail, identity.Name); err != nil {
+		errorf(r.Context(), "Failed to update ciphertext location: %v", err)
+		http.Error(w, "ciphertext location not found", http.StatusNotFound)
+		return
+	}
+	auditf(r.Context(), "ciphertext location %s for DEK %s marked %s by %s", req.LocationID, loc.DEKID, req.Status, identity.Name)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ---------------------------------------------------------------------
+// Unregister Ciphertext Location
+// ---------------------------------------------------------------------
+
+type UnregisterCiphertextLocationRequest struct {
+	LocationID string `json:"locationID"`
+}
+
+func (s *Server) UnregisterCiphertextLocationHandler(w http.ResponseWriter, r *http.Request) {
+	identity, err := getIdentity(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	if s.CiphertextLocations == nil {
+		http.Error(w, "ciphertext locations are not enabled", http.StatusNotFound)
+		return
+	}
+
+	var req UnregisterCiphertextLocationRequest
+	if !decodeJSON(w, r.Body, &req) {
+		return
+	}
+
+	loc, ok := s.authorizeLocationChange(w, r, identity, req.LocationID, "unregister")
+	if !ok {
+		return
+	}
+
+	if err := s.CiphertextLocations.DeleteLocation(r.Context(), identity.Tenant, req.LocationID); err != nil {
+		errorf(r.Context(), "Failed to delete ciphertext location: %v", err)
+		http.Error(w, "ciphertext location not found", http.StatusNotFound)
+		return
+	}
+	auditf(r.Context(), "ciphertext location %s for DEK %s unregistered by %s", req.LocationID, loc.DEKID, identity.Name)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ---------------------------------------------------------------------
+// Helper Functions
+// ---------------------------------------------------------------------
+
+func validateCiphertextLocation(kind, uri string) error {
+	if uri == "" {
+		return fmt.Errorf("uri is required")
+	}
+	switch kind {
+	case storage.LocationKindS3:
+		if !strings.HasPrefix(uri, "s3://") || len(uri) == len("s3://") {
+			return fmt.Errorf("s3 locations must be s3://bucket/prefix")
+		}
+	case storage.LocationKindMongo:
+		if db, coll, ok := strings.Cut(uri, "."); !ok || db == "" || coll == "" {
+			return fmt.Errorf("mongo locations must be database.collection")
+		}
+	case storage.LocationKindCallback:
+		u, err := url.Parse(uri)
+		if err != nil || u.Scheme != "https" || u.Host == "" {
+			return fmt.Errorf("callback locations must be an https URL")
+		}
+	default:
+		return fmt.Errorf("kind must be s3, mongo or callback")
+	}
+	return nil
+}
+
+// authorizeLocationChange loads a location and checks that identity registered it or may manage its key.
+func (s *Server) authorizeLocationChange(w http.ResponseWriter, r *http.Request, identity auth.Identity, locationID, verb string) (*storage.CiphertextLocation, bool) {
+	loc, err := s.CiphertextLocations.GetLocation(r.Context(), identity.Tenant, locationID)
+	if err != nil {
+		errorf(r.Context(), "Failed to get ciphertext location: %v", err)
+		http.Error(w, "ciphertext location not found", http.StatusNotFound)
+		return nil, false
+	}
+	if loc.RegisteredBy == identity.Name {
+		return loc, true
+	}
+	if err := auth.IsAuthorized(identity, auth.ActionManageKey); err != nil {
+		warnf(r.Context(), "Unauthorized attempt by role=%s to %s ciphertext location", identity.Role, verb)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return nil, false
+	}
+	if !s.authorizeKeyManagement(w, r, identity, loc.DEKID) {
+		return nil, false
+	}
+	return loc, true
+}
+
+// locationNotice is POSTed to callback locations when their DEK needs re-encryption.
+type locationNotice struct {
+	Event            string    `json:"event"` // always "reencryption_required"
+	LocationID       string    `json:"locationID"`
+	DEKID            string    `json:"dekID"`
+	Reason           string    `json:"reason"`
+	ReplacementDEKID string    `json:"replacementDEKID,omitempty"`
+	At               time.Time `json:"at"`
+}
+
+// flagCiphertextLocations marks every location of a DEK as pending re-encryption and
+// notifies callback locations. Failures are logged but never fail the request.
+func (s *Server) flagCiphertextLocations(r *http.Request, tenantID, dekID, reason, replacementDEKID string) {
+	if s.CiphertextLocations == nil {
+		return
+	}
+	locs, err := s.CiphertextLocations.MarkPending(r.Context(), tenantID, dekID, reason, replacementDEKID)
+	if err != nil {
+		errorf(r.Context(), "Failed to flag ciphertext locations for DEK %s: %v", dekID, err)
+		return
+	}
+	if len(locs) == 0 {
+		return
+	}
+	auditf(r.Context(), "%d ciphertext locations for DEK %s pending re-encryption (%s)", len(locs), dekID, reason)
+
+	for _, loc := range locs {
+		if loc.Kind != storage.LocationKindCallback {
+			continue
+		}
+		go s.notifyCiphertextLocation(loc)
+	}
+}
+
+func (s *Server) notifyCiphertextLocation(loc storage.CiphertextLocation) {
+	body, _ := json.Marshal(locationNotice{
+		Event:            "reencryption_required",
+		LocationID:       loc.ID.Hex(),
+		DEKID:            loc.DEKID,
+		Reason:           loc.Reason,
+		ReplacementDEKID: loc.ReplacementDEKID,
+		At:               time.Now().UTC(),
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), locationNotifyTimeout)
+	notifyErr := postLocationNotice(ctx, loc.URI, body)
+	cancel()
+	if notifyErr != nil {
+		errorf(ctx, "Failed to notify ciphertext location %s: %v", loc.ID.Hex(), notifyErr)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), locationNotifyTimeout)
+	defer cancel()
+	if err := s.CiphertextLocations.RecordNotification(ctx, loc.ID, notifyErr); err != nil {
+		errorf(ctx, "Failed to record notification for ciphertext location %s: %v", loc.ID.Hex(), err)
+	}
+}
+
+func postLocationNotice(ctx context.Context, target string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := locationNotifyClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("callback returned %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,184 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"my-kms/internal/auth"
+)
+
+// ClientCertMode controls whether callers may authenticate with a TLS client certificate.
+type ClientCertMode string
+
+const (
+	// ClientCertOff ignores client certificates.
+	ClientCertOff ClientCertMode = "off"
+	// ClientCertOptional verifies a certificate when one is presented; it authenticates
+	// requests that carry no token or API key.
+	ClientCertOptional ClientCertMode = "optional"
+	// ClientCertRequire refuses connections without a verified certificate. Requests may
+	// still carry a token or API key, which then decides the identity.
+	ClientCertRequire ClientCertMode = "require"
+)
+
+// ParseClientCertMode validates a CLIENT_CERT_MODE value.
+func ParseClientCertMode(v string) (ClientCertMode, error) {
+	switch m := ClientCertMode(v); m {
+	case ClientCertOff, ClientCertOptional, ClientCertRequire:
+		return m, nil
+	case "":
+		return ClientCertOff, nil
+	default:
+		return "", fmt.Errorf("unknown client certificate mode %q", v)
+	}
+}
+
+// ClientCertTLSConfig returns the server TLS settings for mode, trusting the CAs in caFile.
+func ClientCertTLSConfig(mode ClientCertMode, caFile string, minVersion uint16) (*tls.Config, error) {
+	cfg := &tls.Config{MinVersion: minVersion}
+	if mode == ClientCertOff {
+		return cfg, nil
+	}
+	if caFile == "" {
+		return nil, errors.New("a client CA bundle is required for client certificate authentication")
+	}
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read client CA bundle: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New("client CA bundle contains no certificates")
+	}
+	cfg.ClientCAs = pool
+	cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	if mode == ClientCertRequire {
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg, nil
+}
+
+// CertRule maps matching client certificates to a role and tenant. A rule matches on
+// every non-empty field; SPIFFEID may end in "/*" to match everything below a path.
+type CertRule struct {
+	SPIFFEID string    `json:"spiffeID,omitempty"`
+	OU       string    `json:"ou,omitempty"`
+	Role     auth.Role `json:"role"`
+	Tenant   string    `json:"tenant,omitempty"`
+}
+
+// CertMapping is an ordered rule list; the first matching rule wins.
+type CertMapping struct {
+	Rules []CertRule `json:"rules"`
+}
+
+// LoadCertMapping reads and validates a CertMapping from a JSON file.
+func LoadCertMapping(path string) (*CertMapping, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read client certificate mapping: %w", err)
+	}
+	var m CertMapping
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("failed to parse client certificate mapping: %w", err)
+	}
+	for i, r := range m.Rules {
+		if r.SPIFFEID == "" && r.OU == "" {
+			return nil, fmt.Errorf("rule %d: spiffeID or ou is required", i)
+		}
+		if !auth.KnownRole(r.Role) {
+			return nil, fmt.Errorf("rule %d: unknown role %s", i, r.Role)
+		}
+	}
+	return &m, nil
+}
+
+func (m *CertMapping) match(spiffeID string, ous []string) (CertRule, bool) {
+	if m == nil {
+		return CertRule{}, false
+	}
+	for _, r := range m.Rules {
+		if r.SPIFFEID != "" && !spiffeIDMatches(r.SPIFFEID, spiffeID) {
+			continue
+		}
+		if r.OU != "" && !containsOU(ous, r.OU) {
+			continue
+		}
+		return r, true
+	}
+	return CertRule{}, false
+}
+
+func spiffeIDMatches(pattern, id string) bool {
+	if id == "" {
+		return false
+	}
+	if prefix, ok := strings.CutSuffix(pattern, "/*"); ok {
+		return strings.HasPrefix(id, prefix+"/")
+	}
+	return pattern == id
+}
+
+func containsOU(ous []string, ou string) bool {
+	for _, v := range ous {
+		if v == ou {
+			return true
+		}
+	}
+	return false
+}
+
+// errNoClientCert means the connection carried no verified client certificate.
+var errNoClientCert = errors.New("no verified client certificate")
+
+// authenticateClientCert builds an identity from the verified leaf certificate. The name is
+// its SPIFFE ID (URI SAN), or "cert:<CN>" without one; the role comes from the first
+// matching CertMapping rule, or else from the user store record with that name.
+func (s *Server) authenticateClientCert(r *http.Request) (auth.Identity, error) {
+	if s.ClientCertMode == ClientCertOff || s.ClientCertMode == "" ||
+		r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return auth.Identity{}, errNoClientCert
+	}
+	leaf := r.TLS.VerifiedChains[0][0]
+
+	var spiffeID string
+	for _, u := range leaf.URIs {
+		if u.Scheme == "spiffe" {
+			spiffeID = u.String()
+			break
+		}
+	}
+	name := spiffeID
+	if name == "" {
+		if leaf.Subject.CommonName == "" {
+			return auth.Identity{}, errors.New("client certificate has neither a SPIFFE ID nor a common name")
+		}
+		name = "cert:" + leaf.Subject.CommonName
+	}
+
+	if rule, ok := s.CertMapping.match(spiffeID, leaf.Subject.OrganizationalUnit); ok {
+		return auth.Identity{Name: name, Role: rule.Role, Tenant: rule.Tenant}, nil
+	}
+
+	user, degraded, err := s.lookupUser(r.Context(), name)
+	if err != nil {
+		return auth.Identity{}, err
+	}
+	if user.Disabled {
+		return auth.Identity{}, fmt.Errorf("user %s is disabled", name)
+	}
+	return auth.Identity{
+		Name:   name,
+		Role:   auth.Role(user.Role),
+		Tenant: user.TenantID,
+
+		DecryptOnly: degraded,
+		Conditions:  user.Conditions,
+	}, nil
+}
@@ -0,0 +1,173 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"my-kms/internal/auth"
+	"my-kms/internal/storage"
+)
+
+// ClientHeader carries the calling SDK as "<name>/<version>", e.g. "kms-go/1.4.2".
+const ClientHeader = "X-KMS-Client"
+
+const maxUserAgentLength = 256
+
+// ClientTracker aggregates client fingerprints in memory and periodically flushes them to storage.
+type ClientTracker struct {
+	store   *storage.MongoClientStore
+	blocked []string // "<name>/<version>" entries; a trailing "*" matches any version with that prefix
+
+	mu        sync.Mutex
+	sightings map[clientKey]*storage.ClientSighting
+}
+
+type clientKey struct {
+	identity, sdk, version, userAgent string
+}
+
+// NewClientTracker creates a tracker. blocked is a comma-separated list of refused client versions.
+// With a nil store, blocked versions are still refused but sightings are not kept.
+func NewClientTracker(store *storage.MongoClientStore, blocked string) *ClientTracker {
+	t := &ClientTracker{
+		store:     store,
+		sightings: make(map[clientKey]*storage.ClientSighting),
+	}
+	for _, b := range strings.Split(blocked, ",") {
+		if b = strings.TrimSpace(b); b != "" {
+			t.blocked = append(t.blocked, b)
+		}
+	}
+	return t
+}
+
+// parseClientHeader splits "<name>/<version>" into its parts.
+func parseClientHeader(v string) (string, string) {
+	name, version, _ := strings.Cut(strings.TrimSpace(v), "/")
+	return name, version
+}
+
+// IsBlocked reports whether the client header names a refused version.
+func (t *ClientTracker) IsBlocked(clientHeader string) bool {
+	name, version := parseClientHeader(clientHeader)
+	if name == "" {
+		return false
+	}
+	client := name + "/" + version
+	for _, b := range t.blocked {
+		if prefix, ok := strings.CutSuffix(b, "*"); ok {
+			if strings.HasPrefix(client, prefix) {
+				return true
+			}
+		} else if client == b {
+			return true
+		}
+	}
+	return false
+}
+
+// Observe records one request from identity.
+func (t *ClientTracker) Observe(identity string, r *http.Request) {
+	name, version := parseClientHeader(r.Header.Get(ClientHeader))
+	ua := r.UserAgent()
+	if len(ua) > maxUserAgentLength {
+		ua = ua[:maxUserAgentLength]
+	}
+	key := clientKey{identity: identity, sdk: name, version: version, userAgent: ua}
+	now := time.Now().UTC()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	cs, ok := t.sightings[key]
+	if !ok {
+		cs = &storage.ClientSighting{Identity: identity, SDK: name, SDKVersion: version, UserAgent: ua, FirstSeen: now}
+		t.sightings[key] = cs
+	}
+	cs.Requests++
+	cs.LastSeen = now
+}
+
+// Run flushes aggregated sightings every interval until ctx is cancelled, then flushes once more.
+func (t *ClientTracker) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			t.flush(context.Background())
+			return
+		case <-ticker.C:
+			t.flush(ctx)
+		}
+	}
+}
+
+func (t *ClientTracker) flush(ctx context.Context) {
+	t.mu.Lock()
+	batch := make([]storage.ClientSighting, 0, len(t.sightings))
+	for _, cs := range t.sightings {
+		batch = append(batch, *cs)
+	}
+	t.sightings = make(map[clientKey]*storage.ClientSighting)
+	t.mu.Unlock()
+
+	if t.store == nil {
+		return
+	}
+	if err := t.store.RecordSightings(ctx, batch); err != nil {
+		errorf(ctx, "Failed to flush %d client sightings: %v", len(batch), err)
+	}
+}
+
+// ---------------------------------------------------------------------
+// Client Adoption Report
+// ---------------------------------------------------------------------
+
+type ClientAdoptionResponse struct {
+	Clients []storage.ClientAdoption `json:"clients"`
+}
+
+func (s *Server) ClientAdoptionHandler(w http.ResponseWriter, r *http.Request) {
+	identity, err := getIdentity(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	if err := auth.IsAuthorized(identity, auth.ActionViewClientReport); err != nil {
+		warnf(r.Context(), "Unauthorized attempt by role=%s to view client adoption", identity.Role)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	if s.ClientStore == nil {
+		http.Error(w, "client tracking is not enabled", http.StatusNotFound)
+		return
+	}
+
+	report, err := s.ClientStore.AdoptionReport(r.Context())
+	if err != nil {
+		errorf(r.Context(), "Failed to build client adoption report: %v", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	if report == nil {
+		report = []storage.ClientAdoption{}
+	}
+	writeJSON(w, ClientAdoptionResponse{Clients: report})
+}
+
+// rejectBlockedClient writes a 426 and returns true if the request comes from a refused client version.
+func (s *Server) rejectBlockedClient(w http.ResponseWriter, r *http.Request) bool {
+	if s.Clients == nil || !s.Clients.IsBlocked(r.Header.Get(ClientHeader)) {
+		return false
+	}
+	warnf(r.Context(), "Refused request from blocked client %q at %s", r.Header.Get(ClientHeader), r.RemoteAddr)
+	http.Error(w, fmt.Sprintf("client %s is no longer supported; please upgrade", r.Header.Get(ClientHeader)), http.StatusUpgradeRequired)
+	return true
+}
@@ -0,0 +1,261 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+
+	"my-kms/internal/auth"
+	"my-kms/internal/cmk"
+	"my-kms/internal/crypto"
+	"my-kms/internal/secmem"
+	"my-kms/internal/storage"
+	"my-kms/internal/tracing"
+)
+
+// cmkKeyIDPrefix marks DEKs wrapped by a tenant's CMK rather than a master key.
+const cmkKeyIDPrefix = "cmk:"
+
+// ---------------------------------------------------------------------
+// Register CMK
+// ---------------------------------------------------------------------
+
+type RegisterCMKRequest struct {
+	Provider    string `json:"provider"` // vault
+	Endpoint    string `json:"endpoint"`
+	KeyName     string `json:"keyName"`
+	Credentials string `json:"credentials"` // e.g. a Vault token; stored wrapped, never returned
+}
+
+type CMKResponse struct {
+	TenantID     string    `json:"tenantID,omitempty"`
+	Provider     string    `json:"provider"`
+	Endpoint     string    `json:"endpoint"`
+	KeyName      string    `json:"keyName"`
+	KeyID        string    `json:"keyID"` // masterKeyID recorded on DEKs wrapped by this CMK
+	RegisteredBy string    `json:"registeredBy"`
+	RegisteredAt time.Time `json:"registeredAt"`
+}
+
+func cmkResponseFromDoc(c *storage.TenantCMK) CMKResponse {
+	return CMKResponse{
+		TenantID:     c.TenantID,
+		Provider:     c.Provider,
+		Endpoint:     c.Endpoint,
+		KeyName:      c.KeyName,
+		KeyID:        cmkKeyID(c),
+		RegisteredBy: c.RegisteredBy,
+		RegisteredAt: c.RegisteredAt,
+	}
+}
+
+// RegisterCMKHandler points the caller's tenant at an external key. New DEKs in the
+// tenant are wrapped by it; existing DEKs keep the key they were wrapped with.
+func (s *Server) RegisterCMKHandler(w http.ResponseWriter, r *http.Request) {
+	identity, err := getIdentity(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	if err := auth.IsAuthorized(identity, auth.ActionManageCMK); err != nil {
+		warnf(r.Context(), "Unauthorized attempt by role=%s to register CMK", identity.Role)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	if s.TenantCMKs == nil {
+		http.Error(w, "customer-managed keys are not enabled", http.StatusNotFound)
+		return
+	}
+
+	var req RegisterCMKRequest
+	if !decodeJSON(w, r.Body, &req) {
+		return
+	}
+
+	provider, err := cmk.New(cmk.Config{
+		Provider:    req.Provider,
+		Endpoint:    req.Endpoint,
+		KeyName:     req.KeyName,
+		Credentials: req.Credentials,
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Prove the key works before any DEK depends on it.
+	probe, err := crypto.GenerateKeyFor(crypto.DefaultAlgorithm)
+	if err != nil {
+		errorf(r.Context(), "Failed to generate CMK probe: %v", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	wrapped, err := provider.Wrap(r.Context(), probe)
+	if err == nil {
+		var unwrapped []byte
+		if unwrapped, err = provider.Unwrap(r.Context(), wrapped); err == nil && !bytes.Equal(unwrapped, probe) {
+			err = fmt.Errorf("round trip returned different key material")
+		}
+	}
+	if err != nil {
+		warnf(r.Context(), "CMK verification failed: %v", err)
+		http.Error(w, "CMK verification failed: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	wrappedCreds, credsKeyID, err := s.KeyStore.EncryptDataKey(r.Context(), []byte(req.Credentials))
+	if err != nil {
+		errorf(r.Context(), "Failed to wrap CMK credentials: %v", err)
+		http.Error(w, "encryption failed", http.StatusInternalServerError)
+		return
+	}
+
+	doc := storage.TenantCMK{
+		TenantID:               identity.Tenant,
+		Provider:               strings.ToLower(req.Provider),
+		Endpoint:               req.Endpoint,
+		KeyName:                req.KeyName,
+		WrappedCredentials:     wrappedCreds,
+		CredentialsMasterKeyID: credsKeyID,
+		RegisteredBy:           identity.Name,
+		RegisteredAt:           time.Now().UTC(),
+	}
+	if err := s.TenantCMKs.UpsertTenantCMK(r.Context(), doc); err != nil {
+		errorf(r.Context(), "Failed to store tenant CMK: %v", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	auditf(r.Context(), "tenant %q CMK set to %s by %s", identity.Tenant, cmkKeyID(&doc), identity.Name)
+
+	writeJSON(w, cmkResponseFromDoc(&doc))
+}
+
+// ---------------------------------------------------------------------
+// Describe CMK
+// ---------------------------------------------------------------------
+
+func (s *Server) DescribeCMKHandler(w http.ResponseWriter, r *http.Request) {
+	identity, err := getIdentity(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	if err := auth.IsAuthorized(identity, auth.ActionDescribeKey); err != nil {
+		warnf(r.Context(), "Unauthorized attempt by role=%s to describe CMK", identity.Role)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	if s.TenantCMKs == nil {
+		http.Error(w, "customer-managed keys are not enabled", http.StatusNotFound)
+		return
+	}
+
+	doc, err := s.TenantCMKs.GetTenantCMK(r.Context(), identity.Tenant)
+	if err != nil {
+		errorf(r.Context(), "Failed to get tenant CMK: %v", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	if doc == nil {
+		http.Error(w, "tenant has no CMK registered", http.StatusNotFound)
+		return
+	}
+
+	writeJSON(w, cmkResponseFromDoc(doc))
+}
+
+// ---------------------------------------------------------------------
+// Helper Functions
+// ---------------------------------------------------------------------
+
+func cmkKeyID(c *storage.TenantCMK) string {
+	return cmkKeyIDPrefix + c.Provider + ":" + c.KeyName
+}
+
+// tenantCMK returns the tenant's CMK provider and its key ID, or a nil provider when
+// the tenant uses the server's master keys.
+func (s *Server) tenantCMK(r *http.Request, tenant string) (cmk.Provider, string, error) {
+	if s.TenantCMKs == nil {
+		return nil, "", nil
+	}
+	doc, err := s.TenantCMKs.GetTenantCMK(r.Context(), tenant)
+	if err != nil || doc == nil {
+		return nil, "", err
+	}
+	creds, err := s.KeyStore.DecryptDataKey(doc.WrappedCredentials, doc.CredentialsMasterKeyID)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to unwrap CMK credentials: %w", err)
+	}
+	defer secmem.Zero(creds)
+	provider, err := cmk.New(cmk.Config{
+		Provider:    doc.Provider,
+		Endpoint:    doc.Endpoint,
+		KeyName:     doc.KeyName,
+		Credentials: string(creds),
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return provider, cmkKeyID(doc), nil
+}
+
+// wrapDEK wraps a new DEK with the tenant's CMK if it has one, otherwise with the active
+// master key. It returns the wrapped key and the ID to record as its masterKeyID.
+func (s *Server) wrapDEK(r *http.Request, tenant string, dek []byte) (_ []byte, _ string, err error) {
+	ctx, span := tracing.Start(r.Context(), "wrap-dek")
+	defer func() { tracing.End(span, err) }()
+	r = r.WithContext(ctx)
+
+	provider, keyID, err := s.tenantCMK(r, tenant)
+	if err != nil {
+		if !s.failOpen(r.Context(), SubsystemTenantCMK, err) {
+			return nil, "", err
+		}
+		provider = nil
+	}
+	if provider == nil {
+		return s.KeyStore.EncryptDataKey(r.Context(), dek)
+	}
+	wrapped, err := provider.Wrap(r.Context(), dek)
+	if err != nil {
+		return nil, "", err
+	}
+	return wrapped, keyID, nil
+}
+
+// unwrapDEK reverses wrapDEK for a stored DEK document.
+func (s *Server) unwrapDEK(r *http.Request, doc *storage.DEKDocument) (_ []byte, err error) {
+	ctx, span := tracing.Start(r.Context(), "unwrap-dek", attribute.String("kms.master_key_id", doc.MasterKeyID))
+	defer func() { tracing.End(span, err) }()
+	r = r.WithContext(ctx)
+
+	if !strings.HasPrefix(doc.MasterKeyID, cmkKeyIDPrefix) {
+		return s.KeyStore.DecryptDataKey(doc.DEK, doc.MasterKeyID)
+	}
+	provider, keyID, err := s.tenantCMK(r, doc.TenantID)
+	if err != nil {
+		return nil, err
+	}
+	if provider == nil || keyID != doc.MasterKeyID {
+		return nil, fmt.Errorf("CMK %s is no longer registered for this tenant", doc.MasterKeyID)
+	}
+	return provider.Unwrap(r.Context(), doc.DEK)
+}
+
+// canUnwrap is the validate-only check that the key wrapping doc is available.
+// For CMKs it confirms the registration, not that the external service is reachable.
+func (s *Server) canUnwrap(r *http.Request, doc *storage.DEKDocument) bool {
+	if !strings.HasPrefix(doc.MasterKeyID, cmkKeyIDPrefix) {
+		return s.KeyStore.HasKey(doc.MasterKeyID)
+	}
+	_, keyID, err := s.tenantCMK(r, doc.TenantID)
+	return err == nil && keyID == doc.MasterKeyID
+}
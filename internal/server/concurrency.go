@@ -0,0 +1,127 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"my-kms/internal/metrics"
+)
+
+// ConcurrencyLimit caps an endpoint's requests in flight at InFlight. Up to Queue more
+// wait for a slot; beyond that they are shed.
+type ConcurrencyLimit struct {
+	InFlight int
+	Queue    int
+}
+
+// ParseConcurrencyLimits reads "path=N" or "path=N:queue" pairs separated by commas,
+// such as "/decrypt=64:256,/encrypt=128". The queue defaults to N; "off" removes the
+// limit.
+func ParseConcurrencyLimits(s string) (map[string]ConcurrencyLimit, error) {
+	limits := map[string]ConcurrencyLimit{}
+	for _, pair := range strings.Split(s, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		path, spec, ok := strings.Cut(pair, "=")
+		path, spec = strings.TrimSpace(path), strings.TrimSpace(spec)
+		if !ok || !strings.HasPrefix(path, "/") {
+			return nil, fmt.Errorf("invalid concurrency limit %q; expected /path=N[:queue]", pair)
+		}
+		if spec == "off" {
+			delete(limits, path)
+			continue
+		}
+		inFlight, queue, hasQueue := strings.Cut(spec, ":")
+		var l ConcurrencyLimit
+		var err error
+		if l.InFlight, err = strconv.Atoi(inFlight); err != nil || l.InFlight <= 0 {
+			return nil, fmt.Errorf("endpoint %s: in-flight limit must be a positive integer", path)
+		}
+		l.Queue = l.InFlight
+		if hasQueue {
+			if l.Queue, err = strconv.Atoi(queue); err != nil || l.Queue < 0 {
+				return nil, fmt.Errorf("endpoint %s: queue must be a non-negative integer", path)
+			}
+		}
+		limits[path] = l
+	}
+	return limits, nil
+}
+
+// ConcurrencyLimiter sheds load per endpoint, so that a burst on one (typically
+// /decrypt, each call an unwrap and a MongoDB read) can't starve the rest. Limits are
+// per instance.
+type ConcurrencyLimiter struct {
+	queueTimeout time.Duration
+	gates        map[string]*concurrencyGate
+}
+
+type concurrencyGate struct {
+	slots  chan struct{}
+	queued atomic.Int64
+	queue  int64
+}
+
+// NewConcurrencyLimiter creates a limiter for limits, keyed by route pattern. A queued
+// request is shed after queueTimeout.
+func NewConcurrencyLimiter(limits map[string]ConcurrencyLimit, queueTimeout time.Duration) *ConcurrencyLimiter {
+	c := &ConcurrencyLimiter{queueTimeout: queueTimeout, gates: map[string]*concurrencyGate{}}
+	for path, l := range limits {
+		c.gates[path] = &concurrencyGate{slots: make(chan struct{}, l.InFlight), queue: int64(l.Queue)}
+	}
+	return c
+}
+
+// Middleware runs requests to limited endpoints once a slot is free, and answers 503
+// with Retry-After when the queue is full or the wait too long.
+func (c *ConcurrencyLimiter) Middleware(mux *http.ServeMux, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, pattern := mux.Handler(r)
+		g := c.gates[pattern]
+		if g == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if reason := g.acquire(r, c.queueTimeout); reason != "" {
+			if r.Context().Err() != nil {
+				return // the client gave up while queued
+			}
+			metrics.LoadShed.Inc(pattern, reason)
+			warnf(r.Context(), "Shedding %s request: %s", pattern, strings.ReplaceAll(reason, "_", " "))
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "server is busy; retry later", http.StatusServiceUnavailable)
+			return
+		}
+		defer func() { <-g.slots }()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// acquire takes a slot, waiting in the queue if there is room, and returns why it
+// couldn't otherwise.
+func (g *concurrencyGate) acquire(r *http.Request, timeout time.Duration) string {
+	select {
+	case g.slots <- struct{}{}:
+		return ""
+	default:
+	}
+	defer g.queued.Add(-1)
+	if g.queued.Add(1) > g.queue {
+		return "queue_full"
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case g.slots <- struct{}{}:
+		return ""
+	case <-timer.C:
+		return "queue_timeout"
+	case <-r.Context().Done():
+		return "canceled"
+	}
+}
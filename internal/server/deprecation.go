@@ -0,0 +1,119 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"my-kms/internal/auth"
+	"my-kms/internal/events"
+	"my-kms/internal/storage"
+)
+
+// ---------------------------------------------------------------------
+// Deprecate Key
+// ---------------------------------------------------------------------
+
+type DeprecateKeyRequest struct {
+	DEKID            string     `json:"dekID"`
+	Deprecated       bool       `json:"deprecated"`                 // false clears an earlier deprecation
+	SunsetAt         *time.Time `json:"sunsetAt,omitempty"`         // when the key is expected to stop working
+	ReplacementDEKID string     `json:"replacementDEKID,omitempty"` // key consumers should move to
+	Reason           string     `json:"reason,omitempty"`           // kept in the rotation history with a replacement
+}
+
+func (s *Server) DeprecateKeyHandler(w http.ResponseWriter, r *http.Request) {
+	identity, err := getIdentity(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	if err := auth.IsAuthorized(identity, auth.ActionManageKey); err != nil {
+		warnf(r.Context(), "Unauthorized attempt by role=%s to deprecate key", identity.Role)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	var req DeprecateKeyRequest
+	if !decodeJSON(w, r.Body, &req) {
+		return
+	}
+
+	var deprecatedAt, sunsetAt time.Time
+	if req.Deprecated {
+		deprecatedAt = time.Now().UTC()
+		if req.SunsetAt != nil {
+			sunsetAt = req.SunsetAt.UTC()
+			if !sunsetAt.After(deprecatedAt) {
+				http.Error(w, "sunsetAt must be in the future", http.StatusBadRequest)
+				return
+			}
+		}
+		if req.ReplacementDEKID != "" {
+			if req.ReplacementDEKID == req.DEKID {
+				http.Error(w, "a key cannot replace itself", http.StatusBadRequest)
+				return
+			}
+			if _, err := s.DEKStore.GetDEK(r.Context(), identity.Tenant, req.ReplacementDEKID); err != nil {
+				http.Error(w, "replacement DEK not found", http.StatusBadRequest)
+				return
+			}
+		}
+	}
+
+	if !s.authorizeKeyManagement(w, r, identity, req.DEKID) {
+		return
+	}
+
+	if err := s.DEKStore.SetDEKDeprecation(r.Context(), identity.Tenant, req.DEKID, deprecatedAt, sunsetAt, req.ReplacementDEKID); err != nil {
+		errorf(r.Context(), "Failed to update DEK deprecation: %v", err)
+		http.Error(w, "failed to update DEK deprecation", http.StatusBadRequest)
+		return
+	}
+	auditf(r.Context(), "DEK %s deprecated=%t by %s", req.DEKID, req.Deprecated, identity.Name)
+	if req.Deprecated && req.ReplacementDEKID != "" {
+		s.flagCiphertextLocations(r, identity.Tenant, req.DEKID, storage.ReencryptionReasonRotated, req.ReplacementDEKID)
+		s.recordKeyRotation(r.Context(), storage.KeyRotationEvent{
+			KeyType:   storage.RotatedKeyData,
+			Method:    storage.RotationMethodReplace,
+			TenantID:  identity.Tenant,
+			KeyID:     req.DEKID,
+			NewKeyID:  req.ReplacementDEKID,
+			RotatedBy: identity.Name,
+			Reason:    req.Reason,
+		})
+		s.publishEvent(r, events.KeyRotated, req.DEKID, map[string]string{"replacementKeyId": req.ReplacementDEKID})
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ---------------------------------------------------------------------
+// Helper Functions
+// ---------------------------------------------------------------------
+
+// setDeprecationHeaders emits the Deprecation (RFC 9745) and Sunset (RFC 8594) headers.
+func setDeprecationHeaders(w http.ResponseWriter, deprecatedAt, sunsetAt time.Time) {
+	if deprecatedAt.IsZero() {
+		return
+	}
+	w.Header().Set("Deprecation", fmt.Sprintf("@%d", deprecatedAt.Unix()))
+	if !sunsetAt.IsZero() {
+		w.Header().Set("Sunset", sunsetAt.UTC().Format(http.TimeFormat))
+	}
+}
+
+// signalKeyDeprecation adds deprecation headers for a deprecated DEK and records its continued use.
+func signalKeyDeprecation(w http.ResponseWriter, r *http.Request, doc *storage.DEKDocument) {
+	if doc.DeprecatedAt.IsZero() {
+		return
+	}
+	setDeprecationHeaders(w, doc.DeprecatedAt, doc.SunsetAt)
+	if doc.ReplacementDEKID != "" {
+		w.Header().Set("X-KMS-Replacement-Key", doc.ReplacementDEKID)
+	}
+
+	identity, _ := getIdentity(r)
+	auditf(r.Context(), "deprecated DEK %s used by %s via %s", doc.ID.Hex(), identity.Name, r.URL.Path)
+}
@@ -0,0 +1,110 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+
+	"my-kms/internal/auth"
+	"my-kms/internal/crypto"
+	"my-kms/internal/secmem"
+)
+
+// defaultDerivedKeySize is the size /derive-key returns unless asked otherwise.
+const defaultDerivedKeySize = 32
+
+// ---------------------------------------------------------------------
+// Derive Key
+// ---------------------------------------------------------------------
+
+type DeriveKeyRequest struct {
+	DEKID string `json:"dekID"`
+	Alias string `json:"alias,omitempty"` // alternative to dekID
+
+	Info []byte `json:"info"`           // base64; names the purpose, required
+	Salt []byte `json:"salt,omitempty"` // base64
+	Size int    `json:"size,omitempty"` // bytes; defaults to 32
+}
+
+type DeriveKeyResponse struct {
+	DEKID string `json:"dekID"`
+	Key   []byte `json:"key"` // base64
+}
+
+// DeriveKeyHandler returns HKDF-SHA256 of an HKDF_SHA256 root secret under the caller's
+// info and salt. The derived key leaves the KMS; the root never does.
+func (s *Server) DeriveKeyHandler(w http.ResponseWriter, r *http.Request) {
+	identity, err := getIdentity(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	if err := auth.IsAuthorized(identity, auth.ActionDeriveKey); err != nil {
+		warnf(r.Context(), "Unauthorized attempt by role=%s to derive key", identity.Role)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	var req DeriveKeyRequest
+	if !decodeJSON(w, http.MaxBytesReader(w, r.Body, 8*crypto.MaxDerivationInfoSize), &req) {
+		return
+	}
+	if req.Size == 0 {
+		req.Size = defaultDerivedKeySize
+	}
+	dekID, _, err := s.resolveKey(r, identity.Tenant, req.DEKID, req.Alias)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	dekDoc, err := s.DEKStore.GetDEK(r.Context(), identity.Tenant, dekID)
+	if err != nil {
+		errorf(r.Context(), "Failed to get DEK: %v", err)
+		http.Error(w, "DEK not found", http.StatusBadRequest)
+		return
+	}
+	auditKey(r, dekID, nil)
+	if err := checkKeyPolicy(r.Context(), identity, dekDoc, keyOpDerive, nil); err != nil {
+		warnf(r.Context(), "Unauthorized attempt by role=%s to derive key", identity.Role)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if err := checkKeyUsable(dekDoc); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, err := s.requireKeyAlgorithm(dekDoc, crypto.AlgorithmHKDFSHA256); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	signalKeyDeprecation(w, r, dekDoc)
+	if !s.meterUsage(w, r, identity, dekID, quotaOpDeriveKey, false, true) {
+		return
+	}
+
+	root, err := s.unwrapDEK(r, dekDoc)
+	if err != nil {
+		errorf(r.Context(), "Failed to decrypt DEK: %v", err)
+		http.Error(w, "failed to unwrap DEK", http.StatusInternalServerError)
+		return
+	}
+	defer secmem.Zero(root)
+
+	endCrypto := traceCrypto(r, "derive-key", crypto.AlgorithmHKDFSHA256)
+	key, err := crypto.DeriveKey(root, req.Salt, req.Info, req.Size)
+	endCrypto(err)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer secmem.Zero(key)
+	s.touchDEK(r, identity.Tenant, dekID)
+
+	// The info may itself be sensitive; its hash is enough to tell purposes apart.
+	infoHash := sha256.Sum256(req.Info)
+	auditf(r.Context(), "Derived a %d-byte key from DEK %s for info %s by %s", req.Size, dekID, hex.EncodeToString(infoHash[:8]), identity.Name)
+
+	writeJSON(w, DeriveKeyResponse{DEKID: dekID, Key: key})
+}
@@ -0,0 +1,32 @@
+package server
+
+import (
+	"fmt"
+
+	"my-kms/internal/auth"
+	"my-kms/internal/crypto"
+)
+
+// Deterministic keys (AES_256_SIV) encrypt equal values to equal ciphertexts so that
+// applications can look encrypted fields up by equality. That leaks which records share
+// a value, so using them is opted into twice: the role must hold
+// ENCRYPT_DETERMINISTIC, and every encrypt request must say deterministic: true.
+
+// authorizeDeterministic checks that identity may create or encrypt with a key of alg.
+func authorizeDeterministic(identity auth.Identity, alg crypto.Algorithm) error {
+	if !alg.Deterministic() {
+		return nil
+	}
+	return auth.IsAuthorized(identity, auth.ActionEncryptDeterministic)
+}
+
+// checkDeterministicRequest matches an encrypt request's deterministic flag to the key.
+func checkDeterministicRequest(alg crypto.Algorithm, requested bool) error {
+	switch {
+	case alg.Deterministic() && !requested:
+		return fmt.Errorf("key uses deterministic algorithm %s; set deterministic to true to acknowledge that equal values encrypt alike", alg)
+	case requested && !alg.Deterministic():
+		return fmt.Errorf("key uses randomized algorithm %s; deterministic encryption needs a key generated with %s", alg, crypto.AlgorithmAES256SIV)
+	}
+	return nil
+}
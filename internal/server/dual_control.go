@@ -0,0 +1,90 @@
+package server
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"my-kms/internal/auth"
+)
+
+// DefaultApprovalTTL is how long a dual-control request waits for its second approver.
+const DefaultApprovalTTL = time.Hour
+
+// DualControl holds destructive requests until a second, different identity repeats them.
+type DualControl struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	pending map[string]pendingApproval
+}
+
+type pendingApproval struct {
+	requestedBy string
+	expiresAt   time.Time
+}
+
+// NewDualControl creates a DualControl whose requests expire after ttl.
+func NewDualControl(ttl time.Duration) *DualControl {
+	return &DualControl{ttl: ttl, pending: make(map[string]pendingApproval)}
+}
+
+// PendingApprovalResponse is returned with 202 while a request waits for a second approver.
+type PendingApprovalResponse struct {
+	PendingApproval bool      `json:"pendingApproval"`
+	Operation       string    `json:"operation"`
+	Target          string    `json:"target,omitempty"`
+	RequestedBy     string    `json:"requestedBy"`
+	ExpiresAt       time.Time `json:"expiresAt"`
+}
+
+// requireSecondApprover reports whether the operation may go ahead. With dual control on,
+// the first request is recorded and answered with 202; the same request from another
+// identity before it expires is the approval and proceeds.
+func (s *Server) requireSecondApprover(w http.ResponseWriter, r *http.Request, identity auth.Identity, operation, target string) bool {
+	d := s.DualControl
+	if d == nil {
+		return true
+	}
+	key := identity.Tenant + "|" + operation + "|" + target
+	now := time.Now().UTC()
+
+	d.mu.Lock()
+	p, ok := d.pending[key]
+	if ok && now.After(p.expiresAt) {
+		ok = false
+	}
+	approved := ok && p.requestedBy != identity.Name
+	if approved {
+		delete(d.pending, key)
+	} else if !ok {
+		p = pendingApproval{requestedBy: identity.Name, expiresAt: now.Add(d.ttl)}
+		d.pending[key] = p
+	}
+	for k, v := range d.pending {
+		if now.After(v.expiresAt) {
+			delete(d.pending, k)
+		}
+	}
+	d.mu.Unlock()
+
+	if approved {
+		auditf(r.Context(), "dual control: %s %s requested by %s approved by %s", operation, target, p.requestedBy, identity.Name)
+		return true
+	}
+	if p.requestedBy == identity.Name && ok {
+		auditf(r.Context(), "dual control: %s %s repeated by %s, still awaiting a second approver", operation, target, identity.Name)
+	} else {
+		auditf(r.Context(), "dual control: %s %s requested by %s, awaiting a second approver", operation, target, identity.Name)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	writeJSON(w, PendingApprovalResponse{
+		PendingApproval: true,
+		Operation:       operation,
+		Target:          target,
+		RequestedBy:     p.requestedBy,
+		ExpiresAt:       p.expiresAt,
+	})
+	return false
+}
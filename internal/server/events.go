@@ -0,0 +1,222 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+
+	"my-kms/internal/auth"
+	"my-kms/internal/events"
+)
+
+// eventStreamBuffer is how many events a /events subscriber may fall behind by before
+// it is cut off.
+const eventStreamBuffer = 256
+
+// eventStreamKeepalive is how often an idle /events stream sends a comment, so proxies
+// don't time it out.
+const eventStreamKeepalive = 15 * time.Second
+
+// publishEvent tells the event sinks and /events subscribers about a change the caller
+// of r made to a key in its tenant.
+func (s *Server) publishEvent(r *http.Request, typ events.Type, keyID string, data map[string]string) {
+	identity, _ := getIdentity(r)
+	s.publishEventAs(identity.Name, identity.Tenant, typ, keyID, data)
+}
+
+// publishEventAs publishes a change made by actor, "kms" for the server's own. Master
+// key events have no tenant.
+func (s *Server) publishEventAs(actor, tenantID string, typ events.Type, keyID string, data map[string]string) {
+	if s.Events == nil && s.Outbox == nil {
+		return
+	}
+	ev := events.Event{
+		ID:       uuid.NewString(),
+		Type:     typ,
+		Time:     time.Now().UTC(),
+		TenantID: tenantID,
+		KeyID:    keyID,
+		Actor:    actor,
+		Data:     data,
+	}
+	if s.Outbox != nil {
+		// The outbox is written before anyone hears of the event, so the broker sees
+		// it even if the server dies straight after.
+		ctx, cancel := context.WithTimeout(context.Background(), auditWriteTimeout)
+		err := s.Outbox.AddEvent(ctx, ev)
+		cancel()
+		if err != nil {
+			errorf(ctx, "Failed to add %s event for %s to the event outbox: %v", typ, keyID, err)
+		}
+	}
+	if s.Events != nil {
+		s.Events.Publish(ev)
+	}
+}
+
+// Backoff between failed relays of the event outbox.
+const (
+	minRelayBackoff = time.Second
+	maxRelayBackoff = time.Minute
+)
+
+// RunEventRelay publishes the event outbox to its broker every interval, in batches of
+// batchSize, until ctx is cancelled. Published messages are kept for keep. While the
+// broker is failing, attempts back off up to a minute apart.
+func (s *Server) RunEventRelay(ctx context.Context, interval time.Duration, batchSize int, keep time.Duration) {
+	wait := interval
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+		var err error
+		s.withClusterLock(ctx, LockEventRelay, func(ctx context.Context) {
+			err = s.relayEvents(ctx, batchSize, keep)
+		})
+		switch {
+		case err == nil:
+			wait = interval
+		case ctx.Err() != nil:
+			return
+		default:
+			wait = min(max(2*wait, minRelayBackoff), maxRelayBackoff)
+			warnf(ctx, "Failed to publish the event outbox to %s, retrying in %s: %v", s.Outbox.Name(), wait, err)
+		}
+	}
+}
+
+// relayEvents publishes batches until the outbox is empty.
+func (s *Server) relayEvents(ctx context.Context, batchSize int, keep time.Duration) error {
+	for ctx.Err() == nil {
+		n, err := s.Outbox.Relay(ctx, batchSize, keep)
+		if err != nil {
+			return err
+		}
+		if n < batchSize {
+			return nil
+		}
+	}
+	return nil
+}
+
+// ---------------------------------------------------------------------
+// Event Stream
+// ---------------------------------------------------------------------
+
+// EventsHandler streams key lifecycle events as Server-Sent Events until the client goes
+// away. ?types= takes a comma-separated list of event types; the default is all of them.
+// Tenant callers see their tenant's events and master key events; platform callers see
+// every tenant's. An API key with a key scope sees only its keys.
+func (s *Server) EventsHandler(w http.ResponseWriter, r *http.Request) {
+	identity, err := getIdentity(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	if err := auth.IsAuthorized(identity, auth.ActionSubscribeEvents); err != nil {
+		warnf(r.Context(), "Unauthorized attempt by role=%s to subscribe to events", identity.Role)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	if s.Events == nil {
+		http.Error(w, "events are not enabled", http.StatusNotFound)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "use GET", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var types []events.Type
+	if v := r.URL.Query().Get("types"); v != "" {
+		for _, t := range strings.Split(v, ",") {
+			typ := events.Type(strings.TrimSpace(t))
+			if !slices.Contains(events.AllTypes, typ) {
+				http.Error(w, fmt.Sprintf("unknown event type %q", typ), http.StatusBadRequest)
+				return
+			}
+			types = append(types, typ)
+		}
+	}
+
+	sub := s.Events.Subscribe(eventStreamBuffer, func(ev events.Event) bool {
+		if len(types) > 0 && !slices.Contains(types, ev.Type) {
+			return false
+		}
+		if identity.Tenant != "" && ev.TenantID != "" && ev.TenantID != identity.Tenant {
+			return false
+		}
+		if ev.TenantID != "" && !identity.CanUseKey(ev.KeyID) {
+			return false
+		}
+		return true
+	})
+	defer sub.Close()
+
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no") // stop nginx holding events back
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, ": subscribed\n\n")
+	if err := rc.Flush(); err != nil {
+		errorf(r.Context(), "Event stream cannot be flushed: %v", err)
+		return
+	}
+	auditf(r.Context(), "%s subscribed to events %v", identity.Name, types)
+
+	keepalive := time.NewTicker(eventStreamKeepalive)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepalive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+		case ev, ok := <-sub.C:
+			if !ok {
+				if sub.Overflowed() {
+					fmt.Fprint(w, "event: overflow\ndata: {}\n\n")
+				}
+				rc.Flush()
+				return
+			}
+			data, err := json.Marshal(ev)
+			if err != nil {
+				errorf(r.Context(), "Failed to encode event %s: %v", ev.ID, err)
+				continue
+			}
+			fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", ev.ID, ev.Type, data)
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// streamingEndpoints hold their response open until the client leaves, so no request
+// timeout applies to them.
+var streamingEndpoints = map[string]bool{"/events": true}
+
+// closeEventStreams ends the /events streams, which would otherwise keep
+// http.Server.Shutdown waiting until its deadline.
+func (s *Server) closeEventStreams() {
+	if s.Events != nil {
+		s.Events.CloseSubscriptions()
+	}
+}
+
+// RegisterShutdown arranges for hs.Shutdown to end the server's long-lived streams.
+func (s *Server) RegisterShutdown(hs *http.Server) {
+	hs.RegisterOnShutdown(s.closeEventStreams)
+}
@@ -0,0 +1,139 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"my-kms/internal/auth"
+	"my-kms/internal/crypto"
+	"my-kms/internal/secmem"
+	"my-kms/internal/storage"
+)
+
+const minExportKeyBits = 2048
+
+// ---------------------------------------------------------------------
+// Export Data Key
+// ---------------------------------------------------------------------
+
+type ExportDataKeyRequest struct {
+	DEKID     string `json:"dekID"`
+	PublicKey string `json:"publicKey"` // PEM or base64 DER SubjectPublicKeyInfo (RSA)
+}
+
+type ExportDataKeyResponse struct {
+	DEKID             string           `json:"dekID"`
+	Algorithm         crypto.Algorithm `json:"algorithm"`
+	State             storage.KeyState `json:"state"`
+	WrappingAlgorithm string           `json:"wrappingAlgorithm"`
+	WrappedKey        string           `json:"wrappedKey"` // base64
+}
+
+func (s *Server) ExportDataKeyHandler(w http.ResponseWriter, r *http.Request) {
+	identity, err := getIdentity(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	if err := auth.IsAuthorized(identity, auth.ActionExportKey); err != nil {
+		warnf(r.Context(), "Unauthorized attempt by role=%s to export DEK", identity.Role)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	var req ExportDataKeyRequest
+	if !decodeJSON(w, r.Body, &req) {
+		return
+	}
+	publicKey, err := parseRSAPublicKey(req.PublicKey)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	dekDoc, err := s.DEKStore.GetDEK(r.Context(), identity.Tenant, req.DEKID)
+	if err != nil {
+		errorf(r.Context(), "Failed to get DEK: %v", err)
+		http.Error(w, "DEK not found", http.StatusBadRequest)
+		return
+	}
+	auditKey(r, req.DEKID, nil)
+	if err := checkKeyPolicy(r.Context(), identity, dekDoc, keyOpExport, nil); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	// The approver must approve the same destination key, not just the DEK.
+	keyHash := sha256.Sum256(x509.MarshalPKCS1PublicKey(publicKey))
+	if !s.requireSecondApprover(w, r, identity, "export-data-key", req.DEKID+"|"+hex.EncodeToString(keyHash[:8])) {
+		return
+	}
+
+	dek, err := s.unwrapDEK(r, dekDoc)
+	if err != nil {
+		errorf(r.Context(), "Failed to decrypt DEK: %v", err)
+		http.Error(w, "failed to unwrap DEK", http.StatusInternalServerError)
+		return
+	}
+	defer secmem.Zero(dek)
+
+	wrapped, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, publicKey, dek, nil)
+	if err != nil {
+		errorf(r.Context(), "Failed to wrap DEK for export: %v", err)
+		http.Error(w, "failed to wrap DEK", http.StatusInternalServerError)
+		return
+	}
+	auditf(r.Context(), "DEK %s exported by %s", req.DEKID, identity.Name)
+
+	alg := crypto.Algorithm(dekDoc.Algorithm)
+	if alg == "" {
+		alg = crypto.DefaultAlgorithm
+	}
+	writeJSON(w, ExportDataKeyResponse{
+		DEKID:             req.DEKID,
+		Algorithm:         alg,
+		State:             dekDoc.EffectiveState(),
+		WrappingAlgorithm: importWrappingAlgorithm,
+		WrappedKey:        base64.StdEncoding.EncodeToString(wrapped),
+	})
+}
+
+// parseRSAPublicKey accepts a PEM block or base64 DER SubjectPublicKeyInfo.
+func parseRSAPublicKey(encoded string) (*rsa.PublicKey, error) {
+	encoded = strings.TrimSpace(encoded)
+	if encoded == "" {
+		return nil, errors.New("publicKey is required")
+	}
+
+	var der []byte
+	if block, _ := pem.Decode([]byte(encoded)); block != nil {
+		der = block.Bytes
+	} else {
+		var err error
+		if der, err = base64.StdEncoding.DecodeString(encoded); err != nil {
+			return nil, errors.New("publicKey must be PEM or base64 DER")
+		}
+	}
+
+	parsed, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key: %w", err)
+	}
+	publicKey, ok := parsed.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("publicKey must be an RSA key")
+	}
+	if publicKey.N.BitLen() < minExportKeyBits {
+		return nil, fmt.Errorf("RSA public key must be at least %d bits", minExportKeyBits)
+	}
+	return publicKey, nil
+}
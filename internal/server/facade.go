@@ -0,0 +1,85 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// The compatibility facades (AWS KMS, Vault transit) translate their protocol into
+// native requests and run the native handlers in-process, so every check and audit
+// line is the same whichever protocol a caller speaks.
+
+// nativeError is an error response from a native handler run by callNative.
+type nativeError struct {
+	Status  int
+	Message string
+	Header  http.Header
+}
+
+func (e *nativeError) Error() string { return e.Message }
+
+var errNativeInternal = &nativeError{Status: http.StatusInternalServerError, Message: "internal server error", Header: http.Header{}}
+
+// callNative runs h on an in-process POST to path with the caller's context and
+// decodes its response into out. Callers wrap h in identityRateLimit when the native
+// path's limit should apply. Key deprecation headers are passed on to w.
+func (s *Server) callNative(w http.ResponseWriter, r *http.Request, path string, h http.HandlerFunc, in, out interface{}) *nativeError {
+	body, err := json.Marshal(in)
+	if err != nil {
+		return errNativeInternal
+	}
+	inner, err := http.NewRequestWithContext(r.Context(), http.MethodPost, path, bytes.NewReader(body))
+	if err != nil {
+		return errNativeInternal
+	}
+	inner.Header.Set("Content-Type", "application/json")
+	inner.RemoteAddr, inner.Host = r.RemoteAddr, r.Host
+
+	rec := &captureWriter{header: http.Header{}, status: http.StatusOK}
+	h.ServeHTTP(rec, inner)
+	for _, name := range []string{"Deprecation", "Sunset", "X-KMS-Replacement-Key"} {
+		if v := rec.header.Get(name); v != "" {
+			w.Header().Set(name, v)
+		}
+	}
+	if rec.status/100 != 2 {
+		return &nativeError{Status: rec.status, Message: strings.TrimSpace(rec.body.String()), Header: rec.header}
+	}
+	if err := json.Unmarshal(rec.body.Bytes(), out); err != nil {
+		return errNativeInternal
+	}
+	return nil
+}
+
+// captureWriter buffers a response from callNative.
+type captureWriter struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (c *captureWriter) Header() http.Header         { return c.header }
+func (c *captureWriter) WriteHeader(status int)      { c.status = status }
+func (c *captureWriter) Write(b []byte) (int, error) { return c.body.Write(b) }
+
+const keyedCiphertextVersion = 1
+
+// keyedCiphertext prefixes a ciphertext with its DEK ID, so decrypt callers need not
+// say which key to use, as with an AWS ciphertext blob.
+func keyedCiphertext(dekID string, ciphertext []byte) []byte {
+	blob := make([]byte, 0, 2+len(dekID)+len(ciphertext))
+	blob = append(blob, keyedCiphertextVersion, byte(len(dekID)))
+	blob = append(blob, dekID...)
+	return append(blob, ciphertext...)
+}
+
+func parseKeyedCiphertext(blob []byte) (string, []byte, error) {
+	if len(blob) < 2 || blob[0] != keyedCiphertextVersion || len(blob) < 2+int(blob[1]) {
+		return "", nil, errors.New("ciphertext is not from this server")
+	}
+	n := 2 + int(blob[1])
+	return string(blob[2:n]), blob[n:], nil
+}
@@ -0,0 +1,152 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"my-kms/internal/auth"
+)
+
+// FailureMode says what a subsystem does when its backing service is unavailable.
+type FailureMode string
+
+const (
+	// FailClosed refuses the operation the subsystem guards.
+	FailClosed FailureMode = "closed"
+	// FailOpen carries on as if the subsystem had no objection.
+	FailOpen FailureMode = "open"
+)
+
+// Subsystem names a dependency whose outage needs a fail-open/fail-closed decision.
+type Subsystem string
+
+const (
+	// SubsystemLegalHolds: open lets deletes and purges proceed when holds can't be checked.
+	SubsystemLegalHolds Subsystem = "legal-holds"
+	// SubsystemTenantCMK: open wraps new DEKs with a master key when the tenant's CMK
+	// registration can't be read. Unwrapping a CMK-wrapped DEK always fails closed.
+	SubsystemTenantCMK Subsystem = "tenant-cmk"
+	// SubsystemPolicyStore: open starts with the built-in policy when the configured
+	// policy can't be loaded at startup. Reload failures always keep the current policy.
+	SubsystemPolicyStore Subsystem = "policy-store"
+	// SubsystemRateLimiter: open falls back to per-instance buckets when the shared
+	// (Redis) rate limiter is unreachable; closed answers 503.
+	SubsystemRateLimiter Subsystem = "rate-limiter"
+	// SubsystemQuotas: open lets metered operations through, uncounted, when usage
+	// counters can't be updated.
+	SubsystemQuotas Subsystem = "quotas"
+	// SubsystemAudit: open sends a request's response even though its audit event could
+	// not be stored; closed replaces it with a 503.
+	SubsystemAudit Subsystem = "audit"
+)
+
+// defaultFailureModes fail closed wherever failing open could destroy or expose data.
+var defaultFailureModes = map[Subsystem]FailureMode{
+	SubsystemLegalHolds:  FailClosed,
+	SubsystemTenantCMK:   FailClosed,
+	SubsystemPolicyStore: FailClosed,
+	SubsystemRateLimiter: FailClosed,
+	SubsystemQuotas:      FailClosed,
+	SubsystemAudit:       FailClosed,
+}
+
+// FailurePolicy holds the failure mode of every subsystem.
+type FailurePolicy map[Subsystem]FailureMode
+
+// DefaultFailurePolicy returns the built-in failure modes.
+func DefaultFailurePolicy() FailurePolicy {
+	p := make(FailurePolicy, len(defaultFailureModes))
+	for sub, mode := range defaultFailureModes {
+		p[sub] = mode
+	}
+	return p
+}
+
+// ParseFailurePolicy reads "subsystem=open|closed" pairs separated by commas on top of
+// the defaults.
+func ParseFailurePolicy(s string) (FailurePolicy, error) {
+	p := DefaultFailurePolicy()
+	for _, pair := range strings.Split(s, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		name, mode, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid failure mode %q; expected subsystem=open|closed", pair)
+		}
+		sub := Subsystem(strings.TrimSpace(name))
+		if _, known := defaultFailureModes[sub]; !known {
+			return nil, fmt.Errorf("unknown subsystem %q", sub)
+		}
+		switch m := FailureMode(strings.TrimSpace(mode)); m {
+		case FailOpen, FailClosed:
+			p[sub] = m
+		default:
+			return nil, fmt.Errorf("subsystem %s: failure mode must be open or closed", sub)
+		}
+	}
+	return p, nil
+}
+
+// FailsOpen reports whether sub is configured to fail open.
+func (p FailurePolicy) FailsOpen(sub Subsystem) bool {
+	return p[sub] == FailOpen
+}
+
+// OpenSubsystems lists the subsystems configured to fail open, in name order.
+func (p FailurePolicy) OpenSubsystems() []string {
+	var open []string
+	for sub, mode := range p {
+		if mode == FailOpen {
+			open = append(open, string(sub))
+		}
+	}
+	sort.Strings(open)
+	return open
+}
+
+// Log writes every subsystem's failure mode, one line each, in name order.
+func (p FailurePolicy) Log() {
+	subs := make([]string, 0, len(p))
+	for sub := range p {
+		subs = append(subs, string(sub))
+	}
+	sort.Strings(subs)
+	for _, sub := range subs {
+		logf(context.Background(), "Failure mode: %s fails %s", sub, p[Subsystem(sub)])
+	}
+}
+
+// LoadPolicy installs the authorization policy load returns at startup. If it can't be
+// loaded, the built-in policy stays in force when the policy store fails open, and the
+// error is returned when it fails closed.
+func (s *Server) LoadPolicy(ctx context.Context, load auth.PolicyLoader) error {
+	policy, err := load(ctx)
+	if err == nil {
+		auth.SetPolicyEngine(policy)
+		return nil
+	}
+	if s.failOpen(ctx, SubsystemPolicyStore, err) {
+		warnf(ctx, "Failed to load authorization policy, using the built-in one: %v", err)
+		return nil
+	}
+	return fmt.Errorf("failed to load authorization policy: %w", err)
+}
+
+// failOpen reports whether the operation may continue despite err from sub, and
+// audits the decision either way: on the request's event, or as its own event for
+// background jobs.
+func (s *Server) failOpen(ctx context.Context, sub Subsystem, err error) bool {
+	mode := s.Failures[sub]
+	if mode == "" {
+		mode = FailClosed
+	}
+	if auditRecordFrom(ctx) != nil {
+		auditf(ctx, "%s unavailable, failing %s: %v", sub, mode, err)
+	} else {
+		s.auditSystem("failure-mode", "", "", "%s unavailable, failing %s: %v", sub, mode, err)
+	}
+	return mode == FailOpen
+}
@@ -0,0 +1,283 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"my-kms/internal/auth"
+	"my-kms/internal/ratelimit"
+	"my-kms/internal/storage"
+)
+
+var errUnavailable = errors.New("connection refused")
+
+func TestParseFailurePolicy(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		open    []string // subsystems expected to fail open
+		wantErr string
+	}{
+		{name: "empty keeps the defaults", in: ""},
+		{name: "one subsystem", in: "legal-holds=open", open: []string{"legal-holds"}},
+		{name: "spaces and several pairs", in: " rate-limiter = open , quotas=open ,", open: []string{"quotas", "rate-limiter"}},
+		{name: "closed is accepted", in: "audit=closed,tenant-cmk=open", open: []string{"tenant-cmk"}},
+		{name: "later pair wins", in: "policy-store=open,policy-store=closed"},
+		{name: "unknown subsystem", in: "redis=open", wantErr: `unknown subsystem "redis"`},
+		{name: "bad mode", in: "quotas=maybe", wantErr: "failure mode must be open or closed"},
+		{name: "missing mode", in: "quotas", wantErr: "expected subsystem=open|closed"},
+		{name: "empty mode", in: "audit=", wantErr: "failure mode must be open or closed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := ParseFailurePolicy(tt.in)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("ParseFailurePolicy(%q) error = %v, want %q", tt.in, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseFailurePolicy(%q): %v", tt.in, err)
+			}
+			if got := p.OpenSubsystems(); !reflect.DeepEqual(got, tt.open) {
+				t.Errorf("OpenSubsystems() = %v, want %v", got, tt.open)
+			}
+			for sub := range defaultFailureModes {
+				want := false
+				for _, o := range tt.open {
+					want = want || o == string(sub)
+				}
+				if got := p.FailsOpen(sub); got != want {
+					t.Errorf("FailsOpen(%s) = %t, want %t", sub, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestDefaultFailurePolicyFailsClosed(t *testing.T) {
+	p := DefaultFailurePolicy()
+	if open := p.OpenSubsystems(); len(open) != 0 {
+		t.Errorf("default policy fails open for %v", open)
+	}
+	// Changing a copy must not change the defaults.
+	p[SubsystemAudit] = FailOpen
+	if DefaultFailurePolicy().FailsOpen(SubsystemAudit) {
+		t.Error("DefaultFailurePolicy shares its map")
+	}
+}
+
+// serverFailing returns a server whose failure policy opens sub when open is set.
+func serverFailing(t *testing.T, sub Subsystem, open bool) *Server {
+	t.Helper()
+	s := NewServer(nil, nil, nil, nil)
+	if open {
+		s.Failures[sub] = FailOpen
+	}
+	return s
+}
+
+type failingLimiter struct{}
+
+func (failingLimiter) Allow(context.Context, string, ratelimit.Limit) (bool, time.Duration, error) {
+	return false, 0, errUnavailable
+}
+
+func TestRateLimiterFailureMode(t *testing.T) {
+	tests := []struct {
+		open bool
+		want int
+	}{
+		{open: false, want: http.StatusServiceUnavailable},
+		{open: true, want: http.StatusOK},
+	}
+	for _, tt := range tests {
+		s := serverFailing(t, SubsystemRateLimiter, tt.open)
+		s.RateLimits = &RateLimits{
+			Limiter:  failingLimiter{},
+			Fallback: ratelimit.NewMemory(),
+			IP:       ratelimit.Limit{Rate: 10, Burst: 10},
+		}
+		h := s.RateLimitMiddleware(func(w http.ResponseWriter, r *http.Request) {})
+		rec := httptest.NewRecorder()
+		h(rec, httptest.NewRequest(http.MethodPost, "/encrypt", nil))
+		if rec.Code != tt.want {
+			t.Errorf("open=%t: status %d, want %d", tt.open, rec.Code, tt.want)
+		}
+	}
+}
+
+func TestRateLimiterFallbackStillLimits(t *testing.T) {
+	s := serverFailing(t, SubsystemRateLimiter, true)
+	s.RateLimits = &RateLimits{
+		Limiter:  failingLimiter{},
+		Fallback: ratelimit.NewMemory(),
+		IP:       ratelimit.Limit{Rate: 0.001, Burst: 1},
+	}
+	h := s.RateLimitMiddleware(func(w http.ResponseWriter, r *http.Request) {})
+	for i, want := range []int{http.StatusOK, http.StatusTooManyRequests} {
+		rec := httptest.NewRecorder()
+		h(rec, httptest.NewRequest(http.MethodPost, "/encrypt", nil))
+		if rec.Code != want {
+			t.Errorf("request %d: status %d, want %d", i, rec.Code, want)
+		}
+	}
+}
+
+func TestPolicyStoreFailureMode(t *testing.T) {
+	t.Cleanup(func() { auth.SetPolicyEngine(auth.DefaultPolicy()) })
+	failing := func(context.Context) (*auth.RulePolicy, error) { return nil, errUnavailable }
+
+	if err := serverFailing(t, SubsystemPolicyStore, false).LoadPolicy(context.Background(), failing); !errors.Is(err, errUnavailable) {
+		t.Errorf("closed: LoadPolicy error = %v, want %v", err, errUnavailable)
+	}
+	if err := serverFailing(t, SubsystemPolicyStore, true).LoadPolicy(context.Background(), failing); err != nil {
+		t.Errorf("open: LoadPolicy error = %v, want nil", err)
+	}
+
+	// A policy that loads is installed whatever the mode.
+	denyAll := &auth.RulePolicy{}
+	loaded := func(context.Context) (*auth.RulePolicy, error) { return denyAll, nil }
+	if err := serverFailing(t, SubsystemPolicyStore, false).LoadPolicy(context.Background(), loaded); err != nil {
+		t.Fatalf("LoadPolicy: %v", err)
+	}
+	if err := auth.IsAuthorized(auth.Identity{Name: "alice", Role: auth.RoleAdmin}, auth.ActionEncrypt); err == nil {
+		t.Error("loaded policy was not installed")
+	}
+}
+
+// fakeAuditStore stores events in memory, or fails every append when err is set.
+type fakeAuditStore struct {
+	AuditStore
+	err    error
+	events []storage.AuditEvent
+}
+
+func (f *fakeAuditStore) AppendEvent(_ context.Context, ev storage.AuditEvent) (*storage.AuditEvent, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	ev.Seq = int64(len(f.events) + 1)
+	f.events = append(f.events, ev)
+	return &ev, nil
+}
+
+func TestAuditFailureMode(t *testing.T) {
+	tests := []struct {
+		name     string
+		storeErr error
+		open     bool
+		want     int
+		wantBody string
+	}{
+		{name: "stored", want: http.StatusOK, wantBody: "plaintext"},
+		{name: "stored, error response", want: http.StatusForbidden, wantBody: "denied"},
+		{name: "lost, closed", storeErr: errUnavailable, want: http.StatusServiceUnavailable, wantBody: "audit log unavailable"},
+		{name: "lost, open", storeErr: errUnavailable, open: true, want: http.StatusOK, wantBody: "plaintext"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := serverFailing(t, SubsystemAudit, tt.open)
+			store := &fakeAuditStore{err: tt.storeErr}
+			s.Audit = store
+
+			mux := http.NewServeMux()
+			mux.HandleFunc("/decrypt", func(w http.ResponseWriter, r *http.Request) {
+				if tt.wantBody == "denied" {
+					http.Error(w, "denied", http.StatusForbidden)
+					return
+				}
+				w.Header().Set("Content-Type", "application/json")
+				w.Write([]byte("plaintext"))
+			})
+			rec := httptest.NewRecorder()
+			s.AuditMiddleware(mux, mux).ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/decrypt", nil))
+
+			if rec.Code != tt.want {
+				t.Errorf("status %d, want %d", rec.Code, tt.want)
+			}
+			if body := strings.TrimSpace(rec.Body.String()); body != tt.wantBody {
+				t.Errorf("body %q, want %q", body, tt.wantBody)
+			}
+			if tt.storeErr == nil {
+				if len(store.events) != 1 || store.events[0].Status != tt.want || store.events[0].Action != "/decrypt" {
+					t.Errorf("stored events %+v, want one /decrypt event with status %d", store.events, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestAuditFailureModeNoResponseWritten(t *testing.T) {
+	s := serverFailing(t, SubsystemAudit, false)
+	s.Audit = &fakeAuditStore{err: errUnavailable}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/touch", func(w http.ResponseWriter, r *http.Request) {})
+	rec := httptest.NewRecorder()
+	s.AuditMiddleware(mux, mux).ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/touch", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("status %d, want %d", rec.Code, http.StatusServiceUnavailable)
+	}
+}
+
+// failingUserStore fails every lookup as an unreachable store would.
+type failingUserStore struct {
+	storage.UserStore
+}
+
+func (failingUserStore) GetUserByFirebaseUID(context.Context, string) (*storage.User, error) {
+	return nil, errUnavailable
+}
+
+func TestUserStoreFallback(t *testing.T) {
+	tests := []struct {
+		mode         UserFallbackMode
+		cached       bool
+		wantErr      bool
+		wantDegraded bool
+	}{
+		{mode: UserFallbackNone, cached: true, wantErr: true},
+		{mode: UserFallbackCache, cached: true},
+		{mode: UserFallbackCache, cached: false, wantErr: true},
+		{mode: UserFallbackEmergency, cached: true, wantDegraded: true},
+	}
+	for _, tt := range tests {
+		s := NewServer(nil, failingUserStore{}, nil, nil)
+		s.UserFallback = tt.mode
+		if tt.cached {
+			s.userCache.put(&storage.User{FirebaseUID: "alice", Role: string(auth.RoleAdmin)})
+		}
+		user, degraded, err := s.lookupUser(context.Background(), "alice")
+		if tt.wantErr {
+			if !errors.Is(err, errUserStoreUnavailable) {
+				t.Errorf("%s (cached %t): error = %v, want %v", tt.mode, tt.cached, err, errUserStoreUnavailable)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.mode, err)
+			continue
+		}
+		if user.FirebaseUID != "alice" || degraded != tt.wantDegraded {
+			t.Errorf("%s: user %q degraded %t, want alice degraded %t", tt.mode, user.FirebaseUID, degraded, tt.wantDegraded)
+		}
+	}
+}
+
+func TestUserStoreFallbackStaleness(t *testing.T) {
+	s := NewServer(nil, failingUserStore{}, nil, nil)
+	s.UserFallback = UserFallbackCache
+	s.SetUserCacheTTLs(0, time.Nanosecond)
+	s.userCache.put(&storage.User{FirebaseUID: "alice"})
+	time.Sleep(time.Millisecond)
+	if _, _, err := s.lookupUser(context.Background(), "alice"); !errors.Is(err, errUserStoreUnavailable) {
+		t.Errorf("stale entry served: error = %v", err)
+	}
+}
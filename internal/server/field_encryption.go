@@ -0,0 +1,379 @@
+package server
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"my-kms/internal/auth"
+	"my-kms/internal/crypto"
+	"my-kms/internal/fieldpath"
+	"my-kms/internal/secmem"
+	"my-kms/internal/storage"
+)
+
+// FieldEnvelopePrefix marks a JSON string as a field encrypted by /encrypt-fields; the
+// rest is the base64 ciphertext of the field's JSON value.
+const FieldEnvelopePrefix = "kms:v1:"
+
+// fieldContextKey binds each field's ciphertext to its member name, so an encrypted
+// value moved to another field fails to decrypt. Callers cannot use it themselves.
+const fieldContextKey = "kms:field"
+
+// maxFieldSelectors bounds the paths one request may name.
+const maxFieldSelectors = 100
+
+type EncryptFieldsRequest struct {
+	DEKID    string          `json:"dekID"`
+	Alias    string          `json:"alias,omitempty"` // alternative to dekID
+	JSONData json.RawMessage `json:"jsonData"`        // object or array
+	Fields   []string        `json:"fields"`          // paths such as "user.email" or "$.cards[*].number"
+
+	// Deterministic must be set, and is only accepted, for a deterministic key; equal
+	// values of the same field then encrypt alike and can be looked up by equality.
+	Deterministic bool `json:"deterministic,omitempty"`
+
+	EncryptionContext map[string]string `json:"encryptionContext,omitempty"`
+}
+
+type DecryptFieldsRequest struct {
+	DEKID    string          `json:"dekID"`
+	Alias    string          `json:"alias,omitempty"`
+	JSONData json.RawMessage `json:"jsonData"`
+	Fields   []string        `json:"fields,omitempty"` // empty decrypts every encrypted field
+
+	EncryptionContext map[string]string `json:"encryptionContext,omitempty"`
+}
+
+type FieldsResponse struct {
+	JSONData json.RawMessage `json:"jsonData"`
+	Fields   []string        `json:"fields"` // concrete paths encrypted or decrypted
+}
+
+// ---------------------------------------------------------------------
+// Encrypt Fields
+// ---------------------------------------------------------------------
+
+// EncryptFieldsHandler encrypts the selected fields of a JSON document in place, leaving
+// the rest of it readable and queryable. Fields that are already encrypted are skipped.
+func (s *Server) EncryptFieldsHandler(w http.ResponseWriter, r *http.Request) {
+	identity, err := getIdentity(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	roleErr := auth.IsAuthorized(identity, auth.ActionEncrypt)
+	if roleErr != nil && s.Grants == nil {
+		warnf(r.Context(), "Unauthorized attempt by role=%s to encrypt fields", identity.Role)
+		http.Error(w, roleErr.Error(), http.StatusForbidden)
+		return
+	}
+
+	var req EncryptFieldsRequest
+	if !decodeJSON(w, r.Body, &req) {
+		return
+	}
+	if len(req.Fields) == 0 {
+		http.Error(w, "fields must name at least one path", http.StatusBadRequest)
+		return
+	}
+	selectors, doc, ok := s.parseFieldsRequest(w, req.Fields, req.JSONData, req.EncryptionContext)
+	if !ok {
+		return
+	}
+
+	dekID, dekDoc, alg, ok := s.loadRequestKey(w, r, identity, req.DEKID, req.Alias, keyOpEncrypt, roleErr, req.EncryptionContext)
+	if !ok {
+		return
+	}
+	if err := checkKeyScheme(dekDoc, string(alg)); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if err := checkDeterministicRequest(alg, req.Deterministic); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := authorizeDeterministic(identity, alg); err != nil {
+		warnf(r.Context(), "Unauthorized attempt by role=%s to encrypt fields deterministically", identity.Role)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if !s.meterUsage(w, r, identity, dekID, quotaOpEncrypt, false, true) {
+		return
+	}
+	dek, err := s.unwrapDEK(r, dekDoc)
+	if err != nil {
+		errorf(r.Context(), "Failed to decrypt DEK: %v", err)
+		http.Error(w, "failed to unwrap DEK", http.StatusInternalServerError)
+		return
+	}
+	defer secmem.Zero(dek)
+
+	endCrypto := traceCrypto(r, "encrypt-fields", alg)
+	var done []string
+	for _, sel := range selectors {
+		paths, err := fieldpath.Replace(doc, sel, func(m fieldpath.Match) (interface{}, bool, error) {
+			if str, ok := m.Value.(string); ok && strings.HasPrefix(str, FieldEnvelopePrefix) {
+				return nil, false, nil
+			}
+			plaintext, err := json.Marshal(m.Value)
+			if err != nil {
+				return nil, false, err
+			}
+			if err := checkPayloadSize(dekDoc, len(plaintext)); err != nil {
+				return nil, false, fmt.Errorf("field %s: %w", m.Field, err)
+			}
+			aad, err := fieldAAD(req.EncryptionContext, m.Field)
+			if err != nil {
+				return nil, false, err
+			}
+			if err := s.reserveDEKEncryptions(r.Context(), dekID, alg, 1); err != nil {
+				return nil, false, err
+			}
+			ct, err := crypto.Encrypt(alg, dek, plaintext, aad)
+			if err != nil {
+				return nil, false, err
+			}
+			return FieldEnvelopePrefix + base64.StdEncoding.EncodeToString(ct), true, nil
+		})
+		if errors.Is(err, storage.ErrNonceLimit) {
+			endCrypto(err)
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		var limitErr *payloadLimitError
+		if errors.As(err, &limitErr) {
+			endCrypto(err)
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err != nil {
+			endCrypto(err)
+			errorf(r.Context(), "Failed to encrypt fields: %v", err)
+			http.Error(w, "encryption failed", http.StatusInternalServerError)
+			return
+		}
+		done = append(done, paths...)
+	}
+	endCrypto(nil)
+	s.touchDEK(r, identity.Tenant, dekID)
+	auditf(r.Context(), "Encrypted %d fields with DEK %s", len(done), dekID)
+	writeFieldsResponse(w, r, doc, done)
+}
+
+// ---------------------------------------------------------------------
+// Decrypt Fields
+// ---------------------------------------------------------------------
+
+// DecryptFieldsHandler reverses EncryptFieldsHandler, for the selected fields or, with
+// no fields given, every encrypted field in the document.
+func (s *Server) DecryptFieldsHandler(w http.ResponseWriter, r *http.Request) {
+	identity, err := getIdentity(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	roleErr := auth.IsAuthorized(identity, auth.ActionDecrypt)
+	if roleErr != nil && s.Grants == nil {
+		warnf(r.Context(), "Unauthorized attempt by role=%s to decrypt fields", identity.Role)
+		http.Error(w, roleErr.Error(), http.StatusForbidden)
+		return
+	}
+
+	var req DecryptFieldsRequest
+	if !decodeJSON(w, r.Body, &req) {
+		return
+	}
+	selectors, doc, ok := s.parseFieldsRequest(w, req.Fields, req.JSONData, req.EncryptionContext)
+	if !ok {
+		return
+	}
+
+	dekID, dekDoc, alg, ok := s.loadRequestKey(w, r, identity, req.DEKID, req.Alias, keyOpDecrypt, roleErr, req.EncryptionContext)
+	if !ok {
+		return
+	}
+	if err := checkKeyScheme(dekDoc, string(alg)); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if !s.meterUsage(w, r, identity, dekID, quotaOpDecrypt, false, true) {
+		return
+	}
+	dek, err := s.unwrapDEK(r, dekDoc)
+	if err != nil {
+		errorf(r.Context(), "Failed to decrypt DEK: %v", err)
+		http.Error(w, "failed to unwrap DEK", http.StatusInternalServerError)
+		return
+	}
+	defer secmem.Zero(dek)
+
+	decryptField := func(m fieldpath.Match) (interface{}, bool, error) {
+		str, ok := m.Value.(string)
+		if !ok || !strings.HasPrefix(str, FieldEnvelopePrefix) {
+			return nil, false, nil
+		}
+		ct, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(str, FieldEnvelopePrefix))
+		if err != nil {
+			return nil, false, errors.New("invalid base64 ciphertext")
+		}
+		aad, err := fieldAAD(req.EncryptionContext, m.Field)
+		if err != nil {
+			return nil, false, err
+		}
+		plaintext, err := crypto.Decrypt(alg, dek, ct, aad)
+		if err != nil {
+			return nil, false, err
+		}
+		v, err := decodeJSONValue(plaintext)
+		if err != nil {
+			return nil, false, err
+		}
+		return v, true, nil
+	}
+
+	endCrypto := traceCrypto(r, "decrypt-fields", alg)
+	var done []string
+	if len(selectors) == 0 {
+		done, err = fieldpath.Walk(doc, decryptField)
+	} else {
+		for _, sel := range selectors {
+			var paths []string
+			if paths, err = fieldpath.Replace(doc, sel, decryptField); err != nil {
+				break
+			}
+			done = append(done, paths...)
+		}
+	}
+	endCrypto(err)
+	if err != nil {
+		errorf(r.Context(), "Failed to decrypt fields: %v", err)
+		http.Error(w, "decryption failed", http.StatusInternalServerError)
+		return
+	}
+	s.touchDEK(r, identity.Tenant, dekID)
+	auditf(r.Context(), "Decrypted %d fields with DEK %s", len(done), dekID)
+	writeFieldsResponse(w, r, doc, done)
+}
+
+// ---------------------------------------------------------------------
+// Helper Functions
+// ---------------------------------------------------------------------
+
+// parseFieldsRequest validates the parts of a fields request that need no key: the
+// paths, the encryption context and the document, which it decodes.
+func (s *Server) parseFieldsRequest(w http.ResponseWriter, fields []string, data json.RawMessage, encCtx map[string]string) ([]fieldpath.Selector, interface{}, bool) {
+	if len(fields) > maxFieldSelectors {
+		http.Error(w, fmt.Sprintf("at most %d fields per request", maxFieldSelectors), http.StatusBadRequest)
+		return nil, nil, false
+	}
+	selectors := make([]fieldpath.Selector, 0, len(fields))
+	for _, f := range fields {
+		sel, err := fieldpath.Parse(f)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return nil, nil, false
+		}
+		selectors = append(selectors, sel)
+	}
+	if err := crypto.ValidateEncryptionContext(encCtx); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, nil, false
+	}
+	if _, reserved := encCtx[fieldContextKey]; reserved {
+		http.Error(w, fmt.Sprintf("encryption context key %q is reserved", fieldContextKey), http.StatusBadRequest)
+		return nil, nil, false
+	}
+	if int64(len(data)) > s.MaxPayloadBytes {
+		http.Error(w, fmt.Sprintf("document exceeds the %d byte limit", s.MaxPayloadBytes), http.StatusRequestEntityTooLarge)
+		return nil, nil, false
+	}
+	doc, err := decodeJSONValue(data)
+	if err != nil {
+		http.Error(w, "jsonData must be a JSON document", http.StatusBadRequest)
+		return nil, nil, false
+	}
+	switch doc.(type) {
+	case map[string]interface{}, []interface{}:
+	default:
+		http.Error(w, "jsonData must be a JSON object or array", http.StatusBadRequest)
+		return nil, nil, false
+	}
+	return selectors, doc, true
+}
+
+// loadRequestKey resolves and loads the DEK for a fields or FPE request and runs the
+// same authorization and key-state checks as /encrypt and /decrypt.
+func (s *Server) loadRequestKey(w http.ResponseWriter, r *http.Request, identity auth.Identity, dekIDParam, aliasParam string, op keyOperation, roleErr error, encCtx map[string]string) (string, *storage.DEKDocument, crypto.Algorithm, bool) {
+	dekID, _, err := s.resolveKey(r, identity.Tenant, dekIDParam, aliasParam)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return "", nil, "", false
+	}
+	dekDoc, err := s.DEKStore.GetDEK(r.Context(), identity.Tenant, dekID)
+	if err != nil {
+		errorf(r.Context(), "Failed to get DEK: %v", err)
+		http.Error(w, "DEK not found", http.StatusBadRequest)
+		return "", nil, "", false
+	}
+	if err := s.authorizeKeyUse(r, identity, dekDoc, op, roleErr, encCtx); err != nil {
+		warnf(r.Context(), "Unauthorized attempt by role=%s to %s with DEK %s", identity.Role, op, dekID)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return "", nil, "", false
+	}
+	if err := checkKeyUsable(dekDoc); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return "", nil, "", false
+	}
+	alg, err := s.keyAlgorithm(dekDoc)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return "", nil, "", false
+	}
+	signalKeyDeprecation(w, r, dekDoc)
+	return dekID, dekDoc, alg, true
+}
+
+// fieldAAD is the encryption context with the field name added.
+func fieldAAD(encCtx map[string]string, field string) ([]byte, error) {
+	ctx := make(map[string]string, len(encCtx)+1)
+	for k, v := range encCtx {
+		ctx[k] = v
+	}
+	ctx[fieldContextKey] = field
+	return crypto.EncryptionContextAAD(ctx)
+}
+
+// decodeJSONValue decodes one JSON value, keeping numbers exact.
+func decodeJSONValue(data []byte) (interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	if dec.More() {
+		return nil, errors.New("unexpected data after JSON value")
+	}
+	return v, nil
+}
+
+func writeFieldsResponse(w http.ResponseWriter, r *http.Request, doc interface{}, fields []string) {
+	data, err := json.Marshal(doc)
+	if err != nil {
+		errorf(r.Context(), "Failed to encode document: %v", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	if fields == nil {
+		fields = []string{}
+	}
+	writeJSON(w, FieldsResponse{JSONData: data, Fields: fields})
+}
@@ -1,25 +1,86 @@
 package server
 
 import (
-	"context"
+	"errors"
 	"fmt"
-	"log"
 	"net/http"
+	"strings"
+	"time"
+
+	firebaseauth "firebase.google.com/go/auth"
 
 	"my-kms/internal/auth"
+	"my-kms/internal/storage"
 )
 
 // Authenticate is a middleware that authenticates the request using Firebase and sets the user's identity in context.
 func (s *Server) Authenticate(next http.HandlerFunc) http.HandlerFunc {
+	return s.firebaseAuthMiddleware(next)
+}
+
+// firebaseAuthMiddleware authenticates the Firebase JWT (or an X-API-Key, or a client certificate), retrieves role from MongoDB, sets identity in context.
+func (s *Server) firebaseAuthMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return traceAuth(s.authenticateRequest, s.identityRateLimit(next))
+}
+
+func (s *Server) authenticateRequest(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		// 1. Extract the Authorization header
+		if s.rejectBlockedClient(w, r) {
+			return
+		}
+
+		// Service accounts may present an API key instead of a Firebase token
+		if key := r.Header.Get(APIKeyHeader); key != "" {
+			identity, err := s.authenticateAPIKey(r.Context(), key)
+			if err != nil {
+				warnf(r.Context(), "API key authentication failed: %v", err)
+				if errors.Is(err, errUserStoreUnavailable) {
+					http.Error(w, "User store unavailable", http.StatusServiceUnavailable)
+					return
+				}
+				http.Error(w, "Invalid API key", http.StatusUnauthorized)
+				return
+			}
+			if s.rejectRevoked(w, r, identity) || s.rejectOutsideConditions(w, r, identity) {
+				return
+			}
+			if s.Clients != nil {
+				s.Clients.Observe(identity.Name, r)
+			}
+			setAuditIdentity(r, identity)
+			next.ServeHTTP(w, r.WithContext(auth.WithIdentity(r.Context(), identity)))
+			return
+		}
+
+		// 1. Authorization header; without one a verified client certificate may stand in
 		authHeader := r.Header.Get("Authorization")
 		if authHeader == "" {
+			identity, err := s.authenticateClientCert(r)
+			if err == nil {
+				if s.rejectRevoked(w, r, identity) || s.rejectOutsideConditions(w, r, identity) {
+					return
+				}
+				if s.Clients != nil {
+					s.Clients.Observe(identity.Name, r)
+				}
+				setAuditIdentity(r, identity)
+				next.ServeHTTP(w, r.WithContext(auth.WithIdentity(r.Context(), identity)))
+				return
+			}
+			if !errors.Is(err, errNoClientCert) {
+				warnf(r.Context(), "Client certificate authentication failed: %v", err)
+				if errors.Is(err, errUserStoreUnavailable) {
+					http.Error(w, "User store unavailable", http.StatusServiceUnavailable)
+					return
+				}
+				http.Error(w, "Client certificate not authorized", http.StatusUnauthorized)
+				return
+			}
 			http.Error(w, "Authorization header missing", http.StatusUnauthorized)
 			return
 		}
 
-		// 2. Expect the header to be in the format "Bearer <token>"
+		// 2. Parse token
 		var token string
 		_, err := fmt.Sscanf(authHeader, "Bearer %s", &token)
 		if err != nil || token == "" {
@@ -27,36 +88,129 @@ func (s *Server) Authenticate(next http.HandlerFunc) http.HandlerFunc {
 			return
 		}
 
-		// 3. Verify the ID token with Firebase
-		ctx := context.Background()
-		decodedToken, err := s.FirebaseAuth.VerifyIDToken(ctx, token)
+		// 3. Verify token
+		decodedToken, err := s.FirebaseAuth.VerifyIDToken(r.Context(), token)
 		if err != nil {
-			log.Printf("Failed to verify ID token: %v", err)
+			errorf(r.Context(), "Failed to verify ID token: %v", err)
+			http.Error(w, "Invalid or expired token", http.StatusUnauthorized)
+			return
+		}
+		if err := s.TokenPolicy.Check(decodedToken.IssuedAt, decodedToken.Expires, decodedToken.AuthTime, time.Now()); err != nil {
+			warnf(r.Context(), "Token for %s rejected by time policy: %v", decodedToken.UID, err)
 			http.Error(w, "Invalid or expired token", http.StatusUnauthorized)
 			return
 		}
 
-		// 4. Retrieve the user's role from MongoDB using firebaseUID
-		firebaseUID := decodedToken.UID
-		user, err := s.MongoUserStore.GetUserByFirebaseUID(ctx, firebaseUID)
+		// 4. Deployments that manage roles in Firebase carry them in a custom claim
+		identity, fromClaims, err := s.claimsIdentity(decodedToken)
 		if err != nil {
-			log.Printf("Failed to retrieve user from MongoDB: %v", err)
-			http.Error(w, "User not found", http.StatusUnauthorized)
+			warnf(r.Context(), "Role claim for %s rejected: %v", decodedToken.UID, err)
+			http.Error(w, "Invalid role claim", http.StatusUnauthorized)
+			return
+		}
+		var status int
+		var msg string
+		if fromClaims {
+			status, msg = s.applyUserRecord(r, &identity)
+		} else {
+			identity, status, msg = s.userIdentity(r, decodedToken)
+		}
+		if msg != "" {
+			http.Error(w, msg, status)
+			return
+		}
+		if s.rejectRevoked(w, r, identity) || s.rejectOutsideConditions(w, r, identity) {
 			return
 		}
 
-		// 5. Create an Identity object
-		identity := auth.Identity{
-			Name: firebaseUID, // Using Firebase UID as the name
-			Role: auth.Role(user.Role),
-			// Optionally, add FirebaseUID if the Identity struct includes it
-			// FirebaseUID: firebaseUID,
+		if s.Clients != nil {
+			s.Clients.Observe(identity.Name, r)
 		}
 
-		// 6. Inject the Identity into the request context
-		ctx = context.WithValue(r.Context(), "identity", identity)
-		r = r.WithContext(ctx)
+		// 5. Inject identity into context
+		setAuditIdentity(r, identity)
+		r = r.WithContext(auth.WithIdentity(r.Context(), identity))
 
 		next.ServeHTTP(w, r)
 	}
 }
+
+// userIdentity looks the token's user up in the user store and builds their identity.
+// On failure it returns the status and message to answer with.
+func (s *Server) userIdentity(r *http.Request, token *firebaseauth.Token) (auth.Identity, int, string) {
+	firebaseUID := token.UID
+	user, degraded, err := s.lookupUser(r.Context(), firebaseUID)
+	if err != nil {
+		errorf(r.Context(), "Failed to retrieve user from MongoDB: %v", err)
+		if errors.Is(err, errUserStoreUnavailable) {
+			return auth.Identity{}, http.StatusServiceUnavailable, "User store unavailable"
+		}
+		return auth.Identity{}, http.StatusUnauthorized, "User not found"
+	}
+	if user.Disabled {
+		return auth.Identity{}, http.StatusUnauthorized, "User is disabled"
+	}
+
+	// The custom claim wins, but must agree with the user record if both are set
+	tenant := user.TenantID
+	if claim, ok := token.Claims[s.TenantClaim].(string); ok && claim != "" {
+		if tenant != "" && tenant != claim {
+			warnf(r.Context(), "Tenant claim %q for %s does not match user record tenant %q", claim, firebaseUID, tenant)
+			return auth.Identity{}, http.StatusUnauthorized, "Tenant mismatch"
+		}
+		tenant = claim
+	}
+
+	return auth.Identity{
+		Name:   firebaseUID,
+		Role:   auth.Role(user.Role),
+		Tenant: tenant,
+
+		DecryptOnly: degraded,
+		Conditions:  user.Conditions,
+	}, 0, ""
+}
+
+// applyUserRecord holds an identity built from claims to the user's record, when they
+// have one: a disabled user is refused and the record's conditions apply, so
+// /disable-user and per-user conditions work with ROLE_CLAIM too. The role and tenant
+// still come from the claims. Users without a record are let through on the claims
+// alone. On failure it returns the status and message to answer with.
+func (s *Server) applyUserRecord(r *http.Request, identity *auth.Identity) (int, string) {
+	user, degraded, err := s.lookupUser(r.Context(), identity.Name)
+	if errors.Is(err, storage.ErrUserNotFound) {
+		return 0, ""
+	}
+	if err != nil {
+		errorf(r.Context(), "Failed to retrieve user from MongoDB: %v", err)
+		if errors.Is(err, errUserStoreUnavailable) {
+			return http.StatusServiceUnavailable, "User store unavailable"
+		}
+		return http.StatusUnauthorized, "User not found"
+	}
+	if user.Disabled {
+		return http.StatusUnauthorized, "User is disabled"
+	}
+	identity.DecryptOnly = degraded
+	identity.Conditions = user.Conditions
+	return 0, ""
+}
+
+// claimsIdentity builds the identity from the token's RoleClaim and TenantClaim when
+// RoleClaim is set and the token carries it; applyUserRecord then checks it against
+// the user record. ok is false if the role must come from the user store instead.
+func (s *Server) claimsIdentity(token *firebaseauth.Token) (identity auth.Identity, ok bool, err error) {
+	if s.RoleClaim == "" {
+		return auth.Identity{}, false, nil
+	}
+	claim, ok := token.Claims[s.RoleClaim].(string)
+	if !ok || claim == "" {
+		return auth.Identity{}, false, nil
+	}
+	role := auth.Role(strings.ToUpper(claim))
+	if !auth.KnownRole(role) {
+		return auth.Identity{}, true, fmt.Errorf("unknown role %q in claim %s", claim, s.RoleClaim)
+	}
+	tenant, _ := token.Claims[s.TenantClaim].(string)
+	return auth.Identity{Name: token.UID, Role: role, Tenant: tenant}, true, nil
+}
@@ -0,0 +1,78 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	firebaseauth "firebase.google.com/go/auth"
+
+	"my-kms/internal/auth"
+	"my-kms/internal/storage"
+)
+
+// claimsVerifier takes the bearer token to be the UID, with a kmsRole claim.
+type claimsVerifier struct{ role string }
+
+func (v claimsVerifier) VerifyIDToken(_ context.Context, token string) (*firebaseauth.Token, error) {
+	now := time.Now()
+	return &firebaseauth.Token{
+		UID:      token,
+		IssuedAt: now.Unix(),
+		AuthTime: now.Unix(),
+		Expires:  now.Add(time.Hour).Unix(),
+		Claims:   map[string]interface{}{"kmsRole": v.role, "tenant": "acme"},
+	}, nil
+}
+
+// unavailableUserStore fails every lookup as if MongoDB were down.
+type unavailableUserStore struct{ storage.UserStore }
+
+func (unavailableUserStore) GetUserByFirebaseUID(context.Context, string) (*storage.User, error) {
+	return nil, errUnavailable
+}
+
+func TestRoleClaimStillChecksUserRecord(t *testing.T) {
+	expired := time.Now().Add(-time.Hour)
+	users := storage.NewMemoryUserStore(
+		storage.User{FirebaseUID: "alice", Role: string(auth.RoleAuditor)},
+		storage.User{FirebaseUID: "mallory", Role: string(auth.RoleService), Disabled: true},
+		storage.User{FirebaseUID: "contractor", Role: string(auth.RoleService), Conditions: &auth.AccessCondition{ValidUntil: &expired}},
+	)
+	tests := []struct {
+		name   string
+		users  storage.UserStore
+		uid    string
+		status int
+	}{
+		{name: "record without restrictions", users: users, uid: "alice", status: http.StatusOK},
+		{name: "no record", users: users, uid: "bob", status: http.StatusOK},
+		{name: "disabled record", users: users, uid: "mallory", status: http.StatusUnauthorized},
+		{name: "record outside its conditions", users: users, uid: "contractor", status: http.StatusForbidden},
+		{name: "user store down", users: unavailableUserStore{}, uid: "alice", status: http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewServer(nil, tt.users, nil, claimsVerifier{role: "service"})
+			s.RoleClaim = "kmsRole"
+			var got auth.Identity
+			h := s.Authenticate(func(w http.ResponseWriter, r *http.Request) {
+				got, _ = auth.FromContext(r.Context())
+			})
+
+			r := httptest.NewRequest(http.MethodPost, "/encrypt", nil)
+			r.Header.Set("Authorization", "Bearer "+tt.uid)
+			rec := httptest.NewRecorder()
+			h(rec, r)
+			if rec.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", rec.Code, tt.status, rec.Body)
+			}
+			// The role and tenant still come from the claims, not the record.
+			if tt.status == http.StatusOK && (got.Role != auth.RoleService || got.Tenant != "acme") {
+				t.Errorf("identity %+v, want SERVICE in acme", got)
+			}
+		})
+	}
+}
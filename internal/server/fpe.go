@@ -0,0 +1,272 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"my-kms/internal/auth"
+	"my-kms/internal/crypto"
+	"my-kms/internal/secmem"
+)
+
+// /encrypt-fpe and /decrypt-fpe run FF1 or FF3-1 over values such as card numbers, so
+// the ciphertext fits the column the plaintext came from. The FPE key is derived from
+// the DEK and the encryption context.
+
+const (
+	defaultFPERadix = 10
+	maxFPEValues    = 1000
+)
+
+// fpeDigits is the alphabet for a radix given without one.
+const fpeDigits = "0123456789abcdefghijklmnopqrstuvwxyz"
+
+type FPERequest struct {
+	DEKID    string   `json:"dekID"`
+	Alias    string   `json:"alias,omitempty"`    // alternative to dekID
+	Mode     string   `json:"mode,omitempty"`     // FF1 (default) or FF3-1
+	Radix    int      `json:"radix,omitempty"`    // 2-36 over 0-9a-z; defaults to 10
+	Alphabet string   `json:"alphabet,omitempty"` // instead of radix: the numerals, in order
+	Tweak    []byte   `json:"tweak,omitempty"`    // base64; FF3-1 takes exactly 7 bytes, zeros if omitted
+	Values   []string `json:"values"`
+
+	// Deterministic must be true on /encrypt-fpe, acknowledging that equal values
+	// encrypt alike.
+	Deterministic bool `json:"deterministic,omitempty"`
+
+	EncryptionContext map[string]string `json:"encryptionContext,omitempty"`
+}
+
+type FPEResponse struct {
+	Values []string `json:"values"` // in the order of the request
+}
+
+// ---------------------------------------------------------------------
+// Encrypt FPE
+// ---------------------------------------------------------------------
+
+// EncryptFPEHandler encrypts each value in place: characters of the alphabet are
+// encrypted, anything else (dashes, spaces) keeps its position.
+func (s *Server) EncryptFPEHandler(w http.ResponseWriter, r *http.Request) {
+	identity, err := getIdentity(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	roleErr := auth.IsAuthorized(identity, auth.ActionEncrypt)
+	if roleErr != nil && s.Grants == nil {
+		warnf(r.Context(), "Unauthorized attempt by role=%s to encrypt with FPE", identity.Role)
+		http.Error(w, roleErr.Error(), http.StatusForbidden)
+		return
+	}
+	// FPE output is deterministic whatever the key, so it takes the same opt-in as a
+	// deterministic key.
+	if err := auth.IsAuthorized(identity, auth.ActionEncryptDeterministic); err != nil {
+		warnf(r.Context(), "Unauthorized attempt by role=%s to encrypt with FPE", identity.Role)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	var req FPERequest
+	if !decodeJSON(w, r.Body, &req) {
+		return
+	}
+	if !req.Deterministic {
+		http.Error(w, "format-preserving encryption is deterministic; set deterministic to true to acknowledge that equal values encrypt alike", http.StatusBadRequest)
+		return
+	}
+	s.serveFPE(w, r, identity, req, keyOpEncrypt, roleErr)
+}
+
+// ---------------------------------------------------------------------
+// Decrypt FPE
+// ---------------------------------------------------------------------
+
+func (s *Server) DecryptFPEHandler(w http.ResponseWriter, r *http.Request) {
+	identity, err := getIdentity(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	roleErr := auth.IsAuthorized(identity, auth.ActionDecrypt)
+	if roleErr != nil && s.Grants == nil {
+		warnf(r.Context(), "Unauthorized attempt by role=%s to decrypt with FPE", identity.Role)
+		http.Error(w, roleErr.Error(), http.StatusForbidden)
+		return
+	}
+
+	var req FPERequest
+	if !decodeJSON(w, r.Body, &req) {
+		return
+	}
+	s.serveFPE(w, r, identity, req, keyOpDecrypt, roleErr)
+}
+
+// ---------------------------------------------------------------------
+// Helper Functions
+// ---------------------------------------------------------------------
+
+// serveFPE runs the part of /encrypt-fpe and /decrypt-fpe after the request is decoded.
+func (s *Server) serveFPE(w http.ResponseWriter, r *http.Request, identity auth.Identity, req FPERequest, op keyOperation, roleErr error) {
+	mode := crypto.FPEMode(strings.ToUpper(req.Mode))
+	if mode == "" {
+		mode = crypto.FPEModeFF1
+	}
+	if mode != crypto.FPEModeFF1 && mode != crypto.FPEModeFF31 {
+		http.Error(w, fmt.Sprintf("mode must be %s or %s", crypto.FPEModeFF1, crypto.FPEModeFF31), http.StatusBadRequest)
+		return
+	}
+	alphabet, err := fpeAlphabet(req.Radix, req.Alphabet)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	tweak := req.Tweak
+	if mode == crypto.FPEModeFF31 && tweak == nil {
+		tweak = make([]byte, crypto.FF31TweakSize)
+	}
+	if len(req.Values) == 0 || len(req.Values) > maxFPEValues {
+		http.Error(w, fmt.Sprintf("values must hold 1 to %d strings", maxFPEValues), http.StatusBadRequest)
+		return
+	}
+	if err := crypto.ValidateEncryptionContext(req.EncryptionContext); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	aad, err := crypto.EncryptionContextAAD(req.EncryptionContext)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	dekID, dekDoc, _, ok := s.loadRequestKey(w, r, identity, req.DEKID, req.Alias, op, roleErr, req.EncryptionContext)
+	if !ok {
+		return
+	}
+	if err := checkKeyScheme(dekDoc, string(mode)); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if op == keyOpEncrypt {
+		for i, v := range req.Values {
+			if err := checkPayloadSize(dekDoc, len(v)); err != nil {
+				http.Error(w, fmt.Sprintf("values[%d]: %v", i, err), http.StatusRequestEntityTooLarge)
+				return
+			}
+		}
+	}
+	quotaOp := quotaOpEncrypt
+	if op == keyOpDecrypt {
+		quotaOp = quotaOpDecrypt
+	}
+	if !s.meterUsage(w, r, identity, dekID, quotaOp, false, true) {
+		return
+	}
+	dek, err := s.unwrapDEK(r, dekDoc)
+	if err != nil {
+		errorf(r.Context(), "Failed to decrypt DEK: %v", err)
+		http.Error(w, "failed to unwrap DEK", http.StatusInternalServerError)
+		return
+	}
+	defer secmem.Zero(dek)
+	key, err := crypto.DeriveFPEKey(dek, mode, aad)
+	if err != nil {
+		errorf(r.Context(), "Failed to derive FPE key: %v", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer secmem.Zero(key)
+	fpe, err := crypto.NewFPE(mode, key, len(alphabet))
+	if err != nil {
+		errorf(r.Context(), "Failed to create FPE cipher: %v", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	index := make(map[rune]uint16, len(alphabet))
+	for i, c := range alphabet {
+		index[c] = uint16(i)
+	}
+
+	endCrypto := traceCrypto(r, string(op)+"-fpe", crypto.Algorithm(mode))
+	out := make([]string, len(req.Values))
+	for i, v := range req.Values {
+		if out[i], err = fpeValue(fpe, alphabet, index, tweak, v, op == keyOpEncrypt); err != nil {
+			endCrypto(err)
+			http.Error(w, fmt.Sprintf("values[%d]: %v", i, err), http.StatusBadRequest)
+			return
+		}
+	}
+	endCrypto(nil)
+	s.touchDEK(r, identity.Tenant, dekID)
+	auditf(r.Context(), "%s %d values with %s and DEK %s", fpeVerb(op), len(out), mode, dekID)
+	writeJSON(w, FPEResponse{Values: out})
+}
+
+// fpeAlphabet returns the numerals of a request, in order.
+func fpeAlphabet(radix int, alphabet string) ([]rune, error) {
+	switch {
+	case alphabet != "" && radix != 0:
+		return nil, fmt.Errorf("give radix or alphabet, not both")
+	case alphabet != "":
+		numerals := []rune(alphabet)
+		seen := make(map[rune]bool, len(numerals))
+		for _, c := range numerals {
+			if seen[c] {
+				return nil, fmt.Errorf("alphabet repeats %q", c)
+			}
+			seen[c] = true
+		}
+		if len(numerals) < 2 || len(numerals) > 1<<16 {
+			return nil, fmt.Errorf("alphabet must have 2 to %d characters", 1<<16)
+		}
+		return numerals, nil
+	case radix == 0:
+		radix = defaultFPERadix
+	}
+	if radix < 2 || radix > len(fpeDigits) {
+		return nil, fmt.Errorf("radix must be between 2 and %d; pass an alphabet for more", len(fpeDigits))
+	}
+	return []rune(fpeDigits[:radix]), nil
+}
+
+// fpeValue encrypts or decrypts the alphabet characters of v, leaving the others in place.
+// index maps each alphabet character to its numeral.
+func fpeValue(f crypto.FPE, alphabet []rune, index map[rune]uint16, tweak []byte, v string, encrypt bool) (string, error) {
+	chars := []rune(v)
+	var numerals []uint16
+	for _, c := range chars {
+		if n, ok := index[c]; ok {
+			numerals = append(numerals, n)
+		}
+	}
+	var (
+		result []uint16
+		err    error
+	)
+	if encrypt {
+		result, err = f.Encrypt(tweak, numerals)
+	} else {
+		result, err = f.Decrypt(tweak, numerals)
+	}
+	if err != nil {
+		return "", err
+	}
+	for i, j := 0, 0; i < len(chars); i++ {
+		if _, ok := index[chars[i]]; ok {
+			chars[i] = alphabet[result[j]]
+			j++
+		}
+	}
+	return string(chars), nil
+}
+
+func fpeVerb(op keyOperation) string {
+	if op == keyOpEncrypt {
+		return "Encrypted"
+	}
+	return "Decrypted"
+}
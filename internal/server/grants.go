@@ -0,0 +1,304 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"my-kms/internal/auth"
+	"my-kms/internal/crypto"
+	"my-kms/internal/events"
+	"my-kms/internal/storage"
+)
+
+// GrantResponse is the public view of a grant.
+type GrantResponse struct {
+	GrantID     string                   `json:"grantID"`
+	DEKID       string                   `json:"dekID"`
+	Grantee     string                   `json:"grantee"`
+	Operations  []string                 `json:"operations"`
+	Constraints storage.GrantConstraints `json:"constraints"`
+	CreatedBy   string                   `json:"createdBy"`
+	CreatedAt   time.Time                `json:"createdAt"`
+	ValidFrom   *time.Time               `json:"validFrom,omitempty"`
+	ExpiresAt   *time.Time               `json:"expiresAt,omitempty"`
+}
+
+func grantResponseFromDoc(g *storage.Grant) GrantResponse {
+	return GrantResponse{
+		GrantID:     g.ID.Hex(),
+		DEKID:       g.DEKID,
+		Grantee:     g.Grantee,
+		Operations:  g.Operations,
+		Constraints: g.Constraints,
+		CreatedBy:   g.CreatedBy,
+		CreatedAt:   g.CreatedAt,
+		ValidFrom:   optionalTime(g.ValidFrom),
+		ExpiresAt:   optionalTime(g.ExpiresAt),
+	}
+}
+
+// ---------------------------------------------------------------------
+// Create Grant
+// ---------------------------------------------------------------------
+
+type CreateGrantRequest struct {
+	DEKID       string                   `json:"dekID"`
+	Grantee     string                   `json:"grantee"`    // user:<uid> or role:<ROLE>
+	Operations  []string                 `json:"operations"` // encrypt and/or decrypt
+	Constraints storage.GrantConstraints `json:"constraints,omitempty"`
+	ValidFrom   *time.Time               `json:"validFrom,omitempty"` // the grant applies from then on
+	ExpiresAt   *time.Time               `json:"expiresAt,omitempty"`
+}
+
+func (s *Server) CreateGrantHandler(w http.ResponseWriter, r *http.Request) {
+	identity, err := getIdentity(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	if err := auth.IsAuthorized(identity, auth.ActionManageKey); err != nil {
+		warnf(r.Context(), "Unauthorized attempt by role=%s to create grant", identity.Role)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	if s.Grants == nil {
+		http.Error(w, "grants are not enabled", http.StatusNotFound)
+		return
+	}
+
+	var req CreateGrantRequest
+	if !decodeJSON(w, r.Body, &req) {
+		return
+	}
+	if req.Grantee == auth.PrincipalAnyone {
+		http.Error(w, "grants must name a specific grantee", http.StatusBadRequest)
+		return
+	}
+	if err := auth.ValidatePrincipal(req.Grantee); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := validateGrantOperations(req.Operations); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	for _, c := range []map[string]string{req.Constraints.EncryptionContextSubset, req.Constraints.EncryptionContextEquals} {
+		if err := crypto.ValidateEncryptionContext(c); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if err := req.Constraints.SourceCIDRs.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var validFrom, expiresAt time.Time
+	if req.ValidFrom != nil {
+		validFrom = req.ValidFrom.UTC()
+	}
+	if req.ExpiresAt != nil {
+		expiresAt = req.ExpiresAt.UTC()
+		if !expiresAt.After(time.Now()) {
+			http.Error(w, "expiresAt must be in the future", http.StatusBadRequest)
+			return
+		}
+		if !validFrom.IsZero() && !expiresAt.After(validFrom) {
+			http.Error(w, "expiresAt must be after validFrom", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if !s.authorizeKeyManagement(w, r, identity, req.DEKID) {
+		return
+	}
+
+	g := storage.Grant{
+		TenantID:    identity.Tenant,
+		DEKID:       req.DEKID,
+		Grantee:     req.Grantee,
+		Operations:  req.Operations,
+		Constraints: req.Constraints,
+		CreatedBy:   identity.Name,
+		ValidFrom:   validFrom,
+		ExpiresAt:   expiresAt,
+	}
+	grantID, err := s.Grants.InsertGrant(r.Context(), g)
+	if err != nil {
+		errorf(r.Context(), "Failed to store grant: %v", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	auditf(r.Context(), "grant %s on DEK %s for %s %v created by %s", grantID, req.DEKID, req.Grantee, req.Operations, identity.Name)
+	s.publishEvent(r, events.GrantCreated, req.DEKID, map[string]string{"grantId": grantID, "grantee": req.Grantee})
+
+	stored, err := s.Grants.GetGrant(r.Context(), identity.Tenant, grantID)
+	if err != nil {
+		errorf(r.Context(), "Failed to read back grant: %v", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, grantResponseFromDoc(stored))
+}
+
+// ---------------------------------------------------------------------
+// List Grants
+// ---------------------------------------------------------------------
+
+type ListGrantsRequest struct {
+	DEKID string `json:"dekID"`
+}
+
+type ListGrantsResponse struct {
+	Grants []GrantResponse `json:"grants"`
+}
+
+func (s *Server) ListGrantsHandler(w http.ResponseWriter, r *http.Request) {
+	identity, err := getIdentity(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	if err := auth.IsAuthorized(identity, auth.ActionListKeys); err != nil {
+		warnf(r.Context(), "Unauthorized attempt by role=%s to list grants", identity.Role)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	if s.Grants == nil {
+		http.Error(w, "grants are not enabled", http.StatusNotFound)
+		return
+	}
+
+	var req ListGrantsRequest
+	if !decodeJSON(w, r.Body, &req) {
+		return
+	}
+
+	grants, err := s.Grants.ListGrants(r.Context(), identity.Tenant, req.DEKID)
+	if err != nil {
+		errorf(r.Context(), "Failed to list grants: %v", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	resp := ListGrantsResponse{Grants: make([]GrantResponse, 0, len(grants))}
+	for i := range grants {
+		resp.Grants = append(resp.Grants, grantResponseFromDoc(&grants[i]))
+	}
+	writeJSON(w, resp)
+}
+
+// ---------------------------------------------------------------------
+// Retire Grant
+// ---------------------------------------------------------------------
+
+type RetireGrantRequest struct {
+	GrantID string `json:"grantID"`
+}
+
+// RetireGrantHandler lets key managers revoke a grant, and grantees give one up when their job is done.
+func (s *Server) RetireGrantHandler(w http.ResponseWriter, r *http.Request) {
+	identity, err := getIdentity(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	if s.Grants == nil {
+		http.Error(w, "grants are not enabled", http.StatusNotFound)
+		return
+	}
+
+	var req RetireGrantRequest
+	if !decodeJSON(w, r.Body, &req) {
+		return
+	}
+
+	g, err := s.Grants.GetGrant(r.Context(), identity.Tenant, req.GrantID)
+	if err != nil {
+		errorf(r.Context(), "Failed to get grant: %v", err)
+		http.Error(w, "grant not found", http.StatusNotFound)
+		return
+	}
+	if !auth.PrincipalMatches(identity, []string{g.Grantee}) {
+		if err := auth.IsAuthorized(identity, auth.ActionManageKey); err != nil {
+			warnf(r.Context(), "Unauthorized attempt by role=%s to retire grant", identity.Role)
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		if !s.authorizeKeyManagement(w, r, identity, g.DEKID) {
+			return
+		}
+	}
+
+	if err := s.Grants.RetireGrant(r.Context(), identity.Tenant, req.GrantID, identity.Name); err != nil {
+		errorf(r.Context(), "Failed to retire grant: %v", err)
+		http.Error(w, "grant not found", http.StatusNotFound)
+		return
+	}
+	auditf(r.Context(), "grant %s on DEK %s retired by %s", req.GrantID, g.DEKID, identity.Name)
+	s.publishEvent(r, events.GrantRetired, g.DEKID, map[string]string{"grantId": req.GrantID, "grantee": g.Grantee})
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ---------------------------------------------------------------------
+// Helper Functions
+// ---------------------------------------------------------------------
+
+func validateGrantOperations(ops []string) error {
+	if len(ops) == 0 {
+		return errors.New("at least one operation is required")
+	}
+	for _, op := range ops {
+		switch keyOperation(op) {
+		case keyOpEncrypt, keyOpDecrypt:
+		default:
+			return fmt.Errorf("operation %q cannot be granted; use encrypt or decrypt", op)
+		}
+	}
+	return nil
+}
+
+// authorizeKeyUse decides whether identity may encrypt or decrypt with doc. The key's usage
+// must allow op, and the encryption context must meet the key policy's condition for it. Then normally the role (roleErr is
+// the result of the RBAC check) and the key policy must both allow it; failing that, an
+// active grant matching the encryption context and client address is enough.
+func (s *Server) authorizeKeyUse(r *http.Request, identity auth.Identity, doc *storage.DEKDocument, op keyOperation, roleErr error, encCtx map[string]string) error {
+	auditKey(r, doc.ID.Hex(), encCtx)
+	if err := checkKeyUsage(r, doc, op); err != nil {
+		return err
+	}
+	if err := checkKeyConditions(r.Context(), identity, doc, op, encCtx); err != nil {
+		return err
+	}
+	denied := roleErr
+	if denied == nil {
+		if denied = checkKeyPolicy(r.Context(), identity, doc, op, encCtx); denied == nil {
+			return nil
+		}
+	}
+	// Grants never widen an emergency-mode identity beyond decrypt, nor an API key beyond its scope.
+	if s.Grants == nil || (identity.DecryptOnly && op != keyOpDecrypt) || !identity.CanUseKey(doc.ID.Hex()) {
+		return denied
+	}
+
+	dekID := doc.ID.Hex()
+	grants, err := s.Grants.FindActiveGrants(r.Context(), identity.Tenant, dekID, auth.PrincipalsFor(identity), string(op))
+	if err != nil {
+		errorf(r.Context(), "Failed to look up grants: %v", err)
+		return denied
+	}
+	for _, g := range grants {
+		if g.Constraints.Allows(encCtx) && g.Constraints.SourceCIDRs.Allows(clientIP(r)) {
+			auditf(r.Context(), "%s on DEK %s by %s allowed by grant %s", op, dekID, identity.Name, g.ID.Hex())
+			return nil
+		}
+	}
+	return denied
+}
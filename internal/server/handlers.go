@@ -1,66 +1,133 @@
 package server
 
 import (
+	"context"
 	"encoding/base64"
 	"encoding/json"
-	"log"
+	"errors"
+	"fmt"
 	"net/http"
+	"time"
 
 	"my-kms/internal/auth"
 	"my-kms/internal/crypto"
+	"my-kms/internal/events"
+	"my-kms/internal/secmem"
+	"my-kms/internal/storage"
 )
 
 // ---------------------------------------------------------------------
 // Generate Data Key
 // ---------------------------------------------------------------------
 
+// GenerateDataKeyRequest is optional; an empty body creates a key without metadata.
+type GenerateDataKeyRequest struct {
+	Algorithm   string            `json:"algorithm,omitempty"` // defaults to AES_256_GCM; AES_256_SIV is deterministic
+	Description string            `json:"description,omitempty"`
+	Tags        map[string]string `json:"tags,omitempty"`
+	Usage       *storage.KeyUsage `json:"usage,omitempty"` // fixed for the key's life
+}
+
 type GenerateDataKeyResponse struct {
-	DEKID       string `json:"dekID"`
-	MasterKeyID string `json:"masterKeyID"`
+	DEKID       string           `json:"dekID"`
+	MasterKeyID string           `json:"masterKeyID"`
+	Algorithm   crypto.Algorithm `json:"algorithm"`
+	PublicKey   []byte           `json:"publicKey,omitempty"` // base64 X25519, for HPKE key pairs
 }
 
 func (s *Server) GenerateDataKeyHandler(w http.ResponseWriter, r *http.Request) {
-	log.Printf("[AUDIT] /generate-data-key called by %s", r.RemoteAddr)
-
 	identity, err := getIdentity(r)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
 		return
 	}
 
 	if err := auth.IsAuthorized(identity, auth.ActionGenerateDataKey); err != nil {
-		log.Printf("Unauthorized attempt by role=%s to generate data key", identity.Role)
+		warnf(r.Context(), "Unauthorized attempt by role=%s to generate data key", identity.Role)
 		http.Error(w, err.Error(), http.StatusForbidden)
 		return
 	}
 
+	var req GenerateDataKeyRequest
+	if !decodeOptionalJSON(w, r.Body, &req) {
+		return
+	}
+	if err := validateTags(req.Tags); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	alg, err := crypto.ParseAlgorithm(req.Algorithm)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := s.AlgPolicy.Check(alg); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if err := validateKeyUsage(req.Usage, alg); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := authorizeDeterministic(identity, alg); err != nil {
+		warnf(r.Context(), "Unauthorized attempt by role=%s to generate deterministic data key", identity.Role)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if !s.meterUsage(w, r, identity, "", quotaOpGenerateDataKey, false, true) {
+		return
+	}
+
 	// Generate new DEK
-	dek, err := crypto.GenerateKey()
+	dek, err := crypto.GenerateKeyFor(alg)
+	if err != nil {
+		errorf(r.Context(), "Failed to generate DEK: %v", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer secmem.Zero(dek)
+	publicKey, err := hpkePublicKey(alg, dek)
 	if err != nil {
-		log.Printf("Failed to generate DEK: %v", err)
+		errorf(r.Context(), "Failed to derive HPKE public key: %v", err)
 		http.Error(w, "internal server error", http.StatusInternalServerError)
 		return
 	}
 
 	// Encrypt (wrap) DEK using master key
-	encryptedDEK, masterKeyID, err := s.KeyStore.EncryptDataKey(dek)
+	encryptedDEK, masterKeyID, err := s.wrapDEK(r, identity.Tenant, dek)
 	if err != nil {
-		log.Printf("Failed to encrypt DEK: %v", err)
+		errorf(r.Context(), "Failed to encrypt DEK: %v", err)
 		http.Error(w, "encryption failed", http.StatusInternalServerError)
 		return
 	}
 
 	// Store in Mongo
-	dekID, err := s.DEKStore.InsertDEK(r.Context(), encryptedDEK, masterKeyID)
+	dekID, err := s.DEKStore.InsertDEK(r.Context(), storage.DEKDocument{
+		DEK:         encryptedDEK,
+		MasterKeyID: masterKeyID,
+		TenantID:    identity.Tenant,
+		OwnerUID:    identity.Name,
+		Description: req.Description,
+		Tags:        req.Tags,
+		CreatedBy:   identity.Name,
+		Algorithm:   string(alg),
+		PublicKey:   publicKey,
+		Usage:       req.Usage,
+	})
 	if err != nil {
-		log.Printf("Failed to store DEK in MongoDB: %v", err)
+		errorf(r.Context(), "Failed to store DEK in MongoDB: %v", err)
 		http.Error(w, "internal server error", http.StatusInternalServerError)
 		return
 	}
+	auditKey(r, dekID, nil)
+	s.publishEvent(r, events.KeyCreated, dekID, map[string]string{"algorithm": string(alg)})
 
 	resp := GenerateDataKeyResponse{
 		DEKID:       dekID,
 		MasterKeyID: masterKeyID,
+		Algorithm:   alg,
+		PublicKey:   publicKey,
 	}
 	writeJSON(w, resp)
 }
@@ -70,61 +137,195 @@ func (s *Server) GenerateDataKeyHandler(w http.ResponseWriter, r *http.Request)
 // ---------------------------------------------------------------------
 
 type EncryptRequest struct {
-	DEKID    string          `json:"dekID"`
-	JSONData json.RawMessage `json:"jsonData"` // raw JSON to encrypt
+	DEKID        string          `json:"dekID"`
+	Alias        string          `json:"alias,omitempty"`        // alternative to dekID
+	JSONData     json.RawMessage `json:"jsonData,omitempty"`     // raw JSON to encrypt
+	Plaintext    []byte          `json:"plaintext,omitempty"`    // base64 bytes to encrypt, instead of jsonData
+	ValidateOnly bool            `json:"validateOnly,omitempty"` // run every check but do not encrypt
+
+	// Deterministic must be set, and is only accepted, for a deterministic key.
+	Deterministic bool `json:"deterministic,omitempty"`
+
+	// Format "jwe" returns a JWE compact serialization; AES-GCM keys only.
+	Format string `json:"format,omitempty"`
+
+	// EncryptionContext is bound to the ciphertext; decrypt must present the same map.
+	EncryptionContext map[string]string `json:"encryptionContext,omitempty"`
 }
 
 type EncryptResponse struct {
-	Ciphertext string `json:"ciphertext"` // base64-encoded
+	Ciphertext string `json:"ciphertext"` // base64-encoded, or the JWE with format jwe
+	DEKID      string `json:"dekID"`      // the key used, resolved when an alias was given
 }
 
 func (s *Server) EncryptHandler(w http.ResponseWriter, r *http.Request) {
-	log.Printf("[AUDIT] /encrypt called by %s", r.RemoteAddr)
-
 	identity, err := getIdentity(r)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
 		return
 	}
 
-	if err := auth.IsAuthorized(identity, auth.ActionEncrypt); err != nil {
-		log.Printf("Unauthorized attempt by role=%s to encrypt data", identity.Role)
-		http.Error(w, err.Error(), http.StatusForbidden)
+	// Without the role a grant on the key may still allow the call; checked once the key is loaded.
+	roleErr := auth.IsAuthorized(identity, auth.ActionEncrypt)
+	if roleErr != nil && s.Grants == nil {
+		warnf(r.Context(), "Unauthorized attempt by role=%s to encrypt data", identity.Role)
+		http.Error(w, roleErr.Error(), http.StatusForbidden)
 		return
 	}
 
-	var req EncryptRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "invalid request body", http.StatusBadRequest)
+	req, err := s.readEncryptRequest(r)
+	if errors.Is(err, errPayloadTooLarge) {
+		http.Error(w, fmt.Sprintf("plaintext exceeds the %d byte limit", s.MaxPayloadBytes), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), requestErrorStatus(err))
+		return
+	}
+	if err := crypto.ValidateEncryptionContext(req.EncryptionContext); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := validCiphertextFormat(req.Format); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	dekID, alias, err := s.resolveKey(r, identity.Tenant, req.DEKID, req.Alias)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
 	// Retrieve DEK from Mongo
-	dekDoc, err := s.DEKStore.GetDEK(r.Context(), req.DEKID)
+	dekDoc, err := s.DEKStore.GetDEK(r.Context(), identity.Tenant, dekID)
 	if err != nil {
-		log.Printf("Failed to get DEK: %v", err)
+		errorf(r.Context(), "Failed to get DEK: %v", err)
 		http.Error(w, "DEK not found", http.StatusBadRequest)
 		return
 	}
+	if err := s.authorizeKeyUse(r, identity, dekDoc, keyOpEncrypt, roleErr, req.EncryptionContext); err != nil {
+		warnf(r.Context(), "Unauthorized attempt by role=%s to encrypt data", identity.Role)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	aad, err := crypto.EncryptionContextAAD(req.EncryptionContext)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := checkKeyUsable(dekDoc); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	alg, err := s.keyAlgorithm(dekDoc)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if err := checkDeterministicRequest(alg, req.Deterministic); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := checkKeyScheme(dekDoc, ciphertextScheme(alg, req.Format == ciphertextFormatJWE)); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	var jweHeader crypto.JWEHeader
+	if req.Format == ciphertextFormatJWE {
+		if jweHeader, err = crypto.NewJWEHeader(alg, dekID, jweContextHash(aad)); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if err := authorizeDeterministic(identity, alg); err != nil {
+		warnf(r.Context(), "Unauthorized attempt by role=%s to encrypt deterministically", identity.Role)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	signalKeyDeprecation(w, r, dekDoc)
+
+	if int64(len(req.payload())) > s.MaxPayloadBytes {
+		http.Error(w, fmt.Sprintf("plaintext exceeds the %d byte limit", s.MaxPayloadBytes), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err := checkPayloadSize(dekDoc, len(req.payload())); err != nil {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	plaintext, err := s.beforeEncrypt(r, identity, dekID, alias, req.payload())
+	if err != nil {
+		warnf(r.Context(), "Payload rejected before encryption: %v", err)
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	if !s.meterUsage(w, r, identity, dekID, quotaOpEncrypt, req.ValidateOnly, true) {
+		return
+	}
+
+	if req.ValidateOnly {
+		if !s.canUnwrap(r, dekDoc) {
+			http.Error(w, "failed to unwrap DEK", http.StatusInternalServerError)
+			return
+		}
+		expected := len(plaintext) + alg.Overhead()
+		if req.Format == ciphertextFormatJWE {
+			expected = crypto.JWELength(jweHeader, len(plaintext))
+		}
+		writeJSON(w, ValidationResponse{
+			ValidateOnly:        true,
+			Operation:           "encrypt",
+			DEKID:               dekID,
+			Algorithm:           alg,
+			KeyState:            dekDoc.EffectiveState(),
+			InputBytes:          len(req.payload()),
+			ExpectedOutputBytes: expected,
+		})
+		return
+	}
+
+	if !s.reserveEncryptions(w, r, dekID, alg, 1) {
+		return
+	}
 
 	// Unwrap the DEK
-	dek, err := s.KeyStore.DecryptDataKey(dekDoc.DEK, dekDoc.MasterKeyID)
+	dek, err := s.unwrapDEK(r, dekDoc)
 	if err != nil {
-		log.Printf("Failed to decrypt DEK: %v", err)
+		errorf(r.Context(), "Failed to decrypt DEK: %v", err)
 		http.Error(w, "failed to unwrap DEK", http.StatusInternalServerError)
 		return
 	}
+	defer secmem.Zero(dek)
 
 	// Encrypt the raw JSON
-	ciphertextBytes, err := crypto.EncryptAES256GCM(dek, req.JSONData)
+	endCrypto := traceCrypto(r, "encrypt", alg)
+	var ciphertextBytes []byte
+	if req.Format == ciphertextFormatJWE {
+		var compact string
+		compact, err = crypto.SealJWE(alg, dek, jweHeader, plaintext)
+		ciphertextBytes = []byte(compact)
+	} else {
+		ciphertextBytes, err = crypto.Encrypt(alg, dek, plaintext, aad)
+	}
+	endCrypto(err)
 	if err != nil {
-		log.Printf("Failed to encrypt JSON: %v", err)
+		errorf(r.Context(), "Failed to encrypt JSON: %v", err)
 		http.Error(w, "encryption failed", http.StatusInternalServerError)
 		return
 	}
+	s.touchDEK(r, identity.Tenant, dekID)
 
+	if wantsBinary(r) {
+		writeBinary(w, ciphertextBytes)
+		return
+	}
+	ciphertext := base64.StdEncoding.EncodeToString(ciphertextBytes)
+	if req.Format == ciphertextFormatJWE {
+		ciphertext = string(ciphertextBytes)
+	}
 	resp := EncryptResponse{
-		Ciphertext: base64.StdEncoding.EncodeToString(ciphertextBytes),
+		Ciphertext: ciphertext,
+		DEKID:      dekID,
 	}
 	writeJSON(w, resp)
 }
@@ -134,100 +335,264 @@ func (s *Server) EncryptHandler(w http.ResponseWriter, r *http.Request) {
 // ---------------------------------------------------------------------
 
 type DecryptRequest struct {
-	DEKID      string `json:"dekID"`
-	Ciphertext string `json:"ciphertext"` // base64
+	DEKID        string `json:"dekID"`
+	Alias        string `json:"alias,omitempty"`        // alternative to dekID
+	Ciphertext   string `json:"ciphertext"`             // base64, or a JWE from format jwe
+	ValidateOnly bool   `json:"validateOnly,omitempty"` // run every check but do not decrypt
+
+	// Format "jwe" is only needed for a binary request; a JWE ciphertext in JSON is
+	// recognized, and dekID and alias may then be left out.
+	Format string `json:"format,omitempty"`
+
+	// PlaintextEncoding "base64" always returns plaintext; by default a JSON plaintext
+	// comes back as jsonData.
+	PlaintextEncoding string `json:"plaintextEncoding,omitempty"`
+
+	EncryptionContext map[string]string `json:"encryptionContext,omitempty"`
 }
 
 type DecryptResponse struct {
-	JSONData json.RawMessage `json:"jsonData"`
+	JSONData  json.RawMessage `json:"jsonData,omitempty"`
+	Plaintext []byte          `json:"plaintext,omitempty"` // base64, when the plaintext is not JSON
 }
 
 func (s *Server) DecryptHandler(w http.ResponseWriter, r *http.Request) {
-	log.Printf("[AUDIT] /decrypt called by %s", r.RemoteAddr)
-
 	identity, err := getIdentity(r)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
 		return
 	}
 
-	if err := auth.IsAuthorized(identity, auth.ActionDecrypt); err != nil {
-		log.Printf("Unauthorized attempt by role=%s to decrypt data", identity.Role)
-		http.Error(w, err.Error(), http.StatusForbidden)
+	// Without the role a grant on the key may still allow the call; checked once the key is loaded.
+	roleErr := auth.IsAuthorized(identity, auth.ActionDecrypt)
+	if roleErr != nil && s.Grants == nil {
+		warnf(r.Context(), "Unauthorized attempt by role=%s to decrypt data", identity.Role)
+		http.Error(w, roleErr.Error(), http.StatusForbidden)
 		return
 	}
 
-	var req DecryptRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "invalid request body", http.StatusBadRequest)
+	req, rawCiphertext, err := s.readDecryptRequest(r)
+	if errors.Is(err, errPayloadTooLarge) {
+		http.Error(w, fmt.Sprintf("ciphertext exceeds the %d byte limit", s.MaxPayloadBytes), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), requestErrorStatus(err))
+		return
+	}
+	if err := validPlaintextEncoding(req.PlaintextEncoding); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	jwe, err := readJWE(&req, rawCiphertext)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := crypto.ValidateEncryptionContext(req.EncryptionContext); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	dekID, alias, err := s.resolveKey(r, identity.Tenant, req.DEKID, req.Alias)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	dekDoc, err := s.DEKStore.GetDEK(r.Context(), req.DEKID)
+	dekDoc, err := s.DEKStore.GetDEK(r.Context(), identity.Tenant, dekID)
 	if err != nil {
-		log.Printf("Failed to get DEK: %v", err)
+		errorf(r.Context(), "Failed to get DEK: %v", err)
 		http.Error(w, "DEK not found", http.StatusBadRequest)
 		return
 	}
-
-	// Unwrap the DEK
-	dek, err := s.KeyStore.DecryptDataKey(dekDoc.DEK, dekDoc.MasterKeyID)
+	if err := s.authorizeKeyUse(r, identity, dekDoc, keyOpDecrypt, roleErr, req.EncryptionContext); err != nil {
+		warnf(r.Context(), "Unauthorized attempt by role=%s to decrypt data", identity.Role)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	aad, err := crypto.EncryptionContextAAD(req.EncryptionContext)
 	if err != nil {
-		log.Printf("Failed to decrypt DEK: %v", err)
-		http.Error(w, "failed to unwrap DEK", http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := checkKeyUsable(dekDoc); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	alg, err := s.keyAlgorithm(dekDoc)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if jwe != nil {
+		if err := checkJWE(jwe, dekID, alg, aad); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if err := checkKeyScheme(dekDoc, ciphertextScheme(alg, jwe != nil)); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	signalKeyDeprecation(w, r, dekDoc)
 
 	// Decode ciphertext
-	ciphertextBytes, err := base64.StdEncoding.DecodeString(req.Ciphertext)
+	ciphertextBytes := rawCiphertext
+	switch {
+	case jwe != nil:
+		ciphertextBytes = jwe.Ciphertext
+	case ciphertextBytes == nil:
+		if ciphertextBytes, err = base64.StdEncoding.DecodeString(req.Ciphertext); err != nil {
+			http.Error(w, "invalid base64 ciphertext", http.StatusBadRequest)
+			return
+		}
+	}
+	if int64(len(ciphertextBytes)) > s.MaxPayloadBytes+int64(alg.Overhead()) {
+		http.Error(w, fmt.Sprintf("ciphertext exceeds the %d byte limit", s.MaxPayloadBytes), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if !s.meterUsage(w, r, identity, dekID, quotaOpDecrypt, req.ValidateOnly, true) {
+		return
+	}
+
+	if req.ValidateOnly {
+		expected := len(ciphertextBytes) - alg.Overhead()
+		if jwe != nil {
+			expected = len(jwe.Ciphertext)
+		}
+		if expected < 0 {
+			http.Error(w, "ciphertext too short", http.StatusBadRequest)
+			return
+		}
+		if !s.canUnwrap(r, dekDoc) {
+			http.Error(w, "failed to unwrap DEK", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, ValidationResponse{
+			ValidateOnly:        true,
+			Operation:           "decrypt",
+			DEKID:               dekID,
+			Algorithm:           alg,
+			KeyState:            dekDoc.EffectiveState(),
+			InputBytes:          len(ciphertextBytes),
+			ExpectedOutputBytes: expected,
+		})
+		return
+	}
+
+	// Unwrap the DEK
+	dek, err := s.unwrapDEK(r, dekDoc)
 	if err != nil {
-		http.Error(w, "invalid base64 ciphertext", http.StatusBadRequest)
+		errorf(r.Context(), "Failed to decrypt DEK: %v", err)
+		http.Error(w, "failed to unwrap DEK", http.StatusInternalServerError)
 		return
 	}
+	defer secmem.Zero(dek)
 
 	// Decrypt
-	plaintextBytes, err := crypto.DecryptAES256GCM(dek, ciphertextBytes)
+	endCrypto := traceCrypto(r, "decrypt", alg)
+	var plaintextBytes []byte
+	if jwe != nil {
+		plaintextBytes, err = crypto.OpenJWE(alg, dek, jwe)
+	} else {
+		plaintextBytes, err = crypto.Decrypt(alg, dek, ciphertextBytes, aad)
+	}
+	endCrypto(err)
 	if err != nil {
-		log.Printf("Failed to decrypt data: %v", err)
+		errorf(r.Context(), "Failed to decrypt data: %v", err)
 		http.Error(w, "decryption failed", http.StatusInternalServerError)
 		return
 	}
+	s.touchDEK(r, identity.Tenant, dekID)
 
-	resp := DecryptResponse{
-		JSONData: plaintextBytes,
+	plaintextBytes, err = s.afterDecrypt(r, identity, dekID, alias, plaintextBytes)
+	if err != nil {
+		warnf(r.Context(), "Payload rejected after decryption: %v", err)
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
 	}
-	writeJSON(w, resp)
+
+	writePlaintext(w, r, plaintextBytes, req.PlaintextEncoding)
+}
+
+// ---------------------------------------------------------------------
+// Validate-only (dry run) responses
+// ---------------------------------------------------------------------
+
+// ValidationResponse is returned instead of ciphertext/plaintext when validateOnly is set.
+// Reaching it means every auth, policy, key-state and size check passed.
+type ValidationResponse struct {
+	ValidateOnly        bool             `json:"validateOnly"`
+	Operation           string           `json:"operation"`
+	DEKID               string           `json:"dekID"`
+	Algorithm           crypto.Algorithm `json:"algorithm"`
+	KeyState            storage.KeyState `json:"keyState"`
+	InputBytes          int              `json:"inputBytes"`
+	ExpectedOutputBytes int              `json:"expectedOutputBytes"`
 }
 
 // ---------------------------------------------------------------------
 // Rotate Master Key
 // ---------------------------------------------------------------------
 
+type RotateKeyRequest struct {
+	Reason string `json:"reason,omitempty"` // kept in the rotation history
+}
+
 type RotateKeyResponse struct {
 	NewMasterKeyID string `json:"newMasterKeyID"`
 }
 
 func (s *Server) RotateMasterKeyHandler(w http.ResponseWriter, r *http.Request) {
-	log.Printf("[AUDIT] /rotate-master-key called by %s", r.RemoteAddr)
-
 	identity, err := getIdentity(r)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
 		return
 	}
 
 	if err := auth.IsAuthorized(identity, auth.ActionRotateMasterKey); err != nil {
-		log.Printf("Unauthorized attempt by role=%s to rotate master key", identity.Role)
+		warnf(r.Context(), "Unauthorized attempt by role=%s to rotate master key", identity.Role)
 		http.Error(w, err.Error(), http.StatusForbidden)
 		return
 	}
 
-	newKey, err := s.KeyStore.RotateMasterKey()
+	var req RotateKeyRequest
+	if !decodeOptionalJSON(w, r.Body, &req) {
+		return
+	}
+
+	if !s.requireSecondApprover(w, r, identity, "rotate-master-key", "") {
+		return
+	}
+
+	var previous string
+	var newKey storage.MasterKey
+	ran := s.withClusterLock(r.Context(), LockRotation, func(context.Context) {
+		_, previous = s.KeyStore.KeyIDs()
+		newKey, err = s.KeyStore.RotateMasterKey(identity.Name)
+	})
+	if !ran {
+		http.Error(w, "a master key rotation or rewrap is in progress on another replica; try again later", http.StatusConflict)
+		return
+	}
 	if err != nil {
-		log.Printf("Failed to rotate master key: %v", err)
+		errorf(r.Context(), "Failed to rotate master key: %v", err)
 		http.Error(w, "master key rotation failed", http.StatusInternalServerError)
 		return
 	}
+	auditf(r.Context(), "master key rotated to %s by %s", newKey.ID, identity.Name)
+	s.recordKeyRotation(r.Context(), storage.KeyRotationEvent{
+		KeyType:   storage.RotatedKeyMaster,
+		Method:    storage.RotationMethodRotate,
+		KeyID:     previous,
+		NewKeyID:  newKey.ID,
+		RotatedBy: identity.Name,
+		Reason:    req.Reason,
+	})
+	s.publishEventAs(identity.Name, "", events.MasterKeyRotated, newKey.ID, map[string]string{"previousKeyId": previous})
+	if s.Rotation != nil {
+		s.Rotation.Kick()
+	}
 
 	resp := RotateKeyResponse{NewMasterKeyID: newKey.ID}
 	writeJSON(w, resp)
@@ -238,55 +603,81 @@ func (s *Server) RotateMasterKeyHandler(w http.ResponseWriter, r *http.Request)
 // ---------------------------------------------------------------------
 
 type DeleteDEKRequest struct {
-	DEKID string `json:"dekID"`
+	DEKID string `json:"dekID" validate:"required"`
 }
 
 func (s *Server) DeleteDataKeyHandler(w http.ResponseWriter, r *http.Request) {
-	log.Printf("[AUDIT] /delete-data-key called by %s", r.RemoteAddr)
-
 	identity, err := getIdentity(r)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
 		return
 	}
 
 	// If you want to restrict deletion to Admins or a special action, define a new action or reuse an existing one:
 	// For example, re-use ActionRotateMasterKey or define ActionDeleteDataKey
 	if err := auth.IsAuthorized(identity, auth.ActionRotateMasterKey); err != nil {
-		log.Printf("Unauthorized attempt by role=%s to delete DEK", identity.Role)
+		warnf(r.Context(), "Unauthorized attempt by role=%s to delete DEK", identity.Role)
 		http.Error(w, err.Error(), http.StatusForbidden)
 		return
 	}
 
 	var req DeleteDEKRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "invalid request body", http.StatusBadRequest)
+	if !decodeJSON(w, r.Body, &req) {
+		return
+	}
+
+	if !s.authorizeKeyOperation(w, r, identity, req.DEKID, keyOpDelete) {
+		return
+	}
+	if err := s.checkLegalHold(r, identity.Tenant, req.DEKID); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if !s.requireSecondApprover(w, r, identity, "delete-data-key", req.DEKID) {
 		return
 	}
 
-	if err := s.DEKStore.DeleteDEK(r.Context(), req.DEKID); err != nil {
-		log.Printf("Failed to delete DEK: %v", err)
+	if err := s.DEKStore.DeleteDEK(r.Context(), identity.Tenant, req.DEKID, identity.Name); err != nil {
+		errorf(r.Context(), "Failed to delete DEK: %v", err)
 		http.Error(w, "failed to delete DEK", http.StatusInternalServerError)
 		return
 	}
+	s.flagCiphertextLocations(r, identity.Tenant, req.DEKID, storage.ReencryptionReasonShredded, "")
+	s.publishEvent(r, events.KeyDeletionScheduled, req.DEKID, nil)
 
 	w.WriteHeader(http.StatusNoContent)
 }
 
+// ---------------------------------------------------------------------
+// Server Time
+// ---------------------------------------------------------------------
+
+type TimeResponse struct {
+	ServerTime time.Time `json:"serverTime"`
+	Unix       int64     `json:"unix"`
+}
+
+// TimeHandler is unauthenticated so clients can measure their clock drift before fetching tokens.
+func (s *Server) TimeHandler(w http.ResponseWriter, r *http.Request) {
+	now := time.Now().UTC()
+	writeJSON(w, TimeResponse{ServerTime: now, Unix: now.Unix()})
+}
+
 // ---------------------------------------------------------------------
 // Helper Functions
 // ---------------------------------------------------------------------
 
+// getIdentity returns the caller the auth middleware put in the request context, or
+// ErrNoIdentity, which handlers answer with a 401.
 func getIdentity(r *http.Request) (auth.Identity, error) {
-	ctxVal := r.Context().Value("identity")
-	id, ok := ctxVal.(auth.Identity)
+	id, ok := auth.FromContext(r.Context())
 	if !ok {
 		return auth.Identity{}, ErrNoIdentity
 	}
 	return id, nil
 }
 
-var ErrNoIdentity = &jsonError{"could not read identity"}
+var ErrNoIdentity = &jsonError{"no authenticated identity"}
 
 type jsonError struct {
 	Message string `json:"message"`
@@ -299,6 +690,6 @@ func (e *jsonError) Error() string {
 func writeJSON(w http.ResponseWriter, v interface{}) {
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(v); err != nil {
-		log.Printf("writeJSON error: %v", err)
+		errorf(context.Background(), "writeJSON error: %v", err)
 	}
 }
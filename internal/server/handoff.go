@@ -0,0 +1,253 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"time"
+
+	"my-kms/internal/auth"
+	"my-kms/internal/crypto"
+	"my-kms/internal/secmem"
+	"my-kms/internal/storage"
+)
+
+// DefaultHandoffTokenTTL is used when a handoff request names no lifetime.
+const DefaultHandoffTokenTTL = 5 * time.Minute
+
+// DefaultHandoffTokenMaxTTL caps the lifetime a caller may ask for.
+const DefaultHandoffTokenMaxTTL = 15 * time.Minute
+
+// ---------------------------------------------------------------------
+// Create Handoff Token
+// ---------------------------------------------------------------------
+
+type CreateHandoffTokenRequest struct {
+	DEKID      string `json:"dekID"`
+	Alias      string `json:"alias,omitempty"`                // alternative to dekID
+	Ciphertext string `json:"ciphertext" validate:"required"` // base64; the only ciphertext the token will open
+	Recipient  string `json:"recipient" validate:"required"`  // identity name of the service receiving the payload
+	TTLSeconds int    `json:"ttlSeconds,omitempty"`
+
+	EncryptionContext map[string]string `json:"encryptionContext,omitempty"`
+}
+
+type CreateHandoffTokenResponse struct {
+	HandoffToken string    `json:"handoffToken"`
+	DEKID        string    `json:"dekID"`
+	Recipient    string    `json:"recipient"`
+	ExpiresAt    time.Time `json:"expiresAt"`
+}
+
+// CreateHandoffTokenHandler lets a caller who may decrypt a ciphertext pass that one
+// decryption on to another service, without granting it decrypt on the key.
+func (s *Server) CreateHandoffTokenHandler(w http.ResponseWriter, r *http.Request) {
+	identity, err := getIdentity(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	// A handoff is a delegated decrypt, so the caller needs decrypt itself (role or grant).
+	roleErr := auth.IsAuthorized(identity, auth.ActionDecrypt)
+	if roleErr != nil && s.Grants == nil {
+		warnf(r.Context(), "Unauthorized attempt by role=%s to create handoff token", identity.Role)
+		http.Error(w, roleErr.Error(), http.StatusForbidden)
+		return
+	}
+
+	if s.HandoffTokens == nil {
+		http.Error(w, "handoff tokens are not enabled", http.StatusNotFound)
+		return
+	}
+
+	var req CreateHandoffTokenRequest
+	if !decodeJSON(w, r.Body, &req) {
+		return
+	}
+	if err := crypto.ValidateEncryptionContext(req.EncryptionContext); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ttl := DefaultHandoffTokenTTL
+	if req.TTLSeconds != 0 {
+		ttl = time.Duration(req.TTLSeconds) * time.Second
+	}
+	if ttl <= 0 || ttl > s.HandoffTokenMaxTTL {
+		http.Error(w, fmt.Sprintf("ttlSeconds must be between 1 and %d", int(s.HandoffTokenMaxTTL/time.Second)), http.StatusBadRequest)
+		return
+	}
+	ciphertextBytes, err := base64.StdEncoding.DecodeString(req.Ciphertext)
+	if err != nil || len(ciphertextBytes) == 0 {
+		http.Error(w, "invalid base64 ciphertext", http.StatusBadRequest)
+		return
+	}
+
+	dekID, alias, err := s.resolveKey(r, identity.Tenant, req.DEKID, req.Alias)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	dekDoc, err := s.DEKStore.GetDEK(r.Context(), identity.Tenant, dekID)
+	if err != nil {
+		errorf(r.Context(), "Failed to get DEK: %v", err)
+		http.Error(w, "DEK not found", http.StatusBadRequest)
+		return
+	}
+	if err := s.authorizeKeyUse(r, identity, dekDoc, keyOpDecrypt, roleErr, req.EncryptionContext); err != nil {
+		warnf(r.Context(), "Unauthorized attempt by role=%s to create handoff token", identity.Role)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if err := checkKeyUsable(dekDoc); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	sum := sha256.Sum256(ciphertextBytes)
+	now := time.Now().UTC()
+	tok := storage.HandoffToken{
+		TenantID:          identity.Tenant,
+		DEKID:             dekID,
+		CiphertextHash:    sum[:],
+		EncryptionContext: req.EncryptionContext,
+		Recipient:         req.Recipient,
+		CreatedBy:         identity.Name,
+		CreatedAt:         now,
+		ExpiresAt:         now.Add(ttl),
+	}
+	if alias != nil {
+		tok.AliasName = alias.Name
+	}
+	tokenID, err := s.HandoffTokens.InsertHandoffToken(r.Context(), tok)
+	if err != nil {
+		errorf(r.Context(), "Failed to store handoff token: %v", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	auditf(r.Context(), "handoff token %s on DEK %s for %s created by %s, expires %s", tokenID, dekID, req.Recipient, identity.Name, tok.ExpiresAt.Format(time.RFC3339))
+
+	writeJSON(w, CreateHandoffTokenResponse{
+		HandoffToken: tokenID,
+		DEKID:        dekID,
+		Recipient:    req.Recipient,
+		ExpiresAt:    tok.ExpiresAt,
+	})
+}
+
+// ---------------------------------------------------------------------
+// Redeem Handoff Token
+// ---------------------------------------------------------------------
+
+type RedeemHandoffTokenRequest struct {
+	HandoffToken string `json:"handoffToken" validate:"required"`
+	Ciphertext   string `json:"ciphertext" validate:"required"` // base64; must be the ciphertext the token was minted for
+}
+
+// RedeemHandoffTokenHandler decrypts the ciphertext a handoff token is bound to. Only the
+// named recipient can redeem it, only once, and no decrypt role is required.
+func (s *Server) RedeemHandoffTokenHandler(w http.ResponseWriter, r *http.Request) {
+	identity, err := getIdentity(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	if s.HandoffTokens == nil {
+		http.Error(w, "handoff tokens are not enabled", http.StatusNotFound)
+		return
+	}
+
+	var req RedeemHandoffTokenRequest
+	if !decodeJSON(w, r.Body, &req) {
+		return
+	}
+	ciphertextBytes, err := base64.StdEncoding.DecodeString(req.Ciphertext)
+	if err != nil {
+		http.Error(w, "invalid base64 ciphertext", http.StatusBadRequest)
+		return
+	}
+
+	sum := sha256.Sum256(ciphertextBytes)
+	tok, err := s.HandoffTokens.ConsumeHandoffToken(r.Context(), identity.Tenant, req.HandoffToken, identity.Name, sum[:])
+	if err != nil {
+		errorf(r.Context(), "Failed to redeem handoff token for %s: %v", identity.Name, err)
+		http.Error(w, "invalid handoff token", http.StatusForbidden)
+		return
+	}
+	auditKey(r, tok.DEKID, tok.EncryptionContext)
+	if !identity.CanUseKey(tok.DEKID) {
+		http.Error(w, "API key is not scoped to this DEK", http.StatusForbidden)
+		return
+	}
+
+	dekDoc, err := s.DEKStore.GetDEK(r.Context(), identity.Tenant, tok.DEKID)
+	if err != nil {
+		errorf(r.Context(), "Failed to get DEK: %v", err)
+		http.Error(w, "DEK not found", http.StatusBadRequest)
+		return
+	}
+	if err := checkKeyUsable(dekDoc); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	alg, err := s.keyAlgorithm(dekDoc)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if err := checkKeyScheme(dekDoc, string(alg)); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if int64(len(ciphertextBytes)) > s.MaxPayloadBytes+int64(alg.Overhead()) {
+		http.Error(w, fmt.Sprintf("ciphertext exceeds the %d byte limit", s.MaxPayloadBytes), http.StatusRequestEntityTooLarge)
+		return
+	}
+	aad, err := crypto.EncryptionContextAAD(tok.EncryptionContext)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	signalKeyDeprecation(w, r, dekDoc)
+	// Counted as a decrypt but never refused: the token is already spent, and the
+	// decrypt was sanctioned when it was minted.
+	if !s.meterUsage(w, r, identity, tok.DEKID, quotaOpDecrypt, false, false) {
+		return
+	}
+
+	dek, err := s.unwrapDEK(r, dekDoc)
+	if err != nil {
+		errorf(r.Context(), "Failed to decrypt DEK: %v", err)
+		http.Error(w, "failed to unwrap DEK", http.StatusInternalServerError)
+		return
+	}
+	defer secmem.Zero(dek)
+	endCrypto := traceCrypto(r, "decrypt", alg)
+	plaintextBytes, err := crypto.Decrypt(alg, dek, ciphertextBytes, aad)
+	endCrypto(err)
+	if err != nil {
+		errorf(r.Context(), "Failed to decrypt data: %v", err)
+		http.Error(w, "decryption failed", http.StatusInternalServerError)
+		return
+	}
+	s.touchDEK(r, identity.Tenant, tok.DEKID)
+	auditf(r.Context(), "handoff token %s on DEK %s from %s redeemed by %s", req.HandoffToken, tok.DEKID, tok.CreatedBy, identity.Name)
+
+	// Apply the alias transformers only if the alias still points at the same key.
+	var alias *storage.Alias
+	if tok.AliasName != "" {
+		if dekID, a, err := s.resolveKey(r, identity.Tenant, "", tok.AliasName); err == nil && dekID == tok.DEKID {
+			alias = a
+		}
+	}
+	plaintextBytes, err = s.afterDecrypt(r, identity, tok.DEKID, alias, plaintextBytes)
+	if err != nil {
+		warnf(r.Context(), "Payload rejected after decryption: %v", err)
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+
+	writePlaintext(w, r, plaintextBytes, plaintextEncodingAuto)
+}
@@ -0,0 +1,212 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+
+	"my-kms/internal/auth"
+	"my-kms/internal/crypto"
+	"my-kms/internal/secmem"
+)
+
+// ---------------------------------------------------------------------
+// HPKE
+// ---------------------------------------------------------------------
+
+// HPKESuite names the one RFC 9180 suite HPKE key pairs use, by its registry IDs.
+type HPKESuite struct {
+	KEM  uint16 `json:"kem"`
+	KDF  uint16 `json:"kdf"`
+	AEAD uint16 `json:"aead"`
+}
+
+var hpkeSuite = HPKESuite{KEM: crypto.HPKEKEMID, KDF: crypto.HPKEKDFID, AEAD: crypto.HPKEAEADID}
+
+// hpkePublicKey returns the public key of an HPKE key pair, and nil for any other algorithm.
+func hpkePublicKey(alg crypto.Algorithm, key []byte) ([]byte, error) {
+	if !alg.HPKE() {
+		return nil, nil
+	}
+	return crypto.HPKEPublicKey(key)
+}
+
+type HPKEPublicKeyRequest struct {
+	DEKID string `json:"dekID"`
+	Alias string `json:"alias,omitempty"` // alternative to dekID
+}
+
+type HPKEPublicKeyResponse struct {
+	DEKID     string    `json:"dekID"`
+	PublicKey []byte    `json:"publicKey"` // base64 X25519
+	Suite     HPKESuite `json:"suite"`
+}
+
+// HPKEPublicKeyHandler returns the public key senders seal to. It is not secret, but
+// callers still need DESCRIBE_KEY, as for /describe-key.
+func (s *Server) HPKEPublicKeyHandler(w http.ResponseWriter, r *http.Request) {
+	identity, err := getIdentity(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	if err := auth.IsAuthorized(identity, auth.ActionDescribeKey); err != nil {
+		warnf(r.Context(), "Unauthorized attempt by role=%s to get HPKE public key", identity.Role)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	var req HPKEPublicKeyRequest
+	if !decodeJSON(w, r.Body, &req) {
+		return
+	}
+	dekID, _, err := s.resolveKey(r, identity.Tenant, req.DEKID, req.Alias)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	dekDoc, err := s.DEKStore.GetDEK(r.Context(), identity.Tenant, dekID)
+	if err != nil {
+		errorf(r.Context(), "Failed to get DEK: %v", err)
+		http.Error(w, "DEK not found", http.StatusBadRequest)
+		return
+	}
+	if !identity.CanUseKey(dekID) {
+		http.Error(w, fmt.Sprintf("DEK %s is outside this API key's scope", dekID), http.StatusForbidden)
+		return
+	}
+	if err := auth.IsAuthorizedForKey(identity, auth.ActionDescribeKey, dekDoc.Tags); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if _, err := s.requireKeyAlgorithm(dekDoc, crypto.AlgorithmHPKEX25519); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(dekDoc.PublicKey) == 0 {
+		errorf(r.Context(), "HPKE key pair %s has no public key", dekID)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, HPKEPublicKeyResponse{DEKID: dekID, PublicKey: dekDoc.PublicKey, Suite: hpkeSuite})
+}
+
+type HPKEOpenRequest struct {
+	DEKID string `json:"dekID"`
+	Alias string `json:"alias,omitempty"` // alternative to dekID
+
+	// Enc is the sender's encapsulated key. When omitted, Ciphertext must start with it,
+	// as in the output of Go's crypto/hpke Seal.
+	Enc        []byte `json:"enc,omitempty"`
+	Ciphertext []byte `json:"ciphertext"`
+	Info       []byte `json:"info,omitempty"`
+	AAD        []byte `json:"aad,omitempty"`
+}
+
+type HPKEOpenResponse struct {
+	Plaintext []byte `json:"plaintext"` // base64
+	DEKID     string `json:"dekID"`
+}
+
+// HPKEOpenHandler decapsulates and opens a message a sender sealed to an HPKE key pair.
+// It is authorized like /decrypt: DECRYPT or a grant, then the key policy.
+func (s *Server) HPKEOpenHandler(w http.ResponseWriter, r *http.Request) {
+	identity, err := getIdentity(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	// Without the role a grant on the key may still allow the call; checked once the key is loaded.
+	roleErr := auth.IsAuthorized(identity, auth.ActionDecrypt)
+	if roleErr != nil && s.Grants == nil {
+		warnf(r.Context(), "Unauthorized attempt by role=%s to open HPKE message", identity.Role)
+		http.Error(w, roleErr.Error(), http.StatusForbidden)
+		return
+	}
+
+	var req HPKEOpenRequest
+	if !decodeJSON(w, http.MaxBytesReader(w, r.Body, s.MaxPayloadBytes*2), &req) {
+		return
+	}
+	enc, ciphertext := req.Enc, req.Ciphertext
+	if len(enc) == 0 {
+		if len(ciphertext) < crypto.HPKEEncSize {
+			http.Error(w, "ciphertext too short", http.StatusBadRequest)
+			return
+		}
+		enc, ciphertext = ciphertext[:crypto.HPKEEncSize], ciphertext[crypto.HPKEEncSize:]
+	}
+	if len(enc) != crypto.HPKEEncSize {
+		http.Error(w, fmt.Sprintf("enc must be %d bytes", crypto.HPKEEncSize), http.StatusBadRequest)
+		return
+	}
+	if int64(len(ciphertext)) > s.MaxPayloadBytes+16 {
+		http.Error(w, fmt.Sprintf("ciphertext exceeds the %d byte limit", s.MaxPayloadBytes), http.StatusRequestEntityTooLarge)
+		return
+	}
+	dekID, alias, err := s.resolveKey(r, identity.Tenant, req.DEKID, req.Alias)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	dekDoc, err := s.DEKStore.GetDEK(r.Context(), identity.Tenant, dekID)
+	if err != nil {
+		errorf(r.Context(), "Failed to get DEK: %v", err)
+		http.Error(w, "DEK not found", http.StatusBadRequest)
+		return
+	}
+	if err := s.authorizeKeyUse(r, identity, dekDoc, keyOpDecrypt, roleErr, nil); err != nil {
+		warnf(r.Context(), "Unauthorized attempt by role=%s to open HPKE message", identity.Role)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if err := checkKeyUsable(dekDoc); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	alg, err := s.requireKeyAlgorithm(dekDoc, crypto.AlgorithmHPKEX25519)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := checkKeyScheme(dekDoc, string(alg)); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	signalKeyDeprecation(w, r, dekDoc)
+	if !s.meterUsage(w, r, identity, dekID, quotaOpDecrypt, false, true) {
+		return
+	}
+
+	priv, err := s.unwrapDEK(r, dekDoc)
+	if err != nil {
+		errorf(r.Context(), "Failed to decrypt DEK: %v", err)
+		http.Error(w, "failed to unwrap DEK", http.StatusInternalServerError)
+		return
+	}
+	defer secmem.Zero(priv)
+
+	endCrypto := traceCrypto(r, "hpke-open", alg)
+	plaintext, err := crypto.HPKEOpen(priv, enc, req.Info, req.AAD, ciphertext)
+	endCrypto(err)
+	if err != nil {
+		warnf(r.Context(), "Failed to open HPKE message under DEK %s: %v", dekID, err)
+		http.Error(w, "decryption failed", http.StatusBadRequest)
+		return
+	}
+	s.touchDEK(r, identity.Tenant, dekID)
+	auditf(r.Context(), "HPKE message opened with DEK %s by %s", dekID, identity.Name)
+
+	plaintext, err = s.afterDecrypt(r, identity, dekID, alias, plaintext)
+	if err != nil {
+		warnf(r.Context(), "Payload rejected after decryption: %v", err)
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+
+	writeJSON(w, HPKEOpenResponse{Plaintext: plaintext, DEKID: dekID})
+}
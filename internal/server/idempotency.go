@@ -0,0 +1,138 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"my-kms/internal/storage"
+)
+
+const (
+	idempotencyKeyHeader = "Idempotency-Key"
+	idempotentReplayed   = "Idempotent-Replayed"
+
+	maxIdempotencyKeyLength = 255
+
+	// idempotencyLease is how long a request holds its key before a retry may run it
+	// again, should the instance handling it die.
+	idempotencyLease = time.Minute
+
+	maxIdempotentBody = 1 << 20
+)
+
+// idempotent lets clients retry next safely: a request with an Idempotency-Key header
+// runs once, and retries with the same key, caller and body get its response back
+// instead of minting another key. It is only for endpoints whose responses carry no
+// key material, since they are stored. Without s.Idempotency the header is ignored.
+func (s *Server) idempotent(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(idempotencyKeyHeader)
+		if key == "" || s.Idempotency == nil {
+			next(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			http.Error(w, fmt.Sprintf("%s exceeds %d characters", idempotencyKeyHeader, maxIdempotencyKeyLength), http.StatusBadRequest)
+			return
+		}
+		identity, err := getIdentity(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxIdempotentBody))
+		if err != nil {
+			http.Error(w, "invalid request body", http.StatusBadRequest)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		now := time.Now().UTC()
+		rec := storage.IdempotencyRecord{
+			ID:          idempotencyHash(identity.Tenant, identity.Name, r.URL.Path, key),
+			Fingerprint: idempotencyHash(r.Method, r.URL.RawQuery, string(body)),
+			CreatedAt:   now,
+			ExpiresAt:   now.Add(idempotencyLease),
+		}
+		existing, err := s.Idempotency.Begin(r.Context(), rec)
+		if err != nil {
+			errorf(r.Context(), "Failed to store idempotency key: %v", err)
+			http.Error(w, "failed to store idempotency key", http.StatusServiceUnavailable)
+			return
+		}
+		if existing != nil {
+			replayIdempotent(w, r, existing, rec.Fingerprint)
+			return
+		}
+
+		rw := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+		next(rw, r)
+
+		// The client may have gone away, which is why it will retry; record the outcome anyway.
+		ctx := context.WithoutCancel(r.Context())
+		if rw.status/100 == 2 && rw.status != http.StatusAccepted {
+			err = s.Idempotency.Complete(ctx, rec.ID, rw.status, rw.Header().Get("Content-Type"), rw.body.Bytes(), now.Add(s.IdempotencyKeyTTL))
+		} else {
+			// Failures, and requests still awaiting a second approver, run again on retry.
+			err = s.Idempotency.Release(ctx, rec.ID)
+		}
+		if err != nil {
+			errorf(r.Context(), "Failed to record idempotent response: %v", err)
+		}
+	}
+}
+
+// replayIdempotent answers a retry from the record of the first request.
+func replayIdempotent(w http.ResponseWriter, r *http.Request, rec *storage.IdempotencyRecord, fingerprint string) {
+	switch {
+	case rec.Fingerprint != fingerprint:
+		warnf(r.Context(), "%s reused for a different %s request", idempotencyKeyHeader, r.URL.Path)
+		http.Error(w, idempotencyKeyHeader+" was already used with a different request", http.StatusUnprocessableEntity)
+	case rec.Status == 0:
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "a request with this "+idempotencyKeyHeader+" is still in progress", http.StatusConflict)
+	default:
+		logf(r.Context(), "Replaying %s response for %s", r.URL.Path, idempotencyKeyHeader)
+		if rec.ContentType != "" {
+			w.Header().Set("Content-Type", rec.ContentType)
+		}
+		w.Header().Set(idempotentReplayed, "true")
+		w.WriteHeader(rec.Status)
+		if _, err := w.Write(rec.Body); err != nil && !errors.Is(err, http.ErrBodyNotAllowed) {
+			errorf(r.Context(), "Failed to write replayed response: %v", err)
+		}
+	}
+}
+
+// idempotencyHash hashes parts, each length-prefixed so that no two lists collide.
+func idempotencyHash(parts ...string) string {
+	h := sha256.New()
+	for _, p := range parts {
+		fmt.Fprintf(h, "%d:%s", len(p), p)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// responseRecorder copies the response written by the wrapped handler.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (r *responseRecorder) WriteHeader(code int) {
+	r.status = code
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
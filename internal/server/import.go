@@ -0,0 +1,265 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"my-kms/internal/auth"
+	"my-kms/internal/crypto"
+	"my-kms/internal/events"
+	"my-kms/internal/secmem"
+	"my-kms/internal/storage"
+)
+
+const (
+	importWrappingKeyBits   = 3072
+	importWrappingAlgorithm = "RSAES_OAEP_SHA_256"
+)
+
+// ---------------------------------------------------------------------
+// Get Import Parameters
+// ---------------------------------------------------------------------
+
+type GetImportParametersRequest struct {
+	Algorithm string `json:"algorithm,omitempty"` // algorithm of the key material; defaults to AES_256_GCM
+}
+
+type GetImportParametersResponse struct {
+	ImportToken       string           `json:"importToken"`
+	PublicKey         string           `json:"publicKey"` // base64 DER SubjectPublicKeyInfo
+	WrappingAlgorithm string           `json:"wrappingAlgorithm"`
+	Algorithm         crypto.Algorithm `json:"algorithm"`
+	ExpiresAt         time.Time        `json:"expiresAt"`
+}
+
+func (s *Server) GetImportParametersHandler(w http.ResponseWriter, r *http.Request) {
+	identity, err := getIdentity(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	if err := auth.IsAuthorized(identity, auth.ActionImportKey); err != nil {
+		warnf(r.Context(), "Unauthorized attempt by role=%s to get import parameters", identity.Role)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	if s.ImportTokens == nil {
+		http.Error(w, "key import is not enabled", http.StatusNotFound)
+		return
+	}
+
+	var req GetImportParametersRequest
+	if !decodeOptionalJSON(w, r.Body, &req) {
+		return
+	}
+	alg, err := crypto.ParseAlgorithm(req.Algorithm)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := s.AlgPolicy.Check(alg); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if err := authorizeDeterministic(identity, alg); err != nil {
+		warnf(r.Context(), "Unauthorized attempt by role=%s to import deterministic key", identity.Role)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	privateKey, err := rsa.GenerateKey(rand.Reader, importWrappingKeyBits)
+	if err != nil {
+		errorf(r.Context(), "Failed to generate import wrapping key: %v", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	publicDER, err := x509.MarshalPKIXPublicKey(&privateKey.PublicKey)
+	if err != nil {
+		errorf(r.Context(), "Failed to marshal import public key: %v", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	privateDER, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		errorf(r.Context(), "Failed to marshal import private key: %v", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	// The private half never leaves the server unwrapped.
+	wrappedPrivate, masterKeyID, err := s.KeyStore.EncryptDataKey(r.Context(), privateDER)
+	if err != nil {
+		errorf(r.Context(), "Failed to wrap import private key: %v", err)
+		http.Error(w, "encryption failed", http.StatusInternalServerError)
+		return
+	}
+
+	now := time.Now().UTC()
+	tok := storage.ImportToken{
+		PublicKey:         publicDER,
+		WrappedPrivateKey: wrappedPrivate,
+		MasterKeyID:       masterKeyID,
+		Algorithm:         string(alg),
+		TenantID:          identity.Tenant,
+		CreatedBy:         identity.Name,
+		CreatedAt:         now,
+		ExpiresAt:         now.Add(s.ImportTokenTTL),
+	}
+	tokenID, err := s.ImportTokens.InsertImportToken(r.Context(), tok)
+	if err != nil {
+		errorf(r.Context(), "Failed to store import token: %v", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, GetImportParametersResponse{
+		ImportToken:       tokenID,
+		PublicKey:         base64.StdEncoding.EncodeToString(publicDER),
+		WrappingAlgorithm: importWrappingAlgorithm,
+		Algorithm:         alg,
+		ExpiresAt:         tok.ExpiresAt,
+	})
+}
+
+// ---------------------------------------------------------------------
+// Import Key Material
+// ---------------------------------------------------------------------
+
+type ImportKeyMaterialRequest struct {
+	ImportToken          string            `json:"importToken"`
+	EncryptedKeyMaterial string            `json:"encryptedKeyMaterial"` // base64, RSA-OAEP-SHA256 under the token's public key
+	Description          string            `json:"description,omitempty"`
+	Tags                 map[string]string `json:"tags,omitempty"`
+	Usage                *storage.KeyUsage `json:"usage,omitempty"` // fixed for the key's life
+}
+
+func (s *Server) ImportKeyMaterialHandler(w http.ResponseWriter, r *http.Request) {
+	identity, err := getIdentity(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	if err := auth.IsAuthorized(identity, auth.ActionImportKey); err != nil {
+		warnf(r.Context(), "Unauthorized attempt by role=%s to import key material", identity.Role)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	if s.ImportTokens == nil {
+		http.Error(w, "key import is not enabled", http.StatusNotFound)
+		return
+	}
+
+	var req ImportKeyMaterialRequest
+	if !decodeJSON(w, r.Body, &req) {
+		return
+	}
+	if err := validateTags(req.Tags); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	encrypted, err := base64.StdEncoding.DecodeString(req.EncryptedKeyMaterial)
+	if err != nil {
+		http.Error(w, "invalid base64 key material", http.StatusBadRequest)
+		return
+	}
+
+	tok, err := s.ImportTokens.ConsumeImportToken(r.Context(), identity.Tenant, req.ImportToken)
+	if err != nil {
+		errorf(r.Context(), "Failed to consume import token: %v", err)
+		http.Error(w, "import token is invalid, expired or already used", http.StatusBadRequest)
+		return
+	}
+
+	dek, err := s.unwrapImportedKey(tok, encrypted)
+	if err != nil {
+		errorf(r.Context(), "Failed to unwrap imported key material: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	alg := crypto.Algorithm(tok.Algorithm)
+	if err := s.AlgPolicy.Check(alg); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if err := validateKeyUsage(req.Usage, alg); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	publicKey, err := hpkePublicKey(alg, dek)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	encryptedDEK, masterKeyID, err := s.wrapDEK(r, identity.Tenant, dek)
+	if err != nil {
+		errorf(r.Context(), "Failed to encrypt DEK: %v", err)
+		http.Error(w, "encryption failed", http.StatusInternalServerError)
+		return
+	}
+
+	dekID, err := s.DEKStore.InsertDEK(r.Context(), storage.DEKDocument{
+		DEK:         encryptedDEK,
+		MasterKeyID: masterKeyID,
+		TenantID:    identity.Tenant,
+		OwnerUID:    identity.Name,
+		Description: req.Description,
+		Tags:        req.Tags,
+		CreatedBy:   identity.Name,
+		Algorithm:   string(alg),
+		Origin:      storage.KeyOriginExternal,
+		PublicKey:   publicKey,
+		Usage:       req.Usage,
+	})
+	if err != nil {
+		errorf(r.Context(), "Failed to store DEK in MongoDB: %v", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	auditf(r.Context(), "external key material imported as DEK %s by %s", dekID, identity.Name)
+	s.publishEvent(r, events.KeyCreated, dekID, map[string]string{"algorithm": string(alg), "origin": string(storage.KeyOriginExternal)})
+
+	writeJSON(w, GenerateDataKeyResponse{
+		DEKID:       dekID,
+		MasterKeyID: masterKeyID,
+		Algorithm:   alg,
+	})
+}
+
+// unwrapImportedKey decrypts customer key material with the token's private key and checks its length.
+func (s *Server) unwrapImportedKey(tok *storage.ImportToken, encrypted []byte) ([]byte, error) {
+	privateDER, err := s.KeyStore.DecryptDataKey(tok.WrappedPrivateKey, tok.MasterKeyID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap import key: %w", err)
+	}
+	defer secmem.Zero(privateDER)
+	parsed, err := x509.ParsePKCS8PrivateKey(privateDER)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse import key: %w", err)
+	}
+	privateKey, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("import key is not an RSA key")
+	}
+
+	dek, err := rsa.DecryptOAEP(sha256.New(), nil, privateKey, encrypted, nil)
+	if err != nil {
+		return nil, errors.New("key material could not be decrypted with the import public key")
+	}
+	if want := crypto.Algorithm(tok.Algorithm).KeySize(); len(dek) != want {
+		return nil, fmt.Errorf("key material must be %d bytes for %s", want, tok.Algorithm)
+	}
+	return dek, nil
+}
@@ -0,0 +1,535 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"time"
+
+	"my-kms/internal/auth"
+	"my-kms/internal/crypto"
+	"my-kms/internal/secmem"
+	"my-kms/internal/storage"
+)
+
+// JWT signing: the KMS keeps named ES256 or RS256 signing keys, signs the claims callers
+// send to /sign-jwt and publishes the public keys at /jwks. Keys rotate on a schedule;
+// a retired key stays in the JWKS for as long as tokens it signed may be valid.
+
+const (
+	defaultSigningKeyName = "default"
+	defaultJWTTTL         = time.Hour
+
+	// DefaultJWTMaxTTL caps ttlSeconds unless JWT_MAX_TTL says otherwise.
+	DefaultJWTMaxTTL = 24 * time.Hour
+
+	// jwksGrace keeps retired keys published a little past the last token's expiry, for
+	// verifiers whose clocks run behind.
+	jwksGrace = 5 * time.Minute
+
+	jwksMaxAge   = 5 * time.Minute
+	maxJWTClaims = 16 << 10
+)
+
+// ---------------------------------------------------------------------
+// Create Signing Key
+// ---------------------------------------------------------------------
+
+type CreateSigningKeyRequest struct {
+	Name      string `json:"name,omitempty"`      // defaults to "default"
+	Algorithm string `json:"algorithm,omitempty"` // ES256 (default) or RS256
+
+	// Issuer, when set, becomes the "iss" of every token the key signs; callers can't
+	// claim another.
+	Issuer string `json:"issuer,omitempty"`
+}
+
+type SigningKeyResponse struct {
+	Name      string `json:"name"`
+	Algorithm string `json:"algorithm"`
+	KeyID     string `json:"keyID"` // "kid" of the version that signs
+}
+
+func (s *Server) CreateSigningKeyHandler(w http.ResponseWriter, r *http.Request) {
+	identity, err := getIdentity(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	if err := auth.IsAuthorized(identity, auth.ActionManageKey); err != nil {
+		warnf(r.Context(), "Unauthorized attempt by role=%s to create signing key", identity.Role)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	if s.SigningKeys == nil {
+		http.Error(w, "JWT signing is not enabled", http.StatusNotFound)
+		return
+	}
+
+	var req CreateSigningKeyRequest
+	if !decodeJSON(w, r.Body, &req) {
+		return
+	}
+	name, err := signingKeyName(req.Name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Algorithm == "" {
+		req.Algorithm = crypto.JWSES256
+	}
+	if !crypto.ValidJWSAlgorithm(req.Algorithm) {
+		http.Error(w, fmt.Sprintf("algorithm must be %s or %s", crypto.JWSES256, crypto.JWSRS256), http.StatusBadRequest)
+		return
+	}
+
+	version, err := s.newSigningKeyVersion(r, identity.Tenant, req.Algorithm)
+	if err != nil {
+		errorf(r.Context(), "Failed to create signing key: %v", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	err = s.SigningKeys.CreateSigningKey(r.Context(), storage.SigningKey{
+		TenantID:  identity.Tenant,
+		Name:      name,
+		Algorithm: req.Algorithm,
+		Issuer:    req.Issuer,
+		Versions:  []storage.SigningKeyVersion{*version},
+		CreatedBy: identity.Name,
+	})
+	if errors.Is(err, storage.ErrSigningKeyExists) {
+		http.Error(w, fmt.Sprintf("signing key %s already exists", name), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		errorf(r.Context(), "Failed to store signing key: %v", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	auditf(r.Context(), "Signing key %s (%s, kid %s) created by %s", name, req.Algorithm, version.KeyID, identity.Name)
+
+	writeJSON(w, SigningKeyResponse{Name: name, Algorithm: req.Algorithm, KeyID: version.KeyID})
+}
+
+// ---------------------------------------------------------------------
+// Rotate Signing Key
+// ---------------------------------------------------------------------
+
+type RotateSigningKeyRequest struct {
+	Name string `json:"name,omitempty"`
+}
+
+// RotateSigningKeyHandler rotates a signing key now rather than on schedule, for
+// example after a suspected compromise.
+func (s *Server) RotateSigningKeyHandler(w http.ResponseWriter, r *http.Request) {
+	identity, err := getIdentity(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	if err := auth.IsAuthorized(identity, auth.ActionManageKey); err != nil {
+		warnf(r.Context(), "Unauthorized attempt by role=%s to rotate signing key", identity.Role)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	if s.SigningKeys == nil {
+		http.Error(w, "JWT signing is not enabled", http.StatusNotFound)
+		return
+	}
+
+	var req RotateSigningKeyRequest
+	if !decodeJSON(w, r.Body, &req) {
+		return
+	}
+	name, err := signingKeyName(req.Name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	key, err := s.SigningKeys.GetSigningKey(r.Context(), identity.Tenant, name)
+	if err != nil {
+		errorf(r.Context(), "Failed to load signing key %s: %v", name, err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	if key == nil {
+		http.Error(w, fmt.Sprintf("signing key %s not found", name), http.StatusNotFound)
+		return
+	}
+	if err := s.rotateSigningKey(r, key, identity.Name); err != nil {
+		if errors.Is(err, storage.ErrSigningKeyChanged) {
+			http.Error(w, "signing key was rotated concurrently; retry", http.StatusConflict)
+			return
+		}
+		errorf(r.Context(), "Failed to rotate signing key %s: %v", name, err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, SigningKeyResponse{Name: name, Algorithm: key.Algorithm, KeyID: key.Current().KeyID})
+}
+
+// ---------------------------------------------------------------------
+// Sign JWT
+// ---------------------------------------------------------------------
+
+type SignJWTRequest struct {
+	Name string `json:"name,omitempty"` // signing key; defaults to "default"
+
+	// Claims is the JWT payload. The KMS sets "iat" and "exp" from ttlSeconds, adds a
+	// "jti" unless one is given, and sets "iss" when the key has an issuer.
+	Claims     map[string]json.RawMessage `json:"claims"`
+	TTLSeconds int                        `json:"ttlSeconds,omitempty"` // defaults to an hour
+}
+
+type SignJWTResponse struct {
+	Token     string    `json:"token"`
+	KeyID     string    `json:"keyID"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+type jwsHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+	Typ string `json:"typ"`
+}
+
+func (s *Server) SignJWTHandler(w http.ResponseWriter, r *http.Request) {
+	identity, err := getIdentity(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	if err := auth.IsAuthorized(identity, auth.ActionSignJWT); err != nil {
+		warnf(r.Context(), "Unauthorized attempt by role=%s to sign JWT", identity.Role)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	if s.SigningKeys == nil {
+		http.Error(w, "JWT signing is not enabled", http.StatusNotFound)
+		return
+	}
+
+	var req SignJWTRequest
+	if !decodeJSON(w, http.MaxBytesReader(w, r.Body, maxJWTClaims), &req) {
+		return
+	}
+	name, err := signingKeyName(req.Name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Claims == nil {
+		http.Error(w, "claims must be a JSON object", http.StatusBadRequest)
+		return
+	}
+	for _, reserved := range []string{"iat", "exp"} {
+		if _, ok := req.Claims[reserved]; ok {
+			http.Error(w, fmt.Sprintf("claims must not set %q; the KMS sets it from ttlSeconds", reserved), http.StatusBadRequest)
+			return
+		}
+	}
+	ttl := defaultJWTTTL
+	if req.TTLSeconds != 0 {
+		ttl = time.Duration(req.TTLSeconds) * time.Second
+	}
+	if ttl <= 0 || ttl > s.jwtMaxTTL() {
+		http.Error(w, fmt.Sprintf("ttlSeconds must be between 1 and %d", int(s.jwtMaxTTL()/time.Second)), http.StatusBadRequest)
+		return
+	}
+
+	key, err := s.SigningKeys.GetSigningKey(r.Context(), identity.Tenant, name)
+	if err != nil {
+		errorf(r.Context(), "Failed to load signing key %s: %v", name, err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	if key == nil {
+		http.Error(w, fmt.Sprintf("signing key %s not found", name), http.StatusNotFound)
+		return
+	}
+	if iss, ok := req.Claims["iss"]; ok && key.Issuer != "" && !sameJSONString(iss, key.Issuer) {
+		http.Error(w, fmt.Sprintf("signing key %s only issues tokens for %s", name, key.Issuer), http.StatusForbidden)
+		return
+	}
+	if !s.meterUsage(w, r, identity, "", quotaOpSignJWT, false, true) {
+		return
+	}
+	if err := s.rotateSigningKeyIfDue(r, key); err != nil {
+		// The current version is still good; the next call tries again.
+		warnf(r.Context(), "Scheduled rotation of signing key %s failed: %v", name, err)
+	}
+
+	now := time.Now()
+	expiresAt := now.Add(ttl).Truncate(time.Second)
+	req.Claims["iat"] = mustJSON(now.Unix())
+	req.Claims["exp"] = mustJSON(expiresAt.Unix())
+	if key.Issuer != "" {
+		req.Claims["iss"] = mustJSON(key.Issuer)
+	}
+	if _, ok := req.Claims["jti"]; !ok {
+		jti := make([]byte, 16)
+		if _, err := rand.Read(jti); err != nil {
+			errorf(r.Context(), "Failed to generate jti: %v", err)
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
+		req.Claims["jti"] = mustJSON(base64.RawURLEncoding.EncodeToString(jti))
+	}
+	payload, err := json.Marshal(req.Claims)
+	if err != nil {
+		http.Error(w, "claims must be a JSON object", http.StatusBadRequest)
+		return
+	}
+
+	version := key.Current()
+	header := mustJSON(jwsHeader{Alg: key.Algorithm, Kid: version.KeyID, Typ: "JWT"})
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	priv, err := s.unwrapDEK(r, &storage.DEKDocument{DEK: version.Key, MasterKeyID: version.MasterKeyID, TenantID: key.TenantID})
+	if err != nil {
+		errorf(r.Context(), "Failed to unwrap signing key %s: %v", name, err)
+		http.Error(w, "failed to unwrap signing key", http.StatusInternalServerError)
+		return
+	}
+	defer secmem.Zero(priv)
+
+	endCrypto := traceCrypto(r, "sign-jwt", crypto.Algorithm(key.Algorithm))
+	sig, err := crypto.SignJWS(key.Algorithm, priv, []byte(signingInput))
+	endCrypto(err)
+	if err != nil {
+		errorf(r.Context(), "Failed to sign JWT with %s: %v", name, err)
+		http.Error(w, "signing failed", http.StatusInternalServerError)
+		return
+	}
+	subject := "-"
+	if sub, ok := req.Claims["sub"]; ok {
+		subject = string(sub)
+	}
+	auditf(r.Context(), "JWT signed with %s (kid %s) by %s for sub %s, expires %s", name, version.KeyID, identity.Name, subject, expiresAt.UTC().Format(time.RFC3339))
+
+	writeJSON(w, SignJWTResponse{
+		Token:     signingInput + "." + base64.RawURLEncoding.EncodeToString(sig),
+		KeyID:     version.KeyID,
+		ExpiresAt: expiresAt.UTC(),
+	})
+}
+
+// ---------------------------------------------------------------------
+// JWKS
+// ---------------------------------------------------------------------
+
+// JWK is a public key in RFC 7517 form.
+type JWK struct {
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+
+	Crv string `json:"crv,omitempty"` // EC
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+	N   string `json:"n,omitempty"` // RSA
+	E   string `json:"e,omitempty"`
+}
+
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWKSHandler serves a signing key's public keys: the current one and those retired
+// recently enough that tokens they signed may not have expired. It needs no credentials,
+// since token verifiers are often outside the KMS's users; tenant names the tenant in
+// multi-tenant deployments.
+func (s *Server) JWKSHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.SigningKeys == nil {
+		http.Error(w, "JWT signing is not enabled", http.StatusNotFound)
+		return
+	}
+	name, err := signingKeyName(r.URL.Query().Get("name"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	key, err := s.SigningKeys.GetSigningKey(r.Context(), r.URL.Query().Get("tenant"), name)
+	if err != nil {
+		errorf(r.Context(), "Failed to load signing key %s: %v", name, err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	if key == nil {
+		http.Error(w, fmt.Sprintf("signing key %s not found", name), http.StatusNotFound)
+		return
+	}
+
+	set, err := publishedJWKS(key, time.Now().Add(-s.jwtMaxTTL()-jwksGrace))
+	if err != nil {
+		errorf(r.Context(), "Failed to encode signing key %s: %v", name, err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(jwksMaxAge/time.Second)))
+	writeJSON(w, set)
+}
+
+// ---------------------------------------------------------------------
+// Helper Functions
+// ---------------------------------------------------------------------
+
+func signingKeyName(name string) (string, error) {
+	if name == "" {
+		return defaultSigningKeyName, nil
+	}
+	if !indexNamePattern.MatchString(name) {
+		return "", errors.New("signing key name must be 1-128 characters of letters, digits, '.', '_' or '-'")
+	}
+	return name, nil
+}
+
+func (s *Server) jwtMaxTTL() time.Duration {
+	if s.JWTMaxTTL > 0 {
+		return s.JWTMaxTTL
+	}
+	return DefaultJWTMaxTTL
+}
+
+// newSigningKeyVersion generates a key pair and wraps the private key like a DEK.
+func (s *Server) newSigningKeyVersion(r *http.Request, tenant, alg string) (*storage.SigningKeyVersion, error) {
+	private, public, err := crypto.GenerateSigningKey(alg)
+	if err != nil {
+		return nil, err
+	}
+	defer secmem.Zero(private)
+	jwk, err := publicJWK(alg, public)
+	if err != nil {
+		return nil, err
+	}
+	wrapped, masterKeyID, err := s.wrapDEK(r, tenant, private)
+	if err != nil {
+		return nil, fmt.Errorf("failed to wrap signing key: %w", err)
+	}
+	return &storage.SigningKeyVersion{
+		KeyID:       jwkThumbprint(jwk),
+		Key:         wrapped,
+		MasterKeyID: masterKeyID,
+		PublicKey:   public,
+		CreatedAt:   time.Now().UTC(),
+	}, nil
+}
+
+// rotateSigningKey adds a new version to key, which is updated in place.
+func (s *Server) rotateSigningKey(r *http.Request, key *storage.SigningKey, by string) error {
+	version, err := s.newSigningKeyVersion(r, key.TenantID, key.Algorithm)
+	if err != nil {
+		return err
+	}
+	previous := key.Current().KeyID
+	if err := s.SigningKeys.AddSigningKeyVersion(r.Context(), key, *version, time.Now().Add(-s.jwtMaxTTL()-jwksGrace)); err != nil {
+		return err
+	}
+	auditf(r.Context(), "Signing key %s rotated from kid %s to %s by %s", key.Name, previous, version.KeyID, by)
+	return nil
+}
+
+// rotateSigningKeyIfDue rotates key once its current version is older than
+// SigningKeyRotationPeriod. Losing the race to another replica is fine: key is reloaded
+// and signs with whatever version won.
+func (s *Server) rotateSigningKeyIfDue(r *http.Request, key *storage.SigningKey) error {
+	if s.SigningKeyRotationPeriod <= 0 || time.Since(key.Current().CreatedAt) < s.SigningKeyRotationPeriod {
+		return nil
+	}
+	err := s.rotateSigningKey(r, key, "kms")
+	if !errors.Is(err, storage.ErrSigningKeyChanged) {
+		return err
+	}
+	latest, err := s.SigningKeys.GetSigningKey(r.Context(), key.TenantID, key.Name)
+	if err != nil {
+		return err
+	}
+	if latest != nil {
+		*key = *latest
+	}
+	return nil
+}
+
+// publishedJWKS lists the versions of key that have not been retired since before
+// retiredAfter, newest first.
+func publishedJWKS(key *storage.SigningKey, retiredAfter time.Time) (JWKS, error) {
+	set := JWKS{Keys: []JWK{}}
+	for i := len(key.Versions) - 1; i >= 0; i-- {
+		v := key.Versions[i]
+		if !v.RetiredAt.IsZero() && v.RetiredAt.Before(retiredAfter) {
+			continue
+		}
+		jwk, err := publicJWK(key.Algorithm, v.PublicKey)
+		if err != nil {
+			return JWKS{}, err
+		}
+		jwk.Kid = v.KeyID
+		set.Keys = append(set.Keys, jwk)
+	}
+	return set, nil
+}
+
+func publicJWK(alg string, public []byte) (JWK, error) {
+	parsed, err := x509.ParsePKIXPublicKey(public)
+	if err != nil {
+		return JWK{}, fmt.Errorf("invalid public key: %w", err)
+	}
+	b64 := base64.RawURLEncoding.EncodeToString
+	switch k := parsed.(type) {
+	case *ecdsa.PublicKey:
+		x, y := make([]byte, 32), make([]byte, 32)
+		k.X.FillBytes(x)
+		k.Y.FillBytes(y)
+		return JWK{Kty: "EC", Use: "sig", Alg: alg, Crv: "P-256", X: b64(x), Y: b64(y)}, nil
+	case *rsa.PublicKey:
+		return JWK{Kty: "RSA", Use: "sig", Alg: alg, N: b64(k.N.Bytes()), E: b64(big.NewInt(int64(k.E)).Bytes())}, nil
+	default:
+		return JWK{}, fmt.Errorf("unsupported public key type %T", parsed)
+	}
+}
+
+// jwkThumbprint is the RFC 7638 SHA-256 thumbprint, used as the "kid".
+func jwkThumbprint(k JWK) string {
+	var canonical string
+	if k.Kty == "EC" {
+		canonical = fmt.Sprintf(`{"crv":%q,"kty":"EC","x":%q,"y":%q}`, k.Crv, k.X, k.Y)
+	} else {
+		canonical = fmt.Sprintf(`{"e":%q,"kty":"RSA","n":%q}`, k.E, k.N)
+	}
+	sum := sha256.Sum256([]byte(canonical))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func sameJSONString(raw json.RawMessage, want string) bool {
+	var got string
+	return json.Unmarshal(raw, &got) == nil && got == want
+}
+
+// mustJSON marshals values that can't fail to marshal.
+func mustJSON(v interface{}) json.RawMessage {
+	b, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
@@ -0,0 +1,393 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"my-kms/internal/auth"
+	"my-kms/internal/crypto"
+	"my-kms/internal/storage"
+)
+
+const (
+	defaultListLimit = 50
+	maxListLimit     = 500
+
+	maxTagKeyLength   = 128
+	maxTagValueLength = 256
+	maxTagsPerKey     = 50
+
+	// lastUsedResolution is how far behind a DEK's lastUsedAt may fall. A key used again
+	// within it isn't written back, so a busy key costs each server one write per
+	// interval rather than one per request.
+	lastUsedResolution = 5 * time.Minute
+)
+
+// KeyMetadata is the public view of a DEK document. It never includes key material.
+type KeyMetadata struct {
+	DEKID       string            `json:"dekID"`
+	MasterKeyID string            `json:"masterKeyID"`
+	TenantID    string            `json:"tenantID,omitempty"`
+	State       storage.KeyState  `json:"state"`
+	Algorithm   crypto.Algorithm  `json:"algorithm"`
+	Origin      storage.KeyOrigin `json:"origin"`
+	PublicKey   []byte            `json:"publicKey,omitempty"` // base64 X25519, HPKE key pairs only
+	OwnerUID    string            `json:"ownerUID,omitempty"`
+	Description string            `json:"description,omitempty"`
+	Tags        map[string]string `json:"tags,omitempty"`
+	CreatedBy   string            `json:"createdBy,omitempty"`
+	CreatedAt   *time.Time        `json:"createdAt,omitempty"`
+	LastUsedAt  *time.Time        `json:"lastUsedAt,omitempty"`
+
+	DeprecatedAt     *time.Time `json:"deprecatedAt,omitempty"`
+	SunsetAt         *time.Time `json:"sunsetAt,omitempty"`
+	ReplacementDEKID string     `json:"replacementDEKID,omitempty"`
+
+	Policy *storage.KeyPolicy `json:"policy,omitempty"`
+	Usage  *storage.KeyUsage  `json:"usage,omitempty"`
+}
+
+func keyMetadataFromDoc(doc *storage.DEKDocument) KeyMetadata {
+	md := KeyMetadata{
+		DEKID:       doc.ID.Hex(),
+		MasterKeyID: doc.MasterKeyID,
+		TenantID:    doc.TenantID,
+		State:       doc.EffectiveState(),
+		Algorithm:   crypto.Algorithm(doc.Algorithm),
+		Origin:      doc.Origin,
+		PublicKey:   doc.PublicKey,
+		OwnerUID:    doc.OwnerUID,
+		Description: doc.Description,
+		Tags:        doc.Tags,
+		CreatedBy:   doc.CreatedBy,
+
+		CreatedAt:        optionalTime(doc.CreatedAt),
+		LastUsedAt:       optionalTime(doc.LastUsedAt),
+		DeprecatedAt:     optionalTime(doc.DeprecatedAt),
+		SunsetAt:         optionalTime(doc.SunsetAt),
+		ReplacementDEKID: doc.ReplacementDEKID,
+		Policy:           doc.Policy,
+		Usage:            doc.Usage,
+	}
+	if md.Algorithm == "" {
+		md.Algorithm = crypto.DefaultAlgorithm
+	}
+	if md.Origin == "" {
+		md.Origin = storage.KeyOriginKMS
+	}
+	return md
+}
+
+// ---------------------------------------------------------------------
+// Tag Key
+// ---------------------------------------------------------------------
+
+type TagKeyRequest struct {
+	DEKID string            `json:"dekID"`
+	Tags  map[string]string `json:"tags"`
+}
+
+func (s *Server) TagKeyHandler(w http.ResponseWriter, r *http.Request) {
+	identity, err := getIdentity(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	if err := auth.IsAuthorized(identity, auth.ActionManageKey); err != nil {
+		warnf(r.Context(), "Unauthorized attempt by role=%s to tag key", identity.Role)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	var req TagKeyRequest
+	if !decodeJSON(w, r.Body, &req) {
+		return
+	}
+	if len(req.Tags) == 0 {
+		http.Error(w, "at least one tag is required", http.StatusBadRequest)
+		return
+	}
+	if err := validateTags(req.Tags); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if !s.authorizeKeyManagement(w, r, identity, req.DEKID) {
+		return
+	}
+
+	if err := s.DEKStore.SetDEKTags(r.Context(), identity.Tenant, req.DEKID, req.Tags); err != nil {
+		errorf(r.Context(), "Failed to tag DEK: %v", err)
+		http.Error(w, "failed to tag DEK", http.StatusBadRequest)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ---------------------------------------------------------------------
+// Untag Key
+// ---------------------------------------------------------------------
+
+type UntagKeyRequest struct {
+	DEKID   string   `json:"dekID"`
+	TagKeys []string `json:"tagKeys"`
+}
+
+func (s *Server) UntagKeyHandler(w http.ResponseWriter, r *http.Request) {
+	identity, err := getIdentity(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	if err := auth.IsAuthorized(identity, auth.ActionManageKey); err != nil {
+		warnf(r.Context(), "Unauthorized attempt by role=%s to untag key", identity.Role)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	var req UntagKeyRequest
+	if !decodeJSON(w, r.Body, &req) {
+		return
+	}
+	if len(req.TagKeys) == 0 {
+		http.Error(w, "at least one tag key is required", http.StatusBadRequest)
+		return
+	}
+	for _, k := range req.TagKeys {
+		if err := validateTagKey(k); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if !s.authorizeKeyManagement(w, r, identity, req.DEKID) {
+		return
+	}
+
+	if err := s.DEKStore.RemoveDEKTags(r.Context(), identity.Tenant, req.DEKID, req.TagKeys); err != nil {
+		errorf(r.Context(), "Failed to untag DEK: %v", err)
+		http.Error(w, "failed to untag DEK", http.StatusBadRequest)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ---------------------------------------------------------------------
+// Describe Key
+// ---------------------------------------------------------------------
+
+type DescribeKeyRequest struct {
+	DEKID string `json:"dekID"`
+}
+
+func (s *Server) DescribeKeyHandler(w http.ResponseWriter, r *http.Request) {
+	identity, err := getIdentity(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	if err := auth.IsAuthorized(identity, auth.ActionDescribeKey); err != nil {
+		warnf(r.Context(), "Unauthorized attempt by role=%s to describe key", identity.Role)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	var req DescribeKeyRequest
+	if !decodeJSON(w, r.Body, &req) {
+		return
+	}
+
+	dekDoc, err := s.DEKStore.GetDEK(r.Context(), identity.Tenant, req.DEKID)
+	if err != nil {
+		errorf(r.Context(), "Failed to get DEK: %v", err)
+		http.Error(w, "DEK not found", http.StatusBadRequest)
+		return
+	}
+	if !identity.CanUseKey(dekDoc.ID.Hex()) {
+		http.Error(w, fmt.Sprintf("DEK %s is outside this API key's scope", dekDoc.ID.Hex()), http.StatusForbidden)
+		return
+	}
+	if err := auth.IsAuthorizedForKey(identity, auth.ActionDescribeKey, dekDoc.Tags); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	writeJSON(w, keyMetadataFromDoc(dekDoc))
+}
+
+// ---------------------------------------------------------------------
+// List Data Keys
+// ---------------------------------------------------------------------
+
+type ListDataKeysRequest struct {
+	MasterKeyID string            `json:"masterKeyID,omitempty"`
+	OwnerUID    string            `json:"ownerUID,omitempty"`
+	State       storage.KeyState  `json:"state,omitempty"`
+	Tags        map[string]string `json:"tags,omitempty"` // every tag must match
+	Limit       int               `json:"limit,omitempty"`
+	Cursor      string            `json:"cursor,omitempty"`
+}
+
+type ListDataKeysResponse struct {
+	Keys       []KeyMetadata `json:"keys"`
+	NextCursor string        `json:"nextCursor,omitempty"`
+}
+
+func (s *Server) ListDataKeysHandler(w http.ResponseWriter, r *http.Request) {
+	identity, err := getIdentity(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	if err := auth.IsAuthorized(identity, auth.ActionListKeys); err != nil {
+		warnf(r.Context(), "Unauthorized attempt by role=%s to list keys", identity.Role)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	var req ListDataKeysRequest
+	if !decodeOptionalJSON(w, r.Body, &req) {
+		return
+	}
+	if err := validateTags(req.Tags); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	switch req.State {
+	case "", storage.KeyStateEnabled, storage.KeyStateDisabled, storage.KeyStatePendingDeletion:
+	default:
+		http.Error(w, "unknown key state", http.StatusBadRequest)
+		return
+	}
+	switch {
+	case req.Limit <= 0:
+		req.Limit = defaultListLimit
+	case req.Limit > maxListLimit:
+		req.Limit = maxListLimit
+	}
+
+	filter := storage.DEKFilter{
+		TenantID:    identity.Tenant,
+		MasterKeyID: req.MasterKeyID,
+		OwnerUID:    req.OwnerUID,
+		State:       req.State,
+		Tags:        req.Tags,
+	}
+	docs, next, err := s.DEKStore.ListDEKs(r.Context(), filter, req.Cursor, req.Limit)
+	if err != nil {
+		errorf(r.Context(), "Failed to list DEKs: %v", err)
+		http.Error(w, "failed to list DEKs", http.StatusBadRequest)
+		return
+	}
+
+	resp := ListDataKeysResponse{
+		Keys:       make([]KeyMetadata, 0, len(docs)),
+		NextCursor: next,
+	}
+	// Keys outside an API key's scope, or that rules on their tags hide, are left out,
+	// so a page may come back short.
+	for i := range docs {
+		if !identity.CanUseKey(docs[i].ID.Hex()) || auth.IsAuthorizedForKey(identity, auth.ActionListKeys, docs[i].Tags) != nil {
+			continue
+		}
+		resp.Keys = append(resp.Keys, keyMetadataFromDoc(&docs[i]))
+	}
+	writeJSON(w, resp)
+}
+
+// ---------------------------------------------------------------------
+// Helper Functions
+// ---------------------------------------------------------------------
+
+// optionalTime maps a zero time to nil so it is omitted from JSON.
+func optionalTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+// touchDEK records last-used time for a key, at most once per lastUsedResolution.
+// Failures are logged but never fail the request.
+func (s *Server) touchDEK(r *http.Request, tenantID, dekID string) {
+	key := tenantID + "/" + dekID
+	if !s.touches.due(key, time.Now()) {
+		return
+	}
+	if err := s.DEKStore.TouchDEK(r.Context(), tenantID, dekID); err != nil {
+		s.touches.forget(key)
+		errorf(r.Context(), "Failed to update lastUsedAt for DEK %s: %v", dekID, err)
+	}
+}
+
+// dekTouches remembers when this server last wrote each DEK's lastUsedAt.
+type dekTouches struct {
+	mu   sync.Mutex
+	last map[string]time.Time
+}
+
+func newDEKTouches() *dekTouches {
+	return &dekTouches{last: make(map[string]time.Time)}
+}
+
+// due reports whether key's lastUsedAt should be written at now, and if so counts it
+// as written. Entries older than lastUsedResolution are dropped as the map grows, so it
+// holds at most the keys used within the last interval.
+func (t *dekTouches) due(key string, now time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if last, ok := t.last[key]; ok && now.Sub(last) < lastUsedResolution {
+		return false
+	}
+	if len(t.last) >= 4096 {
+		for k, last := range t.last {
+			if now.Sub(last) >= lastUsedResolution {
+				delete(t.last, k)
+			}
+		}
+	}
+	t.last[key] = now
+	return true
+}
+
+// forget makes the next use of key write again, after a write failed.
+func (t *dekTouches) forget(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.last, key)
+}
+
+func validateTags(tags map[string]string) error {
+	if len(tags) > maxTagsPerKey {
+		return fmt.Errorf("a key may have at most %d tags", maxTagsPerKey)
+	}
+	for k, v := range tags {
+		if err := validateTagKey(k); err != nil {
+			return err
+		}
+		if len(v) > maxTagValueLength {
+			return fmt.Errorf("tag value for %q exceeds %d characters", k, maxTagValueLength)
+		}
+	}
+	return nil
+}
+
+// validateTagKey rejects keys that Mongo would interpret as a path or operator.
+func validateTagKey(k string) error {
+	if k == "" || len(k) > maxTagKeyLength {
+		return fmt.Errorf("tag keys must be 1-%d characters", maxTagKeyLength)
+	}
+	if strings.ContainsAny(k, ".$") {
+		return fmt.Errorf("tag key %q must not contain '.' or '$'", k)
+	}
+	return nil
+}
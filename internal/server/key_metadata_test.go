@@ -0,0 +1,144 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"my-kms/internal/auth"
+	"my-kms/internal/storage"
+)
+
+// countingDEKStore counts TouchDEK calls, failing them while err is set.
+type countingDEKStore struct {
+	storage.DEKStore
+	touches int
+	err     error
+}
+
+func (c *countingDEKStore) TouchDEK(context.Context, string, string) error {
+	c.touches++
+	return c.err
+}
+
+func TestTouchDEKThrottled(t *testing.T) {
+	store := &countingDEKStore{}
+	s := NewServer(nil, nil, store, nil)
+	r := httptest.NewRequest(http.MethodPost, "/encrypt", nil)
+
+	for i := 0; i < 3; i++ {
+		s.touchDEK(r, "acme", "k1")
+	}
+	s.touchDEK(r, "acme", "k2")
+	s.touchDEK(r, "other", "k1")
+	if store.touches != 3 {
+		t.Fatalf("%d writes, want one per key", store.touches)
+	}
+
+	// Once the interval has passed the key is written again.
+	s.touches.last["acme/k1"] = time.Now().Add(-lastUsedResolution)
+	s.touchDEK(r, "acme", "k1")
+	if store.touches != 4 {
+		t.Errorf("%d writes, want the stale key written again", store.touches)
+	}
+}
+
+func TestTouchDEKRetriesAfterFailure(t *testing.T) {
+	store := &countingDEKStore{err: errUnavailable}
+	s := NewServer(nil, nil, store, nil)
+	r := httptest.NewRequest(http.MethodPost, "/decrypt", nil)
+
+	s.touchDEK(r, "", "k1")
+	store.err = nil
+	s.touchDEK(r, "", "k1")
+	s.touchDEK(r, "", "k1")
+	if store.touches != 2 {
+		t.Errorf("%d writes, want a retry after the failed write and nothing after", store.touches)
+	}
+}
+
+// keyRequest calls h as identity with body.
+func keyRequest(h http.HandlerFunc, identity auth.Identity, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+	r = r.WithContext(auth.WithIdentity(r.Context(), identity))
+	rec := httptest.NewRecorder()
+	h(rec, r)
+	return rec
+}
+
+// denyHRKeys installs a policy that keeps SERVICE off keys tagged class=hr.
+func denyHRKeys(t *testing.T, actions ...auth.Action) {
+	t.Helper()
+	policy := auth.DefaultPolicy()
+	policy.Rules = []auth.Rule{{Effect: auth.EffectDeny, Roles: []auth.Role{auth.RoleService, auth.RoleAdmin}, Actions: actions, KeyTags: map[string]string{"class": "hr"}}}
+	auth.SetPolicyEngine(policy)
+	t.Cleanup(func() { auth.SetPolicyEngine(auth.DefaultPolicy()) })
+}
+
+func TestKeyTagRulesApplyToDescribeAndList(t *testing.T) {
+	denyHRKeys(t)
+	deks := storage.NewMemoryDEKStore()
+	hr, _ := deks.InsertDEK(context.Background(), storage.DEKDocument{Tags: map[string]string{"class": "hr"}})
+	other, _ := deks.InsertDEK(context.Background(), storage.DEKDocument{Tags: map[string]string{"class": "ops"}})
+	s := NewServer(nil, nil, deks, nil)
+	service := auth.Identity{Name: "svc", Role: auth.RoleService}
+
+	if rec := keyRequest(s.DescribeKeyHandler, service, `{"dekID":"`+hr+`"}`); rec.Code != http.StatusForbidden {
+		t.Errorf("describe hr key: status %d, want %d", rec.Code, http.StatusForbidden)
+	}
+	if rec := keyRequest(s.DescribeKeyHandler, service, `{"dekID":"`+other+`"}`); rec.Code != http.StatusOK {
+		t.Errorf("describe other key: status %d, want %d", rec.Code, http.StatusOK)
+	}
+
+	rec := keyRequest(s.ListDataKeysHandler, service, `{}`)
+	var resp ListDataKeysResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("list: status %d: %v", rec.Code, err)
+	}
+	if len(resp.Keys) != 1 || resp.Keys[0].DEKID != other {
+		t.Errorf("listed %+v, want only %s", resp.Keys, other)
+	}
+}
+
+func TestKeyTagRulesUseEachOperationsAction(t *testing.T) {
+	denyHRKeys(t, auth.ActionExportKey, auth.ActionRotateMasterKey)
+	doc := &storage.DEKDocument{Tags: map[string]string{"class": "hr"}}
+	admin := auth.Identity{Name: "root", Role: auth.RoleAdmin}
+	ctx := context.Background()
+
+	if err := checkKeyPolicy(ctx, admin, doc, keyOpManage, nil); err != nil {
+		t.Errorf("manage: %v", err)
+	}
+	for _, op := range []keyOperation{keyOpExport, keyOpDelete} {
+		if err := checkKeyPolicy(ctx, admin, doc, op, nil); err == nil {
+			t.Errorf("%s allowed despite a deny rule on its action", op)
+		}
+	}
+}
+
+func TestAPIKeyScopeAppliesToDescribeAndList(t *testing.T) {
+	deks := storage.NewMemoryDEKStore()
+	k1, _ := deks.InsertDEK(context.Background(), storage.DEKDocument{})
+	k2, _ := deks.InsertDEK(context.Background(), storage.DEKDocument{})
+	s := NewServer(nil, nil, deks, nil)
+	scoped := auth.Identity{Name: "apikey:abc", Role: auth.RoleService, KeyScope: []string{k1}}
+
+	if rec := keyRequest(s.DescribeKeyHandler, scoped, `{"dekID":"`+k1+`"}`); rec.Code != http.StatusOK {
+		t.Errorf("describe k1: status %d, want %d", rec.Code, http.StatusOK)
+	}
+	if rec := keyRequest(s.DescribeKeyHandler, scoped, `{"dekID":"`+k2+`"}`); rec.Code != http.StatusForbidden {
+		t.Errorf("describe k2: status %d, want %d", rec.Code, http.StatusForbidden)
+	}
+
+	var resp ListDataKeysResponse
+	if err := json.Unmarshal(keyRequest(s.ListDataKeysHandler, scoped, `{}`).Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Keys) != 1 || resp.Keys[0].DEKID != k1 {
+		t.Errorf("listed %+v, want only %s", resp.Keys, k1)
+	}
+}
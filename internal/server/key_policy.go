@@ -0,0 +1,193 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"my-kms/internal/auth"
+	"my-kms/internal/storage"
+)
+
+// keyOperation names the part of a key policy an action is checked against.
+type keyOperation string
+
+const (
+	keyOpEncrypt keyOperation = "encrypt"
+	keyOpDecrypt keyOperation = "decrypt"
+	keyOpManage  keyOperation = "manage"
+	keyOpDerive  keyOperation = "derive"
+
+	// Export and deletion are checked against the manage list, but against their own
+	// actions in the policy engine.
+	keyOpExport keyOperation = "export"
+	keyOpDelete keyOperation = "delete"
+)
+
+// ---------------------------------------------------------------------
+// Put Key Policy
+// ---------------------------------------------------------------------
+
+type PutKeyPolicyRequest struct {
+	DEKID  string             `json:"dekID"`
+	Policy *storage.KeyPolicy `json:"policy"` // null removes the policy
+}
+
+func (s *Server) PutKeyPolicyHandler(w http.ResponseWriter, r *http.Request) {
+	identity, err := getIdentity(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	if err := auth.IsAuthorized(identity, auth.ActionManageKey); err != nil {
+		warnf(r.Context(), "Unauthorized attempt by role=%s to set key policy", identity.Role)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	var req PutKeyPolicyRequest
+	if !decodeJSON(w, r.Body, &req) {
+		return
+	}
+	if err := validateKeyPolicy(req.Policy); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// Refuse policies that would lock the caller out of managing the key.
+	if req.Policy != nil && len(req.Policy.Manage) > 0 && !auth.PrincipalMatches(identity, req.Policy.Manage) {
+		http.Error(w, "policy must keep the caller in its manage list", http.StatusBadRequest)
+		return
+	}
+
+	dekDoc, err := s.DEKStore.GetDEK(r.Context(), identity.Tenant, req.DEKID)
+	if err != nil {
+		errorf(r.Context(), "Failed to get DEK: %v", err)
+		http.Error(w, "DEK not found", http.StatusBadRequest)
+		return
+	}
+	if err := checkKeyPolicy(r.Context(), identity, dekDoc, keyOpManage, nil); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	if err := s.DEKStore.SetDEKPolicy(r.Context(), identity.Tenant, req.DEKID, req.Policy); err != nil {
+		errorf(r.Context(), "Failed to set DEK policy: %v", err)
+		http.Error(w, "failed to set DEK policy", http.StatusInternalServerError)
+		return
+	}
+	auditf(r.Context(), "policy of DEK %s replaced by %s", req.DEKID, identity.Name)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ---------------------------------------------------------------------
+// Helper Functions
+// ---------------------------------------------------------------------
+
+func validateKeyPolicy(p *storage.KeyPolicy) error {
+	if p == nil {
+		return nil
+	}
+	for _, list := range [][]string{p.Encrypt, p.Decrypt, p.Manage, p.Derive} {
+		for _, principal := range list {
+			if err := auth.ValidatePrincipal(principal); err != nil {
+				return err
+			}
+		}
+	}
+	for op, cond := range p.EncryptionContext {
+		// Only encrypt and decrypt carry an encryption context to check.
+		if op := keyOperation(op); op != keyOpEncrypt && op != keyOpDecrypt {
+			return fmt.Errorf("encryption context conditions apply to encrypt and decrypt, not %q", op)
+		}
+		if len(cond) == 0 {
+			return fmt.Errorf("encryption context condition for %s is empty", op)
+		}
+		if err := cond.Validate(); err != nil {
+			return fmt.Errorf("%s: %w", op, err)
+		}
+	}
+	return nil
+}
+
+// keyOperationActions maps key policy operations to the action re-checked against the
+// policy engine once the key's tags are known.
+var keyOperationActions = map[keyOperation]auth.Action{
+	keyOpEncrypt: auth.ActionEncrypt,
+	keyOpDecrypt: auth.ActionDecrypt,
+	keyOpManage:  auth.ActionManageKey,
+	keyOpDerive:  auth.ActionDeriveKey,
+	keyOpExport:  auth.ActionExportKey,
+	keyOpDelete:  auth.ActionRotateMasterKey,
+}
+
+// checkKeyPolicy applies the API key scope, engine rules conditioned on the key's tags and
+// the encryption context encCtx, and the DEK's own policy after the global role check has
+// passed.
+func checkKeyPolicy(ctx context.Context, identity auth.Identity, doc *storage.DEKDocument, op keyOperation, encCtx map[string]string) error {
+	if !identity.CanUseKey(doc.ID.Hex()) {
+		return fmt.Errorf("DEK %s is outside this API key's scope", doc.ID.Hex())
+	}
+	if err := auth.IsAuthorizedForKeyUse(identity, keyOperationActions[op], doc.Tags, encCtx); err != nil {
+		return err
+	}
+	if doc.Policy == nil {
+		return nil
+	}
+	var allowed []string
+	switch op {
+	case keyOpEncrypt:
+		allowed = doc.Policy.Encrypt
+	case keyOpDecrypt:
+		allowed = doc.Policy.Decrypt
+	case keyOpManage, keyOpExport, keyOpDelete:
+		allowed = doc.Policy.Manage
+	case keyOpDerive:
+		allowed = doc.Policy.Derive
+	}
+	if len(allowed) == 0 || auth.PrincipalMatches(identity, allowed) {
+		return nil
+	}
+	auditf(ctx, "key policy denied %s on DEK %s to %s", op, doc.ID.Hex(), identity.Name)
+	return fmt.Errorf("key policy does not allow %s for this principal", op)
+}
+
+// checkKeyConditions applies the DEK policy's encryption context condition for op. It
+// scopes the data the key may protect, so unlike the principal lists it binds grantees.
+func checkKeyConditions(ctx context.Context, identity auth.Identity, doc *storage.DEKDocument, op keyOperation, encCtx map[string]string) error {
+	if doc.Policy == nil {
+		return nil
+	}
+	cond, ok := doc.Policy.EncryptionContext[string(op)]
+	if !ok {
+		return nil
+	}
+	if err := cond.Check(encCtx); err != nil {
+		auditf(ctx, "key policy denied %s on DEK %s to %s: %v", op, doc.ID.Hex(), identity.Name, err)
+		return err
+	}
+	return nil
+}
+
+// authorizeKeyManagement loads a DEK and checks its manage policy, for handlers
+// that otherwise would not read the document.
+func (s *Server) authorizeKeyManagement(w http.ResponseWriter, r *http.Request, identity auth.Identity, dekID string) bool {
+	return s.authorizeKeyOperation(w, r, identity, dekID, keyOpManage)
+}
+
+// authorizeKeyOperation is authorizeKeyManagement for an operation other than manage.
+func (s *Server) authorizeKeyOperation(w http.ResponseWriter, r *http.Request, identity auth.Identity, dekID string, op keyOperation) bool {
+	auditKey(r, dekID, nil)
+	dekDoc, err := s.DEKStore.GetDEK(r.Context(), identity.Tenant, dekID)
+	if err != nil {
+		errorf(r.Context(), "Failed to get DEK: %v", err)
+		http.Error(w, "DEK not found", http.StatusBadRequest)
+		return false
+	}
+	if err := checkKeyPolicy(r.Context(), identity, dekDoc, op, nil); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return false
+	}
+	return true
+}
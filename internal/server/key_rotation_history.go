@@ -0,0 +1,237 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"my-kms/internal/auth"
+	"my-kms/internal/storage"
+)
+
+// recordKeyRotation adds ev to the rotation history. A failure is only logged: the
+// rotation has happened either way, and the audit log has it too.
+func (s *Server) recordKeyRotation(ctx context.Context, ev storage.KeyRotationEvent) {
+	if s.KeyRotations == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), auditWriteTimeout)
+	defer cancel()
+	if err := s.KeyRotations.RecordRotation(ctx, ev); err != nil {
+		errorf(ctx, "Failed to record %s rotation of %s: %v", ev.KeyType, ev.KeyID, err)
+	}
+}
+
+// ---------------------------------------------------------------------
+// Key Rotation History
+// ---------------------------------------------------------------------
+
+type KeyRotationHistoryResponse struct {
+	Rotations []storage.KeyRotationEvent `json:"rotations"`
+}
+
+// KeyRotationHistoryHandler returns master key and DEK rotations, newest first, filtered
+// by the keyType (MASTER_KEY or DATA_KEY), keyID, since and until (RFC 3339) query
+// parameters; limit caps the count. Tenant callers see their tenant's DEKs and every
+// master key rotation; platform auditors see everything, or one tenant with ?tenant=.
+func (s *Server) KeyRotationHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	identity, err := getIdentity(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	if err := auth.IsAuthorized(identity, auth.ActionViewAuditLog); err != nil {
+		warnf(r.Context(), "Unauthorized attempt by role=%s to read key rotation history", identity.Role)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	if s.KeyRotations == nil {
+		http.Error(w, "key rotation history is not enabled", http.StatusNotFound)
+		return
+	}
+
+	query := r.URL.Query()
+	q := storage.KeyRotationQuery{
+		TenantID: identity.Tenant,
+		KeyType:  query.Get("keyType"),
+		KeyID:    query.Get("keyID"),
+		Limit:    defaultListLimit,
+	}
+	if q.KeyType != "" && q.KeyType != storage.RotatedKeyMaster && q.KeyType != storage.RotatedKeyData {
+		http.Error(w, "keyType must be MASTER_KEY or DATA_KEY", http.StatusBadRequest)
+		return
+	}
+	if identity.Tenant == "" {
+		if t := query.Get("tenant"); t != "" {
+			q.TenantID = t
+		} else {
+			q.AllTenants = true
+		}
+	}
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			http.Error(w, "limit must be a positive integer", http.StatusBadRequest)
+			return
+		}
+		q.Limit = int64(min(n, maxListLimit))
+	}
+	for param, dst := range map[string]*time.Time{"since": &q.Since, "until": &q.Until} {
+		if v := query.Get(param); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				http.Error(w, param+" must be an RFC 3339 timestamp", http.StatusBadRequest)
+				return
+			}
+			*dst = t
+		}
+	}
+
+	events, err := s.KeyRotations.QueryRotations(r.Context(), q)
+	if err != nil {
+		errorf(r.Context(), "Failed to query key rotations: %v", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	if events == nil {
+		events = []storage.KeyRotationEvent{}
+	}
+	writeJSON(w, KeyRotationHistoryResponse{Rotations: events})
+}
+
+// ---------------------------------------------------------------------
+// Key Usage Report
+// ---------------------------------------------------------------------
+
+// Default and longest span of /key-usage-report, in days. Daily counters are only kept
+// for dayUsageRetention.
+const (
+	defaultKeyUsageReportDays = 30
+	maxKeyUsageReportDays     = 90
+)
+
+// KeyUsageDay is how often one DEK was used on one UTC day.
+type KeyUsageDay struct {
+	TenantID string `json:"tenantID,omitempty"`
+	KeyID    string `json:"keyID"`
+	Day      string `json:"day"` // 2006-01-02
+	Encrypt  int64  `json:"encrypt"`
+	Decrypt  int64  `json:"decrypt"`
+}
+
+type KeyUsageReportResponse struct {
+	Since string        `json:"since"`
+	Until string        `json:"until"`
+	Usage []KeyUsageDay `json:"usage"`
+}
+
+// KeyUsageReportHandler reports encrypt and decrypt counts per DEK per day, newest day
+// first, for the days since and until (YYYY-MM-DD, inclusive; the last 30 by default).
+// keyID limits it to one DEK; platform auditors may pass tenant.
+func (s *Server) KeyUsageReportHandler(w http.ResponseWriter, r *http.Request) {
+	identity, err := getIdentity(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	if err := auth.IsAuthorized(identity, auth.ActionViewUsage); err != nil {
+		warnf(r.Context(), "Unauthorized attempt by role=%s to view key usage", identity.Role)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	if s.Quotas == nil {
+		http.Error(w, "usage metering is not enabled", http.StatusNotFound)
+		return
+	}
+
+	query := r.URL.Query()
+	until := time.Now().UTC().Truncate(24 * time.Hour)
+	if v := query.Get("until"); v != "" {
+		if until, err = time.Parse(time.DateOnly, v); err != nil {
+			http.Error(w, "until must be a date (YYYY-MM-DD)", http.StatusBadRequest)
+			return
+		}
+	}
+	since := until.AddDate(0, 0, 1-defaultKeyUsageReportDays)
+	if v := query.Get("since"); v != "" {
+		if since, err = time.Parse(time.DateOnly, v); err != nil {
+			http.Error(w, "since must be a date (YYYY-MM-DD)", http.StatusBadRequest)
+			return
+		}
+	}
+	if since.After(until) {
+		http.Error(w, "since must not be after until", http.StatusBadRequest)
+		return
+	}
+	if until.Sub(since) >= maxKeyUsageReportDays*24*time.Hour {
+		http.Error(w, "the report spans at most "+strconv.Itoa(maxKeyUsageReportDays)+" days", http.StatusBadRequest)
+		return
+	}
+
+	q := storage.UsageQuery{
+		TenantID:   identity.Tenant,
+		Scope:      QuotaScopeKey,
+		Subject:    query.Get("keyID"),
+		Period:     QuotaPeriodDay,
+		WindowFrom: since.Format(time.DateOnly),
+		WindowTo:   until.Format(time.DateOnly),
+	}
+	if identity.Tenant == "" {
+		if t := query.Get("tenant"); t != "" {
+			q.TenantID = t
+		} else {
+			q.AllTenants = true
+		}
+	}
+
+	type dayKey struct{ tenant, key, day string }
+	days := map[dayKey]*KeyUsageDay{}
+	for _, op := range []string{quotaOpEncrypt, quotaOpDecrypt} {
+		q.Operation = op
+		counters, err := s.Quotas.Store.QueryUsage(r.Context(), q)
+		if err != nil {
+			errorf(r.Context(), "Failed to query key usage: %v", err)
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
+		for _, c := range counters {
+			k := dayKey{c.TenantID, c.Subject, c.Window}
+			d := days[k]
+			if d == nil {
+				d = &KeyUsageDay{TenantID: c.TenantID, KeyID: c.Subject, Day: c.Window}
+				days[k] = d
+			}
+			if op == quotaOpEncrypt {
+				d.Encrypt += c.Count
+			} else {
+				d.Decrypt += c.Count
+			}
+		}
+	}
+
+	resp := KeyUsageReportResponse{
+		Since: q.WindowFrom,
+		Until: q.WindowTo,
+		Usage: make([]KeyUsageDay, 0, len(days)),
+	}
+	for _, d := range days {
+		resp.Usage = append(resp.Usage, *d)
+	}
+	sort.Slice(resp.Usage, func(i, j int) bool {
+		a, b := resp.Usage[i], resp.Usage[j]
+		if a.Day != b.Day {
+			return a.Day > b.Day
+		}
+		if a.TenantID != b.TenantID {
+			return a.TenantID < b.TenantID
+		}
+		return a.KeyID < b.KeyID
+	})
+	writeJSON(w, resp)
+}
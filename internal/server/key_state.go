@@ -0,0 +1,134 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+
+	"my-kms/internal/auth"
+	"my-kms/internal/crypto"
+	"my-kms/internal/events"
+	"my-kms/internal/storage"
+)
+
+// ---------------------------------------------------------------------
+// Enable / Disable Key
+// ---------------------------------------------------------------------
+
+type KeyStateRequest struct {
+	DEKID string `json:"dekID"`
+}
+
+type KeyStateResponse struct {
+	DEKID string           `json:"dekID"`
+	State storage.KeyState `json:"state"`
+}
+
+func (s *Server) DisableKeyHandler(w http.ResponseWriter, r *http.Request) {
+	s.changeKeyState(w, r, storage.KeyStateDisabled, storage.KeyStateEnabled)
+}
+
+func (s *Server) EnableKeyHandler(w http.ResponseWriter, r *http.Request) {
+	s.changeKeyState(w, r, storage.KeyStateEnabled, storage.KeyStateDisabled)
+}
+
+// changeKeyState moves the requested DEK to state `to`, provided it is currently in state `from`.
+func (s *Server) changeKeyState(w http.ResponseWriter, r *http.Request, to, from storage.KeyState) {
+	identity, err := getIdentity(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	if err := auth.IsAuthorized(identity, auth.ActionManageKey); err != nil {
+		warnf(r.Context(), "Unauthorized attempt by role=%s to set key state %s", identity.Role, to)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	var req KeyStateRequest
+	if !decodeJSON(w, r.Body, &req) {
+		return
+	}
+
+	dekDoc, err := s.DEKStore.GetDEK(r.Context(), identity.Tenant, req.DEKID)
+	if err != nil {
+		errorf(r.Context(), "Failed to get DEK: %v", err)
+		http.Error(w, "DEK not found", http.StatusBadRequest)
+		return
+	}
+	if err := checkKeyPolicy(r.Context(), identity, dekDoc, keyOpManage, nil); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if current := dekDoc.EffectiveState(); current != from {
+		http.Error(w, fmt.Sprintf("DEK is %s; only %s keys can be moved to %s", current, from, to), http.StatusConflict)
+		return
+	}
+
+	if err := s.DEKStore.SetDEKState(r.Context(), identity.Tenant, req.DEKID, to, from); err != nil {
+		errorf(r.Context(), "Failed to set DEK state: %v", err)
+		http.Error(w, "failed to change DEK state", http.StatusConflict)
+		return
+	}
+	auditf(r.Context(), "DEK %s moved from %s to %s by %s", req.DEKID, from, to, identity.Name)
+	if to == storage.KeyStateDisabled {
+		s.publishEvent(r, events.KeyDisabled, req.DEKID, nil)
+	} else if to == storage.KeyStateEnabled {
+		s.publishEvent(r, events.KeyEnabled, req.DEKID, nil)
+	}
+
+	writeJSON(w, KeyStateResponse{DEKID: req.DEKID, State: to})
+}
+
+// ---------------------------------------------------------------------
+// Helper Functions
+// ---------------------------------------------------------------------
+
+// checkKeyUsable refuses cryptographic operations on keys that are not enabled.
+func checkKeyUsable(doc *storage.DEKDocument) error {
+	if st := doc.EffectiveState(); st != storage.KeyStateEnabled {
+		return fmt.Errorf("DEK %s is %s and cannot be used", doc.ID.Hex(), st)
+	}
+	return nil
+}
+
+// keyAlgorithm resolves a symmetric key's algorithm and checks it against the algorithm
+// policy. HPKE key pairs and root secrets are refused; only requireKeyAlgorithm accepts
+// them.
+func (s *Server) keyAlgorithm(doc *storage.DEKDocument) (crypto.Algorithm, error) {
+	alg, err := s.policyAlgorithm(doc)
+	if err != nil {
+		return "", err
+	}
+	if alg.HPKE() {
+		return "", fmt.Errorf("DEK %s is an HPKE key pair; senders encrypt to its public key and /hpke/open decrypts", doc.ID.Hex())
+	}
+	if alg.Derivation() {
+		return "", fmt.Errorf("DEK %s is a root secret; only /derive-key uses it", doc.ID.Hex())
+	}
+	return alg, nil
+}
+
+// requireKeyAlgorithm is keyAlgorithm for the endpoints that take a single kind of key,
+// such as /hpke/open.
+func (s *Server) requireKeyAlgorithm(doc *storage.DEKDocument, want crypto.Algorithm) (crypto.Algorithm, error) {
+	alg, err := s.policyAlgorithm(doc)
+	if err != nil {
+		return "", err
+	}
+	if alg != want {
+		return "", fmt.Errorf("DEK %s has algorithm %s; this operation needs %s", doc.ID.Hex(), alg, want)
+	}
+	return alg, nil
+}
+
+func (s *Server) policyAlgorithm(doc *storage.DEKDocument) (crypto.Algorithm, error) {
+	alg, err := crypto.ParseAlgorithm(doc.Algorithm)
+	if err != nil {
+		return "", err
+	}
+	if err := s.AlgPolicy.Check(alg); err != nil {
+		return "", err
+	}
+	return alg, nil
+}
@@ -0,0 +1,112 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	"my-kms/internal/crypto"
+	"my-kms/internal/storage"
+)
+
+// usageWrap is the KeyUsage operation for encrypting key material the KMS generated, as
+// AWS GenerateDataKey does, rather than the caller's data.
+const usageWrap = "wrap"
+
+// usageSchemeJWE is the KeyUsage algorithm for /encrypt and /decrypt with format jwe. A
+// key's own algorithm names its native ciphertext, and FPE modes name /encrypt-fpe's.
+const usageSchemeJWE = "JWE"
+
+// validateKeyUsage checks a usage restriction requested for a new key of algorithm alg.
+func validateKeyUsage(u *storage.KeyUsage, alg crypto.Algorithm) error {
+	if u == nil {
+		return nil
+	}
+	if alg.Derivation() {
+		return fmt.Errorf("usage restrictions apply to encryption keys, not %s root secrets", alg)
+	}
+	for _, op := range u.Operations {
+		switch op {
+		case string(keyOpEncrypt), string(keyOpDecrypt), usageWrap:
+		default:
+			return fmt.Errorf("usage operation %q must be encrypt, decrypt or wrap", op)
+		}
+	}
+	if u.MaxPayloadSize < 0 {
+		return fmt.Errorf("usage maxPayloadSize must not be negative")
+	}
+	schemes := []string{string(alg), usageSchemeJWE, string(crypto.FPEModeFF1), string(crypto.FPEModeFF31)}
+	for _, a := range u.Algorithms {
+		if !slices.Contains(schemes, a) {
+			return fmt.Errorf("usage algorithm %q must be one of %s", a, strings.Join(schemes, ", "))
+		}
+	}
+	return nil
+}
+
+type wrappingKey struct{}
+
+// withWrapping marks ctx as encrypting key material the KMS generated, so a key restricted
+// to wrap may be used and one restricted to encrypt may not.
+func withWrapping(ctx context.Context) context.Context {
+	return context.WithValue(ctx, wrappingKey{}, true)
+}
+
+func isWrapping(ctx context.Context) bool {
+	wrapping, _ := ctx.Value(wrappingKey{}).(bool)
+	return wrapping
+}
+
+// checkKeyUsage refuses op when the DEK's usage leaves it out. Nothing widens a usage
+// restriction: not the role, the key policy or a grant.
+func checkKeyUsage(r *http.Request, doc *storage.DEKDocument, op keyOperation) error {
+	if doc.Usage == nil || len(doc.Usage.Operations) == 0 {
+		return nil
+	}
+	name := string(op)
+	if op == keyOpEncrypt && isWrapping(r.Context()) {
+		name = usageWrap
+	}
+	if slices.Contains(doc.Usage.Operations, name) {
+		return nil
+	}
+	auditf(r.Context(), "usage of DEK %s refused %s", doc.ID.Hex(), name)
+	return fmt.Errorf("DEK %s may only be used to %s", doc.ID.Hex(), strings.Join(doc.Usage.Operations, ", "))
+}
+
+// checkKeyScheme refuses to produce or open a ciphertext of scheme, a key's algorithm or
+// one of the usage schemes above, when the DEK's usage leaves it out.
+func checkKeyScheme(doc *storage.DEKDocument, scheme string) error {
+	if doc.Usage == nil || len(doc.Usage.Algorithms) == 0 || slices.Contains(doc.Usage.Algorithms, scheme) {
+		return nil
+	}
+	return fmt.Errorf("DEK %s may not be used with %s", doc.ID.Hex(), scheme)
+}
+
+// ciphertextScheme names the usage scheme of /encrypt and /decrypt ciphertexts.
+func ciphertextScheme(alg crypto.Algorithm, jwe bool) string {
+	if jwe {
+		return usageSchemeJWE
+	}
+	return string(alg)
+}
+
+// payloadLimitError is a plaintext over its DEK's usage limit, answered 413.
+type payloadLimitError struct {
+	size, limit int
+	dekID       string
+}
+
+func (e *payloadLimitError) Error() string {
+	return fmt.Sprintf("plaintext of %d bytes exceeds the %d byte limit of DEK %s", e.size, e.limit, e.dekID)
+}
+
+// checkPayloadSize refuses to encrypt n bytes of plaintext under a DEK limited to fewer.
+func checkPayloadSize(doc *storage.DEKDocument, n int) error {
+	if doc.Usage == nil || doc.Usage.MaxPayloadSize == 0 || n <= doc.Usage.MaxPayloadSize {
+		return nil
+	}
+	return &payloadLimitError{size: n, limit: doc.Usage.MaxPayloadSize, dekID: doc.ID.Hex()}
+}
@@ -0,0 +1,217 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"my-kms/internal/auth"
+	"my-kms/internal/storage"
+)
+
+// errLegalHold is returned when an operation would destroy a held key.
+var errLegalHold = errors.New("DEK is under legal hold")
+
+// LegalHoldResponse is the public view of a legal hold.
+type LegalHoldResponse struct {
+	HoldID     string     `json:"holdID"`
+	Scope      string     `json:"scope"` // "key" or "tenant"
+	DEKID      string     `json:"dekID,omitempty"`
+	Reason     string     `json:"reason"`
+	PlacedBy   string     `json:"placedBy"`
+	PlacedAt   time.Time  `json:"placedAt"`
+	ReleasedBy string     `json:"releasedBy,omitempty"`
+	ReleasedAt *time.Time `json:"releasedAt,omitempty"`
+}
+
+func legalHoldResponseFromDoc(h *storage.LegalHold) LegalHoldResponse {
+	resp := LegalHoldResponse{
+		HoldID:     h.ID.Hex(),
+		Scope:      "key",
+		DEKID:      h.DEKID,
+		Reason:     h.Reason,
+		PlacedBy:   h.PlacedBy,
+		PlacedAt:   h.PlacedAt,
+		ReleasedBy: h.ReleasedBy,
+		ReleasedAt: optionalTime(h.ReleasedAt),
+	}
+	if h.DEKID == "" {
+		resp.Scope = "tenant"
+	}
+	return resp
+}
+
+// ---------------------------------------------------------------------
+// Place Legal Hold
+// ---------------------------------------------------------------------
+
+// PlaceLegalHoldRequest holds one DEK, or the caller's whole tenant when dekID is empty.
+type PlaceLegalHoldRequest struct {
+	DEKID  string `json:"dekID,omitempty"`
+	Reason string `json:"reason" validate:"required"`
+}
+
+func (s *Server) PlaceLegalHoldHandler(w http.ResponseWriter, r *http.Request) {
+	identity, err := getIdentity(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	if err := auth.IsAuthorized(identity, auth.ActionLegalHold); err != nil {
+		warnf(r.Context(), "Unauthorized attempt by role=%s to place legal hold", identity.Role)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	if s.LegalHolds == nil {
+		http.Error(w, "legal holds are not enabled", http.StatusNotFound)
+		return
+	}
+
+	var req PlaceLegalHoldRequest
+	if !decodeJSON(w, r.Body, &req) {
+		return
+	}
+	if req.DEKID != "" {
+		if _, err := s.DEKStore.GetDEK(r.Context(), identity.Tenant, req.DEKID); err != nil {
+			errorf(r.Context(), "Failed to get DEK: %v", err)
+			http.Error(w, "DEK not found", http.StatusBadRequest)
+			return
+		}
+	}
+
+	h, err := s.LegalHolds.PlaceHold(r.Context(), storage.LegalHold{
+		TenantID: identity.Tenant,
+		DEKID:    req.DEKID,
+		Reason:   req.Reason,
+		PlacedBy: identity.Name,
+	})
+	if err != nil {
+		errorf(r.Context(), "Failed to place legal hold: %v", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	resp := legalHoldResponseFromDoc(h)
+	auditf(r.Context(), "legal hold %s placed on %s by %s: %s", resp.HoldID, holdTarget(identity.Tenant, req.DEKID), identity.Name, req.Reason)
+
+	writeJSON(w, resp)
+}
+
+// ---------------------------------------------------------------------
+// Release Legal Hold
+// ---------------------------------------------------------------------
+
+type ReleaseLegalHoldRequest struct {
+	HoldID string `json:"holdID" validate:"required"`
+}
+
+func (s *Server) ReleaseLegalHoldHandler(w http.ResponseWriter, r *http.Request) {
+	identity, err := getIdentity(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	if err := auth.IsAuthorized(identity, auth.ActionLegalHold); err != nil {
+		warnf(r.Context(), "Unauthorized attempt by role=%s to release legal hold", identity.Role)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	if s.LegalHolds == nil {
+		http.Error(w, "legal holds are not enabled", http.StatusNotFound)
+		return
+	}
+
+	var req ReleaseLegalHoldRequest
+	if !decodeJSON(w, r.Body, &req) {
+		return
+	}
+
+	h, err := s.LegalHolds.ReleaseHold(r.Context(), identity.Tenant, req.HoldID, identity.Name)
+	if err != nil {
+		errorf(r.Context(), "Failed to release legal hold: %v", err)
+		http.Error(w, "active legal hold not found", http.StatusNotFound)
+		return
+	}
+	auditf(r.Context(), "legal hold %s on %s released by %s", req.HoldID, holdTarget(h.TenantID, h.DEKID), identity.Name)
+
+	writeJSON(w, legalHoldResponseFromDoc(h))
+}
+
+// ---------------------------------------------------------------------
+// List Legal Holds
+// ---------------------------------------------------------------------
+
+type ListLegalHoldsResponse struct {
+	Holds []LegalHoldResponse `json:"holds"`
+}
+
+// ListLegalHoldsHandler returns the tenant's hold history; ?active=true limits it to holds in force.
+func (s *Server) ListLegalHoldsHandler(w http.ResponseWriter, r *http.Request) {
+	identity, err := getIdentity(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	if err := auth.IsAuthorized(identity, auth.ActionListKeys); err != nil {
+		warnf(r.Context(), "Unauthorized attempt by role=%s to list legal holds", identity.Role)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	if s.LegalHolds == nil {
+		http.Error(w, "legal holds are not enabled", http.StatusNotFound)
+		return
+	}
+
+	holds, err := s.LegalHolds.ListHolds(r.Context(), identity.Tenant, r.URL.Query().Get("active") == "true")
+	if err != nil {
+		errorf(r.Context(), "Failed to list legal holds: %v", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	resp := ListLegalHoldsResponse{Holds: make([]LegalHoldResponse, 0, len(holds))}
+	for i := range holds {
+		resp.Holds = append(resp.Holds, legalHoldResponseFromDoc(&holds[i]))
+	}
+	writeJSON(w, resp)
+}
+
+// ---------------------------------------------------------------------
+// Helper Functions
+// ---------------------------------------------------------------------
+
+// checkLegalHold returns errLegalHold if the DEK may not be destroyed. Lookup failures
+// also block unless legal holds are configured to fail open, since destroying held data
+// cannot be undone.
+func (s *Server) checkLegalHold(r *http.Request, tenant, dekID string) error {
+	if s.LegalHolds == nil {
+		return nil
+	}
+	held, err := s.LegalHolds.IsHeld(r.Context(), tenant, dekID)
+	if err != nil {
+		if s.failOpen(r.Context(), SubsystemLegalHolds, err) {
+			return nil
+		}
+		return errLegalHold
+	}
+	if held {
+		auditf(r.Context(), "destruction of DEK %s blocked by legal hold", dekID)
+		return errLegalHold
+	}
+	return nil
+}
+
+func holdTarget(tenant, dekID string) string {
+	if dekID != "" {
+		return "DEK " + dekID
+	}
+	if tenant == "" {
+		return "the default tenant"
+	}
+	return "tenant " + tenant
+}
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Locks shared by the replicas.
+const (
+	LockRotation         = "master-key-rotation" // scheduled and API rotations, and the rewrap pass
+	LockDEKPurge         = "dek-purge"
+	LockAuditCheckpoints = "audit-checkpoints"
+	LockAuditArchive     = "audit-archive"
+	LockEventRelay       = "event-relay" // keeps the outbox published in order
+)
+
+// DefaultLockLease is how long a replica holds a cluster lock without renewing it.
+const DefaultLockLease = time.Minute
+
+// Locker hands out leases on named locks. It is implemented by storage.MongoLockStore.
+type Locker interface {
+	TryAcquire(ctx context.Context, name, owner string, ttl time.Duration) (bool, error)
+	Release(ctx context.Context, name, owner string) error
+}
+
+// ClusterLocks keeps work that must not run on two replicas at once, such as rotating
+// the master key, to one replica at a time.
+type ClusterLocks struct {
+	Store Locker
+	Owner string        // names this replica in the lock documents, e.g. its hostname
+	Lease time.Duration // renewed every third of it while the work runs
+}
+
+// NewClusterLocks returns locks taken in store under owner.
+func NewClusterLocks(store Locker, owner string, lease time.Duration) *ClusterLocks {
+	if lease <= 0 {
+		lease = DefaultLockLease
+	}
+	return &ClusterLocks{Store: store, Owner: owner, Lease: lease}
+}
+
+// withClusterLock runs fn holding the lock name, renewing the lease while it runs, and
+// reports whether it ran. It doesn't while another replica, or other work on this one,
+// holds the lock, or while the lock can't be checked. fn's context is cancelled if the lease is lost, so it stops before
+// another replica can take over. Without s.Locks, fn always runs.
+func (s *Server) withClusterLock(ctx context.Context, name string, fn func(ctx context.Context)) bool {
+	locks := s.Locks
+	if locks == nil {
+		fn(ctx)
+		return true
+	}
+	// Each hold has its own owner, so work on this replica is excluded as well.
+	owner := locks.Owner + "/" + uuid.NewString()
+	ok, err := locks.Store.TryAcquire(ctx, name, owner, locks.Lease)
+	if err != nil {
+		warnf(ctx, "Skipping %s, the cluster lock is unavailable: %v", name, err)
+		return false
+	}
+	if !ok {
+		return false
+	}
+	defer locks.Store.Release(context.WithoutCancel(ctx), name, owner)
+
+	workCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	renewed := make(chan struct{})
+	go func() {
+		defer close(renewed)
+		ticker := time.NewTicker(locks.Lease / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-workCtx.Done():
+				return
+			case <-ticker.C:
+				ok, err := locks.Store.TryAcquire(workCtx, name, owner, locks.Lease)
+				if ok || workCtx.Err() != nil {
+					continue
+				}
+				if err == nil {
+					err = errors.New("another replica took it over")
+				}
+				warnf(ctx, "Lost the cluster lock %s, stopping: %v", name, err)
+				cancel()
+				return
+			}
+		}
+	}()
+	fn(workCtx)
+	cancel()
+	<-renewed
+	return true
+}
@@ -0,0 +1,140 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"my-kms/internal/auth"
+	"my-kms/internal/events"
+	"my-kms/internal/storage"
+)
+
+// ---------------------------------------------------------------------
+// Retire Master Key
+// ---------------------------------------------------------------------
+
+type RetireMasterKeyRequest struct {
+	MasterKeyID string `json:"masterKeyID"`
+}
+
+// RetireMasterKeyHandler destroys a DECRYPT_ONLY master key once nothing depends on it.
+// From then on it refuses even to unwrap, which is what shows it has left service.
+func (s *Server) RetireMasterKeyHandler(w http.ResponseWriter, r *http.Request) {
+	identity, err := getIdentity(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	if err := auth.IsAuthorized(identity, auth.ActionRotateMasterKey); err != nil {
+		warnf(r.Context(), "Unauthorized attempt by role=%s to retire master key", identity.Role)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	var req RetireMasterKeyRequest
+	if !decodeJSON(w, r.Body, &req) {
+		return
+	}
+
+	var key *storage.MasterKeyInfo
+	for _, k := range s.KeyStore.Keys() {
+		if k.ID == req.MasterKeyID {
+			key = &k
+			break
+		}
+	}
+	switch {
+	case key == nil:
+		http.Error(w, "master key not found", http.StatusNotFound)
+		return
+	case !s.KeyStore.Persistent():
+		http.Error(w, "master keys from MASTER_KEYS cannot be retired; remove the key from MASTER_KEYS instead", http.StatusConflict)
+		return
+	case key.State == storage.MasterKeyStateActive:
+		http.Error(w, "the active master key cannot be retired; rotate first", http.StatusConflict)
+		return
+	case key.State == storage.MasterKeyStateRetired:
+		http.Error(w, "master key is already retired", http.StatusConflict)
+		return
+	}
+
+	dependents, err := s.masterKeyDependents(r.Context(), key.ID)
+	if err != nil {
+		errorf(r.Context(), "Failed to check what master key %s protects: %v", key.ID, err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	if len(dependents) > 0 {
+		http.Error(w, "master key still protects "+strings.Join(dependents, ", "), http.StatusConflict)
+		return
+	}
+
+	if !s.requireSecondApprover(w, r, identity, "retire-master-key", key.ID) {
+		return
+	}
+
+	if err := s.KeyStore.RetireMasterKey(key.ID, auditCheckpointPurpose); err != nil {
+		errorf(r.Context(), "Failed to retire master key %s: %v", key.ID, err)
+		http.Error(w, "master key retirement failed", http.StatusInternalServerError)
+		return
+	}
+	auditf(r.Context(), "master key %s retired by %s", key.ID, identity.Name)
+	s.publishEventAs(identity.Name, "", events.MasterKeyRetired, key.ID, nil)
+
+	for _, k := range s.KeyStore.Keys() {
+		if k.ID == key.ID {
+			writeJSON(w, s.masterKeyInfo(k))
+			return
+		}
+	}
+}
+
+// masterKeyDependents lists what is still wrapped or sealed under master key id. Only
+// the active key wraps anything new, so once this is empty for an inactive key it stays so.
+func (s *Server) masterKeyDependents(ctx context.Context, id string) ([]string, error) {
+	var found []string
+	docs, _, err := s.DEKStore.ListDEKsByMasterKey(ctx, id, "", 1)
+	if err != nil {
+		return nil, err
+	}
+	if len(docs) > 0 {
+		found = append(found, "DEKs")
+	}
+
+	type counter struct {
+		what  string
+		count func(context.Context, string) (int64, error)
+	}
+	var counters []counter
+	if s.IndexKeys != nil {
+		counters = append(counters, counter{"index keys", s.IndexKeys.CountByMasterKey})
+	}
+	if s.CAs != nil {
+		counters = append(counters, counter{"certificate authority keys", s.CAs.CountByMasterKey})
+	}
+	if s.SigningKeys != nil {
+		counters = append(counters, counter{"JWT signing keys", s.SigningKeys.CountByMasterKey})
+	}
+	if s.APIKeys != nil {
+		counters = append(counters, counter{"API key secrets", s.APIKeys.CountByMasterKey})
+	}
+	if s.TenantCMKs != nil {
+		counters = append(counters, counter{"CMK credentials", s.TenantCMKs.CountByMasterKey})
+	}
+	if s.ImportTokens != nil {
+		counters = append(counters, counter{"import tokens", s.ImportTokens.CountByMasterKey})
+	}
+	for _, c := range counters {
+		n, err := c.count(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		if n > 0 {
+			found = append(found, fmt.Sprintf("%d %s", n, c.what))
+		}
+	}
+	return found, nil
+}
@@ -0,0 +1,46 @@
+package server
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strconv"
+	"time"
+
+	"my-kms/internal/metrics"
+)
+
+// MetricsMiddleware records request counts, latencies and auth failures per route
+// pattern. Unmatched paths share one "unmatched" label so scanners can't inflate it.
+func (s *Server) MetricsMiddleware(mux *http.ServeMux, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		endpoint := "unmatched"
+		if _, pattern := mux.Handler(r); pattern != "" {
+			endpoint = pattern
+		}
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+
+		metrics.HTTPDuration.Observe(time.Since(start).Seconds(), endpoint)
+		metrics.HTTPRequests.Inc(endpoint, strconv.Itoa(rec.status))
+		switch rec.status {
+		case http.StatusUnauthorized:
+			metrics.AuthFailures.Inc(endpoint, "unauthenticated")
+		case http.StatusForbidden:
+			metrics.AuthFailures.Inc(endpoint, "forbidden")
+		}
+	})
+}
+
+// MetricsHandler serves Prometheus metrics. When MetricsToken is set, scrapers must
+// send it as a bearer token.
+func (s *Server) MetricsHandler(w http.ResponseWriter, r *http.Request) {
+	if s.MetricsToken != "" {
+		want := "Bearer " + s.MetricsToken
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte(want)) != 1 {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+	}
+	metrics.Handler().ServeHTTP(w, r)
+}
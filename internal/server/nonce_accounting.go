@@ -0,0 +1,163 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"my-kms/internal/crypto"
+	"my-kms/internal/metrics"
+	"my-kms/internal/storage"
+)
+
+const (
+	// DefaultGCMEncryptionLimit is NIST SP 800-38D's bound on encryptions with random
+	// 96-bit nonces under one key.
+	DefaultGCMEncryptionLimit = 1 << 32
+
+	// DefaultGCMEncryptionLease is how many encryptions an instance reserves at once.
+	DefaultGCMEncryptionLease = 1000
+
+	// nonceRotationThreshold is the share of its limit at which the rotation schedule
+	// replaces the active master key early.
+	nonceRotationThreshold = 0.9
+)
+
+// NonceLedger counts encryptions under the keys whose algorithms bound them (AES-GCM),
+// and refuses them once a key reaches Limit. Each instance reserves Lease encryptions at
+// a time from Store, so a restart forfeits at most what was left of its leases.
+type NonceLedger struct {
+	Store *storage.MongoNonceCounterStore // nil counts in this process only
+	Limit int64
+	Lease int64
+
+	mu     sync.Mutex
+	leases map[string]*nonceLease
+}
+
+type nonceLease struct {
+	remaining int64 // reserved for this instance and not yet used
+	reserved  int64 // the key's count across every instance, as of the last reservation
+}
+
+// NewNonceLedger returns a ledger enforcing limit, leasing lease encryptions at a time.
+func NewNonceLedger(store *storage.MongoNonceCounterStore, limit, lease int64) *NonceLedger {
+	if limit <= 0 {
+		limit = DefaultGCMEncryptionLimit
+	}
+	if lease <= 0 {
+		lease = DefaultGCMEncryptionLease
+	}
+	return &NonceLedger{Store: store, Limit: limit, Lease: min(lease, limit), leases: make(map[string]*nonceLease)}
+}
+
+// Reserve claims n encryptions under key, failing with storage.ErrNonceLimit once the
+// key has none left.
+func (nl *NonceLedger) Reserve(ctx context.Context, key string, n int64) error {
+	nl.mu.Lock()
+	defer nl.mu.Unlock()
+
+	l := nl.leases[key]
+	if l == nil {
+		l = &nonceLease{}
+		nl.leases[key] = l
+	}
+	if l.remaining >= n {
+		l.remaining -= n
+		return nil
+	}
+	need := n - l.remaining
+	chunk := max(need, nl.Lease)
+	reserved, err := nl.reserve(ctx, key, chunk)
+	if errors.Is(err, storage.ErrNonceLimit) && chunk > need {
+		// Too close to the limit for a whole lease; take just what this call needs.
+		chunk = need
+		reserved, err = nl.reserve(ctx, key, chunk)
+	}
+	if err != nil {
+		return err
+	}
+	l.reserved = reserved
+	l.remaining += chunk - n
+	return nil
+}
+
+func (nl *NonceLedger) reserve(ctx context.Context, key string, n int64) (int64, error) {
+	if nl.Store != nil {
+		return nl.Store.Reserve(ctx, key, n, nl.Limit)
+	}
+	// Without a store the count lives in the lease itself.
+	reserved := nl.leases[key].reserved
+	if reserved > nl.Limit-n {
+		return reserved, storage.ErrNonceLimit
+	}
+	return reserved + n, nil
+}
+
+// NearLimit reports whether key's count has passed nonceRotationThreshold of the limit.
+func (nl *NonceLedger) NearLimit(key string) bool {
+	nl.mu.Lock()
+	defer nl.mu.Unlock()
+	l := nl.leases[key]
+	return l != nil && float64(l.reserved) >= nonceRotationThreshold*float64(nl.Limit)
+}
+
+func dekNonceKey(dekID string) string             { return "dek:" + dekID }
+func masterKeyNonceKey(masterKeyID string) string { return "master:" + masterKeyID }
+
+// reserveEncryptions counts n encryptions under dekID when alg's nonces bound them, and
+// returns false, having written a 403 when the DEK has used up its limit or a 503 when
+// the count can't be recorded.
+func (s *Server) reserveEncryptions(w http.ResponseWriter, r *http.Request, dekID string, alg crypto.Algorithm, n int64) bool {
+	err := s.reserveDEKEncryptions(r.Context(), dekID, alg, n)
+	if errors.Is(err, storage.ErrNonceLimit) {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return false
+	}
+	if err != nil {
+		errorf(r.Context(), "Failed to count encryptions under DEK %s: %v", dekID, err)
+		http.Error(w, "encryption count unavailable", http.StatusServiceUnavailable)
+		return false
+	}
+	return true
+}
+
+// reserveDEKEncryptions is reserveEncryptions for callers that report errors themselves.
+func (s *Server) reserveDEKEncryptions(ctx context.Context, dekID string, alg crypto.Algorithm, n int64) error {
+	if s.Nonces == nil || !alg.NonceLimited() {
+		return nil
+	}
+	err := s.Nonces.Reserve(ctx, dekNonceKey(dekID), n)
+	if errors.Is(err, storage.ErrNonceLimit) {
+		metrics.EncryptionLimitReached.Inc("dek")
+		warnf(ctx, "DEK %s has reached its limit of %d encryptions", dekID, s.Nonces.Limit)
+		auditf(ctx, "Encryption refused: DEK %s has reached its limit of %d encryptions", dekID, s.Nonces.Limit)
+		return fmt.Errorf("%w: DEK %s has reached its limit of %d encryptions; rotate to a new key", storage.ErrNonceLimit, dekID, s.Nonces.Limit)
+	}
+	return err
+}
+
+// CountMasterKeyWrap counts one DEK wrap under a master key, which uses AES-256-GCM,
+// for storage.MasterKeyStore.SetWrapGuard. The rotation schedule replaces a key nearing
+// the limit at its next check; it is not kicked, since the rewrap after a rotation
+// spends wraps of its own.
+func (s *Server) CountMasterKeyWrap(ctx context.Context, masterKeyID string) error {
+	if s.Nonces == nil {
+		return nil
+	}
+	err := s.Nonces.Reserve(ctx, masterKeyNonceKey(masterKeyID), 1)
+	if errors.Is(err, storage.ErrNonceLimit) {
+		metrics.EncryptionLimitReached.Inc("master")
+		errorf(ctx, "Master key %s has reached its limit of %d wraps", masterKeyID, s.Nonces.Limit)
+		err = fmt.Errorf("%w: master key %s has reached its limit of %d wraps; rotate the master key", storage.ErrNonceLimit, masterKeyID, s.Nonces.Limit)
+	}
+	return err
+}
+
+// masterKeyNearLimit reports whether the active master key should be rotated before it
+// runs out of wraps.
+func (s *Server) masterKeyNearLimit(masterKeyID string) bool {
+	return s.Nonces != nil && s.Nonces.NearLimit(masterKeyNonceKey(masterKeyID))
+}
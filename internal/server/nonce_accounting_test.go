@@ -0,0 +1,83 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"my-kms/internal/crypto"
+	"my-kms/internal/storage"
+)
+
+func TestNonceLedgerRefusesPastLimit(t *testing.T) {
+	ctx := context.Background()
+	nl := NewNonceLedger(nil, 10, 4)
+
+	// Leases of four, then whatever is left: 4+4+2.
+	for i := 0; i < 10; i++ {
+		if err := nl.Reserve(ctx, "dek:k1", 1); err != nil {
+			t.Fatalf("encryption %d: %v", i+1, err)
+		}
+	}
+	if err := nl.Reserve(ctx, "dek:k1", 1); !errors.Is(err, storage.ErrNonceLimit) {
+		t.Fatalf("encryption 11: error = %v, want %v", err, storage.ErrNonceLimit)
+	}
+	if !nl.NearLimit("dek:k1") {
+		t.Error("exhausted key not reported near its limit")
+	}
+	// Other keys are counted on their own.
+	if err := nl.Reserve(ctx, "dek:k2", 1); err != nil {
+		t.Errorf("other key: %v", err)
+	}
+	if nl.NearLimit("dek:k2") {
+		t.Error("fresh key reported near its limit")
+	}
+}
+
+func TestNonceLedgerBatchPastLimit(t *testing.T) {
+	ctx := context.Background()
+	nl := NewNonceLedger(nil, 10, 4)
+	if err := nl.Reserve(ctx, "dek:k1", 8); err != nil {
+		t.Fatal(err)
+	}
+	if err := nl.Reserve(ctx, "dek:k1", 3); !errors.Is(err, storage.ErrNonceLimit) {
+		t.Fatalf("batch past the limit: error = %v, want %v", err, storage.ErrNonceLimit)
+	}
+	if err := nl.Reserve(ctx, "dek:k1", 2); err != nil {
+		t.Errorf("batch up to the limit: %v", err)
+	}
+}
+
+func TestReserveEncryptionsByAlgorithm(t *testing.T) {
+	s := NewServer(nil, nil, nil, nil)
+	s.Nonces = NewNonceLedger(nil, 2, 1)
+	r := httptest.NewRequest(http.MethodPost, "/encrypt", nil)
+
+	for _, tc := range []struct {
+		alg     crypto.Algorithm
+		limited bool
+	}{
+		{crypto.AlgorithmAES256GCM, true},
+		{crypto.AlgorithmAES128GCM, true},
+		{crypto.AlgorithmAES256GCMSIV, false},
+		{crypto.AlgorithmXChaCha20Poly1305, false},
+		{crypto.AlgorithmAES256SIV, false},
+	} {
+		dekID := string(tc.alg)
+		for i := 0; i < 2; i++ {
+			if rec := httptest.NewRecorder(); !s.reserveEncryptions(rec, r, dekID, tc.alg, 1) {
+				t.Fatalf("%s: encryption %d refused with %d", tc.alg, i+1, rec.Code)
+			}
+		}
+		rec := httptest.NewRecorder()
+		ok := s.reserveEncryptions(rec, r, dekID, tc.alg, 1)
+		if tc.limited && (ok || rec.Code != http.StatusForbidden) {
+			t.Errorf("%s: encryption past the limit answered %d, want 403", tc.alg, rec.Code)
+		}
+		if !tc.limited && !ok {
+			t.Errorf("%s: uncapped algorithm refused with %d", tc.alg, rec.Code)
+		}
+	}
+}
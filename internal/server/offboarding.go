@@ -0,0 +1,149 @@
+package server
+
+import (
+	"net/http"
+
+	"my-kms/internal/auth"
+	"my-kms/internal/events"
+	"my-kms/internal/storage"
+)
+
+// ---------------------------------------------------------------------
+// Offboard User
+// ---------------------------------------------------------------------
+
+// OffboardPolicy decides what happens to the DEKs owned by an offboarded user.
+type OffboardPolicy string
+
+const (
+	// OffboardPolicyTransfer hands every owned DEK over to another user.
+	OffboardPolicyTransfer OffboardPolicy = "transfer"
+	// OffboardPolicyDisable disables every owned DEK but keeps it for later review.
+	OffboardPolicyDisable OffboardPolicy = "disable"
+	// OffboardPolicyDelete removes every owned DEK.
+	OffboardPolicyDelete OffboardPolicy = "delete"
+)
+
+type OffboardUserRequest struct {
+	FirebaseUID string         `json:"firebaseUID" validate:"required"`
+	Policy      OffboardPolicy `json:"policy"`
+	TransferTo  string         `json:"transferTo,omitempty"` // required for the transfer policy
+}
+
+type OffboardKeyResult struct {
+	DEKID  string `json:"dekID"`
+	Result string `json:"result"`
+	Error  string `json:"error,omitempty"`
+}
+
+type OffboardUserResponse struct {
+	FirebaseUID string              `json:"firebaseUID"`
+	Policy      OffboardPolicy      `json:"policy"`
+	Keys        []OffboardKeyResult `json:"keys"`
+	Failed      int                 `json:"failed"`
+}
+
+func (s *Server) OffboardUserHandler(w http.ResponseWriter, r *http.Request) {
+	identity, err := getIdentity(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	if err := auth.IsAuthorized(identity, auth.ActionOffboardUser); err != nil {
+		warnf(r.Context(), "Unauthorized attempt by role=%s to offboard user", identity.Role)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	var req OffboardUserRequest
+	if !decodeJSON(w, r.Body, &req) {
+		return
+	}
+
+	switch req.Policy {
+	case OffboardPolicyTransfer:
+		if req.TransferTo == "" || req.TransferTo == req.FirebaseUID {
+			http.Error(w, "transferTo must name a different user", http.StatusBadRequest)
+			return
+		}
+		target, err := s.UserStore.GetUserByFirebaseUID(r.Context(), req.TransferTo)
+		if err != nil || auth.CheckTenant(identity, target.TenantID) != nil {
+			http.Error(w, "transferTo user not found", http.StatusBadRequest)
+			return
+		}
+	case OffboardPolicyDisable, OffboardPolicyDelete:
+	default:
+		http.Error(w, "unknown offboarding policy", http.StatusBadRequest)
+		return
+	}
+
+	user, err := s.UserStore.GetUserByFirebaseUID(r.Context(), req.FirebaseUID)
+	if err != nil || auth.CheckTenant(identity, user.TenantID) != nil {
+		http.Error(w, "user not found", http.StatusBadRequest)
+		return
+	}
+
+	// Disable the user first so no new keys can be created while we process the existing ones.
+	if err := s.UserStore.DisableUser(r.Context(), req.FirebaseUID); err != nil {
+		errorf(r.Context(), "Failed to disable user %s: %v", req.FirebaseUID, err)
+		http.Error(w, "failed to disable user", http.StatusBadRequest)
+		return
+	}
+	// A departed user must not come back through the outage fallback.
+	s.userCache.forget(req.FirebaseUID)
+
+	docs, err := s.DEKStore.ListDEKsByOwner(r.Context(), identity.Tenant, req.FirebaseUID)
+	if err != nil {
+		errorf(r.Context(), "Failed to list DEKs for %s: %v", req.FirebaseUID, err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	resp := OffboardUserResponse{
+		FirebaseUID: req.FirebaseUID,
+		Policy:      req.Policy,
+		Keys:        make([]OffboardKeyResult, 0, len(docs)),
+	}
+	for _, doc := range docs {
+		dekID := doc.ID.Hex()
+		result := OffboardKeyResult{DEKID: dekID}
+
+		switch req.Policy {
+		case OffboardPolicyTransfer:
+			err = s.DEKStore.SetDEKOwner(r.Context(), identity.Tenant, dekID, req.TransferTo)
+			result.Result = "transferred"
+		case OffboardPolicyDisable:
+			if doc.EffectiveState() != storage.KeyStateEnabled {
+				result.Result = "unchanged"
+				resp.Keys = append(resp.Keys, result)
+				continue
+			}
+			err = s.DEKStore.SetDEKState(r.Context(), identity.Tenant, dekID, storage.KeyStateDisabled, storage.KeyStateEnabled)
+			result.Result = "disabled"
+		case OffboardPolicyDelete:
+			if err = s.checkLegalHold(r, identity.Tenant, dekID); err == nil {
+				err = s.DEKStore.DeleteDEK(r.Context(), identity.Tenant, dekID, identity.Name)
+			}
+			if err == nil {
+				s.flagCiphertextLocations(r, identity.Tenant, dekID, storage.ReencryptionReasonShredded, "")
+			}
+			result.Result = "deleted"
+		}
+		if err != nil {
+			result.Result = "failed"
+			result.Error = err.Error()
+			resp.Failed++
+		}
+		auditf(r.Context(), "offboarding %s: DEK %s %s", req.FirebaseUID, dekID, result.Result)
+		switch result.Result {
+		case "disabled":
+			s.publishEvent(r, events.KeyDisabled, dekID, map[string]string{"offboarded": req.FirebaseUID})
+		case "deleted":
+			s.publishEvent(r, events.KeyDeletionScheduled, dekID, map[string]string{"offboarded": req.FirebaseUID})
+		}
+		resp.Keys = append(resp.Keys, result)
+	}
+
+	writeJSON(w, resp)
+}
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// TrustedProxies are the addresses of the load balancers and ingress proxies in front of
+// the server, whose X-Forwarded-For headers are believed.
+type TrustedProxies []netip.Prefix
+
+// ParseTrustedProxies reads comma-separated CIDRs or single addresses, such as
+// "10.0.0.0/8,127.0.0.1".
+func ParseTrustedProxies(s string) (TrustedProxies, error) {
+	var proxies TrustedProxies
+	for _, entry := range strings.Split(s, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			addr, err := netip.ParseAddr(entry)
+			if err != nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q: %w", entry, err)
+			}
+			proxies = append(proxies, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %w", entry, err)
+		}
+		proxies = append(proxies, prefix.Masked())
+	}
+	return proxies, nil
+}
+
+func (p TrustedProxies) contains(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range p {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedClient walks X-Forwarded-For from the right, past the trusted proxies, to
+// the address that reached the first of them. Anything to its left was written by the
+// client and proves nothing. It returns "" if the header is missing or malformed.
+func (p TrustedProxies) forwardedClient(header []string) string {
+	hops := strings.Split(strings.Join(header, ","), ",")
+	client := ""
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr, ok := parseHop(hops[i])
+		if !ok {
+			return ""
+		}
+		client = addr.String()
+		if !p.contains(addr) {
+			break
+		}
+	}
+	return client
+}
+
+// parseHop reads one X-Forwarded-For entry, which some proxies write with a port.
+func parseHop(hop string) (netip.Addr, bool) {
+	hop = strings.TrimSpace(hop)
+	if addr, err := netip.ParseAddr(hop); err == nil {
+		return addr.Unmap(), true
+	}
+	if ap, err := netip.ParseAddrPort(hop); err == nil {
+		return ap.Addr().Unmap(), true
+	}
+	return netip.Addr{}, false
+}
+
+// ProxyMiddleware replaces the remote address of requests relayed by a trusted proxy
+// with the client address from X-Forwarded-For, so that audit logs and per-IP rate
+// limits see the client rather than the proxy. Requests from anywhere else keep their
+// connection's address, whatever headers they carry.
+func (s *Server) ProxyMiddleware(next http.Handler) http.Handler {
+	if len(s.TrustedProxies) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if peer, ok := parseHop(clientIP(r)); ok && s.TrustedProxies.contains(peer) {
+			if client := s.TrustedProxies.forwardedClient(r.Header.Values("X-Forwarded-For")); client != "" {
+				r.RemoteAddr = client
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
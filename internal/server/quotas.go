@@ -0,0 +1,346 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"my-kms/internal/auth"
+	"my-kms/internal/metrics"
+	"my-kms/internal/storage"
+)
+
+// Metered operations.
+const (
+	quotaOpGenerateDataKey = "generate-data-key"
+	quotaOpEncrypt         = "encrypt"
+	quotaOpDecrypt         = "decrypt"
+	quotaOpTokenize        = "tokenize"
+	quotaOpDeriveKey       = "derive-key"
+	quotaOpSignJWT         = "sign-jwt"
+)
+
+var quotaOperations = []string{quotaOpGenerateDataKey, quotaOpEncrypt, quotaOpDecrypt, quotaOpTokenize, quotaOpDeriveKey, quotaOpSignJWT}
+
+// Quota scopes and periods.
+const (
+	QuotaScopeKey      = "key"
+	QuotaScopeIdentity = "identity"
+
+	QuotaPeriodDay   = "day"
+	QuotaPeriodMonth = "month"
+)
+
+// How long counters are kept after their window closes, for reporting and chargeback.
+const (
+	dayUsageRetention   = 90 * 24 * time.Hour
+	monthUsageRetention = 400 * 24 * time.Hour
+)
+
+// Quota caps how often one key or identity may perform an operation per day or month.
+// Operation "*" covers every metered operation; a quota naming the operation wins.
+type Quota struct {
+	Scope     string `json:"scope"`
+	Operation string `json:"operation"`
+	Period    string `json:"period"`
+	Limit     int64  `json:"limit"`
+}
+
+func (q Quota) String() string {
+	return fmt.Sprintf("%s:%s=%d/%s", q.Scope, q.Operation, q.Limit, q.Period)
+}
+
+// ParseQuotas reads "scope:operation=N/period" pairs separated by commas, such as
+// "key:decrypt=10000/day,identity:*=1000000/month".
+func ParseQuotas(s string) ([]Quota, error) {
+	var quotas []Quota
+	seen := map[string]bool{}
+	for _, pair := range strings.Split(s, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		target, spec, ok := strings.Cut(pair, "=")
+		scope, op, ok2 := strings.Cut(strings.TrimSpace(target), ":")
+		countStr, period, ok3 := strings.Cut(strings.TrimSpace(spec), "/")
+		if !ok || !ok2 || !ok3 {
+			return nil, fmt.Errorf("invalid quota %q; expected scope:operation=N/day or N/month", pair)
+		}
+		q := Quota{Scope: scope, Operation: op, Period: period}
+		if q.Scope != QuotaScopeKey && q.Scope != QuotaScopeIdentity {
+			return nil, fmt.Errorf("quota %q: scope must be key or identity", pair)
+		}
+		if q.Operation != "*" && !validQuotaOperation(q.Operation) {
+			return nil, fmt.Errorf("quota %q: operation must be one of %s or *", pair, strings.Join(quotaOperations, ", "))
+		}
+		if q.Period != QuotaPeriodDay && q.Period != QuotaPeriodMonth {
+			return nil, fmt.Errorf("quota %q: period must be day or month", pair)
+		}
+		n, err := strconv.ParseInt(countStr, 10, 64)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("quota %q: limit must be a positive integer", pair)
+		}
+		q.Limit = n
+		key := q.Scope + ":" + q.Operation + "/" + q.Period
+		if seen[key] {
+			return nil, fmt.Errorf("quota %s is given twice", key)
+		}
+		seen[key] = true
+		quotas = append(quotas, q)
+	}
+	return quotas, nil
+}
+
+func validQuotaOperation(op string) bool {
+	for _, known := range quotaOperations {
+		if op == known {
+			return true
+		}
+	}
+	return false
+}
+
+// Quotas counts metered operations per key and per identity, and enforces Limits.
+type Quotas struct {
+	Store  *storage.MongoUsageStore
+	Limits []Quota
+
+	// mu guards Limits once the server is running; see SetLimits.
+	mu sync.RWMutex
+}
+
+// SetLimits replaces the quotas of a running server.
+func (qs *Quotas) SetLimits(limits []Quota) {
+	qs.mu.Lock()
+	defer qs.mu.Unlock()
+	qs.Limits = limits
+}
+
+func (qs *Quotas) limits() []Quota {
+	qs.mu.RLock()
+	defer qs.mu.RUnlock()
+	return qs.Limits
+}
+
+// limit returns the quota for scope, operation and period, zero if there is none.
+func (qs *Quotas) limit(scope, op, period string) int64 {
+	var wildcard int64
+	for _, q := range qs.limits() {
+		if q.Scope != scope || q.Period != period {
+			continue
+		}
+		switch q.Operation {
+		case op:
+			return q.Limit
+		case "*":
+			wildcard = q.Limit
+		}
+	}
+	return wildcard
+}
+
+// usageWindow returns the window containing t for period and when it ends.
+func usageWindow(period string, t time.Time) (string, time.Time) {
+	t = t.UTC()
+	if period == QuotaPeriodDay {
+		return t.Format("2006-01-02"), time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, time.UTC)
+	}
+	return t.Format("2006-01"), time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+}
+
+// meteredCounter is a counter one request increments, with its quota.
+type meteredCounter struct {
+	counter storage.UsageCounter
+	limit   int64
+	resets  time.Time
+}
+
+func (qs *Quotas) counters(tenantID, identity, dekID, op string, now time.Time) []meteredCounter {
+	subjects := []struct{ scope, subject string }{{QuotaScopeIdentity, identity}}
+	if dekID != "" {
+		subjects = append([]struct{ scope, subject string }{{QuotaScopeKey, dekID}}, subjects...)
+	}
+	var limited, unlimited []meteredCounter
+	for _, sub := range subjects {
+		for _, period := range []string{QuotaPeriodDay, QuotaPeriodMonth} {
+			window, resets := usageWindow(period, now)
+			retention := dayUsageRetention
+			if period == QuotaPeriodMonth {
+				retention = monthUsageRetention
+			}
+			mc := meteredCounter{
+				counter: storage.UsageCounter{
+					ID:        strings.Join([]string{tenantID, sub.scope, sub.subject, op, window}, "|"),
+					TenantID:  tenantID,
+					Scope:     sub.scope,
+					Subject:   sub.subject,
+					Operation: op,
+					Period:    period,
+					Window:    window,
+					ExpiresAt: resets.Add(retention),
+				},
+				limit:  qs.limit(sub.scope, op, period),
+				resets: resets,
+			}
+			if mc.limit > 0 {
+				limited = append(limited, mc)
+			} else {
+				unlimited = append(unlimited, mc)
+			}
+		}
+	}
+	// Limited counters go first so a rejection has as little as possible to undo.
+	return append(limited, unlimited...)
+}
+
+// meterUsage counts op by identity on dekID (empty for operations without a key yet)
+// and returns false, having written a 429 (or a 503 when usage can't be recorded and
+// quotas fail closed), if that would exceed a quota. With dryRun the quotas are only
+// checked. With enforce false the operation is counted but never refused.
+func (s *Server) meterUsage(w http.ResponseWriter, r *http.Request, identity auth.Identity, dekID, op string, dryRun, enforce bool) bool {
+	qs := s.Quotas
+	if qs == nil {
+		return true
+	}
+	ctx := r.Context()
+	counters := qs.counters(identity.Tenant, identity.Name, dekID, op, time.Now())
+
+	var done []string
+	undo := func() {
+		for _, id := range done {
+			if err := qs.Store.Decrement(context.WithoutCancel(ctx), id); err != nil {
+				errorf(ctx, "Failed to roll back usage counter: %v", err)
+			}
+		}
+	}
+	for _, mc := range counters {
+		limit := mc.limit
+		if !enforce {
+			limit = 0
+		}
+		var err error
+		switch {
+		case dryRun && limit > 0:
+			var count int64
+			if count, err = qs.Store.Count(ctx, mc.counter.ID); err == nil && count >= limit {
+				err = storage.ErrQuotaExceeded
+			}
+		case dryRun:
+			continue
+		default:
+			err = qs.Store.Increment(ctx, mc.counter, limit)
+		}
+
+		if errors.Is(err, storage.ErrQuotaExceeded) {
+			undo()
+			c := mc.counter
+			metrics.QuotaExceeded.Inc(c.Operation, c.Scope, c.Period)
+			warnf(ctx, "Quota exceeded: %s %s on %s %s (%d/%s)", identity.Name, c.Operation, c.Scope, c.Subject, limit, c.Period)
+			auditf(ctx, "Quota exceeded: %s %s limit %d per %s", c.Scope, c.Operation, limit, c.Period)
+			w.Header().Set("Retry-After", strconv.Itoa(int(time.Until(mc.resets).Seconds())+1))
+			w.Header().Set("X-Quota-Reset", mc.resets.Format(time.RFC3339))
+			http.Error(w, fmt.Sprintf("%s quota exceeded: at most %d %s calls per %s", c.Scope, limit, c.Operation, c.Period), http.StatusTooManyRequests)
+			return false
+		}
+		if err != nil {
+			if s.failOpen(ctx, SubsystemQuotas, err) {
+				return true
+			}
+			undo()
+			errorf(ctx, "Failed to record usage: %v", err)
+			http.Error(w, "usage metering unavailable", http.StatusServiceUnavailable)
+			return false
+		}
+		done = append(done, mc.counter.ID)
+	}
+	return true
+}
+
+// ---------------------------------------------------------------------
+// Usage report
+// ---------------------------------------------------------------------
+
+// UsageEntry is a counter with the quota that applies to it.
+type UsageEntry struct {
+	storage.UsageCounter
+	Limit    int64      `json:"limit,omitempty"`
+	ResetsAt *time.Time `json:"resetsAt,omitempty"` // for the current window only
+}
+
+type UsageResponse struct {
+	Usage  []UsageEntry `json:"usage"`
+	Quotas []Quota      `json:"quotas"`
+}
+
+// UsageHandler reports operation counts for chargeback and quota monitoring. Filters:
+// scope, subject, operation, period, window (e.g. 2026-10 or 2026-10-14) and limit;
+// platform auditors may also pass tenant.
+func (s *Server) UsageHandler(w http.ResponseWriter, r *http.Request) {
+	identity, err := getIdentity(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	if err := auth.IsAuthorized(identity, auth.ActionViewUsage); err != nil {
+		warnf(r.Context(), "Unauthorized attempt by role=%s to view usage", identity.Role)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	if s.Quotas == nil {
+		http.Error(w, "usage metering is not enabled", http.StatusNotFound)
+		return
+	}
+
+	query := r.URL.Query()
+	q := storage.UsageQuery{
+		TenantID:  identity.Tenant,
+		Scope:     query.Get("scope"),
+		Subject:   query.Get("subject"),
+		Operation: query.Get("operation"),
+		Period:    query.Get("period"),
+		Window:    query.Get("window"),
+		Limit:     defaultListLimit,
+	}
+	if identity.Tenant == "" {
+		if t := query.Get("tenant"); t != "" {
+			q.TenantID = t
+		} else {
+			q.AllTenants = true
+		}
+	}
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			http.Error(w, "limit must be a positive integer", http.StatusBadRequest)
+			return
+		}
+		q.Limit = int64(min(n, maxListLimit))
+	}
+
+	counters, err := s.Quotas.Store.QueryUsage(r.Context(), q)
+	if err != nil {
+		errorf(r.Context(), "Failed to query usage: %v", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	now := time.Now()
+	resp := UsageResponse{Usage: make([]UsageEntry, 0, len(counters)), Quotas: s.Quotas.limits()}
+	if resp.Quotas == nil {
+		resp.Quotas = []Quota{}
+	}
+	for _, c := range counters {
+		e := UsageEntry{UsageCounter: c, Limit: s.Quotas.limit(c.Scope, c.Operation, c.Period)}
+		if window, resets := usageWindow(c.Period, now); window == c.Window {
+			e.ResetsAt = &resets
+		}
+		resp.Usage = append(resp.Usage, e)
+	}
+	writeJSON(w, resp)
+}
@@ -0,0 +1,129 @@
+package server
+
+import (
+	"context"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"my-kms/internal/metrics"
+	"my-kms/internal/ratelimit"
+)
+
+// RateLimits configures per-IP and per-identity token buckets.
+type RateLimits struct {
+	Limiter ratelimit.Limiter
+
+	// Fallback takes over, per instance, when Limiter is unavailable and the
+	// rate-limiter subsystem fails open.
+	Fallback *ratelimit.Memory
+
+	// IP applies to every rate-limited request from one client address, before
+	// authentication, so floods of bad credentials are throttled too.
+	IP ratelimit.Limit
+
+	// Identity applies per identity and endpoint unless Endpoints overrides it.
+	Identity  ratelimit.Limit
+	Endpoints map[string]ratelimit.Limit
+
+	// mu guards the limits once the server is running; see SetLimits.
+	mu sync.RWMutex
+}
+
+// SetLimits replaces the limits of a running server.
+func (rl *RateLimits) SetLimits(ip, identity ratelimit.Limit, endpoints map[string]ratelimit.Limit) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	rl.IP, rl.Identity, rl.Endpoints = ip, identity, endpoints
+}
+
+// ipLimit returns the per-IP limit.
+func (rl *RateLimits) ipLimit() ratelimit.Limit {
+	rl.mu.RLock()
+	defer rl.mu.RUnlock()
+	return rl.IP
+}
+
+// endpointLimit returns the per-identity limit for path.
+func (rl *RateLimits) endpointLimit(path string) ratelimit.Limit {
+	rl.mu.RLock()
+	defer rl.mu.RUnlock()
+	if l, ok := rl.Endpoints[path]; ok {
+		return l
+	}
+	return rl.Identity
+}
+
+// rateLimitTimeout bounds a call to a remote limiter.
+const rateLimitTimeout = 250 * time.Millisecond
+
+// RateLimitMiddleware applies the per-IP limit. The per-identity limit is applied by
+// firebaseAuthMiddleware once the caller is known.
+func (s *Server) RateLimitMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if rl := s.RateLimits; rl != nil && !s.allowRate(w, r, "ip", "ip:"+clientIP(r), rl.ipLimit()) {
+			return
+		}
+		next.ServeHTTP(w, r)
+	}
+}
+
+// identityRateLimit applies the caller's per-endpoint limit.
+func (s *Server) identityRateLimit(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rl := s.RateLimits
+		if rl == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		identity, err := getIdentity(r)
+		if err != nil {
+			http.Error(w, ErrNoIdentity.Error(), http.StatusUnauthorized)
+			return
+		}
+		key := "id:" + identity.Tenant + ":" + identity.Name + ":" + r.URL.Path
+		if s.allowRate(w, r, "identity", key, rl.endpointLimit(r.URL.Path)) {
+			next.ServeHTTP(w, r)
+		}
+	}
+}
+
+// allowRate takes a token for key, or writes a 429 with Retry-After (or a 503 when the
+// limiter is down and fails closed) and returns false.
+func (s *Server) allowRate(w http.ResponseWriter, r *http.Request, scope, key string, l ratelimit.Limit) bool {
+	if l.Unlimited() {
+		return true
+	}
+	rl := s.RateLimits
+	ctx, cancel := context.WithTimeout(r.Context(), rateLimitTimeout)
+	ok, wait, err := rl.Limiter.Allow(ctx, key, l)
+	cancel()
+	if err != nil {
+		if !s.failOpen(r.Context(), SubsystemRateLimiter, err) || rl.Fallback == nil {
+			errorf(r.Context(), "Rate limiter unavailable: %v", err)
+			http.Error(w, "rate limiter unavailable", http.StatusServiceUnavailable)
+			return false
+		}
+		ok, wait, _ = rl.Fallback.Allow(r.Context(), key, l)
+	}
+	if ok {
+		return true
+	}
+
+	metrics.RateLimited.Inc(r.URL.Path, scope)
+	warnf(r.Context(), "Rate limit (%s, %s) exceeded on %s by %s", scope, l, r.URL.Path, r.RemoteAddr)
+	w.Header().Set("Retry-After", strconv.Itoa(max(1, int(math.Ceil(wait.Seconds())))))
+	http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
+	return false
+}
+
+// clientIP returns the host part of the connection's remote address.
+func clientIP(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
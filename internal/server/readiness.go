@@ -0,0 +1,248 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// WarmupStep is one piece of start-up work that must succeed before the server
+// reports ready.
+type WarmupStep struct {
+	Name string
+	Run  func(ctx context.Context) error
+}
+
+// WarmupStatus reports the outcome of a warm-up step.
+type WarmupStatus struct {
+	Name     string `json:"name"`
+	Done     bool   `json:"done"`
+	Attempts int    `json:"attempts"`
+	Error    string `json:"error,omitempty"`
+}
+
+// CheckStatus reports the latest result of a dependency check.
+type CheckStatus struct {
+	Name                string    `json:"name"`
+	OK                  bool      `json:"ok"`
+	Error               string    `json:"error,omitempty"`
+	CheckedAt           time.Time `json:"checked_at,omitempty"`
+	ConsecutiveFailures int       `json:"consecutive_failures,omitempty"`
+}
+
+// Readiness tracks warm-up progress and dependency health for /readyz.
+type Readiness struct {
+	mu     sync.RWMutex
+	steps  []WarmupStatus
+	ready  bool
+	checks []CheckStatus
+}
+
+// Ready reports whether every warm-up step has succeeded and every dependency check
+// last passed.
+func (rd *Readiness) Ready() bool {
+	rd.mu.RLock()
+	defer rd.mu.RUnlock()
+	return rd.ready && checksOK(rd.checks)
+}
+
+func (rd *Readiness) snapshot() (bool, []WarmupStatus, []CheckStatus) {
+	rd.mu.RLock()
+	defer rd.mu.RUnlock()
+	return rd.ready && checksOK(rd.checks), append([]WarmupStatus(nil), rd.steps...), append([]CheckStatus(nil), rd.checks...)
+}
+
+func checksOK(checks []CheckStatus) bool {
+	for _, c := range checks {
+		if !c.OK {
+			return false
+		}
+	}
+	return true
+}
+
+func (rd *Readiness) update(i int, f func(*WarmupStatus)) {
+	rd.mu.Lock()
+	defer rd.mu.Unlock()
+	f(&rd.steps[i])
+}
+
+// RunWarmup runs steps in order, retrying a failing step every retry until it succeeds
+// or ctx is cancelled, and marks the server ready once all have passed.
+func (s *Server) RunWarmup(ctx context.Context, steps []WarmupStep, retry time.Duration) {
+	rd := s.Readiness
+	rd.mu.Lock()
+	rd.steps = make([]WarmupStatus, len(steps))
+	for i, step := range steps {
+		rd.steps[i].Name = step.Name
+	}
+	rd.mu.Unlock()
+
+	start := time.Now()
+	for i, step := range steps {
+		for {
+			stepStart := time.Now()
+			err := step.Run(ctx)
+			rd.update(i, func(st *WarmupStatus) {
+				st.Attempts++
+				st.Done = err == nil
+				st.Error = ""
+				if err != nil {
+					st.Error = err.Error()
+				}
+			})
+			if err == nil {
+				logf(ctx, "Warm-up %s done in %s", step.Name, time.Since(stepStart).Round(time.Millisecond))
+				break
+			}
+			warnf(ctx, "Warm-up %s failed, retrying in %s: %v", step.Name, retry, err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(retry):
+			}
+		}
+	}
+
+	rd.mu.Lock()
+	rd.ready = true
+	rd.mu.Unlock()
+	logf(ctx, "Warm-up complete in %s, server is ready", time.Since(start).Round(time.Millisecond))
+}
+
+// ---------------------------------------------------------------------
+// Dependency Checks
+// ---------------------------------------------------------------------
+
+// RunHealthChecks runs checks every interval until ctx is cancelled, all at once so a
+// slow dependency does not hold up the others. /readyz serves the latest results
+// rather than probing on every request, so probe traffic never reaches Mongo or
+// Firebase. Until the first round completes every check counts as failing.
+func (s *Server) RunHealthChecks(ctx context.Context, checks []WarmupStep, interval time.Duration) {
+	rd := s.Readiness
+	rd.mu.Lock()
+	rd.checks = make([]CheckStatus, len(checks))
+	for i, check := range checks {
+		rd.checks[i].Name = check.Name
+	}
+	rd.mu.Unlock()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		var wg sync.WaitGroup
+		for i, check := range checks {
+			wg.Add(1)
+			go func(i int, check WarmupStep) {
+				defer wg.Done()
+				err := check.Run(ctx)
+				if ctx.Err() != nil {
+					return
+				}
+				rd.mu.Lock()
+				st := &rd.checks[i]
+				wasOK := st.OK || st.CheckedAt.IsZero()
+				st.CheckedAt = time.Now().UTC()
+				st.OK = err == nil
+				st.Error = ""
+				if err != nil {
+					st.Error = err.Error()
+					st.ConsecutiveFailures++
+				} else {
+					st.ConsecutiveFailures = 0
+				}
+				rd.mu.Unlock()
+
+				switch {
+				case err != nil && wasOK:
+					errorf(ctx, "Health check %s failing, reporting not ready: %v", check.Name, err)
+				case err == nil && !wasOK:
+					logf(ctx, "Health check %s recovered", check.Name)
+				}
+			}(i, check)
+		}
+		wg.Wait()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// ---------------------------------------------------------------------
+// Healthz / Readyz
+// ---------------------------------------------------------------------
+
+type HealthzResponse struct {
+	Status string `json:"status"`
+}
+
+// HealthzHandler is the unauthenticated liveness probe. It touches no dependency: a
+// Mongo or Firebase outage should take the node out of rotation (/readyz), not get the
+// process restarted.
+func (s *Server) HealthzHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, HealthzResponse{Status: "ok"})
+}
+
+type ReadyzResponse struct {
+	Ready  bool           `json:"ready"`
+	Steps  []WarmupStatus `json:"steps"`
+	Checks []CheckStatus  `json:"checks,omitempty"`
+}
+
+// ReadyzHandler is unauthenticated for load balancers: 200 once warm-up has finished
+// and every dependency check last passed, 503 with per-step and per-check status
+// otherwise.
+func (s *Server) ReadyzHandler(w http.ResponseWriter, r *http.Request) {
+	ready, steps, checks := s.Readiness.snapshot()
+	if !ready {
+		w.Header().Set("Retry-After", "1")
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	writeJSON(w, ReadyzResponse{Ready: ready, Steps: steps, Checks: checks})
+}
+
+// ---------------------------------------------------------------------
+// Helper Functions
+// ---------------------------------------------------------------------
+
+// PingStep wraps a store's Ping as a warm-up step or dependency check. name carries
+// the backend, e.g. "mongo:aliases".
+func PingStep(name string, ping func(context.Context) error) WarmupStep {
+	return WarmupStep{Name: name, Run: func(ctx context.Context) error {
+		ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		defer cancel()
+		return ping(ctx)
+	}}
+}
+
+// firebaseCertsURL serves the public keys Firebase ID tokens are signed with.
+const firebaseCertsURL = "https://www.googleapis.com/robot/v1/metadata/x509/securetoken@system.gserviceaccount.com"
+
+// FirebaseKeysStep checks that the token signing keys can be fetched, so the first
+// real token verification is not the one to discover an egress problem, and so a node
+// that loses its route to Google stops taking traffic.
+func FirebaseKeysStep() WarmupStep {
+	return WarmupStep{Name: "firebase-keys", Run: func(ctx context.Context) error {
+		ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		defer cancel()
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, firebaseCertsURL, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("fetching Firebase keys returned %s", resp.Status)
+		}
+		return nil
+	}}
+}
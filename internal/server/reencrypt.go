@@ -0,0 +1,290 @@
+package server
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"my-kms/internal/auth"
+	"my-kms/internal/crypto"
+	"my-kms/internal/secmem"
+	"my-kms/internal/storage"
+)
+
+// ---------------------------------------------------------------------
+// Re-encrypt
+// ---------------------------------------------------------------------
+
+type ReEncryptRequest struct {
+	SourceDEKID             string            `json:"sourceDEKID"`
+	SourceAlias             string            `json:"sourceAlias,omitempty"` // alternative to sourceDEKID
+	Ciphertext              string            `json:"ciphertext"`            // base64, or a JWE
+	SourceEncryptionContext map[string]string `json:"sourceEncryptionContext,omitempty"`
+
+	DestinationDEKID             string            `json:"destinationDEKID"`
+	DestinationAlias             string            `json:"destinationAlias,omitempty"` // alternative to destinationDEKID
+	DestinationEncryptionContext map[string]string `json:"destinationEncryptionContext,omitempty"`
+	DestinationFormat            string            `json:"destinationFormat,omitempty"` // "jwe" for a JWE; base64 otherwise
+
+	// DestinationDeterministic must be set, and is only accepted, for a deterministic
+	// destination key, as deterministic is for /encrypt.
+	DestinationDeterministic bool `json:"destinationDeterministic,omitempty"`
+
+	ValidateOnly bool `json:"validateOnly,omitempty"`
+}
+
+type ReEncryptResponse struct {
+	Ciphertext  string `json:"ciphertext"` // base64, or the JWE with destinationFormat jwe
+	SourceDEKID string `json:"sourceDEKID"`
+	DEKID       string `json:"dekID"` // the destination key, resolved when an alias was given
+}
+
+// reEncryptKey is one side of a re-encryption, loaded and checked.
+type reEncryptKey struct {
+	dekID string
+	alias *storage.Alias
+	doc   *storage.DEKDocument
+	alg   crypto.Algorithm
+	aad   []byte
+}
+
+// ReEncryptHandler decrypts a ciphertext and encrypts it under another key in one call,
+// like AWS KMS ReEncrypt. The plaintext never leaves the server. The caller needs both
+// DECRYPT on the source and ENCRYPT on the destination, by role or by grant, and both
+// key policies must allow it.
+func (s *Server) ReEncryptHandler(w http.ResponseWriter, r *http.Request) {
+	identity, err := getIdentity(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	// Without the roles grants on the keys may still allow the call; checked once the keys are loaded.
+	decryptRoleErr := auth.IsAuthorized(identity, auth.ActionDecrypt)
+	encryptRoleErr := auth.IsAuthorized(identity, auth.ActionEncrypt)
+	if s.Grants == nil {
+		for _, roleErr := range []error{decryptRoleErr, encryptRoleErr} {
+			if roleErr != nil {
+				warnf(r.Context(), "Unauthorized attempt by role=%s to re-encrypt data", identity.Role)
+				http.Error(w, roleErr.Error(), http.StatusForbidden)
+				return
+			}
+		}
+	}
+
+	var req ReEncryptRequest
+	if !decodeJSON(w, http.MaxBytesReader(w, r.Body, s.MaxPayloadBytes*2), &req) {
+		return
+	}
+	if err := validCiphertextFormat(req.DestinationFormat); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	for _, encCtx := range []map[string]string{req.SourceEncryptionContext, req.DestinationEncryptionContext} {
+		if err := crypto.ValidateEncryptionContext(encCtx); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	jwe, err := readJWE(&DecryptRequest{Ciphertext: req.Ciphertext}, nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	src, status, err := s.loadReEncryptKey(r, identity, req.SourceDEKID, req.SourceAlias, keyOpDecrypt, decryptRoleErr, req.SourceEncryptionContext)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	dst, status, err := s.loadReEncryptKey(r, identity, req.DestinationDEKID, req.DestinationAlias, keyOpEncrypt, encryptRoleErr, req.DestinationEncryptionContext)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	if jwe != nil {
+		if err := checkJWE(jwe, src.dekID, src.alg, src.aad); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if err := checkKeyScheme(src.doc, ciphertextScheme(src.alg, jwe != nil)); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if err := checkKeyScheme(dst.doc, ciphertextScheme(dst.alg, req.DestinationFormat == ciphertextFormatJWE)); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if err := checkDeterministicRequest(dst.alg, req.DestinationDeterministic); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var jweHeader crypto.JWEHeader
+	if req.DestinationFormat == ciphertextFormatJWE {
+		if jweHeader, err = crypto.NewJWEHeader(dst.alg, dst.dekID, jweContextHash(dst.aad)); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if err := authorizeDeterministic(identity, dst.alg); err != nil {
+		warnf(r.Context(), "Unauthorized attempt by role=%s to encrypt deterministically", identity.Role)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	// Moving off a deprecated source is the point, so only the destination is signalled.
+	signalKeyDeprecation(w, r, dst.doc)
+
+	var ciphertextBytes []byte
+	if jwe != nil {
+		ciphertextBytes = jwe.Ciphertext
+	} else if ciphertextBytes, err = base64.StdEncoding.DecodeString(req.Ciphertext); err != nil {
+		http.Error(w, "invalid base64 ciphertext", http.StatusBadRequest)
+		return
+	}
+	if int64(len(ciphertextBytes)) > s.MaxPayloadBytes+int64(src.alg.Overhead()) {
+		http.Error(w, fmt.Sprintf("ciphertext exceeds the %d byte limit", s.MaxPayloadBytes), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if !s.meterUsage(w, r, identity, src.dekID, quotaOpDecrypt, req.ValidateOnly, true) ||
+		!s.meterUsage(w, r, identity, dst.dekID, quotaOpEncrypt, req.ValidateOnly, true) {
+		return
+	}
+
+	if req.ValidateOnly {
+		plaintextSize := len(ciphertextBytes) - src.alg.Overhead()
+		if jwe != nil {
+			plaintextSize = len(jwe.Ciphertext)
+		}
+		if plaintextSize < 0 {
+			http.Error(w, "ciphertext too short", http.StatusBadRequest)
+			return
+		}
+		if !s.canUnwrap(r, src.doc) || !s.canUnwrap(r, dst.doc) {
+			http.Error(w, "failed to unwrap DEK", http.StatusInternalServerError)
+			return
+		}
+		expected := plaintextSize + dst.alg.Overhead()
+		if req.DestinationFormat == ciphertextFormatJWE {
+			expected = crypto.JWELength(jweHeader, plaintextSize)
+		}
+		writeJSON(w, ValidationResponse{
+			ValidateOnly:        true,
+			Operation:           "re-encrypt",
+			DEKID:               dst.dekID,
+			Algorithm:           dst.alg,
+			KeyState:            dst.doc.EffectiveState(),
+			InputBytes:          len(ciphertextBytes),
+			ExpectedOutputBytes: expected,
+		})
+		return
+	}
+
+	srcKey, err := s.unwrapDEK(r, src.doc)
+	if err != nil {
+		errorf(r.Context(), "Failed to decrypt DEK: %v", err)
+		http.Error(w, "failed to unwrap DEK", http.StatusInternalServerError)
+		return
+	}
+	defer secmem.Zero(srcKey)
+
+	endCrypto := traceCrypto(r, "decrypt", src.alg)
+	var plaintext []byte
+	if jwe != nil {
+		plaintext, err = crypto.OpenJWE(src.alg, srcKey, jwe)
+	} else {
+		plaintext, err = crypto.Decrypt(src.alg, srcKey, ciphertextBytes, src.aad)
+	}
+	endCrypto(err)
+	if err != nil {
+		errorf(r.Context(), "Failed to decrypt data: %v", err)
+		http.Error(w, "decryption failed", http.StatusInternalServerError)
+		return
+	}
+	defer secmem.Zero(plaintext)
+	s.touchDEK(r, identity.Tenant, src.dekID)
+
+	// Transformers and the DLP scan run as they would for /decrypt followed by /encrypt.
+	plaintext, err = s.afterDecrypt(r, identity, src.dekID, src.alias, plaintext)
+	if err != nil {
+		warnf(r.Context(), "Payload rejected after decryption: %v", err)
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	if int64(len(plaintext)) > s.MaxPayloadBytes {
+		http.Error(w, fmt.Sprintf("plaintext exceeds the %d byte limit", s.MaxPayloadBytes), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err := checkPayloadSize(dst.doc, len(plaintext)); err != nil {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	plaintext, err = s.beforeEncrypt(r, identity, dst.dekID, dst.alias, plaintext)
+	if err != nil {
+		warnf(r.Context(), "Payload rejected before encryption: %v", err)
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+
+	if !s.reserveEncryptions(w, r, dst.dekID, dst.alg, 1) {
+		return
+	}
+	dstKey, err := s.unwrapDEK(r, dst.doc)
+	if err != nil {
+		errorf(r.Context(), "Failed to decrypt DEK: %v", err)
+		http.Error(w, "failed to unwrap DEK", http.StatusInternalServerError)
+		return
+	}
+	defer secmem.Zero(dstKey)
+
+	endCrypto = traceCrypto(r, "encrypt", dst.alg)
+	var ciphertext string
+	if req.DestinationFormat == ciphertextFormatJWE {
+		ciphertext, err = crypto.SealJWE(dst.alg, dstKey, jweHeader, plaintext)
+	} else {
+		var sealed []byte
+		sealed, err = crypto.Encrypt(dst.alg, dstKey, plaintext, dst.aad)
+		ciphertext = base64.StdEncoding.EncodeToString(sealed)
+	}
+	endCrypto(err)
+	if err != nil {
+		errorf(r.Context(), "Failed to encrypt data: %v", err)
+		http.Error(w, "encryption failed", http.StatusInternalServerError)
+		return
+	}
+	s.touchDEK(r, identity.Tenant, dst.dekID)
+	auditf(r.Context(), "Ciphertext re-encrypted from DEK %s to DEK %s by %s", src.dekID, dst.dekID, identity.Name)
+
+	writeJSON(w, ReEncryptResponse{Ciphertext: ciphertext, SourceDEKID: src.dekID, DEKID: dst.dekID})
+}
+
+// loadReEncryptKey resolves and checks one key of a re-encryption, returning the HTTP
+// status to fail with.
+func (s *Server) loadReEncryptKey(r *http.Request, identity auth.Identity, dekID, aliasName string, op keyOperation, roleErr error, encCtx map[string]string) (*reEncryptKey, int, error) {
+	dekID, alias, err := s.resolveKey(r, identity.Tenant, dekID, aliasName)
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	dekDoc, err := s.DEKStore.GetDEK(r.Context(), identity.Tenant, dekID)
+	if err != nil {
+		errorf(r.Context(), "Failed to get DEK: %v", err)
+		return nil, http.StatusBadRequest, errors.New("DEK not found")
+	}
+	if err := s.authorizeKeyUse(r, identity, dekDoc, op, roleErr, encCtx); err != nil {
+		warnf(r.Context(), "Unauthorized attempt by role=%s to re-encrypt data", identity.Role)
+		return nil, http.StatusForbidden, err
+	}
+	aad, err := crypto.EncryptionContextAAD(encCtx)
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	if err := checkKeyUsable(dekDoc); err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	alg, err := s.keyAlgorithm(dekDoc)
+	if err != nil {
+		return nil, http.StatusForbidden, err
+	}
+	return &reEncryptKey{dekID: dekID, alias: alias, doc: dekDoc, alg: alg, aad: aad}, 0, nil
+}
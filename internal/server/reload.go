@@ -0,0 +1,69 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"my-kms/internal/auth"
+)
+
+// errReloadUnsupported is returned by ReloadConfig when no Reload hook is installed.
+var errReloadUnsupported = errors.New("configuration reload is not enabled")
+
+// ReloadConfig runs the Reload hook, one reload at a time, and writes the outcome to
+// the audit log. by names who asked for it.
+func (s *Server) ReloadConfig(ctx context.Context, by string) error {
+	if s.Reload == nil {
+		return errReloadUnsupported
+	}
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+	if err := s.Reload(ctx); err != nil {
+		s.auditReload(ctx, "configuration reload requested by %s failed: %v", by, err)
+		return err
+	}
+	s.auditReload(ctx, "configuration reloaded by %s", by)
+	return nil
+}
+
+// auditReload records a reload with the request that asked for it, or as a system
+// event for SIGHUP.
+func (s *Server) auditReload(ctx context.Context, format string, args ...interface{}) {
+	if auditRecordFrom(ctx) != nil {
+		auditf(ctx, format, args...)
+		return
+	}
+	s.auditSystem("reload-config", "", "", format, args...)
+}
+
+// ReloadConfigHandler reloads the configuration, as SIGHUP does. Settings are global,
+// so only platform admins may.
+func (s *Server) ReloadConfigHandler(w http.ResponseWriter, r *http.Request) {
+	identity, err := getIdentity(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	if err := auth.IsAuthorized(identity, auth.ActionReloadConfig); err != nil {
+		warnf(r.Context(), "Unauthorized attempt by role=%s to reload configuration", identity.Role)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if identity.Tenant != "" {
+		http.Error(w, "configuration spans every tenant; only platform admins may reload it", http.StatusForbidden)
+		return
+	}
+
+	if err := s.ReloadConfig(r.Context(), identity.Name); err != nil {
+		if errors.Is(err, errReloadUnsupported) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		errorf(r.Context(), "Configuration reload failed: %v", err)
+		http.Error(w, "reload failed: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, map[string]string{"status": "reloaded"})
+}
@@ -0,0 +1,26 @@
+package server
+
+import (
+	"context"
+	"time"
+
+	"my-kms/internal/storage"
+)
+
+// RunDEKReplication keeps r copying DEK changes to the other region until ctx is done,
+// restarting it retryInterval after each failure. Replication resumes where it stopped.
+func (s *Server) RunDEKReplication(ctx context.Context, r *storage.DEKReplicator, retryInterval time.Duration) {
+	for {
+		err := r.Run(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		errorf(ctx, "DEK replication stopped, retrying in %s: %v", retryInterval, err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(retryInterval):
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+
+	"my-kms/internal/logging"
+)
+
+// RequestIDHeader carries the request ID; a well-formed ID sent by the client is kept.
+const RequestIDHeader = "X-Request-ID"
+
+type requestIDKey struct{}
+
+// RequestIDFromContext returns the ID of the request ctx belongs to, or "".
+func RequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// RequestIDMiddleware gives every request an ID: the client's X-Request-ID when it is
+// well formed, otherwise a random one. The ID goes into the context, the response
+// headers, and the body of plain-text error responses, so a client can quote it.
+func RequestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID := r.Header.Get(RequestIDHeader)
+		if !validRequestID(requestID) {
+			requestID = newRequestID()
+		}
+		w.Header().Set(RequestIDHeader, requestID)
+
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, requestID)))
+
+		// http.Error writes "message\n" as text/plain; add the ID as a second line.
+		if rec.status >= 400 && strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain") {
+			fmt.Fprintf(w, "request ID: %s\n", requestID)
+		}
+	})
+}
+
+// logf, warnf and errorf log for the server component, tagged with the request ID and
+// trace ID of ctx when it has them.
+func logf(ctx context.Context, format string, args ...interface{}) {
+	logAt(ctx, slog.LevelInfo, format, args...)
+}
+
+func warnf(ctx context.Context, format string, args ...interface{}) {
+	logAt(ctx, slog.LevelWarn, format, args...)
+}
+
+func errorf(ctx context.Context, format string, args ...interface{}) {
+	logAt(ctx, slog.LevelError, format, args...)
+}
+
+func logAt(ctx context.Context, level slog.Level, format string, args ...interface{}) {
+	var attrs []slog.Attr
+	if id := RequestIDFromContext(ctx); id != "" {
+		attrs = append(attrs, slog.String("request_id", id))
+	}
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		attrs = append(attrs, slog.String("trace_id", sc.TraceID().String()))
+	}
+	logging.Logf(ctx, level, "server", attrs, format, args...)
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%d", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,97 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"my-kms/internal/auth"
+	"my-kms/internal/events"
+	"my-kms/internal/storage"
+)
+
+// ---------------------------------------------------------------------
+// Restore Data Key
+// ---------------------------------------------------------------------
+
+type RestoreDEKRequest struct {
+	DEKID string `json:"dekID" validate:"required"`
+}
+
+func (s *Server) RestoreDataKeyHandler(w http.ResponseWriter, r *http.Request) {
+	identity, err := getIdentity(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	if err := auth.IsAuthorized(identity, auth.ActionRestoreDataKey); err != nil {
+		warnf(r.Context(), "Unauthorized attempt by role=%s to restore DEK", identity.Role)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	var req RestoreDEKRequest
+	if !decodeJSON(w, r.Body, &req) {
+		return
+	}
+
+	if err := s.DEKStore.RestoreDEK(r.Context(), identity.Tenant, req.DEKID); err != nil {
+		errorf(r.Context(), "Failed to restore DEK: %v", err)
+		http.Error(w, "failed to restore DEK", http.StatusBadRequest)
+		return
+	}
+	auditf(r.Context(), "DEK %s restored by %s", req.DEKID, identity.Name)
+	s.publishEvent(r, events.KeyRestored, req.DEKID, nil)
+	if s.CiphertextLocations != nil {
+		if err := s.CiphertextLocations.ClearPending(r.Context(), identity.Tenant, req.DEKID, storage.ReencryptionReasonShredded); err != nil {
+			errorf(r.Context(), "Failed to clear pending ciphertext locations for DEK %s: %v", req.DEKID, err)
+		}
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ---------------------------------------------------------------------
+// Purge Job
+// ---------------------------------------------------------------------
+
+// RunPurgeJob permanently removes DEKs soft-deleted more than retention ago,
+// checking every interval until ctx is cancelled. A purge in progress is not cut short.
+func (s *Server) RunPurgeJob(ctx context.Context, interval, retention time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		s.withClusterLock(ctx, LockDEKPurge, func(ctx context.Context) {
+			s.purgeDeletedDEKs(context.WithoutCancel(ctx), retention)
+		})
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *Server) purgeDeletedDEKs(ctx context.Context, retention time.Duration) {
+	var held storage.HeldKeys
+	if s.LegalHolds != nil {
+		var err error
+		if held, err = s.LegalHolds.ActiveHolds(ctx); err != nil {
+			// Unless configured otherwise, never purge without knowing what is held.
+			if !s.failOpen(ctx, SubsystemLegalHolds, err) {
+				warnf(ctx, "DEK purge skipped, legal holds unavailable")
+				return
+			}
+		}
+	}
+
+	n, err := s.DEKStore.PurgeDeletedDEKs(ctx, time.Now().Add(-retention), held)
+	if err != nil {
+		errorf(ctx, "DEK purge failed: %v", err)
+	} else if n > 0 {
+		s.auditSystem("purge-job", "", "", "purged %d DEKs deleted more than %s ago", n, retention)
+	}
+}
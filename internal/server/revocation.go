@@ -0,0 +1,333 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	firebaseauth "firebase.google.com/go/auth"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"my-kms/internal/auth"
+	"my-kms/internal/storage"
+)
+
+// RevocationCheckingVerifier verifies ID tokens and also asks Firebase whether the
+// user's refresh tokens were revoked or the account disabled since the token was
+// issued. That costs a Firebase round trip per request.
+type RevocationCheckingVerifier struct {
+	Client *firebaseauth.Client
+}
+
+// VerifyIDToken verifies token and rejects it if it was revoked.
+func (v RevocationCheckingVerifier) VerifyIDToken(ctx context.Context, token string) (*firebaseauth.Token, error) {
+	return v.Client.VerifyIDTokenAndCheckRevoked(ctx, token)
+}
+
+// RevocationList holds the principals blocked by /revoke-principal, so authentication
+// can check them without a database read. It reloads from storage every refresh
+// interval to pick up revocations made on other instances; those made here apply at
+// once. With a nil store revocations live only in this process.
+type RevocationList struct {
+	store *storage.MongoRevocationStore
+
+	// writeMu keeps a reload from overwriting a revocation stored after it read.
+	writeMu sync.Mutex
+	mu      sync.RWMutex
+	active  []storage.Revocation
+}
+
+// NewRevocationList creates a list backed by store, which may be nil.
+func NewRevocationList(store *storage.MongoRevocationStore) *RevocationList {
+	return &RevocationList{store: store}
+}
+
+// Load replaces the list with the revocations in storage.
+func (l *RevocationList) Load(ctx context.Context) error {
+	if l.store == nil {
+		return nil
+	}
+	l.writeMu.Lock()
+	defer l.writeMu.Unlock()
+	revs, err := l.store.ActiveRevocations(ctx)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	l.active = revs
+	l.mu.Unlock()
+	return nil
+}
+
+// Run reloads the list every interval until ctx is cancelled. A failed reload keeps
+// the previous list, so known revocations stay in force during an outage.
+func (l *RevocationList) Run(ctx context.Context, interval time.Duration) {
+	if l.store == nil {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := l.Load(ctx); err != nil {
+				errorf(ctx, "Failed to reload revoked principals: %v", err)
+			}
+		}
+	}
+}
+
+// Revoke stores rev and adds it to the list.
+func (l *RevocationList) Revoke(ctx context.Context, rev storage.Revocation) (*storage.Revocation, error) {
+	l.writeMu.Lock()
+	defer l.writeMu.Unlock()
+	if l.store != nil {
+		stored, err := l.store.Revoke(ctx, rev)
+		if err != nil {
+			return nil, err
+		}
+		rev = *stored
+	} else {
+		rev.ID = primitive.NewObjectID()
+		rev.RevokedAt = time.Now().UTC()
+	}
+	l.mu.Lock()
+	l.active = append(l.active, rev)
+	l.mu.Unlock()
+	return &rev, nil
+}
+
+// Reinstate lifts the principal's revocations in tenant and reports whether there
+// were any.
+func (l *RevocationList) Reinstate(ctx context.Context, tenant, principal, by string) (bool, error) {
+	l.writeMu.Lock()
+	defer l.writeMu.Unlock()
+	found := false
+	if l.store != nil {
+		var err error
+		if found, err = l.store.Reinstate(ctx, tenant, principal, by); err != nil {
+			return false, err
+		}
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	kept := l.active[:0]
+	for _, rev := range l.active {
+		if rev.Principal == principal && rev.TenantID == tenant {
+			found = true
+			continue
+		}
+		kept = append(kept, rev)
+	}
+	l.active = kept
+	return found, nil
+}
+
+// Revoked returns the revocation in force against identity, if any: one in its tenant
+// or one made by a platform admin.
+func (l *RevocationList) Revoked(identity auth.Identity) (storage.Revocation, bool) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	for _, rev := range l.active {
+		if rev.Principal == identity.Name && (rev.TenantID == "" || rev.TenantID == identity.Tenant) {
+			return rev, true
+		}
+	}
+	return storage.Revocation{}, false
+}
+
+// List returns the revocations in force in tenant, or in every tenant if all is set.
+func (l *RevocationList) List(tenant string, all bool) []storage.Revocation {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	var revs []storage.Revocation
+	for _, rev := range l.active {
+		if all || rev.TenantID == tenant {
+			revs = append(revs, rev)
+		}
+	}
+	return revs
+}
+
+// rejectRevoked writes a 401 and returns true if identity has been revoked.
+func (s *Server) rejectRevoked(w http.ResponseWriter, r *http.Request, identity auth.Identity) bool {
+	if !s.isRevoked(r, identity) {
+		return false
+	}
+	http.Error(w, "Principal revoked", http.StatusUnauthorized)
+	return true
+}
+
+// isRevoked reports, and logs, whether identity has been revoked, for callers that
+// answer in another format than rejectRevoked.
+func (s *Server) isRevoked(r *http.Request, identity auth.Identity) bool {
+	if s.Revocations == nil {
+		return false
+	}
+	rev, ok := s.Revocations.Revoked(identity)
+	if !ok {
+		return false
+	}
+	warnf(r.Context(), "Refused request from revoked principal %s (revoked by %s at %s)", identity.Name, rev.RevokedBy, rev.RevokedAt.Format(time.RFC3339))
+	return true
+}
+
+// RevocationResponse is the public view of a revocation.
+type RevocationResponse struct {
+	Principal string    `json:"principal"`
+	TenantID  string    `json:"tenantID,omitempty"`
+	Reason    string    `json:"reason"`
+	RevokedBy string    `json:"revokedBy"`
+	RevokedAt time.Time `json:"revokedAt"`
+}
+
+func revocationResponse(rev storage.Revocation) RevocationResponse {
+	return RevocationResponse{
+		Principal: rev.Principal,
+		TenantID:  rev.TenantID,
+		Reason:    rev.Reason,
+		RevokedBy: rev.RevokedBy,
+		RevokedAt: rev.RevokedAt,
+	}
+}
+
+// ---------------------------------------------------------------------
+// Revoke Principal
+// ---------------------------------------------------------------------
+
+// RevokePrincipalRequest blocks principal in the caller's tenant, or in every tenant
+// when the caller is a platform admin.
+type RevokePrincipalRequest struct {
+	Principal string `json:"principal" validate:"required"`
+	Reason    string `json:"reason" validate:"required"`
+}
+
+func (s *Server) RevokePrincipalHandler(w http.ResponseWriter, r *http.Request) {
+	identity, err := getIdentity(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	if err := auth.IsAuthorized(identity, auth.ActionRevokePrincipal); err != nil {
+		warnf(r.Context(), "Unauthorized attempt by role=%s to revoke principal", identity.Role)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	var req RevokePrincipalRequest
+	if !decodeJSON(w, r.Body, &req) {
+		return
+	}
+	if req.Principal == identity.Name {
+		http.Error(w, "cannot revoke yourself", http.StatusBadRequest)
+		return
+	}
+
+	rev, err := s.Revocations.Revoke(r.Context(), storage.Revocation{
+		Principal: req.Principal,
+		TenantID:  identity.Tenant,
+		Reason:    req.Reason,
+		RevokedBy: identity.Name,
+	})
+	if err != nil {
+		errorf(r.Context(), "Failed to revoke principal %s: %v", req.Principal, err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	auditf(r.Context(), "principal %s revoked in %s by %s: %s", req.Principal, revocationScope(identity.Tenant), identity.Name, req.Reason)
+
+	writeJSON(w, revocationResponse(*rev))
+}
+
+// ---------------------------------------------------------------------
+// Reinstate Principal
+// ---------------------------------------------------------------------
+
+type ReinstatePrincipalRequest struct {
+	Principal string `json:"principal" validate:"required"`
+	TenantID  string `json:"tenantID,omitempty"` // platform admins only; defaults to the caller's tenant
+}
+
+func (s *Server) ReinstatePrincipalHandler(w http.ResponseWriter, r *http.Request) {
+	identity, err := getIdentity(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	if err := auth.IsAuthorized(identity, auth.ActionRevokePrincipal); err != nil {
+		warnf(r.Context(), "Unauthorized attempt by role=%s to reinstate principal", identity.Role)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	var req ReinstatePrincipalRequest
+	if !decodeJSON(w, r.Body, &req) {
+		return
+	}
+	tenant := identity.Tenant
+	if req.TenantID != "" && req.TenantID != identity.Tenant {
+		if identity.Tenant != "" {
+			http.Error(w, "only platform admins may reinstate principals in another tenant", http.StatusForbidden)
+			return
+		}
+		tenant = req.TenantID
+	}
+
+	found, err := s.Revocations.Reinstate(r.Context(), tenant, req.Principal, identity.Name)
+	if err != nil {
+		errorf(r.Context(), "Failed to reinstate principal %s: %v", req.Principal, err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		http.Error(w, "principal is not revoked", http.StatusNotFound)
+		return
+	}
+	auditf(r.Context(), "principal %s reinstated in %s by %s", req.Principal, revocationScope(tenant), identity.Name)
+
+	writeJSON(w, map[string]string{"status": "reinstated"})
+}
+
+// ---------------------------------------------------------------------
+// List Revoked Principals
+// ---------------------------------------------------------------------
+
+type ListRevokedPrincipalsResponse struct {
+	Revocations []RevocationResponse `json:"revocations"`
+}
+
+// ListRevokedPrincipalsHandler lists the revocations in force in the caller's tenant,
+// or in every tenant for platform admins.
+func (s *Server) ListRevokedPrincipalsHandler(w http.ResponseWriter, r *http.Request) {
+	identity, err := getIdentity(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	if err := auth.IsAuthorized(identity, auth.ActionRevokePrincipal); err != nil {
+		warnf(r.Context(), "Unauthorized attempt by role=%s to list revoked principals", identity.Role)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	revs := s.Revocations.List(identity.Tenant, identity.Tenant == "")
+	resp := ListRevokedPrincipalsResponse{Revocations: make([]RevocationResponse, 0, len(revs))}
+	for _, rev := range revs {
+		resp.Revocations = append(resp.Revocations, revocationResponse(rev))
+	}
+	writeJSON(w, resp)
+}
+
+func revocationScope(tenant string) string {
+	if tenant == "" {
+		return "every tenant"
+	}
+	return "tenant " + tenant
+}
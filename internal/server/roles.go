@@ -0,0 +1,213 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"my-kms/internal/auth"
+	"my-kms/internal/storage"
+)
+
+// ---------------------------------------------------------------------
+// Create / Update Role
+// ---------------------------------------------------------------------
+
+// RoleRequest defines or redefines a custom role.
+type RoleRequest struct {
+	Name        string   `json:"name"`
+	Actions     []string `json:"actions"`
+	Description string   `json:"description,omitempty"`
+}
+
+func (s *Server) CreateRoleHandler(w http.ResponseWriter, r *http.Request) {
+	s.putRole(w, r, "/create-role", s.UserStore.InsertRole)
+}
+
+func (s *Server) UpdateRoleHandler(w http.ResponseWriter, r *http.Request) {
+	s.putRole(w, r, "/update-role", s.UserStore.UpdateRole)
+}
+
+func (s *Server) putRole(w http.ResponseWriter, r *http.Request, path string, store func(context.Context, storage.RoleDefinition) error) {
+	identity, err := getIdentity(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	if err := auth.IsAuthorized(identity, auth.ActionManageRoles); err != nil {
+		warnf(r.Context(), "Unauthorized attempt by role=%s to define role", identity.Role)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	var req RoleRequest
+	if !decodeJSON(w, r.Body, &req) {
+		return
+	}
+	actions := make([]auth.Action, len(req.Actions))
+	for i, a := range req.Actions {
+		actions[i] = auth.Action(strings.ToUpper(a))
+	}
+	if err := auth.ValidateCustomRole(auth.Role(req.Name), actions); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// Nobody can hand out more than they hold themselves.
+	for _, a := range actions {
+		if err := auth.IsAuthorized(identity, a); err != nil {
+			http.Error(w, fmt.Sprintf("cannot grant %s: caller does not hold it", a), http.StatusForbidden)
+			return
+		}
+	}
+
+	role := storage.RoleDefinition{
+		Name:        req.Name,
+		Actions:     make([]string, len(actions)),
+		Description: req.Description,
+		UpdatedBy:   identity.Name,
+		UpdatedAt:   time.Now().UTC(),
+	}
+	for i, a := range actions {
+		role.Actions[i] = string(a)
+	}
+	if err := store(r.Context(), role); err != nil {
+		errorf(r.Context(), "Failed to store role: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := s.LoadCustomRoles(r.Context()); err != nil {
+		errorf(r.Context(), "Failed to reload custom roles: %v", err)
+	}
+	auditf(r.Context(), "role %s defined as %v by %s", role.Name, role.Actions, identity.Name)
+
+	writeJSON(w, role)
+}
+
+// ---------------------------------------------------------------------
+// List Roles
+// ---------------------------------------------------------------------
+
+type ListRolesResponse struct {
+	BuiltinRoles []auth.Role              `json:"builtinRoles"`
+	Roles        []storage.RoleDefinition `json:"roles"`
+}
+
+func (s *Server) ListRolesHandler(w http.ResponseWriter, r *http.Request) {
+	identity, err := getIdentity(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	if err := auth.IsAuthorized(identity, auth.ActionListRoles); err != nil {
+		warnf(r.Context(), "Unauthorized attempt by role=%s to list roles", identity.Role)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	roles, err := s.UserStore.ListRoles(r.Context())
+	if err != nil {
+		errorf(r.Context(), "Failed to list roles: %v", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, ListRolesResponse{
+		BuiltinRoles: []auth.Role{auth.RoleAdmin, auth.RoleService, auth.RoleAuditor},
+		Roles:        roles,
+	})
+}
+
+// ---------------------------------------------------------------------
+// Delete Role
+// ---------------------------------------------------------------------
+
+type DeleteRoleRequest struct {
+	Name string `json:"name"`
+}
+
+func (s *Server) DeleteRoleHandler(w http.ResponseWriter, r *http.Request) {
+	identity, err := getIdentity(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	if err := auth.IsAuthorized(identity, auth.ActionManageRoles); err != nil {
+		warnf(r.Context(), "Unauthorized attempt by role=%s to delete role", identity.Role)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	var req DeleteRoleRequest
+	if !decodeJSON(w, r.Body, &req) {
+		return
+	}
+
+	// Deleting a role in use would silently lock its users out.
+	n, err := s.UserStore.CountUsersWithRole(r.Context(), req.Name)
+	if err != nil {
+		errorf(r.Context(), "Failed to count users with role: %v", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	if n > 0 {
+		http.Error(w, fmt.Sprintf("role %s is assigned to %d users", req.Name, n), http.StatusConflict)
+		return
+	}
+
+	if err := s.UserStore.DeleteRole(r.Context(), req.Name); err != nil {
+		errorf(r.Context(), "Failed to delete role: %v", err)
+		http.Error(w, "role not found", http.StatusNotFound)
+		return
+	}
+	if err := s.LoadCustomRoles(r.Context()); err != nil {
+		errorf(r.Context(), "Failed to reload custom roles: %v", err)
+	}
+	auditf(r.Context(), "role %s deleted by %s", req.Name, identity.Name)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ---------------------------------------------------------------------
+// Role Reload
+// ---------------------------------------------------------------------
+
+// LoadCustomRoles installs the role definitions from the user store into the policy engine.
+func (s *Server) LoadCustomRoles(ctx context.Context) error {
+	defs, err := s.UserStore.ListRoles(ctx)
+	if err != nil {
+		return err
+	}
+	roles := make(map[auth.Role][]auth.Action, len(defs))
+	for _, d := range defs {
+		actions := make([]auth.Action, len(d.Actions))
+		for i, a := range d.Actions {
+			actions[i] = auth.Action(a)
+		}
+		roles[auth.Role(d.Name)] = actions
+	}
+	auth.SetCustomRoles(roles)
+	return nil
+}
+
+// RunRoleReload picks up role changes made through other instances every interval.
+// A failed reload keeps the roles already loaded.
+func (s *Server) RunRoleReload(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := s.LoadCustomRoles(ctx); err != nil {
+			errorf(ctx, "Custom role reload failed, keeping current roles: %v", err)
+		}
+	}
+}
@@ -0,0 +1,194 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"my-kms/internal/events"
+	"my-kms/internal/metrics"
+	"my-kms/internal/secmem"
+	"my-kms/internal/storage"
+)
+
+// DefaultRewrapBatchSize is how many DEKs the rewrap pass loads per store call.
+const DefaultRewrapBatchSize = 100
+
+// RotationSchedule replaces the active master key once it has been active for Interval,
+// or sooner when it nears its limit of AES-GCM wraps, and moves the DEKs still wrapped
+// under older master keys onto the active one.
+type RotationSchedule struct {
+	Interval  time.Duration // 0 leaves rotation to /rotate-master-key and only rewraps
+	BatchSize int
+
+	kick chan struct{}
+}
+
+// NewRotationSchedule returns a schedule rotating every interval.
+func NewRotationSchedule(interval time.Duration, batchSize int) *RotationSchedule {
+	if batchSize <= 0 {
+		batchSize = DefaultRewrapBatchSize
+	}
+	return &RotationSchedule{Interval: interval, BatchSize: batchSize, kick: make(chan struct{}, 1)}
+}
+
+// Kick starts a rewrap pass without waiting for the next check, after a rotation made
+// through the API.
+func (rs *RotationSchedule) Kick() {
+	select {
+	case rs.kick <- struct{}{}:
+	default:
+	}
+}
+
+// RunRotationSchedule checks every interval whether the active master key is due for
+// rotation, then rewraps what older keys still protect, until ctx is cancelled.
+func (s *Server) RunRotationSchedule(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if !s.KeyStore.Sealed() {
+			s.withClusterLock(ctx, LockRotation, func(ctx context.Context) {
+				// A rotation that has started completes even if shutdown begins meanwhile.
+				s.rotateIfDue(context.WithoutCancel(ctx))
+				s.rewrapDEKs(ctx)
+			})
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-s.Rotation.kick:
+		}
+	}
+}
+
+func (s *Server) rotateIfDue(ctx context.Context) {
+	rs := s.Rotation
+	age := s.KeyStore.ActiveKeyAge()
+	_, previous := s.KeyStore.KeyIDs()
+	// A key close to its wrap limit is rotated whatever its age.
+	exhausted := s.masterKeyNearLimit(previous)
+	if !exhausted && (rs.Interval <= 0 || age < rs.Interval) {
+		return
+	}
+	newKey, err := s.KeyStore.RotateMasterKey("rotation-schedule")
+	if err != nil {
+		errorf(ctx, "Scheduled master key rotation failed: %v", err)
+		return
+	}
+	reason := fmt.Sprintf("scheduled: active for %s, rotation interval %s", age.Round(time.Second), rs.Interval)
+	if exhausted {
+		s.auditSystem("rotation-schedule", "", newKey.ID, "master key %s rotated to %s nearing its limit of %d wraps", previous, newKey.ID, s.Nonces.Limit)
+		reason = fmt.Sprintf("nonce limit: over %.0f%% of %d wraps used", nonceRotationThreshold*100, s.Nonces.Limit)
+	} else {
+		s.auditSystem("rotation-schedule", "", newKey.ID, "master key %s rotated to %s after %s, on schedule", previous, newKey.ID, age.Round(time.Second))
+	}
+	s.recordKeyRotation(ctx, storage.KeyRotationEvent{
+		KeyType:   storage.RotatedKeyMaster,
+		Method:    storage.RotationMethodRotate,
+		KeyID:     previous,
+		NewKeyID:  newKey.ID,
+		RotatedBy: "kms",
+		Reason:    reason,
+	})
+	s.publishEventAs("kms", "", events.MasterKeyRotated, newKey.ID, map[string]string{"previousKeyId": previous, "reason": reason})
+}
+
+// rewrapDEKs moves every DEK wrapped under a loaded, inactive master key onto the active
+// one, and reseals metadata sealed under such a key, so the old keys can be retired.
+func (s *Server) rewrapDEKs(ctx context.Context) {
+	ids, active := s.KeyStore.KeyIDs()
+	for _, id := range ids {
+		if id == active {
+			continue
+		}
+		n, failed, err := s.rewrapFrom(ctx, id)
+		if n > 0 || failed > 0 {
+			s.auditSystem("rotation-schedule", "", id, "rewrapped %d DEKs from master key %s onto %s, %d failed", n, id, active, failed)
+		}
+		if err != nil {
+			if ctx.Err() == nil { // otherwise shutting down; the next start resumes
+				errorf(ctx, "Rewrapping DEKs from master key %s failed: %v", id, err)
+			}
+			return
+		}
+	}
+}
+
+// rewrapFrom rewraps the DEKs that depend on masterKeyID, deleted ones included, since
+// a restored DEK must still open. A DEK that changes meanwhile is left for the next pass.
+// Cancelling ctx stops the pass after the DEK being rewrapped, never halfway through it.
+func (s *Server) rewrapFrom(ctx context.Context, masterKeyID string) (rewrapped, failed int, err error) {
+	work := context.WithoutCancel(ctx)
+	cursor := ""
+	for {
+		docs, next, err := s.DEKStore.ListDEKsByMasterKey(work, masterKeyID, cursor, s.Rotation.BatchSize)
+		if err != nil {
+			return rewrapped, failed, err
+		}
+		for i := range docs {
+			if err := ctx.Err(); err != nil {
+				return rewrapped, failed, err
+			}
+			if err := s.rewrapDEK(work, &docs[i], masterKeyID); err != nil {
+				if !errors.Is(err, storage.ErrDEKChanged) {
+					warnf(ctx, "Failed to rewrap DEK %s: %v", docs[i].ID.Hex(), err)
+					metrics.DEKsRewrapped.Inc("failed")
+					failed++
+				}
+				continue
+			}
+			metrics.DEKsRewrapped.Inc("rewrapped")
+			rewrapped++
+		}
+		if next == "" {
+			return rewrapped, failed, nil
+		}
+		cursor = next
+	}
+}
+
+// metadataResealer is implemented by storage.SealedDEKStore.
+type metadataResealer interface {
+	ResealDEKMetadata(ctx context.Context, doc storage.DEKDocument) error
+}
+
+// rewrapDEK moves doc off masterKeyID: its wrapped key, its sealed metadata, or both.
+func (s *Server) rewrapDEK(ctx context.Context, doc *storage.DEKDocument, masterKeyID string) error {
+	if doc.MasterKeyID == masterKeyID {
+		dek, err := s.KeyStore.DecryptDataKey(doc.DEK, doc.MasterKeyID)
+		if err != nil {
+			return err
+		}
+		defer secmem.Zero(dek)
+		wrapped, keyID, err := s.KeyStore.EncryptDataKey(ctx, dek)
+		if err != nil {
+			return err
+		}
+		if err := s.DEKStore.RewrapDEK(ctx, doc.TenantID, doc.ID.Hex(), doc.MasterKeyID, wrapped, keyID); err != nil {
+			return err
+		}
+		s.recordKeyRotation(ctx, storage.KeyRotationEvent{
+			KeyType:         storage.RotatedKeyData,
+			Method:          storage.RotationMethodRewrap,
+			TenantID:        doc.TenantID,
+			KeyID:           doc.ID.Hex(),
+			RotatedBy:       "kms",
+			Reason:          "master key " + masterKeyID + " is no longer active",
+			FromMasterKeyID: masterKeyID,
+			ToMasterKeyID:   keyID,
+		})
+	}
+	if doc.Sealed != nil && doc.Sealed.KeyID == masterKeyID {
+		r, ok := s.DEKStore.(metadataResealer)
+		if !ok {
+			return errors.New("metadata is sealed but the DEK store cannot reseal it")
+		}
+		return r.ResealDEKMetadata(ctx, *doc)
+	}
+	return nil
+}
@@ -1,83 +1,120 @@
 package server
 
 import (
-	"context"
-	"fmt"
-	"log"
 	"net/http"
-
-	"my-kms/internal/auth"
 )
 
-// Routes sets up the HTTP endpoints.
+// Routes sets up the HTTP endpoints. They are registered without a version prefix;
+// VersionMiddleware maps /v1/... onto them.
 func (s *Server) Routes() http.Handler {
 	mux := http.NewServeMux()
 
-	mux.HandleFunc("/generate-data-key", s.RateLimitMiddleware(s.firebaseAuthMiddleware(s.GenerateDataKeyHandler)))
+	// Unauthenticated endpoints
+	mux.HandleFunc("/time", s.TimeHandler)
+	mux.HandleFunc("/attestation", s.AttestationHandler)
+	mux.HandleFunc("/healthz", s.HealthzHandler)
+	mux.HandleFunc("/readyz", s.ReadyzHandler)
+	mux.HandleFunc("/metrics", s.MetricsHandler)
+	mux.HandleFunc("/seal-status", s.SealStatusHandler)
+	mux.HandleFunc("/jwks", s.RateLimitMiddleware(s.JWKSHandler))
+	mux.HandleFunc("/unseal", s.RateLimitMiddleware(s.UnsealHandler))
+
+	mux.HandleFunc("/generate-data-key", s.RateLimitMiddleware(s.firebaseAuthMiddleware(s.idempotent(s.GenerateDataKeyHandler))))
 	mux.HandleFunc("/encrypt", s.RateLimitMiddleware(s.firebaseAuthMiddleware(s.EncryptHandler)))
 	mux.HandleFunc("/decrypt", s.RateLimitMiddleware(s.firebaseAuthMiddleware(s.DecryptHandler)))
-	mux.HandleFunc("/rotate-master-key", s.RateLimitMiddleware(s.firebaseAuthMiddleware(s.RotateMasterKeyHandler)))
+	mux.HandleFunc("/re-encrypt", s.RateLimitMiddleware(s.firebaseAuthMiddleware(s.ReEncryptHandler)))
+	mux.HandleFunc("/encrypt-fields", s.RateLimitMiddleware(s.firebaseAuthMiddleware(s.EncryptFieldsHandler)))
+	mux.HandleFunc("/decrypt-fields", s.RateLimitMiddleware(s.firebaseAuthMiddleware(s.DecryptFieldsHandler)))
+	mux.HandleFunc("/encrypt-fpe", s.RateLimitMiddleware(s.firebaseAuthMiddleware(s.EncryptFPEHandler)))
+	mux.HandleFunc("/decrypt-fpe", s.RateLimitMiddleware(s.firebaseAuthMiddleware(s.DecryptFPEHandler)))
+	mux.HandleFunc("/tokenize", s.RateLimitMiddleware(s.firebaseAuthMiddleware(s.TokenizeHandler)))
+	mux.HandleFunc("/hpke/public-key", s.RateLimitMiddleware(s.firebaseAuthMiddleware(s.HPKEPublicKeyHandler)))
+	mux.HandleFunc("/hpke/open", s.RateLimitMiddleware(s.firebaseAuthMiddleware(s.HPKEOpenHandler)))
+	mux.HandleFunc("/derive-key", s.RateLimitMiddleware(s.firebaseAuthMiddleware(s.DeriveKeyHandler)))
+	mux.HandleFunc("/create-ca", s.RateLimitMiddleware(s.firebaseAuthMiddleware(s.CreateCAHandler)))
+	mux.HandleFunc("/import-ca-certificate", s.RateLimitMiddleware(s.firebaseAuthMiddleware(s.ImportCACertificateHandler)))
+	mux.HandleFunc("/issue-certificate", s.RateLimitMiddleware(s.firebaseAuthMiddleware(s.IssueCertificateHandler)))
+	mux.HandleFunc("/ca-chain", s.RateLimitMiddleware(s.firebaseAuthMiddleware(s.CAChainHandler)))
+	mux.HandleFunc("/create-signing-key", s.RateLimitMiddleware(s.firebaseAuthMiddleware(s.CreateSigningKeyHandler)))
+	mux.HandleFunc("/rotate-signing-key", s.RateLimitMiddleware(s.firebaseAuthMiddleware(s.RotateSigningKeyHandler)))
+	mux.HandleFunc("/sign-jwt", s.RateLimitMiddleware(s.firebaseAuthMiddleware(s.SignJWTHandler)))
+	mux.HandleFunc("/list-index-keys", s.RateLimitMiddleware(s.firebaseAuthMiddleware(s.ListIndexKeysHandler)))
+	mux.HandleFunc("/create-handoff-token", s.RateLimitMiddleware(s.firebaseAuthMiddleware(s.CreateHandoffTokenHandler)))
+	mux.HandleFunc("/redeem-handoff-token", s.RateLimitMiddleware(s.firebaseAuthMiddleware(s.RedeemHandoffTokenHandler)))
+	mux.HandleFunc("/rotate-master-key", s.RateLimitMiddleware(s.firebaseAuthMiddleware(s.idempotent(s.RotateMasterKeyHandler))))
+	mux.HandleFunc("/retire-master-key", s.RateLimitMiddleware(s.firebaseAuthMiddleware(s.RetireMasterKeyHandler)))
+	mux.HandleFunc("/seal", s.RateLimitMiddleware(s.firebaseAuthMiddleware(s.SealHandler)))
+	mux.HandleFunc("/admin/reload", s.RateLimitMiddleware(s.firebaseAuthMiddleware(s.ReloadConfigHandler)))
 
 	// New endpoint to delete a DEK:
-	mux.HandleFunc("/delete-data-key", s.RateLimitMiddleware(s.firebaseAuthMiddleware(s.DeleteDataKeyHandler)))
-
-	return mux
-}
-
-// firebaseAuthMiddleware authenticates the Firebase JWT, retrieves role from MongoDB, sets identity in context.
-func (s *Server) firebaseAuthMiddleware(next http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		// 1. Authorization header
-		authHeader := r.Header.Get("Authorization")
-		if authHeader == "" {
-			http.Error(w, "Authorization header missing", http.StatusUnauthorized)
-			return
-		}
-
-		// 2. Parse token
-		var token string
-		_, err := fmt.Sscanf(authHeader, "Bearer %s", &token)
-		if err != nil || token == "" {
-			http.Error(w, "Invalid Authorization header format", http.StatusUnauthorized)
-			return
-		}
+	mux.HandleFunc("/delete-data-key", s.RateLimitMiddleware(s.firebaseAuthMiddleware(s.idempotent(s.DeleteDataKeyHandler))))
+	mux.HandleFunc("/restore-data-key", s.RateLimitMiddleware(s.firebaseAuthMiddleware(s.RestoreDataKeyHandler)))
+	mux.HandleFunc("/place-legal-hold", s.RateLimitMiddleware(s.firebaseAuthMiddleware(s.PlaceLegalHoldHandler)))
+	mux.HandleFunc("/release-legal-hold", s.RateLimitMiddleware(s.firebaseAuthMiddleware(s.ReleaseLegalHoldHandler)))
+	mux.HandleFunc("/list-legal-holds", s.RateLimitMiddleware(s.firebaseAuthMiddleware(s.ListLegalHoldsHandler)))
+	mux.HandleFunc("/revoke-principal", s.RateLimitMiddleware(s.firebaseAuthMiddleware(s.RevokePrincipalHandler)))
+	mux.HandleFunc("/reinstate-principal", s.RateLimitMiddleware(s.firebaseAuthMiddleware(s.ReinstatePrincipalHandler)))
+	mux.HandleFunc("/list-revoked-principals", s.RateLimitMiddleware(s.firebaseAuthMiddleware(s.ListRevokedPrincipalsHandler)))
+	mux.HandleFunc("/register-cmk", s.RateLimitMiddleware(s.firebaseAuthMiddleware(s.RegisterCMKHandler)))
+	mux.HandleFunc("/describe-cmk", s.RateLimitMiddleware(s.firebaseAuthMiddleware(s.DescribeCMKHandler)))
+	mux.HandleFunc("/get-import-parameters", s.RateLimitMiddleware(s.firebaseAuthMiddleware(s.GetImportParametersHandler)))
+	mux.HandleFunc("/import-key-material", s.RateLimitMiddleware(s.firebaseAuthMiddleware(s.ImportKeyMaterialHandler)))
+	mux.HandleFunc("/export-data-key", s.RateLimitMiddleware(s.firebaseAuthMiddleware(s.ExportDataKeyHandler)))
+	mux.HandleFunc("/backup", s.RateLimitMiddleware(s.firebaseAuthMiddleware(s.BackupHandler)))
+	mux.HandleFunc("/tag-key", s.RateLimitMiddleware(s.firebaseAuthMiddleware(s.TagKeyHandler)))
+	mux.HandleFunc("/untag-key", s.RateLimitMiddleware(s.firebaseAuthMiddleware(s.UntagKeyHandler)))
+	mux.HandleFunc("/put-key-policy", s.RateLimitMiddleware(s.firebaseAuthMiddleware(s.PutKeyPolicyHandler)))
+	mux.HandleFunc("/create-grant", s.RateLimitMiddleware(s.firebaseAuthMiddleware(s.CreateGrantHandler)))
+	mux.HandleFunc("/list-grants", s.RateLimitMiddleware(s.firebaseAuthMiddleware(s.ListGrantsHandler)))
+	mux.HandleFunc("/retire-grant", s.RateLimitMiddleware(s.firebaseAuthMiddleware(s.RetireGrantHandler)))
+	mux.HandleFunc("/describe-key", s.RateLimitMiddleware(s.firebaseAuthMiddleware(s.DescribeKeyHandler)))
+	mux.HandleFunc("/disable-key", s.RateLimitMiddleware(s.firebaseAuthMiddleware(s.DisableKeyHandler)))
+	mux.HandleFunc("/enable-key", s.RateLimitMiddleware(s.firebaseAuthMiddleware(s.EnableKeyHandler)))
+	mux.HandleFunc("/deprecate-key", s.RateLimitMiddleware(s.firebaseAuthMiddleware(s.DeprecateKeyHandler)))
+	mux.HandleFunc("/register-ciphertext-location", s.RateLimitMiddleware(s.firebaseAuthMiddleware(s.RegisterCiphertextLocationHandler)))
+	mux.HandleFunc("/list-ciphertext-locations", s.RateLimitMiddleware(s.firebaseAuthMiddleware(s.ListCiphertextLocationsHandler)))
+	mux.HandleFunc("/update-ciphertext-location", s.RateLimitMiddleware(s.firebaseAuthMiddleware(s.UpdateCiphertextLocationHandler)))
+	mux.HandleFunc("/unregister-ciphertext-location", s.RateLimitMiddleware(s.firebaseAuthMiddleware(s.UnregisterCiphertextLocationHandler)))
+	mux.HandleFunc("/create-alias", s.RateLimitMiddleware(s.firebaseAuthMiddleware(s.CreateAliasHandler)))
+	mux.HandleFunc("/delete-alias", s.RateLimitMiddleware(s.firebaseAuthMiddleware(s.DeleteAliasHandler)))
+	mux.HandleFunc("/list-aliases", s.RateLimitMiddleware(s.firebaseAuthMiddleware(s.ListAliasesHandler)))
+	mux.HandleFunc("/list-data-keys", s.RateLimitMiddleware(s.firebaseAuthMiddleware(s.ListDataKeysHandler)))
+	mux.HandleFunc("/usage", s.RateLimitMiddleware(s.firebaseAuthMiddleware(s.UsageHandler)))
+	mux.HandleFunc("/key-usage-report", s.RateLimitMiddleware(s.firebaseAuthMiddleware(s.KeyUsageReportHandler)))
+	mux.HandleFunc("/client-adoption", s.RateLimitMiddleware(s.firebaseAuthMiddleware(s.ClientAdoptionHandler)))
+	mux.HandleFunc("/create-role", s.RateLimitMiddleware(s.firebaseAuthMiddleware(s.CreateRoleHandler)))
+	mux.HandleFunc("/update-role", s.RateLimitMiddleware(s.firebaseAuthMiddleware(s.UpdateRoleHandler)))
+	mux.HandleFunc("/list-roles", s.RateLimitMiddleware(s.firebaseAuthMiddleware(s.ListRolesHandler)))
+	mux.HandleFunc("/delete-role", s.RateLimitMiddleware(s.firebaseAuthMiddleware(s.DeleteRoleHandler)))
+	mux.HandleFunc("/create-user", s.RateLimitMiddleware(s.firebaseAuthMiddleware(s.CreateUserHandler)))
+	mux.HandleFunc("/update-user", s.RateLimitMiddleware(s.firebaseAuthMiddleware(s.UpdateUserHandler)))
+	mux.HandleFunc("/disable-user", s.RateLimitMiddleware(s.firebaseAuthMiddleware(s.DisableUserHandler)))
+	mux.HandleFunc("/list-users", s.RateLimitMiddleware(s.firebaseAuthMiddleware(s.ListUsersHandler)))
+	mux.HandleFunc("/create-api-key", s.RateLimitMiddleware(s.firebaseAuthMiddleware(s.CreateAPIKeyHandler)))
+	mux.HandleFunc("/list-api-keys", s.RateLimitMiddleware(s.firebaseAuthMiddleware(s.ListAPIKeysHandler)))
+	mux.HandleFunc("/revoke-api-key", s.RateLimitMiddleware(s.firebaseAuthMiddleware(s.RevokeAPIKeyHandler)))
+	mux.HandleFunc("/audit-logs", s.RateLimitMiddleware(s.firebaseAuthMiddleware(s.AuditLogsHandler)))
+	mux.HandleFunc("/verify-audit-chain", s.RateLimitMiddleware(s.firebaseAuthMiddleware(s.VerifyAuditChainHandler)))
+	mux.HandleFunc("/list-master-keys", s.RateLimitMiddleware(s.firebaseAuthMiddleware(s.ListMasterKeysHandler)))
+	mux.HandleFunc("/key-rotation-history", s.RateLimitMiddleware(s.firebaseAuthMiddleware(s.KeyRotationHistoryHandler)))
+	mux.HandleFunc("/events", s.RateLimitMiddleware(s.firebaseAuthMiddleware(s.EventsHandler)))
+	mux.HandleFunc(AWSKMSPath, s.RateLimitMiddleware(traceAuth(s.authenticateSigV4, s.AWSKMSHandler)))
+	mux.HandleFunc(transitEncryptPattern, s.RateLimitMiddleware(vaultTokenAuth(s.firebaseAuthMiddleware(s.TransitEncryptHandler))))
+	mux.HandleFunc(transitDecryptPattern, s.RateLimitMiddleware(vaultTokenAuth(s.firebaseAuthMiddleware(s.TransitDecryptHandler))))
+	mux.HandleFunc("/offboard-user", s.RateLimitMiddleware(s.firebaseAuthMiddleware(s.OffboardUserHandler)))
 
-		// 3. Verify token
-		ctx := context.Background()
-		decodedToken, err := s.FirebaseAuth.VerifyIDToken(ctx, token)
-		if err != nil {
-			log.Printf("Failed to verify ID token: %v", err)
-			http.Error(w, "Invalid or expired token", http.StatusUnauthorized)
-			return
-		}
-
-		// 4. Lookup user from MongoDB
-		firebaseUID := decodedToken.UID
-		user, err := s.MongoUserStore.GetUserByFirebaseUID(ctx, firebaseUID)
-		if err != nil {
-			log.Printf("Failed to retrieve user from MongoDB: %v", err)
-			http.Error(w, "User not found", http.StatusUnauthorized)
-			return
-		}
-
-		// 5. Create Identity
-		identity := auth.Identity{
-			Name: firebaseUID,
-			Role: auth.Role(user.Role),
-		}
-
-		// 6. Inject identity into context
-		ctx = context.WithValue(r.Context(), "identity", identity)
-		r = r.WithContext(ctx)
-
-		next.ServeHTTP(w, r)
+	var h http.Handler = mux
+	h = s.RequestValidationMiddleware(mux, h)
+	h = s.TimeoutMiddleware(mux, h)
+	if s.Concurrency != nil {
+		h = s.Concurrency.Middleware(mux, h)
 	}
-}
-
-// RateLimitMiddleware is a no-op; implement real rate limiting if needed.
-func (s *Server) RateLimitMiddleware(next http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		// Potentially implement rate-limiting or call an external library here.
-		next.ServeHTTP(w, r)
+	if s.Usage != nil {
+		h = s.Usage.Middleware(mux, h)
 	}
+	h = s.SealMiddleware(h)
+	h = s.MetricsMiddleware(mux, h)
+	h = s.TracingMiddleware(mux, h)
+	h = s.AuditMiddleware(mux, h)
+	return s.ProxyMiddleware(RequestIDMiddleware(s.VersionMiddleware(mux, h)))
 }
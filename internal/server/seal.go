@@ -0,0 +1,125 @@
+package server
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/http"
+
+	"my-kms/internal/auth"
+	"my-kms/internal/seal"
+	"my-kms/internal/secmem"
+)
+
+// servedWhileSealed are the paths answered while the master keys are sealed: probes,
+// metrics, and what it takes to unseal.
+var servedWhileSealed = map[string]bool{
+	"/healthz": true, "/readyz": true, "/metrics": true, "/time": true,
+	"/seal-status": true, "/unseal": true,
+}
+
+// SealMiddleware answers 503 while the master keys are sealed, except on the paths
+// needed to unseal, so callers see why instead of a failed operation.
+func (s *Server) SealMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.Unsealer != nil && !servedWhileSealed[r.URL.Path] && s.KeyStore.Sealed() {
+			w.Header().Set("Retry-After", "5")
+			http.Error(w, "the KMS is sealed", http.StatusServiceUnavailable)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// SealStatusHandler is unauthenticated so key holders can follow unsealing.
+func (s *Server) SealStatusHandler(w http.ResponseWriter, r *http.Request) {
+	if s.Unsealer == nil {
+		http.Error(w, "sealing is not enabled", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, s.Unsealer.Status())
+}
+
+// ---------------------------------------------------------------------
+// Unseal
+// ---------------------------------------------------------------------
+
+// UnsealRequest submits one share, or discards those submitted so far with reset.
+type UnsealRequest struct {
+	Share string `json:"share,omitempty"` // base64
+	Reset bool   `json:"reset,omitempty"`
+}
+
+// UnsealHandler is unauthenticated, as in Vault: the shares are the credential, and no
+// user can be authorized against a sealed KMS anyway.
+func (s *Server) UnsealHandler(w http.ResponseWriter, r *http.Request) {
+	if s.Unsealer == nil {
+		http.Error(w, "sealing is not enabled", http.StatusNotFound)
+		return
+	}
+
+	var req UnsealRequest
+	if !decodeJSON(w, r.Body, &req) {
+		return
+	}
+	if req.Reset {
+		s.Unsealer.Reset()
+		auditf(r.Context(), "unseal progress reset from %s", r.RemoteAddr)
+		writeJSON(w, s.Unsealer.Status())
+		return
+	}
+	share, err := base64.StdEncoding.DecodeString(req.Share)
+	if err != nil {
+		http.Error(w, "share must be base64", http.StatusBadRequest)
+		return
+	}
+
+	st, err := s.Unsealer.Submit(share)
+	secmem.Zero(share)
+	if errors.Is(err, seal.ErrUnsealed) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		warnf(r.Context(), "Unseal share from %s rejected: %v", r.RemoteAddr, err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if st.Sealed {
+		auditf(r.Context(), "unseal share %d of %d accepted from %s", st.Progress, st.Threshold, r.RemoteAddr)
+	} else {
+		auditf(r.Context(), "KMS unsealed by share from %s", r.RemoteAddr)
+	}
+
+	writeJSON(w, st)
+}
+
+// ---------------------------------------------------------------------
+// Seal
+// ---------------------------------------------------------------------
+
+// SealHandler drops the master keys from memory. Unsealing again takes a threshold of
+// shares.
+func (s *Server) SealHandler(w http.ResponseWriter, r *http.Request) {
+	identity, err := getIdentity(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	// Sealing takes the master keys away, so it needs the same permission as replacing them.
+	if err := auth.IsAuthorized(identity, auth.ActionRotateMasterKey); err != nil {
+		warnf(r.Context(), "Unauthorized attempt by role=%s to seal the KMS", identity.Role)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	if s.Unsealer == nil {
+		http.Error(w, "sealing is not enabled", http.StatusNotFound)
+		return
+	}
+
+	s.Unsealer.Seal()
+	auditf(r.Context(), "KMS sealed by %s", identity.Name)
+
+	writeJSON(w, s.Unsealer.Status())
+}
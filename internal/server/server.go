@@ -1,30 +1,204 @@
 package server
 
 import (
-	firebaseauth "firebase.google.com/go/auth"
+	"context"
+	"crypto/rsa"
+	"sync"
+	"time"
 
+	"my-kms/internal/attest"
+	"my-kms/internal/auth"
+	"my-kms/internal/crypto"
+	"my-kms/internal/events"
+	"my-kms/internal/seal"
+	"my-kms/internal/siem"
 	"my-kms/internal/storage"
+	"my-kms/internal/transform"
 )
 
-// Server holds references to the MasterKeyStore, MongoUserStore, DEKStore, etc.
+// DefaultMaxPayloadBytes is the plaintext limit used unless configured otherwise.
+const DefaultMaxPayloadBytes = 4 << 20
+
+// DefaultUserCacheMaxStaleness bounds how old a cached user may be when the user store is down.
+const DefaultUserCacheMaxStaleness = 15 * time.Minute
+
+// DefaultTenantClaim is the Firebase custom claim read for the tenant ID.
+const DefaultTenantClaim = "tenant"
+
+// Server holds references to the MasterKeyStore, UserStore, DEKStore, etc.
 type Server struct {
-	KeyStore       *storage.MasterKeyStore
-	MongoUserStore *storage.MongoUserStore
-	DEKStore       *storage.MongoDEKStore
-	FirebaseAuth   *firebaseauth.Client
+	KeyStore     *storage.MasterKeyStore
+	Unsealer     *seal.Unsealer // set when KeyStore starts sealed
+	UserStore    storage.UserStore
+	DEKStore     storage.DEKStore
+	FirebaseAuth TokenVerifier
+	TokenPolicy  auth.TokenTimePolicy
+	TenantClaim  string // Firebase custom claim carrying the tenant ID
+	RoleClaim    string // Firebase custom claim carrying the role; empty looks roles up in the user store (see applyUserRecord)
+	AlgPolicy    crypto.AlgorithmPolicy
+
+	// MaxPayloadBytes caps plaintext size for encrypt and decrypt.
+	MaxPayloadBytes int64
+	// MaxRequestBodyBytes caps the body of endpoints that take no payload.
+	MaxRequestBodyBytes int64
+
+	// RequestTimeout bounds each request unless EndpointTimeouts, keyed by route, says
+	// otherwise; zero leaves requests unbounded.
+	RequestTimeout   time.Duration
+	EndpointTimeouts map[string]time.Duration
+
+	// Optional subsystems; nil disables them.
+	ClientStore *storage.MongoClientStore
+	Clients     *ClientTracker
+
+	ImportTokens   *storage.MongoImportTokenStore
+	ImportTokenTTL time.Duration
+
+	HandoffTokens      *storage.MongoHandoffTokenStore
+	HandoffTokenMaxTTL time.Duration
+
+	Aliases *storage.MongoAliasStore
+	Grants  *storage.MongoGrantStore
+
+	IndexKeys *storage.MongoIndexKeyStore // blind index keys for /tokenize
+
+	CAs                 *storage.MongoCAStore // issuing CAs for /issue-certificate
+	CertificateProfiles map[string]*CertificateProfile
+
+	SigningKeys              *storage.MongoSigningKeyStore // JWT signing keys for /sign-jwt and /jwks
+	SigningKeyRotationPeriod time.Duration
+	JWTMaxTTL                time.Duration
+
+	Idempotency       *storage.MongoIdempotencyStore // responses replayed for retries with an Idempotency-Key
+	IdempotencyKeyTTL time.Duration
+
+	APIKeys    *storage.MongoAPIKeyStore
+	LegalHolds *storage.MongoLegalHoldStore
+	TenantCMKs *storage.MongoTenantKeyStore
+
+	// CiphertextLocations tracks downstream re-encryption when a DEK is rotated or shredded.
+	CiphertextLocations *storage.MongoCiphertextLocationStore
+
+	// Transformers holds the payload hooks that aliases may enable.
+	Transformers *transform.Registry
+	DLP          *transform.DLPScanner // nil disables DLP scanning
+
+	Usage    *UsageStats // opt-in noisy usage export for analytics
+	Attestor *attest.Signer
+	Audit    AuditStore      // structured audit events served by /audit-logs
+	SIEM     *siem.Forwarder // streams audit events to external sinks; nil when none are configured
+	Events   *events.Bus     // key lifecycle events for webhooks and /events; nil disables them
+	Outbox   *events.Outbox  // publishes lifecycle and audit events to Kafka or NATS; nil disables it
+
+	// MetricsToken, when set, is the bearer token /metrics requires.
+	MetricsToken string
+
+	// UserFallback and UserCacheMaxStaleness govern requests while the user store is down.
+	UserFallback          UserFallbackMode
+	UserCacheMaxStaleness time.Duration
+	userCache             *userCache
+
+	touches *dekTouches // throttles lastUsedAt writes; see touchDEK
+
+	// UserCacheTTL is how long a user lookup is reused before the store is asked again;
+	// 0 asks on every request. Changes made through this instance apply at once.
+	UserCacheTTL time.Duration
+	userCacheMu  sync.RWMutex // guards UserCacheTTL and UserCacheMaxStaleness; see SetUserCacheTTLs
+
+	// Revocations blocks the principals revoked with /revoke-principal.
+	Revocations *RevocationList
+
+	// Reload, when set, re-reads the configuration and applies what can change without
+	// a restart; see ReloadConfig.
+	Reload   func(context.Context) error
+	reloadMu sync.Mutex
+
+	// WriteTimeout is the http.Server's, which TimeoutMiddleware extends for endpoints
+	// allowed to run longer.
+	WriteTimeout time.Duration
+
+	// TrustedProxies are the proxies whose X-Forwarded-For headers name the client.
+	TrustedProxies TrustedProxies
+
+	// ClientCertMode and CertMapping govern authentication by TLS client certificate.
+	ClientCertMode ClientCertMode
+	CertMapping    *CertMapping
+
+	// Rotation, when set, rotates the master key on a schedule and rewraps DEKs onto it.
+	Rotation *RotationSchedule
+
+	// Locks keeps rotation, the DEK purge and audit upkeep to one replica at a time; nil
+	// runs them on every replica.
+	Locks *ClusterLocks
+
+	// KeyRotations records every master key and DEK rotation for /key-rotation-history.
+	KeyRotations *storage.MongoKeyRotationStore
+
+	// BackupRecoveryKey is the offline RSA key /backup encrypts under; nil disables /backup.
+	BackupRecoveryKey *rsa.PublicKey
+
+	// DualControl, when set, holds destructive operations for a second approver.
+	DualControl *DualControl
+
+	// RateLimits throttles requests per client IP and per identity; nil disables it.
+	RateLimits *RateLimits
+	// Concurrency caps requests in flight per endpoint; nil disables it.
+	Concurrency *ConcurrencyLimiter
+
+	// Quotas meters operations per key and identity and enforces usage quotas; nil
+	// disables metering.
+	Quotas *Quotas
+
+	// Nonces caps encryptions per AES-GCM key at the bound for random nonces. NewServer
+	// counts in process; give it a store to count across instances and restarts.
+	Nonces *NonceLedger
+
+	// Failures decides, per subsystem, whether an outage blocks the operation it guards.
+	Failures FailurePolicy
+
+	// AWSFacade enables the AWS KMS-compatible API at /aws-kms; nil disables it.
+	AWSFacade *AWSFacade
+
+	// VaultTransit enables the Vault transit-compatible API at /v1/transit.
+	VaultTransit bool
+
+	// LegacyRoutes governs the unversioned paths that predate /v1.
+	LegacyRoutes LegacyRoutes
+
+	// Readiness is reported by /readyz; RunWarmup marks it ready and RunHealthChecks
+	// keeps it current.
+	Readiness *Readiness
 }
 
 // NewServer creates a new Server with the given dependencies.
 func NewServer(
 	ks *storage.MasterKeyStore,
-	mus *storage.MongoUserStore,
-	dekStore *storage.MongoDEKStore,
-	fa *firebaseauth.Client,
+	users storage.UserStore,
+	dekStore storage.DEKStore,
+	fa TokenVerifier,
 ) *Server {
 	return &Server{
-		KeyStore:       ks,
-		MongoUserStore: mus,
-		DEKStore:       dekStore,
-		FirebaseAuth:   fa,
+		KeyStore:     ks,
+		UserStore:    users,
+		DEKStore:     dekStore,
+		FirebaseAuth: fa,
+		TokenPolicy:  auth.DefaultTokenTimePolicy(),
+		TenantClaim:  DefaultTenantClaim,
+
+		MaxPayloadBytes:     DefaultMaxPayloadBytes,
+		MaxRequestBodyBytes: DefaultMaxRequestBodyBytes,
+		RequestTimeout:      DefaultRequestTimeout,
+		HandoffTokenMaxTTL:  DefaultHandoffTokenMaxTTL,
+		Transformers:        transform.NewRegistry(),
+		Nonces:              NewNonceLedger(nil, DefaultGCMEncryptionLimit, DefaultGCMEncryptionLease),
+
+		UserFallback:          UserFallbackNone,
+		UserCacheMaxStaleness: DefaultUserCacheMaxStaleness,
+		ClientCertMode:        ClientCertOff,
+		userCache:             newUserCache(),
+		touches:               newDEKTouches(),
+		Revocations:           NewRevocationList(nil),
+		Failures:              DefaultFailurePolicy(),
+		Readiness:             &Readiness{},
 	}
 }
@@ -0,0 +1,94 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// Jobs runs the server's background jobs and the hooks that run on shutdown. Shutdown
+// stops the jobs from starting new work and waits for the work in progress, such as a
+// rewrap batch or a purge, to finish before the hooks run.
+type Jobs struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	mu      sync.Mutex
+	running map[string]int
+	hooks   []shutdownHook
+}
+
+type shutdownHook struct {
+	name string
+	run  func(ctx context.Context) error
+}
+
+// NewJobs returns an empty registry.
+func NewJobs() *Jobs {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Jobs{ctx: ctx, cancel: cancel, running: map[string]int{}}
+}
+
+// Go runs job in its own goroutine with a context that is cancelled on Shutdown. A job
+// returns once it sees the cancellation, after finishing what it was in the middle of.
+func (j *Jobs) Go(name string, job func(ctx context.Context)) {
+	j.mu.Lock()
+	j.running[name]++
+	j.mu.Unlock()
+	j.wg.Add(1)
+	go func() {
+		defer j.wg.Done()
+		defer func() {
+			j.mu.Lock()
+			if j.running[name]--; j.running[name] == 0 {
+				delete(j.running, name)
+			}
+			j.mu.Unlock()
+		}()
+		job(j.ctx)
+	}()
+}
+
+// OnShutdown registers hook to run on Shutdown, once the jobs have returned. Hooks run
+// in reverse order of registration, like defers.
+func (j *Jobs) OnShutdown(name string, hook func(ctx context.Context) error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.hooks = append(j.hooks, shutdownHook{name: name, run: hook})
+}
+
+// Shutdown cancels the jobs, waits for them until ctx is done, then runs the hooks. It
+// returns every hook error, and an error naming the jobs still running when ctx ran out.
+func (j *Jobs) Shutdown(ctx context.Context) error {
+	j.cancel()
+	done := make(chan struct{})
+	go func() {
+		j.wg.Wait()
+		close(done)
+	}()
+
+	var errs []error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		j.mu.Lock()
+		names := make([]string, 0, len(j.running))
+		for name := range j.running {
+			names = append(names, name)
+		}
+		j.mu.Unlock()
+		errs = append(errs, fmt.Errorf("background jobs still running after the drain timeout: %v", names))
+	}
+
+	j.mu.Lock()
+	hooks := j.hooks
+	j.mu.Unlock()
+	for i := len(hooks) - 1; i >= 0; i-- {
+		if err := hooks[i].run(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", hooks[i].name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
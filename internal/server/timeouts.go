@@ -0,0 +1,112 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// DefaultRequestTimeout bounds a request unless configured otherwise.
+const DefaultRequestTimeout = 30 * time.Second
+
+// ParseEndpointTimeouts reads "path=duration" pairs separated by commas, such as
+// "/backup=5m,/offboard-user=2m". A zero duration leaves the endpoint unbounded.
+func ParseEndpointTimeouts(s string) (map[string]time.Duration, error) {
+	timeouts := map[string]time.Duration{}
+	for _, pair := range strings.Split(s, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		path, spec, ok := strings.Cut(pair, "=")
+		path = strings.TrimSpace(path)
+		if !ok || !strings.HasPrefix(path, "/") {
+			return nil, fmt.Errorf("invalid endpoint timeout %q; expected /path=duration", pair)
+		}
+		d, err := time.ParseDuration(strings.TrimSpace(spec))
+		if err != nil || d < 0 {
+			return nil, fmt.Errorf("endpoint %s: invalid timeout %q", path, spec)
+		}
+		timeouts[path] = d
+	}
+	return timeouts, nil
+}
+
+// endpointTimeout is the deadline for requests to pattern.
+func (s *Server) endpointTimeout(pattern string) time.Duration {
+	if streamingEndpoints[pattern] {
+		return 0
+	}
+	if d, ok := s.EndpointTimeouts[pattern]; ok {
+		return d
+	}
+	return s.RequestTimeout
+}
+
+// writeDeadlineSlack is how long past its timeout a request may take to write the 504.
+const writeDeadlineSlack = 5 * time.Second
+
+// TimeoutMiddleware puts a deadline on each request's context, which storage, CMK and
+// token verification calls honour. A handler failing because the deadline passed is
+// answered with a 504 in place of its own error. Endpoints allowed longer than
+// WriteTimeout get their connection's write deadline moved out to match.
+func (s *Server) TimeoutMiddleware(mux *http.ServeMux, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, pattern := mux.Handler(r)
+		timeout := s.endpointTimeout(pattern)
+		if s.WriteTimeout > 0 && (timeout <= 0 || timeout+writeDeadlineSlack > s.WriteTimeout) {
+			var deadline time.Time // none, for an unbounded endpoint
+			if timeout > 0 {
+				deadline = time.Now().Add(timeout + writeDeadlineSlack)
+			}
+			if err := http.NewResponseController(w).SetWriteDeadline(deadline); err != nil {
+				warnf(r.Context(), "Failed to extend the write deadline for %s: %v", pattern, err)
+			}
+		}
+		if timeout <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		tw := &timeoutWriter{ResponseWriter: w, ctx: ctx, pattern: pattern, timeout: timeout}
+		next.ServeHTTP(tw, r.WithContext(ctx))
+	})
+}
+
+// timeoutWriter replaces a server error written after the deadline with a 504.
+type timeoutWriter struct {
+	http.ResponseWriter
+	ctx     context.Context
+	pattern string
+	timeout time.Duration
+
+	wroteHeader bool
+	timedOut    bool
+}
+
+func (w *timeoutWriter) WriteHeader(code int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	if code >= http.StatusInternalServerError && errors.Is(w.ctx.Err(), context.DeadlineExceeded) {
+		w.timedOut = true
+		warnf(w.ctx, "Request to %s exceeded its %s timeout", w.pattern, w.timeout)
+		http.Error(w.ResponseWriter, "request timed out", http.StatusGatewayTimeout)
+		return
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *timeoutWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.timedOut {
+		return len(b), nil
+	}
+	return w.ResponseWriter.Write(b)
+}
@@ -0,0 +1,182 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"regexp"
+
+	"my-kms/internal/auth"
+	"my-kms/internal/crypto"
+	"my-kms/internal/secmem"
+	"my-kms/internal/storage"
+)
+
+// Blind indexes: /tokenize returns HMAC-SHA256 of each value under a per-tenant index
+// key the KMS creates on first use and never hands out. Applications store the token
+// next to the ciphertext and search by tokenizing the search term.
+
+// tokenizeAlgorithm labels tokenize spans and metrics.
+const tokenizeAlgorithm crypto.Algorithm = "HMAC_SHA256"
+
+// defaultIndexName is used when a request names no index.
+const defaultIndexName = "default"
+
+const (
+	indexKeySize      = 32
+	maxTokenizeValues = 1000
+)
+
+var indexNamePattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,128}$`)
+
+type TokenizeRequest struct {
+	Index  string   `json:"index,omitempty"` // blind index name; defaults to "default"
+	Values []string `json:"values"`
+}
+
+type TokenizeResponse struct {
+	Index  string   `json:"index"`
+	Tokens []string `json:"tokens"` // base64url, in the order of values
+}
+
+// ---------------------------------------------------------------------
+// Tokenize
+// ---------------------------------------------------------------------
+
+func (s *Server) TokenizeHandler(w http.ResponseWriter, r *http.Request) {
+	identity, err := getIdentity(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	if err := auth.IsAuthorized(identity, auth.ActionTokenize); err != nil {
+		warnf(r.Context(), "Unauthorized attempt by role=%s to tokenize", identity.Role)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	if s.IndexKeys == nil {
+		http.Error(w, "blind indexes are not enabled", http.StatusNotFound)
+		return
+	}
+
+	var req TokenizeRequest
+	if !decodeJSON(w, http.MaxBytesReader(w, r.Body, s.MaxPayloadBytes), &req) {
+		return
+	}
+	if req.Index == "" {
+		req.Index = defaultIndexName
+	}
+	if !indexNamePattern.MatchString(req.Index) {
+		http.Error(w, "index must be 1-128 characters of letters, digits, '.', '_' or '-'", http.StatusBadRequest)
+		return
+	}
+	if len(req.Values) == 0 || len(req.Values) > maxTokenizeValues {
+		http.Error(w, fmt.Sprintf("values must hold 1 to %d strings", maxTokenizeValues), http.StatusBadRequest)
+		return
+	}
+	if !s.meterUsage(w, r, identity, "", quotaOpTokenize, false, true) {
+		return
+	}
+
+	key, err := s.indexKey(r, identity, req.Index)
+	if err != nil {
+		errorf(r.Context(), "Failed to load index key %s: %v", req.Index, err)
+		http.Error(w, "failed to load index key", http.StatusInternalServerError)
+		return
+	}
+	defer secmem.Zero(key)
+
+	endCrypto := traceCrypto(r, "tokenize", tokenizeAlgorithm)
+	tokens := make([]string, len(req.Values))
+	mac := hmac.New(sha256.New, key)
+	for i, v := range req.Values {
+		mac.Reset()
+		mac.Write([]byte(v))
+		tokens[i] = base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+	}
+	endCrypto(nil)
+
+	auditf(r.Context(), "Tokenized %d values with index %s", len(tokens), req.Index)
+	writeJSON(w, TokenizeResponse{Index: req.Index, Tokens: tokens})
+}
+
+// ---------------------------------------------------------------------
+// List Index Keys
+// ---------------------------------------------------------------------
+
+type ListIndexKeysResponse struct {
+	IndexKeys []storage.IndexKey `json:"indexKeys"`
+}
+
+func (s *Server) ListIndexKeysHandler(w http.ResponseWriter, r *http.Request) {
+	identity, err := getIdentity(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	if err := auth.IsAuthorized(identity, auth.ActionListKeys); err != nil {
+		warnf(r.Context(), "Unauthorized attempt by role=%s to list index keys", identity.Role)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	if s.IndexKeys == nil {
+		http.Error(w, "blind indexes are not enabled", http.StatusNotFound)
+		return
+	}
+
+	keys, err := s.IndexKeys.ListIndexKeys(r.Context(), identity.Tenant)
+	if err != nil {
+		errorf(r.Context(), "Failed to list index keys: %v", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	if keys == nil {
+		keys = []storage.IndexKey{}
+	}
+	writeJSON(w, ListIndexKeysResponse{IndexKeys: keys})
+}
+
+// ---------------------------------------------------------------------
+// Helper Functions
+// ---------------------------------------------------------------------
+
+// indexKey returns the unwrapped key of the tenant's index name, creating it on first use.
+func (s *Server) indexKey(r *http.Request, identity auth.Identity, name string) ([]byte, error) {
+	k, err := s.IndexKeys.GetIndexKey(r.Context(), identity.Tenant, name)
+	if err != nil {
+		return nil, err
+	}
+	if k == nil {
+		raw := make([]byte, indexKeySize)
+		if _, err := rand.Read(raw); err != nil {
+			return nil, fmt.Errorf("failed to generate index key: %w", err)
+		}
+		wrapped, masterKeyID, err := s.wrapDEK(r, identity.Tenant, raw)
+		secmem.Zero(raw)
+		if err != nil {
+			return nil, err
+		}
+		var created bool
+		k, created, err = s.IndexKeys.CreateIndexKey(r.Context(), storage.IndexKey{
+			TenantID:    identity.Tenant,
+			Name:        name,
+			Key:         wrapped,
+			MasterKeyID: masterKeyID,
+			CreatedBy:   identity.Name,
+		})
+		if err != nil {
+			return nil, err
+		}
+		if created {
+			auditf(r.Context(), "Created index key %s", name)
+		}
+	}
+	return s.unwrapDEK(r, &storage.DEKDocument{DEK: k.Key, MasterKeyID: k.MasterKeyID, TenantID: k.TenantID})
+}
@@ -0,0 +1,92 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+
+	"my-kms/internal/crypto"
+	"my-kms/internal/metrics"
+	"my-kms/internal/tracing"
+)
+
+// TracingMiddleware starts a server span per request, continuing the trace from the
+// incoming traceparent header when there is one.
+func (s *Server) TracingMiddleware(mux *http.ServeMux, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := "unmatched"
+		if _, pattern := mux.Handler(r); pattern != "" {
+			route = pattern
+		}
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracing.Tracer().Start(ctx, r.Method+" "+route,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPRequestMethodKey.String(r.Method),
+				semconv.HTTPRoute(route),
+				semconv.URLPath(r.URL.Path),
+				attribute.String("kms.request_id", RequestIDFromContext(r.Context())),
+			))
+		defer span.End()
+
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r.WithContext(ctx))
+
+		span.SetAttributes(semconv.HTTPResponseStatusCode(rec.status))
+		if rec.status >= 500 {
+			span.SetStatus(codes.Error, http.StatusText(rec.status))
+		}
+	})
+}
+
+// traceAuth wraps the authentication middleware in its own span. The span ends when the
+// request is authenticated, and the handler's spans hang off the request span, not
+// this one.
+func traceAuth(authenticate func(next http.HandlerFunc) http.HandlerFunc, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		parent := r.Context()
+		ctx, span := tracing.Start(parent, "authenticate")
+		ended := false
+		end := func() {
+			if !ended {
+				ended = true
+				span.End()
+			}
+		}
+		defer end()
+
+		authenticate(func(w http.ResponseWriter, r *http.Request) {
+			if identity, err := getIdentity(r); err == nil {
+				span.SetAttributes(
+					attribute.String("kms.identity", identity.Name),
+					attribute.String("kms.role", string(identity.Role)),
+					attribute.String("kms.tenant", identity.Tenant),
+				)
+			}
+			end()
+			next.ServeHTTP(w, r.WithContext(trace.ContextWithSpan(r.Context(), trace.SpanFromContext(parent))))
+		}).ServeHTTP(w, r.WithContext(ctx))
+	}
+}
+
+// traceCrypto starts a span for an encrypt or decrypt operation. The returned function
+// ends it and records the latency in kms_crypto_operation_duration_seconds.
+func traceCrypto(r *http.Request, operation string, alg crypto.Algorithm) func(error) {
+	start := time.Now()
+	_, span := tracing.Start(r.Context(), operation, attribute.String("kms.algorithm", string(alg)))
+	return func(err error) {
+		metrics.CryptoDuration.Observe(time.Since(start).Seconds(), operation, string(alg))
+		if err != nil {
+			// Never record crypto error details; they can leak oracle information.
+			err = fmt.Errorf("%s failed", operation)
+		}
+		tracing.End(span, err)
+	}
+}
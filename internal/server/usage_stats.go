@@ -0,0 +1,186 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// UsageStats counts requests per endpoint and result, and periodically exports the counts
+// with Laplace noise. It never sees identities, tenants or key IDs, so an export cannot
+// carry them; the noise hides whether any single request happened (epsilon-DP per request).
+type UsageStats struct {
+	epsilon float64
+	path    string // JSON lines file the exports are appended to
+
+	mu          sync.Mutex
+	counts      map[string]*usageCount
+	periodStart time.Time
+}
+
+type usageCount struct {
+	ok, failed int64
+}
+
+// UsageExport is one exported period.
+type UsageExport struct {
+	PeriodStart time.Time                   `json:"periodStart"`
+	PeriodEnd   time.Time                   `json:"periodEnd"`
+	Epsilon     float64                     `json:"epsilon"`
+	Operations  map[string]UsageExportCount `json:"operations"`
+}
+
+// UsageExportCount holds the noisy counts for one endpoint.
+type UsageExportCount struct {
+	OK     int64 `json:"ok"`
+	Failed int64 `json:"failed"`
+}
+
+// NewUsageStats creates a collector that appends exports to path. Smaller epsilon means more noise.
+func NewUsageStats(epsilon float64, path string) (*UsageStats, error) {
+	if epsilon <= 0 || math.IsInf(epsilon, 0) || math.IsNaN(epsilon) {
+		return nil, errors.New("usage export epsilon must be positive")
+	}
+	if path == "" {
+		return nil, errors.New("usage export path is required")
+	}
+	return &UsageStats{
+		epsilon:     epsilon,
+		path:        path,
+		counts:      make(map[string]*usageCount),
+		periodStart: time.Now().UTC(),
+	}, nil
+}
+
+// Middleware counts every request by the mux route pattern it matches; unknown paths count as "other".
+func (u *UsageStats) Middleware(mux *http.ServeMux, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		op := "other"
+		if _, pattern := mux.Handler(r); pattern != "" {
+			op = pattern
+		}
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		u.record(op, rec.status < 400)
+	})
+}
+
+func (u *UsageStats) record(op string, ok bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	c := u.counts[op]
+	if c == nil {
+		c = &usageCount{}
+		u.counts[op] = c
+	}
+	if ok {
+		c.ok++
+	} else {
+		c.failed++
+	}
+}
+
+// Run exports and resets the counts every interval until ctx is cancelled.
+func (u *UsageStats) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := u.Export(); err != nil {
+				errorf(ctx, "Failed to export usage statistics: %v", err)
+			}
+		}
+	}
+}
+
+// Export writes the noisy counts for the period so far and starts a new period.
+func (u *UsageStats) Export() error {
+	u.mu.Lock()
+	counts := u.counts
+	start := u.periodStart
+	u.counts = make(map[string]*usageCount)
+	u.periodStart = time.Now().UTC()
+	u.mu.Unlock()
+
+	exp := UsageExport{
+		PeriodStart: start,
+		PeriodEnd:   u.periodStart,
+		Epsilon:     u.epsilon,
+		Operations:  make(map[string]UsageExportCount, len(counts)),
+	}
+	for op, c := range counts {
+		// ok and failed are disjoint, so each request touches one counter: sensitivity 1.
+		exp.Operations[op] = UsageExportCount{
+			OK:     u.noisy(c.ok),
+			Failed: u.noisy(c.failed),
+		}
+	}
+
+	line, err := json.Marshal(exp)
+	if err != nil {
+		return fmt.Errorf("failed to marshal usage export: %w", err)
+	}
+	f, err := os.OpenFile(u.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to open usage export: %w", err)
+	}
+	defer f.Close()
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("failed to write usage export: %w", err)
+	}
+	logf(context.Background(), "Usage statistics exported for %d operations (epsilon=%g)", len(exp.Operations), u.epsilon)
+	return nil
+}
+
+// noisy adds Laplace(1/epsilon) noise and rounds, clamping at zero.
+func (u *UsageStats) noisy(n int64) int64 {
+	v := math.Round(float64(n) + laplace(1/u.epsilon))
+	if v < 0 {
+		return 0
+	}
+	return int64(v)
+}
+
+// laplace samples from a zero-mean Laplace distribution with scale b using crypto/rand,
+// so the noise cannot be predicted and subtracted.
+func laplace(b float64) float64 {
+	var buf [8]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		panic(fmt.Sprintf("crypto/rand failed: %v", err))
+	}
+	// Uniform in (-0.5, 0.5), excluding the endpoints where the log diverges.
+	uniform := (float64(binary.BigEndian.Uint64(buf[:])>>11)+0.5)/(1<<53) - 0.5
+	if uniform < 0 {
+		return b * math.Log(1+2*uniform)
+	}
+	return -b * math.Log(1-2*uniform)
+}
+
+// statusRecorder remembers the status code written by the wrapped handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	r.status = code
+	r.ResponseWriter.WriteHeader(code)
+}
+
+// Unwrap lets http.ResponseController reach the connection, e.g. to move its write
+// deadline.
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
@@ -0,0 +1,132 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"my-kms/internal/metrics"
+	"my-kms/internal/storage"
+)
+
+// UserFallbackMode decides what happens when the user store cannot be reached.
+type UserFallbackMode string
+
+const (
+	// UserFallbackNone rejects every request until the user store is back.
+	UserFallbackNone UserFallbackMode = "none"
+	// UserFallbackCache serves the last successful lookup, if it is recent enough.
+	UserFallbackCache UserFallbackMode = "cache"
+	// UserFallbackEmergency serves the last successful lookup but allows only DECRYPT.
+	UserFallbackEmergency UserFallbackMode = "emergency"
+)
+
+// ParseUserFallbackMode validates a USER_STORE_FALLBACK value; empty means none.
+func ParseUserFallbackMode(s string) (UserFallbackMode, error) {
+	switch m := UserFallbackMode(s); m {
+	case "":
+		return UserFallbackNone, nil
+	case UserFallbackNone, UserFallbackCache, UserFallbackEmergency:
+		return m, nil
+	default:
+		return "", fmt.Errorf("unknown user store fallback %q (want none, cache or emergency)", s)
+	}
+}
+
+// errUserStoreUnavailable is returned when the store failed and no fallback applies.
+var errUserStoreUnavailable = errors.New("user store unavailable")
+
+// userCache remembers the last good lookup of every user seen. Lookups younger than
+// UserCacheTTL are served from it; older ones only while the store is failing. It
+// holds at most one entry per user in the store.
+type userCache struct {
+	mu      sync.RWMutex
+	entries map[string]cachedUser
+}
+
+type cachedUser struct {
+	user      storage.User
+	fetchedAt time.Time
+}
+
+func newUserCache() *userCache {
+	return &userCache{entries: make(map[string]cachedUser)}
+}
+
+func (c *userCache) put(u *storage.User) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[u.FirebaseUID] = cachedUser{user: *u, fetchedAt: time.Now()}
+}
+
+func (c *userCache) forget(uid string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, uid)
+}
+
+// get returns the cached user if it was fetched within maxAge.
+func (c *userCache) get(uid string, maxAge time.Duration) (*storage.User, time.Duration, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	e, ok := c.entries[uid]
+	if !ok {
+		return nil, 0, false
+	}
+	age := time.Since(e.fetchedAt)
+	if age > maxAge {
+		return nil, age, false
+	}
+	u := e.user
+	return &u, age, true
+}
+
+// lookupUser reads a user from the cache if it was fetched within UserCacheTTL, and
+// otherwise from the store, falling back to the cache according to UserFallback when
+// the store fails. degraded is true for emergency-mode identities. Users that do not
+// exist are never served from the cache.
+func (s *Server) lookupUser(ctx context.Context, uid string) (user *storage.User, degraded bool, err error) {
+	ttl, maxStaleness := s.userCacheTTLs()
+	if ttl > 0 {
+		if cached, _, ok := s.userCache.get(uid, ttl); ok {
+			metrics.UserCacheLookups.Inc("hit")
+			return cached, false, nil
+		}
+		metrics.UserCacheLookups.Inc("miss")
+	}
+	user, err = s.UserStore.GetUserByFirebaseUID(ctx, uid)
+	if err == nil {
+		s.userCache.put(user)
+		return user, false, nil
+	}
+	if errors.Is(err, storage.ErrUserNotFound) {
+		s.userCache.forget(uid)
+		return nil, false, err
+	}
+	if s.UserFallback == UserFallbackNone || s.UserFallback == "" {
+		return nil, false, fmt.Errorf("%w: %v", errUserStoreUnavailable, err)
+	}
+
+	cached, age, ok := s.userCache.get(uid, maxStaleness)
+	if !ok {
+		return nil, false, fmt.Errorf("%w and no fresh cached entry for %s: %v", errUserStoreUnavailable, uid, err)
+	}
+	degraded = s.UserFallback == UserFallbackEmergency
+	auditf(ctx, "user store unavailable (%v); using cached record for %s, %s old, fallback=%s", err, uid, age.Round(time.Second), s.UserFallback)
+	return cached, degraded, nil
+}
+
+// SetUserCacheTTLs changes UserCacheTTL and UserCacheMaxStaleness on a running server.
+func (s *Server) SetUserCacheTTLs(ttl, maxStaleness time.Duration) {
+	s.userCacheMu.Lock()
+	defer s.userCacheMu.Unlock()
+	s.UserCacheTTL, s.UserCacheMaxStaleness = ttl, maxStaleness
+}
+
+func (s *Server) userCacheTTLs() (ttl, maxStaleness time.Duration) {
+	s.userCacheMu.RLock()
+	defer s.userCacheMu.RUnlock()
+	return s.UserCacheTTL, s.UserCacheMaxStaleness
+}
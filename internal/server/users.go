@@ -0,0 +1,275 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"my-kms/internal/auth"
+	"my-kms/internal/storage"
+)
+
+// UserInfo describes a user record.
+type UserInfo struct {
+	FirebaseUID string                `json:"firebaseUID"`
+	Role        string                `json:"role"`
+	TenantID    string                `json:"tenantID,omitempty"`
+	Disabled    bool                  `json:"disabled,omitempty"`
+	Conditions  *auth.AccessCondition `json:"conditions,omitempty"`
+}
+
+func userInfo(u storage.User) UserInfo {
+	return UserInfo{FirebaseUID: u.FirebaseUID, Role: u.Role, TenantID: u.TenantID, Disabled: u.Disabled, Conditions: u.Conditions}
+}
+
+// ---------------------------------------------------------------------
+// Create User
+// ---------------------------------------------------------------------
+
+type CreateUserRequest struct {
+	FirebaseUID string                `json:"firebaseUID" validate:"required"`
+	Role        string                `json:"role" validate:"required"`
+	TenantID    string                `json:"tenantID,omitempty"` // platform admins only; defaults to the caller's tenant
+	Conditions  *auth.AccessCondition `json:"conditions,omitempty"`
+}
+
+func (s *Server) CreateUserHandler(w http.ResponseWriter, r *http.Request) {
+	identity, err := getIdentity(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	if err := auth.IsAuthorized(identity, auth.ActionManageUsers); err != nil {
+		warnf(r.Context(), "Unauthorized attempt by role=%s to create user", identity.Role)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	var req CreateUserRequest
+	if !decodeJSON(w, r.Body, &req) {
+		return
+	}
+	tenant := identity.Tenant
+	if req.TenantID != "" && req.TenantID != identity.Tenant {
+		if identity.Tenant != "" {
+			http.Error(w, "only platform admins may create users in another tenant", http.StatusForbidden)
+			return
+		}
+		tenant = req.TenantID
+	}
+	role, status, err := assignableRole(identity, req.Role)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	if err := validateAccessCondition(req.Conditions); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if _, err := s.UserStore.GetUserByFirebaseUID(r.Context(), req.FirebaseUID); err == nil {
+		http.Error(w, "user already exists", http.StatusConflict)
+		return
+	} else if !errors.Is(err, storage.ErrUserNotFound) {
+		errorf(r.Context(), "Failed to look up user %s: %v", req.FirebaseUID, err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	user := storage.User{FirebaseUID: req.FirebaseUID, Role: string(role), TenantID: tenant, Conditions: normalizeAccessCondition(req.Conditions)}
+	if err := s.UserStore.UpsertUser(r.Context(), user); err != nil {
+		errorf(r.Context(), "Failed to create user %s: %v", req.FirebaseUID, err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	auditf(r.Context(), "user %s created with role %s in tenant %q by %s", user.FirebaseUID, user.Role, user.TenantID, identity.Name)
+
+	writeJSON(w, userInfo(user))
+}
+
+// ---------------------------------------------------------------------
+// Update / Disable User
+// ---------------------------------------------------------------------
+
+type UpdateUserRequest struct {
+	FirebaseUID string                `json:"firebaseUID" validate:"required"`
+	Role        string                `json:"role,omitempty"`
+	Disabled    *bool                 `json:"disabled,omitempty"`   // false re-enables a disabled user
+	Conditions  *auth.AccessCondition `json:"conditions,omitempty"` // replaces the user's; {} clears them
+}
+
+func (s *Server) UpdateUserHandler(w http.ResponseWriter, r *http.Request) {
+	var req UpdateUserRequest
+	s.changeUser(w, r, "/update-user", &req, func(identity auth.Identity, user *storage.User) (int, error) {
+		if req.Role == "" && req.Disabled == nil && req.Conditions == nil {
+			return http.StatusBadRequest, errors.New("role, disabled or conditions is required")
+		}
+		if req.Role != "" {
+			role, status, err := assignableRole(identity, req.Role)
+			if err != nil {
+				return status, err
+			}
+			user.Role = string(role)
+		}
+		if req.Disabled != nil {
+			user.Disabled = *req.Disabled
+		}
+		if req.Conditions != nil {
+			if err := validateAccessCondition(req.Conditions); err != nil {
+				return http.StatusBadRequest, err
+			}
+			user.Conditions = normalizeAccessCondition(req.Conditions)
+		}
+		return 0, nil
+	})
+}
+
+type DisableUserRequest struct {
+	FirebaseUID string `json:"firebaseUID" validate:"required"`
+}
+
+// DisableUserHandler shuts a user out, leaving the DEKs they own as they are; see
+// /offboard-user for a departing user.
+func (s *Server) DisableUserHandler(w http.ResponseWriter, r *http.Request) {
+	var req DisableUserRequest
+	s.changeUser(w, r, "/disable-user", &req, func(_ auth.Identity, user *storage.User) (int, error) {
+		user.Disabled = true
+		return 0, nil
+	})
+}
+
+// changeUser loads the user named by the request decoded into req, lets change modify
+// it and stores the result. change returns the status to answer with if it refuses.
+func (s *Server) changeUser(w http.ResponseWriter, r *http.Request, path string, req interface{ uid() string },
+	change func(auth.Identity, *storage.User) (int, error)) {
+	identity, err := getIdentity(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	if err := auth.IsAuthorized(identity, auth.ActionManageUsers); err != nil {
+		warnf(r.Context(), "Unauthorized attempt by role=%s to change user", identity.Role)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	if !decodeJSON(w, r.Body, req) {
+		return
+	}
+	uid := req.uid()
+	if uid == identity.Name {
+		// An admin demoting or disabling themselves could leave nobody to undo it.
+		http.Error(w, "cannot change your own user", http.StatusBadRequest)
+		return
+	}
+	user, err := s.UserStore.GetUserByFirebaseUID(r.Context(), uid)
+	if errors.Is(err, storage.ErrUserNotFound) || (err == nil && auth.CheckTenant(identity, user.TenantID) != nil && identity.Tenant != "") {
+		http.Error(w, "user not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		errorf(r.Context(), "Failed to look up user %s: %v", uid, err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	// A role the caller couldn't assign is one they can't take away either.
+	if err := checkRoleWithin(identity, auth.Role(user.Role)); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	before := *user
+	if status, err := change(identity, user); err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	if err := s.UserStore.UpsertUser(r.Context(), *user); err != nil {
+		errorf(r.Context(), "Failed to update user %s: %v", uid, err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	// Neither the lookup cache nor the outage fallback may serve the old record.
+	s.userCache.forget(uid)
+	auditf(r.Context(), "user %s changed from role %s (disabled %t, conditions %t) to role %s (disabled %t, conditions %t) by %s",
+		uid, before.Role, before.Disabled, !before.Conditions.Empty(), user.Role, user.Disabled, !user.Conditions.Empty(), identity.Name)
+
+	writeJSON(w, userInfo(*user))
+}
+
+func (req *UpdateUserRequest) uid() string  { return req.FirebaseUID }
+func (req *DisableUserRequest) uid() string { return req.FirebaseUID }
+
+// assignableRole checks that name is a known role granting nothing the caller lacks,
+// and returns it with the status to answer with if not.
+func assignableRole(identity auth.Identity, name string) (auth.Role, int, error) {
+	role := auth.Role(strings.ToUpper(name))
+	if !auth.KnownRole(role) {
+		return "", http.StatusBadRequest, fmt.Errorf("unknown role %q", name)
+	}
+	if err := checkRoleWithin(identity, role); err != nil {
+		return "", http.StatusForbidden, err
+	}
+	return role, 0, nil
+}
+
+// checkRoleWithin reports an action role grants that identity does not hold.
+func checkRoleWithin(identity auth.Identity, role auth.Role) error {
+	for _, a := range auth.AllActions {
+		if auth.IsAuthorized(auth.Identity{Role: role, Tenant: identity.Tenant}, a) == nil && auth.IsAuthorized(identity, a) != nil {
+			return fmt.Errorf("role %s grants %s, which the caller does not hold", role, a)
+		}
+	}
+	return nil
+}
+
+// ---------------------------------------------------------------------
+// List Users
+// ---------------------------------------------------------------------
+
+type ListUsersResponse struct {
+	Users []UserInfo `json:"users"`
+}
+
+// ListUsersHandler lists the users of the caller's tenant. Platform admins see every
+// tenant, or the one named by ?tenantID=.
+func (s *Server) ListUsersHandler(w http.ResponseWriter, r *http.Request) {
+	identity, err := getIdentity(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	if err := auth.IsAuthorized(identity, auth.ActionListUsers); err != nil {
+		warnf(r.Context(), "Unauthorized attempt by role=%s to list users", identity.Role)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	tenant, all := identity.Tenant, identity.Tenant == ""
+	if t, ok := r.URL.Query()["tenantID"]; ok {
+		if identity.Tenant != "" && t[0] != identity.Tenant {
+			http.Error(w, "only platform admins may list users in another tenant", http.StatusForbidden)
+			return
+		}
+		tenant, all = t[0], false
+	}
+
+	users, err := s.UserStore.ListUsers(r.Context())
+	if err != nil {
+		errorf(r.Context(), "Failed to list users: %v", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	resp := ListUsersResponse{Users: []UserInfo{}}
+	for _, u := range users {
+		if all || u.TenantID == tenant {
+			resp.Users = append(resp.Users, userInfo(u))
+		}
+	}
+	sort.Slice(resp.Users, func(i, j int) bool { return resp.Users[i].FirebaseUID < resp.Users[j].FirebaseUID })
+
+	writeJSON(w, resp)
+}
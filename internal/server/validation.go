@@ -0,0 +1,197 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"reflect"
+	"strings"
+)
+
+// DefaultMaxRequestBodyBytes caps JSON request bodies unless configured otherwise.
+// Endpoints that carry a payload get payloadBodyLimit instead.
+const DefaultMaxRequestBodyBytes = 1 << 20
+
+const contentTypeJSON = "application/json"
+
+// payloadRoutes take a plaintext or ciphertext of up to MaxPayloadBytes, base64 in JSON.
+var payloadRoutes = map[string]bool{
+	"/encrypt":              true,
+	"/decrypt":              true,
+	"/re-encrypt":           true,
+	"/encrypt-fields":       true,
+	"/decrypt-fields":       true,
+	"/encrypt-fpe":          true,
+	"/decrypt-fpe":          true,
+	"/tokenize":             true,
+	"/hpke/open":            true,
+	"/create-handoff-token": true,
+	"/redeem-handoff-token": true,
+	transitEncryptPattern:   true,
+	transitDecryptPattern:   true,
+	AWSKMSPath:              true,
+}
+
+// binaryRoutes also take a raw application/octet-stream body.
+var binaryRoutes = map[string]bool{"/encrypt": true, "/decrypt": true}
+
+// payloadBodyLimit is the body limit of payloadRoutes: room for a base64 payload of
+// MaxPayloadBytes and the rest of the request.
+func (s *Server) payloadBodyLimit() int64 {
+	return 2*s.MaxPayloadBytes + 64<<10
+}
+
+// RequestValidationMiddleware refuses request bodies that are too large, before any of
+// them is read, or that are not JSON. The AWS facade speaks its own JSON content types
+// and checks them itself.
+func (s *Server) RequestValidationMiddleware(mux *http.ServeMux, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, pattern := mux.Handler(r)
+		if r.ContentLength == 0 || pattern == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		limit := s.MaxRequestBodyBytes
+		if payloadRoutes[pattern] {
+			limit = s.payloadBodyLimit()
+		}
+		if r.ContentLength > limit {
+			warnf(r.Context(), "Rejected a %d byte body for %s", r.ContentLength, pattern)
+			http.Error(w, (&bodyTooLargeError{limit: limit}).Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, limit)
+
+		if ct := r.Header.Get("Content-Type"); ct != "" && pattern != AWSKMSPath {
+			mt, _, err := mime.ParseMediaType(ct)
+			if err != nil || (mt != contentTypeJSON && !(mt == contentTypeBinary && binaryRoutes[pattern])) {
+				http.Error(w, fmt.Sprintf("unsupported Content-Type %q; send %s", ct, contentTypeJSON), http.StatusUnsupportedMediaType)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// decodeJSON decodes a request body into v, answering the caller itself when it can't:
+// the body must be one JSON object with no fields v doesn't have, and fields tagged
+// validate:"required" must be set.
+func decodeJSON(w http.ResponseWriter, body io.Reader, v interface{}) bool {
+	if err := decodeRequest(body, v, false); err != nil {
+		http.Error(w, err.Error(), requestErrorStatus(err))
+		return false
+	}
+	return true
+}
+
+// decodeOptionalJSON is decodeJSON for endpoints whose body may be left out.
+func decodeOptionalJSON(w http.ResponseWriter, body io.Reader, v interface{}) bool {
+	if err := decodeRequest(body, v, true); err != nil {
+		http.Error(w, err.Error(), requestErrorStatus(err))
+		return false
+	}
+	return true
+}
+
+// decodeRequest is decodeJSON returning the error, whose message names the field at
+// fault where there is one.
+func decodeRequest(body io.Reader, v interface{}, optional bool) error {
+	dec := json.NewDecoder(body)
+	dec.DisallowUnknownFields()
+	err := dec.Decode(v)
+	if err == nil && dec.More() {
+		err = errors.New("invalid request body: unexpected data after the JSON object")
+	}
+	var maxErr *http.MaxBytesError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case err == nil:
+	case errors.Is(err, io.EOF) && optional:
+	case errors.Is(err, io.EOF):
+		return errors.New("request body is required")
+	case errors.As(err, &maxErr):
+		return &bodyTooLargeError{limit: maxErr.Limit}
+	case errors.As(err, &typeErr) && typeErr.Field != "":
+		return fmt.Errorf("invalid request body: %s must be %s", typeErr.Field, jsonKind(typeErr.Type))
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		return fmt.Errorf("invalid request body: unknown field %s", strings.TrimPrefix(err.Error(), "json: unknown field "))
+	case strings.HasPrefix(err.Error(), "invalid request body"):
+		return err
+	default:
+		return errors.New("invalid request body")
+	}
+	return checkRequired(v)
+}
+
+// bodyTooLargeError is returned by decodeRequest past the body limit.
+type bodyTooLargeError struct{ limit int64 }
+
+func (e *bodyTooLargeError) Error() string {
+	return fmt.Sprintf("request body exceeds the %d byte limit", e.limit)
+}
+
+// requestErrorStatus is the HTTP status for an error from decodeRequest.
+func requestErrorStatus(err error) int {
+	var tooLarge *bodyTooLargeError
+	if errors.As(err, &tooLarge) {
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusBadRequest
+}
+
+// checkRequired reports the fields of the struct v points to that are tagged
+// validate:"required" but left zero, by their JSON names.
+func checkRequired(v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.Elem().Kind() != reflect.Struct {
+		return nil
+	}
+	rv = rv.Elem()
+	var missing []string
+	for i := 0; i < rv.NumField(); i++ {
+		f := rv.Type().Field(i)
+		if f.Tag.Get("validate") != "required" || !rv.Field(i).IsZero() {
+			continue
+		}
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "" {
+			name = f.Name
+		}
+		missing = append(missing, name)
+	}
+	switch len(missing) {
+	case 0:
+		return nil
+	case 1:
+		return fmt.Errorf("%s is required", missing[0])
+	default:
+		return fmt.Errorf("%s are required", strings.Join(missing, ", "))
+	}
+}
+
+// jsonKind describes what JSON a Go type decodes from.
+func jsonKind(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.String:
+		return "a string"
+	case reflect.Bool:
+		return "true or false"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "an integer"
+	case reflect.Float32, reflect.Float64:
+		return "a number"
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return "a base64 string"
+		}
+		return "an array"
+	case reflect.Map, reflect.Struct:
+		return "an object"
+	default:
+		return "a " + t.String()
+	}
+}
@@ -0,0 +1,248 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Vault's transit engine, as far as encrypt and decrypt go: POST
+// /v1/transit/encrypt/:name and /v1/transit/decrypt/:name, where name is a key alias.
+// VersionMiddleware has already stripped the /v1, so the routes are /transit/....
+const (
+	transitEncryptPattern = "/transit/encrypt/{name}"
+	transitDecryptPattern = "/transit/decrypt/{name}"
+
+	vaultTokenHeader      = "X-Vault-Token"
+	vaultCiphertextPrefix = "vault:v1:"
+	vaultContextKey       = "vault:context"
+	vaultMaxBatchItems    = 1000
+)
+
+type vaultBatchItem struct {
+	Plaintext  string `json:"plaintext,omitempty"`
+	Ciphertext string `json:"ciphertext,omitempty"`
+	Context    string `json:"context,omitempty"`
+	Reference  string `json:"reference,omitempty"`
+}
+
+type vaultTransitRequest struct {
+	vaultBatchItem
+	KeyVersion                 int              `json:"key_version,omitempty"`
+	BatchInput                 []vaultBatchItem `json:"batch_input,omitempty"`
+	PartialFailureResponseCode int              `json:"partial_failure_response_code,omitempty"`
+}
+
+type vaultBatchResult struct {
+	Ciphertext string `json:"ciphertext,omitempty"`
+	Plaintext  string `json:"plaintext,omitempty"`
+	KeyVersion int    `json:"key_version,omitempty"`
+	Reference  string `json:"reference,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// vaultResponse is Vault's response envelope; the API clients read Data.
+type vaultResponse struct {
+	RequestID     string      `json:"request_id"`
+	LeaseID       string      `json:"lease_id"`
+	Renewable     bool        `json:"renewable"`
+	LeaseDuration int         `json:"lease_duration"`
+	Data          interface{} `json:"data"`
+	WrapInfo      interface{} `json:"wrap_info"`
+	Warnings      []string    `json:"warnings"`
+	Auth          interface{} `json:"auth"`
+}
+
+func writeVaultError(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string][]string{"errors": {msg}})
+}
+
+func writeVaultData(w http.ResponseWriter, r *http.Request, status int, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(vaultResponse{RequestID: RequestIDFromContext(r.Context()), Data: data})
+}
+
+// vaultTokenAuth lets Vault clients authenticate as they always do: X-Vault-Token
+// carries an API key or a Firebase ID token, and is handed to authenticateRequest as
+// the matching header.
+func vaultTokenAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := r.Header.Get(vaultTokenHeader)
+		if token != "" && r.Header.Get("Authorization") == "" && r.Header.Get(APIKeyHeader) == "" {
+			r = r.Clone(r.Context())
+			if strings.HasPrefix(token, apiKeyScheme) {
+				r.Header.Set(APIKeyHeader, token)
+			} else {
+				r.Header.Set("Authorization", "Bearer "+token)
+			}
+		}
+		next.ServeHTTP(w, r)
+	}
+}
+
+// TransitEncryptHandler encrypts under the DEK the alias in the path points to. The
+// ciphertext names the DEK, so it still decrypts after the alias is moved, much as
+// older key versions do in Vault.
+func (s *Server) TransitEncryptHandler(w http.ResponseWriter, r *http.Request) {
+	s.vaultTransit(w, r, "encrypt", s.transitEncrypt)
+}
+
+// TransitDecryptHandler decrypts a vault:v1: ciphertext from TransitEncryptHandler.
+func (s *Server) TransitDecryptHandler(w http.ResponseWriter, r *http.Request) {
+	s.vaultTransit(w, r, "decrypt", s.transitDecrypt)
+}
+
+// vaultTransit runs op on the single item or each batch item of the request. Each
+// item is a native /encrypt or /decrypt call, so it is authorized, metered and
+// audited on its own; the batch counts once against the transit path's rate limit.
+func (s *Server) vaultTransit(w http.ResponseWriter, r *http.Request, opName string, op func(http.ResponseWriter, *http.Request, string, vaultBatchItem) (vaultBatchResult, *nativeError)) {
+	identity, err := getIdentity(r)
+	if err != nil {
+		writeVaultError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	if !s.VaultTransit {
+		writeVaultError(w, http.StatusNotFound, "the Vault transit API is not enabled")
+		return
+	}
+	if r.Method != http.MethodPost && r.Method != http.MethodPut {
+		writeVaultError(w, http.StatusMethodNotAllowed, "unsupported operation")
+		return
+	}
+	name := r.PathValue("name")
+
+	var req vaultTransitRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeVaultError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+	if req.KeyVersion > 1 {
+		writeVaultError(w, http.StatusBadRequest, fmt.Sprintf("key version %d is not available; aliases have a single version", req.KeyVersion))
+		return
+	}
+
+	if req.BatchInput == nil {
+		res, nerr := op(w, r, name, req.vaultBatchItem)
+		if nerr != nil {
+			if nerr.Status >= 500 {
+				errorf(r.Context(), "Vault transit %s failed: %v", opName, nerr)
+			}
+			writeVaultError(w, nerr.Status, nerr.Message)
+			return
+		}
+		auditf(r.Context(), "Vault transit %s with %s by %s", opName, name, identity.Name)
+		writeVaultData(w, r, http.StatusOK, res)
+		return
+	}
+
+	if len(req.BatchInput) > vaultMaxBatchItems {
+		writeVaultError(w, http.StatusBadRequest, fmt.Sprintf("batch_input is limited to %d items", vaultMaxBatchItems))
+		return
+	}
+	results := make([]vaultBatchResult, len(req.BatchInput))
+	failed := 0
+	for i, item := range req.BatchInput {
+		res, nerr := op(w, r, name, item)
+		if nerr != nil {
+			res = vaultBatchResult{Error: nerr.Message}
+			failed++
+		}
+		res.Reference = item.Reference
+		results[i] = res
+	}
+	// Like Vault, any failed item fails the request unless the caller chose a code.
+	status := http.StatusOK
+	if failed > 0 {
+		status = http.StatusBadRequest
+		if req.PartialFailureResponseCode != 0 && failed < len(results) {
+			status = req.PartialFailureResponseCode
+		}
+	}
+	auditf(r.Context(), "Vault transit %s batch of %d (%d failed) with %s by %s", opName, len(results), failed, name, identity.Name)
+	writeVaultData(w, r, status, map[string]interface{}{"batch_results": results})
+}
+
+func (s *Server) transitEncrypt(w http.ResponseWriter, r *http.Request, name string, item vaultBatchItem) (vaultBatchResult, *nativeError) {
+	plaintext, err := base64.StdEncoding.DecodeString(item.Plaintext)
+	if err != nil {
+		return vaultBatchResult{}, &nativeError{Status: http.StatusBadRequest, Message: "failed to base64-decode plaintext"}
+	}
+	if len(plaintext) == 0 {
+		return vaultBatchResult{}, &nativeError{Status: http.StatusBadRequest, Message: "missing plaintext to encrypt"}
+	}
+	defer clear(plaintext)
+	encCtx, nerr := vaultEncryptionContext(item.Context)
+	if nerr != nil {
+		return vaultBatchResult{}, nerr
+	}
+
+	var out EncryptResponse
+	in := EncryptRequest{Alias: name, Plaintext: plaintext, EncryptionContext: encCtx}
+	if nerr := s.callNative(w, r, "/encrypt", s.EncryptHandler, in, &out); nerr != nil {
+		return vaultBatchResult{}, nerr
+	}
+	ciphertext, err := base64.StdEncoding.DecodeString(out.Ciphertext)
+	if err != nil {
+		return vaultBatchResult{}, errNativeInternal
+	}
+	blob := keyedCiphertext(out.DEKID, ciphertext)
+	return vaultBatchResult{Ciphertext: vaultCiphertextPrefix + base64.StdEncoding.EncodeToString(blob), KeyVersion: 1}, nil
+}
+
+func (s *Server) transitDecrypt(w http.ResponseWriter, r *http.Request, name string, item vaultBatchItem) (vaultBatchResult, *nativeError) {
+	encoded, ok := strings.CutPrefix(item.Ciphertext, vaultCiphertextPrefix)
+	if !ok {
+		return vaultBatchResult{}, &nativeError{Status: http.StatusBadRequest, Message: "invalid ciphertext: no prefix"}
+	}
+	blob, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return vaultBatchResult{}, &nativeError{Status: http.StatusBadRequest, Message: "invalid ciphertext: could not decode base64"}
+	}
+	dekID, ciphertext, err := parseKeyedCiphertext(blob)
+	if err != nil {
+		return vaultBatchResult{}, &nativeError{Status: http.StatusBadRequest, Message: "invalid ciphertext: " + err.Error()}
+	}
+	encCtx, nerr := vaultEncryptionContext(item.Context)
+	if nerr != nil {
+		return vaultBatchResult{}, nerr
+	}
+
+	in := DecryptRequest{
+		Alias:             name,
+		Ciphertext:        base64.StdEncoding.EncodeToString(ciphertext),
+		PlaintextEncoding: plaintextEncodingBase64,
+		EncryptionContext: encCtx,
+	}
+	// Once the alias has moved on, decrypt with the DEK the ciphertext names. The
+	// alias's transformers are then not reversed, as they belong to the new key.
+	if s.Aliases != nil {
+		identity, _ := getIdentity(r)
+		if alias, err := s.Aliases.GetAlias(r.Context(), identity.Tenant, name); err == nil && alias.DEKID != dekID {
+			in.Alias, in.DEKID = "", dekID
+		}
+	}
+	var out DecryptResponse
+	if nerr := s.callNative(w, r, "/decrypt", s.DecryptHandler, in, &out); nerr != nil {
+		return vaultBatchResult{}, nerr
+	}
+	defer clear(out.Plaintext)
+	return vaultBatchResult{Plaintext: base64.StdEncoding.EncodeToString(out.Plaintext)}, nil
+}
+
+// vaultEncryptionContext binds Vault's key derivation context, base64 as Vault sends
+// it, to the ciphertext as encryption context.
+func vaultEncryptionContext(context string) (map[string]string, *nativeError) {
+	if context == "" {
+		return nil, nil
+	}
+	if _, err := base64.StdEncoding.DecodeString(context); err != nil {
+		return nil, &nativeError{Status: http.StatusBadRequest, Message: "failed to base64-decode context"}
+	}
+	return map[string]string{vaultContextKey: context}, nil
+}
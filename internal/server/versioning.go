@@ -0,0 +1,131 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"my-kms/internal/metrics"
+)
+
+// APIVersionHeader names the API version that served a request.
+const APIVersionHeader = "X-KMS-API-Version"
+
+// APIVersion is one version of the API, served under /<Name>/. Versions share the
+// handlers; a handler whose request or response shape changes in a later version
+// branches on APIVersionFromContext.
+type APIVersion struct {
+	Name         string
+	DeprecatedAt time.Time // zero while the version is supported
+	SunsetAt     time.Time // when it is expected to be removed; zero if not planned
+}
+
+// apiVersions lists the versions served, oldest first. The last is the current one,
+// which unversioned paths resolve to.
+var apiVersions = []APIVersion{
+	{Name: "v1"},
+}
+
+// unversionedDeprecatedAt is when the API moved under /v1 and the unversioned paths
+// became deprecated aliases.
+var unversionedDeprecatedAt = time.Date(2026, 10, 14, 0, 0, 0, 0, time.UTC)
+
+// operationalPaths are served as they are and never carry deprecation headers: probes
+// and scrapers are configured once and have no API version, and the AWS facade is
+// versioned by its X-Amz-Target.
+var operationalPaths = map[string]bool{"/healthz": true, "/readyz": true, "/metrics": true, AWSKMSPath: true}
+
+// versionedOnlyPatterns arrived after /v1 and have no unversioned alias.
+var versionedOnlyPatterns = map[string]bool{transitEncryptPattern: true, transitDecryptPattern: true}
+
+// LegacyRoutes governs the unversioned paths the API had before /v1.
+type LegacyRoutes struct {
+	Disabled bool      // answer them with 410 Gone instead of serving them
+	SunsetAt time.Time // announced in the Sunset header; zero leaves it out
+}
+
+// ParseLegacyRoutes reads LEGACY_ROUTES ("on" or "off") and LEGACY_ROUTES_SUNSET
+// (RFC 3339, optional).
+func ParseLegacyRoutes(mode, sunset string) (LegacyRoutes, error) {
+	var lr LegacyRoutes
+	switch mode {
+	case "", "on":
+	case "off":
+		lr.Disabled = true
+	default:
+		return lr, fmt.Errorf("unknown legacy routes mode %q (want on or off)", mode)
+	}
+	if sunset != "" {
+		t, err := time.Parse(time.RFC3339, sunset)
+		if err != nil {
+			return lr, fmt.Errorf("legacy routes sunset must be an RFC 3339 timestamp: %w", err)
+		}
+		lr.SunsetAt = t
+	}
+	return lr, nil
+}
+
+type apiVersionKey struct{}
+
+// APIVersionFromContext returns the API version of the request ctx belongs to, or ""
+// for operational endpoints.
+func APIVersionFromContext(ctx context.Context) string {
+	v, _ := ctx.Value(apiVersionKey{}).(string)
+	return v
+}
+
+// VersionMiddleware strips the version prefix, so everything behind it (routes, rate
+// limits, metrics and audit events) sees the same path in every version. An
+// unversioned API path is served as the current version with deprecation headers and
+// a Link to its successor, unless LegacyRoutes disables it.
+func (s *Server) VersionMiddleware(mux *http.ServeMux, next http.Handler) http.Handler {
+	current := apiVersions[len(apiVersions)-1]
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, v := range apiVersions {
+			rest, ok := strings.CutPrefix(r.URL.Path, "/"+v.Name+"/")
+			if !ok {
+				continue
+			}
+			w.Header().Set(APIVersionHeader, v.Name)
+			if !v.DeprecatedAt.IsZero() {
+				setDeprecationHeaders(w, v.DeprecatedAt, v.SunsetAt)
+			}
+			next.ServeHTTP(w, withAPIVersion(r, v.Name, "/"+rest))
+			return
+		}
+
+		if operationalPaths[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		_, pattern := mux.Handler(r)
+		if pattern == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if versionedOnlyPatterns[pattern] {
+			http.NotFound(w, r)
+			return
+		}
+		successor := "/" + current.Name + r.URL.Path
+		if s.LegacyRoutes.Disabled {
+			http.Error(w, fmt.Sprintf("%s has moved to %s", r.URL.Path, successor), http.StatusGone)
+			return
+		}
+		metrics.LegacyRouteRequests.Inc(pattern)
+		w.Header().Set(APIVersionHeader, current.Name)
+		w.Header().Set("Link", fmt.Sprintf("<%s>; rel=\"successor-version\"", successor))
+		setDeprecationHeaders(w, unversionedDeprecatedAt, s.LegacyRoutes.SunsetAt)
+		next.ServeHTTP(w, withAPIVersion(r, current.Name, r.URL.Path))
+	})
+}
+
+func withAPIVersion(r *http.Request, version, path string) *http.Request {
+	r = r.WithContext(context.WithValue(r.Context(), apiVersionKey{}, version))
+	u := *r.URL
+	u.Path, u.RawPath = path, ""
+	r.URL = &u
+	return r
+}
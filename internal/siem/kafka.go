@@ -0,0 +1,38 @@
+package siem
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"my-kms/internal/kafkarest"
+	"my-kms/internal/storage"
+)
+
+// kafkaSink produces events to a topic through the Kafka REST Proxy. Records are keyed
+// by tenant so each tenant's events stay ordered within a partition.
+type kafkaSink struct {
+	producer *kafkarest.Producer
+	topic    string
+}
+
+func newKafkaSink(restURL, topic string, client *http.Client) (*kafkaSink, error) {
+	producer, err := kafkarest.NewProducer(restURL, client)
+	if err != nil {
+		return nil, err
+	}
+	if topic == "" {
+		return nil, fmt.Errorf("Kafka topic is required")
+	}
+	return &kafkaSink{producer: producer, topic: topic}, nil
+}
+
+func (s *kafkaSink) Name() string { return "kafka" }
+
+func (s *kafkaSink) Send(ctx context.Context, events []storage.AuditEvent) error {
+	records := make([]kafkarest.Record, 0, len(events))
+	for _, ev := range events {
+		records = append(records, kafkarest.Record{Key: ev.TenantID, Value: ev})
+	}
+	return s.producer.Produce(ctx, s.topic, records)
+}
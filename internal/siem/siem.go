@@ -0,0 +1,200 @@
+// Package siem streams audit events to external security monitoring systems: CEF over
+// syslog, a signed HTTPS webhook, or a Kafka topic via the Kafka REST Proxy.
+package siem
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"my-kms/internal/logging"
+	"my-kms/internal/storage"
+)
+
+// Sink delivers a batch of audit events; an error means the whole batch is retried.
+type Sink interface {
+	Name() string
+	Send(ctx context.Context, events []storage.AuditEvent) error
+}
+
+// Config selects the sinks to build; each is enabled by setting its address.
+type Config struct {
+	SyslogAddr    string // tcp://, udp:// or tls://host:port
+	WebhookURL    string
+	WebhookSecret string
+	KafkaRESTURL  string
+	KafkaTopic    string
+}
+
+// DefaultTimeout bounds each delivery attempt.
+const DefaultTimeout = 10 * time.Second
+
+// New builds the sinks enabled in cfg.
+func New(cfg Config) ([]Sink, error) {
+	client := &http.Client{Timeout: DefaultTimeout}
+	var sinks []Sink
+	if cfg.SyslogAddr != "" {
+		s, err := newSyslogSink(cfg.SyslogAddr)
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, s)
+	}
+	if cfg.WebhookURL != "" {
+		s, err := newWebhookSink(cfg.WebhookURL, cfg.WebhookSecret, client)
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, s)
+	}
+	if cfg.KafkaRESTURL != "" {
+		s, err := newKafkaSink(cfg.KafkaRESTURL, cfg.KafkaTopic, client)
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, s)
+	}
+	return sinks, nil
+}
+
+// Retry backoff between failed deliveries.
+const (
+	minRetryBackoff = time.Second
+	maxRetryBackoff = time.Minute
+)
+
+// Forwarder buffers events per sink so a slow or unreachable SIEM never blocks a request.
+// When a sink's buffer is full new events for it are dropped and counted.
+type Forwarder struct {
+	queues []*queue
+}
+
+type queue struct {
+	sink    Sink
+	events  chan storage.AuditEvent
+	dropped atomic.Int64
+}
+
+// NewForwarder buffers up to bufferSize events for each sink.
+func NewForwarder(sinks []Sink, bufferSize int) *Forwarder {
+	f := &Forwarder{}
+	for _, s := range sinks {
+		f.queues = append(f.queues, &queue{sink: s, events: make(chan storage.AuditEvent, bufferSize)})
+	}
+	return f
+}
+
+// Names lists the configured sinks.
+func (f *Forwarder) Names() []string {
+	names := make([]string, 0, len(f.queues))
+	for _, q := range f.queues {
+		names = append(names, q.sink.Name())
+	}
+	return names
+}
+
+// Publish queues ev for every sink without blocking.
+func (f *Forwarder) Publish(ev storage.AuditEvent) {
+	for _, q := range f.queues {
+		select {
+		case q.events <- ev:
+		default:
+			if q.dropped.Add(1) == 1 {
+				logging.Warnf("siem", "SIEM sink %s buffer is full; dropping audit events", q.sink.Name())
+			}
+		}
+	}
+}
+
+// Run delivers queued events in batches of up to batchSize, at least every flushInterval,
+// retrying failed batches with backoff until ctx is cancelled.
+func (f *Forwarder) Run(ctx context.Context, batchSize int, flushInterval time.Duration) {
+	done := make(chan struct{})
+	for _, q := range f.queues {
+		go func(q *queue) {
+			q.run(ctx, batchSize, flushInterval)
+			done <- struct{}{}
+		}(q)
+	}
+	for range f.queues {
+		<-done
+	}
+}
+
+func (q *queue) run(ctx context.Context, batchSize int, flushInterval time.Duration) {
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	batch := make([]storage.AuditEvent, 0, batchSize)
+	for {
+		select {
+		case <-ctx.Done():
+			q.flushOnShutdown(batch)
+			return
+		case ev := <-q.events:
+			batch = append(batch, ev)
+			if len(batch) < batchSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+		if !q.deliver(ctx, batch) {
+			q.flushOnShutdown(batch)
+			return
+		}
+		batch = batch[:0]
+	}
+}
+
+// deliver sends batch until it succeeds, or returns false once ctx is cancelled.
+func (q *queue) deliver(ctx context.Context, batch []storage.AuditEvent) bool {
+	backoff := minRetryBackoff
+	for {
+		sendCtx, cancel := context.WithTimeout(ctx, DefaultTimeout)
+		err := q.sink.Send(sendCtx, batch)
+		cancel()
+		if err == nil {
+			if n := q.dropped.Swap(0); n > 0 {
+				logging.Warnf("siem", "SIEM sink %s dropped %d audit events while its buffer was full", q.sink.Name(), n)
+			}
+			return true
+		}
+		logging.Warnf("siem", "SIEM sink %s failed to deliver %d audit events, retrying in %s: %v", q.sink.Name(), len(batch), backoff, err)
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(backoff):
+		}
+		backoff = min(2*backoff, maxRetryBackoff)
+	}
+}
+
+// flushOnShutdown makes one last attempt at whatever is still buffered.
+func (q *queue) flushOnShutdown(batch []storage.AuditEvent) {
+drain:
+	for {
+		select {
+		case ev := <-q.events:
+			batch = append(batch, ev)
+		default:
+			break drain
+		}
+	}
+	if len(batch) == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultTimeout)
+	defer cancel()
+	if err := q.sink.Send(ctx, batch); err != nil {
+		logging.Errorf("siem", "SIEM sink %s lost %d audit events at shutdown: %v", q.sink.Name(), len(batch), err)
+	}
+}
+
+func errStatus(sink string, resp *http.Response) error {
+	return fmt.Errorf("%s returned %s", sink, resp.Status)
+}
@@ -0,0 +1,139 @@
+package siem
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"my-kms/internal/storage"
+)
+
+// syslogSink writes one RFC 5424 syslog message per event with a CEF payload. Stream
+// transports use newline framing; the connection is re-dialled after any error.
+type syslogSink struct {
+	network  string // tcp, udp or tls
+	addr     string
+	hostname string
+	conn     net.Conn
+}
+
+func newSyslogSink(rawAddr string) (*syslogSink, error) {
+	u, err := url.Parse(rawAddr)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("syslog address must look like tcp://host:port, udp://host:port or tls://host:port")
+	}
+	switch u.Scheme {
+	case "tcp", "udp", "tls":
+	default:
+		return nil, fmt.Errorf("unsupported syslog transport %q", u.Scheme)
+	}
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "-"
+	}
+	return &syslogSink{network: u.Scheme, addr: u.Host, hostname: hostname}, nil
+}
+
+func (s *syslogSink) Name() string { return "syslog" }
+
+func (s *syslogSink) Send(ctx context.Context, events []storage.AuditEvent) error {
+	if s.conn == nil {
+		conn, err := s.dial(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to connect to syslog at %s: %w", s.addr, err)
+		}
+		s.conn = conn
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		s.conn.SetWriteDeadline(deadline)
+	}
+	for _, ev := range events {
+		msg := s.format(ev)
+		if s.network != "udp" {
+			msg += "\n"
+		}
+		if _, err := s.conn.Write([]byte(msg)); err != nil {
+			s.conn.Close()
+			s.conn = nil
+			return fmt.Errorf("failed to write to syslog at %s: %w", s.addr, err)
+		}
+	}
+	return nil
+}
+
+func (s *syslogSink) dial(ctx context.Context) (net.Conn, error) {
+	if s.network == "tls" {
+		d := &tls.Dialer{Config: &tls.Config{MinVersion: tls.VersionTLS12}}
+		return d.DialContext(ctx, "tcp", s.addr)
+	}
+	var d net.Dialer
+	return d.DialContext(ctx, s.network, s.addr)
+}
+
+// Syslog facility "security/authorization" (4 << 3, i.e. 32) plus the severity.
+const syslogFacilityAuth = 4 << 3
+
+func (s *syslogSink) format(ev storage.AuditEvent) string {
+	severity := 6 // informational
+	if ev.Result != storage.AuditResultSuccess {
+		severity = 4 // warning
+	}
+	return fmt.Sprintf("<%d>1 %s %s my-kms - - - %s",
+		syslogFacilityAuth+severity, ev.Time.UTC().Format(time.RFC3339Nano), s.hostname, FormatCEF(ev))
+}
+
+// FormatCEF renders ev as an ArcSight Common Event Format record.
+func FormatCEF(ev storage.AuditEvent) string {
+	severity := 3
+	switch ev.Result {
+	case storage.AuditResultDenied:
+		severity = 7
+	case storage.AuditResultError:
+		severity = 5
+	}
+
+	ext := []string{
+		"rt=" + strconv.FormatInt(ev.Time.UnixMilli(), 10),
+		"outcome=" + cefValue(ev.Result),
+	}
+	add := func(key, value string) {
+		if value != "" {
+			ext = append(ext, key+"="+cefValue(value))
+		}
+	}
+	add("suser", ev.Identity)
+	add("spriv", ev.Role)
+	if host, _, err := net.SplitHostPort(ev.RemoteAddr); err == nil && net.ParseIP(host) != nil {
+		add("src", host)
+	}
+	add("cs1Label", "tenant")
+	add("cs1", ev.TenantID)
+	add("cs2Label", "keyID")
+	add("cs2", ev.KeyID)
+	add("cs3Label", "requestID")
+	add("cs3", ev.RequestID)
+	if ev.Status != 0 {
+		ext = append(ext, "cn1Label=status", "cn1="+strconv.Itoa(ev.Status))
+	}
+	if ev.Seq != 0 {
+		ext = append(ext, "cn2Label=seq", "cn2="+strconv.FormatInt(ev.Seq, 10))
+	}
+	add("msg", strings.Join(ev.Details, "; "))
+
+	return fmt.Sprintf("CEF:0|my-kms|kms|1.0|%s|%s|%d|%s",
+		cefHeader(ev.Action), cefHeader(ev.Action+" "+ev.Result), severity, strings.Join(ext, " "))
+}
+
+var (
+	cefHeaderEscaper = strings.NewReplacer(`\`, `\\`, `|`, `\|`, "\n", " ", "\r", " ")
+	cefValueEscaper  = strings.NewReplacer(`\`, `\\`, `=`, `\=`, "\n", `\n`, "\r", `\r`)
+)
+
+func cefHeader(s string) string { return cefHeaderEscaper.Replace(s) }
+func cefValue(s string) string  { return cefValueEscaper.Replace(s) }
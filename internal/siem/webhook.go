@@ -0,0 +1,83 @@
+package siem
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"my-kms/internal/storage"
+)
+
+// Webhook request headers. The signature is HMAC-SHA256 over "<timestamp>.<body>", so a
+// receiver can reject both forged and replayed deliveries.
+const (
+	WebhookSignatureHeader = "X-KMS-Signature"
+	WebhookTimestampHeader = "X-KMS-Timestamp"
+)
+
+type webhookSink struct {
+	url    string
+	secret []byte
+	client *http.Client
+}
+
+func newWebhookSink(rawURL, secret string, client *http.Client) (*webhookSink, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Scheme != "https" || u.Host == "" {
+		return nil, fmt.Errorf("audit webhook URL must be an https URL")
+	}
+	if len(secret) < 16 {
+		return nil, fmt.Errorf("audit webhook secret must be at least 16 characters")
+	}
+	return &webhookSink{url: rawURL, secret: []byte(secret), client: client}, nil
+}
+
+func (s *webhookSink) Name() string { return "webhook" }
+
+func (s *webhookSink) Send(ctx context.Context, events []storage.AuditEvent) error {
+	body, err := json.Marshal(struct {
+		Events []storage.AuditEvent `json:"events"`
+	}{events})
+	if err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookTimestampHeader, timestamp)
+	req.Header.Set(WebhookSignatureHeader, "sha256="+SignWebhook(s.secret, timestamp, body))
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("audit webhook request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errStatus("audit webhook", resp)
+	}
+	return nil
+}
+
+// SignWebhook returns the hex signature a receiver should compare against the
+// X-KMS-Signature header (after its "sha256=" prefix).
+func SignWebhook(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,120 @@
+package snapshot
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"my-kms/internal/crypto"
+	"my-kms/internal/storage"
+)
+
+// FormatVersion is bumped whenever the snapshot layout changes incompatibly.
+const FormatVersion = 1
+
+// Settings holds the non-secret parts of the server configuration.
+// Mongo URIs, master keys and credential paths are deliberately excluded.
+type Settings struct {
+	StorageBackend       string `json:"storageBackend,omitempty"`
+	MongoDBName          string `json:"mongoDBName"`
+	MongoUsersCollection string `json:"mongoUsersCollection"`
+	MongoDEKCollection   string `json:"mongoDEKCollection"`
+}
+
+// Snapshot is the runtime configuration needed to reconstitute a deployment.
+// It never contains key material.
+type Snapshot struct {
+	Version   int            `json:"version"`
+	CreatedAt time.Time      `json:"createdAt"`
+	Settings  Settings       `json:"settings"`
+	Users     []storage.User `json:"users"`
+
+	Roles []storage.RoleDefinition `json:"roles,omitempty"`
+}
+
+// envelope is the on-disk format: an encrypted snapshot plus an HMAC over the header and ciphertext.
+type envelope struct {
+	Version    int       `json:"version"`
+	CreatedAt  time.Time `json:"createdAt"`
+	Ciphertext []byte    `json:"ciphertext"`
+	Signature  []byte    `json:"signature"`
+}
+
+// Seal encrypts and signs a snapshot with subkeys derived from key.
+func Seal(snap *Snapshot, key []byte) ([]byte, error) {
+	encKey, sigKey, err := deriveKeys(key)
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext, err := json.Marshal(snap)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal snapshot: %w", err)
+	}
+
+	ciphertext, err := crypto.EncryptAES256GCM(encKey, plaintext)
+	if err != nil {
+		return nil, err
+	}
+
+	env := envelope{
+		Version:    snap.Version,
+		CreatedAt:  snap.CreatedAt,
+		Ciphertext: ciphertext,
+	}
+	env.Signature = sign(sigKey, &env)
+	return json.MarshalIndent(env, "", "  ")
+}
+
+// Open verifies and decrypts a sealed snapshot.
+func Open(data, key []byte) (*Snapshot, error) {
+	encKey, sigKey, err := deriveKeys(key)
+	if err != nil {
+		return nil, err
+	}
+
+	var env envelope
+	if err := json.Unmarshal(data, &env); err != nil {
+		return nil, fmt.Errorf("failed to parse snapshot: %w", err)
+	}
+	if env.Version != FormatVersion {
+		return nil, fmt.Errorf("unsupported snapshot version %d", env.Version)
+	}
+	if !hmac.Equal(env.Signature, sign(sigKey, &env)) {
+		return nil, errors.New("snapshot signature verification failed")
+	}
+
+	plaintext, err := crypto.DecryptAES256GCM(encKey, env.Ciphertext)
+	if err != nil {
+		return nil, err
+	}
+
+	var snap Snapshot
+	if err := json.Unmarshal(plaintext, &snap); err != nil {
+		return nil, fmt.Errorf("failed to decode snapshot: %w", err)
+	}
+	return &snap, nil
+}
+
+func sign(sigKey []byte, env *envelope) []byte {
+	mac := hmac.New(sha256.New, sigKey)
+	fmt.Fprintf(mac, "%d|%s|", env.Version, env.CreatedAt.UTC().Format(time.RFC3339Nano))
+	mac.Write(env.Ciphertext)
+	return mac.Sum(nil)
+}
+
+// deriveKeys splits the snapshot key into independent encryption and signing keys.
+func deriveKeys(key []byte) ([]byte, []byte, error) {
+	if len(key) != crypto.KeySize {
+		return nil, nil, errors.New("snapshot key must be 32 bytes")
+	}
+	derive := func(label string) []byte {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(label))
+		return mac.Sum(nil)
+	}
+	return derive("kms-snapshot-encryption"), derive("kms-snapshot-signing"), nil
+}
@@ -0,0 +1,40 @@
+package storage
+
+import (
+	"context"
+	"errors"
+
+	"my-kms/internal/metrics"
+)
+
+// FailoverDEKStore reads a DEK from a replica in another region when the local store
+// cannot find it, because it hasn't replicated yet, or cannot be reached. Everything
+// else, writes included, goes to the local store only.
+type FailoverDEKStore struct {
+	DEKStore
+	replica DEKStore
+}
+
+// NewFailoverDEKStore wraps store with reads that fall back to replica.
+func NewFailoverDEKStore(store, replica DEKStore) *FailoverDEKStore {
+	return &FailoverDEKStore{DEKStore: store, replica: replica}
+}
+
+// GetDEK retrieves a DEK from the local store, falling back to the replica. If both
+// fail it returns the local store's error.
+func (f *FailoverDEKStore) GetDEK(ctx context.Context, tenantID, id string) (*DEKDocument, error) {
+	doc, err := f.DEKStore.GetDEK(ctx, tenantID, id)
+	if err == nil || ctx.Err() != nil {
+		return doc, err
+	}
+	reason := "error"
+	if errors.Is(err, ErrDEKNotFound) {
+		reason = "not_found"
+	}
+	replicaDoc, replicaErr := f.replica.GetDEK(ctx, tenantID, id)
+	if replicaErr != nil {
+		return nil, err
+	}
+	metrics.DEKReplicaReads.Inc(reason)
+	return replicaDoc, nil
+}
@@ -0,0 +1,127 @@
+package storage
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/mlkem"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+
+	"my-kms/internal/secmem"
+)
+
+// WrapMode is how a master key wraps DEKs.
+type WrapMode string
+
+const (
+	// WrapModeAES seals DEKs with the master key under AES-256-GCM.
+	WrapModeAES WrapMode = "AES_256_GCM"
+
+	// WrapModeHybrid (experimental) also encapsulates a fresh ML-KEM-768 secret per wrap
+	// and seals under a key derived from both, so a wrapped DEK stays safe as long as
+	// either the AES key or ML-KEM holds. Archives recorded now can't be opened later by
+	// breaking a single primitive.
+	WrapModeHybrid WrapMode = "MLKEM768_AES_256_GCM"
+)
+
+// ParseWrapMode validates a wrap mode name. An empty name yields WrapModeAES.
+func ParseWrapMode(name string) (WrapMode, error) {
+	switch WrapMode(name) {
+	case "", WrapModeAES:
+		return WrapModeAES, nil
+	case WrapModeHybrid:
+		return WrapModeHybrid, nil
+	default:
+		return "", fmt.Errorf("unknown master key wrap mode %q; expected %s or %s", name, WrapModeAES, WrapModeHybrid)
+	}
+}
+
+// hybridEnvelopeV1 starts every hybrid envelope: the version byte, the ML-KEM-768
+// ciphertext, then the AES-256-GCM nonce and sealed DEK. AES envelopes have no header.
+const hybridEnvelopeV1 = 0x01
+
+const hybridWrapInfo = "kms-hybrid-wrap-v1"
+
+// NewKEMSeed returns a fresh ML-KEM-768 decapsulation key seed, from secmem, for a
+// hybrid master key.
+func NewKEMSeed() ([]byte, error) {
+	seed, err := secmem.New(mlkem.SeedSize)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(seed); err != nil {
+		return nil, err
+	}
+	return seed, nil
+}
+
+// hybridKEK derives the AES-256-GCM key sealing one DEK from the master key, the
+// ML-KEM shared secret and the ML-KEM ciphertext carrying it.
+func hybridKEK(masterKey, sharedKey, kemCiphertext []byte) (cipher.AEAD, error) {
+	secret := append(append(make([]byte, 0, len(masterKey)+len(sharedKey)), masterKey...), sharedKey...)
+	defer secmem.Zero(secret)
+	info := append([]byte(hybridWrapInfo), kemCiphertext...)
+	kek := make([]byte, 32)
+	defer secmem.Zero(kek)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, secret, nil, info), kek); err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// hybridWrap seals dek under mk, which must have a KEMSeed.
+func hybridWrap(mk MasterKey, dek []byte) ([]byte, error) {
+	dk, err := mlkem.NewDecapsulationKey768(mk.KEMSeed)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ML-KEM seed for master key %s: %w", mk.ID, err)
+	}
+	sharedKey, kemCiphertext := dk.EncapsulationKey().Encapsulate()
+	defer secmem.Zero(sharedKey)
+	gcm, err := hybridKEK(mk.Key, sharedKey, kemCiphertext)
+	if err != nil {
+		return nil, err
+	}
+
+	envelope := append([]byte{hybridEnvelopeV1}, kemCiphertext...)
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	envelope = append(envelope, nonce...)
+	return gcm.Seal(envelope, nonce, dek, []byte{hybridEnvelopeV1}), nil
+}
+
+// hybridUnwrap opens an envelope from hybridWrap.
+func hybridUnwrap(mk MasterKey, envelope []byte) ([]byte, error) {
+	if len(envelope) == 0 || envelope[0] != hybridEnvelopeV1 {
+		return nil, fmt.Errorf("master key %s is hybrid but the DEK is not in a hybrid envelope", mk.ID)
+	}
+	if len(envelope) < 1+mlkem.CiphertextSize768+12 {
+		return nil, errors.New("ciphertext too short")
+	}
+	dk, err := mlkem.NewDecapsulationKey768(mk.KEMSeed)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ML-KEM seed for master key %s: %w", mk.ID, err)
+	}
+	kemCiphertext := envelope[1 : 1+mlkem.CiphertextSize768]
+	sharedKey, err := dk.Decapsulate(kemCiphertext)
+	if err != nil {
+		return nil, err
+	}
+	defer secmem.Zero(sharedKey)
+	gcm, err := hybridKEK(mk.Key, sharedKey, kemCiphertext)
+	if err != nil {
+		return nil, err
+	}
+	rest := envelope[1+mlkem.CiphertextSize768:]
+	return gcm.Open(nil, rest[:gcm.NonceSize()], rest[gcm.NonceSize():], []byte{hybridEnvelopeV1})
+}
@@ -1,31 +1,124 @@
 package storage
 
 import (
+	"bytes"
 	"context"
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/mlkem"
 	"crypto/rand"
+	"crypto/sha256"
 	"errors"
+	"fmt"
+	"maps"
+	"sort"
 	"sync"
+	"time"
 
 	"github.com/google/uuid"
+
+	"my-kms/internal/secmem"
 )
 
-// MasterKey represents a master key with an ID and the key bytes.
+// MasterKey represents a master key with an ID and the key bytes. A retired key keeps
+// its ID and dates, and the public halves of its signing keys, but no key bytes.
 type MasterKey struct {
-	ID  string
-	Key []byte
+	ID        string
+	Key       []byte
+	CreatedAt time.Time // zero when unknown, as for keys from MASTER_KEYS
+	RetiredAt time.Time
+
+	// KEMSeed is the ML-KEM-768 seed of a WrapModeHybrid key, nil for an AES key.
+	KEMSeed []byte
+
+	// VerifyKeys holds, for a retired key, the Ed25519 public key DeriveSigningKey gave
+	// for each purpose, so what it signed can still be verified.
+	VerifyKeys map[string]ed25519.PublicKey
+}
+
+// WrapMode returns how k wraps DEKs.
+func (k MasterKey) WrapMode() WrapMode {
+	if k.KEMSeed != nil {
+		return WrapModeHybrid
+	}
+	return WrapModeAES
+}
+
+func validKEMSeed(k MasterKey) error {
+	if k.KEMSeed != nil && len(k.KEMSeed) != mlkem.SeedSize {
+		return fmt.Errorf("ML-KEM seed of master key %s must be %d bytes", k.ID, mlkem.SeedSize)
+	}
+	return nil
+}
+
+// cloneKeyMaterial returns k with its key and ML-KEM seed copied into secmem.
+func cloneKeyMaterial(k MasterKey) (MasterKey, error) {
+	c := k
+	c.Key, c.KEMSeed = nil, nil
+	var err error
+	if k.Key != nil {
+		if c.Key, err = secmem.Clone(k.Key); err != nil {
+			return MasterKey{}, err
+		}
+	}
+	if k.KEMSeed != nil {
+		if c.KEMSeed, err = secmem.Clone(k.KEMSeed); err != nil {
+			secmem.Zero(c.Key)
+			return MasterKey{}, err
+		}
+	}
+	return c, nil
+}
+
+// MasterKeyState is where a master key is in its lifecycle.
+type MasterKeyState string
+
+const (
+	MasterKeyStateActive      MasterKeyState = "ACTIVE"       // wraps new DEKs
+	MasterKeyStateDecryptOnly MasterKeyState = "DECRYPT_ONLY" // replaced by a rotation; only unwraps
+	MasterKeyStateRetired     MasterKeyState = "RETIRED"      // destroyed; refuses even to unwrap
+)
+
+// MasterKeyInfo describes a master key without its material.
+type MasterKeyInfo struct {
+	ID        string
+	State     MasterKeyState
+	WrapMode  WrapMode // empty for a retired key
+	CreatedAt time.Time
+	RetiredAt time.Time
+}
+
+// MasterKeyRotation records one master key rotation.
+type MasterKeyRotation struct {
+	KeyID         string    `json:"keyID"`
+	PreviousKeyID string    `json:"previousKeyID"`
+	RotatedBy     string    `json:"rotatedBy"`
+	RotatedAt     time.Time `json:"rotatedAt"`
 }
 
-// MasterKeyStore manages master keys in memory.
+// MasterKeyStore manages master keys in memory. It keeps its own copies of the keys,
+// from secmem, and zeroes them when they are dropped.
 type MasterKeyStore struct {
 	masterKeys  map[string]MasterKey
 	activeKeyID string
+	rotations   []MasterKeyRotation
+	activatedAt time.Time // when the active key became active in this process
 	mu          sync.RWMutex
+
+	// persist, when set, records the keys after a rotation; the rotation fails with it.
+	persist func(keys []MasterKey) error
+
+	// wrapGuard, when set, is asked before each wrap under a master key and fails it.
+	wrapGuard func(ctx context.Context, masterKeyID string) error
+
+	// newKeyMode is the wrap mode of keys RotateMasterKey creates.
+	newKeyMode WrapMode
 }
 
-// NewMasterKeyStore initializes a new MasterKeyStore with the provided master keys.
-// It sets the first key as the active key.
+// NewMasterKeyStore initializes a new MasterKeyStore with copies of the provided master
+// keys. It sets the first key as the active key.
 func NewMasterKeyStore(keys []MasterKey) (*MasterKeyStore, error) {
 	if len(keys) == 0 {
 		return nil, errors.New("no master keys provided")
@@ -36,15 +129,118 @@ func NewMasterKeyStore(keys []MasterKey) (*MasterKeyStore, error) {
 		if len(k.Key) != 32 {
 			return nil, errors.New("master key must be 32 bytes for AES-256")
 		}
-		mkMap[k.ID] = k
+		if err := validKEMSeed(k); err != nil {
+			return nil, err
+		}
+		key, err := cloneKeyMaterial(MasterKey{ID: k.ID, Key: k.Key, KEMSeed: k.KEMSeed})
+		if err != nil {
+			return nil, err
+		}
+		mkMap[k.ID] = key
 	}
 
 	return &MasterKeyStore{
 		masterKeys:  mkMap,
 		activeKeyID: keys[0].ID,
+		activatedAt: time.Now().UTC(),
 	}, nil
 }
 
+// NewSealedMasterKeyStore returns a MasterKeyStore holding no keys, which fails every
+// operation until Unseal loads them.
+func NewSealedMasterKeyStore() *MasterKeyStore {
+	return &MasterKeyStore{masterKeys: make(map[string]MasterKey)}
+}
+
+// Unseal loads keys, the first of which becomes active, into a sealed store. persist,
+// if not nil, is handed the full key set, active key first, whenever a rotation or
+// retirement changes it.
+func (m *MasterKeyStore) Unseal(keys []MasterKey, persist func([]MasterKey) error) error {
+	if len(keys) == 0 {
+		return errors.New("no master keys provided")
+	}
+	if !keys[0].RetiredAt.IsZero() {
+		return errors.New("the active master key is retired")
+	}
+	for _, k := range keys {
+		if k.RetiredAt.IsZero() && len(k.Key) != 32 {
+			return errors.New("master key must be 32 bytes for AES-256")
+		}
+		if err := validKEMSeed(k); err != nil {
+			return err
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.masterKeys) > 0 {
+		return errors.New("master keys are already loaded")
+	}
+	for _, k := range keys {
+		c, err := cloneKeyMaterial(k)
+		if err != nil {
+			m.seal()
+			return err
+		}
+		c.VerifyKeys = maps.Clone(k.VerifyKeys)
+		m.masterKeys[k.ID] = c
+	}
+	m.activeKeyID = keys[0].ID
+	m.activatedAt = time.Now().UTC()
+	m.persist = persist
+	return nil
+}
+
+// Seal zeroes and drops every master key, returning the store to its sealed state.
+func (m *MasterKeyStore) Seal() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.seal()
+}
+
+// seal is Seal with mu held.
+func (m *MasterKeyStore) seal() {
+	for id, k := range m.masterKeys {
+		secmem.Zero(k.Key)
+		secmem.Zero(k.KEMSeed)
+		delete(m.masterKeys, id)
+	}
+	m.activeKeyID = ""
+	m.persist = nil
+}
+
+// Sealed reports whether the store holds no master keys.
+func (m *MasterKeyStore) Sealed() bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return len(m.masterKeys) == 0
+}
+
+// Persistent reports whether rotations and retirements are saved, which is the case
+// for keys kept in a keyring rather than in MASTER_KEYS.
+func (m *MasterKeyStore) Persistent() bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.persist != nil
+}
+
+// keyList returns every key, retired ones included, with the active one first. The
+// caller holds mu.
+func (m *MasterKeyStore) keyList() []MasterKey {
+	keys := []MasterKey{m.masterKeys[m.activeKeyID]}
+	ids := make([]string, 0, len(m.masterKeys))
+	for id := range m.masterKeys {
+		if id != m.activeKeyID {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		keys = append(keys, m.masterKeys[id])
+	}
+	return keys
+}
+
 func (m *MasterKeyStore) GetActiveKey() (MasterKey, error) {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
@@ -56,14 +252,64 @@ func (m *MasterKeyStore) GetActiveKey() (MasterKey, error) {
 	return key, nil
 }
 
-// EncryptDataKey encrypts the DEK using the active master key.
-func (m *MasterKeyStore) EncryptDataKey(dek []byte) ([]byte, string, error) {
+// HasKey reports whether the master key with the given ID is loaded and not retired.
+func (m *MasterKeyStore) HasKey(id string) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	_, err := m.usable(id)
+	return err == nil
+}
+
+// usable returns the master key id unless it is missing or retired. The caller holds mu.
+func (m *MasterKeyStore) usable(id string) (MasterKey, error) {
+	mk, exists := m.masterKeys[id]
+	if !exists {
+		return MasterKey{}, errors.New("specified master key not found")
+	}
+	if !mk.RetiredAt.IsZero() {
+		return MasterKey{}, fmt.Errorf("master key %s is retired", id)
+	}
+	return mk, nil
+}
+
+// SetNewKeyWrapMode sets the wrap mode of the keys RotateMasterKey creates from now on.
+// Existing keys keep theirs.
+func (m *MasterKeyStore) SetNewKeyWrapMode(mode WrapMode) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.newKeyMode = mode
+}
+
+// SetWrapGuard has guard approve every wrap before EncryptDataKey seals under a master
+// key, such as to count them against AES-GCM's bound on random nonces.
+func (m *MasterKeyStore) SetWrapGuard(guard func(ctx context.Context, masterKeyID string) error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.wrapGuard = guard
+}
+
+// EncryptDataKey encrypts the DEK using the active master key. DECRYPT_ONLY keys never
+// wrap. ctx bounds the wrap guard.
+func (m *MasterKeyStore) EncryptDataKey(ctx context.Context, dek []byte) ([]byte, string, error) {
 	m.mu.RLock()
 	activeKey, exists := m.masterKeys[m.activeKeyID]
+	guard := m.wrapGuard
 	m.mu.RUnlock()
 	if !exists {
 		return nil, "", errors.New("active master key not found")
 	}
+	if guard != nil {
+		if err := guard(ctx, activeKey.ID); err != nil {
+			return nil, "", err
+		}
+	}
+	if activeKey.KEMSeed != nil {
+		wrapped, err := hybridWrap(activeKey, dek)
+		if err != nil {
+			return nil, "", err
+		}
+		return wrapped, activeKey.ID, nil
+	}
 
 	block, err := aes.NewCipher(activeKey.Key)
 	if err != nil {
@@ -84,13 +330,16 @@ func (m *MasterKeyStore) EncryptDataKey(dek []byte) ([]byte, string, error) {
 	return ciphertext, activeKey.ID, nil
 }
 
-// DecryptDataKey decrypts the DEK with the specified master key ID.
+// DecryptDataKey decrypts the DEK with the specified master key ID, unless it is retired.
 func (m *MasterKeyStore) DecryptDataKey(encryptedDEK []byte, masterKeyID string) ([]byte, error) {
 	m.mu.RLock()
-	mk, exists := m.masterKeys[masterKeyID]
+	mk, err := m.usable(masterKeyID)
 	m.mu.RUnlock()
-	if !exists {
-		return nil, errors.New("specified master key not found")
+	if err != nil {
+		return nil, err
+	}
+	if mk.KEMSeed != nil {
+		return hybridUnwrap(mk, encryptedDEK)
 	}
 
 	block, err := aes.NewCipher(mk.Key)
@@ -115,26 +364,229 @@ func (m *MasterKeyStore) DecryptDataKey(encryptedDEK []byte, masterKeyID string)
 	return dek, nil
 }
 
+// KeyIDs returns the IDs of all usable master keys, sorted, and the active one.
+// Retired keys are left out.
+func (m *MasterKeyStore) KeyIDs() ([]string, string) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	ids := make([]string, 0, len(m.masterKeys))
+	for id, mk := range m.masterKeys {
+		if mk.RetiredAt.IsZero() {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids, m.activeKeyID
+}
+
+// ActiveKeyAge reports how long the active key has been active. A key becomes active
+// when it is created, so that is used when known; keys loaded from MASTER_KEYS count
+// from process start instead.
+func (m *MasterKeyStore) ActiveKeyAge() time.Duration {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if created := m.masterKeys[m.activeKeyID].CreatedAt; !created.IsZero() {
+		return time.Since(created)
+	}
+	return time.Since(m.activatedAt)
+}
+
+// Keys describes every master key, retired ones included, sorted by ID.
+func (m *MasterKeyStore) Keys() []MasterKeyInfo {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	infos := make([]MasterKeyInfo, 0, len(m.masterKeys))
+	for id, mk := range m.masterKeys {
+		info := MasterKeyInfo{ID: id, State: MasterKeyStateDecryptOnly, WrapMode: mk.WrapMode(), CreatedAt: mk.CreatedAt, RetiredAt: mk.RetiredAt}
+		switch {
+		case !mk.RetiredAt.IsZero():
+			info.State = MasterKeyStateRetired
+			info.WrapMode = "" // no longer known once the material is gone
+		case id == m.activeKeyID:
+			info.State = MasterKeyStateActive
+		}
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ID < infos[j].ID })
+	return infos
+}
+
+// Rotations returns the rotations performed since the process started, oldest first.
+func (m *MasterKeyStore) Rotations() []MasterKeyRotation {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return append([]MasterKeyRotation(nil), m.rotations...)
+}
+
 // RotateMasterKey generates a new master key, adds it to the store, and sets it active.
-func (m *MasterKeyStore) RotateMasterKey() (MasterKey, error) {
-	newKeyBytes := make([]byte, 32)
+func (m *MasterKeyStore) RotateMasterKey(rotatedBy string) (MasterKey, error) {
+	newKeyBytes, err := secmem.New(32)
+	if err != nil {
+		return MasterKey{}, err
+	}
 	if _, err := rand.Read(newKeyBytes); err != nil {
 		return MasterKey{}, err
 	}
 
 	newKeyID := uuid.New().String()
 	newMK := MasterKey{
-		ID:  newKeyID,
-		Key: newKeyBytes,
+		ID:        newKeyID,
+		Key:       newKeyBytes,
+		CreatedAt: time.Now().UTC(),
 	}
 
 	m.mu.Lock()
 	defer m.mu.Unlock()
+	if m.newKeyMode == WrapModeHybrid {
+		if newMK.KEMSeed, err = NewKEMSeed(); err != nil {
+			secmem.Zero(newKeyBytes)
+			return MasterKey{}, err
+		}
+	}
+	if len(m.masterKeys) == 0 {
+		secmem.Zero(newKeyBytes)
+		secmem.Zero(newMK.KEMSeed)
+		return MasterKey{}, errors.New("master keys are sealed")
+	}
+	if m.persist != nil {
+		if err := m.persist(append([]MasterKey{newMK}, m.keyList()...)); err != nil {
+			secmem.Zero(newKeyBytes)
+			secmem.Zero(newMK.KEMSeed)
+			return MasterKey{}, fmt.Errorf("failed to persist master keys: %w", err)
+		}
+	}
 	m.masterKeys[newKeyID] = newMK
+	m.rotations = append(m.rotations, MasterKeyRotation{
+		KeyID:         newKeyID,
+		PreviousKeyID: m.activeKeyID,
+		RotatedBy:     rotatedBy,
+		RotatedAt:     time.Now().UTC(),
+	})
 	m.activeKeyID = newKeyID
+	m.activatedAt = time.Now().UTC()
 	return newMK, nil
 }
 
+// RetireMasterKey destroys the DECRYPT_ONLY key id: its material is zeroed and it
+// refuses every operation from then on. The public keys DeriveSigningKey gives for
+// verifyPurposes are kept, so signatures it made stay verifiable. Only a persistent
+// store retires keys, since a key from MASTER_KEYS would come back at restart.
+func (m *MasterKeyStore) RetireMasterKey(id string, verifyPurposes ...string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.persist == nil {
+		return errors.New("master keys from MASTER_KEYS cannot be retired; remove the key from MASTER_KEYS instead")
+	}
+	mk, err := m.usable(id)
+	if err != nil {
+		return err
+	}
+	if id == m.activeKeyID {
+		return errors.New("the active master key cannot be retired; rotate first")
+	}
+
+	retired := MasterKey{ID: id, CreatedAt: mk.CreatedAt, RetiredAt: time.Now().UTC(), VerifyKeys: maps.Clone(mk.VerifyKeys)}
+	for _, purpose := range verifyPurposes {
+		if retired.VerifyKeys == nil {
+			retired.VerifyKeys = make(map[string]ed25519.PublicKey)
+		}
+		retired.VerifyKeys[purpose] = deriveSigningKey(mk.Key, purpose).Public().(ed25519.PublicKey)
+	}
+	keys := m.keyList()
+	for i := range keys {
+		if keys[i].ID == id {
+			keys[i] = retired
+		}
+	}
+	if err := m.persist(keys); err != nil {
+		return fmt.Errorf("failed to persist master keys: %w", err)
+	}
+	secmem.Zero(mk.Key)
+	secmem.Zero(mk.KEMSeed)
+	m.masterKeys[id] = retired
+	return nil
+}
+
+// SigningPublicKey returns the public half of DeriveSigningKey(id, purpose), also for a
+// retired key that kept it.
+func (m *MasterKeyStore) SigningPublicKey(id, purpose string) (ed25519.PublicKey, error) {
+	m.mu.RLock()
+	mk, exists := m.masterKeys[id]
+	m.mu.RUnlock()
+	if !exists {
+		return nil, errors.New("specified master key not found")
+	}
+	if !mk.RetiredAt.IsZero() {
+		if pub, ok := mk.VerifyKeys[purpose]; ok {
+			return pub, nil
+		}
+		return nil, fmt.Errorf("master key %s is retired", id)
+	}
+	return deriveSigningKey(mk.Key, purpose).Public().(ed25519.PublicKey), nil
+}
+
+func deriveSigningKey(key []byte, purpose string) ed25519.PrivateKey {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("kms-signing-key|" + purpose))
+	return ed25519.NewKeyFromSeed(mac.Sum(nil))
+}
+
+// DeriveSigningKey derives an Ed25519 key for purpose from the master key id, or from the
+// active master key when id is empty. It returns the key and the master key ID used, so the
+// same key can be derived again to verify.
+func (m *MasterKeyStore) DeriveSigningKey(id, purpose string) (ed25519.PrivateKey, string, error) {
+	m.mu.RLock()
+	if id == "" {
+		id = m.activeKeyID
+	}
+	mk, err := m.usable(id)
+	m.mu.RUnlock()
+	if err != nil {
+		return nil, "", err
+	}
+	return deriveSigningKey(mk.Key, purpose), id, nil
+}
+
+// DeriveStorageKey derives a 32-byte key for purpose from the master key id, or from
+// the active master key when id is empty, for encrypting the server's own records. It
+// returns the master key ID used, so the same key can be derived again.
+func (m *MasterKeyStore) DeriveStorageKey(id, purpose string) ([]byte, string, error) {
+	m.mu.RLock()
+	if id == "" {
+		id = m.activeKeyID
+	}
+	mk, err := m.usable(id)
+	m.mu.RUnlock()
+	if err != nil {
+		return nil, "", err
+	}
+
+	mac := hmac.New(sha256.New, mk.Key)
+	mac.Write([]byte("kms-storage-key|" + purpose))
+	return mac.Sum(nil), id, nil
+}
+
+// SelfTest wraps and unwraps a throwaway key with the active master key.
+func (m *MasterKeyStore) SelfTest() error {
+	probe := make([]byte, 32)
+	if _, err := rand.Read(probe); err != nil {
+		return err
+	}
+	wrapped, keyID, err := m.EncryptDataKey(context.Background(), probe)
+	if err != nil {
+		return err
+	}
+	unwrapped, err := m.DecryptDataKey(wrapped, keyID)
+	if err != nil {
+		return err
+	}
+	defer secmem.Zero(unwrapped)
+	if !bytes.Equal(unwrapped, probe) {
+		return errors.New("master key round trip returned different key material")
+	}
+	return nil
+}
+
 // Close is a no-op unless you store external resources in MasterKeyStore.
 func (m *MasterKeyStore) Close(ctx context.Context) error {
 	// No DB connections to close here
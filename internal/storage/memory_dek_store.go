@@ -0,0 +1,395 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"my-kms/internal/auth"
+)
+
+// MemoryDEKStore keeps DEKs in process memory. It is meant for local development and
+// integration tests: nothing survives a restart.
+type MemoryDEKStore struct {
+	mu   sync.RWMutex
+	deks map[primitive.ObjectID]*DEKDocument
+}
+
+// NewMemoryDEKStore returns an empty MemoryDEKStore.
+func NewMemoryDEKStore() *MemoryDEKStore {
+	return &MemoryDEKStore{deks: make(map[primitive.ObjectID]*DEKDocument)}
+}
+
+// copyDEK returns a copy of doc sharing no slices or maps with it.
+func copyDEK(doc *DEKDocument) DEKDocument {
+	c := *doc
+	c.DEK = bytes.Clone(doc.DEK)
+	c.Tags = maps.Clone(doc.Tags)
+	if doc.Policy != nil {
+		p := KeyPolicy{
+			Encrypt: slices.Clone(doc.Policy.Encrypt),
+			Decrypt: slices.Clone(doc.Policy.Decrypt),
+			Manage:  slices.Clone(doc.Policy.Manage),
+			Derive:  slices.Clone(doc.Policy.Derive),
+		}
+		for op, cond := range doc.Policy.EncryptionContext {
+			if p.EncryptionContext == nil {
+				p.EncryptionContext = map[string]auth.ContextCondition{}
+			}
+			copied := auth.ContextCondition{}
+			for k, values := range cond {
+				copied[k] = slices.Clone(values)
+			}
+			p.EncryptionContext[op] = copied
+		}
+		c.Policy = &p
+	}
+	if doc.Usage != nil {
+		u := *doc.Usage
+		u.Operations = slices.Clone(doc.Usage.Operations)
+		u.Algorithms = slices.Clone(doc.Usage.Algorithms)
+		c.Usage = &u
+	}
+	if doc.Sealed != nil {
+		s := SealedMetadata{
+			Ciphertext: bytes.Clone(doc.Sealed.Ciphertext),
+			KeyID:      doc.Sealed.KeyID,
+			TagIndex:   slices.Clone(doc.Sealed.TagIndex),
+		}
+		c.Sealed = &s
+	}
+	return c
+}
+
+// live returns the undeleted DEK id in tenantID. The caller holds mu.
+func (m *MemoryDEKStore) live(tenantID, id string) (*DEKDocument, error) {
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, fmt.Errorf("invalid DEK ID format: %w", err)
+	}
+	doc, ok := m.deks[oid]
+	if !ok || doc.TenantID != tenantID || !doc.DeletedAt.IsZero() {
+		return nil, fmt.Errorf("no DEK found with ID %s", id)
+	}
+	return doc, nil
+}
+
+// InsertDEK stores a new DEK and returns its ID.
+// CreatedAt and State default to the current time and ENABLED if the caller left them empty.
+func (m *MemoryDEKStore) InsertDEK(ctx context.Context, doc DEKDocument) (string, error) {
+	if doc.CreatedAt.IsZero() {
+		doc.CreatedAt = time.Now().UTC()
+	}
+	if doc.State == "" {
+		doc.State = KeyStateEnabled
+	}
+	if doc.ID.IsZero() {
+		doc.ID = primitive.NewObjectID()
+	}
+	c := copyDEK(&doc)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.deks[c.ID]; ok {
+		return "", fmt.Errorf("failed to insert DEK: duplicate ID %s", c.ID.Hex())
+	}
+	m.deks[c.ID] = &c
+	return c.ID.Hex(), nil
+}
+
+// GetDEK retrieves a DEK by ID within a tenant.
+func (m *MemoryDEKStore) GetDEK(ctx context.Context, tenantID, id string) (*DEKDocument, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	doc, err := m.live(tenantID, id)
+	if err != nil {
+		return nil, err
+	}
+	c := copyDEK(doc)
+	return &c, nil
+}
+
+// DeleteDEK soft-deletes a DEK by its ID, leaving a tombstone.
+func (m *MemoryDEKStore) DeleteDEK(ctx context.Context, tenantID, id, deletedBy string) error {
+	return m.updateDEK(tenantID, id, func(doc *DEKDocument) {
+		doc.DeletedAt, doc.DeletedBy = time.Now().UTC(), deletedBy
+	})
+}
+
+// RestoreDEK removes the tombstone from a soft-deleted DEK.
+func (m *MemoryDEKStore) RestoreDEK(ctx context.Context, tenantID, id string) error {
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return fmt.Errorf("invalid DEK ID format: %w", err)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	doc, ok := m.deks[oid]
+	if !ok || doc.TenantID != tenantID || doc.DeletedAt.IsZero() {
+		return fmt.Errorf("no deleted DEK found with ID %s", id)
+	}
+	doc.DeletedAt, doc.DeletedBy = time.Time{}, ""
+	return nil
+}
+
+// PurgeDeletedDEKs permanently removes DEKs soft-deleted before cutoff, sparing
+// anything covered by a legal hold.
+func (m *MemoryDEKStore) PurgeDeletedDEKs(ctx context.Context, cutoff time.Time, held HeldKeys) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var n int64
+	for oid, doc := range m.deks {
+		if doc.DeletedAt.IsZero() || !doc.DeletedAt.Before(cutoff) {
+			continue
+		}
+		if slices.Contains(held.TenantIDs, doc.TenantID) || slices.Contains(held.DEKIDs, oid.Hex()) {
+			continue
+		}
+		delete(m.deks, oid)
+		n++
+	}
+	return n, nil
+}
+
+// sorted returns the live DEKs in tenantID accepted by match, ordered by ID. The
+// caller holds mu.
+func (m *MemoryDEKStore) sorted(tenantID string, match func(*DEKDocument) bool) []*DEKDocument {
+	var docs []*DEKDocument
+	for _, doc := range m.deks {
+		if doc.TenantID == tenantID && doc.DeletedAt.IsZero() && match(doc) {
+			docs = append(docs, doc)
+		}
+	}
+	sort.Slice(docs, func(i, j int) bool { return docs[i].ID.Hex() < docs[j].ID.Hex() })
+	return docs
+}
+
+// ListDEKsByOwner returns all DEKs in a tenant owned by the given Firebase UID.
+func (m *MemoryDEKStore) ListDEKsByOwner(ctx context.Context, tenantID, ownerUID string) ([]DEKDocument, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var docs []DEKDocument
+	for _, doc := range m.sorted(tenantID, func(d *DEKDocument) bool { return d.OwnerUID == ownerUID }) {
+		docs = append(docs, copyDEK(doc))
+	}
+	return docs, nil
+}
+
+// ListDEKs returns up to limit DEKs matching filter, ordered by ID, starting after cursor.
+// The wrapped key material is not returned. The returned cursor is empty when there are no more results.
+func (m *MemoryDEKStore) ListDEKs(ctx context.Context, filter DEKFilter, cursor string, limit int) ([]DEKDocument, string, error) {
+	if cursor != "" {
+		if _, err := primitive.ObjectIDFromHex(cursor); err != nil {
+			return nil, "", fmt.Errorf("invalid cursor: %w", err)
+		}
+	}
+	match := func(d *DEKDocument) bool {
+		if filter.MasterKeyID != "" && d.MasterKeyID != filter.MasterKeyID ||
+			filter.OwnerUID != "" && d.OwnerUID != filter.OwnerUID ||
+			filter.State != "" && d.EffectiveState() != filter.State ||
+			cursor != "" && d.ID.Hex() <= cursor {
+			return false
+		}
+		if len(filter.Tags) == 0 {
+			return true
+		}
+		if d.Sealed != nil {
+			hashes, ok := filter.TagHashes[d.Sealed.KeyID]
+			if !ok {
+				return false
+			}
+			for _, h := range hashes {
+				if !slices.Contains(d.Sealed.TagIndex, h) {
+					return false
+				}
+			}
+			return true
+		}
+		for k, v := range filter.Tags {
+			if tv, ok := d.Tags[k]; !ok || tv != v {
+				return false
+			}
+		}
+		return true
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var docs []DEKDocument
+	next := ""
+	for _, doc := range m.sorted(filter.TenantID, match) {
+		if len(docs) == limit {
+			next = docs[limit-1].ID.Hex()
+			break
+		}
+		c := copyDEK(doc)
+		c.DEK = nil
+		docs = append(docs, c)
+	}
+	return docs, next, nil
+}
+
+// SetDEKOwner changes the owner of a DEK.
+func (m *MemoryDEKStore) SetDEKOwner(ctx context.Context, tenantID, id, ownerUID string) error {
+	return m.updateDEK(tenantID, id, func(doc *DEKDocument) { doc.OwnerUID = ownerUID })
+}
+
+// SetDEKState moves a DEK to a new state, but only if it is currently in one of the allowed states.
+func (m *MemoryDEKStore) SetDEKState(ctx context.Context, tenantID, id string, state KeyState, from ...KeyState) error {
+	if _, err := primitive.ObjectIDFromHex(id); err != nil {
+		return fmt.Errorf("invalid DEK ID format: %w", err)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	doc, err := m.live(tenantID, id)
+	if err != nil || len(from) > 0 && !slices.Contains(from, doc.EffectiveState()) {
+		return fmt.Errorf("no DEK with ID %s in state %v", id, from)
+	}
+	doc.State = state
+	return nil
+}
+
+// SetDEKDeprecation marks a DEK as deprecated. A zero deprecatedAt clears the deprecation.
+func (m *MemoryDEKStore) SetDEKDeprecation(ctx context.Context, tenantID, id string, deprecatedAt, sunsetAt time.Time, replacementDEKID string) error {
+	if deprecatedAt.IsZero() {
+		sunsetAt, replacementDEKID = time.Time{}, ""
+	}
+	return m.updateDEK(tenantID, id, func(doc *DEKDocument) {
+		doc.DeprecatedAt, doc.SunsetAt, doc.ReplacementDEKID = deprecatedAt, sunsetAt, replacementDEKID
+	})
+}
+
+// SetDEKTags adds or overwrites the given tags on a DEK.
+func (m *MemoryDEKStore) SetDEKTags(ctx context.Context, tenantID, id string, tags map[string]string) error {
+	return m.updateDEK(tenantID, id, func(doc *DEKDocument) {
+		if doc.Tags == nil {
+			doc.Tags = make(map[string]string, len(tags))
+		}
+		maps.Copy(doc.Tags, tags)
+	})
+}
+
+// RemoveDEKTags removes the given tag keys from a DEK.
+func (m *MemoryDEKStore) RemoveDEKTags(ctx context.Context, tenantID, id string, keys []string) error {
+	return m.updateDEK(tenantID, id, func(doc *DEKDocument) {
+		for _, k := range keys {
+			delete(doc.Tags, k)
+		}
+		if len(doc.Tags) == 0 {
+			doc.Tags = nil
+		}
+	})
+}
+
+// SetDEKPolicy replaces the access policy of a DEK. A nil policy removes it.
+func (m *MemoryDEKStore) SetDEKPolicy(ctx context.Context, tenantID, id string, policy *KeyPolicy) error {
+	var p *KeyPolicy
+	if policy != nil {
+		p = copyDEK(&DEKDocument{Policy: policy}).Policy
+	}
+	return m.updateDEK(tenantID, id, func(doc *DEKDocument) { doc.Policy = p })
+}
+
+// SetDEKSealedMetadata replaces a DEK's metadata with sealed, provided its sealed
+// ciphertext is still prev (nil for a DEK not yet sealed). The clear description, tags
+// and policy are removed. Soft-deleted DEKs are updated too, so they can be resealed.
+func (m *MemoryDEKStore) SetDEKSealedMetadata(ctx context.Context, tenantID, id string, prev []byte, sealed *SealedMetadata) error {
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return fmt.Errorf("invalid DEK ID format: %w", err)
+	}
+	s := copyDEK(&DEKDocument{Sealed: sealed}).Sealed
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	doc, ok := m.deks[oid]
+	if !ok || doc.TenantID != tenantID {
+		return fmt.Errorf("no DEK found with ID %s", id)
+	}
+	if doc.Sealed == nil && prev != nil || doc.Sealed != nil && !bytes.Equal(doc.Sealed.Ciphertext, prev) {
+		return ErrDEKChanged
+	}
+	doc.Description, doc.Tags, doc.Policy, doc.Sealed = "", nil, nil, s
+	return nil
+}
+
+// ListDEKsByMasterKey returns up to limit DEKs wrapped under masterKeyID or with
+// metadata sealed under it (every DEK when masterKeyID is empty), in every tenant and
+// including soft-deleted ones, ordered by ID, starting after cursor.
+func (m *MemoryDEKStore) ListDEKsByMasterKey(ctx context.Context, masterKeyID, cursor string, limit int) ([]DEKDocument, string, error) {
+	if cursor != "" {
+		if _, err := primitive.ObjectIDFromHex(cursor); err != nil {
+			return nil, "", fmt.Errorf("invalid cursor: %w", err)
+		}
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var all []*DEKDocument
+	for _, doc := range m.deks {
+		sealedUnder := doc.Sealed != nil && doc.Sealed.KeyID == masterKeyID
+		if (masterKeyID == "" || doc.MasterKeyID == masterKeyID || sealedUnder) && doc.ID.Hex() > cursor {
+			all = append(all, doc)
+		}
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].ID.Hex() < all[j].ID.Hex() })
+
+	var docs []DEKDocument
+	next := ""
+	for _, doc := range all {
+		if len(docs) == limit {
+			next = docs[limit-1].ID.Hex()
+			break
+		}
+		docs = append(docs, copyDEK(doc))
+	}
+	return docs, next, nil
+}
+
+// RewrapDEK replaces a DEK's wrapped key, deleted or not, provided it is still wrapped
+// under prevMasterKeyID. Otherwise it returns ErrDEKChanged.
+func (m *MemoryDEKStore) RewrapDEK(ctx context.Context, tenantID, id, prevMasterKeyID string, dek []byte, masterKeyID string) error {
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return fmt.Errorf("invalid DEK ID format: %w", err)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	doc, ok := m.deks[oid]
+	if !ok || doc.TenantID != tenantID || doc.MasterKeyID != prevMasterKeyID {
+		return ErrDEKChanged
+	}
+	doc.DEK, doc.MasterKeyID = bytes.Clone(dek), masterKeyID
+	return nil
+}
+
+// TouchDEK records that a DEK was just used for a cryptographic operation.
+func (m *MemoryDEKStore) TouchDEK(ctx context.Context, tenantID, id string) error {
+	return m.updateDEK(tenantID, id, func(doc *DEKDocument) { doc.LastUsedAt = time.Now().UTC() })
+}
+
+func (m *MemoryDEKStore) updateDEK(tenantID, id string, update func(*DEKDocument)) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	doc, err := m.live(tenantID, id)
+	if err != nil {
+		return err
+	}
+	update(doc)
+	return nil
+}
+
+// Ping always succeeds.
+func (m *MemoryDEKStore) Ping(ctx context.Context) error {
+	return nil
+}
+
+// Close is a no-op; the DEKs are kept until the process exits.
+func (m *MemoryDEKStore) Close(ctx context.Context) error {
+	return nil
+}
@@ -0,0 +1,153 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sort"
+	"sync"
+)
+
+// MemoryUserStore keeps users and custom roles in process memory, for local
+// development and integration tests.
+type MemoryUserStore struct {
+	mu    sync.RWMutex
+	users map[string]User
+	roles map[string]RoleDefinition
+}
+
+// NewMemoryUserStore returns a MemoryUserStore holding users.
+func NewMemoryUserStore(users ...User) *MemoryUserStore {
+	m := &MemoryUserStore{
+		users: make(map[string]User, len(users)),
+		roles: make(map[string]RoleDefinition),
+	}
+	for _, u := range users {
+		m.users[u.FirebaseUID] = u
+	}
+	return m
+}
+
+// GetUserByFirebaseUID retrieves a user by their Firebase UID.
+func (m *MemoryUserStore) GetUserByFirebaseUID(ctx context.Context, uid string) (*User, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	u, ok := m.users[uid]
+	if !ok {
+		return nil, fmt.Errorf("no user found with Firebase UID %s: %w", uid, ErrUserNotFound)
+	}
+	return &u, nil
+}
+
+// DisableUser marks a user as disabled so that further requests are rejected.
+func (m *MemoryUserStore) DisableUser(ctx context.Context, uid string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u, ok := m.users[uid]
+	if !ok {
+		return fmt.Errorf("no user found with Firebase UID %s", uid)
+	}
+	u.Disabled = true
+	m.users[uid] = u
+	return nil
+}
+
+// ListUsers returns every user, sorted by Firebase UID.
+func (m *MemoryUserStore) ListUsers(ctx context.Context) ([]User, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	users := make([]User, 0, len(m.users))
+	for _, u := range m.users {
+		users = append(users, u)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].FirebaseUID < users[j].FirebaseUID })
+	return users, nil
+}
+
+// UpsertUser creates or replaces the user with the same Firebase UID.
+func (m *MemoryUserStore) UpsertUser(ctx context.Context, user User) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.users[user.FirebaseUID] = user
+	return nil
+}
+
+// CountUsersWithRole returns how many users are assigned role.
+func (m *MemoryUserStore) CountUsersWithRole(ctx context.Context, role string) (int64, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var n int64
+	for _, u := range m.users {
+		if u.Role == role {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// InsertRole stores a new role definition, failing if the name is taken.
+func (m *MemoryUserStore) InsertRole(ctx context.Context, role RoleDefinition) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.roles[role.Name]; ok {
+		return fmt.Errorf("role %s already exists", role.Name)
+	}
+	role.Actions = slices.Clone(role.Actions)
+	m.roles[role.Name] = role
+	return nil
+}
+
+// UpdateRole replaces the actions and description of an existing role.
+func (m *MemoryUserStore) UpdateRole(ctx context.Context, role RoleDefinition) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.roles[role.Name]; !ok {
+		return fmt.Errorf("no role found with name %s", role.Name)
+	}
+	role.Actions = slices.Clone(role.Actions)
+	m.roles[role.Name] = role
+	return nil
+}
+
+// UpsertRole creates or replaces a role definition.
+func (m *MemoryUserStore) UpsertRole(ctx context.Context, role RoleDefinition) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	role.Actions = slices.Clone(role.Actions)
+	m.roles[role.Name] = role
+	return nil
+}
+
+// ListRoles returns every custom role, sorted by name.
+func (m *MemoryUserStore) ListRoles(ctx context.Context) ([]RoleDefinition, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	roles := make([]RoleDefinition, 0, len(m.roles))
+	for _, r := range m.roles {
+		r.Actions = slices.Clone(r.Actions)
+		roles = append(roles, r)
+	}
+	sort.Slice(roles, func(i, j int) bool { return roles[i].Name < roles[j].Name })
+	return roles, nil
+}
+
+// DeleteRole removes a custom role definition.
+func (m *MemoryUserStore) DeleteRole(ctx context.Context, name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.roles[name]; !ok {
+		return fmt.Errorf("no role found with name %s", name)
+	}
+	delete(m.roles, name)
+	return nil
+}
+
+// Ping always succeeds.
+func (m *MemoryUserStore) Ping(ctx context.Context) error {
+	return nil
+}
+
+// Close is a no-op.
+func (m *MemoryUserStore) Close(ctx context.Context) error {
+	return nil
+}
@@ -0,0 +1,45 @@
+-- Users, custom roles and DEKs, as the Mongo collections of the same names hold them.
+
+CREATE TABLE users (
+    firebase_uid TEXT PRIMARY KEY,
+    role         TEXT NOT NULL,
+    tenant_id    TEXT NOT NULL DEFAULT '',
+    disabled     BOOLEAN NOT NULL DEFAULT false
+);
+CREATE INDEX users_role_idx ON users (role);
+
+CREATE TABLE roles (
+    name        TEXT PRIMARY KEY,
+    actions     TEXT[] NOT NULL,
+    description TEXT NOT NULL DEFAULT '',
+    updated_by  TEXT NOT NULL,
+    updated_at  TIMESTAMPTZ NOT NULL
+);
+
+-- id is a Mongo ObjectID in hex, so DEK IDs look the same on either backend and
+-- sort by creation time.
+CREATE TABLE deks (
+    id                 CHAR(24) PRIMARY KEY,
+    dek                BYTEA NOT NULL,
+    master_key_id      TEXT NOT NULL,
+    tenant_id          TEXT NOT NULL DEFAULT '',
+    owner_uid          TEXT NOT NULL DEFAULT '',
+    description        TEXT NOT NULL DEFAULT '',
+    tags               JSONB NOT NULL DEFAULT '{}',
+    created_by         TEXT NOT NULL DEFAULT '',
+    created_at         TIMESTAMPTZ NOT NULL,
+    last_used_at       TIMESTAMPTZ,
+    state              TEXT NOT NULL DEFAULT 'ENABLED',
+    algorithm          TEXT NOT NULL DEFAULT '',
+    origin             TEXT NOT NULL DEFAULT '',
+    deprecated_at      TIMESTAMPTZ,
+    sunset_at          TIMESTAMPTZ,
+    replacement_dek_id TEXT NOT NULL DEFAULT '',
+    policy             JSONB,
+    deleted_at         TIMESTAMPTZ,
+    deleted_by         TEXT NOT NULL DEFAULT ''
+);
+CREATE INDEX deks_tenant_idx ON deks (tenant_id, id) WHERE deleted_at IS NULL;
+CREATE INDEX deks_owner_idx ON deks (tenant_id, owner_uid) WHERE deleted_at IS NULL;
+CREATE INDEX deks_deleted_idx ON deks (deleted_at) WHERE deleted_at IS NOT NULL;
+CREATE INDEX deks_tags_idx ON deks USING GIN (tags);
@@ -0,0 +1,8 @@
+-- Sealed DEK metadata (see SealedDEKStore). A row with sealed_ciphertext set keeps its
+-- description, tags and policy there instead of in the clear columns.
+
+ALTER TABLE deks
+    ADD COLUMN sealed_ciphertext BYTEA,
+    ADD COLUMN sealed_key_id     TEXT NOT NULL DEFAULT '',
+    ADD COLUMN sealed_tag_index  TEXT[] NOT NULL DEFAULT '{}';
+CREATE INDEX deks_sealed_tag_index_idx ON deks USING GIN (sealed_tag_index);
@@ -0,0 +1,4 @@
+-- The rewrap job pages through the DEKs still wrapped under each retired master key,
+-- deleted ones included.
+
+CREATE INDEX deks_master_key_id_idx ON deks (master_key_id, id);
@@ -0,0 +1,3 @@
+-- Retiring a master key reseals the DEK metadata still sealed under it first.
+
+CREATE INDEX deks_sealed_key_id_idx ON deks (sealed_key_id, id);
@@ -0,0 +1,3 @@
+-- Usage restrictions fixed when a DEK is created (see KeyUsage); NULL allows everything.
+
+ALTER TABLE deks ADD COLUMN usage JSONB;
@@ -0,0 +1,3 @@
+-- When and from where a user may act (see auth.AccessCondition); NULL means always and anywhere.
+
+ALTER TABLE users ADD COLUMN conditions JSONB;
@@ -0,0 +1,102 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/event"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+
+	"my-kms/internal/metrics"
+	"my-kms/internal/tracing"
+)
+
+// MongoClientConfig tunes the connection pool and timeouts of the MongoDB clients.
+// Zero fields keep what MONGO_URI says, or the driver's defaults.
+type MongoClientConfig struct {
+	MaxPoolSize            uint64
+	MinPoolSize            uint64
+	ServerSelectionTimeout time.Duration
+	SocketTimeout          time.Duration
+
+	// ReadPreference applies to the user and DEK stores only: primary,
+	// primaryPreferred, secondary, secondaryPreferred or nearest. The other stores read
+	// back what they have just written, so they always read from the primary.
+	ReadPreference string
+}
+
+var (
+	mongoClientConfig MongoClientConfig
+	mongoReadPref     *readpref.ReadPref
+)
+
+// ConfigureMongoClients sets the options stores created from now on connect with.
+// Call it before creating any.
+func ConfigureMongoClients(cfg MongoClientConfig) error {
+	if cfg.MaxPoolSize > 0 && cfg.MinPoolSize > cfg.MaxPoolSize {
+		return fmt.Errorf("minimum pool size %d exceeds the maximum of %d", cfg.MinPoolSize, cfg.MaxPoolSize)
+	}
+	var rp *readpref.ReadPref
+	if cfg.ReadPreference != "" {
+		mode, err := readpref.ModeFromString(cfg.ReadPreference)
+		if err != nil {
+			return fmt.Errorf("invalid read preference %q", cfg.ReadPreference)
+		}
+		if rp, err = readpref.New(mode); err != nil {
+			return fmt.Errorf("invalid read preference %q: %w", cfg.ReadPreference, err)
+		}
+	}
+	mongoClientConfig, mongoReadPref = cfg, rp
+	return nil
+}
+
+// clientOptions returns the options every store connects with: the URI and the pool
+// settings, plus a command monitor that traces each command and feeds
+// kms_mongo_errors_total.
+func clientOptions(uri string) *options.ClientOptions {
+	opts := options.Client().ApplyURI(uri).SetMonitor(tracing.MongoMonitor(
+		func(_ context.Context, e *event.CommandFailedEvent) {
+			metrics.MongoErrors.Inc(e.CommandName)
+		},
+	))
+	cfg := mongoClientConfig
+	if cfg.MaxPoolSize > 0 {
+		opts.SetMaxPoolSize(cfg.MaxPoolSize)
+	}
+	if cfg.MinPoolSize > 0 {
+		opts.SetMinPoolSize(cfg.MinPoolSize)
+	}
+	if cfg.ServerSelectionTimeout > 0 {
+		opts.SetServerSelectionTimeout(cfg.ServerSelectionTimeout)
+	}
+	if cfg.SocketTimeout > 0 {
+		opts.SetSocketTimeout(cfg.SocketTimeout)
+	}
+	return opts
+}
+
+// ConnectMongo connects to uri and checks the connection, for stores that share one
+// client. The caller disconnects it.
+func ConnectMongo(uri string) (*mongo.Client, error) {
+	client, err := mongo.Connect(context.Background(), clientOptions(uri))
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to MongoDB: %w", err)
+	}
+	if err := client.Ping(context.Background(), nil); err != nil {
+		client.Disconnect(context.Background())
+		return nil, fmt.Errorf("failed to ping MongoDB: %w", err)
+	}
+	return client, nil
+}
+
+// readDatabaseOptions applies the configured read preference to the user and DEK stores.
+func readDatabaseOptions() *options.DatabaseOptions {
+	opts := options.Database()
+	if mongoReadPref != nil {
+		opts.SetReadPreference(mongoReadPref)
+	}
+	return opts
+}
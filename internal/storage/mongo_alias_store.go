@@ -0,0 +1,97 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Alias is a stable, human-readable name pointing at a DEK, plus per-alias settings.
+type Alias struct {
+	Name         string    `bson:"name" json:"name"`
+	TenantID     string    `bson:"tenantId,omitempty" json:"tenantID,omitempty"`
+	DEKID        string    `bson:"dekId" json:"dekID"`
+	Transformers []string  `bson:"transformers,omitempty" json:"transformers,omitempty"`
+	UpdatedBy    string    `bson:"updatedBy" json:"updatedBy"`
+	UpdatedAt    time.Time `bson:"updatedAt" json:"updatedAt"`
+
+	// ApprovedDataClasses lists DLP data classes (e.g. PCI) this alias may carry.
+	ApprovedDataClasses []string `bson:"approvedDataClasses,omitempty" json:"approvedDataClasses,omitempty"`
+}
+
+// MongoAliasStore handles key aliases in MongoDB.
+type MongoAliasStore struct {
+	client     *mongo.Client
+	collection *mongo.Collection
+}
+
+// NewMongoAliasStoreFromClient creates a MongoAliasStore on a client shared with other
+// stores.
+func NewMongoAliasStoreFromClient(client *mongo.Client, dbName, collectionName string) *MongoAliasStore {
+	collection := client.Database(dbName).Collection(collectionName)
+	return &MongoAliasStore{
+		client:     client,
+		collection: collection,
+	}
+}
+
+// UpsertAlias creates an alias or replaces the existing alias with the same tenant and name.
+func (m *MongoAliasStore) UpsertAlias(ctx context.Context, alias Alias) error {
+	if alias.UpdatedAt.IsZero() {
+		alias.UpdatedAt = time.Now().UTC()
+	}
+	filter := bson.M{"tenantId": tenantMatch(alias.TenantID), "name": alias.Name}
+	_, err := m.collection.ReplaceOne(ctx, filter, alias, options.Replace().SetUpsert(true))
+	if err != nil {
+		return fmt.Errorf("failed to upsert alias: %w", err)
+	}
+	return nil
+}
+
+// GetAlias retrieves an alias by name within a tenant.
+func (m *MongoAliasStore) GetAlias(ctx context.Context, tenantID, name string) (*Alias, error) {
+	var alias Alias
+	filter := bson.M{"tenantId": tenantMatch(tenantID), "name": name}
+	if err := m.collection.FindOne(ctx, filter).Decode(&alias); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, fmt.Errorf("no alias found with name %s", name)
+		}
+		return nil, fmt.Errorf("error retrieving alias: %w", err)
+	}
+	return &alias, nil
+}
+
+// ListAliases returns every alias in a tenant, ordered by name.
+func (m *MongoAliasStore) ListAliases(ctx context.Context, tenantID string) ([]Alias, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "name", Value: 1}})
+	cur, err := m.collection.Find(ctx, bson.M{"tenantId": tenantMatch(tenantID)}, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list aliases: %w", err)
+	}
+	var aliases []Alias
+	if err := cur.All(ctx, &aliases); err != nil {
+		return nil, fmt.Errorf("failed to decode aliases: %w", err)
+	}
+	return aliases, nil
+}
+
+// DeleteAlias removes an alias. The DEK it pointed at is unaffected.
+func (m *MongoAliasStore) DeleteAlias(ctx context.Context, tenantID, name string) error {
+	res, err := m.collection.DeleteOne(ctx, bson.M{"tenantId": tenantMatch(tenantID), "name": name})
+	if err != nil {
+		return fmt.Errorf("failed to delete alias: %w", err)
+	}
+	if res.DeletedCount == 0 {
+		return fmt.Errorf("no alias found with name %s", name)
+	}
+	return nil
+}
+
+// Ping checks the connection to MongoDB.
+func (m *MongoAliasStore) Ping(ctx context.Context) error {
+	return m.client.Ping(ctx, nil)
+}
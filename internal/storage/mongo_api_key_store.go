@@ -0,0 +1,126 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"my-kms/internal/auth"
+)
+
+// ErrAPIKeyNotFound is wrapped by lookups of API keys that do not exist.
+var ErrAPIKeyNotFound = errors.New("API key not found")
+
+// APIKey is a service account credential. Only a hash of the secret is stored.
+type APIKey struct {
+	Prefix     string    `bson:"_id"` // public part of the key, used for lookup
+	TenantID   string    `bson:"tenantId,omitempty"`
+	Name       string    `bson:"name"`
+	SecretHash []byte    `bson:"secretHash"`
+	Role       string    `bson:"role"`
+	DEKIDs     []string  `bson:"dekIds,omitempty"` // empty allows every key in the tenant
+	CreatedBy  string    `bson:"createdBy"`
+	CreatedAt  time.Time `bson:"createdAt"`
+	ExpiresAt  time.Time `bson:"expiresAt,omitempty"` // zero never expires
+	RevokedAt  time.Time `bson:"revokedAt,omitempty"`
+	RevokedBy  string    `bson:"revokedBy,omitempty"`
+
+	Conditions *auth.AccessCondition `bson:"conditions,omitempty"`
+
+	// SigningSecret is the secret again, wrapped like a DEK, for keys that also sign
+	// AWS Signature Version 4 requests: verifying a signature needs the secret itself.
+	SigningSecret      []byte `bson:"signingSecret,omitempty"`
+	SigningMasterKeyID string `bson:"signingMasterKeyId,omitempty"`
+}
+
+// Active reports whether the key is neither revoked nor expired at now.
+func (k *APIKey) Active(now time.Time) bool {
+	return k.RevokedAt.IsZero() && (k.ExpiresAt.IsZero() || now.Before(k.ExpiresAt))
+}
+
+// MongoAPIKeyStore handles API keys in MongoDB.
+type MongoAPIKeyStore struct {
+	client     *mongo.Client
+	collection *mongo.Collection
+}
+
+// NewMongoAPIKeyStoreFromClient creates a MongoAPIKeyStore on a client shared with other
+// stores.
+func NewMongoAPIKeyStoreFromClient(client *mongo.Client, dbName, collectionName string) *MongoAPIKeyStore {
+	collection := client.Database(dbName).Collection(collectionName)
+	return &MongoAPIKeyStore{
+		client:     client,
+		collection: collection,
+	}
+}
+
+// InsertAPIKey stores a new API key.
+func (m *MongoAPIKeyStore) InsertAPIKey(ctx context.Context, k APIKey) error {
+	if k.CreatedAt.IsZero() {
+		k.CreatedAt = time.Now().UTC()
+	}
+	if _, err := m.collection.InsertOne(ctx, k); err != nil {
+		return fmt.Errorf("failed to insert API key: %w", err)
+	}
+	return nil
+}
+
+// GetAPIKey retrieves an API key by prefix regardless of tenant, for authentication.
+func (m *MongoAPIKeyStore) GetAPIKey(ctx context.Context, prefix string) (*APIKey, error) {
+	var k APIKey
+	if err := m.collection.FindOne(ctx, bson.M{"_id": prefix}).Decode(&k); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, fmt.Errorf("no API key found with prefix %s: %w", prefix, ErrAPIKeyNotFound)
+		}
+		return nil, fmt.Errorf("error retrieving API key: %w", err)
+	}
+	return &k, nil
+}
+
+// ListAPIKeys returns the tenant's API keys, including revoked ones, newest first.
+func (m *MongoAPIKeyStore) ListAPIKeys(ctx context.Context, tenantID string) ([]APIKey, error) {
+	filter := bson.M{"tenantId": tenantMatch(tenantID)}
+	cur, err := m.collection.Find(ctx, filter, options.Find().SetSort(bson.D{{Key: "createdAt", Value: -1}}))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list API keys: %w", err)
+	}
+	var keys []APIKey
+	if err := cur.All(ctx, &keys); err != nil {
+		return nil, fmt.Errorf("failed to decode API keys: %w", err)
+	}
+	return keys, nil
+}
+
+// RevokeAPIKey marks an unrevoked API key in the tenant as revoked.
+func (m *MongoAPIKeyStore) RevokeAPIKey(ctx context.Context, tenantID, prefix, revokedBy string) error {
+	filter := bson.M{"_id": prefix, "tenantId": tenantMatch(tenantID), "revokedAt": bson.M{"$exists": false}}
+	update := bson.M{"$set": bson.M{"revokedAt": time.Now().UTC(), "revokedBy": revokedBy}}
+	res, err := m.collection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return fmt.Errorf("failed to revoke API key: %w", err)
+	}
+	if res.MatchedCount == 0 {
+		return fmt.Errorf("no active API key found with prefix %s", prefix)
+	}
+	return nil
+}
+
+// CountByMasterKey counts the unrevoked API keys whose signing secret is wrapped under
+// masterKeyID.
+func (m *MongoAPIKeyStore) CountByMasterKey(ctx context.Context, masterKeyID string) (int64, error) {
+	n, err := m.collection.CountDocuments(ctx, bson.M{"signingMasterKeyId": masterKeyID, "revokedAt": bson.M{"$exists": false}})
+	if err != nil {
+		return 0, fmt.Errorf("failed to count API keys: %w", err)
+	}
+	return n, nil
+}
+
+// Ping checks the connection to MongoDB.
+func (m *MongoAPIKeyStore) Ping(ctx context.Context) error {
+	return m.client.Ping(ctx, nil)
+}
@@ -0,0 +1,522 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"my-kms/internal/canonical"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Audit event results.
+const (
+	AuditResultSuccess = "success"
+	AuditResultDenied  = "denied"
+	AuditResultError   = "error"
+)
+
+// AuditEvent is one structured audit record: a request, or something the server did on its own.
+type AuditEvent struct {
+	ID                primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	Time              time.Time          `bson:"time" json:"time"`
+	RequestID         string             `bson:"requestId,omitempty" json:"requestID,omitempty"`
+	Identity          string             `bson:"identity,omitempty" json:"identity,omitempty"` // "kms" for the server's own actions
+	Role              string             `bson:"role,omitempty" json:"role,omitempty"`
+	TenantID          string             `bson:"tenantId,omitempty" json:"tenantID,omitempty"`
+	Action            string             `bson:"action" json:"action"` // endpoint, or job name
+	KeyID             string             `bson:"keyId,omitempty" json:"keyID,omitempty"`
+	Result            string             `bson:"result" json:"result"`
+	Status            int                `bson:"status,omitempty" json:"status,omitempty"`
+	EncryptionContext map[string]string  `bson:"encryptionContext,omitempty" json:"encryptionContext,omitempty"`
+	RemoteAddr        string             `bson:"remoteAddr,omitempty" json:"remoteAddr,omitempty"`
+	Details           []string           `bson:"details,omitempty" json:"details,omitempty"`
+
+	// Seq, PrevHash and Hash chain every event to the one before it; see ChainHash.
+	Seq      int64  `bson:"seq,omitempty" json:"seq,omitempty"`
+	PrevHash []byte `bson:"prevHash,omitempty" json:"prevHash,omitempty"`
+	Hash     []byte `bson:"hash,omitempty" json:"hash,omitempty"`
+}
+
+// chainView is the hashed form of an event: everything but its ID and own hash, with the
+// time at the millisecond precision MongoDB keeps.
+type chainView struct {
+	Seq               int64             `json:"seq"`
+	PrevHash          []byte            `json:"prevHash,omitempty"`
+	Time              string            `json:"time"`
+	RequestID         string            `json:"requestID,omitempty"`
+	Identity          string            `json:"identity,omitempty"`
+	Role              string            `json:"role,omitempty"`
+	TenantID          string            `json:"tenantID,omitempty"`
+	Action            string            `json:"action"`
+	KeyID             string            `json:"keyID,omitempty"`
+	Result            string            `json:"result"`
+	Status            int               `json:"status,omitempty"`
+	EncryptionContext map[string]string `json:"encryptionContext,omitempty"`
+	RemoteAddr        string            `json:"remoteAddr,omitempty"`
+	Details           []string          `json:"details,omitempty"`
+}
+
+// ChainHash returns SHA-256 over the RFC 8785 canonical JSON of the event's content,
+// including Seq and PrevHash.
+func (e *AuditEvent) ChainHash() ([]byte, error) {
+	data, err := canonical.Marshal(chainView{
+		Seq:               e.Seq,
+		PrevHash:          e.PrevHash,
+		Time:              e.Time.UTC().Truncate(time.Millisecond).Format(time.RFC3339Nano),
+		RequestID:         e.RequestID,
+		Identity:          e.Identity,
+		Role:              e.Role,
+		TenantID:          e.TenantID,
+		Action:            e.Action,
+		KeyID:             e.KeyID,
+		Result:            e.Result,
+		Status:            e.Status,
+		EncryptionContext: e.EncryptionContext,
+		RemoteAddr:        e.RemoteAddr,
+		Details:           e.Details,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to canonicalize audit event: %w", err)
+	}
+	sum := sha256.Sum256(data)
+	return sum[:], nil
+}
+
+// AuditCheckpoint is a signed statement of the chain head at some point in time.
+type AuditCheckpoint struct {
+	Seq       int64     `bson:"_id" json:"seq"`
+	Hash      []byte    `bson:"hash" json:"hash"`
+	Time      time.Time `bson:"time" json:"time"`
+	KeyID     string    `bson:"keyId" json:"keyID"` // master key the signing key was derived from
+	PublicKey []byte    `bson:"publicKey" json:"publicKey"`
+	Signature []byte    `bson:"signature" json:"signature"`
+}
+
+// SignedPayload is the canonical JSON the checkpoint signature covers.
+func (c *AuditCheckpoint) SignedPayload() ([]byte, error) {
+	return canonical.Marshal(struct {
+		Seq  int64  `json:"seq"`
+		Hash []byte `json:"hash"`
+		Time string `json:"time"`
+	}{c.Seq, c.Hash, c.Time.UTC().Truncate(time.Millisecond).Format(time.RFC3339Nano)})
+}
+
+// AuditQuery filters audit events; empty fields match everything.
+type AuditQuery struct {
+	TenantID string
+	// AllTenants ignores TenantID; only for platform-level auditors.
+	AllTenants bool
+	Identity   string
+	Action     string
+	KeyID      string
+	Result     string
+	RequestID  string
+	Since      time.Time
+	Until      time.Time
+	Limit      int64
+}
+
+// Appends are queued for one writer goroutine, which chains and inserts them in batches.
+const (
+	appendQueueSize    = 4096
+	maxAppendBatch     = 500
+	appendBatchTimeout = 10 * time.Second
+)
+
+// errAuditStoreClosed is returned by appends after Close.
+var errAuditStoreClosed = errors.New("audit store is closed")
+
+// pendingAppend is one queued AppendEvent; done is closed once stored or err is set.
+type pendingAppend struct {
+	ev     AuditEvent
+	stored *AuditEvent
+	err    error
+	done   chan struct{}
+}
+
+// MongoAuditStore keeps audit events and chain checkpoints in MongoDB.
+type MongoAuditStore struct {
+	client      *mongo.Client
+	collection  *mongo.Collection
+	checkpoints *mongo.Collection
+
+	appends   chan *pendingAppend
+	stop      chan struct{}
+	stopped   chan struct{}
+	closeOnce sync.Once
+
+	// The chain head as last written by the writer goroutine, which alone touches them.
+	headKnown bool
+	headSeq   int64
+	headHash  []byte
+}
+
+// NewMongoAuditStoreFromClient creates a MongoAuditStore on a client shared with other
+// stores. Closing the store leaves the client connected. The unique index on seq is what
+// keeps the chain linear when several servers append at once.
+func NewMongoAuditStoreFromClient(client *mongo.Client, dbName, collectionName, checkpointsCollection string) (*MongoAuditStore, error) {
+	collection := client.Database(dbName).Collection(collectionName)
+	seqIndex := mongo.IndexModel{
+		Keys: bson.D{{Key: "seq", Value: 1}},
+		Options: options.Index().SetName("seq_unique").SetUnique(true).
+			SetPartialFilterExpression(bson.M{"seq": bson.M{"$exists": true}}),
+	}
+	if _, err := collection.Indexes().CreateOne(context.Background(), seqIndex); err != nil {
+		return nil, fmt.Errorf("failed to create audit sequence index: %w", err)
+	}
+	m := &MongoAuditStore{
+		client:      client,
+		collection:  collection,
+		checkpoints: client.Database(dbName).Collection(checkpointsCollection),
+		appends:     make(chan *pendingAppend, appendQueueSize),
+		stop:        make(chan struct{}),
+		stopped:     make(chan struct{}),
+	}
+	go m.runAppends()
+	return m, nil
+}
+
+// EnsureRetention installs a TTL index expiring events older than retention; zero keeps them forever.
+func (m *MongoAuditStore) EnsureRetention(ctx context.Context, retention time.Duration) error {
+	const name = "time_ttl"
+	// A TTL index's expiry can't be changed in place, so drop and recreate it.
+	if _, err := m.collection.Indexes().DropOne(ctx, name); err != nil {
+		var cmdErr mongo.CommandError
+		if !(errors.As(err, &cmdErr) && cmdErr.Name == "IndexNotFound") {
+			return fmt.Errorf("failed to drop audit retention index: %w", err)
+		}
+	}
+	if retention <= 0 {
+		return nil
+	}
+	model := mongo.IndexModel{
+		Keys:    bson.D{{Key: "time", Value: 1}},
+		Options: options.Index().SetName(name).SetExpireAfterSeconds(int32(retention / time.Second)),
+	}
+	if _, err := m.collection.Indexes().CreateOne(ctx, model); err != nil {
+		return fmt.Errorf("failed to create audit retention index: %w", err)
+	}
+	return nil
+}
+
+// AppendEvent links ev to the chain and stores it, returning the stored event. Appends
+// from the whole process go through one writer, so a busy server batches them instead of
+// contending for the chain head; an error means ev was not stored.
+func (m *MongoAuditStore) AppendEvent(ctx context.Context, ev AuditEvent) (*AuditEvent, error) {
+	ev.Time = ev.Time.UTC().Truncate(time.Millisecond)
+	p := &pendingAppend{ev: ev, done: make(chan struct{})}
+	select {
+	case m.appends <- p:
+	case <-m.stop:
+		return nil, errAuditStoreClosed
+	case <-ctx.Done():
+		return nil, fmt.Errorf("failed to queue audit event: %w", ctx.Err())
+	}
+	select {
+	case <-p.done:
+		return p.stored, p.err
+	case <-ctx.Done():
+		return nil, fmt.Errorf("failed to append audit event: %w", ctx.Err())
+	}
+}
+
+// runAppends writes queued events until Close, taking whatever has queued up as one batch.
+func (m *MongoAuditStore) runAppends() {
+	defer close(m.stopped)
+	for {
+		select {
+		case <-m.stop:
+			return
+		case p := <-m.appends:
+			batch := []*pendingAppend{p}
+		drain:
+			for len(batch) < maxAppendBatch {
+				select {
+				case p := <-m.appends:
+					batch = append(batch, p)
+				default:
+					break drain
+				}
+			}
+			m.appendBatch(batch)
+		}
+	}
+}
+
+// appendBatch chains batch onto the head and inserts it in order. The unique seq index
+// refuses events another server has already chained at the same place; the ones before
+// the conflict are kept and the rest are chained again onto the new head, until
+// appendBatchTimeout runs out.
+func (m *MongoAuditStore) appendBatch(batch []*pendingAppend) {
+	ctx, cancel := context.WithTimeout(context.Background(), appendBatchTimeout)
+	defer cancel()
+	fail := func(ps []*pendingAppend, err error) {
+		m.headKnown = false
+		for _, p := range ps {
+			p.err = err
+			close(p.done)
+		}
+	}
+
+	for pending := batch; len(pending) > 0; {
+		if !m.headKnown {
+			seq, hash, err := m.chainHead(ctx)
+			if err != nil {
+				fail(pending, err)
+				return
+			}
+			m.headSeq, m.headHash, m.headKnown = seq, hash, true
+		}
+
+		docs := make([]interface{}, len(pending))
+		seq, prev := m.headSeq, m.headHash
+		for i, p := range pending {
+			seq++
+			p.ev.ID = primitive.NewObjectID()
+			p.ev.Seq, p.ev.PrevHash = seq, prev
+			hash, err := p.ev.ChainHash()
+			if err != nil {
+				fail(pending, err)
+				return
+			}
+			p.ev.Hash, prev = hash, hash
+			docs[i] = p.ev
+		}
+
+		inserted := len(pending)
+		_, err := m.collection.InsertMany(ctx, docs, options.InsertMany().SetOrdered(true))
+		if err != nil {
+			var bulkErr mongo.BulkWriteException
+			if !errors.As(err, &bulkErr) || !mongo.IsDuplicateKeyError(err) || len(bulkErr.WriteErrors) == 0 {
+				fail(pending, fmt.Errorf("failed to insert audit events: %w", err))
+				return
+			}
+			inserted = bulkErr.WriteErrors[0].Index
+		}
+		for _, p := range pending[:inserted] {
+			stored := p.ev
+			p.stored = &stored
+			close(p.done)
+		}
+		if inserted > 0 {
+			last := pending[inserted-1].ev
+			m.headSeq, m.headHash = last.Seq, last.Hash
+		}
+		if inserted < len(pending) {
+			// Another server appended first; read its head and chain the rest onto it.
+			m.headKnown = false
+			if ctx.Err() != nil {
+				fail(pending[inserted:], fmt.Errorf("failed to append audit events: %w", ctx.Err()))
+				return
+			}
+		}
+		pending = pending[inserted:]
+	}
+}
+
+// chainHead returns the sequence number and hash of the newest event. When retention or
+// archival has removed every event, the latest checkpoint carries the chain on.
+func (m *MongoAuditStore) chainHead(ctx context.Context) (int64, []byte, error) {
+	head, err := m.LastEvent(ctx)
+	if err != nil {
+		return 0, nil, err
+	}
+	if head != nil {
+		return head.Seq, head.Hash, nil
+	}
+	cp, err := m.LatestCheckpoint(ctx)
+	if err != nil || cp == nil {
+		return 0, nil, err
+	}
+	return cp.Seq, cp.Hash, nil
+}
+
+// LastEvent returns the newest chained event, or nil when there is none.
+func (m *MongoAuditStore) LastEvent(ctx context.Context) (*AuditEvent, error) {
+	var ev AuditEvent
+	opts := options.FindOne().SetSort(bson.D{{Key: "seq", Value: -1}})
+	err := m.collection.FindOne(ctx, bson.M{"seq": bson.M{"$exists": true}}, opts).Decode(&ev)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read audit chain head: %w", err)
+	}
+	return &ev, nil
+}
+
+// WalkChain calls fn for every chained event with fromSeq <= seq <= toSeq (toSeq 0 means
+// no upper bound), in sequence order, stopping at the first error fn returns.
+func (m *MongoAuditStore) WalkChain(ctx context.Context, fromSeq, toSeq int64, fn func(*AuditEvent) error) error {
+	seqFilter := bson.M{"$gte": fromSeq}
+	if toSeq > 0 {
+		seqFilter["$lte"] = toSeq
+	}
+	cur, err := m.collection.Find(ctx, bson.M{"seq": seqFilter}, options.Find().SetSort(bson.D{{Key: "seq", Value: 1}}))
+	if err != nil {
+		return fmt.Errorf("failed to read audit chain: %w", err)
+	}
+	defer cur.Close(ctx)
+	for cur.Next(ctx) {
+		var ev AuditEvent
+		if err := cur.Decode(&ev); err != nil {
+			return fmt.Errorf("failed to decode audit event: %w", err)
+		}
+		if err := fn(&ev); err != nil {
+			return err
+		}
+	}
+	if err := cur.Err(); err != nil {
+		return fmt.Errorf("failed to read audit chain: %w", err)
+	}
+	return nil
+}
+
+// InsertCheckpoint stores a signed checkpoint.
+func (m *MongoAuditStore) InsertCheckpoint(ctx context.Context, cp AuditCheckpoint) error {
+	if _, err := m.checkpoints.InsertOne(ctx, cp); err != nil {
+		return fmt.Errorf("failed to insert audit checkpoint: %w", err)
+	}
+	return nil
+}
+
+// LatestCheckpoint returns the newest checkpoint, or nil when there is none.
+func (m *MongoAuditStore) LatestCheckpoint(ctx context.Context) (*AuditCheckpoint, error) {
+	var cp AuditCheckpoint
+	opts := options.FindOne().SetSort(bson.D{{Key: "_id", Value: -1}})
+	err := m.checkpoints.FindOne(ctx, bson.M{}, opts).Decode(&cp)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read audit checkpoint: %w", err)
+	}
+	return &cp, nil
+}
+
+// ListCheckpoints returns the checkpoints with fromSeq <= seq <= toSeq (toSeq 0 means no
+// upper bound), oldest first.
+func (m *MongoAuditStore) ListCheckpoints(ctx context.Context, fromSeq, toSeq int64) ([]AuditCheckpoint, error) {
+	seqFilter := bson.M{"$gte": fromSeq}
+	if toSeq > 0 {
+		seqFilter["$lte"] = toSeq
+	}
+	cur, err := m.checkpoints.Find(ctx, bson.M{"_id": seqFilter}, options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list audit checkpoints: %w", err)
+	}
+	var cps []AuditCheckpoint
+	if err := cur.All(ctx, &cps); err != nil {
+		return nil, fmt.Errorf("failed to decode audit checkpoints: %w", err)
+	}
+	return cps, nil
+}
+
+// QueryEvents returns matching events, newest first.
+func (m *MongoAuditStore) QueryEvents(ctx context.Context, q AuditQuery) ([]AuditEvent, error) {
+	filter := bson.M{}
+	if !q.AllTenants {
+		filter["tenantId"] = tenantMatch(q.TenantID)
+	}
+	for field, v := range map[string]string{
+		"identity": q.Identity, "action": q.Action, "keyId": q.KeyID, "result": q.Result, "requestId": q.RequestID,
+	} {
+		if v != "" {
+			filter[field] = v
+		}
+	}
+	timeFilter := bson.M{}
+	if !q.Since.IsZero() {
+		timeFilter["$gte"] = q.Since
+	}
+	if !q.Until.IsZero() {
+		timeFilter["$lt"] = q.Until
+	}
+	if len(timeFilter) > 0 {
+		filter["time"] = timeFilter
+	}
+
+	opts := options.Find().SetSort(bson.D{{Key: "time", Value: -1}, {Key: "_id", Value: -1}})
+	if q.Limit > 0 {
+		opts.SetLimit(q.Limit)
+	}
+	cur, err := m.collection.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query audit events: %w", err)
+	}
+	var events []AuditEvent
+	if err := cur.All(ctx, &events); err != nil {
+		return nil, fmt.Errorf("failed to decode audit events: %w", err)
+	}
+	return events, nil
+}
+
+// ArchiveBefore writes up to limit events older than before to w as JSON lines, oldest
+// first, then deletes what it wrote. It returns the number of events archived. The chain
+// head is never archived, so new events keep linking to it.
+func (m *MongoAuditStore) ArchiveBefore(ctx context.Context, before time.Time, limit int64, w io.Writer) (int, error) {
+	filter := bson.M{"time": bson.M{"$lt": before}}
+	head, err := m.LastEvent(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if head != nil {
+		filter["_id"] = bson.M{"$ne": head.ID}
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "time", Value: 1}, {Key: "seq", Value: 1}}).SetLimit(limit)
+	cur, err := m.collection.Find(ctx, filter, opts)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read audit events for archival: %w", err)
+	}
+	defer cur.Close(ctx)
+
+	enc := json.NewEncoder(w)
+	var ids []primitive.ObjectID
+	for cur.Next(ctx) {
+		var ev AuditEvent
+		if err := cur.Decode(&ev); err != nil {
+			return 0, fmt.Errorf("failed to decode audit event: %w", err)
+		}
+		if err := enc.Encode(ev); err != nil {
+			return 0, fmt.Errorf("failed to write audit archive: %w", err)
+		}
+		ids = append(ids, ev.ID)
+	}
+	if err := cur.Err(); err != nil {
+		return 0, fmt.Errorf("failed to read audit events for archival: %w", err)
+	}
+	if len(ids) == 0 {
+		return 0, nil
+	}
+	// Only delete what was written, so events arriving meanwhile are kept for the next run.
+	if _, err := m.collection.DeleteMany(ctx, bson.M{"_id": bson.M{"$in": ids}}); err != nil {
+		return 0, fmt.Errorf("failed to delete archived audit events: %w", err)
+	}
+	return len(ids), nil
+}
+
+// Ping checks the connection to MongoDB.
+func (m *MongoAuditStore) Ping(ctx context.Context) error {
+	return m.client.Ping(ctx, nil)
+}
+
+// Close stops the append writer once it has finished the batch in hand. The client is
+// shared, so it stays connected.
+func (m *MongoAuditStore) Close(ctx context.Context) error {
+	m.closeOnce.Do(func() { close(m.stop) })
+	select {
+	case <-m.stopped:
+	case <-ctx.Done():
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ErrCAExists is returned by CreateCA when the tenant already has a CA with that name.
+var ErrCAExists = errors.New("certificate authority already exists")
+
+// CertificateAuthority is one tenant's issuing CA. Its private key, PKCS #8, is wrapped
+// by a master key (or the tenant's CMK) exactly like a DEK.
+type CertificateAuthority struct {
+	ID          primitive.ObjectID `bson:"_id,omitempty" json:"-"`
+	TenantID    string             `bson:"tenantId,omitempty" json:"tenantID,omitempty"`
+	Name        string             `bson:"name" json:"name"`
+	Key         []byte             `bson:"key" json:"-"`
+	MasterKeyID string             `bson:"masterKeyId" json:"masterKeyID"`
+
+	// Certificates is the DER chain, the CA's own certificate first. It is empty while a
+	// sub-CA waits for its parent to sign the CSR.
+	Certificates [][]byte `bson:"certificates,omitempty" json:"-"`
+
+	CreatedBy string    `bson:"createdBy" json:"createdBy"`
+	CreatedAt time.Time `bson:"createdAt" json:"createdAt"`
+	UpdatedAt time.Time `bson:"updatedAt,omitempty" json:"updatedAt,omitempty"`
+}
+
+// MongoCAStore keeps certificate authorities in MongoDB, one per tenant and name.
+type MongoCAStore struct {
+	client     *mongo.Client
+	collection *mongo.Collection
+}
+
+// NewMongoCAStoreFromClient creates a MongoCAStore on a client shared with other
+// stores.
+func NewMongoCAStoreFromClient(client *mongo.Client, dbName, collectionName string) (*MongoCAStore, error) {
+	collection := client.Database(dbName).Collection(collectionName)
+	index := mongo.IndexModel{
+		Keys:    bson.D{{Key: "tenantId", Value: 1}, {Key: "name", Value: 1}},
+		Options: options.Index().SetName("tenant_name").SetUnique(true),
+	}
+	if _, err := collection.Indexes().CreateOne(context.Background(), index); err != nil {
+		return nil, fmt.Errorf("failed to create certificate authority indexes: %w", err)
+	}
+	return &MongoCAStore{
+		client:     client,
+		collection: collection,
+	}, nil
+}
+
+// CreateCA stores ca, failing with ErrCAExists if its name is taken.
+func (m *MongoCAStore) CreateCA(ctx context.Context, ca CertificateAuthority) error {
+	if ca.CreatedAt.IsZero() {
+		ca.CreatedAt = time.Now().UTC()
+	}
+	if _, err := m.collection.InsertOne(ctx, ca); err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return ErrCAExists
+		}
+		return fmt.Errorf("failed to insert certificate authority: %w", err)
+	}
+	return nil
+}
+
+// GetCA returns a tenant's CA by name, nil if there is none.
+func (m *MongoCAStore) GetCA(ctx context.Context, tenantID, name string) (*CertificateAuthority, error) {
+	var ca CertificateAuthority
+	err := m.collection.FindOne(ctx, bson.M{"tenantId": tenantMatch(tenantID), "name": name}).Decode(&ca)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get certificate authority: %w", err)
+	}
+	return &ca, nil
+}
+
+// SetCACertificates replaces a CA's certificate chain.
+func (m *MongoCAStore) SetCACertificates(ctx context.Context, tenantID, name string, certificates [][]byte) error {
+	res, err := m.collection.UpdateOne(ctx,
+		bson.M{"tenantId": tenantMatch(tenantID), "name": name},
+		bson.M{"$set": bson.M{"certificates": certificates, "updatedAt": time.Now().UTC()}},
+	)
+	if err != nil {
+		return fmt.Errorf("failed to update certificate authority: %w", err)
+	}
+	if res.MatchedCount == 0 {
+		return fmt.Errorf("certificate authority %s not found", name)
+	}
+	return nil
+}
+
+// CountByMasterKey counts the CA keys wrapped under masterKeyID.
+func (m *MongoCAStore) CountByMasterKey(ctx context.Context, masterKeyID string) (int64, error) {
+	n, err := m.collection.CountDocuments(ctx, bson.M{"masterKeyId": masterKeyID})
+	if err != nil {
+		return 0, fmt.Errorf("failed to count certificate authorities: %w", err)
+	}
+	return n, nil
+}
+
+// Ping checks the connection to MongoDB.
+func (m *MongoCAStore) Ping(ctx context.Context) error {
+	return m.client.Ping(ctx, nil)
+}
@@ -0,0 +1,216 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Ciphertext location kinds.
+const (
+	LocationKindS3       = "s3"
+	LocationKindMongo    = "mongo"
+	LocationKindCallback = "callback"
+)
+
+// Re-encryption statuses of a ciphertext location.
+const (
+	ReencryptionCurrent    = "current"     // nothing to do
+	ReencryptionPending    = "pending"     // the DEK was rotated or shredded; work not started
+	ReencryptionInProgress = "in_progress" // the owner reported progress
+	ReencryptionDone       = "done"        // re-encrypted or destroyed downstream
+	ReencryptionFailed     = "failed"
+)
+
+// Reasons a location needs re-encryption.
+const (
+	ReencryptionReasonRotated  = "rotated"
+	ReencryptionReasonShredded = "shredded"
+)
+
+// CiphertextLocation is a place where ciphertext under a DEK is stored downstream.
+type CiphertextLocation struct {
+	ID           primitive.ObjectID `bson:"_id,omitempty"`
+	TenantID     string             `bson:"tenantId,omitempty"`
+	DEKID        string             `bson:"dekId"`
+	Kind         string             `bson:"kind"`
+	URI          string             `bson:"uri"` // s3://bucket/prefix, mongodb collection name, or https callback URL
+	Description  string             `bson:"description,omitempty"`
+	RegisteredBy string             `bson:"registeredBy"`
+	RegisteredAt time.Time          `bson:"registeredAt"`
+
+	Status           string    `bson:"status"`
+	Reason           string    `bson:"reason,omitempty"`
+	ReplacementDEKID string    `bson:"replacementDekId,omitempty"`
+	StatusDetail     string    `bson:"statusDetail,omitempty"`
+	StatusUpdatedBy  string    `bson:"statusUpdatedBy,omitempty"`
+	StatusUpdatedAt  time.Time `bson:"statusUpdatedAt,omitempty"`
+
+	LastNotifiedAt time.Time `bson:"lastNotifiedAt,omitempty"`
+	NotifyError    string    `bson:"notifyError,omitempty"`
+}
+
+// MongoCiphertextLocationStore handles the re-encryption registry in MongoDB.
+type MongoCiphertextLocationStore struct {
+	client     *mongo.Client
+	collection *mongo.Collection
+}
+
+// NewMongoCiphertextLocationStoreFromClient creates a MongoCiphertextLocationStore on a client shared with other
+// stores.
+func NewMongoCiphertextLocationStoreFromClient(client *mongo.Client, dbName, collectionName string) *MongoCiphertextLocationStore {
+	collection := client.Database(dbName).Collection(collectionName)
+	return &MongoCiphertextLocationStore{
+		client:     client,
+		collection: collection,
+	}
+}
+
+// InsertLocation registers a location and returns it with its ID.
+func (m *MongoCiphertextLocationStore) InsertLocation(ctx context.Context, loc CiphertextLocation) (*CiphertextLocation, error) {
+	if loc.RegisteredAt.IsZero() {
+		loc.RegisteredAt = time.Now().UTC()
+	}
+	if loc.Status == "" {
+		loc.Status = ReencryptionCurrent
+	}
+	res, err := m.collection.InsertOne(ctx, loc)
+	if err != nil {
+		return nil, fmt.Errorf("failed to insert ciphertext location: %w", err)
+	}
+	oid, ok := res.InsertedID.(primitive.ObjectID)
+	if !ok {
+		return nil, fmt.Errorf("failed to convert inserted ID to ObjectID")
+	}
+	loc.ID = oid
+	return &loc, nil
+}
+
+// GetLocation retrieves a location by ID within a tenant.
+func (m *MongoCiphertextLocationStore) GetLocation(ctx context.Context, tenantID, id string) (*CiphertextLocation, error) {
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, fmt.Errorf("invalid location ID format: %w", err)
+	}
+	var loc CiphertextLocation
+	if err := m.collection.FindOne(ctx, bson.M{"_id": oid, "tenantId": tenantMatch(tenantID)}).Decode(&loc); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, fmt.Errorf("no ciphertext location found with ID %s", id)
+		}
+		return nil, fmt.Errorf("error retrieving ciphertext location: %w", err)
+	}
+	return &loc, nil
+}
+
+// ListLocations returns the tenant's locations, optionally limited to one DEK and/or status.
+func (m *MongoCiphertextLocationStore) ListLocations(ctx context.Context, tenantID, dekID, status string) ([]CiphertextLocation, error) {
+	filter := bson.M{"tenantId": tenantMatch(tenantID)}
+	if dekID != "" {
+		filter["dekId"] = dekID
+	}
+	if status != "" {
+		filter["status"] = status
+	}
+	cur, err := m.collection.Find(ctx, filter, options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list ciphertext locations: %w", err)
+	}
+	var locs []CiphertextLocation
+	if err := cur.All(ctx, &locs); err != nil {
+		return nil, fmt.Errorf("failed to decode ciphertext locations: %w", err)
+	}
+	return locs, nil
+}
+
+// MarkPending flags every location of a DEK as needing re-encryption and returns them.
+func (m *MongoCiphertextLocationStore) MarkPending(ctx context.Context, tenantID, dekID, reason, replacementDEKID string) ([]CiphertextLocation, error) {
+	filter := bson.M{"tenantId": tenantMatch(tenantID), "dekId": dekID}
+	update := bson.M{
+		"$set": bson.M{
+			"status":           ReencryptionPending,
+			"reason":           reason,
+			"replacementDekId": replacementDEKID,
+			"statusUpdatedAt":  time.Now().UTC(),
+			"statusUpdatedBy":  "kms",
+		},
+		"$unset": bson.M{"statusDetail": ""},
+	}
+	if _, err := m.collection.UpdateMany(ctx, filter, update); err != nil {
+		return nil, fmt.Errorf("failed to mark ciphertext locations pending: %w", err)
+	}
+	return m.ListLocations(ctx, tenantID, dekID, ReencryptionPending)
+}
+
+// ClearPending returns a DEK's untouched pending locations for reason to current, e.g.
+// when a deleted DEK is restored before anyone acted on it.
+func (m *MongoCiphertextLocationStore) ClearPending(ctx context.Context, tenantID, dekID, reason string) error {
+	filter := bson.M{"tenantId": tenantMatch(tenantID), "dekId": dekID, "status": ReencryptionPending, "reason": reason}
+	update := bson.M{
+		"$set":   bson.M{"status": ReencryptionCurrent, "statusUpdatedAt": time.Now().UTC(), "statusUpdatedBy": "kms"},
+		"$unset": bson.M{"reason": "", "replacementDekId": ""},
+	}
+	if _, err := m.collection.UpdateMany(ctx, filter, update); err != nil {
+		return fmt.Errorf("failed to clear pending ciphertext locations: %w", err)
+	}
+	return nil
+}
+
+// UpdateStatus records progress reported by a location's owner.
+func (m *MongoCiphertextLocationStore) UpdateStatus(ctx context.Context, tenantID, id, status, detail, updatedBy string) error {
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return fmt.Errorf("invalid location ID format: %w", err)
+	}
+	update := bson.M{"$set": bson.M{
+		"status":          status,
+		"statusDetail":    detail,
+		"statusUpdatedBy": updatedBy,
+		"statusUpdatedAt": time.Now().UTC(),
+	}}
+	res, err := m.collection.UpdateOne(ctx, bson.M{"_id": oid, "tenantId": tenantMatch(tenantID)}, update)
+	if err != nil {
+		return fmt.Errorf("failed to update ciphertext location: %w", err)
+	}
+	if res.MatchedCount == 0 {
+		return fmt.Errorf("no ciphertext location found with ID %s", id)
+	}
+	return nil
+}
+
+// RecordNotification stores the outcome of the latest callback notification.
+func (m *MongoCiphertextLocationStore) RecordNotification(ctx context.Context, id primitive.ObjectID, notifyErr error) error {
+	set := bson.M{"lastNotifiedAt": time.Now().UTC(), "notifyError": ""}
+	if notifyErr != nil {
+		set["notifyError"] = notifyErr.Error()
+	}
+	if _, err := m.collection.UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": set}); err != nil {
+		return fmt.Errorf("failed to record notification: %w", err)
+	}
+	return nil
+}
+
+// DeleteLocation unregisters a location.
+func (m *MongoCiphertextLocationStore) DeleteLocation(ctx context.Context, tenantID, id string) error {
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return fmt.Errorf("invalid location ID format: %w", err)
+	}
+	res, err := m.collection.DeleteOne(ctx, bson.M{"_id": oid, "tenantId": tenantMatch(tenantID)})
+	if err != nil {
+		return fmt.Errorf("failed to delete ciphertext location: %w", err)
+	}
+	if res.DeletedCount == 0 {
+		return fmt.Errorf("no ciphertext location found with ID %s", id)
+	}
+	return nil
+}
+
+// Ping checks the connection to MongoDB.
+func (m *MongoCiphertextLocationStore) Ping(ctx context.Context) error {
+	return m.client.Ping(ctx, nil)
+}
@@ -0,0 +1,111 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ClientSighting aggregates requests from one identity using one client build.
+type ClientSighting struct {
+	Identity   string    `bson:"identity"`
+	SDK        string    `bson:"sdk"`
+	SDKVersion string    `bson:"sdkVersion"`
+	UserAgent  string    `bson:"userAgent"`
+	Requests   int64     `bson:"requests"`
+	FirstSeen  time.Time `bson:"firstSeen"`
+	LastSeen   time.Time `bson:"lastSeen"`
+}
+
+// ClientAdoption summarizes how widely one SDK version is used.
+type ClientAdoption struct {
+	SDK        string    `bson:"sdk" json:"sdk"`
+	SDKVersion string    `bson:"sdkVersion" json:"sdkVersion"`
+	Identities int64     `bson:"identities" json:"identities"`
+	Requests   int64     `bson:"requests" json:"requests"`
+	LastSeen   time.Time `bson:"lastSeen" json:"lastSeen"`
+}
+
+// MongoClientStore records client fingerprints in MongoDB.
+type MongoClientStore struct {
+	client     *mongo.Client
+	collection *mongo.Collection
+}
+
+// NewMongoClientStoreFromClient creates a MongoClientStore on a client shared with other
+// stores.
+func NewMongoClientStoreFromClient(client *mongo.Client, dbName, collectionName string) *MongoClientStore {
+	collection := client.Database(dbName).Collection(collectionName)
+	return &MongoClientStore{
+		client:     client,
+		collection: collection,
+	}
+}
+
+// RecordSightings merges the given sightings into the stored aggregates.
+func (m *MongoClientStore) RecordSightings(ctx context.Context, sightings []ClientSighting) error {
+	if len(sightings) == 0 {
+		return nil
+	}
+
+	models := make([]mongo.WriteModel, 0, len(sightings))
+	for _, cs := range sightings {
+		filter := bson.M{
+			"identity":   cs.Identity,
+			"sdk":        cs.SDK,
+			"sdkVersion": cs.SDKVersion,
+			"userAgent":  cs.UserAgent,
+		}
+		update := bson.M{
+			"$inc":         bson.M{"requests": cs.Requests},
+			"$max":         bson.M{"lastSeen": cs.LastSeen},
+			"$setOnInsert": bson.M{"firstSeen": cs.FirstSeen},
+		}
+		models = append(models, mongo.NewUpdateOneModel().SetFilter(filter).SetUpdate(update).SetUpsert(true))
+	}
+
+	if _, err := m.collection.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false)); err != nil {
+		return fmt.Errorf("failed to record client sightings: %w", err)
+	}
+	return nil
+}
+
+// AdoptionReport groups sightings by SDK version, most recently seen first.
+func (m *MongoClientStore) AdoptionReport(ctx context.Context) ([]ClientAdoption, error) {
+	pipeline := mongo.Pipeline{
+		{{Key: "$group", Value: bson.M{
+			"_id":        bson.M{"sdk": "$sdk", "sdkVersion": "$sdkVersion"},
+			"identities": bson.M{"$addToSet": "$identity"},
+			"requests":   bson.M{"$sum": "$requests"},
+			"lastSeen":   bson.M{"$max": "$lastSeen"},
+		}}},
+		{{Key: "$project", Value: bson.M{
+			"_id":        0,
+			"sdk":        "$_id.sdk",
+			"sdkVersion": "$_id.sdkVersion",
+			"identities": bson.M{"$size": "$identities"},
+			"requests":   1,
+			"lastSeen":   1,
+		}}},
+		{{Key: "$sort", Value: bson.D{{Key: "lastSeen", Value: -1}}}},
+	}
+
+	cur, err := m.collection.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, fmt.Errorf("failed to aggregate client sightings: %w", err)
+	}
+	var report []ClientAdoption
+	if err := cur.All(ctx, &report); err != nil {
+		return nil, fmt.Errorf("failed to decode client adoption report: %w", err)
+	}
+	return report, nil
+}
+
+// Ping checks the connection to MongoDB.
+func (m *MongoClientStore) Ping(ctx context.Context) error {
+	return m.client.Ping(ctx, nil)
+}
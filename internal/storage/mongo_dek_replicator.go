@@ -0,0 +1,175 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"my-kms/internal/metrics"
+)
+
+// Outcomes of replicating one change, as counted in kms_dek_replication_changes_total.
+const (
+	ReplicationApplied  = "applied"  // the target now matches
+	ReplicationSkipped  = "skipped"  // nothing to do: only LastUsedAt changed, or the target already had it
+	ReplicationConflict = "conflict" // the target changed more recently and keeps its version
+)
+
+// replicationStateID names the resume token document in the state collection.
+const replicationStateID = "deks"
+
+// DEKReplicator copies DEK changes from one MongoDB cluster to another by tailing the
+// source collection's change stream, so DEKs created in one region can be decrypted in
+// another. Run one in each region, pointed at the other, for two-way replication.
+//
+// Conflicts are settled by ModifiedAt: a change only replaces the target document if it
+// is newer, so concurrent edits in two regions converge on the latest. A purge only
+// removes the target document if it is deleted there as well.
+type DEKReplicator struct {
+	source *mongo.Collection
+	target *mongo.Collection
+	state  *mongo.Collection // on the source cluster
+}
+
+// NewDEKReplicator replicates source to target, keeping its place in stateCollection in
+// the source database. The source must be a replica set or sharded cluster.
+func NewDEKReplicator(source, target *MongoDEKStore, stateCollection string) *DEKReplicator {
+	return &DEKReplicator{
+		source: source.collection,
+		target: target.collection,
+		state:  source.collection.Database().Collection(stateCollection),
+	}
+}
+
+type dekChangeEvent struct {
+	ResumeToken   bson.Raw            `bson:"_id"`
+	OperationType string              `bson:"operationType"`
+	ClusterTime   primitive.Timestamp `bson:"clusterTime"`
+	DocumentKey   struct {
+		ID primitive.ObjectID `bson:"_id"`
+	} `bson:"documentKey"`
+	FullDocument      *DEKDocument `bson:"fullDocument"`
+	UpdateDescription struct {
+		UpdatedFields bson.M `bson:"updatedFields"`
+	} `bson:"updateDescription"`
+}
+
+type replicationState struct {
+	ResumeToken bson.Raw  `bson:"resumeToken"`
+	UpdatedAt   time.Time `bson:"updatedAt"`
+}
+
+// Run replicates changes until ctx is done or the change stream fails. It resumes after
+// the last change it applied, so calling it again after an error loses nothing.
+func (r *DEKReplicator) Run(ctx context.Context) error {
+	opts := options.ChangeStream().SetFullDocument(options.UpdateLookup)
+	var st replicationState
+	switch err := r.state.FindOne(ctx, bson.M{"_id": replicationStateID}).Decode(&st); {
+	case err == nil:
+		opts.SetResumeAfter(st.ResumeToken)
+	case !errors.Is(err, mongo.ErrNoDocuments):
+		return fmt.Errorf("failed to read replication state: %w", err)
+	}
+
+	stream, err := r.source.Watch(ctx, mongo.Pipeline{}, opts)
+	if err != nil {
+		return fmt.Errorf("failed to open DEK change stream: %w", err)
+	}
+	defer stream.Close(context.Background())
+
+	for stream.Next(ctx) {
+		var ev dekChangeEvent
+		if err := stream.Decode(&ev); err != nil {
+			return fmt.Errorf("failed to decode DEK change: %w", err)
+		}
+		result, err := r.apply(ctx, &ev)
+		if err != nil {
+			return fmt.Errorf("failed to replicate DEK %s: %w", ev.DocumentKey.ID.Hex(), err)
+		}
+		metrics.DEKReplicationChanges.Inc(result)
+		if ev.ClusterTime.T != 0 {
+			metrics.DEKReplicationLag.Observe(time.Since(time.Unix(int64(ev.ClusterTime.T), 0)).Seconds())
+		}
+		if _, err := r.state.UpdateOne(ctx, bson.M{"_id": replicationStateID},
+			bson.M{"$set": replicationState{ResumeToken: ev.ResumeToken, UpdatedAt: time.Now().UTC()}},
+			options.Update().SetUpsert(true)); err != nil {
+			return fmt.Errorf("failed to save replication state: %w", err)
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return fmt.Errorf("DEK change stream ended: %w", stream.Err())
+}
+
+// apply makes the target reflect one change.
+func (r *DEKReplicator) apply(ctx context.Context, ev *dekChangeEvent) (string, error) {
+	id := ev.DocumentKey.ID
+	switch ev.OperationType {
+	case "insert", "update", "replace":
+		if ev.OperationType == "update" && onlyTouched(ev.UpdateDescription.UpdatedFields) {
+			return ReplicationSkipped, nil
+		}
+		doc := ev.FullDocument
+		if doc == nil {
+			// Purged before the change was read; the delete event follows.
+			return ReplicationSkipped, nil
+		}
+		filter := bson.M{"_id": id, "$or": bson.A{
+			bson.M{"modifiedAt": bson.M{"$exists": false}},
+			bson.M{"modifiedAt": bson.M{"$lt": doc.ModifiedAt}},
+		}}
+		_, err := r.target.ReplaceOne(ctx, filter, doc, options.Replace().SetUpsert(true))
+		if err == nil {
+			return ReplicationApplied, nil
+		}
+		if !mongo.IsDuplicateKeyError(err) {
+			return "", err
+		}
+		// The target has the document and it is not older. If it is the same version,
+		// this is our own change coming back, or one already applied.
+		var existing DEKDocument
+		if err := r.target.FindOne(ctx, bson.M{"_id": id}).Decode(&existing); err != nil {
+			return "", err
+		}
+		if existing.ModifiedAt.Equal(doc.ModifiedAt) {
+			return ReplicationSkipped, nil
+		}
+		return ReplicationConflict, nil
+	case "delete":
+		res, err := r.target.DeleteOne(ctx, bson.M{"_id": id, "deletedAt": bson.M{"$exists": true}})
+		if err != nil {
+			return "", err
+		}
+		if res.DeletedCount == 1 {
+			return ReplicationApplied, nil
+		}
+		// Either already gone, or restored in the target region since.
+		if err := r.target.FindOne(ctx, bson.M{"_id": id}).Err(); errors.Is(err, mongo.ErrNoDocuments) {
+			return ReplicationSkipped, nil
+		} else if err != nil {
+			return "", err
+		}
+		return ReplicationConflict, nil
+	case "invalidate", "drop", "rename", "dropDatabase":
+		return "", fmt.Errorf("DEK collection was %s", ev.OperationType)
+	default:
+		return ReplicationSkipped, nil
+	}
+}
+
+// onlyTouched reports whether an update changed nothing but lastUsedAt.
+func onlyTouched(fields bson.M) bool {
+	for k := range fields {
+		if k != "lastUsedAt" {
+			return false
+		}
+	}
+	return len(fields) > 0
+}
@@ -2,52 +2,189 @@ package storage
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"my-kms/internal/auth"
+)
+
+// KeyState is the lifecycle state of a DEK.
+type KeyState string
+
+const (
+	KeyStateEnabled         KeyState = "ENABLED"
+	KeyStateDisabled        KeyState = "DISABLED"
+	KeyStatePendingDeletion KeyState = "PENDING_DELETION"
+)
+
+// KeyOrigin records where a DEK's key material came from.
+type KeyOrigin string
+
+const (
+	KeyOriginKMS      KeyOrigin = "KMS"      // generated by this server
+	KeyOriginExternal KeyOrigin = "EXTERNAL" // imported by the customer (BYOK)
 )
 
+// KeyPolicy restricts which principals may use a DEK, on top of role checks.
+// Principals are "user:<uid>", "role:<ROLE>" or "*"; an empty list leaves that operation unrestricted.
+type KeyPolicy struct {
+	Encrypt []string `bson:"encrypt,omitempty" json:"encrypt,omitempty"`
+	Decrypt []string `bson:"decrypt,omitempty" json:"decrypt,omitempty"`
+	Manage  []string `bson:"manage,omitempty" json:"manage,omitempty"`
+	Derive  []string `bson:"derive,omitempty" json:"derive,omitempty"`
+
+	// EncryptionContext conditions encrypt and decrypt on the request's encryption
+	// context, e.g. {"decrypt": {"orderRegion": ["EU"]}}. It binds grantees too.
+	EncryptionContext map[string]auth.ContextCondition `bson:"encryptionContext,omitempty" json:"encryptionContext,omitempty"`
+}
+
+// KeyUsage restricts what a DEK may do for its whole life: it is set when the key is
+// created and never changes.
+type KeyUsage struct {
+	Operations     []string `bson:"operations,omitempty" json:"operations,omitempty"`         // encrypt, decrypt, wrap; empty allows all
+	MaxPayloadSize int      `bson:"maxPayloadSize,omitempty" json:"maxPayloadSize,omitempty"` // plaintext bytes per encrypt; 0 is no limit
+	Algorithms     []string `bson:"algorithms,omitempty" json:"algorithms,omitempty"`         // ciphertext schemes, e.g. AES_256_GCM, JWE, FF1; empty allows all
+}
+
 // DEKDocument represents a stored DEK document in MongoDB.
 type DEKDocument struct {
 	ID          primitive.ObjectID `bson:"_id,omitempty"`
 	DEK         []byte             `bson:"dek"`
 	MasterKeyID string             `bson:"masterKeyId"`
+	TenantID    string             `bson:"tenantId,omitempty"`
+	OwnerUID    string             `bson:"ownerUid,omitempty"`
+	Description string             `bson:"description,omitempty"`
+	Tags        map[string]string  `bson:"tags,omitempty"`
+	CreatedBy   string             `bson:"createdBy,omitempty"`
+	CreatedAt   time.Time          `bson:"createdAt,omitempty"`
+	LastUsedAt  time.Time          `bson:"lastUsedAt,omitempty"`
+	State       KeyState           `bson:"state,omitempty"`
+	Algorithm   string             `bson:"algorithm,omitempty"` // empty means AES_256_GCM
+	Origin      KeyOrigin          `bson:"origin,omitempty"`    // empty means KMS
+	PublicKey   []byte             `bson:"publicKey,omitempty"` // HPKE key pairs only
+
+	DeprecatedAt     time.Time `bson:"deprecatedAt,omitempty"`
+	SunsetAt         time.Time `bson:"sunsetAt,omitempty"`
+	ReplacementDEKID string    `bson:"replacementDekId,omitempty"`
+
+	Policy *KeyPolicy `bson:"policy,omitempty"` // nil means role checks only
+	Usage  *KeyUsage  `bson:"usage,omitempty"`  // nil allows whatever the algorithm supports
+
+	// Sealed holds Description, Tags and Policy encrypted, in which case those fields
+	// are empty in the store. SealedDEKStore seals and opens it.
+	Sealed *SealedMetadata `bson:"sealed,omitempty"`
+
+	// DeletedAt is the tombstone; deleted documents are invisible until restored or purged.
+	DeletedAt time.Time `bson:"deletedAt,omitempty"`
+	DeletedBy string    `bson:"deletedBy,omitempty"`
+
+	// ModifiedAt is when the document last changed, other than its LastUsedAt. MongoDB only:
+	// DEKReplicator uses it to settle conflicting changes made in two regions.
+	ModifiedAt time.Time `bson:"modifiedAt,omitempty"`
+}
+
+// ErrDEKNotFound is returned by MongoDEKStore.GetDEK for a DEK that doesn't exist.
+var ErrDEKNotFound = errors.New("no DEK found")
+
+// EffectiveState returns the key's state, treating documents written before states existed as enabled.
+func (d *DEKDocument) EffectiveState() KeyState {
+	if d.State == "" {
+		return KeyStateEnabled
+	}
+	return d.State
+}
+
+// DEKFilter narrows a DEK listing. TenantID is always applied; other empty fields match everything.
+type DEKFilter struct {
+	TenantID    string
+	MasterKeyID string
+	OwnerUID    string
+	State       KeyState
+	Tags        map[string]string
+
+	// TagHashes is Tags as blind index entries, by sealing key ID. A document with sealed
+	// metadata matches if its TagIndex holds every entry for its key ID.
+	TagHashes map[string][]string
+}
+
+// notDeleted matches documents without a tombstone.
+var notDeleted = bson.M{"$exists": false}
+
+// tenantMatch matches documents belonging to tenantID. The empty tenant
+// matches documents written without one, so single-tenant deployments keep working.
+func tenantMatch(tenantID string) interface{} {
+	if tenantID == "" {
+		return bson.M{"$in": bson.A{"", nil}}
+	}
+	return tenantID
+}
+
+// modified stamps an update with the current time as the document's modifiedAt.
+func modified(update bson.M) bson.M {
+	set, _ := update["$set"].(bson.M)
+	if set == nil {
+		set = bson.M{}
+		update["$set"] = set
+	}
+	set["modifiedAt"] = time.Now().UTC()
+	return update
+}
+
+// dekSelector builds the filter for a live DEK in the given tenant.
+func dekSelector(tenantID, id string) (bson.M, error) {
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, fmt.Errorf("invalid DEK ID format: %w", err)
+	}
+	return bson.M{"_id": oid, "tenantId": tenantMatch(tenantID), "deletedAt": notDeleted}, nil
 }
 
 // MongoDEKStore handles DEK data in MongoDB.
 type MongoDEKStore struct {
 	client     *mongo.Client
+	ownsClient bool
 	collection *mongo.Collection
 }
 
 // NewMongoDEKStore initializes a new MongoDEKStore.
 func NewMongoDEKStore(uri, dbName, collectionName string) (*MongoDEKStore, error) {
-	clientOpts := options.Client().ApplyURI(uri)
-	client, err := mongo.Connect(context.Background(), clientOpts)
+	client, err := ConnectMongo(uri)
 	if err != nil {
-		return nil, fmt.Errorf("failed to connect to MongoDB: %w", err)
-	}
-
-	if err := client.Ping(context.Background(), nil); err != nil {
-		return nil, fmt.Errorf("failed to ping MongoDB: %w", err)
+		return nil, err
 	}
+	store := NewMongoDEKStoreFromClient(client, dbName, collectionName)
+	store.ownsClient = true
+	return store, nil
+}
 
-	collection := client.Database(dbName).Collection(collectionName)
+// NewMongoDEKStoreFromClient creates a MongoDEKStore on a client shared with other
+// stores. Closing the store leaves the client connected.
+func NewMongoDEKStoreFromClient(client *mongo.Client, dbName, collectionName string) *MongoDEKStore {
 	return &MongoDEKStore{
 		client:     client,
-		collection: collection,
-	}, nil
+		collection: client.Database(dbName, readDatabaseOptions()).Collection(collectionName),
+	}
 }
 
 // InsertDEK inserts a new DEK document and returns its ID (hex string).
-func (m *MongoDEKStore) InsertDEK(ctx context.Context, dekEncrypted []byte, masterKeyID string) (string, error) {
-	res, err := m.collection.InsertOne(ctx, DEKDocument{
-		DEK:         dekEncrypted,
-		MasterKeyID: masterKeyID,
-	})
+// CreatedAt and State default to the current time and ENABLED if the caller left them empty.
+func (m *MongoDEKStore) InsertDEK(ctx context.Context, doc DEKDocument) (string, error) {
+	if doc.CreatedAt.IsZero() {
+		doc.CreatedAt = time.Now().UTC()
+	}
+	if doc.State == "" {
+		doc.State = KeyStateEnabled
+	}
+	if doc.ModifiedAt.IsZero() {
+		doc.ModifiedAt = time.Now().UTC()
+	}
+	res, err := m.collection.InsertOne(ctx, doc)
 	if err != nil {
 		return "", fmt.Errorf("failed to insert DEK: %w", err)
 	}
@@ -58,38 +195,344 @@ func (m *MongoDEKStore) InsertDEK(ctx context.Context, dekEncrypted []byte, mast
 	return oid.Hex(), nil
 }
 
-// GetDEK retrieves a DEK document by ID.
-func (m *MongoDEKStore) GetDEK(ctx context.Context, id string) (*DEKDocument, error) {
-	oid, err := primitive.ObjectIDFromHex(id)
+// GetDEK retrieves a DEK document by ID within a tenant.
+func (m *MongoDEKStore) GetDEK(ctx context.Context, tenantID, id string) (*DEKDocument, error) {
+	filter, err := dekSelector(tenantID, id)
 	if err != nil {
-		return nil, fmt.Errorf("invalid DEK ID format: %w", err)
+		return nil, err
 	}
 
 	var doc DEKDocument
-	if err := m.collection.FindOne(ctx, bson.M{"_id": oid}).Decode(&doc); err != nil {
+	if err := m.collection.FindOne(ctx, filter).Decode(&doc); err != nil {
 		if err == mongo.ErrNoDocuments {
-			return nil, fmt.Errorf("no DEK found with ID %s", id)
+			return nil, fmt.Errorf("%w with ID %s", ErrDEKNotFound, id)
 		}
 		return nil, fmt.Errorf("error retrieving DEK: %w", err)
 	}
 	return &doc, nil
 }
 
-// DeleteDEK deletes a DEK document by its ID.
-func (m *MongoDEKStore) DeleteDEK(ctx context.Context, id string) error {
+// DeleteDEK soft-deletes a DEK document by its ID, leaving a tombstone.
+func (m *MongoDEKStore) DeleteDEK(ctx context.Context, tenantID, id, deletedBy string) error {
+	return m.updateDEK(ctx, tenantID, id, modified(bson.M{"$set": bson.M{"deletedAt": time.Now().UTC(), "deletedBy": deletedBy}}))
+}
+
+// RestoreDEK removes the tombstone from a soft-deleted DEK document.
+func (m *MongoDEKStore) RestoreDEK(ctx context.Context, tenantID, id string) error {
+	filter, err := dekSelector(tenantID, id)
+	if err != nil {
+		return err
+	}
+	filter["deletedAt"] = bson.M{"$exists": true}
+
+	res, err := m.collection.UpdateOne(ctx, filter, modified(bson.M{"$unset": bson.M{"deletedAt": "", "deletedBy": ""}}))
+	if err != nil {
+		return fmt.Errorf("failed to restore DEK: %w", err)
+	}
+	if res.MatchedCount == 0 {
+		return fmt.Errorf("no deleted DEK found with ID %s", id)
+	}
+	return nil
+}
+
+// PurgeDeletedDEKs permanently removes DEK documents soft-deleted before cutoff,
+// sparing anything covered by a legal hold.
+func (m *MongoDEKStore) PurgeDeletedDEKs(ctx context.Context, cutoff time.Time, held HeldKeys) (int64, error) {
+	filter := bson.M{"deletedAt": bson.M{"$lt": cutoff}}
+	if len(held.TenantIDs) > 0 {
+		tenants := bson.A{}
+		for _, t := range held.TenantIDs {
+			tenants = append(tenants, t)
+			if t == "" {
+				tenants = append(tenants, nil)
+			}
+		}
+		filter["tenantId"] = bson.M{"$nin": tenants}
+	}
+	if len(held.DEKIDs) > 0 {
+		ids := bson.A{}
+		for _, id := range held.DEKIDs {
+			if oid, err := primitive.ObjectIDFromHex(id); err == nil {
+				ids = append(ids, oid)
+			}
+		}
+		filter["_id"] = bson.M{"$nin": ids}
+	}
+
+	res, err := m.collection.DeleteMany(ctx, filter)
+	if err != nil {
+		return 0, fmt.Errorf("failed to purge DEKs: %w", err)
+	}
+	return res.DeletedCount, nil
+}
+
+// ListDEKsByOwner returns all DEK documents in a tenant owned by the given Firebase UID.
+func (m *MongoDEKStore) ListDEKsByOwner(ctx context.Context, tenantID, ownerUID string) ([]DEKDocument, error) {
+	cur, err := m.collection.Find(ctx, bson.M{"tenantId": tenantMatch(tenantID), "ownerUid": ownerUID, "deletedAt": notDeleted})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list DEKs: %w", err)
+	}
+	var docs []DEKDocument
+	if err := cur.All(ctx, &docs); err != nil {
+		return nil, fmt.Errorf("failed to decode DEKs: %w", err)
+	}
+	return docs, nil
+}
+
+// ListDEKs returns up to limit DEK documents matching filter, ordered by ID, starting after cursor.
+// The wrapped key material is not loaded. The returned cursor is empty when there are no more results.
+func (m *MongoDEKStore) ListDEKs(ctx context.Context, filter DEKFilter, cursor string, limit int) ([]DEKDocument, string, error) {
+	query := bson.M{"tenantId": tenantMatch(filter.TenantID), "deletedAt": notDeleted}
+	if filter.MasterKeyID != "" {
+		query["masterKeyId"] = filter.MasterKeyID
+	}
+	if filter.OwnerUID != "" {
+		query["ownerUid"] = filter.OwnerUID
+	}
+	switch filter.State {
+	case "":
+	case KeyStateEnabled:
+		query["state"] = bson.M{"$in": bson.A{string(KeyStateEnabled), nil}}
+	default:
+		query["state"] = filter.State
+	}
+	if len(filter.Tags) > 0 {
+		clearTags := bson.M{}
+		for k, v := range filter.Tags {
+			clearTags["tags."+k] = v
+		}
+		or := bson.A{clearTags}
+		for keyID, hashes := range filter.TagHashes {
+			or = append(or, bson.M{"sealed.keyId": keyID, "sealed.tagIndex": bson.M{"$all": hashes}})
+		}
+		query["$or"] = or
+	}
+	if cursor != "" {
+		oid, err := primitive.ObjectIDFromHex(cursor)
+		if err != nil {
+			return nil, "", fmt.Errorf("invalid cursor: %w", err)
+		}
+		query["_id"] = bson.M{"$gt": oid}
+	}
+
+	// Fetch one extra document to learn whether another page exists.
+	opts := options.Find().
+		SetSort(bson.D{{Key: "_id", Value: 1}}).
+		SetLimit(int64(limit) + 1).
+		SetProjection(bson.M{"dek": 0})
+	cur, err := m.collection.Find(ctx, query, opts)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to list DEKs: %w", err)
+	}
+	var docs []DEKDocument
+	if err := cur.All(ctx, &docs); err != nil {
+		return nil, "", fmt.Errorf("failed to decode DEKs: %w", err)
+	}
+
+	next := ""
+	if len(docs) > limit {
+		docs = docs[:limit]
+		next = docs[limit-1].ID.Hex()
+	}
+	return docs, next, nil
+}
+
+// SetDEKOwner changes the owner of a DEK document.
+func (m *MongoDEKStore) SetDEKOwner(ctx context.Context, tenantID, id, ownerUID string) error {
+	return m.updateDEK(ctx, tenantID, id, modified(bson.M{"$set": bson.M{"ownerUid": ownerUID}}))
+}
+
+// SetDEKState moves a DEK to a new state, but only if it is currently in one of the allowed states.
+func (m *MongoDEKStore) SetDEKState(ctx context.Context, tenantID, id string, state KeyState, from ...KeyState) error {
+	filter, err := dekSelector(tenantID, id)
+	if err != nil {
+		return err
+	}
+	if len(from) > 0 {
+		allowed := bson.A{}
+		for _, st := range from {
+			allowed = append(allowed, string(st))
+			if st == KeyStateEnabled {
+				allowed = append(allowed, nil)
+			}
+		}
+		filter["state"] = bson.M{"$in": allowed}
+	}
+
+	res, err := m.collection.UpdateOne(ctx, filter, modified(bson.M{"$set": bson.M{"state": state}}))
+	if err != nil {
+		return fmt.Errorf("failed to update DEK state: %w", err)
+	}
+	if res.MatchedCount == 0 {
+		return fmt.Errorf("no DEK with ID %s in state %v", id, from)
+	}
+	return nil
+}
+
+// SetDEKDeprecation marks a DEK as deprecated. A zero deprecatedAt clears the deprecation.
+func (m *MongoDEKStore) SetDEKDeprecation(ctx context.Context, tenantID, id string, deprecatedAt, sunsetAt time.Time, replacementDEKID string) error {
+	if deprecatedAt.IsZero() {
+		return m.updateDEK(ctx, tenantID, id, modified(bson.M{"$unset": bson.M{"deprecatedAt": "", "sunsetAt": "", "replacementDekId": ""}}))
+	}
+	set := bson.M{"deprecatedAt": deprecatedAt}
+	unset := bson.M{}
+	if sunsetAt.IsZero() {
+		unset["sunsetAt"] = ""
+	} else {
+		set["sunsetAt"] = sunsetAt
+	}
+	if replacementDEKID == "" {
+		unset["replacementDekId"] = ""
+	} else {
+		set["replacementDekId"] = replacementDEKID
+	}
+	update := bson.M{"$set": set}
+	if len(unset) > 0 {
+		update["$unset"] = unset
+	}
+	return m.updateDEK(ctx, tenantID, id, modified(update))
+}
+
+// SetDEKTags adds or overwrites the given tags on a DEK document.
+func (m *MongoDEKStore) SetDEKTags(ctx context.Context, tenantID, id string, tags map[string]string) error {
+	set := bson.M{}
+	for k, v := range tags {
+		set["tags."+k] = v
+	}
+	return m.updateDEK(ctx, tenantID, id, modified(bson.M{"$set": set}))
+}
+
+// RemoveDEKTags removes the given tag keys from a DEK document.
+func (m *MongoDEKStore) RemoveDEKTags(ctx context.Context, tenantID, id string, keys []string) error {
+	unset := bson.M{}
+	for _, k := range keys {
+		unset["tags."+k] = ""
+	}
+	return m.updateDEK(ctx, tenantID, id, modified(bson.M{"$unset": unset}))
+}
+
+// SetDEKPolicy replaces the access policy of a DEK. A nil policy removes it.
+func (m *MongoDEKStore) SetDEKPolicy(ctx context.Context, tenantID, id string, policy *KeyPolicy) error {
+	if policy == nil {
+		return m.updateDEK(ctx, tenantID, id, modified(bson.M{"$unset": bson.M{"policy": ""}}))
+	}
+	return m.updateDEK(ctx, tenantID, id, modified(bson.M{"$set": bson.M{"policy": policy}}))
+}
+
+// SetDEKSealedMetadata replaces a DEK's sealed metadata and removes any metadata held
+// in the clear, provided the sealed ciphertext is still prev (nil for none). Otherwise
+// it returns ErrDEKChanged. Soft-deleted DEKs are updated too, so they can be resealed.
+func (m *MongoDEKStore) SetDEKSealedMetadata(ctx context.Context, tenantID, id string, prev []byte, sealed *SealedMetadata) error {
+	filter, err := dekSelector(tenantID, id)
+	if err != nil {
+		return err
+	}
+	delete(filter, "deletedAt")
+	if prev == nil {
+		filter["sealed"] = bson.M{"$exists": false}
+	} else {
+		filter["sealed.ciphertext"] = prev
+	}
+
+	res, err := m.collection.UpdateOne(ctx, filter, modified(bson.M{
+		"$set":   bson.M{"sealed": sealed},
+		"$unset": bson.M{"description": "", "tags": "", "policy": ""},
+	}))
+	if err != nil {
+		return fmt.Errorf("failed to update DEK: %w", err)
+	}
+	if res.MatchedCount == 0 {
+		return ErrDEKChanged
+	}
+	return nil
+}
+
+// ListDEKsByMasterKey returns up to limit DEK documents wrapped under masterKeyID or
+// with metadata sealed under it (every DEK when masterKeyID is empty), in every tenant
+// and including soft-deleted ones, ordered by ID, starting after cursor.
+func (m *MongoDEKStore) ListDEKsByMasterKey(ctx context.Context, masterKeyID, cursor string, limit int) ([]DEKDocument, string, error) {
+	query := bson.M{}
+	if masterKeyID != "" {
+		query["$or"] = bson.A{bson.M{"masterKeyId": masterKeyID}, bson.M{"sealed.keyId": masterKeyID}}
+	}
+	if cursor != "" {
+		oid, err := primitive.ObjectIDFromHex(cursor)
+		if err != nil {
+			return nil, "", fmt.Errorf("invalid cursor: %w", err)
+		}
+		query["_id"] = bson.M{"$gt": oid}
+	}
+
+	opts := options.Find().
+		SetSort(bson.D{{Key: "_id", Value: 1}}).
+		SetLimit(int64(limit) + 1)
+	cur, err := m.collection.Find(ctx, query, opts)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to list DEKs: %w", err)
+	}
+	var docs []DEKDocument
+	if err := cur.All(ctx, &docs); err != nil {
+		return nil, "", fmt.Errorf("failed to decode DEKs: %w", err)
+	}
+
+	next := ""
+	if len(docs) > limit {
+		docs = docs[:limit]
+		next = docs[limit-1].ID.Hex()
+	}
+	return docs, next, nil
+}
+
+// RewrapDEK replaces a DEK's wrapped key, deleted or not, provided it is still wrapped
+// under prevMasterKeyID. Otherwise it returns ErrDEKChanged.
+func (m *MongoDEKStore) RewrapDEK(ctx context.Context, tenantID, id, prevMasterKeyID string, dek []byte, masterKeyID string) error {
 	oid, err := primitive.ObjectIDFromHex(id)
 	if err != nil {
 		return fmt.Errorf("invalid DEK ID format: %w", err)
 	}
+	res, err := m.collection.UpdateOne(ctx,
+		bson.M{"_id": oid, "tenantId": tenantMatch(tenantID), "masterKeyId": prevMasterKeyID},
+		modified(bson.M{"$set": bson.M{"dek": dek, "masterKeyId": masterKeyID}}))
+	if err != nil {
+		return fmt.Errorf("failed to rewrap DEK: %w", err)
+	}
+	if res.MatchedCount == 0 {
+		return ErrDEKChanged
+	}
+	return nil
+}
+
+// TouchDEK records that a DEK was just used for a cryptographic operation. It leaves
+// modifiedAt alone, so use alone never counts as a change to replicate.
+func (m *MongoDEKStore) TouchDEK(ctx context.Context, tenantID, id string) error {
+	return m.updateDEK(ctx, tenantID, id, bson.M{"$set": bson.M{"lastUsedAt": time.Now().UTC()}})
+}
+
+func (m *MongoDEKStore) updateDEK(ctx context.Context, tenantID, id string, update bson.M) error {
+	filter, err := dekSelector(tenantID, id)
+	if err != nil {
+		return err
+	}
 
-	_, err = m.collection.DeleteOne(ctx, bson.M{"_id": oid})
+	res, err := m.collection.UpdateOne(ctx, filter, update)
 	if err != nil {
-		return fmt.Errorf("failed to delete DEK: %w", err)
+		return fmt.Errorf("failed to update DEK: %w", err)
+	}
+	if res.MatchedCount == 0 {
+		return fmt.Errorf("no DEK found with ID %s", id)
 	}
 	return nil
 }
 
+// Ping checks the connection to MongoDB.
+func (m *MongoDEKStore) Ping(ctx context.Context) error {
+	return m.client.Ping(ctx, nil)
+}
+
 // Close disconnects from MongoDB.
 func (m *MongoDEKStore) Close(ctx context.Context) error {
+	if !m.ownsClient {
+		return nil
+	}
 	return m.client.Disconnect(ctx)
 }
@@ -0,0 +1,179 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"my-kms/internal/auth"
+)
+
+// GrantConstraints limit a grant to requests carrying a matching encryption context, and
+// from the listed networks.
+type GrantConstraints struct {
+	// EncryptionContextSubset pairs must all be present in the request's context.
+	EncryptionContextSubset map[string]string `bson:"encryptionContextSubset,omitempty" json:"encryptionContextSubset,omitempty"`
+	// EncryptionContextEquals must equal the request's context exactly.
+	EncryptionContextEquals map[string]string `bson:"encryptionContextEquals,omitempty" json:"encryptionContextEquals,omitempty"`
+	// SourceCIDRs must contain the request's client address.
+	SourceCIDRs auth.SourceCIDRs `bson:"sourceCidrs,omitempty" json:"sourceCIDRs,omitempty"`
+}
+
+// Allows reports whether an encryption context satisfies the constraints.
+func (c GrantConstraints) Allows(encCtx map[string]string) bool {
+	if c.EncryptionContextEquals != nil {
+		if len(encCtx) != len(c.EncryptionContextEquals) {
+			return false
+		}
+		for k, v := range c.EncryptionContextEquals {
+			if got, ok := encCtx[k]; !ok || got != v {
+				return false
+			}
+		}
+	}
+	for k, v := range c.EncryptionContextSubset {
+		if got, ok := encCtx[k]; !ok || got != v {
+			return false
+		}
+	}
+	return true
+}
+
+// Grant delegates specific operations on one DEK to a grantee principal.
+type Grant struct {
+	ID          primitive.ObjectID `bson:"_id,omitempty"`
+	TenantID    string             `bson:"tenantId,omitempty"`
+	DEKID       string             `bson:"dekId"`
+	Grantee     string             `bson:"grantee"` // principal, e.g. user:<uid>
+	Operations  []string           `bson:"operations"`
+	Constraints GrantConstraints   `bson:"constraints,omitempty"`
+	CreatedBy   string             `bson:"createdBy"`
+	CreatedAt   time.Time          `bson:"createdAt"`
+	ValidFrom   time.Time          `bson:"validFrom,omitempty"` // zero applies at once
+	ExpiresAt   time.Time          `bson:"expiresAt,omitempty"` // zero never expires
+	RetiredAt   time.Time          `bson:"retiredAt,omitempty"`
+	RetiredBy   string             `bson:"retiredBy,omitempty"`
+}
+
+// MongoGrantStore handles key grants in MongoDB.
+type MongoGrantStore struct {
+	client     *mongo.Client
+	collection *mongo.Collection
+}
+
+// NewMongoGrantStoreFromClient creates a MongoGrantStore on a client shared with other
+// stores.
+func NewMongoGrantStoreFromClient(client *mongo.Client, dbName, collectionName string) *MongoGrantStore {
+	collection := client.Database(dbName).Collection(collectionName)
+	return &MongoGrantStore{
+		client:     client,
+		collection: collection,
+	}
+}
+
+// InsertGrant stores a new grant and returns its ID (hex string).
+func (m *MongoGrantStore) InsertGrant(ctx context.Context, g Grant) (string, error) {
+	if g.CreatedAt.IsZero() {
+		g.CreatedAt = time.Now().UTC()
+	}
+	res, err := m.collection.InsertOne(ctx, g)
+	if err != nil {
+		return "", fmt.Errorf("failed to insert grant: %w", err)
+	}
+	oid, ok := res.InsertedID.(primitive.ObjectID)
+	if !ok {
+		return "", fmt.Errorf("failed to convert inserted ID to ObjectID")
+	}
+	return oid.Hex(), nil
+}
+
+// GetGrant retrieves an unretired grant by ID within a tenant.
+func (m *MongoGrantStore) GetGrant(ctx context.Context, tenantID, id string) (*Grant, error) {
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, fmt.Errorf("invalid grant ID format: %w", err)
+	}
+	var g Grant
+	filter := bson.M{"_id": oid, "tenantId": tenantMatch(tenantID), "retiredAt": bson.M{"$exists": false}}
+	if err := m.collection.FindOne(ctx, filter).Decode(&g); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, fmt.Errorf("no grant found with ID %s", id)
+		}
+		return nil, fmt.Errorf("error retrieving grant: %w", err)
+	}
+	return &g, nil
+}
+
+// ListGrants returns the unretired grants on a DEK, including expired ones.
+func (m *MongoGrantStore) ListGrants(ctx context.Context, tenantID, dekID string) ([]Grant, error) {
+	filter := bson.M{"tenantId": tenantMatch(tenantID), "dekId": dekID, "retiredAt": bson.M{"$exists": false}}
+	cur, err := m.collection.Find(ctx, filter, options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list grants: %w", err)
+	}
+	var grants []Grant
+	if err := cur.All(ctx, &grants); err != nil {
+		return nil, fmt.Errorf("failed to decode grants: %w", err)
+	}
+	return grants, nil
+}
+
+// FindActiveGrants returns the unretired grants on a DEK, inside their validity window,
+// that give any of principals the operation.
+func (m *MongoGrantStore) FindActiveGrants(ctx context.Context, tenantID, dekID string, principals []string, operation string) ([]Grant, error) {
+	now := time.Now().UTC()
+	filter := bson.M{
+		"tenantId":   tenantMatch(tenantID),
+		"dekId":      dekID,
+		"grantee":    bson.M{"$in": principals},
+		"operations": operation,
+		"retiredAt":  bson.M{"$exists": false},
+		"$and": bson.A{
+			bson.M{"$or": bson.A{
+				bson.M{"expiresAt": bson.M{"$exists": false}},
+				bson.M{"expiresAt": bson.M{"$gt": now}},
+			}},
+			bson.M{"$or": bson.A{
+				bson.M{"validFrom": bson.M{"$exists": false}},
+				bson.M{"validFrom": bson.M{"$lte": now}},
+			}},
+		},
+	}
+	cur, err := m.collection.Find(ctx, filter)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find grants: %w", err)
+	}
+	var grants []Grant
+	if err := cur.All(ctx, &grants); err != nil {
+		return nil, fmt.Errorf("failed to decode grants: %w", err)
+	}
+	return grants, nil
+}
+
+// RetireGrant marks a grant retired; it stops applying immediately.
+func (m *MongoGrantStore) RetireGrant(ctx context.Context, tenantID, id, retiredBy string) error {
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return fmt.Errorf("invalid grant ID format: %w", err)
+	}
+	filter := bson.M{"_id": oid, "tenantId": tenantMatch(tenantID), "retiredAt": bson.M{"$exists": false}}
+	update := bson.M{"$set": bson.M{"retiredAt": time.Now().UTC(), "retiredBy": retiredBy}}
+	res, err := m.collection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return fmt.Errorf("failed to retire grant: %w", err)
+	}
+	if res.MatchedCount == 0 {
+		return fmt.Errorf("no grant found with ID %s", id)
+	}
+	return nil
+}
+
+// Ping checks the connection to MongoDB.
+func (m *MongoGrantStore) Ping(ctx context.Context) error {
+	return m.client.Ping(ctx, nil)
+}
@@ -0,0 +1,89 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// HandoffToken lets one named recipient decrypt one specific ciphertext, once.
+type HandoffToken struct {
+	ID                primitive.ObjectID `bson:"_id,omitempty"`
+	TenantID          string             `bson:"tenantId,omitempty"`
+	DEKID             string             `bson:"dekId"`
+	AliasName         string             `bson:"aliasName,omitempty"` // alias the token was minted through, if any
+	CiphertextHash    []byte             `bson:"ciphertextHash"`      // SHA-256 of the ciphertext
+	EncryptionContext map[string]string  `bson:"encryptionContext,omitempty"`
+	Recipient         string             `bson:"recipient"` // identity name of the only caller who may redeem it
+	CreatedBy         string             `bson:"createdBy"`
+	CreatedAt         time.Time          `bson:"createdAt"`
+	ExpiresAt         time.Time          `bson:"expiresAt"`
+	RedeemedAt        time.Time          `bson:"redeemedAt,omitempty"`
+}
+
+// MongoHandoffTokenStore handles handoff tokens in MongoDB.
+type MongoHandoffTokenStore struct {
+	client     *mongo.Client
+	collection *mongo.Collection
+}
+
+// NewMongoHandoffTokenStoreFromClient creates a MongoHandoffTokenStore on a client shared with other
+// stores.
+func NewMongoHandoffTokenStoreFromClient(client *mongo.Client, dbName, collectionName string) *MongoHandoffTokenStore {
+	collection := client.Database(dbName).Collection(collectionName)
+	return &MongoHandoffTokenStore{
+		client:     client,
+		collection: collection,
+	}
+}
+
+// InsertHandoffToken stores a new handoff token and returns its ID (hex string).
+func (m *MongoHandoffTokenStore) InsertHandoffToken(ctx context.Context, tok HandoffToken) (string, error) {
+	res, err := m.collection.InsertOne(ctx, tok)
+	if err != nil {
+		return "", fmt.Errorf("failed to insert handoff token: %w", err)
+	}
+	oid, ok := res.InsertedID.(primitive.ObjectID)
+	if !ok {
+		return "", fmt.Errorf("failed to convert inserted ID to ObjectID")
+	}
+	return oid.Hex(), nil
+}
+
+// ConsumeHandoffToken atomically marks an unexpired, unredeemed token as redeemed and returns it.
+// The token must belong to the tenant, name recipient and be bound to ciphertextHash.
+func (m *MongoHandoffTokenStore) ConsumeHandoffToken(ctx context.Context, tenantID, id, recipient string, ciphertextHash []byte) (*HandoffToken, error) {
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, fmt.Errorf("invalid handoff token format: %w", err)
+	}
+
+	now := time.Now().UTC()
+	filter := bson.M{
+		"_id":            oid,
+		"tenantId":       tenantMatch(tenantID),
+		"recipient":      recipient,
+		"ciphertextHash": ciphertextHash,
+		"redeemedAt":     bson.M{"$exists": false},
+		"expiresAt":      bson.M{"$gt": now},
+	}
+	update := bson.M{"$set": bson.M{"redeemedAt": now}}
+
+	var tok HandoffToken
+	if err := m.collection.FindOneAndUpdate(ctx, filter, update).Decode(&tok); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, fmt.Errorf("handoff token %s is unknown, expired, already redeemed or not valid for this ciphertext", id)
+		}
+		return nil, fmt.Errorf("error consuming handoff token: %w", err)
+	}
+	return &tok, nil
+}
+
+// Ping checks the connection to MongoDB.
+func (m *MongoHandoffTokenStore) Ping(ctx context.Context) error {
+	return m.client.Ping(ctx, nil)
+}
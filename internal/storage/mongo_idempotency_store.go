@@ -0,0 +1,102 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// IdempotencyRecord is the outcome of a request made with an Idempotency-Key header.
+// Until the first request finishes it holds only the fingerprint; retries see a zero
+// Status and must wait.
+type IdempotencyRecord struct {
+	ID          string    `bson:"_id"`         // hash of the tenant, caller, endpoint and key
+	Fingerprint string    `bson:"fingerprint"` // hash of the request the key was first used with
+	Status      int       `bson:"status,omitempty"`
+	ContentType string    `bson:"contentType,omitempty"`
+	Body        []byte    `bson:"body,omitempty"`
+	CreatedAt   time.Time `bson:"createdAt"`
+	ExpiresAt   time.Time `bson:"expiresAt"`
+}
+
+// MongoIdempotencyStore keeps idempotency records in MongoDB, so that a retry is
+// answered from the first response whichever instance it reaches.
+type MongoIdempotencyStore struct {
+	client     *mongo.Client
+	collection *mongo.Collection
+}
+
+// NewMongoIdempotencyStoreFromClient creates a MongoIdempotencyStore on a client shared with other
+// stores.
+func NewMongoIdempotencyStoreFromClient(client *mongo.Client, dbName, collectionName string) (*MongoIdempotencyStore, error) {
+	collection := client.Database(dbName).Collection(collectionName)
+	index := mongo.IndexModel{
+		Keys:    bson.D{{Key: "expiresAt", Value: 1}},
+		Options: options.Index().SetName("expires_ttl").SetExpireAfterSeconds(0),
+	}
+	if _, err := collection.Indexes().CreateOne(context.Background(), index); err != nil {
+		return nil, fmt.Errorf("failed to create idempotency key indexes: %w", err)
+	}
+	return &MongoIdempotencyStore{
+		client:     client,
+		collection: collection,
+	}, nil
+}
+
+// Begin stores rec unless a live record has its ID, and returns that record if so. A nil
+// record means the caller owns rec and must Complete or Release it. Expired records are
+// replaced, since the TTL index removes them only periodically.
+func (m *MongoIdempotencyStore) Begin(ctx context.Context, rec IdempotencyRecord) (*IdempotencyRecord, error) {
+	for attempt := 1; ; attempt++ {
+		_, err := m.collection.InsertOne(ctx, rec)
+		if err == nil {
+			return nil, nil
+		}
+		if !mongo.IsDuplicateKeyError(err) || attempt == maxIncrementAttempts {
+			return nil, fmt.Errorf("failed to store idempotency key: %w", err)
+		}
+		var existing IdempotencyRecord
+		err = m.collection.FindOne(ctx, bson.M{"_id": rec.ID}).Decode(&existing)
+		if err == mongo.ErrNoDocuments {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to get idempotency key: %w", err)
+		}
+		if existing.ExpiresAt.After(time.Now()) {
+			return &existing, nil
+		}
+		if _, err := m.collection.DeleteOne(ctx, bson.M{"_id": rec.ID, "expiresAt": existing.ExpiresAt}); err != nil {
+			return nil, fmt.Errorf("failed to delete idempotency key: %w", err)
+		}
+	}
+}
+
+// Complete records the response to the request that began id, kept until expiresAt.
+func (m *MongoIdempotencyStore) Complete(ctx context.Context, id string, status int, contentType string, body []byte, expiresAt time.Time) error {
+	_, err := m.collection.UpdateOne(ctx,
+		bson.M{"_id": id},
+		bson.M{"$set": bson.M{"status": status, "contentType": contentType, "body": body, "expiresAt": expiresAt}},
+	)
+	if err != nil {
+		return fmt.Errorf("failed to complete idempotency key: %w", err)
+	}
+	return nil
+}
+
+// Release deletes id while no response is recorded for it, so that a retry runs again.
+func (m *MongoIdempotencyStore) Release(ctx context.Context, id string) error {
+	if _, err := m.collection.DeleteOne(ctx, bson.M{"_id": id, "status": bson.M{"$exists": false}}); err != nil {
+		return fmt.Errorf("failed to release idempotency key: %w", err)
+	}
+	return nil
+}
+
+// Ping checks the connection to MongoDB.
+func (m *MongoIdempotencyStore) Ping(ctx context.Context) error {
+	return m.client.Ping(ctx, nil)
+}
@@ -0,0 +1,96 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// ImportToken holds the wrapping key pair issued for one key-material import.
+// The private key is stored wrapped under a master key.
+type ImportToken struct {
+	ID                primitive.ObjectID `bson:"_id,omitempty"`
+	PublicKey         []byte             `bson:"publicKey"` // DER-encoded SubjectPublicKeyInfo
+	WrappedPrivateKey []byte             `bson:"wrappedPrivateKey"`
+	MasterKeyID       string             `bson:"masterKeyId"`
+	Algorithm         string             `bson:"algorithm"` // algorithm of the key material to be imported
+	TenantID          string             `bson:"tenantId,omitempty"`
+	CreatedBy         string             `bson:"createdBy"`
+	CreatedAt         time.Time          `bson:"createdAt"`
+	ExpiresAt         time.Time          `bson:"expiresAt"`
+	UsedAt            time.Time          `bson:"usedAt,omitempty"`
+}
+
+// MongoImportTokenStore handles import tokens in MongoDB.
+type MongoImportTokenStore struct {
+	client     *mongo.Client
+	collection *mongo.Collection
+}
+
+// NewMongoImportTokenStoreFromClient creates a MongoImportTokenStore on a client shared with other
+// stores.
+func NewMongoImportTokenStoreFromClient(client *mongo.Client, dbName, collectionName string) *MongoImportTokenStore {
+	collection := client.Database(dbName).Collection(collectionName)
+	return &MongoImportTokenStore{
+		client:     client,
+		collection: collection,
+	}
+}
+
+// InsertImportToken stores a new import token and returns its ID (hex string).
+func (m *MongoImportTokenStore) InsertImportToken(ctx context.Context, tok ImportToken) (string, error) {
+	res, err := m.collection.InsertOne(ctx, tok)
+	if err != nil {
+		return "", fmt.Errorf("failed to insert import token: %w", err)
+	}
+	oid, ok := res.InsertedID.(primitive.ObjectID)
+	if !ok {
+		return "", fmt.Errorf("failed to convert inserted ID to ObjectID")
+	}
+	return oid.Hex(), nil
+}
+
+// ConsumeImportToken atomically marks an unexpired, unused token of the tenant as used and returns it.
+func (m *MongoImportTokenStore) ConsumeImportToken(ctx context.Context, tenantID, id string) (*ImportToken, error) {
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, fmt.Errorf("invalid import token format: %w", err)
+	}
+
+	now := time.Now().UTC()
+	filter := bson.M{
+		"_id":       oid,
+		"tenantId":  tenantMatch(tenantID),
+		"usedAt":    bson.M{"$exists": false},
+		"expiresAt": bson.M{"$gt": now},
+	}
+	update := bson.M{"$set": bson.M{"usedAt": now}}
+
+	var tok ImportToken
+	if err := m.collection.FindOneAndUpdate(ctx, filter, update).Decode(&tok); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, fmt.Errorf("import token %s is unknown, expired or already used", id)
+		}
+		return nil, fmt.Errorf("error consuming import token: %w", err)
+	}
+	return &tok, nil
+}
+
+// CountByMasterKey counts the unexpired import tokens whose private key is wrapped
+// under masterKeyID.
+func (m *MongoImportTokenStore) CountByMasterKey(ctx context.Context, masterKeyID string) (int64, error) {
+	n, err := m.collection.CountDocuments(ctx, bson.M{"masterKeyId": masterKeyID, "expiresAt": bson.M{"$gt": time.Now().UTC()}})
+	if err != nil {
+		return 0, fmt.Errorf("failed to count import tokens: %w", err)
+	}
+	return n, nil
+}
+
+// Ping checks the connection to MongoDB.
+func (m *MongoImportTokenStore) Ping(ctx context.Context) error {
+	return m.client.Ping(ctx, nil)
+}
@@ -0,0 +1,111 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// IndexKey is one tenant's HMAC key for a named blind index, wrapped by a master key
+// (or the tenant's CMK) exactly like a DEK.
+type IndexKey struct {
+	ID          primitive.ObjectID `bson:"_id,omitempty" json:"-"`
+	TenantID    string             `bson:"tenantId,omitempty" json:"tenantID,omitempty"`
+	Name        string             `bson:"name" json:"name"`
+	Key         []byte             `bson:"key" json:"-"`
+	MasterKeyID string             `bson:"masterKeyId" json:"masterKeyID"`
+	CreatedBy   string             `bson:"createdBy" json:"createdBy"`
+	CreatedAt   time.Time          `bson:"createdAt" json:"createdAt"`
+}
+
+// MongoIndexKeyStore keeps blind index keys in MongoDB, one per tenant and name.
+type MongoIndexKeyStore struct {
+	client     *mongo.Client
+	collection *mongo.Collection
+}
+
+// NewMongoIndexKeyStoreFromClient creates a MongoIndexKeyStore on a client shared with other
+// stores.
+func NewMongoIndexKeyStoreFromClient(client *mongo.Client, dbName, collectionName string) (*MongoIndexKeyStore, error) {
+	collection := client.Database(dbName).Collection(collectionName)
+	index := mongo.IndexModel{
+		Keys:    bson.D{{Key: "tenantId", Value: 1}, {Key: "name", Value: 1}},
+		Options: options.Index().SetName("tenant_name").SetUnique(true),
+	}
+	if _, err := collection.Indexes().CreateOne(context.Background(), index); err != nil {
+		return nil, fmt.Errorf("failed to create index key indexes: %w", err)
+	}
+	return &MongoIndexKeyStore{
+		client:     client,
+		collection: collection,
+	}, nil
+}
+
+// GetIndexKey returns a tenant's index key by name, nil if it does not exist yet.
+func (m *MongoIndexKeyStore) GetIndexKey(ctx context.Context, tenantID, name string) (*IndexKey, error) {
+	var k IndexKey
+	err := m.collection.FindOne(ctx, bson.M{"tenantId": tenantMatch(tenantID), "name": name}).Decode(&k)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get index key: %w", err)
+	}
+	return &k, nil
+}
+
+// CreateIndexKey stores k unless the tenant already has a key with its name, and
+// returns whichever key is stored and whether it is k: two instances creating the same
+// index at once end up using the same key.
+func (m *MongoIndexKeyStore) CreateIndexKey(ctx context.Context, k IndexKey) (*IndexKey, bool, error) {
+	if k.CreatedAt.IsZero() {
+		k.CreatedAt = time.Now().UTC()
+	}
+	if _, err := m.collection.InsertOne(ctx, k); err != nil {
+		if !mongo.IsDuplicateKeyError(err) {
+			return nil, false, fmt.Errorf("failed to insert index key: %w", err)
+		}
+		existing, err := m.GetIndexKey(ctx, k.TenantID, k.Name)
+		if err != nil {
+			return nil, false, err
+		}
+		if existing == nil {
+			return nil, false, fmt.Errorf("index key %s was created concurrently but cannot be read", k.Name)
+		}
+		return existing, false, nil
+	}
+	return &k, true, nil
+}
+
+// ListIndexKeys returns a tenant's index keys, ordered by name.
+func (m *MongoIndexKeyStore) ListIndexKeys(ctx context.Context, tenantID string) ([]IndexKey, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "name", Value: 1}}).SetProjection(bson.M{"key": 0})
+	cur, err := m.collection.Find(ctx, bson.M{"tenantId": tenantMatch(tenantID)}, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list index keys: %w", err)
+	}
+	var keys []IndexKey
+	if err := cur.All(ctx, &keys); err != nil {
+		return nil, fmt.Errorf("failed to decode index keys: %w", err)
+	}
+	return keys, nil
+}
+
+// CountByMasterKey counts the index keys wrapped under masterKeyID.
+func (m *MongoIndexKeyStore) CountByMasterKey(ctx context.Context, masterKeyID string) (int64, error) {
+	n, err := m.collection.CountDocuments(ctx, bson.M{"masterKeyId": masterKeyID})
+	if err != nil {
+		return 0, fmt.Errorf("failed to count index keys: %w", err)
+	}
+	return n, nil
+}
+
+// Ping checks the connection to MongoDB.
+func (m *MongoIndexKeyStore) Ping(ctx context.Context) error {
+	return m.client.Ping(ctx, nil)
+}
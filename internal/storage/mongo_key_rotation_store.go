@@ -0,0 +1,140 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Kinds of key rotated.
+const (
+	RotatedKeyMaster = "MASTER_KEY"
+	RotatedKeyData   = "DATA_KEY"
+)
+
+// Ways a key is rotated.
+const (
+	RotationMethodRotate  = "rotate"  // a new master key became active
+	RotationMethodRewrap  = "rewrap"  // a DEK moved onto the active master key
+	RotationMethodReplace = "replace" // a DEK was deprecated in favour of another
+)
+
+// KeyRotationEvent records one rotation: what changed, who did it, when and why.
+type KeyRotationEvent struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	Time      time.Time          `bson:"time" json:"time"`
+	KeyType   string             `bson:"keyType" json:"keyType"`
+	Method    string             `bson:"method" json:"method"`
+	TenantID  string             `bson:"tenantId,omitempty" json:"tenantID,omitempty"` // data keys only
+	KeyID     string             `bson:"keyId" json:"keyID"`                           // the master key replaced, or the DEK
+	NewKeyID  string             `bson:"newKeyId,omitempty" json:"newKeyID,omitempty"` // the new master key, or the replacement DEK
+	RotatedBy string             `bson:"rotatedBy" json:"rotatedBy"`                   // "kms" for scheduled rotations and rewraps
+	Reason    string             `bson:"reason,omitempty" json:"reason,omitempty"`
+
+	// For a rewrap, the master keys the DEK moved between.
+	FromMasterKeyID string `bson:"fromMasterKeyId,omitempty" json:"fromMasterKeyID,omitempty"`
+	ToMasterKeyID   string `bson:"toMasterKeyId,omitempty" json:"toMasterKeyID,omitempty"`
+}
+
+// KeyRotationQuery selects rotation events; empty fields match anything. Master key
+// rotations belong to no tenant and match every TenantID.
+type KeyRotationQuery struct {
+	TenantID   string
+	AllTenants bool
+	KeyType    string
+	KeyID      string // matches KeyID, NewKeyID and the master keys of a rewrap
+	Since      time.Time
+	Until      time.Time
+	Limit      int64
+}
+
+// MongoKeyRotationStore keeps the history of key rotations in MongoDB.
+type MongoKeyRotationStore struct {
+	client     *mongo.Client
+	collection *mongo.Collection
+}
+
+// NewMongoKeyRotationStoreFromClient creates a MongoKeyRotationStore on a client shared with other
+// stores.
+func NewMongoKeyRotationStoreFromClient(client *mongo.Client, dbName, collectionName string) (*MongoKeyRotationStore, error) {
+	collection := client.Database(dbName).Collection(collectionName)
+	timeIndex := mongo.IndexModel{Keys: bson.D{{Key: "time", Value: -1}}}
+	if _, err := collection.Indexes().CreateOne(context.Background(), timeIndex); err != nil {
+		return nil, fmt.Errorf("failed to create key rotation index: %w", err)
+	}
+	return &MongoKeyRotationStore{
+		client:     client,
+		collection: collection,
+	}, nil
+}
+
+// RecordRotation stores ev, setting its time if unset.
+func (m *MongoKeyRotationStore) RecordRotation(ctx context.Context, ev KeyRotationEvent) error {
+	if ev.Time.IsZero() {
+		ev.Time = time.Now().UTC()
+	}
+	if _, err := m.collection.InsertOne(ctx, ev); err != nil {
+		return fmt.Errorf("failed to insert key rotation event: %w", err)
+	}
+	return nil
+}
+
+// QueryRotations returns matching events, newest first.
+func (m *MongoKeyRotationStore) QueryRotations(ctx context.Context, q KeyRotationQuery) ([]KeyRotationEvent, error) {
+	var and bson.A
+	if !q.AllTenants {
+		and = append(and, bson.M{"$or": bson.A{
+			bson.M{"tenantId": tenantMatch(q.TenantID)},
+			bson.M{"keyType": RotatedKeyMaster},
+		}})
+	}
+	if q.KeyType != "" {
+		and = append(and, bson.M{"keyType": q.KeyType})
+	}
+	if q.KeyID != "" {
+		and = append(and, bson.M{"$or": bson.A{
+			bson.M{"keyId": q.KeyID},
+			bson.M{"newKeyId": q.KeyID},
+			bson.M{"fromMasterKeyId": q.KeyID},
+			bson.M{"toMasterKeyId": q.KeyID},
+		}})
+	}
+	timeFilter := bson.M{}
+	if !q.Since.IsZero() {
+		timeFilter["$gte"] = q.Since
+	}
+	if !q.Until.IsZero() {
+		timeFilter["$lt"] = q.Until
+	}
+	if len(timeFilter) > 0 {
+		and = append(and, bson.M{"time": timeFilter})
+	}
+	filter := bson.M{}
+	if len(and) > 0 {
+		filter["$and"] = and
+	}
+
+	opts := options.Find().SetSort(bson.D{{Key: "time", Value: -1}, {Key: "_id", Value: -1}})
+	if q.Limit > 0 {
+		opts.SetLimit(q.Limit)
+	}
+	cur, err := m.collection.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query key rotations: %w", err)
+	}
+	var events []KeyRotationEvent
+	if err := cur.All(ctx, &events); err != nil {
+		return nil, fmt.Errorf("failed to decode key rotations: %w", err)
+	}
+	return events, nil
+}
+
+// Ping checks the connection to MongoDB.
+func (m *MongoKeyRotationStore) Ping(ctx context.Context) error {
+	return m.client.Ping(ctx, nil)
+}
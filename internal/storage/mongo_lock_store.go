@@ -0,0 +1,90 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Lease is a lock document: Owner holds the lock Name until ExpiresAt, unless it renews.
+type Lease struct {
+	Name       string    `bson:"_id"`
+	Owner      string    `bson:"owner"`
+	AcquiredAt time.Time `bson:"acquiredAt"`
+	ExpiresAt  time.Time `bson:"expiresAt"`
+}
+
+// MongoLockStore hands out leases on named locks in MongoDB, so that replicas sharing a
+// database take turns at jobs that must not run twice at once. A lease whose owner
+// stops renewing it, e.g. because the replica died, lapses and can be taken over.
+type MongoLockStore struct {
+	client     *mongo.Client
+	collection *mongo.Collection
+}
+
+// NewMongoLockStoreFromClient creates a MongoLockStore on a client shared with other
+// stores.
+func NewMongoLockStoreFromClient(client *mongo.Client, dbName, collectionName string) *MongoLockStore {
+	collection := client.Database(dbName).Collection(collectionName)
+	return &MongoLockStore{
+		client:     client,
+		collection: collection,
+	}
+}
+
+// TryAcquire takes the lock name for owner until ttl from now, or extends the lease if
+// owner already holds it. It reports false, without waiting, while another owner's
+// lease is current.
+func (m *MongoLockStore) TryAcquire(ctx context.Context, name, owner string, ttl time.Duration) (bool, error) {
+	now := time.Now().UTC()
+	filter := bson.M{"_id": name, "$or": bson.A{
+		bson.M{"owner": owner},
+		bson.M{"expiresAt": bson.M{"$lt": now}},
+	}}
+	// acquiredAt is kept across renewals, so it says how long this owner has held the
+	// lock. Expressions in one $set stage see the document as it was.
+	update := mongo.Pipeline{{{Key: "$set", Value: bson.M{
+		"acquiredAt": bson.M{"$cond": bson.A{bson.M{"$eq": bson.A{"$owner", owner}}, "$acquiredAt", now}},
+		"owner":      owner,
+		"expiresAt":  now.Add(ttl),
+	}}}}
+	_, err := m.collection.UpdateOne(ctx, filter, update, options.Update().SetUpsert(true))
+	if mongo.IsDuplicateKeyError(err) {
+		return false, nil // the filter missed because someone else holds it
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to acquire lock %s: %w", name, err)
+	}
+	return true, nil
+}
+
+// Release gives up owner's lease on name. Releasing a lease owner no longer holds does
+// nothing.
+func (m *MongoLockStore) Release(ctx context.Context, name, owner string) error {
+	if _, err := m.collection.DeleteOne(ctx, bson.M{"_id": name, "owner": owner}); err != nil {
+		return fmt.Errorf("failed to release lock %s: %w", name, err)
+	}
+	return nil
+}
+
+// Holder returns the current lease on name, or nil if nobody holds it.
+func (m *MongoLockStore) Holder(ctx context.Context, name string) (*Lease, error) {
+	var lease Lease
+	err := m.collection.FindOne(ctx, bson.M{"_id": name, "expiresAt": bson.M{"$gte": time.Now().UTC()}}).Decode(&lease)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read lock %s: %w", name, err)
+	}
+	return &lease, nil
+}
+
+// Ping checks the connection to MongoDB.
+func (m *MongoLockStore) Ping(ctx context.Context) error {
+	return m.client.Ping(ctx, nil)
+}
@@ -0,0 +1,168 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// MongoSchema names the collections the MongoDB migrations work on.
+type MongoSchema struct {
+	Users string
+	DEKs  string
+}
+
+// mongoMigration is one versioned change to the MongoDB schema. Versions are never
+// reused or reordered once released; a later change gets a new migration.
+type mongoMigration struct {
+	Version int
+	Name    string
+	Up      func(ctx context.Context, db *mongo.Database, schema MongoSchema) error
+}
+
+var mongoMigrations = []mongoMigration{
+	{1, "users_firebase_id_unique", func(ctx context.Context, db *mongo.Database, schema MongoSchema) error {
+		return createIndexes(ctx, db.Collection(schema.Users), mongo.IndexModel{
+			Keys:    bson.D{{Key: "firebaseId", Value: 1}},
+			Options: options.Index().SetName("firebase_id_unique").SetUnique(true),
+		})
+	}},
+	{2, "deks_lookup_indexes", func(ctx context.Context, db *mongo.Database, schema MongoSchema) error {
+		return createIndexes(ctx, db.Collection(schema.DEKs),
+			// The rewrap job pages through each retired master key's DEKs.
+			mongo.IndexModel{Keys: bson.D{{Key: "masterKeyId", Value: 1}, {Key: "_id", Value: 1}}, Options: options.Index().SetName("master_key_id")},
+			mongo.IndexModel{Keys: bson.D{{Key: "sealed.keyId", Value: 1}, {Key: "_id", Value: 1}}, Options: options.Index().SetName("sealed_key_id").SetSparse(true)},
+			// /list-data-keys pages through a tenant's DEKs, optionally by state and tags.
+			mongo.IndexModel{Keys: bson.D{{Key: "tenantId", Value: 1}, {Key: "state", Value: 1}, {Key: "_id", Value: 1}}, Options: options.Index().SetName("tenant_state")},
+			mongo.IndexModel{Keys: bson.D{{Key: "tenantId", Value: 1}, {Key: "ownerUid", Value: 1}}, Options: options.Index().SetName("tenant_owner")},
+			mongo.IndexModel{Keys: bson.D{{Key: "tags.$**", Value: 1}}, Options: options.Index().SetName("tags")},
+			mongo.IndexModel{Keys: bson.D{{Key: "sealed.tagIndex", Value: 1}}, Options: options.Index().SetName("sealed_tag_index").SetSparse(true)},
+			// The purge job finds soft-deleted DEKs past their retention.
+			mongo.IndexModel{Keys: bson.D{{Key: "deletedAt", Value: 1}}, Options: options.Index().SetName("deleted_at").SetSparse(true)},
+		)
+	}},
+}
+
+func createIndexes(ctx context.Context, coll *mongo.Collection, models ...mongo.IndexModel) error {
+	if _, err := coll.Indexes().CreateMany(ctx, models); err != nil {
+		return fmt.Errorf("failed to create indexes on %s: %w", coll.Name(), err)
+	}
+	return nil
+}
+
+// mongoMigrationsCollection records the migrations that have run, plus the lock
+// replicas take while migrating.
+const mongoMigrationsCollection = "schema_migrations"
+
+// mongoMigrationLease is how long a replica holds the migration lock before another may
+// take it over, should it die mid-migration.
+const mongoMigrationLease = 10 * time.Minute
+
+type mongoMigrationRecord struct {
+	Version   int       `bson:"_id"`
+	Name      string    `bson:"name"`
+	AppliedAt time.Time `bson:"appliedAt"`
+}
+
+// MigrateMongo applies, in order, each migration not yet recorded in schema_migrations,
+// and returns the names of those it applied. Replicas take a lock first, so only one
+// migrates at a time.
+func MigrateMongo(ctx context.Context, client *mongo.Client, dbName string, schema MongoSchema) ([]string, error) {
+	db := client.Database(dbName)
+	records := db.Collection(mongoMigrationsCollection)
+	release, err := lockMongoMigrations(ctx, records)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	applied, err := appliedMongoMigrations(ctx, records)
+	if err != nil {
+		return nil, err
+	}
+	var ran []string
+	for _, m := range mongoMigrations {
+		if applied[m.Version] {
+			continue
+		}
+		if err := m.Up(ctx, db, schema); err != nil {
+			return ran, fmt.Errorf("failed to apply migration %04d_%s: %w", m.Version, m.Name, err)
+		}
+		rec := mongoMigrationRecord{Version: m.Version, Name: m.Name, AppliedAt: time.Now().UTC()}
+		if _, err := records.InsertOne(ctx, rec); err != nil {
+			return ran, fmt.Errorf("failed to record migration %04d_%s: %w", m.Version, m.Name, err)
+		}
+		ran = append(ran, fmt.Sprintf("%04d_%s", m.Version, m.Name))
+	}
+	return ran, nil
+}
+
+// PendingMongoMigrations returns the names of the migrations MigrateMongo would apply.
+func PendingMongoMigrations(ctx context.Context, client *mongo.Client, dbName string) ([]string, error) {
+	applied, err := appliedMongoMigrations(ctx, client.Database(dbName).Collection(mongoMigrationsCollection))
+	if err != nil {
+		return nil, err
+	}
+	var pending []string
+	for _, m := range mongoMigrations {
+		if !applied[m.Version] {
+			pending = append(pending, fmt.Sprintf("%04d_%s", m.Version, m.Name))
+		}
+	}
+	return pending, nil
+}
+
+func appliedMongoMigrations(ctx context.Context, records *mongo.Collection) (map[int]bool, error) {
+	cur, err := records.Find(ctx, bson.M{"_id": bson.M{"$type": "number"}})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read schema_migrations: %w", err)
+	}
+	var recs []mongoMigrationRecord
+	if err := cur.All(ctx, &recs); err != nil {
+		return nil, fmt.Errorf("failed to read schema_migrations: %w", err)
+	}
+	applied := make(map[int]bool, len(recs))
+	for _, rec := range recs {
+		applied[rec.Version] = true
+	}
+	return applied, nil
+}
+
+// lockMongoMigrations waits for the migration lock and returns its release.
+func lockMongoMigrations(ctx context.Context, records *mongo.Collection) (func(), error) {
+	owner := primitive.NewObjectID().Hex()
+	for {
+		now := time.Now().UTC()
+		lock := bson.M{"_id": "lock", "owner": owner, "expiresAt": now.Add(mongoMigrationLease)}
+		_, err := records.InsertOne(ctx, lock)
+		if mongo.IsDuplicateKeyError(err) {
+			// Take over a lock whose holder died.
+			var res *mongo.UpdateResult
+			res, err = records.ReplaceOne(ctx, bson.M{"_id": "lock", "expiresAt": bson.M{"$lt": now}}, lock)
+			if err == nil && res.MatchedCount == 0 {
+				err = errMigrationLocked
+			}
+		}
+		if err == nil {
+			return func() {
+				records.DeleteOne(context.Background(), bson.M{"_id": "lock", "owner": owner})
+			}, nil
+		}
+		if !errors.Is(err, errMigrationLocked) {
+			return nil, fmt.Errorf("failed to take migration lock: %w", err)
+		}
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("waiting for another replica's migrations: %w", ctx.Err())
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+var errMigrationLocked = errors.New("migrations are running elsewhere")
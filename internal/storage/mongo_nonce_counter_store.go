@@ -0,0 +1,84 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ErrNonceLimit is returned by Reserve when a key has no encryptions left.
+var ErrNonceLimit = errors.New("encryption limit reached")
+
+// nonceCounter counts the encryptions reserved under one key, across every instance.
+type nonceCounter struct {
+	ID    string `bson:"_id"` // e.g. "dek:<id>" or "master:<id>"
+	Count int64  `bson:"count"`
+}
+
+// MongoNonceCounterStore keeps per-key encryption counts in MongoDB, so that the bound
+// on random nonces holds across instances and restarts.
+type MongoNonceCounterStore struct {
+	client     *mongo.Client
+	collection *mongo.Collection
+}
+
+// NewMongoNonceCounterStoreFromClient creates a MongoNonceCounterStore on a client shared with other
+// stores.
+func NewMongoNonceCounterStoreFromClient(client *mongo.Client, dbName, collectionName string) *MongoNonceCounterStore {
+	collection := client.Database(dbName).Collection(collectionName)
+	return &MongoNonceCounterStore{
+		client:     client,
+		collection: collection,
+	}
+}
+
+// Reserve adds n to key's count, creating it if needed, unless that would take it past
+// limit; ErrNonceLimit then. It returns the count after the reservation.
+func (m *MongoNonceCounterStore) Reserve(ctx context.Context, key string, n, limit int64) (int64, error) {
+	if n > limit {
+		return 0, ErrNonceLimit
+	}
+	filter := bson.M{"_id": key, "count": bson.M{"$lte": limit - n}}
+	update := bson.M{"$inc": bson.M{"count": n}}
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+	for attempt := 1; ; attempt++ {
+		var c nonceCounter
+		err := m.collection.FindOneAndUpdate(ctx, filter, update, opts).Decode(&c)
+		if err == nil {
+			return c.Count, nil
+		}
+		if !mongo.IsDuplicateKeyError(err) || attempt == maxIncrementAttempts {
+			return 0, fmt.Errorf("failed to reserve encryptions: %w", err)
+		}
+		// The upsert collided with an existing counter: either it is too close to the
+		// limit, or another instance created it first.
+		count, err := m.Count(ctx, key)
+		if err != nil {
+			return 0, err
+		}
+		if count > limit-n {
+			return count, ErrNonceLimit
+		}
+	}
+}
+
+// Count returns key's count, zero if nothing was ever reserved under it.
+func (m *MongoNonceCounterStore) Count(ctx context.Context, key string) (int64, error) {
+	var c nonceCounter
+	if err := m.collection.FindOne(ctx, bson.M{"_id": key}).Decode(&c); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("failed to read encryption count: %w", err)
+	}
+	return c.Count, nil
+}
+
+// Ping checks the connection to MongoDB.
+func (m *MongoNonceCounterStore) Ping(ctx context.Context) error {
+	return m.client.Ping(ctx, nil)
+}
@@ -0,0 +1,121 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// OutboxMessage is an event waiting to be published to a message broker. Once published
+// it is kept until ExpiresAt, so a broker's consumers can be checked against it.
+type OutboxMessage struct {
+	ID        string     `bson:"_id"`           // brokers and consumers dedupe on it
+	Topic     string     `bson:"topic"`         // Kafka topic or NATS subject
+	Key       string     `bson:"key,omitempty"` // partition key, the tenant
+	Payload   []byte     `bson:"payload"`       // the event as JSON
+	CreatedAt time.Time  `bson:"createdAt"`
+	Attempts  int        `bson:"attempts,omitempty"`
+	LastError string     `bson:"lastError,omitempty"`
+	SentAt    *time.Time `bson:"sentAt,omitempty"`
+	ExpiresAt *time.Time `bson:"expiresAt,omitempty"`
+}
+
+// MongoOutboxStore keeps events in MongoDB until they have been published, so that a
+// broker outage or a restart delays them rather than losing them.
+type MongoOutboxStore struct {
+	client     *mongo.Client
+	collection *mongo.Collection
+}
+
+// NewMongoOutboxStoreFromClient creates a MongoOutboxStore on a client shared with other
+// stores.
+func NewMongoOutboxStoreFromClient(client *mongo.Client, dbName, collectionName string) (*MongoOutboxStore, error) {
+	collection := client.Database(dbName).Collection(collectionName)
+	indexes := []mongo.IndexModel{
+		{
+			Keys: bson.D{{Key: "createdAt", Value: 1}, {Key: "_id", Value: 1}},
+			Options: options.Index().SetName("pending").
+				SetPartialFilterExpression(bson.M{"sentAt": bson.M{"$exists": false}}),
+		},
+		{
+			Keys:    bson.D{{Key: "expiresAt", Value: 1}},
+			Options: options.Index().SetName("expires_ttl").SetExpireAfterSeconds(0),
+		},
+	}
+	if _, err := collection.Indexes().CreateMany(context.Background(), indexes); err != nil {
+		return nil, fmt.Errorf("failed to create outbox indexes: %w", err)
+	}
+	return &MongoOutboxStore{
+		client:     client,
+		collection: collection,
+	}, nil
+}
+
+// Add stores msg for publishing. Adding a message whose ID is already there does nothing.
+func (m *MongoOutboxStore) Add(ctx context.Context, msg OutboxMessage) error {
+	_, err := m.collection.InsertOne(ctx, msg)
+	if err != nil && !mongo.IsDuplicateKeyError(err) {
+		return fmt.Errorf("failed to add outbox message: %w", err)
+	}
+	return nil
+}
+
+// Pending returns up to limit unpublished messages, oldest first.
+func (m *MongoOutboxStore) Pending(ctx context.Context, limit int) ([]OutboxMessage, error) {
+	opts := options.Find().
+		SetSort(bson.D{{Key: "createdAt", Value: 1}, {Key: "_id", Value: 1}}).
+		SetLimit(int64(limit)).
+		SetHint("pending")
+	cursor, err := m.collection.Find(ctx, bson.M{"sentAt": bson.M{"$exists": false}}, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list outbox messages: %w", err)
+	}
+	var msgs []OutboxMessage
+	if err := cursor.All(ctx, &msgs); err != nil {
+		return nil, fmt.Errorf("failed to decode outbox messages: %w", err)
+	}
+	return msgs, nil
+}
+
+// MarkSent records that the messages ids were published, keeping them for keep.
+func (m *MongoOutboxStore) MarkSent(ctx context.Context, ids []string, keep time.Duration) error {
+	now := time.Now().UTC()
+	_, err := m.collection.UpdateMany(ctx, bson.M{"_id": bson.M{"$in": ids}}, bson.M{
+		"$set":   bson.M{"sentAt": now, "expiresAt": now.Add(keep)},
+		"$unset": bson.M{"lastError": ""},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to mark outbox messages sent: %w", err)
+	}
+	return nil
+}
+
+// MarkFailed records a failed attempt to publish the messages ids.
+func (m *MongoOutboxStore) MarkFailed(ctx context.Context, ids []string, cause error) error {
+	_, err := m.collection.UpdateMany(ctx, bson.M{"_id": bson.M{"$in": ids}}, bson.M{
+		"$inc": bson.M{"attempts": 1},
+		"$set": bson.M{"lastError": cause.Error()},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to record outbox failure: %w", err)
+	}
+	return nil
+}
+
+// CountPending returns how many messages are waiting to be published.
+func (m *MongoOutboxStore) CountPending(ctx context.Context) (int64, error) {
+	n, err := m.collection.CountDocuments(ctx, bson.M{"sentAt": bson.M{"$exists": false}}, options.Count().SetHint("pending"))
+	if err != nil {
+		return 0, fmt.Errorf("failed to count outbox messages: %w", err)
+	}
+	return n, nil
+}
+
+// Ping checks the connection to MongoDB.
+func (m *MongoOutboxStore) Ping(ctx context.Context) error {
+	return m.client.Ping(ctx, nil)
+}
@@ -0,0 +1,70 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"my-kms/internal/auth"
+)
+
+// AuthorizationPolicyID is the _id of the document holding the authorization policy.
+const AuthorizationPolicyID = "authorization"
+
+// policyDocument wraps an authorization policy stored in MongoDB.
+type policyDocument struct {
+	ID        string          `bson:"_id"`
+	Policy    auth.RulePolicy `bson:"policy"`
+	UpdatedBy string          `bson:"updatedBy,omitempty"`
+	UpdatedAt time.Time       `bson:"updatedAt,omitempty"`
+}
+
+// MongoPolicyStore handles authorization policies in MongoDB.
+type MongoPolicyStore struct {
+	client     *mongo.Client
+	collection *mongo.Collection
+}
+
+// NewMongoPolicyStoreFromClient creates a MongoPolicyStore on a client shared with other
+// stores.
+func NewMongoPolicyStoreFromClient(client *mongo.Client, dbName, collectionName string) *MongoPolicyStore {
+	collection := client.Database(dbName).Collection(collectionName)
+	return &MongoPolicyStore{
+		client:     client,
+		collection: collection,
+	}
+}
+
+// GetPolicy loads and validates the authorization policy.
+func (m *MongoPolicyStore) GetPolicy(ctx context.Context) (*auth.RulePolicy, error) {
+	var doc policyDocument
+	if err := m.collection.FindOne(ctx, bson.M{"_id": AuthorizationPolicyID}).Decode(&doc); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, fmt.Errorf("no %q policy document found", AuthorizationPolicyID)
+		}
+		return nil, fmt.Errorf("error retrieving policy: %w", err)
+	}
+	if err := doc.Policy.Validate(); err != nil {
+		return nil, err
+	}
+	return &doc.Policy, nil
+}
+
+// PutPolicy stores the authorization policy, replacing any previous version.
+func (m *MongoPolicyStore) PutPolicy(ctx context.Context, p *auth.RulePolicy, updatedBy string) error {
+	doc := policyDocument{ID: AuthorizationPolicyID, Policy: *p, UpdatedBy: updatedBy, UpdatedAt: time.Now().UTC()}
+	_, err := m.collection.ReplaceOne(ctx, bson.M{"_id": AuthorizationPolicyID}, doc, options.Replace().SetUpsert(true))
+	if err != nil {
+		return fmt.Errorf("failed to store policy: %w", err)
+	}
+	return nil
+}
+
+// Ping checks the connection to MongoDB.
+func (m *MongoPolicyStore) Ping(ctx context.Context) error {
+	return m.client.Ping(ctx, nil)
+}
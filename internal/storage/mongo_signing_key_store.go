@@ -0,0 +1,167 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	// ErrSigningKeyExists is returned by CreateSigningKey when the name is taken.
+	ErrSigningKeyExists = errors.New("signing key already exists")
+	// ErrSigningKeyChanged is returned by AddSigningKeyVersion when another rotation won.
+	ErrSigningKeyChanged = errors.New("signing key was rotated concurrently")
+)
+
+// SigningKeyVersion is one key pair of a signing key. Its private key, PKCS #8, is
+// wrapped by a master key (or the tenant's CMK) exactly like a DEK.
+type SigningKeyVersion struct {
+	KeyID       string    `bson:"keyId" json:"keyID"` // the JWS "kid"
+	Key         []byte    `bson:"key" json:"-"`
+	MasterKeyID string    `bson:"masterKeyId" json:"masterKeyID"`
+	PublicKey   []byte    `bson:"publicKey" json:"-"` // PKIX DER
+	CreatedAt   time.Time `bson:"createdAt" json:"createdAt"`
+	RetiredAt   time.Time `bson:"retiredAt,omitempty" json:"retiredAt,omitempty"` // when a newer version took over
+}
+
+// SigningKey is a named, rotating JWT signing key. The last version signs; retired ones
+// stay published until tokens they signed have expired.
+type SigningKey struct {
+	ID        primitive.ObjectID  `bson:"_id,omitempty" json:"-"`
+	TenantID  string              `bson:"tenantId,omitempty" json:"tenantID,omitempty"`
+	Name      string              `bson:"name" json:"name"`
+	Algorithm string              `bson:"algorithm" json:"algorithm"`               // ES256 or RS256
+	Issuer    string              `bson:"issuer,omitempty" json:"issuer,omitempty"` // forced into every token's "iss"
+	Versions  []SigningKeyVersion `bson:"versions" json:"versions"`
+
+	CreatedBy string    `bson:"createdBy" json:"createdBy"`
+	CreatedAt time.Time `bson:"createdAt" json:"createdAt"`
+}
+
+// Current returns the version that signs new tokens.
+func (k *SigningKey) Current() *SigningKeyVersion {
+	return &k.Versions[len(k.Versions)-1]
+}
+
+// MongoSigningKeyStore keeps JWT signing keys in MongoDB, one per tenant and name.
+type MongoSigningKeyStore struct {
+	client     *mongo.Client
+	collection *mongo.Collection
+}
+
+// NewMongoSigningKeyStoreFromClient creates a MongoSigningKeyStore on a client shared with other
+// stores.
+func NewMongoSigningKeyStoreFromClient(client *mongo.Client, dbName, collectionName string) (*MongoSigningKeyStore, error) {
+	collection := client.Database(dbName).Collection(collectionName)
+	index := mongo.IndexModel{
+		Keys:    bson.D{{Key: "tenantId", Value: 1}, {Key: "name", Value: 1}},
+		Options: options.Index().SetName("tenant_name").SetUnique(true),
+	}
+	if _, err := collection.Indexes().CreateOne(context.Background(), index); err != nil {
+		return nil, fmt.Errorf("failed to create signing key indexes: %w", err)
+	}
+	return &MongoSigningKeyStore{
+		client:     client,
+		collection: collection,
+	}, nil
+}
+
+// CreateSigningKey stores key with its first version, failing with ErrSigningKeyExists
+// if its name is taken.
+func (m *MongoSigningKeyStore) CreateSigningKey(ctx context.Context, key SigningKey) error {
+	if key.CreatedAt.IsZero() {
+		key.CreatedAt = time.Now().UTC()
+	}
+	if _, err := m.collection.InsertOne(ctx, key); err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return ErrSigningKeyExists
+		}
+		return fmt.Errorf("failed to insert signing key: %w", err)
+	}
+	return nil
+}
+
+// GetSigningKey returns a tenant's signing key by name, nil if there is none.
+func (m *MongoSigningKeyStore) GetSigningKey(ctx context.Context, tenantID, name string) (*SigningKey, error) {
+	var key SigningKey
+	err := m.collection.FindOne(ctx, bson.M{"tenantId": tenantMatch(tenantID), "name": name}).Decode(&key)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get signing key: %w", err)
+	}
+	return &key, nil
+}
+
+// AddSigningKeyVersion makes v the signing version of key, retires the current one and
+// drops versions retired before pruneBefore. key must be as last read; if another
+// rotation got there first it returns ErrSigningKeyChanged.
+func (m *MongoSigningKeyStore) AddSigningKeyVersion(ctx context.Context, key *SigningKey, v SigningKeyVersion, pruneBefore time.Time) error {
+	now := time.Now().UTC()
+	versions := make([]SigningKeyVersion, 0, len(key.Versions)+1)
+	for _, old := range key.Versions {
+		if old.RetiredAt.IsZero() {
+			old.RetiredAt = now
+		}
+		if old.RetiredAt.Before(pruneBefore) {
+			continue
+		}
+		versions = append(versions, old)
+	}
+	versions = append(versions, v)
+
+	last := "versions." + strconv.Itoa(len(key.Versions)-1) + ".keyId"
+	res, err := m.collection.UpdateOne(ctx,
+		bson.M{
+			"tenantId": tenantMatch(key.TenantID),
+			"name":     key.Name,
+			"versions": bson.M{"$size": len(key.Versions)},
+			last:       key.Current().KeyID,
+		},
+		bson.M{"$set": bson.M{"versions": versions}},
+	)
+	if err != nil {
+		return fmt.Errorf("failed to rotate signing key: %w", err)
+	}
+	if res.MatchedCount == 0 {
+		return ErrSigningKeyChanged
+	}
+	key.Versions = versions
+	return nil
+}
+
+// CountByMasterKey counts the signing key versions wrapped under masterKeyID.
+func (m *MongoSigningKeyStore) CountByMasterKey(ctx context.Context, masterKeyID string) (int64, error) {
+	cursor, err := m.collection.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$unwind", Value: "$versions"}},
+		{{Key: "$match", Value: bson.M{"versions.masterKeyId": masterKeyID}}},
+		{{Key: "$count", Value: "n"}},
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to count signing keys: %w", err)
+	}
+	defer cursor.Close(ctx)
+	var out []struct {
+		N int64 `bson:"n"`
+	}
+	if err := cursor.All(ctx, &out); err != nil {
+		return 0, fmt.Errorf("failed to count signing keys: %w", err)
+	}
+	if len(out) == 0 {
+		return 0, nil
+	}
+	return out[0].N, nil
+}
+
+// Ping checks the connection to MongoDB.
+func (m *MongoSigningKeyStore) Ping(ctx context.Context) error {
+	return m.client.Ping(ctx, nil)
+}
@@ -0,0 +1,79 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// TenantCMK points a tenant at its customer-managed key. The credentials are stored
+// wrapped under a master key.
+type TenantCMK struct {
+	TenantID               string    `bson:"tenantId"`
+	Provider               string    `bson:"provider"`
+	Endpoint               string    `bson:"endpoint"`
+	KeyName                string    `bson:"keyName"`
+	WrappedCredentials     []byte    `bson:"wrappedCredentials"`
+	CredentialsMasterKeyID string    `bson:"credentialsMasterKeyId"`
+	RegisteredBy           string    `bson:"registeredBy"`
+	RegisteredAt           time.Time `bson:"registeredAt"`
+}
+
+// MongoTenantKeyStore handles tenant CMK registrations in MongoDB.
+type MongoTenantKeyStore struct {
+	client     *mongo.Client
+	collection *mongo.Collection
+}
+
+// NewMongoTenantKeyStoreFromClient creates a MongoTenantKeyStore on a client shared with other
+// stores.
+func NewMongoTenantKeyStoreFromClient(client *mongo.Client, dbName, collectionName string) *MongoTenantKeyStore {
+	collection := client.Database(dbName).Collection(collectionName)
+	return &MongoTenantKeyStore{
+		client:     client,
+		collection: collection,
+	}
+}
+
+// UpsertTenantCMK registers or replaces a tenant's CMK.
+func (m *MongoTenantKeyStore) UpsertTenantCMK(ctx context.Context, c TenantCMK) error {
+	if c.RegisteredAt.IsZero() {
+		c.RegisteredAt = time.Now().UTC()
+	}
+	filter := bson.M{"tenantId": tenantMatch(c.TenantID)}
+	if _, err := m.collection.ReplaceOne(ctx, filter, c, options.Replace().SetUpsert(true)); err != nil {
+		return fmt.Errorf("failed to upsert tenant CMK: %w", err)
+	}
+	return nil
+}
+
+// GetTenantCMK returns the tenant's CMK, or nil if the tenant uses the server's master keys.
+func (m *MongoTenantKeyStore) GetTenantCMK(ctx context.Context, tenantID string) (*TenantCMK, error) {
+	var c TenantCMK
+	if err := m.collection.FindOne(ctx, bson.M{"tenantId": tenantMatch(tenantID)}).Decode(&c); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("error retrieving tenant CMK: %w", err)
+	}
+	return &c, nil
+}
+
+// CountByMasterKey counts the CMK registrations whose credentials are wrapped under
+// masterKeyID.
+func (m *MongoTenantKeyStore) CountByMasterKey(ctx context.Context, masterKeyID string) (int64, error) {
+	n, err := m.collection.CountDocuments(ctx, bson.M{"credentialsMasterKeyId": masterKeyID})
+	if err != nil {
+		return 0, fmt.Errorf("failed to count CMK registrations: %w", err)
+	}
+	return n, nil
+}
+
+// Ping checks the connection to MongoDB.
+func (m *MongoTenantKeyStore) Ping(ctx context.Context) error {
+	return m.client.Ping(ctx, nil)
+}
@@ -0,0 +1,178 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// UsageCounter counts one operation by one key or identity over a UTC day or month.
+type UsageCounter struct {
+	ID        string    `bson:"_id" json:"-"`
+	TenantID  string    `bson:"tenantId,omitempty" json:"tenantId,omitempty"`
+	Scope     string    `bson:"scope" json:"scope"`         // "key" or "identity"
+	Subject   string    `bson:"subject" json:"subject"`     // DEK ID or identity name
+	Operation string    `bson:"operation" json:"operation"` // e.g. "decrypt"
+	Period    string    `bson:"period" json:"period"`       // "day" or "month"
+	Window    string    `bson:"window" json:"window"`       // "2006-01-02" or "2006-01"
+	Count     int64     `bson:"count" json:"count"`
+	ExpiresAt time.Time `bson:"expiresAt" json:"-"`
+}
+
+// UsageQuery selects usage counters; empty fields match anything.
+type UsageQuery struct {
+	TenantID   string
+	AllTenants bool
+	Scope      string
+	Subject    string
+	Operation  string
+	Period     string
+	Window     string
+	WindowFrom string // inclusive bounds on Window; only meaningful with Period set
+	WindowTo   string
+	Limit      int64
+}
+
+// ErrQuotaExceeded is returned by Increment when a counter has reached its limit.
+var ErrQuotaExceeded = errors.New("quota exceeded")
+
+// maxIncrementAttempts bounds retries when two requests create the same counter at once.
+const maxIncrementAttempts = 3
+
+// MongoUsageStore keeps operation counters in MongoDB. Counters expire at their
+// ExpiresAt, through a TTL index, once they are no longer needed for reporting.
+type MongoUsageStore struct {
+	client     *mongo.Client
+	collection *mongo.Collection
+}
+
+// NewMongoUsageStoreFromClient creates a MongoUsageStore on a client shared with other
+// stores.
+func NewMongoUsageStoreFromClient(client *mongo.Client, dbName, collectionName string) (*MongoUsageStore, error) {
+	collection := client.Database(dbName).Collection(collectionName)
+	indexes := []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "expiresAt", Value: 1}},
+			Options: options.Index().SetName("expires_ttl").SetExpireAfterSeconds(0),
+		},
+		{
+			Keys:    bson.D{{Key: "tenantId", Value: 1}, {Key: "window", Value: -1}, {Key: "scope", Value: 1}, {Key: "subject", Value: 1}},
+			Options: options.Index().SetName("tenant_window"),
+		},
+	}
+	if _, err := collection.Indexes().CreateMany(context.Background(), indexes); err != nil {
+		return nil, fmt.Errorf("failed to create usage indexes: %w", err)
+	}
+	return &MongoUsageStore{
+		client:     client,
+		collection: collection,
+	}, nil
+}
+
+// Increment adds one to the counter, creating it if needed. With a positive limit the
+// counter is only incremented while below it, atomically; ErrQuotaExceeded otherwise.
+func (m *MongoUsageStore) Increment(ctx context.Context, c UsageCounter, limit int64) error {
+	filter := bson.M{"_id": c.ID}
+	if limit > 0 {
+		filter["count"] = bson.M{"$lt": limit}
+	}
+	update := bson.M{
+		"$inc": bson.M{"count": 1},
+		"$setOnInsert": bson.M{
+			"tenantId":  c.TenantID,
+			"scope":     c.Scope,
+			"subject":   c.Subject,
+			"operation": c.Operation,
+			"period":    c.Period,
+			"window":    c.Window,
+			"expiresAt": c.ExpiresAt,
+		},
+	}
+	for attempt := 1; ; attempt++ {
+		_, err := m.collection.UpdateOne(ctx, filter, update, options.Update().SetUpsert(true))
+		if err == nil {
+			return nil
+		}
+		if !mongo.IsDuplicateKeyError(err) || attempt == maxIncrementAttempts {
+			return fmt.Errorf("failed to increment usage counter: %w", err)
+		}
+		// The upsert collided with an existing counter: either it is at the limit, or
+		// another request created it first.
+		if limit > 0 {
+			count, err := m.Count(ctx, c.ID)
+			if err != nil {
+				return err
+			}
+			if count >= limit {
+				return ErrQuotaExceeded
+			}
+		}
+	}
+}
+
+// Decrement takes back an increment, for a request rejected by a later quota.
+func (m *MongoUsageStore) Decrement(ctx context.Context, id string) error {
+	if _, err := m.collection.UpdateOne(ctx, bson.M{"_id": id, "count": bson.M{"$gt": 0}}, bson.M{"$inc": bson.M{"count": -1}}); err != nil {
+		return fmt.Errorf("failed to decrement usage counter: %w", err)
+	}
+	return nil
+}
+
+// Count returns a counter's value, zero if it does not exist.
+func (m *MongoUsageStore) Count(ctx context.Context, id string) (int64, error) {
+	var c UsageCounter
+	if err := m.collection.FindOne(ctx, bson.M{"_id": id}).Decode(&c); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("failed to read usage counter: %w", err)
+	}
+	return c.Count, nil
+}
+
+// QueryUsage returns matching counters, newest window first.
+func (m *MongoUsageStore) QueryUsage(ctx context.Context, q UsageQuery) ([]UsageCounter, error) {
+	filter := bson.M{}
+	if !q.AllTenants {
+		filter["tenantId"] = tenantMatch(q.TenantID)
+	}
+	for field, v := range map[string]string{"scope": q.Scope, "subject": q.Subject, "operation": q.Operation, "period": q.Period, "window": q.Window} {
+		if v != "" {
+			filter[field] = v
+		}
+	}
+	// Windows of one period sort as strings in time order.
+	if q.Window == "" && (q.WindowFrom != "" || q.WindowTo != "") {
+		window := bson.M{}
+		if q.WindowFrom != "" {
+			window["$gte"] = q.WindowFrom
+		}
+		if q.WindowTo != "" {
+			window["$lte"] = q.WindowTo
+		}
+		filter["window"] = window
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "window", Value: -1}, {Key: "scope", Value: 1}, {Key: "subject", Value: 1}, {Key: "operation", Value: 1}})
+	if q.Limit > 0 {
+		opts.SetLimit(q.Limit)
+	}
+	cur, err := m.collection.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query usage: %w", err)
+	}
+	var counters []UsageCounter
+	if err := cur.All(ctx, &counters); err != nil {
+		return nil, fmt.Errorf("failed to decode usage counters: %w", err)
+	}
+	return counters, nil
+}
+
+// Ping checks the connection to MongoDB.
+func (m *MongoUsageStore) Ping(ctx context.Context) error {
+	return m.client.Ping(ctx, nil)
+}
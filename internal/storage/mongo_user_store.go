@@ -2,42 +2,68 @@ package storage
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"my-kms/internal/auth"
 )
 
 // User represents a user document in MongoDB.
 type User struct {
-	FirebaseUID string `bson:"firebaseUID"`
-	Role        string `bson:"role"`
+	FirebaseUID string                `bson:"firebaseId"`
+	Role        string                `bson:"role"`
+	TenantID    string                `bson:"tenantId,omitempty"`
+	Disabled    bool                  `bson:"disabled,omitempty"`
+	Conditions  *auth.AccessCondition `bson:"conditions,omitempty"`
+}
+
+// ErrUserNotFound is wrapped by lookups for users that do not exist, as opposed to
+// lookups that failed.
+var ErrUserNotFound = errors.New("user not found")
+
+// RoleDefinition is an admin-defined role and the actions it grants.
+type RoleDefinition struct {
+	Name        string    `bson:"_id" json:"name"`
+	Actions     []string  `bson:"actions" json:"actions"`
+	Description string    `bson:"description,omitempty" json:"description,omitempty"`
+	UpdatedBy   string    `bson:"updatedBy" json:"updatedBy"`
+	UpdatedAt   time.Time `bson:"updatedAt" json:"updatedAt"`
 }
 
 // MongoUserStore handles user data retrieval from MongoDB.
 type MongoUserStore struct {
 	client     *mongo.Client
+	ownsClient bool
 	collection *mongo.Collection
+	roles      *mongo.Collection
 }
 
-// NewMongoUserStore initializes a new MongoUserStore.
-func NewMongoUserStore(uri, dbName, collectionName string) (*MongoUserStore, error) {
-	clientOpts := options.Client().ApplyURI(uri)
-	client, err := mongo.Connect(context.Background(), clientOpts)
+// NewMongoUserStore initializes a new MongoUserStore. Custom role definitions are
+// kept in rolesCollection of the same database.
+func NewMongoUserStore(uri, dbName, collectionName, rolesCollection string) (*MongoUserStore, error) {
+	client, err := ConnectMongo(uri)
 	if err != nil {
-		return nil, fmt.Errorf("failed to connect to MongoDB: %w", err)
-	}
-
-	if err := client.Ping(context.Background(), nil); err != nil {
-		return nil, fmt.Errorf("failed to ping MongoDB: %w", err)
+		return nil, err
 	}
+	store := NewMongoUserStoreFromClient(client, dbName, collectionName, rolesCollection)
+	store.ownsClient = true
+	return store, nil
+}
 
-	collection := client.Database(dbName).Collection(collectionName)
+// NewMongoUserStoreFromClient creates a MongoUserStore on a client shared with other
+// stores. Closing the store leaves the client connected.
+func NewMongoUserStoreFromClient(client *mongo.Client, dbName, collectionName, rolesCollection string) *MongoUserStore {
+	db := client.Database(dbName, readDatabaseOptions())
 	return &MongoUserStore{
 		client:     client,
-		collection: collection,
-	}, nil
+		collection: db.Collection(collectionName),
+		roles:      db.Collection(rolesCollection),
+	}
 }
 
 // GetUserByFirebaseUID retrieves a user by their Firebase UID.
@@ -47,14 +73,124 @@ func (m *MongoUserStore) GetUserByFirebaseUID(ctx context.Context, uid string) (
 	err := m.collection.FindOne(ctx, filter).Decode(&user)
 	if err != nil {
 		if err == mongo.ErrNoDocuments {
-			return nil, fmt.Errorf("no user found with Firebase UID %s", uid)
+			return nil, fmt.Errorf("no user found with Firebase UID %s: %w", uid, ErrUserNotFound)
 		}
 		return nil, fmt.Errorf("error retrieving user: %w", err)
 	}
 	return &user, nil
 }
 
+// DisableUser marks a user as disabled so that further requests are rejected.
+func (m *MongoUserStore) DisableUser(ctx context.Context, uid string) error {
+	filter := bson.M{"firebaseId": uid}
+	res, err := m.collection.UpdateOne(ctx, filter, bson.M{"$set": bson.M{"disabled": true}})
+	if err != nil {
+		return fmt.Errorf("failed to disable user: %w", err)
+	}
+	if res.MatchedCount == 0 {
+		return fmt.Errorf("no user found with Firebase UID %s", uid)
+	}
+	return nil
+}
+
+// ListUsers returns every user document.
+func (m *MongoUserStore) ListUsers(ctx context.Context) ([]User, error) {
+	cur, err := m.collection.Find(ctx, bson.M{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list users: %w", err)
+	}
+	var users []User
+	if err := cur.All(ctx, &users); err != nil {
+		return nil, fmt.Errorf("failed to decode users: %w", err)
+	}
+	return users, nil
+}
+
+// UpsertUser creates or replaces the user document with the same Firebase UID.
+func (m *MongoUserStore) UpsertUser(ctx context.Context, user User) error {
+	filter := bson.M{"firebaseId": user.FirebaseUID}
+	_, err := m.collection.ReplaceOne(ctx, filter, user, options.Replace().SetUpsert(true))
+	if err != nil {
+		return fmt.Errorf("failed to upsert user: %w", err)
+	}
+	return nil
+}
+
+// CountUsersWithRole returns how many users are assigned role.
+func (m *MongoUserStore) CountUsersWithRole(ctx context.Context, role string) (int64, error) {
+	n, err := m.collection.CountDocuments(ctx, bson.M{"role": role})
+	if err != nil {
+		return 0, fmt.Errorf("failed to count users: %w", err)
+	}
+	return n, nil
+}
+
+// InsertRole stores a new role definition, failing if the name is taken.
+func (m *MongoUserStore) InsertRole(ctx context.Context, role RoleDefinition) error {
+	if _, err := m.roles.InsertOne(ctx, role); err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return fmt.Errorf("role %s already exists", role.Name)
+		}
+		return fmt.Errorf("failed to insert role: %w", err)
+	}
+	return nil
+}
+
+// UpdateRole replaces the actions and description of an existing role.
+func (m *MongoUserStore) UpdateRole(ctx context.Context, role RoleDefinition) error {
+	res, err := m.roles.ReplaceOne(ctx, bson.M{"_id": role.Name}, role)
+	if err != nil {
+		return fmt.Errorf("failed to update role: %w", err)
+	}
+	if res.MatchedCount == 0 {
+		return fmt.Errorf("no role found with name %s", role.Name)
+	}
+	return nil
+}
+
+// UpsertRole creates or replaces a role definition.
+func (m *MongoUserStore) UpsertRole(ctx context.Context, role RoleDefinition) error {
+	_, err := m.roles.ReplaceOne(ctx, bson.M{"_id": role.Name}, role, options.Replace().SetUpsert(true))
+	if err != nil {
+		return fmt.Errorf("failed to upsert role: %w", err)
+	}
+	return nil
+}
+
+// ListRoles returns every custom role, sorted by name.
+func (m *MongoUserStore) ListRoles(ctx context.Context) ([]RoleDefinition, error) {
+	cur, err := m.roles.Find(ctx, bson.M{}, options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list roles: %w", err)
+	}
+	roles := []RoleDefinition{}
+	if err := cur.All(ctx, &roles); err != nil {
+		return nil, fmt.Errorf("failed to decode roles: %w", err)
+	}
+	return roles, nil
+}
+
+// DeleteRole removes a custom role definition.
+func (m *MongoUserStore) DeleteRole(ctx context.Context, name string) error {
+	res, err := m.roles.DeleteOne(ctx, bson.M{"_id": name})
+	if err != nil {
+		return fmt.Errorf("failed to delete role: %w", err)
+	}
+	if res.DeletedCount == 0 {
+		return fmt.Errorf("no role found with name %s", name)
+	}
+	return nil
+}
+
+// Ping checks the connection to MongoDB.
+func (m *MongoUserStore) Ping(ctx context.Context) error {
+	return m.client.Ping(ctx, nil)
+}
+
 // Close gracefully disconnects from MongoDB.
 func (m *MongoUserStore) Close(ctx context.Context) error {
+	if !m.ownsClient {
+		return nil
+	}
 	return m.client.Disconnect(ctx)
 }
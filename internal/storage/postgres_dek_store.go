@@ -0,0 +1,454 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// PostgresDEKStore handles DEK data in PostgreSQL, in the deks table.
+type PostgresDEKStore struct {
+	pool *pgxpool.Pool
+}
+
+// NewPostgresDEKStore connects to PostgreSQL and applies pending migrations.
+func NewPostgresDEKStore(url string) (*PostgresDEKStore, error) {
+	pool, err := connectPostgres(url)
+	if err != nil {
+		return nil, err
+	}
+	return &PostgresDEKStore{pool: pool}, nil
+}
+
+// dekColumns are the deks columns scanDEK reads, without the key material.
+const dekColumns = `id, master_key_id, tenant_id, owner_uid, description, tags, created_by, created_at,
+	last_used_at, state, algorithm, origin, deprecated_at, sunset_at, replacement_dek_id, policy, deleted_at, deleted_by,
+	sealed_ciphertext, sealed_key_id, sealed_tag_index, usage`
+
+func scanDEK(row pgx.Row, withKey bool) (*DEKDocument, error) {
+	var doc DEKDocument
+	var id string
+	var tags, policy, usage []byte
+	var lastUsed, deprecated, sunset, deleted *time.Time
+	var state, origin string
+	var sealed SealedMetadata
+	dest := []interface{}{&id, &doc.MasterKeyID, &doc.TenantID, &doc.OwnerUID, &doc.Description, &tags, &doc.CreatedBy, &doc.CreatedAt,
+		&lastUsed, &state, &doc.Algorithm, &origin, &deprecated, &sunset, &doc.ReplacementDEKID, &policy, &deleted, &doc.DeletedBy,
+		&sealed.Ciphertext, &sealed.KeyID, &sealed.TagIndex, &usage}
+	if withKey {
+		dest = append(dest, &doc.DEK)
+	}
+	if err := row.Scan(dest...); err != nil {
+		return nil, err
+	}
+
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, fmt.Errorf("invalid DEK ID %q in database: %w", id, err)
+	}
+	doc.ID = oid
+	doc.CreatedAt = doc.CreatedAt.UTC()
+	doc.LastUsedAt, doc.DeprecatedAt, doc.SunsetAt, doc.DeletedAt = timeOrZero(lastUsed), timeOrZero(deprecated), timeOrZero(sunset), timeOrZero(deleted)
+	doc.State, doc.Origin = KeyState(state), KeyOrigin(origin)
+	if err := json.Unmarshal(tags, &doc.Tags); err != nil {
+		return nil, fmt.Errorf("failed to decode DEK tags: %w", err)
+	}
+	if len(doc.Tags) == 0 {
+		doc.Tags = nil
+	}
+	if policy != nil {
+		doc.Policy = &KeyPolicy{}
+		if err := json.Unmarshal(policy, doc.Policy); err != nil {
+			return nil, fmt.Errorf("failed to decode DEK policy: %w", err)
+		}
+	}
+	if usage != nil {
+		doc.Usage = &KeyUsage{}
+		if err := json.Unmarshal(usage, doc.Usage); err != nil {
+			return nil, fmt.Errorf("failed to decode DEK usage: %w", err)
+		}
+	}
+	if sealed.Ciphertext != nil {
+		if len(sealed.TagIndex) == 0 {
+			sealed.TagIndex = nil
+		}
+		doc.Sealed = &sealed
+	}
+	return &doc, nil
+}
+
+// checkDEKID rejects IDs that are not ObjectID hex, as the Mongo store does.
+func checkDEKID(id string) error {
+	if _, err := primitive.ObjectIDFromHex(id); err != nil {
+		return fmt.Errorf("invalid DEK ID format: %w", err)
+	}
+	return nil
+}
+
+// InsertDEK inserts a new DEK row and returns its ID.
+// CreatedAt and State default to the current time and ENABLED if the caller left them empty.
+func (p *PostgresDEKStore) InsertDEK(ctx context.Context, doc DEKDocument) (string, error) {
+	if doc.CreatedAt.IsZero() {
+		doc.CreatedAt = time.Now().UTC()
+	}
+	if doc.State == "" {
+		doc.State = KeyStateEnabled
+	}
+	if doc.ID.IsZero() {
+		doc.ID = primitive.NewObjectID()
+	}
+	tags, err := json.Marshal(doc.Tags)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode DEK tags: %w", err)
+	}
+	if doc.Tags == nil {
+		tags = []byte("{}")
+	}
+	var policy []byte
+	if doc.Policy != nil {
+		if policy, err = json.Marshal(doc.Policy); err != nil {
+			return "", fmt.Errorf("failed to encode DEK policy: %w", err)
+		}
+	}
+	var usage []byte
+	if doc.Usage != nil {
+		if usage, err = json.Marshal(doc.Usage); err != nil {
+			return "", fmt.Errorf("failed to encode DEK usage: %w", err)
+		}
+	}
+
+	sealed := doc.Sealed
+	if sealed == nil {
+		sealed = &SealedMetadata{}
+	}
+
+	_, err = p.pool.Exec(ctx, `INSERT INTO deks (id, dek, master_key_id, tenant_id, owner_uid, description, tags, created_by, created_at,
+		last_used_at, state, algorithm, origin, deprecated_at, sunset_at, replacement_dek_id, policy, deleted_at, deleted_by,
+		sealed_ciphertext, sealed_key_id, sealed_tag_index, usage)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20, $21, $22, $23)`,
+		doc.ID.Hex(), doc.DEK, doc.MasterKeyID, doc.TenantID, doc.OwnerUID, doc.Description, tags, doc.CreatedBy, doc.CreatedAt,
+		nullTime(doc.LastUsedAt), string(doc.State), doc.Algorithm, string(doc.Origin), nullTime(doc.DeprecatedAt), nullTime(doc.SunsetAt),
+		doc.ReplacementDEKID, policy, nullTime(doc.DeletedAt), doc.DeletedBy,
+		sealed.Ciphertext, sealed.KeyID, textArray(sealed.TagIndex), usage)
+	if err != nil {
+		return "", fmt.Errorf("failed to insert DEK: %w", err)
+	}
+	return doc.ID.Hex(), nil
+}
+
+// GetDEK retrieves a DEK by ID within a tenant.
+func (p *PostgresDEKStore) GetDEK(ctx context.Context, tenantID, id string) (*DEKDocument, error) {
+	if err := checkDEKID(id); err != nil {
+		return nil, err
+	}
+	row := p.pool.QueryRow(ctx, `SELECT `+dekColumns+`, dek FROM deks WHERE id = $1 AND tenant_id = $2 AND deleted_at IS NULL`, id, tenantID)
+	doc, err := scanDEK(row, true)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, fmt.Errorf("no DEK found with ID %s", id)
+		}
+		return nil, fmt.Errorf("error retrieving DEK: %w", err)
+	}
+	return doc, nil
+}
+
+// DeleteDEK soft-deletes a DEK by its ID, leaving a tombstone.
+func (p *PostgresDEKStore) DeleteDEK(ctx context.Context, tenantID, id, deletedBy string) error {
+	return p.updateDEK(ctx, tenantID, id, "deleted_at = $3, deleted_by = $4", time.Now().UTC(), deletedBy)
+}
+
+// RestoreDEK removes the tombstone from a soft-deleted DEK.
+func (p *PostgresDEKStore) RestoreDEK(ctx context.Context, tenantID, id string) error {
+	if err := checkDEKID(id); err != nil {
+		return err
+	}
+	tag, err := p.pool.Exec(ctx, `UPDATE deks SET deleted_at = NULL, deleted_by = '' WHERE id = $1 AND tenant_id = $2 AND deleted_at IS NOT NULL`, id, tenantID)
+	if err != nil {
+		return fmt.Errorf("failed to restore DEK: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf("no deleted DEK found with ID %s", id)
+	}
+	return nil
+}
+
+// PurgeDeletedDEKs permanently removes DEKs soft-deleted before cutoff, sparing
+// anything covered by a legal hold.
+func (p *PostgresDEKStore) PurgeDeletedDEKs(ctx context.Context, cutoff time.Time, held HeldKeys) (int64, error) {
+	tenants, ids := held.TenantIDs, held.DEKIDs
+	if tenants == nil {
+		tenants = []string{}
+	}
+	if ids == nil {
+		ids = []string{}
+	}
+	tag, err := p.pool.Exec(ctx, `DELETE FROM deks WHERE deleted_at < $1 AND NOT tenant_id = ANY($2) AND NOT id = ANY($3)`, cutoff, tenants, ids)
+	if err != nil {
+		return 0, fmt.Errorf("failed to purge DEKs: %w", err)
+	}
+	return tag.RowsAffected(), nil
+}
+
+// ListDEKsByOwner returns all DEKs in a tenant owned by the given Firebase UID.
+func (p *PostgresDEKStore) ListDEKsByOwner(ctx context.Context, tenantID, ownerUID string) ([]DEKDocument, error) {
+	rows, err := p.pool.Query(ctx, `SELECT `+dekColumns+`, dek FROM deks WHERE tenant_id = $1 AND owner_uid = $2 AND deleted_at IS NULL ORDER BY id`, tenantID, ownerUID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list DEKs: %w", err)
+	}
+	docs, err := collectDEKs(rows, true)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode DEKs: %w", err)
+	}
+	return docs, nil
+}
+
+// ListDEKs returns up to limit DEKs matching filter, ordered by ID, starting after cursor.
+// The wrapped key material is not loaded. The returned cursor is empty when there are no more results.
+func (p *PostgresDEKStore) ListDEKs(ctx context.Context, filter DEKFilter, cursor string, limit int) ([]DEKDocument, string, error) {
+	where := []string{"tenant_id = $1", "deleted_at IS NULL"}
+	args := []interface{}{filter.TenantID}
+	add := func(cond string, arg interface{}) {
+		args = append(args, arg)
+		where = append(where, strings.ReplaceAll(cond, "?", "$"+strconv.Itoa(len(args))))
+	}
+	if filter.MasterKeyID != "" {
+		add("master_key_id = ?", filter.MasterKeyID)
+	}
+	if filter.OwnerUID != "" {
+		add("owner_uid = ?", filter.OwnerUID)
+	}
+	if filter.State != "" {
+		add("state = ?", string(filter.State))
+	}
+	if len(filter.Tags) > 0 {
+		tags, err := json.Marshal(filter.Tags)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to encode tag filter: %w", err)
+		}
+		// Sealed rows match through their blind index instead.
+		args = append(args, tags)
+		cond := "sealed_ciphertext IS NULL AND tags @> $" + strconv.Itoa(len(args)) + "::jsonb"
+		for keyID, hashes := range filter.TagHashes {
+			args = append(args, keyID, textArray(hashes))
+			cond += " OR sealed_key_id = $" + strconv.Itoa(len(args)-1) + " AND sealed_tag_index @> $" + strconv.Itoa(len(args))
+		}
+		where = append(where, "("+cond+")")
+	}
+	if cursor != "" {
+		if _, err := primitive.ObjectIDFromHex(cursor); err != nil {
+			return nil, "", fmt.Errorf("invalid cursor: %w", err)
+		}
+		add("id > ?", cursor)
+	}
+
+	// Fetch one extra row to learn whether another page exists.
+	args = append(args, limit+1)
+	query := `SELECT ` + dekColumns + ` FROM deks WHERE ` + strings.Join(where, " AND ") + ` ORDER BY id LIMIT $` + strconv.Itoa(len(args))
+	rows, err := p.pool.Query(ctx, query, args...)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to list DEKs: %w", err)
+	}
+	docs, err := collectDEKs(rows, false)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to decode DEKs: %w", err)
+	}
+
+	next := ""
+	if len(docs) > limit {
+		docs = docs[:limit]
+		next = docs[limit-1].ID.Hex()
+	}
+	return docs, next, nil
+}
+
+func collectDEKs(rows pgx.Rows, withKey bool) ([]DEKDocument, error) {
+	defer rows.Close()
+	var docs []DEKDocument
+	for rows.Next() {
+		doc, err := scanDEK(rows, withKey)
+		if err != nil {
+			return nil, err
+		}
+		docs = append(docs, *doc)
+	}
+	return docs, rows.Err()
+}
+
+// SetDEKOwner changes the owner of a DEK.
+func (p *PostgresDEKStore) SetDEKOwner(ctx context.Context, tenantID, id, ownerUID string) error {
+	return p.updateDEK(ctx, tenantID, id, "owner_uid = $3", ownerUID)
+}
+
+// SetDEKState moves a DEK to a new state, but only if it is currently in one of the allowed states.
+func (p *PostgresDEKStore) SetDEKState(ctx context.Context, tenantID, id string, state KeyState, from ...KeyState) error {
+	if err := checkDEKID(id); err != nil {
+		return err
+	}
+	query := `UPDATE deks SET state = $3 WHERE id = $1 AND tenant_id = $2 AND deleted_at IS NULL`
+	args := []interface{}{id, tenantID, string(state)}
+	if len(from) > 0 {
+		allowed := make([]string, len(from))
+		for i, st := range from {
+			allowed[i] = string(st)
+		}
+		query += ` AND state = ANY($4)`
+		args = append(args, allowed)
+	}
+
+	tag, err := p.pool.Exec(ctx, query, args...)
+	if err != nil {
+		return fmt.Errorf("failed to update DEK state: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf("no DEK with ID %s in state %v", id, from)
+	}
+	return nil
+}
+
+// SetDEKDeprecation marks a DEK as deprecated. A zero deprecatedAt clears the deprecation.
+func (p *PostgresDEKStore) SetDEKDeprecation(ctx context.Context, tenantID, id string, deprecatedAt, sunsetAt time.Time, replacementDEKID string) error {
+	if deprecatedAt.IsZero() {
+		sunsetAt, replacementDEKID = time.Time{}, ""
+	}
+	return p.updateDEK(ctx, tenantID, id, "deprecated_at = $3, sunset_at = $4, replacement_dek_id = $5",
+		nullTime(deprecatedAt), nullTime(sunsetAt), replacementDEKID)
+}
+
+// SetDEKTags adds or overwrites the given tags on a DEK.
+func (p *PostgresDEKStore) SetDEKTags(ctx context.Context, tenantID, id string, tags map[string]string) error {
+	b, err := json.Marshal(tags)
+	if err != nil {
+		return fmt.Errorf("failed to encode DEK tags: %w", err)
+	}
+	return p.updateDEK(ctx, tenantID, id, "tags = tags || $3::jsonb", b)
+}
+
+// RemoveDEKTags removes the given tag keys from a DEK.
+func (p *PostgresDEKStore) RemoveDEKTags(ctx context.Context, tenantID, id string, keys []string) error {
+	return p.updateDEK(ctx, tenantID, id, "tags = tags - $3::text[]", keys)
+}
+
+// SetDEKPolicy replaces the access policy of a DEK. A nil policy removes it.
+func (p *PostgresDEKStore) SetDEKPolicy(ctx context.Context, tenantID, id string, policy *KeyPolicy) error {
+	var b []byte
+	if policy != nil {
+		var err error
+		if b, err = json.Marshal(policy); err != nil {
+			return fmt.Errorf("failed to encode DEK policy: %w", err)
+		}
+	}
+	return p.updateDEK(ctx, tenantID, id, "policy = $3", b)
+}
+
+// SetDEKSealedMetadata replaces a DEK's sealed metadata and clears the description,
+// tags and policy columns, provided the sealed ciphertext is still prev (nil for none).
+// Otherwise it returns ErrDEKChanged. Soft-deleted DEKs are updated too, so they can be
+// resealed.
+func (p *PostgresDEKStore) SetDEKSealedMetadata(ctx context.Context, tenantID, id string, prev []byte, sealed *SealedMetadata) error {
+	if err := checkDEKID(id); err != nil {
+		return err
+	}
+	tag, err := p.pool.Exec(ctx, `UPDATE deks SET sealed_ciphertext = $3, sealed_key_id = $4, sealed_tag_index = $5,
+		description = '', tags = '{}', policy = NULL
+		WHERE id = $1 AND tenant_id = $2 AND sealed_ciphertext IS NOT DISTINCT FROM $6`,
+		id, tenantID, sealed.Ciphertext, sealed.KeyID, textArray(sealed.TagIndex), prev)
+	if err != nil {
+		return fmt.Errorf("failed to update DEK: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrDEKChanged
+	}
+	return nil
+}
+
+// ListDEKsByMasterKey returns up to limit DEKs wrapped under masterKeyID or with
+// metadata sealed under it (every DEK when masterKeyID is empty), in every tenant and
+// including soft-deleted ones, ordered by ID, starting after cursor.
+func (p *PostgresDEKStore) ListDEKsByMasterKey(ctx context.Context, masterKeyID, cursor string, limit int) ([]DEKDocument, string, error) {
+	if cursor != "" {
+		if err := checkDEKID(cursor); err != nil {
+			return nil, "", fmt.Errorf("invalid cursor: %w", err)
+		}
+	}
+	rows, err := p.pool.Query(ctx, `SELECT `+dekColumns+`, dek FROM deks WHERE ($1 = '' OR master_key_id = $1 OR sealed_key_id = $1) AND id > $2 ORDER BY id LIMIT $3`,
+		masterKeyID, cursor, limit+1)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to list DEKs: %w", err)
+	}
+	docs, err := collectDEKs(rows, true)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to decode DEKs: %w", err)
+	}
+
+	next := ""
+	if len(docs) > limit {
+		docs = docs[:limit]
+		next = docs[limit-1].ID.Hex()
+	}
+	return docs, next, nil
+}
+
+// RewrapDEK replaces a DEK's wrapped key, deleted or not, provided it is still wrapped
+// under prevMasterKeyID. Otherwise it returns ErrDEKChanged.
+func (p *PostgresDEKStore) RewrapDEK(ctx context.Context, tenantID, id, prevMasterKeyID string, dek []byte, masterKeyID string) error {
+	if err := checkDEKID(id); err != nil {
+		return err
+	}
+	tag, err := p.pool.Exec(ctx, `UPDATE deks SET dek = $4, master_key_id = $5 WHERE id = $1 AND tenant_id = $2 AND master_key_id = $3`,
+		id, tenantID, prevMasterKeyID, dek, masterKeyID)
+	if err != nil {
+		return fmt.Errorf("failed to rewrap DEK: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrDEKChanged
+	}
+	return nil
+}
+
+// TouchDEK records that a DEK was just used for a cryptographic operation.
+func (p *PostgresDEKStore) TouchDEK(ctx context.Context, tenantID, id string) error {
+	return p.updateDEK(ctx, tenantID, id, "last_used_at = $3", time.Now().UTC())
+}
+
+// updateDEK applies set, whose parameters start at $3, to a live DEK.
+func (p *PostgresDEKStore) updateDEK(ctx context.Context, tenantID, id, set string, args ...interface{}) error {
+	if err := checkDEKID(id); err != nil {
+		return err
+	}
+
+	tag, err := p.pool.Exec(ctx, `UPDATE deks SET `+set+` WHERE id = $1 AND tenant_id = $2 AND deleted_at IS NULL`, append([]interface{}{id, tenantID}, args...)...)
+	if err != nil {
+		return fmt.Errorf("failed to update DEK: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf("no DEK found with ID %s", id)
+	}
+	return nil
+}
+
+// textArray stands in an empty array for nil, which pgx would send as NULL.
+func textArray(s []string) []string {
+	if s == nil {
+		return []string{}
+	}
+	return s
+}
+
+// Ping checks the connection to PostgreSQL.
+func (p *PostgresDEKStore) Ping(ctx context.Context) error {
+	return p.pool.Ping(ctx)
+}
+
+// Close closes the connection pool.
+func (p *PostgresDEKStore) Close(ctx context.Context) error {
+	p.pool.Close()
+	return nil
+}
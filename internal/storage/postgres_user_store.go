@@ -0,0 +1,201 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// pgUniqueViolation is the SQLSTATE of a duplicate key.
+const pgUniqueViolation = "23505"
+
+// PostgresUserStore handles users and custom roles in PostgreSQL, in the users and
+// roles tables.
+type PostgresUserStore struct {
+	pool *pgxpool.Pool
+}
+
+// NewPostgresUserStore connects to PostgreSQL and applies pending migrations.
+func NewPostgresUserStore(url string) (*PostgresUserStore, error) {
+	pool, err := connectPostgres(url)
+	if err != nil {
+		return nil, err
+	}
+	return &PostgresUserStore{pool: pool}, nil
+}
+
+const userColumns = `firebase_uid, role, tenant_id, disabled, conditions`
+
+func scanUser(row pgx.Row) (User, error) {
+	var u User
+	var conditions []byte
+	if err := row.Scan(&u.FirebaseUID, &u.Role, &u.TenantID, &u.Disabled, &conditions); err != nil {
+		return User{}, err
+	}
+	if conditions != nil {
+		if err := json.Unmarshal(conditions, &u.Conditions); err != nil {
+			return User{}, fmt.Errorf("failed to decode user conditions: %w", err)
+		}
+	}
+	return u, nil
+}
+
+// GetUserByFirebaseUID retrieves a user by their Firebase UID.
+func (p *PostgresUserStore) GetUserByFirebaseUID(ctx context.Context, uid string) (*User, error) {
+	user, err := scanUser(p.pool.QueryRow(ctx, `SELECT `+userColumns+` FROM users WHERE firebase_uid = $1`, uid))
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, fmt.Errorf("no user found with Firebase UID %s: %w", uid, ErrUserNotFound)
+		}
+		return nil, fmt.Errorf("error retrieving user: %w", err)
+	}
+	return &user, nil
+}
+
+// DisableUser marks a user as disabled so that further requests are rejected.
+func (p *PostgresUserStore) DisableUser(ctx context.Context, uid string) error {
+	tag, err := p.pool.Exec(ctx, `UPDATE users SET disabled = true WHERE firebase_uid = $1`, uid)
+	if err != nil {
+		return fmt.Errorf("failed to disable user: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf("no user found with Firebase UID %s", uid)
+	}
+	return nil
+}
+
+// ListUsers returns every user.
+func (p *PostgresUserStore) ListUsers(ctx context.Context) ([]User, error) {
+	rows, err := p.pool.Query(ctx, `SELECT `+userColumns+` FROM users ORDER BY firebase_uid`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list users: %w", err)
+	}
+	users, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (User, error) {
+		return scanUser(row)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode users: %w", err)
+	}
+	return users, nil
+}
+
+// UpsertUser creates or replaces the user with the same Firebase UID.
+func (p *PostgresUserStore) UpsertUser(ctx context.Context, user User) error {
+	var conditions []byte
+	if user.Conditions != nil {
+		var err error
+		if conditions, err = json.Marshal(user.Conditions); err != nil {
+			return fmt.Errorf("failed to encode user conditions: %w", err)
+		}
+	}
+	_, err := p.pool.Exec(ctx, `INSERT INTO users (`+userColumns+`) VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (firebase_uid) DO UPDATE SET role = EXCLUDED.role, tenant_id = EXCLUDED.tenant_id,
+			disabled = EXCLUDED.disabled, conditions = EXCLUDED.conditions`,
+		user.FirebaseUID, user.Role, user.TenantID, user.Disabled, conditions)
+	if err != nil {
+		return fmt.Errorf("failed to upsert user: %w", err)
+	}
+	return nil
+}
+
+// CountUsersWithRole returns how many users are assigned role.
+func (p *PostgresUserStore) CountUsersWithRole(ctx context.Context, role string) (int64, error) {
+	var n int64
+	if err := p.pool.QueryRow(ctx, `SELECT count(*) FROM users WHERE role = $1`, role).Scan(&n); err != nil {
+		return 0, fmt.Errorf("failed to count users: %w", err)
+	}
+	return n, nil
+}
+
+// InsertRole stores a new role definition, failing if the name is taken.
+func (p *PostgresUserStore) InsertRole(ctx context.Context, role RoleDefinition) error {
+	_, err := p.pool.Exec(ctx, `INSERT INTO roles (name, actions, description, updated_by, updated_at) VALUES ($1, $2, $3, $4, $5)`,
+		role.Name, roleActions(role), role.Description, role.UpdatedBy, role.UpdatedAt)
+	if err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == pgUniqueViolation {
+			return fmt.Errorf("role %s already exists", role.Name)
+		}
+		return fmt.Errorf("failed to insert role: %w", err)
+	}
+	return nil
+}
+
+// UpdateRole replaces the actions and description of an existing role.
+func (p *PostgresUserStore) UpdateRole(ctx context.Context, role RoleDefinition) error {
+	tag, err := p.pool.Exec(ctx, `UPDATE roles SET actions = $2, description = $3, updated_by = $4, updated_at = $5 WHERE name = $1`,
+		role.Name, roleActions(role), role.Description, role.UpdatedBy, role.UpdatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to update role: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf("no role found with name %s", role.Name)
+	}
+	return nil
+}
+
+// UpsertRole creates or replaces a role definition.
+func (p *PostgresUserStore) UpsertRole(ctx context.Context, role RoleDefinition) error {
+	_, err := p.pool.Exec(ctx, `INSERT INTO roles (name, actions, description, updated_by, updated_at) VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (name) DO UPDATE SET actions = EXCLUDED.actions, description = EXCLUDED.description,
+			updated_by = EXCLUDED.updated_by, updated_at = EXCLUDED.updated_at`,
+		role.Name, roleActions(role), role.Description, role.UpdatedBy, role.UpdatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to upsert role: %w", err)
+	}
+	return nil
+}
+
+// ListRoles returns every custom role, sorted by name.
+func (p *PostgresUserStore) ListRoles(ctx context.Context) ([]RoleDefinition, error) {
+	rows, err := p.pool.Query(ctx, `SELECT name, actions, description, updated_by, updated_at FROM roles ORDER BY name`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list roles: %w", err)
+	}
+	roles, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (RoleDefinition, error) {
+		var r RoleDefinition
+		err := row.Scan(&r.Name, &r.Actions, &r.Description, &r.UpdatedBy, &r.UpdatedAt)
+		r.UpdatedAt = r.UpdatedAt.UTC()
+		return r, err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode roles: %w", err)
+	}
+	return roles, nil
+}
+
+// DeleteRole removes a custom role definition.
+func (p *PostgresUserStore) DeleteRole(ctx context.Context, name string) error {
+	tag, err := p.pool.Exec(ctx, `DELETE FROM roles WHERE name = $1`, name)
+	if err != nil {
+		return fmt.Errorf("failed to delete role: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf("no role found with name %s", name)
+	}
+	return nil
+}
+
+// roleActions keeps the NOT NULL actions column from receiving a nil slice.
+func roleActions(role RoleDefinition) []string {
+	if role.Actions == nil {
+		return []string{}
+	}
+	return role.Actions
+}
+
+// Ping checks the connection to PostgreSQL.
+func (p *PostgresUserStore) Ping(ctx context.Context) error {
+	return p.pool.Ping(ctx)
+}
+
+// Close closes the connection pool.
+func (p *PostgresUserStore) Close(ctx context.Context) error {
+	p.pool.Close()
+	return nil
+}
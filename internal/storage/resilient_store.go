@@ -0,0 +1,390 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"my-kms/internal/logging"
+	"my-kms/internal/metrics"
+)
+
+// ErrCircuitOpen is returned without calling the store while its circuit breaker is
+// open.
+var ErrCircuitOpen = errors.New("storage unavailable: circuit breaker is open")
+
+// ResiliencePolicy controls how calls to MongoDB are retried and when they stop being
+// made at all.
+type ResiliencePolicy struct {
+	MaxAttempts    int           // including the first; 1 disables retries
+	BaseDelay      time.Duration // doubled on each retry, with jitter
+	AttemptTimeout time.Duration // bounds each attempt; 0 leaves it to the request's deadline
+
+	BreakerThreshold int           // consecutive transient failures that open the breaker; 0 disables it
+	BreakerCooldown  time.Duration // how long the breaker stays open before a trial call
+}
+
+// CircuitBreaker fails calls fast once the store behind it has failed
+// BreakerThreshold times in a row, instead of letting each one wait out the driver's
+// timeouts. After BreakerCooldown one trial call goes through; its success closes the
+// breaker again. One breaker is shared by every store on the same cluster.
+type CircuitBreaker struct {
+	name   string
+	policy ResiliencePolicy
+
+	mu       sync.Mutex
+	failures int
+	open     bool
+	openedAt time.Time
+	trial    bool // a trial call is in flight
+}
+
+// NewCircuitBreaker creates a closed breaker; name identifies it in logs.
+func NewCircuitBreaker(name string, policy ResiliencePolicy) *CircuitBreaker {
+	if policy.MaxAttempts < 1 {
+		policy.MaxAttempts = 1
+	}
+	return &CircuitBreaker{name: name, policy: policy}
+}
+
+// Open reports whether calls are currently being refused.
+func (b *CircuitBreaker) Open() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.open
+}
+
+// allow reports whether a call may go ahead, and whether it is the trial call.
+func (b *CircuitBreaker) allow() (ok, trial bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.open {
+		return true, false
+	}
+	if b.trial || time.Since(b.openedAt) < b.policy.BreakerCooldown {
+		return false, false
+	}
+	b.trial = true
+	return true, true
+}
+
+// record updates the breaker with the outcome of a call it allowed.
+func (b *CircuitBreaker) record(trial, failed bool) {
+	if b.policy.BreakerThreshold <= 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if trial {
+		b.trial = false
+	}
+	if !failed {
+		if b.open && trial {
+			logging.Infof("storage", "%s recovered, closing its circuit breaker", b.name)
+			b.open = false
+		}
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if trial || (!b.open && b.failures >= b.policy.BreakerThreshold) {
+		if !b.open {
+			logging.Errorf("storage", "%s failed %d times in a row, opening its circuit breaker for %s", b.name, b.failures, b.policy.BreakerCooldown)
+		}
+		b.open = true
+		b.openedAt = time.Now()
+	}
+}
+
+// release gives up a trial call whose caller went away before it finished, so that
+// the next call becomes the trial.
+func (b *CircuitBreaker) release(trial bool) {
+	if trial {
+		b.mu.Lock()
+		b.trial = false
+		b.mu.Unlock()
+	}
+}
+
+// do runs fn under the breaker, retrying transient failures if retry is set.
+func (b *CircuitBreaker) do(ctx context.Context, op string, retry bool, fn func(context.Context) error) error {
+	for attempt := 1; ; attempt++ {
+		ok, trial := b.allow()
+		if !ok {
+			return ErrCircuitOpen
+		}
+		attemptCtx, cancel := ctx, context.CancelFunc(func() {})
+		if b.policy.AttemptTimeout > 0 {
+			attemptCtx, cancel = context.WithTimeout(ctx, b.policy.AttemptTimeout)
+		}
+		err := fn(attemptCtx)
+		cancel()
+		if ctx.Err() != nil {
+			b.release(trial)
+			return err
+		}
+		failed := transient(err)
+		b.record(trial, failed)
+		if !failed || !retry || attempt >= b.policy.MaxAttempts {
+			return err
+		}
+		metrics.MongoRetries.Inc(op)
+		backoff := b.policy.BaseDelay << (attempt - 1)
+		backoff = backoff/2 + rand.N(backoff/2+1)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+	}
+}
+
+// transient reports whether err is a failure another attempt might not hit: network
+// errors, timeouts, server selection failures and errors MongoDB labels retryable.
+// The caller has already ruled out its own context ending.
+func transient(err error) bool {
+	if err == nil {
+		return false
+	}
+	if mongo.IsNetworkError(err) || mongo.IsTimeout(err) {
+		return true
+	}
+	var serverErr mongo.ServerError
+	return errors.As(err, &serverErr) &&
+		(serverErr.HasErrorLabel("RetryableWriteError") || serverErr.HasErrorLabel("TransientTransactionError"))
+}
+
+// breakerCall runs a store call that returns a value under b.
+func breakerCall[T any](ctx context.Context, b *CircuitBreaker, op string, retry bool, fn func(context.Context) (T, error)) (T, error) {
+	var v T
+	err := b.do(ctx, op, retry, func(ctx context.Context) error {
+		var err error
+		v, err = fn(ctx)
+		return err
+	})
+	return v, err
+}
+
+// ---------------------------------------------------------------------
+// DEK Store
+// ---------------------------------------------------------------------
+
+// ResilientDEKStore calls its DEKStore under a CircuitBreaker. Reads and writes that
+// change nothing when repeated are retried; the rest, such as InsertDEK, are left to
+// the driver's own single retry, since a retry of a write that reached the server
+// could insert a second DEK or fail its own precondition.
+type ResilientDEKStore struct {
+	store   DEKStore
+	breaker *CircuitBreaker
+}
+
+// NewResilientDEKStore wraps store with breaker.
+func NewResilientDEKStore(store DEKStore, breaker *CircuitBreaker) *ResilientDEKStore {
+	return &ResilientDEKStore{store: store, breaker: breaker}
+}
+
+func (r *ResilientDEKStore) InsertDEK(ctx context.Context, doc DEKDocument) (string, error) {
+	return breakerCall(ctx, r.breaker, "InsertDEK", false, func(ctx context.Context) (string, error) {
+		return r.store.InsertDEK(ctx, doc)
+	})
+}
+
+func (r *ResilientDEKStore) GetDEK(ctx context.Context, tenantID, id string) (*DEKDocument, error) {
+	return breakerCall(ctx, r.breaker, "GetDEK", true, func(ctx context.Context) (*DEKDocument, error) {
+		return r.store.GetDEK(ctx, tenantID, id)
+	})
+}
+
+func (r *ResilientDEKStore) DeleteDEK(ctx context.Context, tenantID, id, deletedBy string) error {
+	return r.breaker.do(ctx, "DeleteDEK", false, func(ctx context.Context) error {
+		return r.store.DeleteDEK(ctx, tenantID, id, deletedBy)
+	})
+}
+
+func (r *ResilientDEKStore) RestoreDEK(ctx context.Context, tenantID, id string) error {
+	return r.breaker.do(ctx, "RestoreDEK", false, func(ctx context.Context) error {
+		return r.store.RestoreDEK(ctx, tenantID, id)
+	})
+}
+
+func (r *ResilientDEKStore) PurgeDeletedDEKs(ctx context.Context, cutoff time.Time, held HeldKeys) (int64, error) {
+	return breakerCall(ctx, r.breaker, "PurgeDeletedDEKs", true, func(ctx context.Context) (int64, error) {
+		return r.store.PurgeDeletedDEKs(ctx, cutoff, held)
+	})
+}
+
+func (r *ResilientDEKStore) ListDEKsByOwner(ctx context.Context, tenantID, ownerUID string) ([]DEKDocument, error) {
+	return breakerCall(ctx, r.breaker, "ListDEKsByOwner", true, func(ctx context.Context) ([]DEKDocument, error) {
+		return r.store.ListDEKsByOwner(ctx, tenantID, ownerUID)
+	})
+}
+
+func (r *ResilientDEKStore) ListDEKs(ctx context.Context, filter DEKFilter, cursor string, limit int) ([]DEKDocument, string, error) {
+	var next string
+	docs, err := breakerCall(ctx, r.breaker, "ListDEKs", true, func(ctx context.Context) ([]DEKDocument, error) {
+		docs, n, err := r.store.ListDEKs(ctx, filter, cursor, limit)
+		next = n
+		return docs, err
+	})
+	return docs, next, err
+}
+
+func (r *ResilientDEKStore) SetDEKOwner(ctx context.Context, tenantID, id, ownerUID string) error {
+	return r.breaker.do(ctx, "SetDEKOwner", true, func(ctx context.Context) error {
+		return r.store.SetDEKOwner(ctx, tenantID, id, ownerUID)
+	})
+}
+
+func (r *ResilientDEKStore) SetDEKState(ctx context.Context, tenantID, id string, state KeyState, from ...KeyState) error {
+	return r.breaker.do(ctx, "SetDEKState", false, func(ctx context.Context) error {
+		return r.store.SetDEKState(ctx, tenantID, id, state, from...)
+	})
+}
+
+func (r *ResilientDEKStore) SetDEKDeprecation(ctx context.Context, tenantID, id string, deprecatedAt, sunsetAt time.Time, replacementDEKID string) error {
+	return r.breaker.do(ctx, "SetDEKDeprecation", true, func(ctx context.Context) error {
+		return r.store.SetDEKDeprecation(ctx, tenantID, id, deprecatedAt, sunsetAt, replacementDEKID)
+	})
+}
+
+func (r *ResilientDEKStore) SetDEKTags(ctx context.Context, tenantID, id string, tags map[string]string) error {
+	return r.breaker.do(ctx, "SetDEKTags", true, func(ctx context.Context) error {
+		return r.store.SetDEKTags(ctx, tenantID, id, tags)
+	})
+}
+
+func (r *ResilientDEKStore) RemoveDEKTags(ctx context.Context, tenantID, id string, keys []string) error {
+	return r.breaker.do(ctx, "RemoveDEKTags", true, func(ctx context.Context) error {
+		return r.store.RemoveDEKTags(ctx, tenantID, id, keys)
+	})
+}
+
+func (r *ResilientDEKStore) SetDEKPolicy(ctx context.Context, tenantID, id string, policy *KeyPolicy) error {
+	return r.breaker.do(ctx, "SetDEKPolicy", true, func(ctx context.Context) error {
+		return r.store.SetDEKPolicy(ctx, tenantID, id, policy)
+	})
+}
+
+func (r *ResilientDEKStore) SetDEKSealedMetadata(ctx context.Context, tenantID, id string, prev []byte, sealed *SealedMetadata) error {
+	return r.breaker.do(ctx, "SetDEKSealedMetadata", false, func(ctx context.Context) error {
+		return r.store.SetDEKSealedMetadata(ctx, tenantID, id, prev, sealed)
+	})
+}
+
+func (r *ResilientDEKStore) ListDEKsByMasterKey(ctx context.Context, masterKeyID, cursor string, limit int) ([]DEKDocument, string, error) {
+	var next string
+	docs, err := breakerCall(ctx, r.breaker, "ListDEKsByMasterKey", true, func(ctx context.Context) ([]DEKDocument, error) {
+		docs, n, err := r.store.ListDEKsByMasterKey(ctx, masterKeyID, cursor, limit)
+		next = n
+		return docs, err
+	})
+	return docs, next, err
+}
+
+func (r *ResilientDEKStore) RewrapDEK(ctx context.Context, tenantID, id, prevMasterKeyID string, dek []byte, masterKeyID string) error {
+	return r.breaker.do(ctx, "RewrapDEK", false, func(ctx context.Context) error {
+		return r.store.RewrapDEK(ctx, tenantID, id, prevMasterKeyID, dek, masterKeyID)
+	})
+}
+
+func (r *ResilientDEKStore) TouchDEK(ctx context.Context, tenantID, id string) error {
+	return r.breaker.do(ctx, "TouchDEK", true, func(ctx context.Context) error {
+		return r.store.TouchDEK(ctx, tenantID, id)
+	})
+}
+
+// Ping is not retried, and reports ErrCircuitOpen while the breaker is open, so
+// health checks take the server out of rotation; once the cooldown is over, a health
+// check may be the trial call that closes it.
+func (r *ResilientDEKStore) Ping(ctx context.Context) error {
+	return r.breaker.do(ctx, "Ping", false, r.store.Ping)
+}
+
+func (r *ResilientDEKStore) Close(ctx context.Context) error {
+	return r.store.Close(ctx)
+}
+
+// ---------------------------------------------------------------------
+// User Store
+// ---------------------------------------------------------------------
+
+// ResilientUserStore calls its UserStore under a CircuitBreaker, retrying everything
+// but InsertRole and DeleteRole, which fail when repeated after succeeding.
+type ResilientUserStore struct {
+	store   UserStore
+	breaker *CircuitBreaker
+}
+
+// NewResilientUserStore wraps store with breaker.
+func NewResilientUserStore(store UserStore, breaker *CircuitBreaker) *ResilientUserStore {
+	return &ResilientUserStore{store: store, breaker: breaker}
+}
+
+func (r *ResilientUserStore) GetUserByFirebaseUID(ctx context.Context, uid string) (*User, error) {
+	return breakerCall(ctx, r.breaker, "GetUserByFirebaseUID", true, func(ctx context.Context) (*User, error) {
+		return r.store.GetUserByFirebaseUID(ctx, uid)
+	})
+}
+
+func (r *ResilientUserStore) DisableUser(ctx context.Context, uid string) error {
+	return r.breaker.do(ctx, "DisableUser", true, func(ctx context.Context) error {
+		return r.store.DisableUser(ctx, uid)
+	})
+}
+
+func (r *ResilientUserStore) ListUsers(ctx context.Context) ([]User, error) {
+	return breakerCall(ctx, r.breaker, "ListUsers", true, r.store.ListUsers)
+}
+
+func (r *ResilientUserStore) UpsertUser(ctx context.Context, user User) error {
+	return r.breaker.do(ctx, "UpsertUser", true, func(ctx context.Context) error {
+		return r.store.UpsertUser(ctx, user)
+	})
+}
+
+func (r *ResilientUserStore) CountUsersWithRole(ctx context.Context, role string) (int64, error) {
+	return breakerCall(ctx, r.breaker, "CountUsersWithRole", true, func(ctx context.Context) (int64, error) {
+		return r.store.CountUsersWithRole(ctx, role)
+	})
+}
+
+func (r *ResilientUserStore) InsertRole(ctx context.Context, role RoleDefinition) error {
+	return r.breaker.do(ctx, "InsertRole", false, func(ctx context.Context) error {
+		return r.store.InsertRole(ctx, role)
+	})
+}
+
+func (r *ResilientUserStore) UpdateRole(ctx context.Context, role RoleDefinition) error {
+	return r.breaker.do(ctx, "UpdateRole", true, func(ctx context.Context) error {
+		return r.store.UpdateRole(ctx, role)
+	})
+}
+
+func (r *ResilientUserStore) UpsertRole(ctx context.Context, role RoleDefinition) error {
+	return r.breaker.do(ctx, "UpsertRole", true, func(ctx context.Context) error {
+		return r.store.UpsertRole(ctx, role)
+	})
+}
+
+func (r *ResilientUserStore) ListRoles(ctx context.Context) ([]RoleDefinition, error) {
+	return breakerCall(ctx, r.breaker, "ListRoles", true, r.store.ListRoles)
+}
+
+func (r *ResilientUserStore) DeleteRole(ctx context.Context, name string) error {
+	return r.breaker.do(ctx, "DeleteRole", false, func(ctx context.Context) error {
+		return r.store.DeleteRole(ctx, name)
+	})
+}
+
+// Ping behaves as ResilientDEKStore.Ping.
+func (r *ResilientUserStore) Ping(ctx context.Context) error {
+	return r.breaker.do(ctx, "Ping", false, r.store.Ping)
+}
+
+func (r *ResilientUserStore) Close(ctx context.Context) error {
+	return r.store.Close(ctx)
+}
@@ -0,0 +1,314 @@
+package storage
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Storage key purposes for DEK metadata, derived from the master keys.
+const (
+	metadataKeyPurpose = "dek-metadata"
+	tagIndexKeyPurpose = "dek-tag-index"
+)
+
+// sealedMetadataRetries bounds how often a metadata update is retried after a
+// concurrent one.
+const sealedMetadataRetries = 5
+
+// ErrDEKChanged is returned by SetDEKSealedMetadata when the sealed metadata is no
+// longer what the caller read.
+var ErrDEKChanged = errors.New("DEK metadata was changed concurrently")
+
+// SealedMetadata is the encrypted form of a DEK's description, tags and policy.
+type SealedMetadata struct {
+	Ciphertext []byte   `bson:"ciphertext" json:"ciphertext"` // nonce, then sealed JSON
+	KeyID      string   `bson:"keyId" json:"keyId"`           // master key the storage key derives from
+	TagIndex   []string `bson:"tagIndex,omitempty" json:"tagIndex,omitempty"`
+}
+
+// dekMetadata is what SealedMetadata encrypts.
+type dekMetadata struct {
+	Description string            `json:"description,omitempty"`
+	Tags        map[string]string `json:"tags,omitempty"`
+	Policy      *KeyPolicy        `json:"policy,omitempty"`
+}
+
+// SealedDEKStore encrypts DEK descriptions, tags and policies before they reach the
+// store beneath it, so a dump of the store alone shows none of them. Tags stay
+// filterable through a blind index of HMACs of tag pairs, which does reveal which
+// DEKs in a tenant share a tag.
+//
+// Documents are opened on every read whether or not Seal is set, so sealing can be
+// turned off without losing access. With Seal set, new DEKs are sealed, as are older
+// ones the next time their metadata changes.
+type SealedDEKStore struct {
+	DEKStore
+	keys *MasterKeyStore
+	seal bool
+}
+
+// NewSealedDEKStore wraps store. seal decides whether metadata not yet sealed is sealed
+// when written.
+func NewSealedDEKStore(store DEKStore, keys *MasterKeyStore, seal bool) *SealedDEKStore {
+	return &SealedDEKStore{DEKStore: store, keys: keys, seal: seal}
+}
+
+func metadataAAD(tenantID, id string) []byte {
+	return []byte("kms-dek-metadata|" + tenantID + "|" + id)
+}
+
+// sealMetadata encrypts meta for DEK id under the active master key.
+func (s *SealedDEKStore) sealMetadata(tenantID, id string, meta dekMetadata) (*SealedMetadata, error) {
+	key, keyID, err := s.keys.DeriveStorageKey("", metadataKeyPurpose)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := json.Marshal(meta)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode DEK metadata: %w", err)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	index, err := s.tagIndex(keyID, tenantID, meta.Tags)
+	if err != nil {
+		return nil, err
+	}
+	return &SealedMetadata{
+		Ciphertext: gcm.Seal(nonce, nonce, plaintext, metadataAAD(tenantID, id)),
+		KeyID:      keyID,
+		TagIndex:   index,
+	}, nil
+}
+
+// open decrypts doc's sealed metadata into its Description, Tags and Policy.
+func (s *SealedDEKStore) open(doc *DEKDocument) error {
+	if doc.Sealed == nil {
+		return nil
+	}
+	key, _, err := s.keys.DeriveStorageKey(doc.Sealed.KeyID, metadataKeyPurpose)
+	if err != nil {
+		return fmt.Errorf("failed to open metadata of DEK %s: %w", doc.ID.Hex(), err)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return err
+	}
+	ct := doc.Sealed.Ciphertext
+	if len(ct) < gcm.NonceSize() {
+		return fmt.Errorf("sealed metadata of DEK %s is truncated", doc.ID.Hex())
+	}
+	plaintext, err := gcm.Open(nil, ct[:gcm.NonceSize()], ct[gcm.NonceSize():], metadataAAD(doc.TenantID, doc.ID.Hex()))
+	if err != nil {
+		return fmt.Errorf("failed to open metadata of DEK %s: %w", doc.ID.Hex(), err)
+	}
+	var meta dekMetadata
+	if err := json.Unmarshal(plaintext, &meta); err != nil {
+		return fmt.Errorf("failed to decode metadata of DEK %s: %w", doc.ID.Hex(), err)
+	}
+	doc.Description, doc.Tags, doc.Policy = meta.Description, meta.Tags, meta.Policy
+	return nil
+}
+
+// OpenDEKMetadata decrypts the sealed metadata of doc, in stored form as
+// ListDEKsByMasterKey returns it, into its Description, Tags and Policy.
+func (s *SealedDEKStore) OpenDEKMetadata(doc *DEKDocument) error {
+	if err := s.open(doc); err != nil {
+		return err
+	}
+	doc.Sealed = nil
+	return nil
+}
+
+// ResealDEKMetadata seals doc's metadata again under the active master key, so the key
+// it was sealed under can be retired. doc is in stored form, as ListDEKsByMasterKey
+// returns it; ErrDEKChanged means it has changed since.
+func (s *SealedDEKStore) ResealDEKMetadata(ctx context.Context, doc DEKDocument) error {
+	if doc.Sealed == nil {
+		return nil
+	}
+	prev := doc.Sealed.Ciphertext
+	if err := s.open(&doc); err != nil {
+		return err
+	}
+	sealed, err := s.sealMetadata(doc.TenantID, doc.ID.Hex(), dekMetadata{Description: doc.Description, Tags: doc.Tags, Policy: doc.Policy})
+	if err != nil {
+		return err
+	}
+	return s.DEKStore.SetDEKSealedMetadata(ctx, doc.TenantID, doc.ID.Hex(), prev, sealed)
+}
+
+// tagIndex returns the blind index entries of tags under the index key derived from
+// master key keyID.
+func (s *SealedDEKStore) tagIndex(keyID, tenantID string, tags map[string]string) ([]string, error) {
+	if len(tags) == 0 {
+		return nil, nil
+	}
+	key, _, err := s.keys.DeriveStorageKey(keyID, tagIndexKeyPurpose)
+	if err != nil {
+		return nil, err
+	}
+	index := make([]string, 0, len(tags))
+	for k, v := range tags {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(tenantID + "\x00" + k + "\x00" + v))
+		index = append(index, base64.RawStdEncoding.EncodeToString(mac.Sum(nil)))
+	}
+	slices.Sort(index)
+	return index, nil
+}
+
+// InsertDEK seals the new DEK's metadata before inserting it.
+func (s *SealedDEKStore) InsertDEK(ctx context.Context, doc DEKDocument) (string, error) {
+	if !s.seal {
+		return s.DEKStore.InsertDEK(ctx, doc)
+	}
+	if doc.ID.IsZero() {
+		doc.ID = primitive.NewObjectID()
+	}
+	sealed, err := s.sealMetadata(doc.TenantID, doc.ID.Hex(), dekMetadata{Description: doc.Description, Tags: doc.Tags, Policy: doc.Policy})
+	if err != nil {
+		return "", fmt.Errorf("failed to seal DEK metadata: %w", err)
+	}
+	doc.Description, doc.Tags, doc.Policy, doc.Sealed = "", nil, nil, sealed
+	return s.DEKStore.InsertDEK(ctx, doc)
+}
+
+// GetDEK retrieves a DEK and opens its metadata.
+func (s *SealedDEKStore) GetDEK(ctx context.Context, tenantID, id string) (*DEKDocument, error) {
+	doc, err := s.DEKStore.GetDEK(ctx, tenantID, id)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.open(doc); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+// ListDEKsByOwner lists an owner's DEKs and opens their metadata.
+func (s *SealedDEKStore) ListDEKsByOwner(ctx context.Context, tenantID, ownerUID string) ([]DEKDocument, error) {
+	docs, err := s.DEKStore.ListDEKsByOwner(ctx, tenantID, ownerUID)
+	if err != nil {
+		return nil, err
+	}
+	for i := range docs {
+		if err := s.open(&docs[i]); err != nil {
+			return nil, err
+		}
+	}
+	return docs, nil
+}
+
+// ListDEKs lists DEKs and opens their metadata. A tag filter also matches sealed
+// documents through their blind index, under each loaded master key.
+func (s *SealedDEKStore) ListDEKs(ctx context.Context, filter DEKFilter, cursor string, limit int) ([]DEKDocument, string, error) {
+	if len(filter.Tags) > 0 {
+		ids, _ := s.keys.KeyIDs()
+		filter.TagHashes = make(map[string][]string, len(ids))
+		for _, keyID := range ids {
+			hashes, err := s.tagIndex(keyID, filter.TenantID, filter.Tags)
+			if err != nil {
+				return nil, "", err
+			}
+			filter.TagHashes[keyID] = hashes
+		}
+	}
+	docs, next, err := s.DEKStore.ListDEKs(ctx, filter, cursor, limit)
+	if err != nil {
+		return nil, "", err
+	}
+	for i := range docs {
+		if err := s.open(&docs[i]); err != nil {
+			return nil, "", err
+		}
+	}
+	return docs, next, nil
+}
+
+// SetDEKTags adds or overwrites tags, in the sealed metadata if the DEK has any.
+func (s *SealedDEKStore) SetDEKTags(ctx context.Context, tenantID, id string, tags map[string]string) error {
+	return s.updateMetadata(ctx, tenantID, id, func(meta *dekMetadata) {
+		if meta.Tags == nil {
+			meta.Tags = make(map[string]string, len(tags))
+		}
+		maps.Copy(meta.Tags, tags)
+	}, func() error { return s.DEKStore.SetDEKTags(ctx, tenantID, id, tags) })
+}
+
+// RemoveDEKTags removes tag keys, from the sealed metadata if the DEK has any.
+func (s *SealedDEKStore) RemoveDEKTags(ctx context.Context, tenantID, id string, keys []string) error {
+	return s.updateMetadata(ctx, tenantID, id, func(meta *dekMetadata) {
+		for _, k := range keys {
+			delete(meta.Tags, k)
+		}
+	}, func() error { return s.DEKStore.RemoveDEKTags(ctx, tenantID, id, keys) })
+}
+
+// SetDEKPolicy replaces the policy, in the sealed metadata if the DEK has any.
+func (s *SealedDEKStore) SetDEKPolicy(ctx context.Context, tenantID, id string, policy *KeyPolicy) error {
+	return s.updateMetadata(ctx, tenantID, id, func(meta *dekMetadata) {
+		meta.Policy = policy
+	}, func() error { return s.DEKStore.SetDEKPolicy(ctx, tenantID, id, policy) })
+}
+
+// updateMetadata applies change to a DEK's metadata. A DEK that is sealed, or is to be,
+// is read, changed and sealed again, retrying if another update got in between; any
+// other DEK is updated in the clear by inPlace.
+func (s *SealedDEKStore) updateMetadata(ctx context.Context, tenantID, id string, change func(*dekMetadata), inPlace func() error) error {
+	for attempt := 0; attempt < sealedMetadataRetries; attempt++ {
+		doc, err := s.DEKStore.GetDEK(ctx, tenantID, id)
+		if err != nil {
+			return err
+		}
+		if doc.Sealed == nil && !s.seal {
+			return inPlace()
+		}
+		var prev []byte
+		if doc.Sealed != nil {
+			prev = doc.Sealed.Ciphertext
+		}
+		if err := s.open(doc); err != nil {
+			return err
+		}
+		meta := dekMetadata{Description: doc.Description, Tags: doc.Tags, Policy: doc.Policy}
+		change(&meta)
+		if len(meta.Tags) == 0 {
+			meta.Tags = nil
+		}
+		sealed, err := s.sealMetadata(tenantID, id, meta)
+		if err != nil {
+			return fmt.Errorf("failed to seal DEK metadata: %w", err)
+		}
+		err = s.DEKStore.SetDEKSealedMetadata(ctx, tenantID, id, prev, sealed)
+		if !errors.Is(err, ErrDEKChanged) {
+			return err
+		}
+	}
+	return fmt.Errorf("failed to update DEK %s: %w", id, ErrDEKChanged)
+}
@@ -0,0 +1,47 @@
+package storage
+
+import (
+	"context"
+	"time"
+)
+
+// DEKStore persists wrapped DEKs. It is implemented by MongoDEKStore,
+// PostgresDEKStore and MemoryDEKStore; DEK IDs are 24-character hex strings on all of them.
+type DEKStore interface {
+	InsertDEK(ctx context.Context, doc DEKDocument) (string, error)
+	GetDEK(ctx context.Context, tenantID, id string) (*DEKDocument, error)
+	DeleteDEK(ctx context.Context, tenantID, id, deletedBy string) error
+	RestoreDEK(ctx context.Context, tenantID, id string) error
+	PurgeDeletedDEKs(ctx context.Context, cutoff time.Time, held HeldKeys) (int64, error)
+	ListDEKsByOwner(ctx context.Context, tenantID, ownerUID string) ([]DEKDocument, error)
+	ListDEKs(ctx context.Context, filter DEKFilter, cursor string, limit int) ([]DEKDocument, string, error)
+	SetDEKOwner(ctx context.Context, tenantID, id, ownerUID string) error
+	SetDEKState(ctx context.Context, tenantID, id string, state KeyState, from ...KeyState) error
+	SetDEKDeprecation(ctx context.Context, tenantID, id string, deprecatedAt, sunsetAt time.Time, replacementDEKID string) error
+	SetDEKTags(ctx context.Context, tenantID, id string, tags map[string]string) error
+	RemoveDEKTags(ctx context.Context, tenantID, id string, keys []string) error
+	SetDEKPolicy(ctx context.Context, tenantID, id string, policy *KeyPolicy) error
+	SetDEKSealedMetadata(ctx context.Context, tenantID, id string, prev []byte, sealed *SealedMetadata) error
+	ListDEKsByMasterKey(ctx context.Context, masterKeyID, cursor string, limit int) ([]DEKDocument, string, error)
+	RewrapDEK(ctx context.Context, tenantID, id, prevMasterKeyID string, dek []byte, masterKeyID string) error
+	TouchDEK(ctx context.Context, tenantID, id string) error
+	Ping(ctx context.Context) error
+	Close(ctx context.Context) error
+}
+
+// UserStore persists users and custom role definitions. It is implemented by
+// MongoUserStore, PostgresUserStore and MemoryUserStore.
+type UserStore interface {
+	GetUserByFirebaseUID(ctx context.Context, uid string) (*User, error)
+	DisableUser(ctx context.Context, uid string) error
+	ListUsers(ctx context.Context) ([]User, error)
+	UpsertUser(ctx context.Context, user User) error
+	CountUsersWithRole(ctx context.Context, role string) (int64, error)
+	InsertRole(ctx context.Context, role RoleDefinition) error
+	UpdateRole(ctx context.Context, role RoleDefinition) error
+	UpsertRole(ctx context.Context, role RoleDefinition) error
+	ListRoles(ctx context.Context) ([]RoleDefinition, error)
+	DeleteRole(ctx context.Context, name string) error
+	Ping(ctx context.Context) error
+	Close(ctx context.Context) error
+}
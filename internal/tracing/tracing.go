@@ -0,0 +1,129 @@
+// Package tracing sets up OpenTelemetry tracing and holds the server's span helpers.
+// Exporter, sampler and resource settings come from the standard OTEL_* environment
+// variables, read by the OpenTelemetry SDK itself.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/event"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ServiceName is used when OTEL_SERVICE_NAME is not set.
+const ServiceName = "my-kms"
+
+// Supported OTEL_TRACES_EXPORTER values.
+const (
+	ExporterNone = "none"
+	ExporterOTLP = "otlp"
+)
+
+// Setup installs the global tracer provider and W3C trace context propagation. With the
+// "none" exporter spans are still created, so incoming trace IDs propagate, but nothing
+// is exported. The returned function flushes and stops the exporter.
+func Setup(ctx context.Context, exporter string) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	switch strings.ToLower(exporter) {
+	case ExporterNone, "":
+		return func(context.Context) error { return nil }, nil
+	case ExporterOTLP:
+	default:
+		return nil, fmt.Errorf("unsupported OTEL_TRACES_EXPORTER %q; expected otlp or none", exporter)
+	}
+
+	exp, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OTLP exporter: %w", err)
+	}
+	// resource.Default is overridden by OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES.
+	res, err := resource.Merge(resource.NewSchemaless(semconv.ServiceName(ServiceName)), resource.Default())
+	if err != nil {
+		return nil, fmt.Errorf("failed to build trace resource: %w", err)
+	}
+	tp := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exp), sdktrace.WithResource(res))
+	otel.SetTracerProvider(tp)
+	return tp.Shutdown, nil
+}
+
+// Tracer returns the server's tracer.
+func Tracer() trace.Tracer {
+	return otel.Tracer("my-kms")
+}
+
+// Start starts a span; see trace.Tracer.Start.
+func Start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return Tracer().Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// End records err, if any, on span and ends it.
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// ---------------------------------------------------------------------
+// MongoDB
+// ---------------------------------------------------------------------
+
+// MongoMonitor starts a client span for every MongoDB command issued with a traced
+// context. failed, when not nil, is also called for each failed command.
+func MongoMonitor(failed func(context.Context, *event.CommandFailedEvent)) *event.CommandMonitor {
+	var (
+		mu    sync.Mutex
+		spans = map[int64]trace.Span{}
+	)
+	finish := func(requestID int64, err error) {
+		mu.Lock()
+		span, ok := spans[requestID]
+		delete(spans, requestID)
+		mu.Unlock()
+		if ok {
+			End(span, err)
+		}
+	}
+	return &event.CommandMonitor{
+		Started: func(ctx context.Context, e *event.CommandStartedEvent) {
+			if !trace.SpanContextFromContext(ctx).IsValid() {
+				return
+			}
+			attrs := []attribute.KeyValue{
+				semconv.DBSystemMongoDB,
+				semconv.DBOperationName(e.CommandName),
+				semconv.DBNamespace(e.DatabaseName),
+			}
+			if coll, ok := e.Command.Lookup(e.CommandName).StringValueOK(); ok {
+				attrs = append(attrs, semconv.DBCollectionName(coll))
+			}
+			_, span := Tracer().Start(ctx, "mongodb."+e.CommandName,
+				trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attrs...))
+			mu.Lock()
+			spans[e.RequestID] = span
+			mu.Unlock()
+		},
+		Succeeded: func(_ context.Context, e *event.CommandSucceededEvent) {
+			finish(e.RequestID, nil)
+		},
+		Failed: func(ctx context.Context, e *event.CommandFailedEvent) {
+			finish(e.RequestID, fmt.Errorf("%s", e.Failure))
+			if failed != nil {
+				failed(ctx, e)
+			}
+		},
+	}
+}
@@ -0,0 +1,167 @@
+package transform
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// Data classes used by the built-in DLP rules.
+const (
+	DataClassPCI = "PCI"
+	DataClassPII = "PII"
+)
+
+// DLPMode controls what happens when a payload contains unapproved data.
+type DLPMode string
+
+const (
+	DLPModeOff   DLPMode = "off"
+	DLPModeFlag  DLPMode = "flag"  // record findings, let the request through
+	DLPModeBlock DLPMode = "block" // record findings and reject the request
+)
+
+// ParseDLPMode validates a mode name. An empty name yields off.
+func ParseDLPMode(name string) (DLPMode, error) {
+	switch mode := DLPMode(strings.ToLower(name)); mode {
+	case "", DLPModeOff:
+		return DLPModeOff, nil
+	case DLPModeFlag, DLPModeBlock:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("unsupported DLP mode %q", name)
+	}
+}
+
+// DLPRule detects one kind of sensitive data.
+type DLPRule struct {
+	Name    string `json:"name"`
+	Class   string `json:"class"`
+	Pattern string `json:"pattern"`
+	Luhn    bool   `json:"luhn,omitempty"` // only count matches with a valid Luhn check digit
+
+	re *regexp.Regexp
+}
+
+// DLPFinding reports how often a rule matched. Matched content is never included.
+type DLPFinding struct {
+	Rule     string `json:"rule"`
+	Class    string `json:"class"`
+	Count    int    `json:"count"`
+	Approved bool   `json:"approved"` // the alias is approved for this class
+}
+
+// DefaultDLPRules is the built-in ruleset.
+func DefaultDLPRules() []DLPRule {
+	return []DLPRule{
+		{Name: "card-number", Class: DataClassPCI, Pattern: `\b(?:\d[ -]?){12,18}\d\b`, Luhn: true},
+		{Name: "us-ssn", Class: DataClassPII, Pattern: `\b\d{3}-\d{2}-\d{4}\b`},
+		{Name: "email", Class: DataClassPII, Pattern: `\b[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}\b`},
+	}
+}
+
+// LoadDLPRules reads a JSON array of rules from path.
+func LoadDLPRules(path string) ([]DLPRule, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read DLP rules: %w", err)
+	}
+	var rules []DLPRule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("failed to parse DLP rules: %w", err)
+	}
+	return rules, nil
+}
+
+// DLPScanner inspects plaintext against a ruleset.
+type DLPScanner struct {
+	Mode  DLPMode
+	rules []DLPRule
+}
+
+// NewDLPScanner compiles rules. It returns nil when mode is off.
+func NewDLPScanner(mode DLPMode, rules []DLPRule) (*DLPScanner, error) {
+	if mode == DLPModeOff {
+		return nil, nil
+	}
+	compiled := make([]DLPRule, len(rules))
+	for i, rule := range rules {
+		if rule.Name == "" || rule.Class == "" {
+			return nil, fmt.Errorf("DLP rule %d needs a name and a class", i)
+		}
+		re, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("DLP rule %s: %w", rule.Name, err)
+		}
+		rule.re = re
+		compiled[i] = rule
+	}
+	return &DLPScanner{Mode: mode, rules: compiled}, nil
+}
+
+// Scan returns a finding per matching rule. approved lists the data classes allowed for the key.
+func (d *DLPScanner) Scan(plaintext []byte, approved []string) []DLPFinding {
+	var findings []DLPFinding
+	for _, rule := range d.rules {
+		count := 0
+		for _, m := range rule.re.FindAll(plaintext, -1) {
+			if !rule.Luhn || luhnValid(m) {
+				count++
+			}
+		}
+		if count > 0 {
+			findings = append(findings, DLPFinding{
+				Rule:     rule.Name,
+				Class:    rule.Class,
+				Count:    count,
+				Approved: containsFold(approved, rule.Class),
+			})
+		}
+	}
+	return findings
+}
+
+// Blocks reports whether findings should reject the payload.
+func (d *DLPScanner) Blocks(findings []DLPFinding) bool {
+	if d.Mode != DLPModeBlock {
+		return false
+	}
+	for _, f := range findings {
+		if !f.Approved {
+			return true
+		}
+	}
+	return false
+}
+
+// luhnValid checks the Luhn digit of the digits in s, ignoring separators.
+func luhnValid(s []byte) bool {
+	sum, n := 0, 0
+	for i := len(s) - 1; i >= 0; i-- {
+		c := s[i]
+		if c < '0' || c > '9' {
+			continue
+		}
+		d := int(c - '0')
+		if n%2 == 1 {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		n++
+	}
+	return n >= 13 && sum%10 == 0
+}
+
+func containsFold(list []string, v string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, v) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,139 @@
+// Package transform lets deployments hook into the payload path: transformers run on
+// plaintext before it is encrypted and after it is decrypted, and are enabled per alias.
+// It also holds the DLP scanner that inspects plaintext for sensitive data classes.
+package transform
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Info describes the operation a transformer is being applied to.
+type Info struct {
+	Tenant   string
+	Identity string
+	Alias    string
+	DEKID    string
+}
+
+// Transformer inspects or rewrites plaintext. Returning an error rejects the request.
+type Transformer interface {
+	// Name is the identifier used in alias configuration.
+	Name() string
+	// BeforeEncrypt runs on the caller's plaintext before encryption.
+	BeforeEncrypt(ctx context.Context, info Info, plaintext []byte) ([]byte, error)
+	// AfterDecrypt runs on decrypted plaintext before it is returned.
+	AfterDecrypt(ctx context.Context, info Info, plaintext []byte) ([]byte, error)
+}
+
+// Registry holds the transformers available to aliases.
+type Registry struct {
+	mu           sync.RWMutex
+	transformers map[string]Transformer
+}
+
+// NewRegistry returns a registry containing the built-in transformers.
+func NewRegistry() *Registry {
+	r := &Registry{transformers: make(map[string]Transformer)}
+	r.MustRegister(JSONCompact{})
+	return r
+}
+
+// Register adds a transformer. Names must be unique.
+func (r *Registry) Register(t Transformer) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, exists := r.transformers[t.Name()]; exists {
+		return fmt.Errorf("transformer %q already registered", t.Name())
+	}
+	r.transformers[t.Name()] = t
+	return nil
+}
+
+// MustRegister is Register for use during startup.
+func (r *Registry) MustRegister(t Transformer) {
+	if err := r.Register(t); err != nil {
+		panic(err)
+	}
+}
+
+// Names lists registered transformers in sorted order.
+func (r *Registry) Names() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	names := make([]string, 0, len(r.transformers))
+	for n := range r.transformers {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Validate reports the first name that is not registered.
+func (r *Registry) Validate(names []string) error {
+	_, err := r.lookup(names)
+	return err
+}
+
+func (r *Registry) lookup(names []string) ([]Transformer, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	chain := make([]Transformer, 0, len(names))
+	for _, n := range names {
+		t, ok := r.transformers[n]
+		if !ok {
+			return nil, fmt.Errorf("unknown transformer %q", n)
+		}
+		chain = append(chain, t)
+	}
+	return chain, nil
+}
+
+// BeforeEncrypt applies the named transformers in order.
+func (r *Registry) BeforeEncrypt(ctx context.Context, names []string, info Info, plaintext []byte) ([]byte, error) {
+	chain, err := r.lookup(names)
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range chain {
+		if plaintext, err = t.BeforeEncrypt(ctx, info, plaintext); err != nil {
+			return nil, fmt.Errorf("transformer %s: %w", t.Name(), err)
+		}
+	}
+	return plaintext, nil
+}
+
+// AfterDecrypt applies the named transformers in reverse order, undoing BeforeEncrypt.
+func (r *Registry) AfterDecrypt(ctx context.Context, names []string, info Info, plaintext []byte) ([]byte, error) {
+	chain, err := r.lookup(names)
+	if err != nil {
+		return nil, err
+	}
+	for i := len(chain) - 1; i >= 0; i-- {
+		if plaintext, err = chain[i].AfterDecrypt(ctx, info, plaintext); err != nil {
+			return nil, fmt.Errorf("transformer %s: %w", chain[i].Name(), err)
+		}
+	}
+	return plaintext, nil
+}
+
+// JSONCompact strips insignificant whitespace from JSON payloads before encryption.
+type JSONCompact struct{}
+
+func (JSONCompact) Name() string { return "json-compact" }
+
+func (JSONCompact) BeforeEncrypt(_ context.Context, _ Info, plaintext []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, plaintext); err != nil {
+		return nil, fmt.Errorf("payload is not valid JSON: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+func (JSONCompact) AfterDecrypt(_ context.Context, _ Info, plaintext []byte) ([]byte, error) {
+	return plaintext, nil
+}
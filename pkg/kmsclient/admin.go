@@ -0,0 +1,257 @@
+package kmsclient
+
+import (
+	"context"
+	"encoding/json"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// KeyMetadata describes a DEK as /describe-key and /list-data-keys report it.
+type KeyMetadata struct {
+	DEKID       string            `json:"dekID"`
+	MasterKeyID string            `json:"masterKeyID"`
+	TenantID    string            `json:"tenantID,omitempty"`
+	State       string            `json:"state"`
+	Algorithm   string            `json:"algorithm"`
+	Origin      string            `json:"origin"`
+	PublicKey   []byte            `json:"publicKey,omitempty"` // HPKE key pairs only
+	OwnerUID    string            `json:"ownerUID,omitempty"`
+	Description string            `json:"description,omitempty"`
+	Tags        map[string]string `json:"tags,omitempty"`
+	CreatedBy   string            `json:"createdBy,omitempty"`
+	CreatedAt   *time.Time        `json:"createdAt,omitempty"`
+	LastUsedAt  *time.Time        `json:"lastUsedAt,omitempty"`
+
+	DeprecatedAt     *time.Time `json:"deprecatedAt,omitempty"`
+	SunsetAt         *time.Time `json:"sunsetAt,omitempty"`
+	ReplacementDEKID string     `json:"replacementDEKID,omitempty"`
+}
+
+// ListDataKeysInput filters a key listing; every field is optional.
+type ListDataKeysInput struct {
+	MasterKeyID string            `json:"masterKeyID,omitempty"`
+	OwnerUID    string            `json:"ownerUID,omitempty"`
+	State       string            `json:"state,omitempty"`
+	Tags        map[string]string `json:"tags,omitempty"` // every tag must match
+	Limit       int               `json:"limit,omitempty"`
+	Cursor      string            `json:"cursor,omitempty"` // NextCursor of the previous page
+}
+
+type DataKeyList struct {
+	Keys       []KeyMetadata `json:"keys"`
+	NextCursor string        `json:"nextCursor,omitempty"` // empty on the last page
+}
+
+// ListDataKeys returns one page of the caller's DEKs.
+func (c *Client) ListDataKeys(ctx context.Context, in ListDataKeysInput) (*DataKeyList, error) {
+	var out DataKeyList
+	if err := c.call(ctx, "/list-data-keys", in, &out, true); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// Rotation is the outcome of RotateMasterKey. With dual control on, the first call
+// only records the request: PendingApproval is set and a second identity must make
+// the same call before ExpiresAt.
+type Rotation struct {
+	NewMasterKeyID  string    `json:"newMasterKeyID,omitempty"`
+	PendingApproval bool      `json:"pendingApproval,omitempty"`
+	RequestedBy     string    `json:"requestedBy,omitempty"`
+	ExpiresAt       time.Time `json:"expiresAt,omitempty"`
+}
+
+// RotateMasterKey makes a new master key active. It is not retried on network errors
+// unless ctx carries WithIdempotencyKey.
+func (c *Client) RotateMasterKey(ctx context.Context) (*Rotation, error) {
+	var out Rotation
+	if err := c.call(ctx, "/rotate-master-key", struct{}{}, &out, false); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// MasterKey describes a master key, never its material. State is ACTIVE,
+// DECRYPT_ONLY or RETIRED. WrapMode is AES_256_GCM or MLKEM768_AES_256_GCM, and empty
+// once the key is retired.
+type MasterKey struct {
+	ID        string     `json:"id"`
+	Active    bool       `json:"active"`
+	State     string     `json:"state"`
+	WrapMode  string     `json:"wrapMode,omitempty"`
+	CreatedAt *time.Time `json:"createdAt,omitempty"`
+	RetiredAt *time.Time `json:"retiredAt,omitempty"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+}
+
+// ListMasterKeys returns every master key the server knows, retired ones included.
+func (c *Client) ListMasterKeys(ctx context.Context) ([]MasterKey, error) {
+	var out struct {
+		Keys []MasterKey `json:"keys"`
+	}
+	if err := c.get(ctx, "/list-master-keys", nil, &out); err != nil {
+		return nil, err
+	}
+	return out.Keys, nil
+}
+
+// Retirement is the outcome of RetireMasterKey. With dual control on it may only
+// record the request, as for Rotation.
+type Retirement struct {
+	MasterKey
+	PendingApproval bool   `json:"pendingApproval,omitempty"`
+	RequestedBy     string `json:"requestedBy,omitempty"`
+}
+
+// RetireMasterKey destroys a DECRYPT_ONLY master key that nothing depends on any
+// more. It is not retried on network errors.
+func (c *Client) RetireMasterKey(ctx context.Context, masterKeyID string) (*Retirement, error) {
+	var out Retirement
+	in := struct {
+		MasterKeyID string `json:"masterKeyID"`
+	}{masterKeyID}
+	if err := c.call(ctx, "/retire-master-key", in, &out, false); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// Backup is the outcome of Backup: the sealed backup for kms-restore in Data or, with
+// dual control on, a pending approval as for Rotation.
+type Backup struct {
+	Data            []byte    `json:"-"`
+	PendingApproval bool      `json:"pendingApproval,omitempty"`
+	RequestedBy     string    `json:"requestedBy,omitempty"`
+	ExpiresAt       time.Time `json:"expiresAt,omitempty"`
+}
+
+// Backup takes a disaster-recovery backup of the key hierarchy, readable only with the
+// server's recovery private key. It is not retried on network errors.
+func (c *Client) Backup(ctx context.Context) (*Backup, error) {
+	var raw json.RawMessage
+	if err := c.call(ctx, "/backup", struct{}{}, &raw, false); err != nil {
+		return nil, err
+	}
+	var out Backup
+	if err := json.Unmarshal(raw, &out); err != nil {
+		return nil, err
+	}
+	if !out.PendingApproval {
+		out.Data = raw
+	}
+	return &out, nil
+}
+
+// SealStatus reports whether a server started with SEAL_TYPE=shamir holds its master
+// keys, and how many unseal shares it has so far.
+type SealStatus struct {
+	Sealed    bool `json:"sealed"`
+	Threshold int  `json:"threshold"`
+	Shares    int  `json:"shares"`
+	Progress  int  `json:"progress"`
+}
+
+// SealStatus returns the server's seal state. It needs no credentials.
+func (c *Client) SealStatus(ctx context.Context) (*SealStatus, error) {
+	var out SealStatus
+	if err := c.get(ctx, "/seal-status", nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// Unseal submits one unseal share. It needs no credentials.
+func (c *Client) Unseal(ctx context.Context, share []byte) (*SealStatus, error) {
+	var out SealStatus
+	in := struct {
+		Share []byte `json:"share"`
+	}{share}
+	if err := c.call(ctx, "/unseal", in, &out, false); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// ResetUnseal discards the unseal shares submitted so far.
+func (c *Client) ResetUnseal(ctx context.Context) (*SealStatus, error) {
+	var out SealStatus
+	if err := c.call(ctx, "/unseal", struct {
+		Reset bool `json:"reset"`
+	}{true}, &out, true); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// Seal makes the server drop its master keys until it is unsealed again.
+func (c *Client) Seal(ctx context.Context) (*SealStatus, error) {
+	var out SealStatus
+	if err := c.call(ctx, "/seal", struct{}{}, &out, true); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// AuditQuery filters audit events; every field is optional.
+type AuditQuery struct {
+	Identity  string
+	Action    string
+	KeyID     string
+	Result    string
+	RequestID string
+	Tenant    string // only for callers outside any tenant
+	Since     time.Time
+	Until     time.Time
+	Limit     int
+}
+
+type AuditEvent struct {
+	ID                string            `json:"id"`
+	Time              time.Time         `json:"time"`
+	RequestID         string            `json:"requestID,omitempty"`
+	Identity          string            `json:"identity,omitempty"`
+	Role              string            `json:"role,omitempty"`
+	TenantID          string            `json:"tenantID,omitempty"`
+	Action            string            `json:"action"`
+	KeyID             string            `json:"keyID,omitempty"`
+	Result            string            `json:"result"`
+	Status            int               `json:"status,omitempty"`
+	EncryptionContext map[string]string `json:"encryptionContext,omitempty"`
+	RemoteAddr        string            `json:"remoteAddr,omitempty"`
+	Details           []string          `json:"details,omitempty"`
+}
+
+// AuditEvents returns matching audit events, newest first.
+func (c *Client) AuditEvents(ctx context.Context, q AuditQuery) ([]AuditEvent, error) {
+	query := url.Values{}
+	for k, v := range map[string]string{
+		"identity":  q.Identity,
+		"action":    q.Action,
+		"keyID":     q.KeyID,
+		"result":    q.Result,
+		"requestID": q.RequestID,
+		"tenant":    q.Tenant,
+	} {
+		if v != "" {
+			query.Set(k, v)
+		}
+	}
+	if !q.Since.IsZero() {
+		query.Set("since", q.Since.UTC().Format(time.RFC3339))
+	}
+	if !q.Until.IsZero() {
+		query.Set("until", q.Until.UTC().Format(time.RFC3339))
+	}
+	if q.Limit > 0 {
+		query.Set("limit", strconv.Itoa(q.Limit))
+	}
+	var out struct {
+		Events []AuditEvent `json:"events"`
+	}
+	if err := c.get(ctx, "/audit-logs", query, &out); err != nil {
+		return nil, err
+	}
+	return out.Events, nil
+}
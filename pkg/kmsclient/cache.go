@@ -0,0 +1,136 @@
+package kmsclient
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// CachePolicy bounds how long envelope data keys are reused. Reusing a data key for
+// several envelopes saves a KMS call per SealEnvelope, and remembering unwrapped keys
+// saves one per OpenEnvelope, at the cost of keeping plaintext keys in memory; the
+// KMS then also sees, and audits, fewer calls.
+type CachePolicy struct {
+	MaxAge      time.Duration // how long a key is used or remembered
+	MaxMessages int           // envelopes sealed with one data key; 0 means no limit
+	MaxEntries  int           // keys held per direction; 0 means 1000
+}
+
+const defaultCacheEntries = 1000
+
+type cachedKey struct {
+	plaintext []byte
+	wrapped   []byte
+	created   time.Time
+	uses      int
+}
+
+// keyCache keeps encryption keys by KMS key and context, and decryption keys by
+// wrapped key as well. Keys are handed out shared, so they are only cleared by Close.
+type keyCache struct {
+	policy CachePolicy
+
+	mu      sync.Mutex
+	encrypt map[string]*cachedKey
+	decrypt map[string]*cachedKey
+}
+
+func newKeyCache(p CachePolicy) *keyCache {
+	if p.MaxEntries <= 0 {
+		p.MaxEntries = defaultCacheEntries
+	}
+	return &keyCache{policy: p, encrypt: map[string]*cachedKey{}, decrypt: map[string]*cachedKey{}}
+}
+
+func (kc *keyCache) forEncrypt(keyID string, encCtx map[string]string) *cachedKey {
+	kc.mu.Lock()
+	defer kc.mu.Unlock()
+	id := cacheID(keyID, nil, encCtx)
+	dk := kc.encrypt[id]
+	if dk == nil {
+		return nil
+	}
+	if kc.expired(dk) || (kc.policy.MaxMessages > 0 && dk.uses >= kc.policy.MaxMessages) {
+		delete(kc.encrypt, id)
+		return nil
+	}
+	dk.uses++
+	return dk
+}
+
+func (kc *keyCache) putEncrypt(keyID string, encCtx map[string]string, dk *cachedKey) {
+	kc.mu.Lock()
+	defer kc.mu.Unlock()
+	dk.created, dk.uses = time.Now(), 1
+	kc.put(kc.encrypt, cacheID(keyID, nil, encCtx), dk)
+}
+
+func (kc *keyCache) forDecrypt(keyID string, wrapped []byte, encCtx map[string]string) []byte {
+	kc.mu.Lock()
+	defer kc.mu.Unlock()
+	id := cacheID(keyID, wrapped, encCtx)
+	dk := kc.decrypt[id]
+	if dk == nil {
+		return nil
+	}
+	if kc.expired(dk) {
+		delete(kc.decrypt, id)
+		return nil
+	}
+	return dk.plaintext
+}
+
+func (kc *keyCache) putDecrypt(keyID string, wrapped []byte, encCtx map[string]string, key []byte) {
+	kc.mu.Lock()
+	defer kc.mu.Unlock()
+	kc.put(kc.decrypt, cacheID(keyID, wrapped, encCtx), &cachedKey{plaintext: key, wrapped: wrapped, created: time.Now()})
+}
+
+// put stores dk, first dropping expired entries and then the oldest if m is full.
+func (kc *keyCache) put(m map[string]*cachedKey, id string, dk *cachedKey) {
+	if len(m) >= kc.policy.MaxEntries {
+		var oldestID string
+		var oldest time.Time
+		for k, v := range m {
+			if kc.expired(v) {
+				delete(m, k)
+				continue
+			}
+			if oldestID == "" || v.created.Before(oldest) {
+				oldestID, oldest = k, v.created
+			}
+		}
+		if len(m) >= kc.policy.MaxEntries {
+			delete(m, oldestID)
+		}
+	}
+	m[id] = dk
+}
+
+func (kc *keyCache) expired(dk *cachedKey) bool {
+	return kc.policy.MaxAge > 0 && time.Since(dk.created) > kc.policy.MaxAge
+}
+
+func (kc *keyCache) purge() {
+	kc.mu.Lock()
+	defer kc.mu.Unlock()
+	for _, m := range []map[string]*cachedKey{kc.encrypt, kc.decrypt} {
+		for id, dk := range m {
+			clear(dk.plaintext)
+			delete(m, id)
+		}
+	}
+}
+
+func cacheID(keyID string, wrapped []byte, encCtx map[string]string) string {
+	ctx, _ := json.Marshal(encCtx)
+	h := sha256.New()
+	h.Write([]byte(keyID))
+	h.Write([]byte{0})
+	h.Write(wrapped)
+	h.Write([]byte{0})
+	h.Write(ctx)
+	return hex.EncodeToString(h.Sum(nil))
+}
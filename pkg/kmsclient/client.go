@@ -0,0 +1,203 @@
+// Package kmsclient is the Go client for the KMS HTTP API. It wraps the JSON
+// endpoints in typed methods, retries throttled and unavailable calls, and adds
+// client-side envelope encryption with optional local caching of data keys.
+//
+//	c, err := kmsclient.New("https://kms:8443", kmsclient.WithTokenSource(idToken))
+//	ct, err := c.Encrypt(ctx, kmsclient.EncryptInput{KeyID: dekID, Plaintext: data})
+//	pt, err := c.Decrypt(ctx, kmsclient.DecryptInput{KeyID: dekID, Ciphertext: ct})
+package kmsclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Version is reported to the server in the X-KMS-Client header.
+const Version = "0.1.0"
+
+const (
+	// apiPrefix is the API version this client speaks.
+	apiPrefix = "/v1"
+
+	clientHeader    = "X-KMS-Client"
+	apiKeyHeader    = "X-API-Key"
+	requestIDHeader = "X-Request-ID"
+
+	idempotencyKeyHeader = "Idempotency-Key"
+
+	// maxErrorBody bounds how much of an error response is kept as the message.
+	maxErrorBody = 4 << 10
+)
+
+// TokenSource returns a bearer token (a Firebase ID token) for each request.
+type TokenSource func(ctx context.Context) (string, error)
+
+// Client calls one KMS server. It is safe for concurrent use.
+type Client struct {
+	baseURL    string
+	httpClient *http.Client
+	token      TokenSource
+	apiKey     string
+	retry      RetryPolicy
+	cache      *keyCache // nil unless WithDataKeyCache is given
+}
+
+// Option configures a Client.
+type Option func(*Client)
+
+// WithHTTPClient sets the HTTP client, e.g. one with a custom TLS configuration or
+// client certificate.
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Client) { c.httpClient = hc }
+}
+
+// WithTokenSource authenticates every request with a bearer token.
+func WithTokenSource(ts TokenSource) Option {
+	return func(c *Client) { c.token = ts }
+}
+
+// WithAPIKey authenticates every request with an API key.
+func WithAPIKey(key string) Option {
+	return func(c *Client) { c.apiKey = key }
+}
+
+// WithRetry replaces DefaultRetryPolicy.
+func WithRetry(p RetryPolicy) Option {
+	return func(c *Client) { c.retry = p }
+}
+
+// WithDataKeyCache enables local caching of envelope data keys; see CachePolicy.
+func WithDataKeyCache(p CachePolicy) Option {
+	return func(c *Client) { c.cache = newKeyCache(p) }
+}
+
+// New creates a client for the server at baseURL.
+func New(baseURL string, opts ...Option) (*Client, error) {
+	if !strings.HasPrefix(baseURL, "https://") && !strings.HasPrefix(baseURL, "http://") {
+		return nil, fmt.Errorf("base URL %q must start with https:// or http://", baseURL)
+	}
+	c := &Client{
+		baseURL:    strings.TrimRight(baseURL, "/"),
+		httpClient: &http.Client{Timeout: 30 * time.Second},
+		retry:      DefaultRetryPolicy,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if c.retry.MaxAttempts < 1 {
+		return nil, errors.New("retry policy needs at least one attempt")
+	}
+	return c, nil
+}
+
+type idempotencyKeyContext struct{}
+
+// WithIdempotencyKey returns a context whose calls send key, any unique string such as
+// a UUID, as an Idempotency-Key. The server then runs /generate-data-key,
+// /rotate-master-key and /delete-data-key once however often they are sent, so with a
+// key GenerateDataKey and RotateMasterKey are retried on network errors too. Reuse the key only to retry the same call; a 409 means the
+// first attempt is still running. The server needs MongoDB for this and otherwise
+// ignores the key.
+func WithIdempotencyKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, idempotencyKeyContext{}, key)
+}
+
+// Close discards cached data keys.
+func (c *Client) Close() {
+	if c.cache != nil {
+		c.cache.purge()
+	}
+}
+
+// APIError is a non-2xx response from the server.
+type APIError struct {
+	StatusCode int
+	Message    string
+	RequestID  string        // the server's X-Request-ID, for support requests
+	RetryAfter time.Duration // from Retry-After, on 429 and 503
+}
+
+func (e *APIError) Error() string {
+	if e.RequestID != "" {
+		return fmt.Sprintf("kms: %d %s (request %s)", e.StatusCode, e.Message, e.RequestID)
+	}
+	return fmt.Sprintf("kms: %d %s", e.StatusCode, e.Message)
+}
+
+// call POSTs in as JSON to path and decodes the response into out. Calls that are
+// safe to repeat are retried on network errors as well as on throttling.
+func (c *Client) call(ctx context.Context, path string, in, out interface{}, idempotent bool) error {
+	body, err := json.Marshal(in)
+	if err != nil {
+		return fmt.Errorf("failed to encode request: %w", err)
+	}
+	return c.send(ctx, http.MethodPost, path, body, out, idempotent)
+}
+
+// get GETs path with query and decodes the response into out.
+func (c *Client) get(ctx context.Context, path string, query url.Values, out interface{}) error {
+	if len(query) > 0 {
+		path += "?" + query.Encode()
+	}
+	return c.send(ctx, http.MethodGet, path, nil, out, true)
+}
+
+func (c *Client) send(ctx context.Context, method, path string, body []byte, out interface{}, idempotent bool) error {
+	idempotencyKey, _ := ctx.Value(idempotencyKeyContext{}).(string)
+	if idempotencyKey != "" {
+		idempotent = true
+	}
+	return c.retry.do(ctx, idempotent, func() error {
+		req, err := http.NewRequestWithContext(ctx, method, c.baseURL+apiPrefix+path, bytes.NewReader(body))
+		if err != nil {
+			return permanent(err)
+		}
+		if body != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		req.Header.Set(clientHeader, "kms-go/"+Version)
+		if idempotencyKey != "" {
+			req.Header.Set(idempotencyKeyHeader, idempotencyKey)
+		}
+		if c.apiKey != "" {
+			req.Header.Set(apiKeyHeader, c.apiKey)
+		}
+		if c.token != nil {
+			token, err := c.token(ctx)
+			if err != nil {
+				return permanent(fmt.Errorf("failed to get token: %w", err))
+			}
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+
+		resp, err := c.httpClient.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			msg, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+			return &APIError{
+				StatusCode: resp.StatusCode,
+				Message:    strings.TrimSpace(string(msg)),
+				RequestID:  resp.Header.Get(requestIDHeader),
+				RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+			}
+		}
+		if out == nil {
+			return nil
+		}
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return permanent(fmt.Errorf("failed to decode %s response: %w", path, err))
+		}
+		return nil
+	})
+}
@@ -0,0 +1,190 @@
+package kmsclient
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Envelope encryption: SealEnvelope encrypts data locally with a fresh AES-256-GCM
+// data key and has the KMS encrypt only that key, so payloads of any size cost one
+// small KMS call (or none, with WithDataKeyCache) and never leave the process.
+
+const (
+	envelopeVersion = 1
+	dataKeySize     = 32
+)
+
+// Envelope is a locally encrypted payload with its KMS-wrapped data key. It marshals
+// to JSON for storage.
+type Envelope struct {
+	Version           int               `json:"v"`
+	KeyID             string            `json:"keyID"`      // the KMS DEK that wraps the data key
+	WrappedKey        []byte            `json:"wrappedKey"` // KMS ciphertext of the data key
+	Ciphertext        []byte            `json:"ciphertext"` // nonce + AES-256-GCM ciphertext
+	EncryptionContext map[string]string `json:"encryptionContext,omitempty"`
+}
+
+// SealEnvelope encrypts plaintext under a data key wrapped by the KMS key keyID. The
+// encryption context is bound to both the wrapped key and the payload.
+func (c *Client) SealEnvelope(ctx context.Context, keyID string, plaintext []byte, encCtx map[string]string) (*Envelope, error) {
+	if keyID == "" {
+		return nil, errors.New("a key ID is required")
+	}
+	dk, err := c.encryptionKey(ctx, keyID, encCtx)
+	if err != nil {
+		return nil, err
+	}
+	env := &Envelope{Version: envelopeVersion, KeyID: keyID, WrappedKey: dk.wrapped, EncryptionContext: encCtx}
+	if err := env.seal(dk.plaintext, plaintext); err != nil {
+		return nil, err
+	}
+	return env, nil
+}
+
+// OpenEnvelope decrypts an envelope from SealEnvelope.
+func (c *Client) OpenEnvelope(ctx context.Context, env *Envelope) ([]byte, error) {
+	if env.Version != envelopeVersion {
+		return nil, fmt.Errorf("unsupported envelope version %d", env.Version)
+	}
+	key, err := c.decryptionKey(ctx, env)
+	if err != nil {
+		return nil, err
+	}
+	return env.open(key)
+}
+
+// RewrapEnvelope moves an envelope to the KMS key newKeyID by rewrapping its data
+// key. The payload keeps its data key; it is only sealed again because the key ID is
+// part of its AAD.
+func (c *Client) RewrapEnvelope(ctx context.Context, env *Envelope, newKeyID string) (*Envelope, error) {
+	if env.Version != envelopeVersion {
+		return nil, fmt.Errorf("unsupported envelope version %d", env.Version)
+	}
+	if newKeyID == "" {
+		return nil, errors.New("a key ID is required")
+	}
+	key, err := c.decryptionKey(ctx, env)
+	if err != nil {
+		return nil, err
+	}
+	pt, err := env.open(key)
+	if err != nil {
+		return nil, err
+	}
+	defer clear(pt)
+
+	wrapped, err := c.Encrypt(ctx, EncryptInput{KeyID: newKeyID, Plaintext: key, EncryptionContext: env.EncryptionContext})
+	if err != nil {
+		return nil, err
+	}
+	out := &Envelope{Version: envelopeVersion, KeyID: newKeyID, WrappedKey: wrapped, EncryptionContext: env.EncryptionContext}
+	if err := out.seal(key, pt); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// encryptionKey returns a data key for sealing: a cached one while the cache allows,
+// otherwise a new one wrapped by the KMS.
+func (c *Client) encryptionKey(ctx context.Context, keyID string, encCtx map[string]string) (*cachedKey, error) {
+	if c.cache != nil {
+		if dk := c.cache.forEncrypt(keyID, encCtx); dk != nil {
+			return dk, nil
+		}
+	}
+	key := make([]byte, dataKeySize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, fmt.Errorf("failed to generate data key: %w", err)
+	}
+	wrapped, err := c.Encrypt(ctx, EncryptInput{KeyID: keyID, Plaintext: key, EncryptionContext: encCtx})
+	if err != nil {
+		clear(key)
+		return nil, err
+	}
+	dk := &cachedKey{plaintext: key, wrapped: wrapped}
+	if c.cache != nil {
+		c.cache.putEncrypt(keyID, encCtx, dk)
+	}
+	return dk, nil
+}
+
+// decryptionKey unwraps an envelope's data key, from the cache when it has it.
+func (c *Client) decryptionKey(ctx context.Context, env *Envelope) ([]byte, error) {
+	if c.cache != nil {
+		if key := c.cache.forDecrypt(env.KeyID, env.WrappedKey, env.EncryptionContext); key != nil {
+			return key, nil
+		}
+	}
+	key, err := c.Decrypt(ctx, DecryptInput{KeyID: env.KeyID, Ciphertext: env.WrappedKey, EncryptionContext: env.EncryptionContext})
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != dataKeySize {
+		return nil, errors.New("envelope data key has the wrong size")
+	}
+	if c.cache != nil {
+		c.cache.putDecrypt(env.KeyID, env.WrappedKey, env.EncryptionContext, key)
+	}
+	return key, nil
+}
+
+func (e *Envelope) seal(key, plaintext []byte) error {
+	aad, err := e.aad()
+	if err != nil {
+		return err
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	e.Ciphertext = gcm.Seal(nonce, nonce, plaintext, aad)
+	return nil
+}
+
+func (e *Envelope) open(key []byte) ([]byte, error) {
+	aad, err := e.aad()
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(e.Ciphertext) < gcm.NonceSize() {
+		return nil, errors.New("envelope ciphertext too short")
+	}
+	nonce, ct := e.Ciphertext[:gcm.NonceSize()], e.Ciphertext[gcm.NonceSize():]
+	pt, err := gcm.Open(nil, nonce, ct, aad)
+	if err != nil {
+		return nil, errors.New("failed to decrypt envelope")
+	}
+	return pt, nil
+}
+
+// aad binds the payload to the key ID and encryption context. encoding/json sorts map
+// keys, so equal contexts always give equal AAD.
+func (e *Envelope) aad() ([]byte, error) {
+	ctx, err := json.Marshal(e.EncryptionContext)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode encryption context: %w", err)
+	}
+	return append([]byte(fmt.Sprintf("kmsclient envelope v%d\x00%s\x00", e.Version, e.KeyID)), ctx...), nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create AES cipher: %w", err)
+	}
+	return cipher.NewGCM(block)
+}
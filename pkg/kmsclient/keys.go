@@ -0,0 +1,266 @@
+package kmsclient
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+)
+
+// DataKey describes a DEK created on the server. Its key material never leaves it.
+type DataKey struct {
+	ID          string `json:"dekID"`
+	MasterKeyID string `json:"masterKeyID"`
+	Algorithm   string `json:"algorithm"`
+	PublicKey   []byte `json:"publicKey,omitempty"` // X25519, HPKE key pairs only
+}
+
+type GenerateDataKeyInput struct {
+	Algorithm   string            `json:"algorithm,omitempty"` // defaults to AES_256_GCM on the server
+	Description string            `json:"description,omitempty"`
+	Tags        map[string]string `json:"tags,omitempty"`
+}
+
+// GenerateDataKey creates a DEK. It is not retried on network errors, which could
+// leave a second, unused key behind, unless ctx carries WithIdempotencyKey.
+func (c *Client) GenerateDataKey(ctx context.Context, in GenerateDataKeyInput) (*DataKey, error) {
+	var out DataKey
+	if err := c.call(ctx, "/generate-data-key", in, &out, false); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// EncryptInput names the key by KeyID or Alias.
+type EncryptInput struct {
+	KeyID             string
+	Alias             string
+	Plaintext         []byte
+	EncryptionContext map[string]string
+	Deterministic     bool // required, and only accepted, for AES_256_SIV keys
+}
+
+type encryptRequest struct {
+	DEKID             string            `json:"dekID,omitempty"`
+	Alias             string            `json:"alias,omitempty"`
+	Plaintext         []byte            `json:"plaintext"`
+	Deterministic     bool              `json:"deterministic,omitempty"`
+	EncryptionContext map[string]string `json:"encryptionContext,omitempty"`
+}
+
+type encryptResponse struct {
+	Ciphertext string `json:"ciphertext"`
+}
+
+// Encrypt encrypts plaintext on the server and returns the raw ciphertext.
+func (c *Client) Encrypt(ctx context.Context, in EncryptInput) ([]byte, error) {
+	if err := checkKey(in.KeyID, in.Alias); err != nil {
+		return nil, err
+	}
+	if in.Plaintext == nil {
+		in.Plaintext = []byte{}
+	}
+	var out encryptResponse
+	req := encryptRequest{DEKID: in.KeyID, Alias: in.Alias, Plaintext: in.Plaintext, Deterministic: in.Deterministic, EncryptionContext: in.EncryptionContext}
+	if err := c.call(ctx, "/encrypt", req, &out, true); err != nil {
+		return nil, err
+	}
+	ct, err := base64.StdEncoding.DecodeString(out.Ciphertext)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode ciphertext: %w", err)
+	}
+	return ct, nil
+}
+
+// DecryptInput names the key the ciphertext was encrypted with and repeats its
+// encryption context.
+type DecryptInput struct {
+	KeyID             string
+	Alias             string
+	Ciphertext        []byte
+	EncryptionContext map[string]string
+}
+
+type decryptRequest struct {
+	DEKID             string            `json:"dekID,omitempty"`
+	Alias             string            `json:"alias,omitempty"`
+	Ciphertext        string            `json:"ciphertext"`
+	PlaintextEncoding string            `json:"plaintextEncoding"`
+	EncryptionContext map[string]string `json:"encryptionContext,omitempty"`
+}
+
+type decryptResponse struct {
+	Plaintext []byte `json:"plaintext"`
+}
+
+// Decrypt decrypts a ciphertext from Encrypt.
+func (c *Client) Decrypt(ctx context.Context, in DecryptInput) ([]byte, error) {
+	if err := checkKey(in.KeyID, in.Alias); err != nil {
+		return nil, err
+	}
+	var out decryptResponse
+	req := decryptRequest{
+		DEKID:             in.KeyID,
+		Alias:             in.Alias,
+		Ciphertext:        base64.StdEncoding.EncodeToString(in.Ciphertext),
+		PlaintextEncoding: "base64",
+		EncryptionContext: in.EncryptionContext,
+	}
+	if err := c.call(ctx, "/decrypt", req, &out, true); err != nil {
+		return nil, err
+	}
+	if out.Plaintext == nil {
+		out.Plaintext = []byte{}
+	}
+	return out.Plaintext, nil
+}
+
+// RewrapInput moves a ciphertext from one key, or encryption context, to another.
+type RewrapInput struct {
+	Ciphertext []byte
+
+	SourceKeyID             string
+	SourceEncryptionContext map[string]string
+
+	DestinationKeyID             string
+	DestinationEncryptionContext map[string]string
+}
+
+type reEncryptRequest struct {
+	SourceDEKID                  string            `json:"sourceDEKID"`
+	Ciphertext                   string            `json:"ciphertext"`
+	SourceEncryptionContext      map[string]string `json:"sourceEncryptionContext,omitempty"`
+	DestinationDEKID             string            `json:"destinationDEKID"`
+	DestinationEncryptionContext map[string]string `json:"destinationEncryptionContext,omitempty"`
+}
+
+// Rewrap has the server decrypt a ciphertext and encrypt it again under the destination
+// key (/re-encrypt); the plaintext never reaches this process. For envelopes use
+// RewrapEnvelope, which only rewraps the data key.
+func (c *Client) Rewrap(ctx context.Context, in RewrapInput) ([]byte, error) {
+	if in.SourceKeyID == "" || in.DestinationKeyID == "" {
+		return nil, errors.New("rewrap needs a source and a destination key")
+	}
+	var out encryptResponse
+	req := reEncryptRequest{
+		SourceDEKID:                  in.SourceKeyID,
+		Ciphertext:                   base64.StdEncoding.EncodeToString(in.Ciphertext),
+		SourceEncryptionContext:      in.SourceEncryptionContext,
+		DestinationDEKID:             in.DestinationKeyID,
+		DestinationEncryptionContext: in.DestinationEncryptionContext,
+	}
+	if err := c.call(ctx, "/re-encrypt", req, &out, true); err != nil {
+		return nil, err
+	}
+	ct, err := base64.StdEncoding.DecodeString(out.Ciphertext)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode ciphertext: %w", err)
+	}
+	return ct, nil
+}
+
+func checkKey(keyID, alias string) error {
+	switch {
+	case keyID == "" && alias == "":
+		return errors.New("a key ID or alias is required")
+	case keyID != "" && alias != "":
+		return errors.New("give a key ID or an alias, not both")
+	}
+	return nil
+}
+
+// HPKEPublicKey returns the X25519 public key of an HPKE key pair. Senders seal to it
+// with any RFC 9180 library, suite DHKEM(X25519, HKDF-SHA256), HKDF-SHA256, AES-256-GCM.
+func (c *Client) HPKEPublicKey(ctx context.Context, keyID, alias string) ([]byte, error) {
+	if err := checkKey(keyID, alias); err != nil {
+		return nil, err
+	}
+	var out struct {
+		PublicKey []byte `json:"publicKey"`
+	}
+	req := hpkeKeyRequest{DEKID: keyID, Alias: alias}
+	if err := c.call(ctx, "/hpke/public-key", req, &out, true); err != nil {
+		return nil, err
+	}
+	return out.PublicKey, nil
+}
+
+// HPKEOpenInput is a message sealed to an HPKE key pair. Enc may be left empty when
+// Ciphertext starts with the encapsulated key.
+type HPKEOpenInput struct {
+	KeyID      string
+	Alias      string
+	Enc        []byte
+	Ciphertext []byte
+	Info       []byte
+	AAD        []byte
+}
+
+type hpkeKeyRequest struct {
+	DEKID string `json:"dekID,omitempty"`
+	Alias string `json:"alias,omitempty"`
+}
+
+type hpkeOpenRequest struct {
+	hpkeKeyRequest
+	Enc        []byte `json:"enc,omitempty"`
+	Ciphertext []byte `json:"ciphertext"`
+	Info       []byte `json:"info,omitempty"`
+	AAD        []byte `json:"aad,omitempty"`
+}
+
+// HPKEOpen has the server open an HPKE message with the key pair's private key.
+func (c *Client) HPKEOpen(ctx context.Context, in HPKEOpenInput) ([]byte, error) {
+	if err := checkKey(in.KeyID, in.Alias); err != nil {
+		return nil, err
+	}
+	var out decryptResponse
+	req := hpkeOpenRequest{
+		hpkeKeyRequest: hpkeKeyRequest{DEKID: in.KeyID, Alias: in.Alias},
+		Enc:            in.Enc,
+		Ciphertext:     in.Ciphertext,
+		Info:           in.Info,
+		AAD:            in.AAD,
+	}
+	if err := c.call(ctx, "/hpke/open", req, &out, true); err != nil {
+		return nil, err
+	}
+	if out.Plaintext == nil {
+		out.Plaintext = []byte{}
+	}
+	return out.Plaintext, nil
+}
+
+// DeriveKeyInput asks for the key derived from an HKDF_SHA256 root secret under Info,
+// which names its purpose, and Salt. Size defaults to 32 bytes on the server.
+type DeriveKeyInput struct {
+	KeyID string
+	Alias string
+	Info  []byte
+	Salt  []byte
+	Size  int
+}
+
+type deriveKeyRequest struct {
+	DEKID string `json:"dekID,omitempty"`
+	Alias string `json:"alias,omitempty"`
+	Info  []byte `json:"info"`
+	Salt  []byte `json:"salt,omitempty"`
+	Size  int    `json:"size,omitempty"`
+}
+
+// DeriveKey returns a key derived on the server with HKDF-SHA256. The same root, info
+// and salt always give the same key, so callers need not store it.
+func (c *Client) DeriveKey(ctx context.Context, in DeriveKeyInput) ([]byte, error) {
+	if err := checkKey(in.KeyID, in.Alias); err != nil {
+		return nil, err
+	}
+	var out struct {
+		Key []byte `json:"key"`
+	}
+	req := deriveKeyRequest{DEKID: in.KeyID, Alias: in.Alias, Info: in.Info, Salt: in.Salt, Size: in.Size}
+	if err := c.call(ctx, "/derive-key", req, &out, true); err != nil {
+		return nil, err
+	}
+	return out.Key, nil
+}
@@ -0,0 +1,100 @@
+package kmsclient
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// RetryPolicy controls retries of throttled (429) and unavailable (502, 503, 504)
+// calls, and of network errors for calls that are safe to repeat. Waits grow
+// exponentially from BaseDelay with jitter, capped at MaxDelay; a Retry-After longer
+// than MaxDelay, such as an exhausted daily quota, is returned as an error instead.
+type RetryPolicy struct {
+	MaxAttempts int // including the first; 1 disables retries
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+}
+
+// DefaultRetryPolicy tries each call up to three times over about a second.
+var DefaultRetryPolicy = RetryPolicy{MaxAttempts: 3, BaseDelay: 200 * time.Millisecond, MaxDelay: 2 * time.Second}
+
+// permanentError marks an error that no retry can fix.
+type permanentError struct{ err error }
+
+func (e permanentError) Error() string { return e.err.Error() }
+func (e permanentError) Unwrap() error { return e.err }
+
+func permanent(err error) error { return permanentError{err} }
+
+func (p RetryPolicy) do(ctx context.Context, idempotent bool, attempt func() error) error {
+	var err error
+	for n := 1; ; n++ {
+		if err = attempt(); err == nil {
+			return nil
+		}
+		wait, ok := p.retryable(err, idempotent, n)
+		if !ok || n >= p.MaxAttempts {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+	var perm permanentError
+	if errors.As(err, &perm) {
+		return perm.err
+	}
+	return err
+}
+
+// retryable reports whether err is worth another attempt, and after how long.
+func (p RetryPolicy) retryable(err error, idempotent bool, n int) (time.Duration, bool) {
+	var perm permanentError
+	if errors.As(err, &perm) || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return 0, false
+	}
+	backoff := p.BaseDelay << (n - 1)
+	if backoff <= 0 || backoff > p.MaxDelay {
+		backoff = p.MaxDelay
+	}
+	backoff = backoff/2 + rand.N(backoff/2+1)
+
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) {
+		// A network error may come after the server acted on the call.
+		return backoff, idempotent
+	}
+	switch apiErr.StatusCode {
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+		// Both are answered before the call takes effect.
+	case http.StatusBadGateway, http.StatusGatewayTimeout:
+		if !idempotent {
+			return 0, false
+		}
+	default:
+		return 0, false
+	}
+	if apiErr.RetryAfter > p.MaxDelay {
+		return 0, false
+	}
+	return max(backoff, apiErr.RetryAfter), true
+}
+
+func parseRetryAfter(v string) time.Duration {
+	if v == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(v); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return max(0, time.Until(t))
+	}
+	return 0
+}